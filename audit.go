@@ -0,0 +1,656 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oferchen/inventory/internal/logging"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// AuditLog appends one JSON line per mutation to a file, synced after each
+// entry so a crash cannot lose the last record.
+type AuditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	user    string
+	command string
+}
+
+// auditRecord is one line of the audit log. Before and After are the host's
+// data; Before is null for a create and After is null for a remove.
+type auditRecord struct {
+	Time          time.Time              `json:"time"`
+	User          string                 `json:"user"`
+	Command       string                 `json:"command,omitempty"`
+	Operation     string                 `json:"operation"`
+	Host          string                 `json:"host"`
+	FieldsChanged []string               `json:"fields_changed"`
+	Before        map[string]interface{} `json:"before"`
+	After         map[string]interface{} `json:"after"`
+}
+
+// OpenAuditLog opens (or creates) the audit file for appending. command is
+// the subcommand recorded with each entry.
+func OpenAuditLog(path, command string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return &AuditLog{file: f, user: name, command: command}, nil
+}
+
+// record logs a write. Failing to audit is fatal: the change has already
+// been made, and carrying on would leave it unrecorded.
+func (a *AuditLog) record(w hostWrite) {
+	rec := auditRecord{
+		Time:      time.Now().UTC(),
+		User:      a.user,
+		Command:   a.command,
+		Operation: w.operation,
+		Host:      w.host,
+		Before:    auditData(w.before),
+		After:     auditData(w.after),
+	}
+	rec.FieldsChanged = ChangedFields(rec.Before, rec.After)
+	line, err := json.Marshal(rec)
+	if err != nil {
+		logging.Fatalf("Error writing audit log: %v", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		logging.Fatalf("Error writing audit log: %v", err)
+	}
+	if err := a.file.Sync(); err != nil {
+		logging.Fatalf("Error syncing audit log: %v", err)
+	}
+}
+
+func auditData(value []byte) map[string]interface{} {
+	if value == nil {
+		return nil
+	}
+	// Secret fields stay sealed, so audit entries never hold them in
+	// the clear.
+	host, err := decodeStoredHost(value)
+	if err != nil {
+		return map[string]interface{}{"$malformed": string(value)}
+	}
+	if host.Data == nil {
+		host.Data = make(map[string]interface{})
+	}
+	return EncodeBinaryValues(host.Data)
+}
+
+// ChangedFields returns the sorted top-level fields that differ.
+func ChangedFields(before, after map[string]interface{}) []string {
+	changed := make([]string, 0)
+	for field, value := range before {
+		if other, ok := after[field]; !ok || !reflect.DeepEqual(value, other) {
+			changed = append(changed, field)
+		}
+	}
+	for field := range after {
+		if _, ok := before[field]; !ok {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// hostWrite is one successful write of a host's key: its value before and
+// after (nil if the key did not exist or was deleted), and the revision
+// the write created.
+type hostWrite struct {
+	operation     string // "put" or "delete"
+	host          string
+	before, after []byte
+	revision      int64
+}
+
+// recordKV wraps a KV to pass every successful write to record, for the
+// audit log and OnMutation. Puts and deletes ask for the previous value;
+// transactions read the previous values of the keys they write in the same
+// transaction.
+type recordKV struct {
+	clientv3.KV
+	record   func(hostWrite)
+	hostName func(key string) string
+}
+
+func (kv recordKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	resp, err := kv.KV.Put(ctx, key, val, append(opts, clientv3.WithPrevKV())...)
+	if err != nil {
+		return resp, err
+	}
+	var before []byte
+	if resp.PrevKv != nil {
+		before = resp.PrevKv.Value
+	}
+	kv.record(hostWrite{"put", kv.hostName(key), before, []byte(val), resp.Header.Revision})
+	return resp, nil
+}
+
+func (kv recordKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	resp, err := kv.KV.Delete(ctx, key, append(opts, clientv3.WithPrevKV())...)
+	if err != nil {
+		return resp, err
+	}
+	for _, prev := range resp.PrevKvs {
+		kv.record(hostWrite{"delete", kv.hostName(string(prev.Key)), prev.Value, nil, resp.Header.Revision})
+	}
+	return resp, nil
+}
+
+func (kv recordKV) Txn(ctx context.Context) clientv3.Txn {
+	return &recordTxn{Txn: kv.KV.Txn(ctx), kv: kv}
+}
+
+type recordTxn struct {
+	clientv3.Txn
+	kv        recordKV
+	then, els []clientv3.Op
+}
+
+func (t *recordTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.Txn = t.Txn.If(cs...)
+	return t
+}
+
+// Then and Else prefix the branch with a get of every key it writes; the
+// builder is only run at Commit so each branch is prefixed once.
+func (t *recordTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.then = append(t.then, ops...)
+	return t
+}
+
+func (t *recordTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.els = append(t.els, ops...)
+	return t
+}
+
+func (t *recordTxn) Commit() (*clientv3.TxnResponse, error) {
+	then, thenGets := withPrevGets(t.then)
+	els, elsGets := withPrevGets(t.els)
+	resp, err := t.Txn.Then(then...).Else(els...).Commit()
+	if err != nil {
+		return resp, err
+	}
+	ops, gets := t.then, thenGets
+	if !resp.Succeeded {
+		ops, gets = t.els, elsGets
+	}
+	// Report only the caller's own responses, without the added gets.
+	prevs := resp.Responses[:len(gets)]
+	resp.Responses = resp.Responses[len(gets):]
+	for n, op := range ops {
+		get, ok := gets[n]
+		if !ok {
+			continue
+		}
+		var before []byte
+		if kvs := prevs[get].GetResponseRange().Kvs; len(kvs) > 0 {
+			before = kvs[0].Value
+		}
+		switch {
+		case op.IsPut():
+			t.kv.record(hostWrite{"put", t.kv.hostName(string(op.KeyBytes())), before, op.ValueBytes(), resp.Header.Revision})
+		case op.IsDelete() && before != nil:
+			t.kv.record(hostWrite{"delete", t.kv.hostName(string(op.KeyBytes())), before, nil, resp.Header.Revision})
+		}
+	}
+	return resp, nil
+}
+
+// withPrevGets returns ops preceded by a get of the key of each put and
+// delete among them, so the responses start with those keys' values before
+// the branch ran, and the index of each of those gets by the index of its
+// op. Reads get none, so a transaction of gets fits the same --max-txn-ops
+// with the hooks as without.
+func withPrevGets(ops []clientv3.Op) ([]clientv3.Op, map[int]int) {
+	gets := make(map[int]int)
+	var all []clientv3.Op
+	for n, op := range ops {
+		if op.IsPut() || op.IsDelete() {
+			gets[n] = len(all)
+			all = append(all, clientv3.OpGet(string(op.KeyBytes())))
+		}
+	}
+	return append(all, ops...), gets
+}
+
+// EnableAudit records every write the Inventory makes in a.
+func (i *Inventory) EnableAudit(a *AuditLog) {
+	i.kv = recordKV{KV: i.kv, record: a.record, hostName: i.hostNameFromKey}
+}
+
+// Mutation is one write made through the Inventory, as reported to the
+// function given to OnMutation.
+type Mutation struct {
+	// Operation is "put" or "delete".
+	Operation string
+	Host      string
+	// Created is set for a put of a host that did not exist.
+	Created bool
+	// Revision is the etcd revision the write created.
+	Revision      int64
+	FieldsChanged []string
+}
+
+// OnMutation calls fn after every successful write the Inventory makes,
+// in the order they are made, so callers can report exactly what a command
+// changed.
+func (i *Inventory) OnMutation(fn func(Mutation)) {
+	i.kv = recordKV{KV: i.kv, hostName: i.hostNameFromKey, record: func(w hostWrite) {
+		fn(Mutation{
+			Operation:     w.operation,
+			Host:          w.host,
+			Created:       w.operation == "put" && w.before == nil,
+			Revision:      w.revision,
+			FieldsChanged: ChangedFields(auditData(w.before), auditData(w.after)),
+		})
+	}}
+}
+
+// auditKey prefixes the audit entries written by EnableAuditEntries, keyed
+// by the time of the change and the host, so they sort by time.
+const auditKey = "/audit/"
+
+// AuditEntry is one host change recorded under /audit/. Before and After
+// are the host's data; Before is null for a create and After is null for a
+// remove.
+type AuditEntry struct {
+	Time          time.Time              `json:"time"`
+	Actor         string                 `json:"actor"`
+	Command       string                 `json:"command,omitempty"`
+	Operation     string                 `json:"operation"` // create, update or remove
+	Host          string                 `json:"host"`
+	FieldsChanged []string               `json:"fields_changed"`
+	Before        map[string]interface{} `json:"before"`
+	After         map[string]interface{} `json:"after"`
+	// RenamedFrom is set on the create of a renamed host, and RenamedTo on
+	// the remove of its old name; see RenameHost.
+	RenamedFrom string `json:"renamed_from,omitempty"`
+	RenamedTo   string `json:"renamed_to,omitempty"`
+	// Revision is the etcd revision of the change, filled in when the entry
+	// is read.
+	Revision int64 `json:"revision,omitempty"`
+}
+
+// EnableAuditEntries writes an AuditEntry under /audit/ for every create,
+// update and remove of a host, in the same transaction as the change, so
+// no change lands without its entry. actor and command are recorded with
+// each entry. To learn the value it replaces, each write reads the host
+// first and is then made only if the host is still at that revision,
+// retrying like a compare-and-swap update when it is not. Call it after
+// EnableReauth and before EnableCache, EnableAudit and OnMutation.
+func (i *Inventory) EnableAuditEntries(actor, command string) {
+	i.kv = auditKV{KV: i.kv, inv: i, actor: actor, command: command}
+}
+
+// auditKV wraps a KV to add an audit entry to every single-key write of a
+// host; see EnableAuditEntries. Other keys pass through.
+type auditKV struct {
+	clientv3.KV
+	inv            *Inventory
+	actor, command string
+}
+
+// entryOp returns the put of the audit entry for a write of key from
+// before to after (nil for a missing or deleted host). renamed is the key
+// of the host's other name when the write is half of a rename, else "".
+func (kv auditKV) entryOp(key string, before, after []byte, renamed string) (clientv3.Op, error) {
+	name := kv.inv.hostNameFromKey(key)
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		Actor:     kv.actor,
+		Command:   kv.command,
+		Operation: "update",
+		Host:      name,
+		Before:    auditData(before),
+		After:     auditData(after),
+	}
+	switch {
+	case before == nil:
+		entry.Operation = "create"
+	case after == nil:
+		entry.Operation = "remove"
+	}
+	if renamed != "" {
+		if before == nil {
+			entry.RenamedFrom = kv.inv.hostNameFromKey(renamed)
+		} else {
+			entry.RenamedTo = kv.inv.hostNameFromKey(renamed)
+		}
+	}
+	entry.FieldsChanged = ChangedFields(entry.Before, entry.After)
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return clientv3.Op{}, err
+	}
+	return clientv3.OpPut(auditEntryKey(entry.Time, name), string(value)), nil
+}
+
+// auditEntryKey is the key of the entry for a change of host at t.
+func auditEntryKey(t time.Time, host string) string {
+	return fmt.Sprintf("%s%019d/%s", auditKey, t.UnixNano(), url.PathEscape(host))
+}
+
+// renamedKeys returns the other key of each of the two keys of a branch
+// that creates one host and removes another, which only RenameHost
+// writes, and nil for any other branch.
+func renamedKeys(ops []clientv3.Op, current map[string][]byte) map[string]string {
+	var created, removed []string
+	for _, op := range ops {
+		key := string(op.KeyBytes())
+		switch {
+		case !auditedKey(op):
+		case op.IsPut() && current[key] == nil:
+			created = append(created, key)
+		case op.IsDelete() && current[key] != nil:
+			removed = append(removed, key)
+		default:
+			return nil
+		}
+	}
+	if len(created) != 1 || len(removed) != 1 {
+		return nil
+	}
+	return map[string]string{created[0]: removed[0], removed[0]: created[0]}
+}
+
+// auditedKey reports whether a write of op is audited: a put or a
+// single-key delete of a host.
+func auditedKey(op clientv3.Op) bool {
+	return (op.IsPut() || op.IsDelete()) && len(op.RangeBytes()) == 0 && strings.HasPrefix(string(op.KeyBytes()), baseKey)
+}
+
+func (kv auditKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	op := clientv3.OpPut(key, val, opts...)
+	if !auditedKey(op) {
+		return kv.KV.Put(ctx, key, val, opts...)
+	}
+	resp, err := kv.commit(ctx, nil, []clientv3.Op{op}, nil)
+	if err != nil {
+		return nil, err
+	}
+	put := resp.Responses[0].GetResponsePut()
+	put.Header = resp.Header
+	return (*clientv3.PutResponse)(put), nil
+}
+
+func (kv auditKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	op := clientv3.OpDelete(key, opts...)
+	if !auditedKey(op) {
+		return kv.KV.Delete(ctx, key, opts...)
+	}
+	resp, err := kv.commit(ctx, nil, []clientv3.Op{op}, nil)
+	if err != nil {
+		return nil, err
+	}
+	deleted := resp.Responses[0].GetResponseDeleteRange()
+	deleted.Header = resp.Header
+	return (*clientv3.DeleteResponse)(deleted), nil
+}
+
+func (kv auditKV) Txn(ctx context.Context) clientv3.Txn {
+	return &auditTxn{ctx: ctx, kv: kv}
+}
+
+// auditTxn collects a transaction for auditKV.commit.
+type auditTxn struct {
+	ctx       context.Context
+	kv        auditKV
+	cmps      []clientv3.Cmp
+	then, els []clientv3.Op
+}
+
+func (t *auditTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *auditTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.then = append(t.then, ops...)
+	return t
+}
+
+func (t *auditTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.els = append(t.els, ops...)
+	return t
+}
+
+func (t *auditTxn) Commit() (*clientv3.TxnResponse, error) {
+	return t.kv.commit(t.ctx, t.cmps, t.then, t.els)
+}
+
+// commit runs the transaction cmps, then, els with an audit entry added to
+// each branch for every host it writes. The hosts are read first, and the
+// transaction runs nested in one that checks they are still at the
+// revisions read, so the entries record the values actually replaced. The
+// response is the nested transaction's, without the entries' puts.
+func (kv auditKV) commit(ctx context.Context, cmps []clientv3.Cmp, then, els []clientv3.Op) (*clientv3.TxnResponse, error) {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, op := range append(append([]clientv3.Op(nil), then...), els...) {
+		if key := string(op.KeyBytes()); auditedKey(op) && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return kv.KV.Txn(ctx).If(cmps...).Then(then...).Else(els...).Commit()
+	}
+	gets := make([]clientv3.Op, len(keys))
+	for n, key := range keys {
+		gets[n] = clientv3.OpGet(key)
+	}
+	for attempt := 1; ; attempt++ {
+		read, err := kv.KV.Txn(ctx).Then(gets...).Commit()
+		if err != nil {
+			return nil, err
+		}
+		current := make(map[string][]byte, len(keys))
+		guards := make([]clientv3.Cmp, len(keys))
+		for n, key := range keys {
+			revision := int64(0)
+			if kvs := read.Responses[n].GetResponseRange().Kvs; len(kvs) > 0 {
+				current[key], revision = kvs[0].Value, kvs[0].ModRevision
+			}
+			guards[n] = clientv3.Compare(clientv3.ModRevision(key), "=", revision)
+		}
+		audited := func(ops []clientv3.Op) ([]clientv3.Op, error) {
+			all := append([]clientv3.Op(nil), ops...)
+			renamed := renamedKeys(ops, current)
+			for _, op := range ops {
+				key := string(op.KeyBytes())
+				if !auditedKey(op) || (op.IsDelete() && current[key] == nil) {
+					continue
+				}
+				var after []byte
+				if op.IsPut() {
+					after = op.ValueBytes()
+				}
+				entry, err := kv.entryOp(key, current[key], after, renamed[key])
+				if err != nil {
+					return nil, err
+				}
+				all = append(all, entry)
+			}
+			return all, nil
+		}
+		auditedThen, err := audited(then)
+		if err != nil {
+			return nil, err
+		}
+		auditedElse, err := audited(els)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := kv.KV.Txn(ctx).If(guards...).Then(clientv3.OpTxn(cmps, auditedThen, auditedElse)).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			nested := resp.Responses[0].GetResponseTxn()
+			ops := then
+			if !nested.Succeeded {
+				ops = els
+			}
+			return &clientv3.TxnResponse{Header: resp.Header, Succeeded: nested.Succeeded, Responses: nested.Responses[:len(ops)]}, nil
+		}
+		if attempt == maxModifyAttempts {
+			return nil, fmt.Errorf("%w: %s", ErrHostChanged, kv.inv.hostNameFromKey(keys[0]))
+		}
+	}
+}
+
+// AuditQuery selects audit entries. Zero fields select everything.
+type AuditQuery struct {
+	// Since and Until bound the time of the change, inclusively.
+	Since, Until time.Time
+	Host         string
+	Actor        string
+	// Limit is the most entries returned, the newest.
+	Limit int
+}
+
+// auditPageSize is the number of entries read per request by AuditEntries.
+const auditPageSize = 500
+
+// AuditEntries returns the audit entries selected by q, newest first.
+// Entries that cannot be decoded are skipped with a warning. With q.Host,
+// the entries of the names the host had before a rename are included.
+func (i *Inventory) AuditEntries(q AuditQuery) ([]AuditEntry, error) {
+	names := map[string]bool{q.Host: true}
+	start, end := auditKey, clientv3.GetPrefixRangeEnd(auditKey)
+	if !q.Since.IsZero() {
+		start = fmt.Sprintf("%s%019d", auditKey, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		end = fmt.Sprintf("%s%019d", auditKey, q.Until.UnixNano()+1)
+	}
+	var entries []AuditEntry
+	for start < end {
+		ctx, cancel := i.requestContext()
+		resp, err := i.kv.Get(ctx, start, i.readOpts(clientv3.WithRange(end), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend), clientv3.WithLimit(auditPageSize))...)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			var entry AuditEntry
+			if err := json.Unmarshal(kv.Value, &entry); err != nil {
+				logging.Warnf("skipping malformed audit entry %s: %v", kv.Key, err)
+				continue
+			}
+			if q.Host != "" && !names[entry.Host] {
+				continue
+			}
+			if q.Host != "" && entry.RenamedFrom != "" {
+				// Older entries are read later, so the old name is
+				// followed from here on.
+				names[entry.RenamedFrom] = true
+			}
+			if q.Actor != "" && entry.Actor != q.Actor {
+				continue
+			}
+			entry.Revision = kv.ModRevision
+			entries = append(entries, entry)
+			if q.Limit > 0 && len(entries) == q.Limit {
+				return entries, nil
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		end = string(resp.Kvs[len(resp.Kvs)-1].Key)
+	}
+	return entries, nil
+}
+
+// ErrRevisionCompacted is returned when a requested revision is older than
+// etcd's compaction point. etcd keeps prior versions only until it
+// compacts, so how far back GetHostAt and HostHistory reach depends on the
+// cluster's --auto-compaction-mode and --auto-compaction-retention.
+var ErrRevisionCompacted = errors.New("revision has been compacted")
+
+// HostVersion is a host as stored by one write.
+type HostVersion struct {
+	Host Host
+	// Revision is the etcd revision of the write.
+	Revision int64
+	// Version counts the writes to the host since it was created, from 1.
+	Version int64
+}
+
+// GetHostAt returns the host as it was at etcd revision rev, or as it is
+// now if rev is 0.
+func (i *Inventory) GetHostAt(hostName string, rev int64) (HostVersion, error) {
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Get(ctx, i.hostKey(hostName), i.readOpts(clientv3.WithRev(rev))...)
+	if errors.Is(err, rpctypes.ErrCompacted) {
+		return HostVersion{}, fmt.Errorf("%w: %d", ErrRevisionCompacted, rev)
+	}
+	if err != nil {
+		return HostVersion{}, err
+	}
+	if len(resp.Kvs) == 0 && rev == 0 {
+		return HostVersion{}, fmt.Errorf("%w: %s", ErrHostNotFound, hostName)
+	}
+	if len(resp.Kvs) == 0 {
+		return HostVersion{}, fmt.Errorf("%w at revision %d: %s", ErrHostNotFound, rev, hostName)
+	}
+	kv := resp.Kvs[0]
+	host, err := i.unmarshalHost(kv.Value)
+	if err != nil {
+		return HostVersion{}, err
+	}
+	return HostVersion{Host: host, Revision: kv.ModRevision, Version: kv.Version}, nil
+}
+
+// HostHistory returns up to limit (0 for all) versions of the host,
+// newest first, by reading it at the revision before each write until it
+// did not exist. Only the host's current life is covered: a host deleted
+// and created again starts a new history. complete is false when the walk
+// stopped at etcd's compaction point or at limit, before the host's
+// creation.
+func (i *Inventory) HostHistory(hostName string, limit int) (versions []HostVersion, complete bool, err error) {
+	// Revision 0 reads the current version.
+	rev := int64(0)
+	for limit == 0 || len(versions) < limit {
+		version, err := i.GetHostAt(hostName, rev)
+		switch {
+		case errors.Is(err, ErrRevisionCompacted):
+			return versions, false, nil
+		case errors.Is(err, ErrHostNotFound) && rev != 0:
+			return versions, true, nil
+		case err != nil:
+			return versions, false, err
+		}
+		versions = append(versions, version)
+		if version.Version <= 1 {
+			return versions, true, nil
+		}
+		rev = version.Revision - 1
+	}
+	return versions, false, nil
+}
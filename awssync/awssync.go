@@ -0,0 +1,176 @@
+// Package awssync discovers AWS EC2 instances as inventory hosts, for
+// Inventory.SyncHosts. Each instance becomes a host named by its Name tag,
+// or by its instance ID if it has none or shares it with another instance,
+// with these fields:
+//
+//	instance_id, instance_type, state, arch, image (the AMI),
+//	availability_zone, vpc_id, subnet_id, launch_time
+//	ipaddr (the private IP address), public_ip, private_dns, public_dns
+//	tags (an object of all its tags)
+//
+// Fields an instance has no value for, such as public_ip once it is
+// stopped, are removed from its host. Terminated instances are left out,
+// so their hosts are pruned.
+package awssync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/oferchen/inventory"
+)
+
+// DefaultNameTag is the tag naming the host of an instance.
+const DefaultNameTag = "Name"
+
+// liveStates are the instance states discovered; only terminated is not.
+var liveStates = []string{"pending", "running", "shutting-down", "stopping", "stopped"}
+
+// Provider discovers the EC2 instances of one region. It implements
+// inventory.SyncProvider.
+type Provider struct {
+	// Tags keeps only the instances with all these tag values.
+	Tags map[string]string
+	// NameTag is the tag naming hosts, DefaultNameTag if empty.
+	NameTag string
+
+	client *ec2.Client
+	region string
+}
+
+// New returns a provider for region, or for the region of the default
+// AWS configuration (AWS_REGION, or that of the profile) if it is empty.
+// Credentials come from the default chain: the environment, the shared
+// files and the instance role.
+func New(ctx context.Context, region string) (*Provider, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("loading the AWS configuration: %w", err)
+	}
+	if cfg.Region == "" {
+		return nil, errors.New("no AWS region configured: set AWS_REGION or pass a region")
+	}
+	return &Provider{client: ec2.NewFromConfig(cfg), region: cfg.Region}, nil
+}
+
+// Source is "aws/" followed by the region and the tag filters, as in
+// "aws/us-east-1/env=prod,role=web".
+func (p *Provider) Source() string {
+	source := "aws/" + p.region
+	if len(p.Tags) > 0 {
+		source += "/" + strings.Join(p.tagFilters(), ",")
+	}
+	return source
+}
+
+// tagFilters returns the Tags as key=value, sorted.
+func (p *Provider) tagFilters() []string {
+	filters := make([]string, 0, len(p.Tags))
+	for key, value := range p.Tags {
+		filters = append(filters, key+"="+value)
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+// Discover lists the instances that are not terminated and have the Tags.
+func (p *Provider) Discover(ctx context.Context) ([]inventory.Host, error) {
+	filters := []types.Filter{{Name: aws.String("instance-state-name"), Values: liveStates}}
+	for key, value := range p.Tags {
+		filters = append(filters, types.Filter{Name: aws.String("tag:" + key), Values: []string{value}})
+	}
+	var instances []types.Instance
+	pages := ec2.NewDescribeInstancesPaginator(p.client, &ec2.DescribeInstancesInput{Filters: filters})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing instances in %s: %w", p.region, err)
+		}
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+	}
+	nameTag := p.NameTag
+	if nameTag == "" {
+		nameTag = DefaultNameTag
+	}
+	names := make([]string, len(instances))
+	uses := make(map[string]int)
+	for n, instance := range instances {
+		names[n] = tagValue(instance.Tags, nameTag)
+		uses[names[n]]++
+	}
+	hosts := make([]inventory.Host, len(instances))
+	for n, instance := range instances {
+		name := names[n]
+		if name == "" || uses[name] > 1 {
+			name = aws.ToString(instance.InstanceId)
+		}
+		hosts[n] = inventory.Host{Name: name, Data: instanceData(instance)}
+	}
+	return hosts, nil
+}
+
+// tagValue returns the value of the tag key, or "" without it.
+func tagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
+
+// instanceData maps an instance to host fields, nil for those it has no
+// value for.
+func instanceData(instance types.Instance) map[string]interface{} {
+	data := map[string]interface{}{
+		"instance_id":       optional(aws.ToString(instance.InstanceId)),
+		"instance_type":     optional(string(instance.InstanceType)),
+		"arch":              optional(string(instance.Architecture)),
+		"image":             optional(aws.ToString(instance.ImageId)),
+		"vpc_id":            optional(aws.ToString(instance.VpcId)),
+		"subnet_id":         optional(aws.ToString(instance.SubnetId)),
+		"ipaddr":            optional(aws.ToString(instance.PrivateIpAddress)),
+		"public_ip":         optional(aws.ToString(instance.PublicIpAddress)),
+		"private_dns":       optional(aws.ToString(instance.PrivateDnsName)),
+		"public_dns":        optional(aws.ToString(instance.PublicDnsName)),
+		"state":             nil,
+		"availability_zone": nil,
+		"launch_time":       nil,
+		"tags":              nil,
+	}
+	if instance.State != nil {
+		data["state"] = optional(string(instance.State.Name))
+	}
+	if instance.Placement != nil {
+		data["availability_zone"] = optional(aws.ToString(instance.Placement.AvailabilityZone))
+	}
+	if instance.LaunchTime != nil {
+		data["launch_time"] = instance.LaunchTime.UTC().Format(time.RFC3339)
+	}
+	if len(instance.Tags) > 0 {
+		tags := make(map[string]interface{}, len(instance.Tags))
+		for _, tag := range instance.Tags {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+		data["tags"] = tags
+	}
+	return data
+}
+
+// optional returns s, or nil if it is empty.
+func optional(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
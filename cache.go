@@ -0,0 +1,403 @@
+package inventory
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oferchen/inventory/internal/logging"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// hostCache is a bounded LRU of raw host values with a TTL. Values are kept
+// encoded so every hit decodes a private copy the caller may modify.
+type hostCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	value   []byte
+	fetched time.Time
+}
+
+func newHostCache(size int, ttl time.Duration) *hostCache {
+	return &hostCache{size: size, ttl: ttl, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *hostCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Since(entry.fetched) > c.ttl {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *hostCache) put(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &cacheEntry{key: key, value: value, fetched: time.Now()}
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value, fetched: time.Now()})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *hostCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// cacheKV wraps a KV to drop the cached value of every key it writes.
+type cacheKV struct {
+	clientv3.KV
+	cache *hostCache
+}
+
+func (kv cacheKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	defer kv.cache.invalidate(key)
+	return kv.KV.Put(ctx, key, val, opts...)
+}
+
+func (kv cacheKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	defer kv.cache.invalidate(key)
+	resp, err := kv.KV.Delete(ctx, key, append(opts, clientv3.WithPrevKV())...)
+	if err == nil {
+		for _, prev := range resp.PrevKvs {
+			kv.cache.invalidate(string(prev.Key))
+		}
+	}
+	return resp, err
+}
+
+func (kv cacheKV) Txn(ctx context.Context) clientv3.Txn {
+	return &cacheTxn{Txn: kv.KV.Txn(ctx), cache: kv.cache}
+}
+
+type cacheTxn struct {
+	clientv3.Txn
+	cache *hostCache
+	keys  []string
+}
+
+func (t *cacheTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.Txn = t.Txn.If(cs...)
+	return t
+}
+
+func (t *cacheTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.Txn = t.Txn.Then(ops...)
+	t.addKeys(ops)
+	return t
+}
+
+func (t *cacheTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.Txn = t.Txn.Else(ops...)
+	t.addKeys(ops)
+	return t
+}
+
+func (t *cacheTxn) addKeys(ops []clientv3.Op) {
+	for _, op := range ops {
+		if op.IsPut() || op.IsDelete() {
+			t.keys = append(t.keys, string(op.KeyBytes()))
+		}
+	}
+}
+
+func (t *cacheTxn) Commit() (*clientv3.TxnResponse, error) {
+	defer func() {
+		for _, key := range t.keys {
+			t.cache.invalidate(key)
+		}
+	}()
+	return t.Txn.Commit()
+}
+
+// EnableCache makes GetHost read through an LRU of up to size hosts, each
+// trusted for ttl. Writes made through this Inventory invalidate their keys,
+// but changes by other clients are only seen once an entry expires, so
+// reads become eventually consistent. With watch, a background watch also
+// invalidates keys changed elsewhere until ctx is done.
+func (i *Inventory) EnableCache(ctx context.Context, size int, ttl time.Duration, watch bool) {
+	i.cache = newHostCache(size, ttl)
+	i.kv = cacheKV{KV: i.kv, cache: i.cache}
+	if !watch {
+		return
+	}
+	go func() {
+		err := i.WatchHosts(ctx, 0, func(event HostEvent) error {
+			i.cache.invalidate(i.hostKey(event.Name))
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			logging.Warnf("cache watch stopped, entries now only expire by TTL: %v", err)
+		}
+	}()
+}
+
+// LocalCacheVersion is the format version of the files written by
+// EnableLocalCache and LocalCache.Watch.
+const LocalCacheVersion = 1
+
+// localCacheFile is a local cache on disk: the stored values of the hosts
+// of the inventory at Namespace by key at Revision, and when they were last
+// checked against etcd.
+type localCacheFile struct {
+	Version   int               `json:"version"`
+	Namespace string            `json:"namespace,omitempty"`
+	Revision  int64             `json:"revision"`
+	Checked   time.Time         `json:"checked"`
+	Keys      map[string][]byte `json:"keys"`
+}
+
+// LocalCacheOptions control how EnableLocalCache brings the file up to
+// date.
+type LocalCacheOptions struct {
+	// MaxAge trusts a file checked against etcd less than this long ago
+	// as it is, so reads need no request at all; 0 always checks.
+	MaxAge time.Duration
+	// Refresh reads every host again instead of only the changed ones.
+	Refresh bool
+}
+
+// StaleCacheError is returned by EnableLocalCache when the file could not
+// be checked against etcd, and is used as it is.
+type StaleCacheError struct {
+	Revision int64
+	Checked  time.Time
+	Err      error
+}
+
+func (e *StaleCacheError) Error() string {
+	return fmt.Sprintf("using the local cache as of revision %d, checked %s ago: %v", e.Revision, time.Since(e.Checked).Round(time.Second), e.Err)
+}
+
+func (e *StaleCacheError) Unwrap() error { return e.Err }
+
+// EnableLocalCache makes ListHosts, ListHostsWithOptions, ListHostsPage,
+// StreamHosts, ListHostNames and GetHost read from a copy of every host
+// kept in the file at path between runs, as a HostSnapshot does, so only
+// the hosts changed since the file's revision are read from etcd. Listings
+// a snapshot cannot serve still go to etcd. When etcd cannot be reached,
+// the file is used as it is and a *StaleCacheError is returned; any other
+// error leaves the Inventory unchanged. The file is saved whenever it
+// changed. Writes through the Inventory do not update it, so it suits
+// read-only commands.
+func (i *Inventory) EnableLocalCache(path string, opts LocalCacheOptions) error {
+	file, err := i.readLocalCache(path)
+	if err != nil {
+		return err
+	}
+	var stale error
+	if opts.Refresh || opts.MaxAge <= 0 || file.Revision == 0 || time.Since(file.Checked) >= opts.MaxAge {
+		changed, err := i.updateLocalCache(file, opts.Refresh)
+		if err != nil {
+			if file.Revision == 0 {
+				return err
+			}
+			stale = &StaleCacheError{Revision: file.Revision, Checked: file.Checked, Err: err}
+		} else {
+			file.Checked = time.Now().UTC()
+			if changed || opts.MaxAge > 0 {
+				if err := writeLocalCache(path, file); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	i.local = i.localSnapshot(file)
+	return stale
+}
+
+// listsLocally reports whether a listing with opts is served by the local
+// cache.
+func (i *Inventory) listsLocally(opts ListOptions) bool {
+	return i.local != nil && opts.Revision == 0 && i.local.lists(opts)
+}
+
+// readLocalCache reads the file at path, or returns an empty one if there
+// is none.
+func (i *Inventory) readLocalCache(path string) (*localCacheFile, error) {
+	file := &localCacheFile{Version: LocalCacheVersion, Namespace: i.namespace, Keys: make(map[string][]byte)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("local cache %s: %w", path, err)
+	}
+	if file.Version != LocalCacheVersion {
+		return nil, fmt.Errorf("local cache %s has version %d, expected %d (remove it to start over)", path, file.Version, LocalCacheVersion)
+	}
+	if file.Namespace != i.namespace {
+		return nil, fmt.Errorf("local cache %s holds the inventory at %q, not %q", path, file.Namespace, i.namespace)
+	}
+	if file.Keys == nil {
+		file.Keys = make(map[string][]byte)
+	}
+	return file, nil
+}
+
+func writeLocalCache(path string, file *localCacheFile) error {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data)
+}
+
+// updateLocalCache brings file to the current revision, reading the values
+// of only the hosts changed since its revision (all of them with refresh)
+// and the keys of the others to learn which were removed, in one
+// transaction. It reports whether any host changed.
+func (i *Inventory) updateLocalCache(file *localCacheFile, refresh bool) (bool, error) {
+	from := file.Revision + 1
+	if refresh {
+		from = 0
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Txn(ctx).Then(
+		clientv3.OpGet(baseKey, clientv3.WithPrefix(), clientv3.WithKeysOnly()),
+		clientv3.OpGet(baseKey, clientv3.WithPrefix(), clientv3.WithMinModRev(from)),
+	).Commit()
+	if err != nil {
+		return false, err
+	}
+	keys, changedKVs := resp.Responses[0].GetResponseRange().Kvs, resp.Responses[1].GetResponseRange().Kvs
+	changed := len(changedKVs) > 0 || len(keys) != len(file.Keys)
+	present := make(map[string]bool, len(keys))
+	for _, kv := range keys {
+		present[string(kv.Key)] = true
+	}
+	for key := range file.Keys {
+		if !present[key] {
+			delete(file.Keys, key)
+		}
+	}
+	for _, kv := range changedKVs {
+		file.Keys[string(kv.Key)] = kv.Value
+	}
+	file.Revision = resp.Header.Revision
+	return changed, nil
+}
+
+// localSnapshot decodes file as a HostSnapshot without a watch, skipping
+// malformed values with a warning.
+func (i *Inventory) localSnapshot(file *localCacheFile) *HostSnapshot {
+	s := &HostSnapshot{inv: i, keys: sortedKeys(file.Keys), hosts: make(map[string]Host, len(file.Keys)), revision: file.Revision, updated: file.Checked}
+	kept := s.keys[:0]
+	for _, key := range s.keys {
+		host, err := i.unmarshalHost(file.Keys[key])
+		if err != nil {
+			WarnMalformed([]error{&MalformedHostError{Key: key, Err: err}})
+			continue
+		}
+		if host.Name == "" {
+			host.Name = i.hostNameFromKey(key)
+		}
+		s.hosts[key] = host
+		kept = append(kept, key)
+	}
+	s.keys = kept
+	return s
+}
+
+// WatchLocalCache keeps the local cache file at path current until ctx is
+// done: it is brought up to date as by EnableLocalCache, then follows a
+// watch of the hosts, saved at most once per interval. The file is also
+// saved every interval while etcd answers, marking it checked, so readers
+// with a LocalCacheOptions.MaxAge above interval need not contact etcd.
+func (i *Inventory) WatchLocalCache(ctx context.Context, path string, interval time.Duration) error {
+	file, err := i.readLocalCache(path)
+	if err != nil {
+		return err
+	}
+	if _, err := i.updateLocalCache(file, false); err != nil {
+		return err
+	}
+	file.Checked = time.Now().UTC()
+	if err := writeLocalCache(path, file); err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(file.Keys))
+	for key := range file.Keys {
+		known[i.hostNameFromKey(key)] = true
+	}
+	var mu sync.Mutex
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- i.watchHosts(ctx, file.Revision+1, known, false, func(event HostEvent) error {
+			key := i.hostKey(event.Name)
+			mu.Lock()
+			defer mu.Unlock()
+			if event.Type == mvccpb.DELETE {
+				delete(file.Keys, key)
+			} else {
+				file.Keys[key] = event.value
+			}
+			file.Revision = event.Revision
+			return nil
+		})
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-watchErr:
+			// Keep the changes followed since the last save.
+			if saveErr := writeLocalCache(path, file); saveErr != nil {
+				return saveErr
+			}
+			return err
+		case <-ticker.C:
+		}
+		ctx, cancel := i.requestContext()
+		_, err := i.kv.Get(ctx, baseKey, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		cancel()
+		if err != nil {
+			logging.Warnf("etcd is unreachable, the local cache is no longer marked checked: %v", err)
+			continue
+		}
+		mu.Lock()
+		file.Checked = time.Now().UTC()
+		err = writeLocalCache(path, file)
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+)
+
+func handleAuth(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	const usage = "Usage: auth token create --name <name> --grant <role[:namespace[:hosts]]>... [--ttl <duration>] | auth token revoke <id> | auth token list"
+	if len(args) < 2 || args[0] != "token" {
+		logging.Fatal(usage)
+	}
+	switch args[1] {
+	case "create":
+		fs := flag.NewFlagSet("auth token create", flag.ExitOnError)
+		name := fs.String("name", "", "Who or what the token is for, shown in the list and in server logs")
+		var grantArgs stringList
+		fs.Var(&grantArgs, "grant", "Grant a role ("+strings.Join(inventory.Roles(), ", ")+"), optionally only in a namespace and on the hosts matching a pattern, as role[:namespace[:hosts]] (repeatable)")
+		ttl := fs.Duration("ttl", 0, "Expire the token after this long (0 for never)")
+		fs.Parse(args[2:])
+		if *name == "" || len(grantArgs) == 0 || fs.NArg() != 0 || *ttl < 0 {
+			logging.Fatal(usage)
+		}
+		grants := make([]inventory.Grant, len(grantArgs))
+		for n, arg := range grantArgs {
+			grant, err := inventory.ParseGrant(arg)
+			if err != nil {
+				logging.Fatalf("Invalid --grant: %v", err)
+			}
+			grants[n] = grant
+		}
+		token, stored, err := inv.CreateAuthToken(*name, grants, *ttl)
+		if err != nil {
+			logging.Fatalf("Error creating token: %v", err)
+		}
+		fmt.Println(token)
+		logDone("Created token %s for %s; it cannot be shown again", stored.ID, stored.Name)
+	case "revoke":
+		if len(args) != 3 {
+			logging.Fatal(usage)
+		}
+		if err := inv.RevokeAuthToken(args[2]); err != nil {
+			logging.Fatalf("Error revoking token: %v", err)
+		}
+		logDone("Revoked token %s", args[2])
+	case "list":
+		if len(args) != 2 {
+			logging.Fatal(usage)
+		}
+		tokens, err := inv.AuthTokens()
+		if err != nil {
+			logging.Fatalf("Error listing tokens: %v", err)
+		}
+		rows := make([]inventory.Host, len(tokens))
+		for n, token := range tokens {
+			grants := make([]string, len(token.Grants))
+			for g, grant := range token.Grants {
+				grants[g] = grant.String()
+			}
+			data := map[string]interface{}{"name": token.Name, "grants": strings.Join(grants, " "), "created": token.Created.Format(time.RFC3339)}
+			if token.Expires != nil {
+				data["expires"] = token.Expires.Format(time.RFC3339)
+			}
+			rows[n] = inventory.Host{Name: token.ID, Data: data}
+		}
+		output.Wide = true
+		printOutput(output, rows)
+	default:
+		logging.Fatalf("Unknown auth token subcommand %q. Use 'create', 'revoke' or 'list'.", args[1])
+	}
+}
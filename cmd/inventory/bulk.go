@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"golang.org/x/time/rate"
+)
+
+// handleNormalize canonicalizes the stored JSON of every host, or with
+// --dry-run lists the hosts that would change.
+func handleNormalize(inv *inventory.Inventory, args []string) {
+	normalizeCmd := flag.NewFlagSet("normalize", flag.ExitOnError)
+	dryRun := normalizeCmd.Bool("dry-run", false, "Only report the hosts that would be rewritten")
+	normalizeCmd.Parse(args)
+
+	normalized, err := inv.NormalizeHosts(*dryRun)
+	for _, name := range normalized {
+		fmt.Println(name)
+	}
+	if err != nil {
+		logging.Fatalf("Error normalizing hosts after %d rewritten: %v", len(normalized), err)
+	}
+	if *dryRun {
+		logging.Infof("%d hosts would be normalized", len(normalized))
+		return
+	}
+	logDone("Normalized %d hosts", len(normalized))
+}
+
+// handleSet sets fields on every host matching --filter.
+func handleSet(inv *inventory.Inventory, args []string) {
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	filterExpr := fs.String("filter", "", "Hosts to update, as field=value, field!=value or field in CIDR (comma-separated; required)")
+	dryRun := fs.Bool("dry-run", false, "Only list the hosts that would be updated")
+	bulk := addBulkFlags(fs)
+	fs.Parse(args)
+	args = fs.Args()
+
+	if *filterExpr == "" || len(args) == 0 {
+		logging.Fatal("Usage: set --filter <expr> [--dry-run] <field>=<value> ... (a value of @path reads the file)")
+	}
+	filter, err := inventory.ParseHostFilter(*filterExpr)
+	if err != nil {
+		logging.Fatalf("Invalid --filter: %v", err)
+	}
+	fields := make(map[string]interface{})
+	for _, arg := range args {
+		field, rawValue, ok := strings.Cut(arg, "=")
+		if !ok || strings.TrimSpace(field) == "" {
+			logging.Fatalf("Invalid assignment %q: expected field=value", arg)
+		}
+		if fields[field], err = readFieldValue(rawValue); err != nil {
+			logging.Fatalf("Error reading value for field '%s': %v", field, err)
+		}
+	}
+
+	result, err := inv.ListHostsWithOptions(inventory.ListOptions{Filter: filter})
+	if err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+	inventory.WarnMalformed(result.Malformed)
+	if *dryRun {
+		for _, host := range result.Hosts {
+			fmt.Println(host.Name)
+		}
+		logging.Infof("%d hosts would be updated", len(result.Hosts))
+		return
+	}
+	errs := bulk.run(result.Hosts, func(_ int, host inventory.Host) error {
+		return inv.UpdateHostFields(host.Name, fields)
+	})
+	failed, notStarted := 0, 0
+	for i, err := range errs {
+		switch {
+		case errors.Is(err, errNotStarted):
+			notStarted++
+		case err != nil:
+			logging.Errorf("Error updating host '%s': %v", result.Hosts[i].Name, err)
+			failed++
+		}
+	}
+	logDone("Updated %d hosts (%d failed, %d not started)", len(result.Hosts)-failed-notStarted, failed, notStarted)
+	if failed+notStarted > 0 {
+		os.Exit(1)
+	}
+}
+
+// handleBulkUpdate sets fields on every host matching --filter like set,
+// but --batch-size hosts per transaction, and prints the names of the hosts
+// it changed.
+func handleBulkUpdate(inv *inventory.Inventory, args []string) {
+	const usage = "Usage: bulk-update --filter <expr> --set <field>=<value> ... [--batch-size N] [--dry-run] (a value of @path reads the file)"
+	fs := flag.NewFlagSet("bulk-update", flag.ExitOnError)
+	filterExpr := fs.String("filter", "", "Hosts to update, as field=value, field!=value or field in CIDR (comma-separated; required)")
+	var sets stringList
+	fs.Var(&sets, "set", "Field to set, as field=value (repeatable; required)")
+	batchSize := fs.Int("batch-size", inventory.DefaultUpdateBatch, "Hosts updated per etcd transaction; each batch is written entirely or not at all")
+	dryRun := fs.Bool("dry-run", false, "Only list the matching hosts")
+	bulk := addBulkFlags(fs)
+	fs.Parse(args)
+	if *filterExpr == "" || len(sets) == 0 || fs.NArg() != 0 {
+		logging.Fatal(usage)
+	}
+	if *batchSize < 1 {
+		logging.Fatal("--batch-size must be at least 1")
+	}
+	filter, err := inventory.ParseHostFilter(*filterExpr)
+	if err != nil {
+		logging.Fatalf("Invalid --filter: %v", err)
+	}
+	fields := make(map[string]interface{})
+	for _, arg := range sets {
+		field, rawValue, ok := strings.Cut(arg, "=")
+		if !ok || strings.TrimSpace(field) == "" {
+			logging.Fatalf("Invalid --set %q: expected field=value", arg)
+		}
+		if fields[field], err = readFieldValue(rawValue); err != nil {
+			logging.Fatalf("Error reading value for field '%s': %v", field, err)
+		}
+	}
+
+	result, err := inv.ListHostsWithOptions(inventory.ListOptions{Filter: filter})
+	if err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+	inventory.WarnMalformed(result.Malformed)
+	if *dryRun {
+		for _, host := range result.Hosts {
+			fmt.Println(host.Name)
+		}
+		logging.Infof("%d hosts match", len(result.Hosts))
+		return
+	}
+	updated := make([]bool, len(result.Hosts))
+	errs := bulk.runBatches(result.Hosts, *batchSize, func(start int, batch []inventory.Host) []error {
+		names := make([]string, len(batch))
+		for n, host := range batch {
+			names[n] = host.Name
+		}
+		batchUpdated, errs, err := inv.UpdateHostsFields(names, fields)
+		if errors.Is(err, rpctypes.ErrTooManyOps) {
+			err = fmt.Errorf("%w (lower --batch-size)", err)
+		}
+		if err != nil {
+			errs = make([]error, len(batch))
+			for n := range errs {
+				errs[n] = err
+			}
+			return errs
+		}
+		copy(updated[start:], batchUpdated)
+		return errs
+	})
+	changed, failed, notStarted := 0, 0, 0
+	for i, err := range errs {
+		switch {
+		case errors.Is(err, errNotStarted):
+			notStarted++
+		case err != nil:
+			logging.Errorf("Error updating host '%s': %v", result.Hosts[i].Name, err)
+			failed++
+		case updated[i]:
+			fmt.Println(result.Hosts[i].Name)
+			changed++
+		}
+	}
+	logDone("Updated %d of %d matching hosts (%d already set, %d failed, %d not started)",
+		changed, len(result.Hosts), len(result.Hosts)-changed-failed-notStarted, failed, notStarted)
+	if failed+notStarted > 0 {
+		os.Exit(1)
+	}
+}
+
+// handlePruneEmpty deletes the empty fields of every host, listing each
+// host and the fields it lost.
+func handlePruneEmpty(inv *inventory.Inventory, args []string) {
+	fs := flag.NewFlagSet("prune-empty", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only list the fields that would be deleted")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		logging.Fatal("Usage: prune-empty [--dry-run]")
+	}
+	pruned, err := inv.PruneEmptyFields(*dryRun)
+	names := make([]string, 0, len(pruned))
+	for name := range pruned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s: %s\n", name, strings.Join(pruned[name], ", "))
+	}
+	if err != nil {
+		logging.Fatalf("Error pruning hosts after %d pruned: %v", len(pruned), err)
+	}
+	if *dryRun {
+		logging.Infof("%d hosts would be pruned", len(pruned))
+	} else {
+		logDone("Pruned %d hosts", len(pruned))
+	}
+}
+
+// bulkOptions controls how bulk operations spread their etcd writes.
+type bulkOptions struct {
+	concurrency *int
+	rateLimit   *float64
+	resumeFile  *string
+}
+
+// errNotStarted is the error run reports for the hosts it never got to
+// because it was interrupted.
+var errNotStarted = errors.New("not started: interrupted")
+
+func addBulkFlags(fs *flag.FlagSet) bulkOptions {
+	return bulkOptions{
+		concurrency: fs.Int("concurrency", 1, "Number of hosts processed in parallel"),
+		rateLimit:   fs.Float64("rate-limit", 0, "Maximum operations per second against etcd (0 for unlimited)"),
+		resumeFile:  fs.String("resume-file", "", "If interrupted, write the names of the hosts not done, one per line, to this file"),
+	}
+}
+
+// run calls fn for every host on a pool of workers, pacing the calls with a
+// token bucket when a rate limit is set, and returns the per-host errors in
+// input order. On SIGINT or SIGTERM it stops handing out hosts but lets the
+// calls in flight finish, so each host is either done or errNotStarted;
+// the hosts not done are then listed in the resume file. A second signal
+// exits at once.
+func (b bulkOptions) run(hosts []inventory.Host, fn func(i int, host inventory.Host) error) []error {
+	return b.runBatches(hosts, 1, func(start int, batch []inventory.Host) []error {
+		return []error{fn(start, batch[0])}
+	})
+}
+
+// runBatches is run for an fn that handles up to size hosts per call,
+// such as in one transaction: batch is hosts[start:start+size], and fn
+// returns the error of each of its hosts. Workers, the rate limit and
+// interruption apply per batch.
+func (b bulkOptions) runBatches(hosts []inventory.Host, size int, fn func(start int, batch []inventory.Host) []error) []error {
+	workers := *b.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	var limiter *rate.Limiter
+	if *b.rateLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(*b.rateLimit), 1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	errs := make([]error, len(hosts))
+	for i := range errs {
+		errs[i] = errNotStarted
+	}
+	progress := newProgress(len(hosts), os.Stderr)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range jobs {
+				if limiter != nil && limiter.Wait(ctx) != nil {
+					continue
+				}
+				end := start + size
+				if end > len(hosts) {
+					end = len(hosts)
+				}
+				copy(errs[start:end], fn(start, hosts[start:end]))
+				for range hosts[start:end] {
+					progress.advance()
+				}
+			}
+		}()
+	}
+dispatch:
+	for i := 0; i < len(hosts); i += size {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	progress.finish()
+	if ctx.Err() != nil {
+		b.reportInterrupted(hosts, errs)
+	}
+	return errs
+}
+
+// reportInterrupted logs how far an interrupted run got and writes the
+// names of the hosts not done, failed or not started, to the resume file.
+func (b bulkOptions) reportInterrupted(hosts []inventory.Host, errs []error) {
+	var pending []string
+	notStarted := 0
+	for i, err := range errs {
+		if err != nil {
+			pending = append(pending, hosts[i].Name)
+		}
+		if errors.Is(err, errNotStarted) {
+			notStarted++
+		}
+	}
+	logging.Errorf("Interrupted: %d hosts done, %d failed, %d not started", len(hosts)-len(pending), len(pending)-notStarted, notStarted)
+	if *b.resumeFile == "" {
+		return
+	}
+	var buf bytes.Buffer
+	for _, name := range pending {
+		fmt.Fprintln(&buf, name)
+	}
+	if err := inventory.WriteFileAtomic(*b.resumeFile, buf.Bytes()); err != nil {
+		logging.Errorf("Error writing resume file: %v", err)
+		return
+	}
+	logging.Infof("Wrote the %d hosts not done to %s", len(pending), *b.resumeFile)
+}
+
+// progressLogInterval is how often progress is logged when stderr is not a
+// terminal.
+const progressLogInterval = 10 * time.Second
+
+// progress reports how far a bulk operation has got: a bar redrawn in place
+// on a terminal, or a log line every progressLogInterval otherwise, so
+// redirected output never contains control characters.
+type progress struct {
+	mu       sync.Mutex
+	w        io.Writer
+	terminal bool
+	total    int
+	done     int
+	start    time.Time
+	lastLog  time.Time
+}
+
+func newProgress(total int, w *os.File) *progress {
+	now := time.Now()
+	return &progress{w: w, terminal: inventory.IsTerminal(w), total: total, start: now, lastLog: now}
+}
+
+func (p *progress) advance() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	switch {
+	case p.terminal:
+		fmt.Fprintf(p.w, "\r\x1b[K%s", p.status(true))
+	case time.Since(p.lastLog) >= progressLogInterval:
+		p.lastLog = time.Now()
+		logging.Infof("%s", p.status(false))
+	}
+}
+
+// finish ends the bar's line so later output starts on a fresh one.
+func (p *progress) finish() {
+	if p.terminal && p.done > 0 {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// progressBarWidth is the number of cells in the progress bar.
+const progressBarWidth = 30
+
+func (p *progress) status(bar bool) string {
+	elapsed := time.Since(p.start)
+	rate := float64(p.done) / elapsed.Seconds()
+	eta := "?"
+	if rate > 0 {
+		eta = time.Duration(float64(p.total-p.done) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+	percent := 100 * p.done / p.total
+	s := fmt.Sprintf("%3d%% %d/%d %.1f/s ETA %s", percent, p.done, p.total, rate, eta)
+	if !bar {
+		return "Progress: " + s
+	}
+	filled := progressBarWidth * p.done / p.total
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled) + "] " + s
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigName is the config file looked up in the home directory.
+const defaultConfigName = ".inventory.yaml"
+
+// config holds defaults from the config file. Each setting is folded into
+// the global flag of the same name unless that flag was given explicitly, so
+// flags override the config and the config overrides built-in defaults.
+type config struct {
+	Output     string            `yaml:"output"`
+	TimeFormat string            `yaml:"time-format"`
+	Timezone   string            `yaml:"timezone"`
+	Columns    []string          `yaml:"columns"`
+	Aliases    map[string]string `yaml:"aliases"`
+	Trim       bool              `yaml:"trim"`
+	PruneEmpty bool              `yaml:"prune-empty"`
+	Lowercase  []string          `yaml:"lowercase"`
+	Uppercase  []string          `yaml:"uppercase"`
+	KeyField   []string          `yaml:"key-field"`
+	RulesFile  string            `yaml:"rules-file"`
+	// SecretFields and SecretKey are shared by everyone writing the
+	// inventory, so they are best kept here rather than in flags.
+	SecretFields []string `yaml:"secret-fields"`
+	SecretKey    string   `yaml:"secret-key"`
+	// VirtualFields is not a flag default: the --virtual-field flags are
+	// added to it, overriding fields of the same name.
+	VirtualFields map[string]string `yaml:"virtual-fields"`
+	Endpoints     []string          `yaml:"endpoints"`
+	Namespace     string            `yaml:"namespace"`
+	Timeout       string            `yaml:"timeout"`
+	DialTimeout   string            `yaml:"dial-timeout"`
+	LocalCache    string            `yaml:"local-cache"`
+}
+
+// loadConfig reads the config file at path. A missing file is only an
+// error if it was asked for explicitly.
+func loadConfig(path string, explicit bool) (config, error) {
+	var cfg config
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// apply sets the flags in fs that the config provides and the command line
+// did not.
+func (c config) apply(fs *flag.FlagSet) error {
+	return setFlagDefaults(fs, map[string]string{
+		"output":         c.Output,
+		"time-format":    c.TimeFormat,
+		"timezone":       c.Timezone,
+		"columns":        strings.Join(c.Columns, ","),
+		"alias":          inventory.AliasMap(c.Aliases).String(),
+		"trim":           strconv.FormatBool(c.Trim),
+		"prune-empty":    strconv.FormatBool(c.PruneEmpty),
+		"lowercase":      strings.Join(c.Lowercase, ","),
+		"uppercase":      strings.Join(c.Uppercase, ","),
+		"key-field":      strings.Join(c.KeyField, ","),
+		"rules-file":     c.RulesFile,
+		"secret-fields":  strings.Join(c.SecretFields, ","),
+		"secret-key":     c.SecretKey,
+		"etcd-endpoints": strings.Join(c.Endpoints, ","),
+		"namespace":      c.Namespace,
+		"timeout":        c.Timeout,
+		"dial-timeout":   c.DialTimeout,
+		"local-cache":    c.LocalCache,
+	})
+}
+
+// envPrefix starts the environment variable that stands in for each global
+// flag: INVENTORY_ followed by the flag name in upper case with dashes as
+// underscores, e.g. INVENTORY_OUTPUT or INVENTORY_DIAL_TIMEOUT.
+const envPrefix = "INVENTORY_"
+
+// envFlagValues returns the value of the environment variable of each flag
+// in fs that has one set. Applied with setFlagDefaults before the context
+// and config file, it ranks below the command line and above both.
+func envFlagValues(fs *flag.FlagSet, prefix string) map[string]string {
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		name := prefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			values[f.Name] = value
+		}
+	})
+	return values
+}
+
+// loadSecretKey reads the key of the secret fields from source: file:PATH,
+// env:VARIABLE, or awskms:PATH for a file holding a data key encrypted by
+// AWS KMS, decrypted with the default AWS configuration. The key itself
+// may be raw, hex or base64; see inventory.ParseSecretKey.
+func loadSecretKey(source string) ([]byte, error) {
+	kind, value, _ := strings.Cut(source, ":")
+	var key []byte
+	switch kind {
+	case "file":
+		content, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		key = content
+	case "env":
+		content, ok := os.LookupEnv(value)
+		if !ok {
+			return nil, fmt.Errorf("$%s is not set", value)
+		}
+		key = []byte(content)
+	case "awskms":
+		blob, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), inventory.DefaultRequestTimeout)
+		defer cancel()
+		cfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("loading the AWS configuration: %w", err)
+		}
+		// Data keys are usually stored as the base64 the AWS CLI prints.
+		if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(blob))); err == nil {
+			blob = decoded
+		}
+		out, err := kms.NewFromConfig(cfg).Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+		if err != nil {
+			return nil, fmt.Errorf("decrypting %s with KMS: %w", value, err)
+		}
+		key = out.Plaintext
+	default:
+		return nil, inventory.UnknownChoiceError("key source", kind, []string{"file", "env", "awskms"})
+	}
+	return inventory.ParseSecretKey(key)
+}
+
+// setFlagDefaults sets each named flag in fs to its non-empty value unless
+// the flag was already set, on the command line or by an earlier call. A
+// value given under both the current and the former name of a flag is
+// taken from the current one.
+func setFlagDefaults(fs *flag.FlagSet, values map[string]string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+		if name, ok := etcdFlagAliases[f.Name]; ok {
+			explicit[name] = true
+		}
+	})
+	// An explicit host or port must not lose to configured endpoints.
+	if explicit["etcd-host"] || explicit["etcd-port"] {
+		explicit["etcd-endpoints"] = true
+	}
+	for alias, name := range etcdFlagAliases {
+		if explicit[name] || values[name] != "" {
+			explicit[alias] = true
+		}
+	}
+	for name, value := range values {
+		if value == "" || explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// defaultContextsName is the contexts file looked up in the home directory.
+const defaultContextsName = ".inventory-contexts.yaml"
+
+// clusterContext is a named set of connection settings, the etcd analog of
+// a kubeconfig context. Like the config file, its settings only fill in
+// flags that were not given.
+type clusterContext struct {
+	Endpoints []string `yaml:"endpoints"`
+	Namespace string   `yaml:"namespace,omitempty"`
+	CACert    string   `yaml:"cacert,omitempty"`
+	Cert      string   `yaml:"cert,omitempty"`
+	Key       string   `yaml:"key,omitempty"`
+	Username  string   `yaml:"username,omitempty"`
+	Password  string   `yaml:"password,omitempty"`
+	// User is "name:password", as for --user, in older files.
+	User string `yaml:"user,omitempty"`
+}
+
+type contextsFile struct {
+	CurrentContext string                    `yaml:"current-context"`
+	Contexts       map[string]clusterContext `yaml:"contexts"`
+}
+
+// loadContexts reads the contexts file; a missing file has no contexts.
+func loadContexts(path string) (contextsFile, error) {
+	var contexts contextsFile
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return contexts, nil
+	}
+	if err != nil {
+		return contexts, err
+	}
+	if err := yaml.Unmarshal(content, &contexts); err != nil {
+		return contexts, fmt.Errorf("contexts %s: %w", path, err)
+	}
+	return contexts, nil
+}
+
+func (c contextsFile) save(path string) error {
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return inventory.WriteFileAtomic(path, content)
+}
+
+// selected returns the context named name, or the current context when name
+// is empty. ok is false when neither names a context.
+func (c contextsFile) selected(name string) (ctx clusterContext, ok bool, err error) {
+	if name == "" {
+		name = c.CurrentContext
+		if name == "" {
+			return clusterContext{}, false, nil
+		}
+	}
+	ctx, ok = c.Contexts[name]
+	if !ok {
+		return clusterContext{}, false, fmt.Errorf("no context named %q", name)
+	}
+	return ctx, true, nil
+}
+
+func (c clusterContext) apply(fs *flag.FlagSet) error {
+	return setFlagDefaults(fs, map[string]string{
+		"etcd-endpoints": strings.Join(c.Endpoints, ","),
+		"namespace":      c.Namespace,
+		"etcd-ca":        c.CACert,
+		"etcd-cert":      c.Cert,
+		"etcd-key":       c.Key,
+		"etcd-username":  c.Username,
+		"etcd-password":  c.Password,
+		"user":           c.User,
+	})
+}
+
+// handleUseContext sets the default context, or without an argument lists
+// the contexts with the current one marked.
+func handleUseContext(path string, args []string) {
+	contexts, err := loadContexts(path)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	switch len(args) {
+	case 0:
+		names := make([]string, 0, len(contexts.Contexts))
+		for name := range contexts.Contexts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			marker := " "
+			if name == contexts.CurrentContext {
+				marker = "*"
+			}
+			fmt.Printf("%s %s\t%s\n", marker, name, strings.Join(contexts.Contexts[name].Endpoints, ","))
+		}
+	case 1:
+		if _, ok := contexts.Contexts[args[0]]; !ok {
+			logging.Fatalf("No context named %q in %s", args[0], path)
+		}
+		contexts.CurrentContext = args[0]
+		if err := contexts.save(path); err != nil {
+			logging.Fatalf("Error saving %s: %v", path, err)
+		}
+		logging.Infof("Switched to context %q", args[0])
+	default:
+		logging.Fatal("Usage: use-context [<context_name>]")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+	"gopkg.in/yaml.v3"
+)
+
+// handleEdit opens a host's data in $EDITOR, like kubectl edit, and writes
+// the result back only if the host was not changed in the meantime. Invalid
+// edits reopen the editor with the error at the top of the file.
+func handleEdit(inv *inventory.Inventory, args []string) {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	format := fs.String("output", "json", "Format to edit the data in: json or yaml")
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) != 1 || (*format != "json" && *format != "yaml") {
+		logging.Fatal("Usage: edit [--output json|yaml] <host_name>")
+	}
+	hostName := args[0]
+	host, modRevision, err := inv.GetHostWithRevision(hostName)
+	if err != nil {
+		logging.Fatalf("Error getting host: %v", err)
+	}
+	original, err := marshalEditData(host.Data, *format)
+	if err != nil {
+		logging.Fatalf("Error encoding host: %v", err)
+	}
+
+	f, err := os.CreateTemp("", "inventory-edit-*."+*format)
+	if err != nil {
+		logging.Fatalf("Error creating temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	content := original
+	for {
+		if err := os.WriteFile(f.Name(), content, 0o600); err != nil {
+			logging.Fatalf("Error writing temp file: %v", err)
+		}
+		if err := runEditor(f.Name()); err != nil {
+			logging.Fatalf("Error running editor: %v", err)
+		}
+		edited, err := os.ReadFile(f.Name())
+		if err != nil {
+			logging.Fatalf("Error reading temp file: %v", err)
+		}
+		// Saving the file untouched, including after an error was shown,
+		// aborts the edit.
+		if bytes.Equal(edited, content) {
+			logging.Infof("Edit cancelled, no changes made.")
+			return
+		}
+		edited = stripEditComments(edited)
+		data, err := unmarshalEditData(edited, *format)
+		if err == nil {
+			if problems := inv.ValidateHost(inventory.Host{Name: hostName, Data: data}); len(problems) > 0 {
+				err = errors.Join(problems...)
+			}
+		}
+		if err != nil {
+			content = append(editComment(err), edited...)
+			continue
+		}
+		if err := inv.UpdateHostIfRevision(hostName, data, modRevision); err != nil {
+			logging.Fatalf("Error saving host (your edit is lost; rerun edit): %v", err)
+		}
+		logDone("Host '%s' edited successfully!", hostName)
+		return
+	}
+}
+
+func marshalEditData(data map[string]interface{}, format string) ([]byte, error) {
+	data = inventory.EncodeBinaryValues(data)
+	if format == "yaml" {
+		return yaml.Marshal(data)
+	}
+	b, err := json.MarshalIndent(data, "", "    ")
+	return append(b, '\n'), err
+}
+
+func unmarshalEditData(content []byte, format string) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	var err error
+	if format == "yaml" {
+		err = yaml.Unmarshal(content, &data)
+	} else {
+		err = json.Unmarshal(content, &data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	return inventory.DecodeBinaryValues(data), nil
+}
+
+// editComment renders err as "#" lines placed above the content on reopen;
+// stripEditComments removes them again before parsing.
+func editComment(err error) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Please fix the error below; exit without saving to abort.\n")
+	for _, line := range strings.Split(err.Error(), "\n") {
+		b.WriteString("# " + line + "\n")
+	}
+	return b.Bytes()
+}
+
+func stripEditComments(content []byte) []byte {
+	for bytes.HasPrefix(content, []byte("#")) {
+		_, rest, _ := bytes.Cut(content, []byte("\n"))
+		content = rest
+	}
+	return content
+}
+
+// runEditor opens path in $VISUAL or $EDITOR, defaulting to vi. The variable
+// may carry arguments, e.g. "code --wait".
+func runEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	parts := strings.Fields(editor)
+	cmd := exec.Command(parts[0], append(parts[1:], path)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// clientSecurity holds the TLS files and credentials for the etcd client;
+// empty fields are not used.
+type clientSecurity struct {
+	CACert   string
+	Cert     string
+	Key      string
+	Username string
+	Password string
+}
+
+// setUser sets the credentials from user, "name:password" as given to
+// --user, unless a user name is already set.
+func (s *clientSecurity) setUser(user string) error {
+	if user == "" || s.Username != "" {
+		return nil
+	}
+	var ok bool
+	s.Username, s.Password, ok = strings.Cut(user, ":")
+	if !ok {
+		return errors.New("--user must be name:password")
+	}
+	return nil
+}
+
+// etcdFlags are the global flags saying how to reach etcd.
+type etcdFlags struct {
+	host      string
+	port      int
+	endpoints string
+	ca        string
+	cert      string
+	key       string
+	username  string
+	password  string
+	// user is the deprecated --user, "name:password".
+	user string
+}
+
+// etcdFlagAliases maps the former names of the connection flags, still
+// accepted on the command line, in the environment and in the config file,
+// to their current ones.
+var etcdFlagAliases = map[string]string{"endpoints": "etcd-endpoints", "cacert": "etcd-ca", "cert": "etcd-cert", "key": "etcd-key"}
+
+// addEtcdFlags defines the connection flags in fs.
+func addEtcdFlags(fs *flag.FlagSet) *etcdFlags {
+	f := new(etcdFlags)
+	fs.StringVar(&f.host, "etcd-host", inventory.DefaultEtcdHost, "etcd server address")
+	fs.IntVar(&f.port, "etcd-port", inventory.DefaultEtcdPort, "etcd server port")
+	fs.StringVar(&f.endpoints, "etcd-endpoints", "", "Comma-separated etcd endpoints (overrides --etcd-host and --etcd-port)")
+	fs.StringVar(&f.ca, "etcd-ca", "", "CA bundle to verify the etcd server certificate")
+	fs.StringVar(&f.cert, "etcd-cert", "", "Client certificate for etcd TLS authentication")
+	fs.StringVar(&f.key, "etcd-key", "", "Client key for etcd TLS authentication")
+	fs.StringVar(&f.username, "etcd-username", "", "etcd user name")
+	fs.StringVar(&f.password, "etcd-password", "", "Password of --etcd-username; set "+envPrefix+"ETCD_PASSWORD instead to keep it out of the process list")
+	fs.StringVar(&f.user, "user", "", "etcd credentials as name:password (deprecated: use --etcd-username and "+envPrefix+"ETCD_PASSWORD)")
+	for alias, name := range etcdFlagAliases {
+		fs.Var(fs.Lookup(name).Value, alias, "Former name of --"+name)
+	}
+	return f
+}
+
+// endpointList returns the endpoints to connect to.
+func (f *etcdFlags) endpointList() []string {
+	if f.endpoints != "" {
+		return inventory.SplitList(f.endpoints)
+	}
+	return []string{fmt.Sprintf("%s:%d", f.host, f.port)}
+}
+
+// security returns the TLS files and credentials the flags give.
+func (f *etcdFlags) security() (clientSecurity, error) {
+	security := clientSecurity{CACert: f.ca, Cert: f.cert, Key: f.key, Username: f.username, Password: f.password}
+	return security, security.setUser(f.user)
+}
+
+func getClient(endpoints []string, dialTimeout time.Duration, security clientSecurity) (*clientv3.Client, error) {
+	config := clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: dialTimeout,
+	}
+	if security.CACert != "" || security.Cert != "" || security.Key != "" {
+		tlsInfo := transport.TLSInfo{CertFile: security.Cert, KeyFile: security.Key, TrustedCAFile: security.CACert}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS settings: %w", err)
+		}
+		config.TLS = tlsConfig
+	}
+	config.Username, config.Password = security.Username, security.Password
+	client, err := clientv3.New(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to etcd at %s: %w", strings.Join(endpoints, ","), err)
+	}
+	return client, nil
+}
+
+// checkConnection asks each endpoint for its status and succeeds as soon as
+// one answers. clientv3.New connects lazily, so without this an unreachable
+// cluster only shows up later as a confusing request timeout.
+func checkConnection(client *clientv3.Client, endpoints []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var lastErr error
+	for _, endpoint := range endpoints {
+		if _, err := client.Status(ctx, endpoint); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot reach etcd at %s: %v", strings.Join(endpoints, ","), lastErr)
+}
+
+// discoverEndpoints resolves _etcd-client-ssl._tcp and _etcd-client._tcp SRV
+// records for domain into endpoint URLs, mirroring etcdctl's --discovery-srv.
+func discoverEndpoints(domain string) ([]string, error) {
+	var endpoints []string
+	var lastErr error
+	for service, scheme := range map[string]string{"etcd-client-ssl": "https://", "etcd-client": "http://"} {
+		_, addrs, err := net.LookupSRV(service, "tcp", domain)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, addr := range addrs {
+			host := strings.TrimSuffix(addr.Target, ".")
+			endpoints = append(endpoints, scheme+net.JoinHostPort(host, fmt.Sprint(addr.Port)))
+		}
+	}
+	if len(endpoints) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return endpoints, nil
+}
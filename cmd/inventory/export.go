@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+	"github.com/oferchen/inventory/query"
+)
+
+// handlePrometheus prints the hosts as Prometheus file_sd targets, or
+// writes them to the file a file_sd_configs entry watches, replacing it
+// atomically so Prometheus never reads half a file.
+func handlePrometheus(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	fs := flag.NewFlagSet("prometheus", flag.ExitOnError)
+	file := fs.String("file", "", "Write the targets to this file instead of standard output")
+	filterExpr := fs.String("filter", "", "Only include hosts matching this filter (see list --filter)")
+	whereExpr := fs.String("where", "", "Only include hosts matching this expression (see list --where)")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		logging.Fatal("Usage: prometheus [--file <path>] [--filter F] [--where E] (see also --address-field, --sd-group-field and --sd-port)")
+	}
+	opts := inventory.ListOptions{}
+	var err error
+	if opts.Filter, err = inventory.ParseHostFilter(*filterExpr); err != nil {
+		logging.Fatalf("Invalid --filter: %v", err)
+	}
+	if *whereExpr != "" {
+		if opts.Where, err = query.Parse(*whereExpr); err != nil {
+			logging.Fatalf("Invalid --where: %v", err)
+		}
+	}
+	result, err := inv.ListHostsWithOptions(opts)
+	if err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+	inventory.WarnMalformed(result.Malformed)
+	output.Format = "prometheus"
+	if *file == "" {
+		if err := inventory.WriteOutput(os.Stdout, output, result.Hosts); err != nil {
+			logging.Fatalf("Error writing output: %v", err)
+		}
+		return
+	}
+	var buf bytes.Buffer
+	if err := inventory.WriteOutput(&buf, output, result.Hosts); err != nil {
+		logging.Fatalf("Error writing output: %v", err)
+	}
+	if err := inventory.WriteFileAtomic(*file, buf.Bytes()); err != nil {
+		logging.Fatalf("Error writing %s: %v", *file, err)
+	}
+	logging.Infof("Wrote %d targets to %s", len(result.Hosts), *file)
+}
+
+// handleAnsibleInventory implements ansible-inventory [--list | --host
+// NAME], the interface of an Ansible dynamic inventory script: --list
+// prints every host in the ansible format, --host one host's variables.
+// Ansible calls the script with just those flags, which main accepts in
+// place of the subcommand.
+func handleAnsibleInventory(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	fs := flag.NewFlagSet("ansible-inventory", flag.ExitOnError)
+	fs.Bool("list", true, "Print all hosts, their groups and variables (the default)")
+	hostName := fs.String("host", "", "Print the variables of this host only")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		logging.Fatal("Usage: ansible-inventory [--list | --host NAME]")
+	}
+
+	if *hostName == "" {
+		hosts, err := inv.ListHosts()
+		if err != nil {
+			logging.Fatalf("Error listing hosts: %v", err)
+		}
+		output.Format = "ansible"
+		if err := inventory.WriteOutput(os.Stdout, output, hosts); err != nil {
+			logging.Fatalf("Error writing output: %v", err)
+		}
+		return
+	}
+
+	// Ansible expects an empty object, not an error, for an unknown host.
+	vars := map[string]interface{}{}
+	host, err := inv.GetHost(*hostName)
+	switch {
+	case errors.Is(err, inventory.ErrHostNotFound):
+	case err != nil:
+		logging.Fatalf("Error getting host: %v", err)
+	default:
+		hosts, err := jsonHosts(output, []inventory.Host{host})
+		if err != nil {
+			logging.Fatalf("Error writing output: %v", err)
+		}
+		if len(hosts) == 1 {
+			vars = inventory.AnsibleHostVars(hosts[0])
+		}
+	}
+	var b []byte
+	if output.Indent(inventory.IsTerminal(os.Stdout)) {
+		b, err = json.MarshalIndent(vars, "", "    ")
+	} else {
+		b, err = json.Marshal(vars)
+	}
+	if err != nil {
+		logging.Fatalf("Error writing output: %v", err)
+	}
+	fmt.Println(string(b))
+}
+
+func handleExport(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	if len(args) > 0 && (args[0] == "dns" || args[0] == "hostsfile") {
+		handleExportDNS(inv, args[0], args[1:], output)
+		return
+	}
+	if len(args) > 0 && (args[0] == "ssh-config" || args[0] == "known-hosts") {
+		handleExportSSH(inv, args[0], args[1:], output)
+		return
+	}
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	file := fs.String("file", "", "File to write the export to (default stdout)")
+	withRevisions := fs.Bool("with-revisions", false, "Record each host's etcd revision, so importing the edited file refuses to overwrite hosts changed since")
+	namePrefix := fs.String("name-prefix", "", "Only export hosts whose name starts with this prefix")
+	filterExpr := fs.String("filter", "", "Only export hosts matching this filter (see list --filter)")
+	whereExpr := fs.String("where", "", "Only export hosts matching this expression (see list --where)")
+	format := fs.String("format", "export", "Output format: export (with a header import verifies), or json or yaml (as --output writes them, without revisions)")
+	fs.Parse(args)
+	switch *format {
+	case "export":
+	case "json", "yaml":
+		if *withRevisions {
+			logging.Fatal("--with-revisions needs --format export")
+		}
+	default:
+		logging.Fatalf("Invalid --format %q (use export, json or yaml)", *format)
+	}
+
+	opts := inventory.ListOptions{NamePrefix: *namePrefix}
+	var err error
+	if opts.Filter, err = inventory.ParseHostFilter(*filterExpr); err != nil {
+		logging.Fatalf("Invalid --filter: %v", err)
+	}
+	if *whereExpr != "" {
+		if opts.Where, err = query.Parse(*whereExpr); err != nil {
+			logging.Fatalf("Invalid --where: %v", err)
+		}
+	}
+	hosts, revisions, err := inv.ListHostsWithRevisions(opts)
+	if err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+	if !*withRevisions {
+		revisions = nil
+	}
+	var data []byte
+	if *format == "export" {
+		data, err = inv.EncodeExport(hosts, revisions)
+	} else {
+		var buf bytes.Buffer
+		err = inventory.WriteOutput(&buf, inventory.OutputOptions{Format: *format, Pretty: true, Transforms: []inventory.HostTransform{inv.SealSecrets}}, hosts)
+		data = bytes.TrimRight(buf.Bytes(), "\n")
+	}
+	if err != nil {
+		logging.Fatalf("Error encoding export: %v", err)
+	}
+	if *file == "" {
+		fmt.Println(string(data))
+		return
+	}
+	if err := inventory.WriteFileAtomic(*file, append(data, '\n')); err != nil {
+		logging.Fatalf("Error writing export: %v", err)
+	}
+	logging.Infof("Exported %d hosts to '%s'", len(hosts), *file)
+}
+
+// handleExportDNS implements export dns, which writes the hosts' addresses
+// and aliases as zone file records, and export hostsfile, which writes
+// them as /etc/hosts lines. With --check it reports the problems
+// inventory.DNSEntries finds instead, and only writes when there are none.
+func handleExportDNS(inv *inventory.Inventory, kind string, args []string, output inventory.OutputOptions) {
+	fs := flag.NewFlagSet("export "+kind, flag.ExitOnError)
+	file := fs.String("file", "", "File to write to (default stdout)")
+	namePrefix := fs.String("name-prefix", "", "Only export hosts whose name starts with this prefix")
+	filterExpr := fs.String("filter", "", "Only export hosts matching this filter (see list --filter)")
+	whereExpr := fs.String("where", "", "Only export hosts matching this expression (see list --where)")
+	origin := fs.String("origin", "", "Zone the names belong to; names are qualified with it and hosts outside it left out")
+	ttl := fs.Int("ttl", 3600, "Default TTL of the zone's records in seconds (dns only; 0 for none)")
+	fqdnField := fs.String("fqdn-field", "fqdn", "Field holding a host's fully qualified name, used instead of its host name")
+	aliasField := fs.String("alias-field", "aliases", "Field listing other names of a host, written as CNAMEs")
+	check := fs.Bool("check", false, "Report invalid, missing and duplicate addresses and names, and only write if there are none")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		logging.Fatalf("Usage: export %s [--origin ZONE] [--file F] [--check] [--filter F] [--where E] (see also --address-field)", kind)
+	}
+
+	opts := inventory.ListOptions{NamePrefix: *namePrefix}
+	var err error
+	if opts.Filter, err = inventory.ParseHostFilter(*filterExpr); err != nil {
+		logging.Fatalf("Invalid --filter: %v", err)
+	}
+	if *whereExpr != "" {
+		if opts.Where, err = query.Parse(*whereExpr); err != nil {
+			logging.Fatalf("Invalid --where: %v", err)
+		}
+	}
+	result, err := inv.ListHostsWithOptions(opts)
+	if err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+	inventory.WarnMalformed(result.Malformed)
+
+	dns := inventory.DNSOptions{Origin: *origin, TTL: *ttl, AddressField: output.AddressField, FQDNField: *fqdnField, AliasField: *aliasField}
+	entries, problems := inventory.DNSEntries(result.Hosts, dns)
+	if *check && len(problems) > 0 {
+		var rows []inventory.Host
+		for _, host := range result.Hosts {
+			for _, problem := range problems[host.Name] {
+				rows = append(rows, inventory.Host{Name: host.Name, Data: map[string]interface{}{"problem": problem.Error()}})
+			}
+		}
+		output.Wide = true
+		printOutput(output, rows)
+		logging.Errorf("%d of %d hosts have address problems; nothing was written", len(problems), len(result.Hosts))
+		os.Exit(1)
+	}
+	if len(problems) > 0 {
+		logging.Warnf("%d of %d hosts have address problems (see --check)", len(problems), len(result.Hosts))
+	}
+
+	var buf bytes.Buffer
+	if kind == "dns" {
+		err = inventory.WriteZone(&buf, entries, dns)
+	} else {
+		err = inventory.WriteHostsFile(&buf, entries)
+	}
+	if err != nil {
+		logging.Fatalf("Error writing output: %v", err)
+	}
+	if *file == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+	if err := inventory.WriteFileAtomic(*file, buf.Bytes()); err != nil {
+		logging.Fatalf("Error writing %s: %v", *file, err)
+	}
+	logging.Infof("Exported %d hosts to '%s'", len(entries), *file)
+}
+
+// handleExportSSH implements export ssh-config, which writes a Host block
+// per host for ~/.ssh/config, and export known-hosts, which writes the
+// host keys stored with the hosts as known_hosts lines. --probe checks the
+// ssh port of every host first, and comments or leaves out the ones that
+// do not answer.
+func handleExportSSH(inv *inventory.Inventory, kind string, args []string, output inventory.OutputOptions) {
+	fs := flag.NewFlagSet("export "+kind, flag.ExitOnError)
+	file := fs.String("file", "", "File to write to (default stdout)")
+	namePrefix := fs.String("name-prefix", "", "Only export hosts whose name starts with this prefix")
+	filterExpr := fs.String("filter", "", "Only export hosts matching this filter (see list --filter)")
+	whereExpr := fs.String("where", "", "Only export hosts matching this expression (see list --where)")
+	userField := fs.String("user-field", "ssh_user", "Field holding the user to log in as")
+	portField := fs.String("port-field", "ssh_port", "Field holding the ssh port")
+	jumpField := fs.String("jump-field", "ssh_jump", "Field holding the ProxyJump hosts")
+	hostKeyField := fs.String("host-key-field", "ssh_host_keys", "Field listing the host's public keys as \"type base64\" (known-hosts only)")
+	probe := fs.Bool("probe", false, "Check that the ssh port of each host accepts connections (hosts behind a ProxyJump are not checked)")
+	probeTimeout := fs.Duration("probe-timeout", 2*time.Second, "Timeout for each --probe connection")
+	probeWorkers := fs.Int("probe-workers", 32, "Most --probe connections made at a time")
+	unreachable := fs.String("unreachable", "annotate", "What --probe does with hosts that do not answer: annotate (with a comment) or exclude")
+	check := fs.Bool("check", false, "Report values ssh_config cannot hold and invalid ports and keys, and only write if there are none")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *probeWorkers < 1 || (*unreachable != "annotate" && *unreachable != "exclude") {
+		logging.Fatalf("Usage: export %s [--file F] [--check] [--probe [--unreachable annotate|exclude]] [--filter F] [--where E] (see also --address-field and the group vars of the fields)", kind)
+	}
+
+	opts := inventory.ListOptions{NamePrefix: *namePrefix}
+	var err error
+	if opts.Filter, err = inventory.ParseHostFilter(*filterExpr); err != nil {
+		logging.Fatalf("Invalid --filter: %v", err)
+	}
+	if *whereExpr != "" {
+		if opts.Where, err = query.Parse(*whereExpr); err != nil {
+			logging.Fatalf("Invalid --where: %v", err)
+		}
+	}
+	result, err := inv.ListHostsWithOptions(opts)
+	if err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+	inventory.WarnMalformed(result.Malformed)
+	groups, err := inv.ListGroups()
+	if err != nil {
+		logging.Fatalf("Error listing groups: %v", err)
+	}
+
+	ssh := inventory.SSHOptions{HostNameField: output.AddressField, UserField: *userField, PortField: *portField, JumpField: *jumpField, HostKeyField: *hostKeyField}
+	entries, problems := inventory.SSHHosts(result.Hosts, groups, ssh)
+	if *check && len(problems) > 0 {
+		var rows []inventory.Host
+		for _, host := range result.Hosts {
+			for _, problem := range problems[host.Name] {
+				rows = append(rows, inventory.Host{Name: host.Name, Data: map[string]interface{}{"problem": problem.Error()}})
+			}
+		}
+		output.Wide = true
+		printOutput(output, rows)
+		logging.Errorf("%d of %d hosts have ssh problems; nothing was written", len(problems), len(result.Hosts))
+		os.Exit(1)
+	}
+	if len(problems) > 0 {
+		logging.Warnf("%d of %d hosts have ssh problems (see --check)", len(problems), len(result.Hosts))
+	}
+
+	if *probe {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		failed := inventory.ProbeSSH(ctx, entries, *probeTimeout, *probeWorkers)
+		stop()
+		if ctx.Err() != nil {
+			logging.Fatal("Interrupted while probing; nothing was written")
+		}
+		kept := entries[:0]
+		for _, entry := range entries {
+			if err, ok := failed[entry.Host]; ok {
+				if *unreachable == "exclude" {
+					continue
+				}
+				entry.Comment = "unreachable: " + err.Error()
+			}
+			kept = append(kept, entry)
+		}
+		entries = kept
+		logging.Warnf("%d hosts did not answer on their ssh port", len(failed))
+	}
+
+	var buf bytes.Buffer
+	if kind == "ssh-config" {
+		err = inventory.WriteSSHConfig(&buf, entries)
+	} else {
+		err = inventory.WriteKnownHosts(&buf, entries)
+	}
+	if err != nil {
+		logging.Fatalf("Error writing output: %v", err)
+	}
+	if *file == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+	if err := inventory.WriteFileAtomic(*file, buf.Bytes()); err != nil {
+		logging.Fatalf("Error writing %s: %v", *file, err)
+	}
+	logging.Infof("Exported %d hosts to '%s'", len(entries), *file)
+}
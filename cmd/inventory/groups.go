@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"sort"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+)
+
+// handleGroups prints one row per distinct value of the --by field, with the
+// member host names, through the selected formatter.
+func handleGroups(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	fs := flag.NewFlagSet("groups", flag.ExitOnError)
+	by := fs.String("by", "", "Field to group hosts by")
+	fs.Parse(args)
+
+	if *by == "" {
+		logging.Fatal("Usage: groups --by <field>")
+	}
+
+	groups, err := inv.GroupBy(*by)
+	if err != nil {
+		logging.Fatalf("Error grouping hosts: %v", err)
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := make([]inventory.Host, 0, len(groups))
+	for _, name := range names {
+		members := make([]interface{}, 0, len(groups[name]))
+		for _, host := range groups[name] {
+			members = append(members, host.Name)
+		}
+		rows = append(rows, inventory.Host{Name: name, Data: map[string]interface{}{
+			"count": len(members),
+			"hosts": members,
+		}})
+	}
+	// The rows are summaries, not hosts, so show all their columns.
+	output.Wide = true
+	printOutput(output, rows)
+}
+
+// handleGroup implements the group subcommands: create a group, optionally
+// with variables given like host data, add hosts to or remove them from
+// it, and list the groups.
+func handleGroup(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	const usage = "Usage: group create <group> [<vars>] | group add-host|remove-host <group> <host_name> [host_name ...] | group list"
+	if len(args) < 1 {
+		logging.Fatal(usage)
+	}
+	action, args := args[0], args[1:]
+	switch {
+	case action == "create" && (len(args) == 1 || len(args) == 2):
+		var vars map[string]interface{}
+		if len(args) == 2 {
+			var err error
+			if vars, _, err = parseHostData(args[1]); err != nil {
+				logging.Fatalf("Failed to parse group variables: %v", err)
+			}
+		}
+		if err := inv.CreateGroup(args[0], vars); err != nil {
+			logging.Fatalf("Error creating group: %v", err)
+		}
+		logDone("Group '%s' created", args[0])
+	case action == "add-host" && len(args) >= 2:
+		if err := inv.AddGroupHosts(args[0], args[1:]...); err != nil {
+			logging.Fatalf("Error adding hosts to group: %v", err)
+		}
+		logDone("Added %d host(s) to group '%s'", len(args)-1, args[0])
+	case action == "remove-host" && len(args) >= 2:
+		if err := inv.RemoveGroupHosts(args[0], args[1:]...); err != nil {
+			logging.Fatalf("Error removing hosts from group: %v", err)
+		}
+		logDone("Removed %d host(s) from group '%s'", len(args)-1, args[0])
+	case action == "list" && len(args) == 0:
+		groups, err := inv.ListGroups()
+		if err != nil {
+			logging.Fatalf("Error listing groups: %v", err)
+		}
+		rows := make([]inventory.Host, len(groups))
+		for n, group := range groups {
+			members := make([]interface{}, len(group.Hosts))
+			for m, host := range group.Hosts {
+				members[m] = host
+			}
+			rows[n] = inventory.Host{Name: group.Name, Data: map[string]interface{}{
+				"count": len(members),
+				"hosts": members,
+			}}
+			if len(group.Vars) > 0 {
+				rows[n].Data["vars"] = group.Vars
+			}
+		}
+		// The rows are groups, not hosts, so show all their columns.
+		output.Wide = true
+		printOutput(output, rows)
+	default:
+		logging.Fatal(usage)
+	}
+}
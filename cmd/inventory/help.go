@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+)
+
+// subcommand describes a subcommand for help and shell completion. Those
+// with hosts set work on hosts and also answer as "inventory hosts <name>".
+type subcommand struct {
+	name    string
+	summary string
+	hosts   bool
+}
+
+// subcommands are the subcommands, in the order help lists them.
+var subcommands = []subcommand{
+	{"create", "Create a host from JSON data or field=value pairs", true},
+	{"update", "Set a field of a host, or replace its data", true},
+	{"set-default", "Set a field of a host unless it has one", true},
+	{"set", "Set fields on every host matching a filter", true},
+	{"bulk-update", "Set fields on every host matching a filter, in batched transactions", true},
+	{"edit", "Edit a host in $EDITOR", true},
+	{"clone", "Create a host as a copy of another", true},
+	{"rename", "Rename a host, keeping its data, lease and audit history", true},
+	{"tag", "Add, remove or list the tags of a host", true},
+	{"touch", "Bump updated_at and renew the TTL of hosts", true},
+	{"remove", "Remove a host, or the hosts matching a pattern or filter", true},
+	{"status", "Move a host through its lifecycle, or list archived hosts", true},
+	{"list", "List the hosts", true},
+	{"get", "Show hosts by name, or a host at a past revision", true},
+	{"get-field", "Print one field of a host", true},
+	{"describe", "Show a host with its metadata and field types", true},
+	{"exists", "Exit 0 if a host exists and 1 if not", true},
+	{"compare", "Show the fields two hosts differ in", true},
+	{"recent", "List the most recently changed hosts", true},
+	{"watch", "Stream changes to hosts", true},
+	{"history", "List the stored versions of a host", true},
+	{"values", "Count the hosts holding each value of a field", true},
+	{"groups", "Group the hosts by the value of a field", true},
+	{"find-duplicates", "Find hosts sharing the values of fields", true},
+	{"stats", "Describe each field across the hosts", true},
+	{"validate", "Check every host against the rules and the schema", true},
+	{"normalize", "Rewrite hosts whose stored JSON is not canonical", true},
+	{"prune-empty", "Delete the empty fields of every host", true},
+	{"export", "Export the hosts for import, or as a DNS zone or /etc/hosts", true},
+	{"import", "Import hosts from an export, JSON, YAML or CSV", true},
+	{"seed", "Create or remove generated hosts for demos and tests", true},
+	{"tui", "Browse and edit the hosts in the terminal", true},
+	{"group", "Manage named groups of hosts", false},
+	{"schema", "Store, show or remove the JSON Schema of host data", false},
+	{"ansible-inventory", "Print the hosts as an Ansible dynamic inventory", false},
+	{"prometheus", "Print the hosts as Prometheus service discovery targets", false},
+	{"serve", "Serve the hosts over HTTP or a Unix socket", false},
+	{"notify", "Send every change to the hosts to webhooks, NATS or Kafka", false},
+	{"local-cache", "Keep the --local-cache file current with a watch", false},
+	{"sync", "Reconcile the instances of a cloud provider or the nodes of a Kubernetes cluster into hosts", false},
+	{"namespace", "List or copy the named inventories", false},
+	{"auth", "Create, revoke or list the API tokens of serve --rbac", false},
+	{"snapshot", "Create, list, restore and diff snapshots of the inventory", false},
+	{"audit", "List the audit entries written with --audit", false},
+	{"keys", "Read raw etcd keys (keys iter)", false},
+	{"preflight", "Check the permissions of the etcd user", false},
+	{"maintenance", "Compact and defragment etcd", false},
+	{"use-context", "Select or list the cluster contexts", false},
+	{"completion", "Print a bash, zsh or fish completion script", false},
+	{"help", "Show the subcommands, or what one does", false},
+}
+
+// findSubcommand returns the subcommand named name.
+func findSubcommand(name string) (subcommand, bool) {
+	for _, sub := range subcommands {
+		if sub.name == name {
+			return sub, true
+		}
+	}
+	return subcommand{}, false
+}
+
+// unknownSubcommand reports a name that is not a subcommand, suggesting
+// the closest one.
+func unknownSubcommand(name string, hostsOnly bool) error {
+	var names []string
+	for _, sub := range subcommands {
+		if sub.hosts || !hostsOnly {
+			names = append(names, sub.name)
+		}
+	}
+	if hostsOnly {
+		return inventory.UnknownChoiceError("hosts subcommand", name, names)
+	}
+	return inventory.UnknownChoiceError("subcommand", name, names)
+}
+
+// printUsage is the usage of the inventory command: the subcommands, then
+// the global flags.
+func printUsage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintln(w, "Usage: inventory [global flags] <subcommand> [flags] [args]")
+	for _, hosts := range []bool{true, false} {
+		if hosts {
+			fmt.Fprintln(w, "\nHost subcommands (also as inventory hosts <subcommand>):")
+		} else {
+			fmt.Fprintln(w, "\nOther subcommands:")
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, sub := range subcommands {
+			if sub.hosts == hosts {
+				fmt.Fprintf(tw, "  %s\t%s\n", sub.name, sub.summary)
+			}
+		}
+		tw.Flush()
+	}
+	fmt.Fprintln(w, "\nRun 'inventory <subcommand> -h' for the flags of a subcommand.\n\nGlobal flags:")
+	flag.PrintDefaults()
+}
+
+// handleHelp prints the usage, or the summary of one subcommand.
+func handleHelp(args []string) {
+	if len(args) == 0 {
+		flag.CommandLine.SetOutput(os.Stdout)
+		printUsage()
+		return
+	}
+	sub, ok := findSubcommand(args[0])
+	if !ok {
+		logging.Fatal(unknownSubcommand(args[0], false))
+	}
+	fmt.Printf("inventory %s: %s\n", sub.name, sub.summary)
+	if sub.hosts {
+		fmt.Printf("Also run as 'inventory hosts %s'.\n", sub.name)
+	}
+	fmt.Printf("Run 'inventory %s -h' for its flags.\n", sub.name)
+}
+
+// completeHostsCommand is the hidden subcommand completion scripts run to
+// complete host names.
+const completeHostsCommand = "__complete-hosts"
+
+// bashCompletion completes subcommands, global flags and, after a
+// subcommand, host names. %[1]s is the subcommands, %[2]s the global
+// flags and %[3]s those of them that take a value.
+const bashCompletion = `# inventory completion for bash; source it, e.g. from ~/.bashrc:
+#   source <(inventory completion bash)
+_inventory() {
+	local cur=${COMP_WORDS[COMP_CWORD]} sub="" skip="" word
+	for word in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do
+		if [[ -n $skip ]]; then
+			skip=""
+			continue
+		fi
+		case " %[3]s " in
+		*" $word "*) skip=1; continue ;;
+		esac
+		case $word in
+		-* | hosts) ;;
+		*) sub=$word; break ;;
+		esac
+	done
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "%[2]s" -- "$cur"))
+	elif [[ -z $sub ]]; then
+		COMPREPLY=($(compgen -W "hosts %[1]s" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -W "$(inventory ` + completeHostsCommand + ` "$cur" 2>/dev/null)" -- "$cur"))
+	fi
+}
+complete -F _inventory inventory
+`
+
+// handleCompletion prints the completion script for a shell.
+func handleCompletion(args []string) {
+	if len(args) != 1 {
+		logging.Fatal("Usage: completion bash|zsh|fish")
+	}
+	var names, flags, valueFlags []string
+	for _, sub := range subcommands {
+		names = append(names, sub.name)
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, "--"+f.Name)
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+			valueFlags = append(valueFlags, "--"+f.Name)
+		}
+	})
+	bash := fmt.Sprintf(bashCompletion, strings.Join(names, " "), strings.Join(flags, " "), strings.Join(valueFlags, " "))
+	switch args[0] {
+	case "bash":
+		fmt.Print(bash)
+	case "zsh":
+		// zsh runs the bash script through its bash completion emulation.
+		fmt.Print("autoload -U +X bashcompinit && bashcompinit\n" + bash)
+	case "fish":
+		fmt.Println("complete -c inventory -f")
+		for _, sub := range append([]subcommand{{name: "hosts", summary: "The host subcommands"}}, subcommands...) {
+			fmt.Printf("complete -c inventory -n __fish_use_subcommand -a %s -d %s\n", sub.name, fishQuote(sub.summary))
+		}
+		flag.VisitAll(func(f *flag.Flag) {
+			usage, _ := flag.UnquoteUsage(f)
+			fmt.Printf("complete -c inventory -l %s -d %s\n", f.Name, fishQuote(strings.SplitN(usage, "\n", 2)[0]))
+		})
+		fmt.Printf("complete -c inventory -n 'not __fish_use_subcommand' -a '(inventory %s (commandline -ct) 2>/dev/null)'\n", completeHostsCommand)
+	default:
+		logging.Fatalf("Unknown shell %q. Use 'bash', 'zsh' or 'fish'.", args[0])
+	}
+}
+
+// fishQuote quotes s as a fish string.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// handleCompleteHosts prints the names of the hosts starting with the
+// prefix given, for completion scripts.
+func handleCompleteHosts(inv *inventory.Inventory, args []string) {
+	prefix := ""
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	names, err := inv.ListHostNames(prefix)
+	if err != nil {
+		os.Exit(1)
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+)
+
+// handleHistory prints one row per stored version of a host, newest first,
+// with the revision to pass to get --at-revision. etcd records no write
+// times, so the time column is the host's updated_at field where touch
+// has set it.
+func handleHistory(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	limit := fs.Int("limit", 0, "Show at most this many versions (0 for all)")
+	fromAudit := fs.Bool("audit", false, "Show the host's audit entries (see --audit) with who made each change, instead of the versions etcd still holds")
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) > 0 {
+		fs.Parse(args[1:])
+		args = append(args[:1], fs.Args()...)
+	}
+	if len(args) != 1 || *limit < 0 {
+		logging.Fatal("Usage: history <host_name> [--limit N] [--audit]")
+	}
+	if *fromAudit {
+		printAuditEntries(inv, inventory.AuditQuery{Host: args[0], Limit: *limit}, output)
+		return
+	}
+
+	versions, complete, err := inv.HostHistory(args[0], *limit)
+	if err != nil {
+		logging.Fatalf("Error reading history: %v", err)
+	}
+	rows := make([]inventory.Host, len(versions))
+	for n, version := range versions {
+		rows[n] = inventory.Host{
+			Name: args[0],
+			Data: map[string]interface{}{
+				"revision":               version.Revision,
+				"version":                version.Version,
+				inventory.UpdatedAtField: version.Host.Data[inventory.UpdatedAtField],
+				"data":                   version.Host.Data,
+			},
+			Order: []string{"revision", "version", inventory.UpdatedAtField, "data"},
+		}
+	}
+	// The rows are summaries, not hosts, so show all their columns.
+	output.Wide = true
+	printOutput(output, rows)
+	if !complete {
+		logging.Infof("Older versions are compacted or past --limit")
+	}
+}
+
+// handleAudit reads the audit entries written with --audit.
+func handleAudit(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	const usage = "Usage: audit list [--since T] [--until T] [--host H] [--actor A] [--limit N] (T is an RFC 3339 time or a duration ago, e.g. 24h)"
+	if len(args) == 0 || args[0] != "list" {
+		logging.Fatal(usage)
+	}
+	fs := flag.NewFlagSet("audit list", flag.ExitOnError)
+	since := fs.String("since", "", "Only show changes at or after this time")
+	until := fs.String("until", "", "Only show changes at or before this time")
+	host := fs.String("host", "", "Only show changes to this host")
+	actor := fs.String("actor", "", "Only show changes by this actor")
+	limit := fs.Int("limit", 0, "Show at most this many changes, the newest (0 for all)")
+	fs.Parse(args[1:])
+	if fs.NArg() != 0 || *limit < 0 {
+		logging.Fatal(usage)
+	}
+	q := inventory.AuditQuery{Host: *host, Actor: *actor, Limit: *limit}
+	now := time.Now()
+	var err error
+	if q.Since, err = parseTimeBound(*since, now); err != nil {
+		logging.Fatalf("Invalid --since: %v", err)
+	}
+	if q.Until, err = parseTimeBound(*until, now); err != nil {
+		logging.Fatalf("Invalid --until: %v", err)
+	}
+	printAuditEntries(inv, q, output)
+}
+
+// parseTimeBound reads an RFC 3339 time, or a duration meaning that long
+// before now. An empty value is the zero time.
+func parseTimeBound(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a duration", value)
+	}
+	return t, nil
+}
+
+// printAuditEntries prints one row per selected audit entry, newest first,
+// named after the changed host. JSON output has the whole entries,
+// including the data before and after each change.
+func printAuditEntries(inv *inventory.Inventory, q inventory.AuditQuery, output inventory.OutputOptions) {
+	entries, err := inv.AuditEntries(q)
+	if err != nil {
+		logging.Fatalf("Error reading audit entries: %v", err)
+	}
+	if output.Format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		if output.Indent(inventory.IsTerminal(os.Stdout)) {
+			enc.SetIndent("", "    ")
+		}
+		if err := enc.Encode(entries); err != nil {
+			logging.Fatalf("Error writing audit entries: %v", err)
+		}
+		return
+	}
+	rows := make([]inventory.Host, len(entries))
+	for n, entry := range entries {
+		rows[n] = inventory.Host{
+			Name: entry.Host,
+			Data: map[string]interface{}{
+				"time":           entry.Time.Format(time.RFC3339),
+				"actor":          entry.Actor,
+				"operation":      entry.Operation,
+				"fields_changed": strings.Join(entry.FieldsChanged, ","),
+				"revision":       entry.Revision,
+			},
+			Order: []string{"time", "actor", "operation", "fields_changed", "revision"},
+		}
+	}
+	// The rows are summaries, not hosts, so show all their columns.
+	output.Wide = true
+	printOutput(output, rows)
+}
@@ -0,0 +1,1029 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+)
+
+func handleCreate(inv *inventory.Inventory, args []string, results *resultReporter) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	ifNotExists := fs.Bool("if-not-exists", false, "Fail instead of overwriting an existing host")
+	updateOnly := fs.Bool("update-only", false, "Fail instead of creating a host that does not exist yet")
+	ttlFlag := fs.String("ttl", "", "Expire the host this long after it was written or last touched, as seconds or a duration (e.g. 3600 or 1h)")
+	heartbeat := fs.Bool("heartbeat", false, "With --ttl, keep renewing the host's lease until interrupted, registering it again if it expires")
+	fs.Parse(args)
+	args = fs.Args()
+
+	// With --key-field the name comes from the data, and may be omitted.
+	keyed := len(inv.KeyFields) > 0
+	if !(len(args) == 2 || keyed && len(args) == 1) || (*ifNotExists && *updateOnly) || (*heartbeat && *ttlFlag == "") {
+		logging.Fatal("Usage: create [--if-not-exists|--update-only] [--ttl T [--heartbeat]] <host_name> <host_data> (with --key-field: create [--update-only] [--ttl T [--heartbeat]] [<host_name>] <host_data>)")
+	}
+	var ttl time.Duration
+	if *ttlFlag != "" {
+		var err error
+		if ttl, err = parseTTL(*ttlFlag); err != nil {
+			logging.Fatalf("Invalid --ttl: %v", err)
+		}
+	}
+
+	hostDataStr := args[len(args)-1]
+	hostData, order, err := parseHostData(hostDataStr)
+	if err != nil {
+		logging.Fatalf("Failed to parse host data: %v", err)
+	}
+	var hostName string
+	if keyed {
+		if hostName, err = inv.KeyName(hostData); err != nil {
+			logging.Fatalf("Invalid host: %v", err)
+		}
+		if len(args) == 2 && args[0] != hostName {
+			logging.Fatalf("Invalid host: name %s does not match its key fields, which give %s", args[0], hostName)
+		}
+		// Keys must be unique: two hosts with the same key fields are the
+		// same host, so a create never overwrites.
+		*ifNotExists = !*updateOnly
+	} else {
+		hostName = args[0]
+	}
+	host := inventory.Host{Name: hostName, Data: hostData}
+	if inv.PreserveOrder {
+		host.Order = order
+	}
+
+	if problems := inv.ValidateHost(host); len(problems) > 0 {
+		for _, problem := range problems {
+			logging.Errorf("Invalid host '%s': %v", hostName, problem)
+		}
+		os.Exit(1)
+	}
+
+	overwrote := false
+	switch {
+	case *ifNotExists && ttl > 0:
+		err = inv.CreateWithTTL(host, ttl)
+	case *ifNotExists:
+		err = inv.Create(host)
+	case *updateOnly && ttl > 0:
+		overwrote = true
+		err = inv.ReplaceWithTTL(host, ttl)
+	case *updateOnly:
+		overwrote = true
+		err = inv.Replace(host)
+	case ttl > 0:
+		overwrote, err = inv.PutWithTTL(host, ttl)
+	default:
+		overwrote, err = inv.Put(host)
+	}
+	if err != nil {
+		logging.Fatalf("Error creating host: %v", err)
+	}
+	if overwrote {
+		results.report(hostName, "updated", fmt.Sprintf("Host '%s' updated (overwrote existing)", hostName))
+	} else {
+		results.report(hostName, "created", fmt.Sprintf("Host '%s' created successfully!", hostName))
+	}
+	if *heartbeat {
+		keepAlive(inv, hostName, func() error {
+			_, err := inv.PutWithTTL(host, ttl)
+			return err
+		})
+	}
+}
+
+// parseTTL reads a TTL given as whole seconds or as a duration.
+func parseTTL(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		value = strconv.FormatInt(seconds, 10) + "s"
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if ttl < time.Second {
+		return 0, fmt.Errorf("%s is shorter than a second", value)
+	}
+	return ttl, nil
+}
+
+// heartbeatRetry is how long keepAlive waits before registering a host
+// again after its lease was lost.
+const heartbeatRetry = 5 * time.Second
+
+// keepAlive renews the lease of hostName until SIGINT or SIGTERM, leaving
+// the host to expire after its TTL once the process is gone. If the lease
+// is lost, it calls register to write the host again with a new one, or
+// exits if register is nil.
+func keepAlive(inv *inventory.Inventory, hostName string, register func() error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	logging.Infof("Keeping host '%s' alive until interrupted", hostName)
+	for {
+		err := inv.KeepHostAlive(ctx, hostName)
+		if err == nil {
+			return
+		}
+		if register == nil {
+			logging.Fatalf("Error keeping host alive: %v", err)
+		}
+		logging.Warnf("%v; registering host '%s' again", err, hostName)
+		for err = register(); err != nil; err = register() {
+			logging.Errorf("Error registering host '%s': %v", hostName, err)
+			select {
+			case <-time.After(heartbeatRetry):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func handleClone(inv *inventory.Inventory, args []string) {
+	fs := flag.NewFlagSet("clone", flag.ExitOnError)
+	force := fs.Bool("force", false, "Overwrite the destination host if it exists")
+	var sets stringList
+	fs.Var(&sets, "set", "Set a field of the new host, as field=value (repeatable; same as the trailing field=value arguments)")
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) < 2 {
+		logging.Fatal("Usage: clone [--force] [--set field=value]... <source_host> <new_host> [field=value ...]")
+	}
+	srcName, dstName := args[0], args[1]
+	if err := inventory.ValidateHostName(dstName); err != nil {
+		logging.Fatalf("Invalid host '%s': %v", dstName, err)
+	}
+	overrides := make(map[string]string)
+	for _, arg := range append(sets, args[2:]...) {
+		field, value, ok := strings.Cut(arg, "=")
+		if !ok || strings.TrimSpace(field) == "" {
+			logging.Fatalf("Invalid override %q: expected field=value", arg)
+		}
+		overrides[field] = value
+	}
+
+	if err := inv.CopyHost(srcName, dstName, overrides, *force); err != nil {
+		logging.Fatalf("Error cloning host: %v", err)
+	}
+	logDone("Host '%s' cloned to '%s' successfully!", srcName, dstName)
+}
+
+func handleRename(inv *inventory.Inventory, args []string) {
+	if len(args) != 2 {
+		logging.Fatal("Usage: rename <old_host> <new_host>")
+	}
+	oldName, newName := args[0], args[1]
+	if err := inventory.ValidateHostName(newName); err != nil {
+		logging.Fatalf("Invalid host '%s': %v", newName, err)
+	}
+	if err := inv.RenameHost(oldName, newName); err != nil {
+		logging.Fatalf("Error renaming host: %v", err)
+	}
+	logDone("Host '%s' renamed to '%s' successfully!", oldName, newName)
+}
+
+// parseHostData detects the format of host data (JSON object, XML element
+// with one child per field, or whitespace-separated key=value pairs) and
+// parses it accordingly.
+// parseHostData parses host data given as a JSON object, XML elements or
+// key=value pairs, and returns the fields in the order they were given.
+func parseHostData(hostDataStr string) (map[string]interface{}, []string, error) {
+	hostDataStr = strings.TrimSpace(hostDataStr)
+	switch {
+	case strings.HasPrefix(hostDataStr, "{") && strings.HasSuffix(hostDataStr, "}"):
+		hostData := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(hostDataStr), &hostData); err != nil {
+			return nil, nil, err
+		}
+		order, err := jsonKeyOrder([]byte(hostDataStr))
+		return hostData, order, err
+
+	case strings.Contains(hostDataStr, "<") && strings.Contains(hostDataStr, ">"):
+		var root struct {
+			Fields []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		}
+		if err := xml.Unmarshal([]byte(hostDataStr), &root); err != nil {
+			return nil, nil, err
+		}
+		hostData := make(map[string]interface{})
+		var order []string
+		for _, field := range root.Fields {
+			hostData[field.XMLName.Local] = field.Value
+			order = append(order, field.XMLName.Local)
+		}
+		return hostData, order, nil
+
+	default:
+		hostData := make(map[string]interface{})
+		var order []string
+		for _, item := range strings.Fields(hostDataStr) {
+			key, value, ok := strings.Cut(item, "=")
+			if !ok {
+				return nil, nil, fmt.Errorf("expected key=value, got %q", item)
+			}
+			hostData[key] = value
+			order = append(order, key)
+		}
+		return hostData, order, nil
+	}
+}
+
+// jsonKeyOrder returns the keys of a JSON object in document order.
+func jsonKeyOrder(b []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, token.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func handleUpdate(inv *inventory.Inventory, args []string, results *resultReporter) {
+	const usage = "Usage: update [--if-revision N] [--type T] <host_name> <field_path> <field_value> | update [--if-revision N] [--type T] <host_name> <field_path>=<field_value> | update [--if-revision N] <host_name> --patch <json|@path> (a value of @path reads the file; a field path may be nested, e.g. network.interfaces[0].ip)"
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	patch := fs.String("patch", "", "Apply a JSON merge patch (RFC 7386) to the host's data; null values delete keys")
+	valueType := fs.String("type", "string", "Store the value as this type: "+strings.Join(inventory.ValueTypes, ", ")+" (auto infers numbers, booleans, null and JSON)")
+	ifRevision := fs.Int64("if-revision", 0, "Only update if the host is still at this etcd revision (as reported by recent, export --with-revisions or json results)")
+	fs.Parse(args)
+	args = fs.Args()
+	// Allow the flag after the host name too: update web01 --patch @x.json
+	if len(args) > 0 {
+		fs.Parse(args[1:])
+		args = append(args[:1], fs.Args()...)
+	}
+
+	if *patch != "" {
+		if len(args) != 1 {
+			logging.Fatal(usage)
+		}
+		handlePatch(inv, args[0], *patch, *ifRevision, results)
+		return
+	}
+
+	var hostName, fieldName, rawValue string
+	switch len(args) {
+	case 3:
+		hostName, fieldName, rawValue = args[0], args[1], args[2]
+	case 2:
+		var ok bool
+		hostName = args[0]
+		if fieldName, rawValue, ok = strings.Cut(args[1], "="); !ok {
+			logging.Fatal(usage)
+		}
+	default:
+		logging.Fatal(usage)
+	}
+
+	if strings.TrimSpace(fieldName) == "" {
+		logging.Fatal("Field name must not be empty")
+	}
+
+	fieldValue, err := readFieldValue(rawValue)
+	if err != nil {
+		logging.Fatalf("Error reading value for field '%s': %v", fieldName, err)
+	}
+	if text, ok := fieldValue.(string); ok {
+		if fieldValue, err = inventory.ParseTypedValue(text, *valueType); err != nil {
+			logging.Fatalf("Invalid value for field '%s': %v", fieldName, err)
+		}
+	}
+
+	err = inv.UpdateHostFieldValueIfRevision(hostName, fieldName, fieldValue, *ifRevision)
+	if err != nil {
+		logging.Fatalf("Error updating host field: %v", err)
+	}
+	results.report(hostName, "updated", fmt.Sprintf("Field '%s' for host '%s' updated successfully!", fieldName, hostName))
+}
+
+// handleSetDefault sets a field only if the host lacks it, leaving a value
+// already there alone.
+func handleSetDefault(inv *inventory.Inventory, args []string) {
+	if len(args) != 3 || strings.TrimSpace(args[1]) == "" {
+		logging.Fatal("Usage: set-default <host_name> <field_name> <field_value> (a value of @path reads the file)")
+	}
+	hostName, fieldName := args[0], args[1]
+	fieldValue, err := readFieldValue(args[2])
+	if err != nil {
+		logging.Fatalf("Error reading value for field '%s': %v", fieldName, err)
+	}
+	set, err := inv.SetFieldIfAbsent(hostName, fieldName, fieldValue)
+	if err != nil {
+		logging.Fatalf("Error setting default: %v", err)
+	}
+	if !set {
+		logging.Infof("Field '%s' for host '%s' is already set; left unchanged", fieldName, hostName)
+		return
+	}
+	logDone("Field '%s' for host '%s' set to the default", fieldName, hostName)
+}
+
+func handlePatch(inv *inventory.Inventory, hostName, arg string, modRevision int64, results *resultReporter) {
+	content := []byte(arg)
+	if path, ok := strings.CutPrefix(arg, "@"); ok {
+		var err error
+		if content, err = os.ReadFile(path); err != nil {
+			logging.Fatalf("Error reading patch: %v", err)
+		}
+	}
+	var patch map[string]interface{}
+	if err := json.Unmarshal(content, &patch); err != nil {
+		logging.Fatalf("Patch must be a JSON object: %v", err)
+	}
+	if err := inv.PatchHostDataIfRevision(hostName, patch, modRevision); err != nil {
+		logging.Fatalf("Error patching host: %v", err)
+	}
+	results.report(hostName, "updated", fmt.Sprintf("Host '%s' patched successfully!", hostName))
+}
+
+// readFieldValue resolves a command-line field value. "@path" stands for the
+// contents of the file: parsed JSON for a .json file, a string for text, or
+// []byte (stored as base64) for binary content. "@@..." escapes a literal
+// leading "@".
+func readFieldValue(arg string) (interface{}, error) {
+	if strings.HasPrefix(arg, "@@") {
+		return arg[1:], nil
+	}
+	path, ok := strings.CutPrefix(arg, "@")
+	if !ok {
+		return arg, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var value interface{}
+		if err := json.Unmarshal(content, &value); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return value, nil
+	}
+	if !utf8.Valid(content) {
+		return content, nil
+	}
+	return string(content), nil
+}
+
+// handleGet prints one host in the selected output format.
+func handleGet(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	const usage = "Usage: get <host_name> [--at-revision N] | get <host_name>... | get --names-file <file>"
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	atRevision := fs.Int64("at-revision", 0, "Show the host as it was at this etcd revision (see history)")
+	namesFile := fs.String("names-file", "", "File listing the hosts to get, one per line (# comments allowed; - for stdin)")
+	failOnEmpty := fs.Bool("fail-on-empty", false, fmt.Sprintf("Exit with status %d if none of the hosts exist", exitEmpty))
+	showKey := fs.Bool("show-key", false, "Add a _key field with each host's full etcd key")
+	fs.Parse(args)
+	args = fs.Args()
+	// Allow the flag after the host name too: get web01 --at-revision 42
+	if len(args) > 0 {
+		fs.Parse(args[1:])
+		args = append(args[:1], fs.Args()...)
+	}
+	if *showKey {
+		output.Columns = append(output.Columns, inventory.KeyField)
+	}
+	if *namesFile != "" || len(args) > 1 {
+		if *atRevision != 0 {
+			logging.Fatal(usage)
+		}
+		handleGetMany(inv, args, *namesFile, output, *failOnEmpty, *showKey)
+		return
+	}
+	if len(args) != 1 || *atRevision < 0 {
+		logging.Fatal(usage)
+	}
+
+	var host inventory.Host
+	var err error
+	if *atRevision > 0 {
+		var version inventory.HostVersion
+		version, err = inv.GetHostAt(args[0], *atRevision)
+		host = version.Host
+	} else {
+		host, err = inv.GetHost(args[0])
+	}
+	if *failOnEmpty && errors.Is(err, inventory.ErrHostNotFound) {
+		printOutput(output, []inventory.Host{})
+		logging.Errorf("Host '%s' not found", args[0])
+		os.Exit(exitEmpty)
+	}
+	if err != nil {
+		logging.Fatalf("Error getting host: %v", err)
+	}
+	if host.Name == "" {
+		host.Name = args[0]
+	}
+	if *showKey {
+		addEtcdKeys(inv, []inventory.Host{host})
+	}
+	printOutput(output, []inventory.Host{host})
+}
+
+// addEtcdKeys sets inventory.KeyField on each host to its full etcd key,
+// for get --show-key.
+func addEtcdKeys(inv *inventory.Inventory, hosts []inventory.Host) {
+	for n := range hosts {
+		if hosts[n].Data == nil {
+			hosts[n].Data = make(map[string]interface{})
+		}
+		hosts[n].Data[inventory.KeyField] = inv.EtcdKey(hosts[n].Name)
+	}
+}
+
+// handleGetMany prints the hosts named by args and the names file in one
+// listing, reporting the missing ones on stderr and exiting nonzero after
+// printing the rest. With failOnEmpty, finding none of them exits with
+// exitEmpty instead.
+func handleGetMany(inv *inventory.Inventory, names []string, namesFile string, output inventory.OutputOptions, failOnEmpty, showKey bool) {
+	if namesFile != "" {
+		fileNames, err := readNamesFile(namesFile)
+		if err != nil {
+			logging.Fatalf("Error reading names file: %v", err)
+		}
+		names = append(names, fileNames...)
+	}
+	hosts, err := inv.GetHosts(names)
+	var missing *inventory.MissingHostsError
+	if err != nil && !errors.As(err, &missing) {
+		logging.Fatalf("Error getting hosts: %v", err)
+	}
+	if showKey {
+		addEtcdKeys(inv, hosts)
+	}
+	printOutput(output, hosts)
+	if missing != nil {
+		for _, name := range missing.Names {
+			logging.Errorf("Host '%s' not found", name)
+		}
+		failIfEmpty(failOnEmpty, len(hosts))
+		os.Exit(1)
+	}
+	failIfEmpty(failOnEmpty, len(hosts))
+}
+
+// exitEmpty is the exit status of --fail-on-empty, distinct from the 1 of
+// errors so monitoring can tell "found nothing" from "could not look".
+const exitEmpty = 3
+
+// failIfEmpty exits with exitEmpty if failOnEmpty is set and count hosts,
+// already printed, is zero.
+func failIfEmpty(failOnEmpty bool, count int) {
+	if failOnEmpty && count == 0 {
+		logging.Infof("No hosts found")
+		os.Exit(exitEmpty)
+	}
+}
+
+// readNamesFile reads one host name per line, skipping blank lines and
+// lines starting with #. A path of "-" reads stdin.
+func readNamesFile(path string) ([]string, error) {
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var names []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names, scanner.Err()
+}
+
+// handleCompare prints the field-level differences between two hosts and,
+// like diff(1), exits 1 if there are any.
+func handleCompare(inv *inventory.Inventory, args []string, reveal bool) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	ignoreFields := fs.String("ignore-fields", "", "Comma-separated fields to leave out of the comparison")
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) != 2 {
+		logging.Fatal("Usage: compare [--ignore-fields f1,f2] <host_a> <host_b>")
+	}
+	a, err := inv.GetHost(args[0])
+	if err != nil {
+		logging.Fatalf("Error getting host: %v", err)
+	}
+	b, err := inv.GetHost(args[1])
+	if err != nil {
+		logging.Fatalf("Error getting host: %v", err)
+	}
+	for _, field := range inventory.SplitList(*ignoreFields) {
+		delete(a.Data, field)
+		delete(b.Data, field)
+	}
+
+	var onlyA, onlyB, differ []string
+	for _, field := range inventory.ChangedFields(a.Data, b.Data) {
+		_, inA := a.Data[field]
+		_, inB := b.Data[field]
+		switch {
+		case !inB:
+			onlyA = append(onlyA, field)
+		case !inA:
+			onlyB = append(onlyB, field)
+		default:
+			differ = append(differ, field)
+		}
+	}
+	if len(onlyA)+len(onlyB)+len(differ) == 0 {
+		fmt.Printf("Hosts '%s' and '%s' are identical\n", args[0], args[1])
+		return
+	}
+	if !reveal {
+		// Secrets are compared as stored but printed masked.
+		masked, _ := inv.MaskSecrets([]inventory.Host{a, b})
+		a, b = masked[0], masked[1]
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, section := range []struct {
+		title  string
+		fields []string
+		host   inventory.Host
+	}{
+		{"Only in " + args[0], onlyA, a},
+		{"Only in " + args[1], onlyB, b},
+	} {
+		if len(section.fields) == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "%s:\n", section.title)
+		for _, field := range section.fields {
+			fmt.Fprintf(tw, "  %s:\t%s\n", field, inventory.FormatValue(section.host.Data[field]))
+		}
+	}
+	if len(differ) > 0 {
+		fmt.Fprintf(tw, "Different:\t%s\t%s\n", args[0], args[1])
+		for _, field := range differ {
+			fmt.Fprintf(tw, "  %s:\t%s\t%s\n", field, inventory.FormatValue(a.Data[field]), inventory.FormatValue(b.Data[field]))
+		}
+	}
+	tw.Flush()
+	os.Exit(1)
+}
+
+// handleGetField prints a single field value, raw and newline-terminated,
+// for use in shell substitutions.
+func handleGetField(inv *inventory.Inventory, args []string, reveal bool) {
+	if len(args) != 2 {
+		logging.Fatal("Usage: get-field <host_name> <field_name>")
+	}
+	value, err := inv.GetHostField(args[0], args[1])
+	if err != nil {
+		logging.Fatalf("Error getting field: %v", err)
+	}
+	// Printing a mask instead would hand scripts a wrong value.
+	if !reveal && inv.IsSecret(args[1], value) {
+		logging.Fatalf("Field %s is secret; pass --reveal-secrets to print it", args[1])
+	}
+	if b, ok := value.([]byte); ok {
+		os.Stdout.Write(b)
+		return
+	}
+	fmt.Println(inventory.FormatValue(value))
+}
+
+// handleDescribe prints one host vertically: its etcd metadata, then each
+// field with its value and type.
+func handleDescribe(inv *inventory.Inventory, args []string, timeFormat inventory.TimeFormat, reveal bool) {
+	if len(args) != 1 {
+		logging.Fatal("Usage: describe <host_name>")
+	}
+	host, err := inv.GetHost(args[0])
+	if err != nil {
+		logging.Fatalf("Error getting host: %v", err)
+	}
+	if !reveal {
+		masked, _ := inv.MaskSecrets([]inventory.Host{host})
+		host = masked[0]
+	}
+	meta, err := inv.GetHostMeta(args[0])
+	if err != nil {
+		logging.Fatalf("Error getting host metadata: %v", err)
+	}
+
+	lease := "none"
+	if meta.Lease != 0 {
+		lease = fmt.Sprintf("%x (%ds remaining)", meta.Lease, meta.TTL)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Name:\t%s\n", args[0])
+	fmt.Fprintf(tw, "Key:\t%s\n", meta.Key)
+	fmt.Fprintf(tw, "Created at revision:\t%d\n", meta.CreateRevision)
+	fmt.Fprintf(tw, "Modified at revision:\t%d\n", meta.ModRevision)
+	fmt.Fprintf(tw, "Version:\t%d\n", meta.Version)
+	fmt.Fprintf(tw, "Lease:\t%s\n", lease)
+	tw.Flush()
+
+	fmt.Println("Fields:")
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, field := range inventory.FieldNames([]inventory.Host{host}) {
+		value := host.Data[field]
+		fmt.Fprintf(tw, "  %s:\t%s\t(%s)\n", field, timeFormat.Format(value), inventory.TypeName(value))
+	}
+	tw.Flush()
+
+	if len(inv.VirtualFields) == 0 {
+		return
+	}
+	transform, err := inv.VirtualFields.Transform()
+	if err == nil {
+		var computed []inventory.Host
+		if computed, err = transform([]inventory.Host{host}); err == nil {
+			host = computed[0]
+		}
+	}
+	if err != nil {
+		logging.Fatalf("Error computing virtual fields: %v", err)
+	}
+	fmt.Println("Virtual fields (computed, not stored):")
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	virtual := make([]string, 0, len(inv.VirtualFields))
+	for field := range inv.VirtualFields {
+		virtual = append(virtual, field)
+	}
+	sort.Strings(virtual)
+	for _, field := range virtual {
+		fmt.Fprintf(tw, "  %s:\t%s\n", field, timeFormat.Format(host.Data[field]))
+	}
+	tw.Flush()
+}
+
+// handleExists exits 0 if the host exists and 1 if it does not, printing
+// nothing unless --verbose. Errors exit with 2 so scripts can tell them
+// apart from absence.
+func handleExists(inv *inventory.Inventory, args []string) {
+	fs := flag.NewFlagSet("exists", flag.ExitOnError)
+	verbose := fs.Bool("verbose", false, "Print whether the host exists")
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) != 1 {
+		logging.Fatal("Usage: exists [--verbose] <host_name>")
+	}
+	exists, err := inv.HostExists(args[0])
+	if err != nil {
+		logging.Errorf("Error checking host: %v", err)
+		os.Exit(2)
+	}
+	if *verbose {
+		if exists {
+			fmt.Printf("Host '%s' exists\n", args[0])
+		} else {
+			fmt.Printf("Host '%s' does not exist\n", args[0])
+		}
+	}
+	if !exists {
+		os.Exit(1)
+	}
+}
+
+func handleRemove(inv *inventory.Inventory, args []string, results *resultReporter) {
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	force := fs.Bool("force", false, "Remove without asking for confirmation")
+	yes := fs.Bool("yes", false, "Assume yes to the confirmation prompt (for scripts)")
+	match := fs.String("match", "", "Remove every host whose name matches this glob (e.g. 'test-*'); requires --yes")
+	filterExpr := fs.String("filter", "", "Remove every host matching this filter (see list --filter); requires --yes")
+	dryRun := fs.Bool("dry-run", false, "With --match or --filter, only list the hosts that would be removed")
+	ifRevision := fs.Int64("if-revision", 0, "Only remove the host if it is still at this etcd revision")
+	purge := fs.Bool("purge", false, "Delete decommissioned hosts too, instead of moving them to the archive")
+	fs.Parse(args)
+	args = fs.Args()
+
+	if *match != "" || *filterExpr != "" {
+		if len(args) != 0 || *ifRevision != 0 {
+			logging.Fatal("Usage: remove (--match <glob> | --filter <expr>) [--purge] [--dry-run] --yes")
+		}
+		removeMatching(inv, *match, *filterExpr, *dryRun, *yes || *force, *purge, results)
+		return
+	}
+	if len(args) != 1 {
+		logging.Fatal("Usage: remove [--force|--yes] [--purge] [--if-revision N] <host_name>")
+	}
+	hostName := args[0]
+
+	if !*force && !*yes {
+		if !inventory.IsTerminal(os.Stdin) {
+			logging.Fatal("Refusing to remove without confirmation: stdin is not a terminal (use --yes)")
+		}
+		if !confirm(fmt.Sprintf("Remove host '%s'?", hostName)) {
+			logging.Infof("Host '%s' not removed", hostName)
+			return
+		}
+	}
+
+	archived, err := inv.DeleteHost(hostName, *ifRevision, *purge)
+	if errors.Is(err, inventory.ErrHostNotFound) {
+		results.report(hostName, "not_found", fmt.Sprintf("Host '%s' not found; nothing removed", hostName))
+		return
+	}
+	if err != nil {
+		logging.Fatalf("Error removing host: %v", err)
+	}
+	if archived {
+		results.report(hostName, "archived", fmt.Sprintf("Host '%s' is decommissioned and was moved to the archive (use --purge to delete it)", hostName))
+		return
+	}
+	results.report(hostName, "removed", fmt.Sprintf("Host '%s' removed successfully!", hostName))
+}
+
+func removeMatching(inv *inventory.Inventory, pattern, filterExpr string, dryRun, yes, purge bool, results *resultReporter) {
+	filter, err := inventory.ParseHostFilter(filterExpr)
+	if err != nil {
+		logging.Fatalf("Invalid --filter: %v", err)
+	}
+	names, err := inv.HostNamesMatching(pattern, filter)
+	if err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+	if dryRun {
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		logging.Infof("%d hosts would be removed", len(names))
+		return
+	}
+	if !yes {
+		logging.Fatalf("Refusing to remove %d hosts without --yes (use --dry-run to preview)", len(names))
+	}
+	deleted, archived, err := inv.DeleteHosts(names, purge)
+	if err != nil {
+		logging.Fatalf("Error removing hosts after %d removed and %d archived: %v", deleted, archived, err)
+	}
+	if archived > 0 {
+		results.reportAll("removed", fmt.Sprintf("Removed %d hosts and archived %d decommissioned ones", deleted, archived))
+		return
+	}
+	results.reportAll("removed", fmt.Sprintf("Removed %d hosts", deleted))
+}
+
+// handleStatus moves a host to a lifecycle state, or lists the hosts
+// removed while decommissioned.
+func handleStatus(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	const usage = "Usage: status set <host_name> <provisioning|active|maintenance|decommissioned> | status archived"
+	if len(args) == 0 {
+		logging.Fatal(usage)
+	}
+	switch args[0] {
+	case "set":
+		if len(args) != 3 {
+			logging.Fatal(usage)
+		}
+		status, err := inventory.ParseHostStatus(args[2])
+		if err != nil {
+			logging.Fatal(err)
+		}
+		from, err := inv.SetHostStatus(args[1], status)
+		if err != nil {
+			logging.Fatalf("Error setting status: %v", err)
+		}
+		if from == "" {
+			from = "none"
+		}
+		logDone("Host '%s' is now %s (was %s)", args[1], status, from)
+	case "archived":
+		if len(args) != 1 {
+			logging.Fatal(usage)
+		}
+		hosts, err := inv.ArchivedHosts()
+		if err != nil {
+			logging.Fatalf("Error listing archived hosts: %v", err)
+		}
+		printOutput(output, hosts)
+	default:
+		logging.Fatal(usage)
+	}
+}
+
+// mutationResult is what the mutating subcommands print with --output
+// json. Status is created, updated, removed or not_found; Revision is the
+// etcd revision of the write, and 0 if nothing was written.
+type mutationResult struct {
+	Operation     string   `json:"operation"`
+	Host          string   `json:"host"`
+	Status        string   `json:"status"`
+	Revision      int64    `json:"revision"`
+	FieldsChanged []string `json:"fields_changed"`
+}
+
+// resultReporter collects the writes of a mutating subcommand to print
+// them as mutationResults. A nil resultReporter logs the human message
+// with logDone instead.
+type resultReporter struct {
+	operation string
+	compact   bool
+	mutations []inventory.Mutation
+}
+
+func newResultReporter(inv *inventory.Inventory, operation string, output inventory.OutputOptions) *resultReporter {
+	r := &resultReporter{operation: operation, compact: !output.Indent(inventory.IsTerminal(os.Stdout))}
+	inv.OnMutation(func(m inventory.Mutation) {
+		r.mutations = append(r.mutations, m)
+	})
+	return r
+}
+
+// report prints the result of the command on hostName, taking the
+// revision and changed fields from its last write of the host.
+func (r *resultReporter) report(hostName, status, message string) {
+	if r == nil {
+		logDone("%s", message)
+		return
+	}
+	result := mutationResult{Operation: r.operation, Host: hostName, Status: status, FieldsChanged: []string{}}
+	for _, m := range r.mutations {
+		if m.Host == hostName {
+			result.Revision, result.FieldsChanged = m.Revision, m.FieldsChanged
+		}
+	}
+	r.print(result)
+}
+
+// reportAll prints an array with one result per host written, for the
+// commands that change many hosts.
+func (r *resultReporter) reportAll(status, message string) {
+	if r == nil {
+		logDone("%s", message)
+		return
+	}
+	results := make([]mutationResult, 0, len(r.mutations))
+	for _, m := range r.mutations {
+		results = append(results, mutationResult{Operation: r.operation, Host: m.Host, Status: status, Revision: m.Revision, FieldsChanged: m.FieldsChanged})
+	}
+	r.print(results)
+}
+
+func (r *resultReporter) print(v interface{}) {
+	var b []byte
+	var err error
+	if r.compact {
+		b, err = json.Marshal(v)
+	} else {
+		b, err = json.MarshalIndent(v, "", "    ")
+	}
+	if err != nil {
+		logging.Fatalf("Error writing result: %v", err)
+	}
+	fmt.Println(string(b))
+}
+
+// confirm asks a yes/no question on stderr and reads the answer from stdin,
+// defaulting to no.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// handleTag manages a host's tags: tag add|remove <host> <tag>... or tag
+// list <host>.
+func handleTag(inv *inventory.Inventory, args []string) {
+	const usage = "Usage: tag add|remove <host_name> <tag> [tag ...] | tag list <host_name>"
+	if len(args) < 2 {
+		logging.Fatal(usage)
+	}
+	action, hostName, tags := args[0], args[1], args[2:]
+	var result []string
+	var err error
+	switch {
+	case action == "add" && len(tags) > 0:
+		result, err = inv.AddTags(hostName, tags...)
+	case action == "remove" && len(tags) > 0:
+		result, err = inv.RemoveTags(hostName, tags...)
+	case action == "list" && len(tags) == 0:
+		host, err := inv.GetHost(hostName)
+		if err != nil {
+			logging.Fatalf("Error getting host: %v", err)
+		}
+		result = inventory.HostTags(host)
+		sort.Strings(result)
+	default:
+		logging.Fatal(usage)
+	}
+	if err != nil {
+		logging.Fatalf("Error updating tags: %v", err)
+	}
+	for _, tag := range result {
+		fmt.Println(tag)
+	}
+}
+
+// handleTouch bumps updated_at and renews the lease of one host, or of every
+// host matching --filter.
+func handleTouch(inv *inventory.Inventory, args []string) {
+	const usage = "Usage: touch [--heartbeat] <host_name> | touch --filter <expr> [--dry-run]"
+	fs := flag.NewFlagSet("touch", flag.ExitOnError)
+	filterExpr := fs.String("filter", "", "Touch every host matching field=value, field!=value or field in CIDR (comma-separated)")
+	dryRun := fs.Bool("dry-run", false, "Only list the hosts that would be touched")
+	heartbeat := fs.Bool("heartbeat", false, "After touching the host, keep renewing its lease until interrupted (for hosts created with --ttl)")
+	bulk := addBulkFlags(fs)
+	fs.Parse(args)
+	args = fs.Args()
+
+	if *filterExpr == "" {
+		if len(args) != 1 {
+			logging.Fatal(usage)
+		}
+		renewed, err := inv.TouchHost(args[0])
+		if err != nil {
+			logging.Fatalf("Error touching host: %v", err)
+		}
+		if renewed {
+			logDone("Host '%s' touched and its lease renewed", args[0])
+		} else {
+			logDone("Host '%s' touched", args[0])
+		}
+		if *heartbeat {
+			keepAlive(inv, args[0], nil)
+		}
+		return
+	}
+	if *heartbeat {
+		logging.Fatal("--heartbeat keeps a single host alive and cannot be combined with --filter")
+	}
+	if len(args) != 0 {
+		logging.Fatal(usage)
+	}
+	filter, err := inventory.ParseHostFilter(*filterExpr)
+	if err != nil {
+		logging.Fatalf("Invalid --filter: %v", err)
+	}
+	result, err := inv.ListHostsWithOptions(inventory.ListOptions{Filter: filter})
+	if err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+	inventory.WarnMalformed(result.Malformed)
+	if *dryRun {
+		for _, host := range result.Hosts {
+			fmt.Println(host.Name)
+		}
+		logging.Infof("%d hosts would be touched", len(result.Hosts))
+		return
+	}
+	errs := bulk.run(result.Hosts, func(_ int, host inventory.Host) error {
+		_, err := inv.TouchHost(host.Name)
+		return err
+	})
+	failed, notStarted := 0, 0
+	for i, err := range errs {
+		switch {
+		case errors.Is(err, errNotStarted):
+			notStarted++
+		case err != nil:
+			logging.Errorf("Error touching host '%s': %v", result.Hosts[i].Name, err)
+			failed++
+		}
+	}
+	logDone("Touched %d hosts (%d failed, %d not started)", len(result.Hosts)-failed-notStarted, failed, notStarted)
+	if failed+notStarted > 0 {
+		os.Exit(1)
+	}
+}
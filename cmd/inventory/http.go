@@ -0,0 +1,802 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/grpcserver"
+	"github.com/oferchen/inventory/internal/logging"
+	"github.com/oferchen/inventory/query"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"gopkg.in/yaml.v3"
+)
+
+// newHTTPHandler serves GET /hosts, narrowed by the filter and where query
+// parameters as in list and paged by limit and continue, GET
+// /hosts/{name}, and GET /hosts/watch (see streamHostEvents). Responses are
+// rendered by the CLI's formatters in the format chosen by negotiateFormat;
+// output supplies the table columns and aliases. Responses read from the
+// cache carry its age in seconds in an X-Cache-Age header. GET /prometheus
+// serves the hosts as Prometheus http_sd targets, narrowed like GET /hosts,
+// and GET /metrics the server's own metrics (see writeMetrics). If
+// writable, it also serves the writes of registerHTTPWrites. Behind
+// authorizeRequests, listings leave out the hosts the caller may not view,
+// so a page may hold fewer than limit hosts.
+func newHTTPHandler(source hostSource, output inventory.OutputOptions, pageSize int64, writable bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /hosts", func(w http.ResponseWriter, r *http.Request) {
+		if !allowRole(w, r, "", inventory.RoleViewer) {
+			return
+		}
+		opts, err := pageOptions(r, pageSize)
+		if err == nil {
+			err = selectionOptions(r, &opts)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, cached, err := source.list(opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		inventory.WarnMalformed(result.Malformed)
+		if cached {
+			setCacheAge(w, source.snapshot)
+		}
+		var next string
+		if result.Truncated && len(result.Hosts) > 0 {
+			next = base64.RawURLEncoding.EncodeToString([]byte(result.Hosts[len(result.Hosts)-1].Name))
+		}
+		writeHTTPHosts(w, r, output, requestAccess(r).Visible(result.Hosts, source.inv.MaskSecrets), next)
+	})
+	mux.HandleFunc("GET /hosts/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !allowRole(w, r, name, inventory.RoleViewer) {
+			return
+		}
+		host, cached, err := source.get(name)
+		if cached {
+			setCacheAge(w, source.snapshot)
+		}
+		switch {
+		case errors.Is(err, inventory.ErrHostNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if host.Name == "" {
+			host.Name = name
+		}
+		writeHTTPHosts(w, r, output, requestAccess(r).Visible([]inventory.Host{host}, source.inv.MaskSecrets), "")
+	})
+	mux.HandleFunc("GET /hosts/watch", func(w http.ResponseWriter, r *http.Request) {
+		streamHostEvents(w, r, source, output)
+	})
+	mux.HandleFunc("GET /prometheus", func(w http.ResponseWriter, r *http.Request) {
+		if !allowRole(w, r, "", inventory.RoleViewer) {
+			return
+		}
+		var opts inventory.ListOptions
+		if err := selectionOptions(r, &opts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, cached, err := source.list(opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		inventory.WarnMalformed(result.Malformed)
+		if cached {
+			setCacheAge(w, source.snapshot)
+		}
+		sd := output
+		sd.Format = "prometheus"
+		var buf bytes.Buffer
+		if err := inventory.WriteOutput(&buf, sd, requestAccess(r).Visible(result.Hosts, source.inv.MaskSecrets)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf.Bytes())
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		if !allowRole(w, r, "", inventory.RoleViewer) {
+			return
+		}
+		writeMetrics(w, source)
+	})
+	if writable {
+		registerHTTPWrites(mux, source.inv)
+	}
+	return mux
+}
+
+// selectionOptions reads the filter and where query parameters of a host
+// listing into opts.
+func selectionOptions(r *http.Request, opts *inventory.ListOptions) error {
+	var err error
+	if opts.Filter, err = inventory.ParseHostFilter(r.URL.Query().Get("filter")); err != nil {
+		return fmt.Errorf("invalid filter: %w", err)
+	}
+	if where := r.URL.Query().Get("where"); where != "" {
+		if opts.Where, err = query.Parse(where); err != nil {
+			return fmt.Errorf("invalid where: %w", err)
+		}
+	}
+	return nil
+}
+
+// httpRequests counts the requests of the HTTP API by method and status,
+// for GET /metrics.
+var httpRequests = expvar.NewMap("http_requests")
+
+// statusRecorder remembers the status a handler writes. It passes flushes
+// through for the event streams of GET /hosts/watch.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// countRequests counts every request in httpRequests once it is answered.
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		httpRequests.Add(r.Method+" "+strconv.Itoa(rec.status), 1)
+	})
+}
+
+// metricFamilies are the expvar maps GET /metrics exposes, each with its
+// Prometheus name, type and help.
+var metricFamilies = []struct {
+	expvar, name, kind, help string
+}{
+	{"http_requests", "inventory_http_requests_total", "counter", "HTTP API requests by method and status code."},
+	{"etcd_requests", "inventory_etcd_requests_total", "counter", "etcd requests by operation, each counted once however often it was retried."},
+	{"etcd_request_errors", "inventory_etcd_request_errors_total", "counter", "etcd requests that failed after any retries, by operation."},
+	{"etcd_request_seconds", "inventory_etcd_request_seconds_total", "counter", "Seconds spent in etcd requests, retries included, by operation."},
+	{"etcd_retries", "inventory_etcd_retries_total", "counter", "Retries of etcd requests after transient errors, by operation."},
+}
+
+// writeMetrics writes the server's metrics in the Prometheus text format:
+// the counters of metricFamilies and the number of hosts, read from the
+// cache when serving from it. Dividing the etcd seconds by the requests
+// gives the mean etcd latency.
+func writeMetrics(w http.ResponseWriter, source hostSource) {
+	var buf bytes.Buffer
+	for _, family := range metricFamilies {
+		m, ok := expvar.Get(family.expvar).(*expvar.Map)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		m.Do(func(kv expvar.KeyValue) {
+			var labels string
+			if method, code, ok := strings.Cut(kv.Key, " "); ok {
+				labels = fmt.Sprintf("method=%q,code=%q", method, code)
+			} else {
+				labels = fmt.Sprintf("op=%q", kv.Key)
+			}
+			fmt.Fprintf(&buf, "%s{%s} %s\n", family.name, labels, kv.Value)
+		})
+	}
+	var hosts int64
+	var err error
+	if source.snapshot != nil {
+		var result inventory.ListResult
+		if result, err = source.snapshot.List(inventory.ListOptions{}); err == nil {
+			hosts = int64(len(result.Hosts))
+		}
+	}
+	if source.snapshot == nil || err != nil {
+		hosts, err = source.inv.CountHosts()
+	}
+	if err == nil {
+		fmt.Fprintf(&buf, "# HELP inventory_hosts Hosts in the inventory.\n# TYPE inventory_hosts gauge\ninventory_hosts %d\n", hosts)
+	} else {
+		logging.Errorf("Error counting hosts for /metrics: %v", err)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// maxRequestBody bounds the body of an HTTP write.
+const maxRequestBody = 1 << 20
+
+// registerHTTPWrites adds the write endpoints to mux:
+//
+//   - PUT /hosts/{name} stores a host given as JSON in the form GET returns
+//     ({"name": ..., "data": {...}}), answering 201 if it created the host
+//     and 204 if it replaced one;
+//   - PATCH /hosts/{name}/fields/{field} sets one field to the JSON value
+//     in the body;
+//   - DELETE /hosts/{name} removes the host.
+//
+// Writes go to etcd even when reads are cached, so a read right after a
+// write may briefly return the old host. An If-Match header with an etcd
+// revision makes any of them conditional on the host still being at that
+// revision, as --if-revision does in the CLI, and "If-None-Match: *" makes
+// a PUT create only.
+func registerHTTPWrites(mux *http.ServeMux, inv *inventory.Inventory) {
+	mux.HandleFunc("PUT /hosts/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !allowRole(w, r, name, inventory.RoleEditor) {
+			return
+		}
+		var host inventory.Host
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&host); err != nil {
+			http.Error(w, "body must be a JSON host: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if host.Name != "" && host.Name != name {
+			http.Error(w, fmt.Sprintf("body names host '%s', not '%s'", host.Name, name), http.StatusBadRequest)
+			return
+		}
+		if host.Data == nil {
+			host.Data = map[string]interface{}{}
+		}
+		host.Name = name
+		modRevision, ok := ifMatchRevision(w, r)
+		if !ok {
+			return
+		}
+		var err error
+		created := false
+		switch {
+		case modRevision > 0:
+			err = inv.UpdateHostIfRevision(name, host.Data, modRevision)
+		case strings.TrimSpace(r.Header.Get("If-None-Match")) == "*":
+			err = inv.Create(host)
+			created = true
+		default:
+			var overwrote bool
+			overwrote, err = inv.Put(host)
+			created = !overwrote
+		}
+		if err == nil && created {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		writeHTTPWriteResult(w, err)
+	})
+	mux.HandleFunc("PATCH /hosts/{name}/fields/{field}", func(w http.ResponseWriter, r *http.Request) {
+		if !allowRole(w, r, r.PathValue("name"), inventory.RoleEditor) {
+			return
+		}
+		var value interface{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&value); err != nil {
+			http.Error(w, "body must be a JSON value: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		modRevision, ok := ifMatchRevision(w, r)
+		if !ok {
+			return
+		}
+		writeHTTPWriteResult(w, inv.UpdateHostFieldValueIfRevision(r.PathValue("name"), r.PathValue("field"), value, modRevision))
+	})
+	mux.HandleFunc("DELETE /hosts/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !allowRole(w, r, name, inventory.RoleEditor) {
+			return
+		}
+		modRevision, ok := ifMatchRevision(w, r)
+		if !ok {
+			return
+		}
+		// Decommissioned hosts are archived, as by remove.
+		_, err := inv.DeleteHost(name, modRevision, false)
+		writeHTTPWriteResult(w, err)
+	})
+}
+
+// ifMatchRevision reads the etcd revision of an If-Match header, quoted
+// like an entity tag or not, or 0 without one. It answers 400 and returns
+// false if the header is not a revision.
+func ifMatchRevision(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" {
+		return 0, true
+	}
+	revision, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+	if err != nil || revision < 1 {
+		http.Error(w, fmt.Sprintf("invalid If-Match %q: must be an etcd revision", value), http.StatusBadRequest)
+		return 0, false
+	}
+	return revision, true
+}
+
+// writeHTTPWriteResult answers a write: 204 on success, otherwise a status
+// for the error.
+func writeHTTPWriteResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, inventory.ErrHostNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, inventory.ErrHostChanged), errors.Is(err, inventory.ErrHostExists):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, inventory.ErrFieldImmutable), errors.Is(err, inventory.ErrSchemaViolation),
+		errors.Is(err, inventory.ErrInvalidStatus), errors.Is(err, inventory.ErrStatusTransition):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// requireToken answers 401 to requests without "Authorization: Bearer
+// <token>", comparing tokens in constant time.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="inventory"`)
+			http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessKey keys the caller's access in the context of a request.
+type accessKey struct{}
+
+// authorizeRequests answers 401 to requests whose "Authorization: Bearer
+// <token>" authenticate refuses, and passes the others on with the
+// caller's access in their context. Handlers then check it with allowRole.
+func authorizeRequests(authenticate grpcserver.Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		err := errors.New("missing bearer token")
+		var access *inventory.Access
+		if ok {
+			access, err = authenticate(r.Context(), strings.TrimSpace(token))
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="inventory"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		debugf("%s %s by %s", r.Method, r.URL.Path, access.Name)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accessKey{}, access)))
+	})
+}
+
+// requestAccess returns the access authorizeRequests found for r, or nil,
+// which may do everything, without it.
+func requestAccess(r *http.Request) *inventory.Access {
+	access, _ := r.Context().Value(accessKey{}).(*inventory.Access)
+	return access
+}
+
+// allowRole answers 403 and returns false unless the caller of r holds role
+// on the host name or, for "", on any host.
+func allowRole(w http.ResponseWriter, r *http.Request, name string, role inventory.Role) bool {
+	access := requestAccess(r)
+	allowed := access.AllowsAny(role)
+	if name != "" {
+		allowed = access.Allows(name, role)
+	}
+	if !allowed {
+		http.Error(w, fmt.Sprintf("%s role required", role), http.StatusForbidden)
+	}
+	return allowed
+}
+
+// oidcConfig is the file of serve --oidc-config. ID tokens issued by Issuer
+// to Audience are accepted, and each value of their Claim, a string or a
+// list of strings, gives the grants Roles maps it to, written as for
+// --grant of auth token create.
+type oidcConfig struct {
+	Issuer   string              `yaml:"issuer"`
+	Audience string              `yaml:"audience"`
+	Claim    string              `yaml:"claim"`
+	Roles    map[string][]string `yaml:"roles"`
+}
+
+// serverAuth authenticates the callers of serve --rbac: tokens of auth
+// token create and, with an OIDC verifier, ID tokens.
+type serverAuth struct {
+	inv      *inventory.Inventory
+	verifier *oidc.IDTokenVerifier
+	claim    string
+	roles    map[string][]inventory.Grant
+}
+
+// newServerAuth reads the --oidc-config at path, if any, and discovers its
+// issuer.
+func newServerAuth(ctx context.Context, inv *inventory.Inventory, path string) (*serverAuth, error) {
+	auth := &serverAuth{inv: inv}
+	if path == "" {
+		return auth, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := oidcConfig{Claim: "groups"}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, errors.New("issuer and audience are required")
+	}
+	auth.claim = config.Claim
+	auth.roles = make(map[string][]inventory.Grant, len(config.Roles))
+	for value, grants := range config.Roles {
+		for _, text := range grants {
+			grant, err := inventory.ParseGrant(text)
+			if err != nil {
+				return nil, fmt.Errorf("roles of %q: %w", value, err)
+			}
+			auth.roles[value] = append(auth.roles[value], grant)
+		}
+	}
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	auth.verifier = provider.Verifier(&oidc.Config{ClientID: config.Audience})
+	return auth, nil
+}
+
+// authenticate returns the access of a bearer token. The grants of an ID
+// token are read anew from its claims on every request, so they follow the
+// identity provider.
+func (a *serverAuth) authenticate(ctx context.Context, token string) (*inventory.Access, error) {
+	if a.verifier == nil || strings.HasPrefix(token, inventory.AuthTokenPrefix) {
+		stored, err := a.inv.CheckAuthToken(token)
+		if err != nil {
+			return nil, err
+		}
+		return &inventory.Access{Name: stored.Name, Grants: stored.Grants, Prefix: a.inv.KeyPrefix()}, nil
+	}
+	idToken, err := a.verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	var values []string
+	switch claim := claims[a.claim].(type) {
+	case string:
+		values = []string{claim}
+	case []interface{}:
+		for _, item := range claim {
+			if value, ok := item.(string); ok {
+				values = append(values, value)
+			}
+		}
+	}
+	access := &inventory.Access{Name: idToken.Subject, Prefix: a.inv.KeyPrefix()}
+	for _, value := range values {
+		access.Grants = append(access.Grants, a.roles[value]...)
+	}
+	return access, nil
+}
+
+// sseHeartbeat is how often GET /hosts/watch writes a comment line when
+// nothing changes, so proxies do not time out the idle stream. It is a
+// variable for the tests.
+var sseHeartbeat = 15 * time.Second
+
+// sseHostEvent is the data of the put and delete events of GET
+// /hosts/watch. Resync marks the events replayed after etcd compacted the
+// watched revisions (see WatchHosts).
+type sseHostEvent struct {
+	Name     string          `json:"name"`
+	Host     *inventory.Host `json:"host,omitempty"`
+	Revision int64           `json:"revision"`
+	Resync   bool            `json:"resync,omitempty"`
+}
+
+// streamHostEvents serves GET /hosts/watch as Server-Sent Events: a list
+// event with every host, then a put or delete event for each change from
+// the revision of that list on, each with the revision as its id. Hosts are
+// JSON as in GET /hosts. The watch ends when the client disconnects. A host
+// named "watch" is shadowed by this endpoint.
+func streamHostEvents(w http.ResponseWriter, r *http.Request, source hostSource, output inventory.OutputOptions) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	if !allowRole(w, r, "", inventory.RoleViewer) {
+		return
+	}
+	access := requestAccess(r)
+	result, _, err := source.list(inventory.ListOptions{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	inventory.WarnMalformed(result.Malformed)
+	hosts, err := jsonHosts(output, access.Visible(result.Hosts, source.inv.MaskSecrets))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := writeSSE(w, "list", result.Revision, hosts); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	events := make(chan inventory.HostEvent)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- source.inv.WatchHosts(ctx, result.Revision+1, func(event inventory.HostEvent) error {
+			select {
+			case events <- event:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-watchErr:
+			if ctx.Err() == nil {
+				logging.Errorf("Error watching hosts for %s: %v", r.RemoteAddr, err)
+			}
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			if !access.Allows(event.Name, inventory.RoleViewer) {
+				continue
+			}
+			data := sseHostEvent{Name: event.Name, Revision: event.Revision, Resync: event.Resync}
+			name := "delete"
+			if event.Type == mvccpb.PUT {
+				name = "put"
+				if event.Host.Name == "" {
+					event.Host.Name = event.Name
+				}
+				hosts, err := jsonHosts(output, access.Visible([]inventory.Host{event.Host}, source.inv.MaskSecrets))
+				if err != nil {
+					logging.Errorf("Error rendering host '%s': %v", event.Name, err)
+					continue
+				}
+				data.Host = &hosts[0]
+			}
+			if err := writeSSE(w, name, event.Revision, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeSSE writes one Server-Sent Event with data as JSON.
+func writeSSE(w io.Writer, event string, id int64, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", event, id, b)
+	return err
+}
+
+// hostSource reads hosts for the servers: from snapshot while it is set and
+// current, from etcd otherwise.
+type hostSource struct {
+	inv      *inventory.Inventory
+	snapshot *inventory.HostSnapshot
+}
+
+// list lists hosts, reporting whether they came from the snapshot.
+func (s hostSource) list(opts inventory.ListOptions) (result inventory.ListResult, cached bool, err error) {
+	if s.snapshot != nil {
+		if result, err = s.snapshot.List(opts); !errors.Is(err, inventory.ErrSnapshotStale) {
+			return result, err == nil, err
+		}
+	}
+	result, err = s.inv.ListHostsWithOptions(opts)
+	return result, false, err
+}
+
+// get reads one host, reporting whether it came from the snapshot.
+func (s hostSource) get(name string) (host inventory.Host, cached bool, err error) {
+	if s.snapshot != nil {
+		if host, err = s.snapshot.Get(name); !errors.Is(err, inventory.ErrSnapshotStale) {
+			return host, true, err
+		}
+	}
+	host, err = s.inv.GetHost(name)
+	return host, false, err
+}
+
+// setCacheAge sets the X-Cache-Age header to the whole seconds since the
+// snapshot last changed.
+func setCacheAge(w http.ResponseWriter, snapshot *inventory.HostSnapshot) {
+	w.Header().Set("X-Cache-Age", strconv.Itoa(int(snapshot.Age().Seconds())))
+}
+
+// pageOptions reads the limit and continue query parameters of a host
+// listing. limit defaults to, and is capped at, pageSize; continue is the
+// token returned with the previous page.
+func pageOptions(r *http.Request, pageSize int64) (inventory.ListOptions, error) {
+	opts := inventory.ListOptions{Limit: pageSize}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 1 {
+			return opts, fmt.Errorf("invalid limit %q", value)
+		}
+		opts.Limit = min(limit, pageSize)
+	}
+	if token := r.URL.Query().Get("continue"); token != "" {
+		after, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil || len(after) == 0 {
+			return opts, fmt.Errorf("invalid continue token %q", token)
+		}
+		opts.After = string(after)
+	}
+	return opts, nil
+}
+
+// hostPage is the JSON body of a host listing: a page of hosts and the
+// token for the next one, empty after the last page.
+type hostPage struct {
+	Items    []inventory.Host `json:"items"`
+	Continue string           `json:"continue"`
+}
+
+// httpFormats maps the output formats served over HTTP to their media
+// types.
+var httpFormats = map[string]string{
+	"json":  "application/json",
+	"yaml":  "application/yaml",
+	"xml":   "application/xml",
+	"csv":   "text/csv; charset=utf-8",
+	"table": "text/plain; charset=utf-8",
+}
+
+// acceptedTypes maps the media types understood in an Accept header to
+// output formats.
+var acceptedTypes = map[string]string{
+	"application/json":   "json",
+	"application/yaml":   "yaml",
+	"application/x-yaml": "yaml",
+	"text/yaml":          "yaml",
+	"application/xml":    "xml",
+	"text/xml":           "xml",
+	"text/csv":           "csv",
+	"text/plain":         "table",
+	"application/*":      "json",
+	"text/*":             "table",
+	"*/*":                "json",
+}
+
+// negotiateFormat picks the output format for a request: the format query
+// parameter if given, otherwise the Accept media type with the highest
+// quality that has a format, otherwise JSON. ok is false if the request
+// only accepts formats that cannot be served.
+func negotiateFormat(r *http.Request) (format string, ok bool) {
+	if format = r.URL.Query().Get("format"); format != "" {
+		_, ok = httpFormats[format]
+		return format, ok
+	}
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return "json", true
+	}
+	bestQ := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		candidate, known := acceptedTypes[strings.ToLower(strings.TrimSpace(mediaType))]
+		if !known {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, found := strings.CutPrefix(strings.TrimSpace(param), "q="); found {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > bestQ {
+			format, bestQ = candidate, q
+		}
+	}
+	return format, format != ""
+}
+
+// jsonHosts applies the output transforms and aliases to hosts written as
+// plain JSON, which bypass the formatters that would otherwise apply them.
+func jsonHosts(output inventory.OutputOptions, hosts []inventory.Host) ([]inventory.Host, error) {
+	hosts, err := inventory.ApplyTransforms(output.Transforms, hosts)
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Aliases) > 0 {
+		hosts = output.Aliases.Apply(hosts)
+	}
+	return hosts, nil
+}
+
+// writeHTTPHosts renders hosts in the negotiated format. A single JSON
+// host is written as an object rather than a one-element array, and a JSON
+// listing as a hostPage. Other formats carry the next page's token, if
+// any, in the Continue header.
+func writeHTTPHosts(w http.ResponseWriter, r *http.Request, output inventory.OutputOptions, hosts []inventory.Host, next string) {
+	format, ok := negotiateFormat(r)
+	if !ok {
+		formats := make([]string, 0, len(httpFormats))
+		for name := range httpFormats {
+			formats = append(formats, name)
+		}
+		sort.Strings(formats)
+		http.Error(w, "no acceptable format (use "+strings.Join(formats, ", ")+")", http.StatusNotAcceptable)
+		return
+	}
+	output.Format = format
+	output.ColorMode = "never"
+	var buf bytes.Buffer
+	var err error
+	if format == "json" {
+		hosts, err = jsonHosts(output, hosts)
+		if err == nil {
+			if r.PathValue("name") != "" {
+				err = json.NewEncoder(&buf).Encode(hosts[0])
+			} else {
+				err = json.NewEncoder(&buf).Encode(hostPage{Items: hosts, Continue: next})
+			}
+		}
+	} else {
+		err = inventory.WriteOutput(&buf, output, hosts)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", httpFormats[format])
+	w.Header().Add("Vary", "Accept")
+	if next != "" {
+		w.Header().Set("Continue", next)
+	}
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+func handleImport(inv *inventory.Inventory, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	file := fs.String("file", "", "Export file to import (default stdin)")
+	noVerify := fs.Bool("no-verify", false, "Skip the export header version and checksum checks")
+	strictJSON := fs.Bool("strict-json", false, "Refuse hosts with top-level keys other than name, data and mod_revision, such as a misspelled \"dta\"")
+	onConflict := fs.String("on-conflict", "replace", "What to do with hosts that already exist: replace, skip or merge")
+	force := fs.Bool("force", false, "Replace hosts even if they changed since an export --with-revisions")
+	format := fs.String("format", "export", "Input format: export (as written by export), json or yaml (as written by --output json or yaml), or csv (see inventory.DecodeCSVHosts)")
+	noInfer := fs.Bool("no-infer", false, "With --format csv, keep cells of untyped columns as strings instead of reading true, false and numbers as such")
+	batchSize := fs.Int("batch-size", inventory.DefaultImportBatch, "Hosts written per etcd transaction; each batch is written entirely or not at all")
+	bulk := addBulkFlags(fs)
+	fs.Parse(args)
+
+	switch *onConflict {
+	case inventory.ImportReplace, inventory.ImportSkip, inventory.ImportMerge:
+	default:
+		logging.Fatalf("Invalid --on-conflict %q (use replace, skip or merge)", *onConflict)
+	}
+	if *batchSize < 1 {
+		logging.Fatal("--batch-size must be at least 1")
+	}
+
+	var data []byte
+	var err error
+	if *file == "" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		logging.Fatalf("Error reading import: %v", err)
+	}
+	var hosts []inventory.Host
+	var revisions map[string]int64
+	switch *format {
+	case "export":
+		hosts, revisions, err = inventory.DecodeExport(bytes.TrimRight(data, "\n"), !*noVerify, *strictJSON)
+	case "json":
+		// A bare host array is an export without its header.
+		hosts, revisions, err = inventory.DecodeExport(bytes.TrimRight(data, "\n"), false, *strictJSON)
+	case "yaml":
+		hosts, err = inventory.DecodeYAMLHosts(data)
+	case "csv":
+		hosts, err = inventory.DecodeCSVHosts(bytes.NewReader(data), !*noInfer)
+	default:
+		logging.Fatalf("Invalid --format %q (use export, json, yaml or csv)", *format)
+	}
+	if err != nil {
+		logging.Fatalf("Refusing to import: %v", err)
+	}
+	if *force {
+		revisions = nil
+	}
+	actions := make([]string, len(hosts))
+	errs := bulk.runBatches(hosts, *batchSize, func(start int, batch []inventory.Host) []error {
+		batchActions, errs, err := inv.ImportHosts(batch, *onConflict, revisions)
+		if errors.Is(err, rpctypes.ErrTooManyOps) {
+			err = fmt.Errorf("%w (lower --batch-size)", err)
+		}
+		if err != nil {
+			errs = make([]error, len(batch))
+			for n := range errs {
+				errs[n] = err
+			}
+			return errs
+		}
+		for n, host := range batch {
+			if errs[n] == nil {
+				logDone("Host '%s': %s", host.Name, batchActions[n])
+			}
+		}
+		copy(actions[start:], batchActions)
+		return errs
+	})
+	counts := make(map[string]int)
+	failed, conflicts, notStarted := 0, 0, 0
+	for i, err := range errs {
+		switch {
+		case errors.Is(err, errNotStarted):
+			notStarted++
+		case errors.Is(err, inventory.ErrHostChanged) && revisions[hosts[i].Name] > 0:
+			logging.Warnf("Conflict on host '%s': changed since it was exported at revision %d; not replaced (use --force to overwrite)", hosts[i].Name, revisions[hosts[i].Name])
+			conflicts++
+		case err != nil:
+			logging.Errorf("Error importing host '%s': %v", hosts[i].Name, err)
+			failed++
+		default:
+			counts[actions[i]]++
+		}
+	}
+	logDone("Imported %d hosts (%d created, %d replaced, %d merged, %d skipped, %d conflicts, %d failed, %d not started)",
+		len(hosts)-failed-conflicts-notStarted, counts["created"], counts["replaced"], counts["merged"], counts["skipped"], conflicts, failed, notStarted)
+	if failed+conflicts+notStarted > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oferchen/inventory"
+)
+
+// JSONPath support for list --query. The subset covers what is useful on a
+// host list: $, .name, ['name'], [n], [*], .*, recursive descent (..) and
+// filters of the form [?(@.path)] or [?(@.path op literal)] with op one of
+// == != < <= > >=. Literals are JSON or single-quoted strings; quoted
+// strings may hold operators and brackets.
+
+type jsonPathStep struct {
+	recursive bool
+	wildcard  bool
+	key       string
+	isIndex   bool
+	index     int
+	filter    *jsonPathFilter
+}
+
+type jsonPathFilter struct {
+	path    []jsonPathStep
+	op      string
+	literal interface{}
+}
+
+func parseJSONPath(expr string) ([]jsonPathStep, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(expr), "$")
+	if !ok {
+		return nil, fmt.Errorf("JSONPath %q must start with $", expr)
+	}
+	return parseJSONPathSteps(expr, rest)
+}
+
+func parseJSONPathSteps(expr, rest string) ([]jsonPathStep, error) {
+	var steps []jsonPathStep
+	for rest != "" {
+		step := jsonPathStep{}
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.recursive = true
+			rest = rest[2:]
+			if strings.HasPrefix(rest, "[") {
+				break
+			}
+			fallthrough
+		case strings.HasPrefix(rest, "."):
+			rest = strings.TrimPrefix(rest, ".")
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			if name == "" {
+				return nil, fmt.Errorf("empty name in JSONPath %q", expr)
+			}
+			if name == "*" {
+				step.wildcard = true
+			} else {
+				step.key = name
+			}
+			steps = append(steps, step)
+			continue
+		case !strings.HasPrefix(rest, "["):
+			return nil, fmt.Errorf("unexpected %q in JSONPath %q", rest, expr)
+		}
+
+		// Bracket forms: [*], [n], ['name'] and [?(...)].
+		rest = rest[1:]
+		switch {
+		case strings.HasPrefix(rest, "?("):
+			end, _, err := scanJSONPath(rest[2:], ")]")
+			if err != nil {
+				return nil, fmt.Errorf("%w in JSONPath %q", err, expr)
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated filter in JSONPath %q", expr)
+			}
+			filter, err := parseJSONPathFilter(expr, rest[2:2+end])
+			if err != nil {
+				return nil, err
+			}
+			step.filter = filter
+			rest = rest[2+end+2:]
+		case strings.HasPrefix(rest, "'") || strings.HasPrefix(rest, `"`):
+			end := quotedEnd(rest)
+			if end < 0 || !strings.HasPrefix(rest[end+1:], "]") {
+				return nil, fmt.Errorf("unterminated name in JSONPath %q", expr)
+			}
+			step.key = unquoteJSONPath(rest[:end+1])
+			rest = rest[end+2:]
+		default:
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated index in JSONPath %q", expr)
+			}
+			inner := strings.TrimSpace(rest[:end])
+			rest = rest[end+1:]
+			if inner == "*" {
+				step.wildcard = true
+				break
+			}
+			n, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %q in JSONPath %q", inner, expr)
+			}
+			step.isIndex = true
+			step.index = n
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func parseJSONPathFilter(expr, text string) (*jsonPathFilter, error) {
+	text = strings.TrimSpace(text)
+	filter := &jsonPathFilter{}
+	pathText := text
+	idx, op, err := scanJSONPath(text, "==", "!=", "<=", ">=", "<", ">")
+	if err != nil {
+		return nil, fmt.Errorf("%w in JSONPath filter %q", err, text)
+	}
+	if idx >= 0 {
+		pathText = strings.TrimSpace(text[:idx])
+		filter.op = op
+		literal := strings.TrimSpace(text[idx+len(op):])
+		if strings.HasPrefix(literal, "'") && quotedEnd(literal) == len(literal)-1 {
+			filter.literal = unquoteJSONPath(literal)
+		} else if err := json.Unmarshal([]byte(literal), &filter.literal); err != nil {
+			return nil, fmt.Errorf("invalid literal in JSONPath filter %q: %w", text, err)
+		}
+	}
+	rest, ok := strings.CutPrefix(pathText, "@")
+	if !ok {
+		return nil, fmt.Errorf("JSONPath filter %q must start with @", text)
+	}
+	path, err := parseJSONPathSteps(expr, rest)
+	if err != nil {
+		return nil, err
+	}
+	filter.path = path
+	return filter, nil
+}
+
+// scanJSONPath returns the index in s of the first of tokens found outside
+// quoted strings and outside the parentheses opened in s, and which token
+// it is, or -1 if there is none. Tokens are tried in order at each index.
+func scanJSONPath(s string, tokens ...string) (int, string, error) {
+	depth := 0
+	for n := 0; n < len(s); n++ {
+		if s[n] == '\'' || s[n] == '"' {
+			end := quotedEnd(s[n:])
+			if end < 0 {
+				return -1, "", fmt.Errorf("unterminated string %s", s[n:])
+			}
+			n += end
+			continue
+		}
+		if depth == 0 {
+			for _, token := range tokens {
+				if strings.HasPrefix(s[n:], token) {
+					return n, token, nil
+				}
+			}
+		}
+		switch s[n] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+	}
+	return -1, "", nil
+}
+
+// quotedEnd returns the index of the quote closing the string s starts
+// with, or -1 if it is unterminated. A backslash escapes the next byte.
+func quotedEnd(s string) int {
+	for n := 1; n < len(s); n++ {
+		switch s[n] {
+		case '\\':
+			n++
+		case s[0]:
+			return n
+		}
+	}
+	return -1
+}
+
+// unquoteJSONPath returns the content of a quoted string that quotedEnd
+// found whole: JSON's escapes for double quotes, and for single quotes a
+// backslash taking the next byte as it is.
+func unquoteJSONPath(quoted string) string {
+	if quoted[0] == '"' {
+		var s string
+		if json.Unmarshal([]byte(quoted), &s) == nil {
+			return s
+		}
+	}
+	var b strings.Builder
+	for n := 1; n < len(quoted)-1; n++ {
+		if quoted[n] == '\\' && n+1 < len(quoted)-1 {
+			n++
+		}
+		b.WriteByte(quoted[n])
+	}
+	return b.String()
+}
+
+func evalJSONPath(steps []jsonPathStep, doc interface{}) []interface{} {
+	nodes := []interface{}{doc}
+	for _, step := range steps {
+		if step.recursive {
+			var all []interface{}
+			for _, node := range nodes {
+				all = appendDescendants(all, node)
+			}
+			nodes = all
+		}
+		var next []interface{}
+		for _, node := range nodes {
+			next = append(next, step.apply(node)...)
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+func appendDescendants(nodes []interface{}, node interface{}) []interface{} {
+	nodes = append(nodes, node)
+	for _, child := range jsonChildren(node) {
+		nodes = appendDescendants(nodes, child)
+	}
+	return nodes
+}
+
+// jsonChildren returns the elements of an array or the values of an object
+// in key order.
+func jsonChildren(node interface{}) []interface{} {
+	switch n := node.(type) {
+	case []interface{}:
+		return n
+	case map[string]interface{}:
+		keys := make([]string, 0, len(n))
+		for key := range n {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		children := make([]interface{}, 0, len(n))
+		for _, key := range keys {
+			children = append(children, n[key])
+		}
+		return children
+	}
+	return nil
+}
+
+func (step jsonPathStep) apply(node interface{}) []interface{} {
+	switch {
+	case step.wildcard:
+		return jsonChildren(node)
+	case step.filter != nil:
+		var matched []interface{}
+		for _, child := range jsonChildren(node) {
+			if step.filter.matches(child) {
+				matched = append(matched, child)
+			}
+		}
+		return matched
+	case step.isIndex:
+		arr, ok := node.([]interface{})
+		if !ok {
+			return nil
+		}
+		index := step.index
+		if index < 0 {
+			index += len(arr)
+		}
+		if index < 0 || index >= len(arr) {
+			return nil
+		}
+		return []interface{}{arr[index]}
+	default:
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value, ok := obj[step.key]
+		if !ok {
+			return nil
+		}
+		return []interface{}{value}
+	}
+}
+
+func (f *jsonPathFilter) matches(node interface{}) bool {
+	values := evalJSONPath(f.path, node)
+	if f.op == "" {
+		return len(values) > 0
+	}
+	for _, value := range values {
+		if compareJSON(value, f.op, f.literal) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareJSON(a interface{}, op string, b interface{}) bool {
+	an, aNum := inventory.ToFloat(a)
+	bn, bNum := inventory.ToFloat(b)
+	as, aStr := a.(string)
+	bs, bStr := b.(string)
+	switch {
+	case aNum && bNum:
+		switch op {
+		case "<":
+			return an < bn
+		case "<=":
+			return an <= bn
+		case ">":
+			return an > bn
+		case ">=":
+			return an >= bn
+		}
+	case aStr && bStr:
+		switch op {
+		case "<":
+			return as < bs
+		case "<=":
+			return as <= bs
+		case ">":
+			return as > bs
+		case ">=":
+			return as >= bs
+		}
+	}
+	switch op {
+	case "==":
+		return reflect.DeepEqual(a, b)
+	case "!=":
+		return !reflect.DeepEqual(a, b)
+	}
+	return false
+}
+
+// writeQueryResults prints the values matched by a JSONPath query over the
+// JSON form of hosts, one per line: strings raw, everything else as JSON.
+func writeQueryResults(w io.Writer, steps []jsonPathStep, hosts []inventory.Host) error {
+	encoded := make([]inventory.Host, len(hosts))
+	for i, host := range hosts {
+		encoded[i] = inventory.Host{Name: host.Name, Data: inventory.EncodeBinaryValues(host.Data)}
+	}
+	b, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	for _, value := range evalJSONPath(steps, doc) {
+		if _, err := fmt.Fprintln(w, inventory.FormatValue(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
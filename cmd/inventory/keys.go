@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+	"go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
+)
+
+// keyRange is one read of raw keys starting at key; opt sets where it
+// ends.
+type keyRange struct {
+	key  string
+	opt  clientv3.OpOption
+	desc string
+}
+
+// prefixRange is the keys under prefix.
+func prefixRange(prefix string) keyRange {
+	return keyRange{prefix, clientv3.WithPrefix(), fmt.Sprintf("under %q", prefix)}
+}
+
+// parseKeyRange parses --range start:end, the keys from start up to but
+// not including end. The bounds are split at the first ':'.
+func parseKeyRange(arg string) (keyRange, error) {
+	start, end, ok := strings.Cut(arg, ":")
+	if !ok || start == "" || end == "" {
+		return keyRange{}, fmt.Errorf("invalid range %q: expected start:end", arg)
+	}
+	if start >= end {
+		return keyRange{}, fmt.Errorf("invalid range %q: start must sort before end", arg)
+	}
+	return keyRange{start, clientv3.WithRange(end), fmt.Sprintf("in [%q, %q)", start, end)}, nil
+}
+
+// fromKeyRange is every key from start onwards.
+func fromKeyRange(start string) keyRange {
+	return keyRange{start, clientv3.WithFromKey(), fmt.Sprintf("from %q", start)}
+}
+
+// readPrefixesFile reads one key prefix per line, skipping blank lines and
+// lines starting with #.
+func readPrefixesFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var prefixes []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		prefixes = append(prefixes, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+// mergePrefixes concatenates prefix lists, dropping empty entries and
+// repeats while keeping the first occurrence of each in order.
+func mergePrefixes(lists ...[]string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, list := range lists {
+		for _, prefix := range list {
+			if prefix == "" || seen[prefix] {
+				continue
+			}
+			seen[prefix] = true
+			merged = append(merged, prefix)
+		}
+	}
+	return merged
+}
+
+// handleKeys implements keys iter, which prints the raw keys and values
+// under prefixes, in a range or from a key onwards, one row per key with
+// its value, to look at what is stored beside the hosts. Keys are relative
+// to the namespace, if any.
+func handleKeys(client *clientv3.Client, prefix string, args []string, output inventory.OutputOptions) {
+	const usage = "Usage: keys iter [--dedupe] (<prefix>... | --key-prefixes P1,P2 | --prefixes-file F | --range start:end | --from-key K)"
+	if len(args) == 0 || args[0] != "iter" {
+		logging.Fatal(usage)
+	}
+	fs := flag.NewFlagSet("keys iter", flag.ExitOnError)
+	keyPrefixes := fs.String("key-prefixes", "", "Comma-separated key prefixes to read, like the arguments")
+	prefixesFile := fs.String("prefixes-file", "", "File listing key prefixes, one per line (# comments allowed); merged after the others")
+	rangeFlag := fs.String("range", "", "Read the keys from start up to but not including end, given as start:end, instead of prefixes")
+	fromKey := fs.String("from-key", "", "Read every key from this one onwards, instead of prefixes")
+	dedupe := fs.Bool("dedupe", false, "Show keys under more than one of the prefixes only once, in first-seen order")
+	fs.Parse(args[1:])
+
+	prefixMode := fs.NArg() > 0 || *keyPrefixes != "" || *prefixesFile != ""
+	modes := 0
+	for _, set := range []bool{prefixMode, *rangeFlag != "", *fromKey != ""} {
+		if set {
+			modes++
+		}
+	}
+	if modes != 1 {
+		logging.Fatal(usage)
+	}
+	var ranges []keyRange
+	switch {
+	case *rangeFlag != "":
+		r, err := parseKeyRange(*rangeFlag)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		ranges = append(ranges, r)
+	case *fromKey != "":
+		ranges = append(ranges, fromKeyRange(*fromKey))
+	default:
+		var filePrefixes []string
+		if *prefixesFile != "" {
+			var err error
+			if filePrefixes, err = readPrefixesFile(*prefixesFile); err != nil {
+				logging.Fatalf("Error reading prefixes file: %v", err)
+			}
+		}
+		for _, p := range mergePrefixes(fs.Args(), strings.Split(*keyPrefixes, ","), filePrefixes) {
+			ranges = append(ranges, prefixRange(p))
+		}
+		if len(ranges) == 0 {
+			logging.Fatal("No key prefixes given")
+		}
+	}
+	if client == nil {
+		logging.Fatal("keys iter reads etcd directly, so it cannot be explained")
+	}
+
+	kv := client.KV
+	if prefix != "" {
+		kv = namespace.NewKV(client.KV, prefix)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var rows []inventory.Host
+	seen := make(map[string]bool)
+	for _, r := range ranges {
+		resp, err := kv.Get(ctx, r.key, r.opt)
+		if err != nil {
+			logging.Fatalf("Error reading the keys %s: %v", r.desc, err)
+		}
+		for _, item := range resp.Kvs {
+			key := string(item.Key)
+			if *dedupe {
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			rows = append(rows, inventory.Host{Name: key, Data: map[string]interface{}{"value": string(item.Value)}})
+		}
+	}
+	output.Wide = true
+	printOutput(output, rows)
+}
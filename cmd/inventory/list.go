@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+	"github.com/oferchen/inventory/query"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// localCacheCommands are the subcommands read through --local-cache.
+var localCacheCommands = map[string]bool{"list": true, "get": true, "values": true, "ansible-inventory": true}
+
+// handleLocalCache keeps the --local-cache file current until interrupted,
+// for the read commands of other processes to use.
+func handleLocalCache(inv *inventory.Inventory, args []string, path string) {
+	const usage = "Usage: local-cache watch [--interval D]"
+	if len(args) == 0 || args[0] != "watch" {
+		logging.Fatal(usage)
+	}
+	fs := flag.NewFlagSet("local-cache watch", flag.ExitOnError)
+	interval := fs.Duration("interval", 10*time.Second, "Save the file at most this often, and mark it checked this often while etcd answers")
+	fs.Parse(args[1:])
+	if fs.NArg() != 0 || *interval <= 0 {
+		logging.Fatal(usage)
+	}
+	if path == "" {
+		logging.Fatal("local-cache watch needs the global --local-cache")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	logging.Infof("Keeping the local cache %s current", path)
+	if err := inv.WatchLocalCache(ctx, path, *interval); err != nil && ctx.Err() == nil {
+		logging.Fatalf("Error watching for changes: %v", err)
+	}
+}
+
+func handleList(inv *inventory.Inventory, args []string, output inventory.OutputOptions, connector clusterConnector) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	limit := fs.Int64("limit", 0, "Maximum number of hosts to show (0 for all)")
+	offset := fs.Int64("offset", 0, "Number of hosts to skip")
+	namePrefix := fs.String("name-prefix", "", "Only list hosts whose name starts with this prefix")
+	var alsoOutput outputTargets
+	fs.Var(&alsoOutput, "also-output", "Additionally render the same hosts as format=path (repeatable; path - is stdout)")
+	watchInterval := fs.Duration("watch-interval", 0, "Re-render the list every interval until interrupted (e.g. 5s)")
+	sinceRevision := fs.Int64("since-revision", 0, "Only list hosts modified after this etcd revision")
+	showRevision := fs.Bool("show-revision", false, "Print the etcd revision the list was read at, for a later --since-revision")
+	filterExpr := fs.String("filter", "", "Only list hosts matching field=value, field!=value or field in CIDR (comma-separated, all must hold)")
+	whereExpr := fs.String("where", "", `Only list hosts matching an expression (e.g. 'role == "web" && (env == "prod" || env == "stage") && !maintenance')`)
+	fields := fs.String("fields", "", "Comma-separated fields to show; all others are left out (like the global --only-fields)")
+	strict := fs.Bool("strict", false, "Fail on a malformed stored host instead of skipping it with a warning")
+	showTTL := fs.Bool("show-ttl", false, "Add a ttl_remaining column with the seconds left on each host's lease")
+	showKey := fs.Bool("show-key", false, "Add a _key column with each host's full etcd key")
+	jsonPath := fs.String("query", "", `Print the values matching a JSONPath expression instead of formatted hosts (e.g. '$[?(@.data.role=="db")].name')`)
+	namesOnly := fs.Bool("names-only", false, "Print only host names, one per line")
+	groupBy := fs.String("group-by", "", "Print hosts in one section per value of this field, sorted by value")
+	failOnEmpty := fs.Bool("fail-on-empty", false, fmt.Sprintf("Exit with status %d if no hosts match", exitEmpty))
+	clustersFlag := fs.String("clusters", "", "Comma-separated contexts to list concurrently and merge, tagging each host with a "+clusterField+" field (all for every context)")
+	requireAll := fs.Bool("require-all", false, "With --clusters, fail if any cluster cannot be listed instead of warning")
+	group := fs.String("group", "", "Only list the members of this group (see the group subcommand)")
+	groupVars := fs.Bool("group-vars", false, "Merge the variables of each host's groups into it; the host's own fields win, then groups in name order")
+	statusFlag := fs.String("status", "", "Only list hosts in these lifecycle states (comma-separated: "+strings.Join(inventory.HostStatuses(), ", ")+")")
+	pageSize := fs.Int64("page-size", inventory.DefaultPageSize, "Number of keys to read from etcd per request while streaming the list")
+	fs.Parse(args)
+
+	if *pageSize <= 0 {
+		logging.Fatal("--page-size must be positive")
+	}
+	if *limit < 0 || *offset < 0 {
+		logging.Fatal("Usage: list [--name-prefix P] [--limit N] [--offset N] (N must not be negative)")
+	}
+	if *failOnEmpty && *watchInterval > 0 {
+		logging.Fatal("--fail-on-empty cannot be combined with --watch-interval")
+	}
+	var clusters []clusterInventory
+	if *clustersFlag != "" {
+		if *jsonPath != "" || *namesOnly || *sinceRevision > 0 || *showRevision {
+			logging.Fatal("--clusters cannot be combined with --query, --names-only, --since-revision or --show-revision")
+		}
+		var err error
+		if clusters, err = connector.connect(inventory.SplitList(*clustersFlag)); err != nil {
+			logging.Fatalf("Invalid --clusters: %v", err)
+		}
+		output.Columns = append(output.Columns, clusterField)
+	}
+
+	filter, err := inventory.ParseHostFilter(*filterExpr)
+	if err != nil {
+		logging.Fatalf("Invalid --filter: %v", err)
+	}
+	var where *query.Query
+	if *whereExpr != "" {
+		if where, err = query.Parse(*whereExpr); err != nil {
+			logging.Fatalf("Invalid --where: %v", err)
+		}
+	}
+	var statuses []inventory.HostStatus
+	for _, name := range inventory.SplitList(*statusFlag) {
+		status, err := inventory.ParseHostStatus(name)
+		if err != nil {
+			logging.Fatalf("Invalid --status: %v", err)
+		}
+		statuses = append(statuses, status)
+	}
+	if *fields != "" {
+		output.Transforms = append(output.Transforms, inventory.OnlyFields(inventory.SplitList(*fields)))
+	}
+	if *showTTL {
+		output.Columns = append(output.Columns, inventory.TTLField)
+	}
+	if *showKey {
+		output.Columns = append(output.Columns, inventory.KeyField)
+	}
+	cmd := listCommand{
+		name:         "list",
+		inventory:    inv,
+		opts:         inventory.ListOptions{NamePrefix: *namePrefix, Offset: *offset, Limit: *limit, SinceRevision: *sinceRevision, Filter: filter, Where: where, Strict: *strict, WithTTL: *showTTL, WithKey: *showKey, Group: *group, GroupVars: *groupVars, Statuses: statuses},
+		output:       output,
+		alsoOutput:   alsoOutput,
+		showRevision: *showRevision,
+		groupBy:      *groupBy,
+		failOnEmpty:  *failOnEmpty,
+		clusters:     clusters,
+		requireAll:   *requireAll,
+		pageSize:     *pageSize,
+	}
+	if *jsonPath != "" {
+		steps, err := parseJSONPath(*jsonPath)
+		if err != nil {
+			logging.Fatalf("Invalid --query: %v", err)
+		}
+		result, err := inv.ListHostsWithOptions(cmd.opts)
+		if err != nil {
+			logging.Fatalf("Error listing hosts: %v", err)
+		}
+		inventory.WarnMalformed(result.Malformed)
+		if err := writeQueryResults(os.Stdout, steps, result.Hosts); err != nil {
+			logging.Fatalf("Error writing query results: %v", err)
+		}
+		failIfEmpty(*failOnEmpty, len(result.Hosts))
+		return
+	}
+	if *namesOnly {
+		count, err := printHostNames(os.Stdout, inv, cmd.opts)
+		if err != nil {
+			logging.Fatalf("Error listing hosts: %v", err)
+		}
+		failIfEmpty(*failOnEmpty, count)
+		return
+	}
+	if *watchInterval > 0 {
+		cmd.watch(*watchInterval)
+		return
+	}
+	if err := cmd.once(); err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+}
+
+// printHostNames writes the name of each host selected by opts, one per
+// line, and returns how many it wrote. Without a filter, query or revision
+// bound it reads keys only; the others need the values and fall back to a
+// full listing.
+func printHostNames(w io.Writer, inv *inventory.Inventory, opts inventory.ListOptions) (int, error) {
+	var names []string
+	if len(opts.Filter) == 0 && opts.Where == nil && opts.SinceRevision == 0 {
+		all, err := inv.ListHostNames(opts.NamePrefix)
+		if err != nil {
+			return 0, err
+		}
+		if opts.Offset < int64(len(all)) {
+			names = all[opts.Offset:]
+		}
+		if opts.Limit > 0 && int64(len(names)) > opts.Limit {
+			names = names[:opts.Limit]
+		}
+	} else {
+		result, err := inv.ListHostsWithOptions(opts)
+		if err != nil {
+			return 0, err
+		}
+		inventory.WarnMalformed(result.Malformed)
+		for _, host := range result.Hosts {
+			names = append(names, host.Name)
+		}
+	}
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		fmt.Fprintln(bw, name)
+	}
+	return len(names), bw.Flush()
+}
+
+// handleRecent lists the most recently changed hosts, newest first,
+// optionally refreshing like list --watch-interval.
+func handleRecent(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	fs := flag.NewFlagSet("recent", flag.ExitOnError)
+	limit := fs.Int64("limit", 10, "Number of hosts to show")
+	watchInterval := fs.Duration("watch-interval", 0, "Refresh every interval until interrupted (e.g. 2s)")
+	fs.Parse(args)
+
+	if *limit <= 0 {
+		logging.Fatal("Usage: recent [--limit N] [--watch-interval D] (N must be positive)")
+	}
+	output.Columns = append([]string{inventory.ModRevisionField}, output.Columns...)
+	output.KeepOrder = true
+	cmd := listCommand{
+		name:      "recent",
+		inventory: inv,
+		opts:      inventory.ListOptions{Limit: *limit, RecentFirst: true},
+		output:    output,
+	}
+	if *watchInterval > 0 {
+		cmd.watch(*watchInterval)
+		return
+	}
+	if err := cmd.once(); err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+}
+
+// listCommand holds the resolved flags of the list subcommand.
+type listCommand struct {
+	// name is the subcommand, shown in the watch header.
+	name         string
+	inventory    *inventory.Inventory
+	opts         inventory.ListOptions
+	output       inventory.OutputOptions
+	alsoOutput   outputTargets
+	showRevision bool
+	// groupBy, if set, splits the output into one section per field value.
+	groupBy string
+	// failOnEmpty exits with exitEmpty after printing no hosts.
+	failOnEmpty bool
+	// clusters, if set, are listed instead of inventory; see listClusters.
+	clusters   []clusterInventory
+	requireAll bool
+	// pageSize, if set, streams the listing that many keys at a time when
+	// nothing needs every host at once; see stream.
+	pageSize int64
+}
+
+func (c listCommand) once() error {
+	if c.pageSize > 0 && len(c.clusters) == 0 && c.groupBy == "" && len(c.alsoOutput) == 0 && c.output.PostProcess == "" && !c.opts.RecentFirst {
+		return c.stream()
+	}
+	var result inventory.ListResult
+	var err error
+	if len(c.clusters) > 0 {
+		result, err = listClusters(c.clusters, c.opts, c.requireAll)
+	} else {
+		result, err = c.inventory.ListHostsWithOptions(c.opts)
+	}
+	if err != nil {
+		return err
+	}
+	inventory.WarnMalformed(result.Malformed)
+	if c.groupBy != "" {
+		printGroups(c.output, c.groupBy, result.Hosts)
+	} else {
+		printOutput(c.output, result.Hosts)
+	}
+	if err := writeOutputTargets(c.output, c.alsoOutput, result.Hosts); err != nil {
+		logging.Fatalf("Error writing additional output: %v", err)
+	}
+	if result.Truncated {
+		logging.Infof("Output truncated to %d hosts starting at offset %d; use --limit and --offset to see more", len(result.Hosts), c.opts.Offset)
+	}
+	if c.showRevision {
+		logging.Infof("Revision: %d", result.Revision)
+	}
+	failIfEmpty(c.failOnEmpty, len(result.Hosts))
+	return nil
+}
+
+// stream lists the hosts a page at a time, writing each page as it is
+// read with the formats that allow it, so neither etcd nor the command has
+// to hold the whole inventory at once.
+func (c listCommand) stream() error {
+	out, err := inventory.NewOutputStream(os.Stdout, c.output)
+	if err != nil {
+		logging.Fatalf("Error writing output: %v", err)
+	}
+	result, err := c.inventory.StreamHosts(c.opts, c.pageSize, func(hosts []inventory.Host) error {
+		if err := out.Write(hosts); err != nil {
+			logging.Fatalf("Error writing output: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		logging.Fatalf("Error writing output: %v", err)
+	}
+	inventory.WarnMalformed(result.Malformed)
+	if result.Truncated {
+		logging.Infof("Output truncated to %d hosts starting at offset %d; use --limit and --offset to see more", result.Count, c.opts.Offset)
+	}
+	if c.showRevision {
+		logging.Infof("Revision: %d", result.Revision)
+	}
+	failIfEmpty(c.failOnEmpty, result.Count)
+	return nil
+}
+
+// clusterField tags each host of a list --clusters with the context it was
+// listed from.
+const clusterField = "_cluster"
+
+// clusterConnector opens inventories on the contexts of the contexts file
+// for list --clusters, with the global settings of base.
+type clusterConnector struct {
+	path        string
+	dialTimeout time.Duration
+	base        *inventory.Inventory
+	explain     bool
+}
+
+// clusterInventory is the inventory of one context, or the error
+// connecting to it.
+type clusterInventory struct {
+	name string
+	inv  *inventory.Inventory
+	err  error
+}
+
+// connect opens an inventory on each named context, or on every context for
+// "all". Only an unknown name is an error: a cluster that cannot be
+// connected to is returned with its error, for listClusters to skip.
+func (c clusterConnector) connect(names []string) ([]clusterInventory, error) {
+	if c.explain {
+		return nil, errors.New("cannot be explained")
+	}
+	if c.path == "" {
+		return nil, errors.New("no contexts file")
+	}
+	contexts, err := loadContexts(c.path)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 1 && names[0] == "all" {
+		names = make([]string, 0, len(contexts.Contexts))
+		for name := range contexts.Contexts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no contexts in %s", c.path)
+	}
+	clusters := make([]clusterInventory, len(names))
+	for n, name := range names {
+		ctx, ok := contexts.Contexts[name]
+		if !ok {
+			return nil, fmt.Errorf("no context named %q", name)
+		}
+		clusters[n].name = name
+		security := clientSecurity{CACert: ctx.CACert, Cert: ctx.Cert, Key: ctx.Key, Username: ctx.Username, Password: ctx.Password}
+		if err := security.setUser(ctx.User); err != nil {
+			clusters[n].err = err
+			continue
+		}
+		client, err := getClient(ctx.Endpoints, c.dialTimeout, security)
+		if err != nil {
+			clusters[n].err = err
+			continue
+		}
+		prefix, err := inventory.NamespacePrefix(ctx.Namespace)
+		if err != nil {
+			clusters[n].err = fmt.Errorf("context %s: %w", name, err)
+			continue
+		}
+		inv := inventory.NewNamespacedInventory(client, prefix)
+		inv.Timeout = c.base.Timeout
+		inv.RawNames = c.base.RawNames
+		inv.Serializable = c.base.Serializable
+		inv.KeyFields = c.base.KeyFields
+		inv.VirtualFields = c.base.VirtualFields
+		inv.SecretFields = c.base.SecretFields
+		inv.Secrets = c.base.Secrets
+		inv.Debug = c.base.Debug
+		clusters[n].inv = inv
+	}
+	return clusters, nil
+}
+
+// listClusters lists every cluster concurrently and merges the hosts by
+// name, tagging each with clusterField. A cluster that fails is skipped
+// with a warning, unless requireAll; if all fail, so does the listing.
+// Offset and Limit apply to the merged list.
+func listClusters(clusters []clusterInventory, opts inventory.ListOptions, requireAll bool) (inventory.ListResult, error) {
+	perCluster := opts
+	perCluster.Offset = 0
+	if opts.Limit > 0 {
+		perCluster.Limit = opts.Offset + opts.Limit
+	}
+	results := make([]inventory.ListResult, len(clusters))
+	errs := make([]error, len(clusters))
+	var wg sync.WaitGroup
+	for n, cluster := range clusters {
+		if cluster.err != nil {
+			errs[n] = cluster.err
+			continue
+		}
+		wg.Add(1)
+		go func(n int, inv *inventory.Inventory) {
+			defer wg.Done()
+			results[n], errs[n] = inv.ListHostsWithOptions(perCluster)
+		}(n, cluster.inv)
+	}
+	wg.Wait()
+
+	var merged inventory.ListResult
+	listed := 0
+	for n, cluster := range clusters {
+		if errs[n] != nil {
+			if requireAll {
+				return inventory.ListResult{}, fmt.Errorf("cluster %s: %w", cluster.name, errs[n])
+			}
+			logging.Warnf("skipping cluster %s: %v", cluster.name, errs[n])
+			continue
+		}
+		listed++
+		for _, host := range results[n].Hosts {
+			if host.Data == nil {
+				host.Data = make(map[string]interface{})
+			}
+			host.Data[clusterField] = cluster.name
+			merged.Hosts = append(merged.Hosts, host)
+		}
+		merged.Truncated = merged.Truncated || results[n].Truncated
+		merged.Malformed = append(merged.Malformed, results[n].Malformed...)
+	}
+	if listed == 0 {
+		return inventory.ListResult{}, errors.New("no cluster could be listed")
+	}
+	sort.SliceStable(merged.Hosts, func(a, b int) bool { return merged.Hosts[a].Name < merged.Hosts[b].Name })
+	if opts.Offset >= int64(len(merged.Hosts)) {
+		merged.Hosts = nil
+	} else {
+		merged.Hosts = merged.Hosts[opts.Offset:]
+	}
+	if opts.Limit > 0 && int64(len(merged.Hosts)) > opts.Limit {
+		merged.Hosts = merged.Hosts[:opts.Limit]
+		merged.Truncated = true
+	}
+	return merged, nil
+}
+
+// ungroupedSection heads the list --group-by section of hosts without the
+// field.
+const ungroupedSection = "<ungrouped>"
+
+// printGroups prints hosts in one section per value of field, each under a
+// "=== field: value ===" header and rendered with the selected format. The
+// sections are sorted by value, with hosts lacking the field last.
+func printGroups(output inventory.OutputOptions, field string, hosts []inventory.Host) {
+	groups, ungrouped := inventory.GroupHosts(hosts, field)
+	values := make([]string, 0, len(groups))
+	for value := range groups {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for n, value := range values {
+		if n > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("=== %s: %s ===\n", field, value)
+		printOutput(output, groups[value])
+	}
+	if len(ungrouped) > 0 {
+		if len(values) > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("=== %s: %s ===\n", field, ungroupedSection)
+		printOutput(output, ungrouped)
+	}
+}
+
+// watch re-runs the listing every interval, like watch(1), until
+// interrupted. On a terminal the screen is cleared before each frame, which
+// also picks up any resize since the last one; errors are shown in the frame
+// instead of aborting so a dashboard survives a transient etcd failure.
+func (c listCommand) watch(interval time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	clearScreen := inventory.IsTerminal(os.Stdout)
+	for {
+		if clearScreen {
+			fmt.Print("\x1b[H\x1b[2J")
+		}
+		fmt.Printf("Every %s: inventory %s\t%s\n\n", interval, c.name, time.Now().Format(time.RFC1123))
+		if err := c.once(); err != nil {
+			logging.Errorf("Error listing hosts: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// eventField is the synthetic field watch adds to each host it prints: put
+// or delete.
+const eventField = "_event"
+
+// watchEvent is a change as watch prints it in json output, one per line.
+type watchEvent struct {
+	Type string `json:"type"`
+	sseHostEvent
+}
+
+// handleWatch streams host changes to stdout until interrupted: in json
+// output one watchEvent per line, in the other formats each change as a
+// host with eventField and ModRevisionField columns. A delete carries no
+// data to filter, so it is shown unless the host's last change seen did not
+// match.
+func handleWatch(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	sinceRevision := fs.Int64("since-revision", 0, "Replay the changes made after this etcd revision before streaming new ones")
+	namePrefix := fs.String("name-prefix", "", "Only show hosts whose name starts with this prefix")
+	filterExpr := fs.String("filter", "", "Only show hosts matching field=value, field!=value or field in CIDR (comma-separated, all must hold)")
+	fs.Parse(args)
+	if *sinceRevision < 0 || fs.NArg() != 0 {
+		logging.Fatal("Usage: watch [--since-revision N] [--name-prefix P] [--filter <expr>]")
+	}
+	filter, err := inventory.ParseHostFilter(*filterExpr)
+	if err != nil {
+		logging.Fatalf("Invalid --filter: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	output.Columns = append([]string{eventField, inventory.ModRevisionField}, output.Columns...)
+	matched := make(map[string]bool)
+	rev := *sinceRevision
+	if rev > 0 {
+		rev++
+	}
+	err = inv.WatchHosts(ctx, rev, func(event inventory.HostEvent) error {
+		if !strings.HasPrefix(event.Name, *namePrefix) {
+			return nil
+		}
+		host := event.Host
+		host.Name = event.Name
+		data := sseHostEvent{Name: event.Name, Revision: event.Revision, Resync: event.Resync}
+		eventType := "delete"
+		if event.Type == mvccpb.PUT {
+			eventType = "put"
+			if !filter.Match(host) {
+				matched[event.Name] = false
+				return nil
+			}
+			matched[event.Name] = true
+		} else {
+			if shown, seen := matched[event.Name]; seen && !shown {
+				delete(matched, event.Name)
+				return nil
+			}
+			delete(matched, event.Name)
+		}
+		if output.Format == "json" {
+			if event.Type == mvccpb.PUT {
+				hosts, err := jsonHosts(output, []inventory.Host{host})
+				if err != nil {
+					return err
+				}
+				data.Host = &hosts[0]
+			}
+			b, err := json.Marshal(watchEvent{Type: eventType, sseHostEvent: data})
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+			return nil
+		}
+		row := inventory.Host{Name: event.Name, Data: make(map[string]interface{}, len(host.Data)+2)}
+		for key, value := range host.Data {
+			row.Data[key] = value
+		}
+		row.Data[eventField] = eventType
+		row.Data[inventory.ModRevisionField] = event.Revision
+		printOutput(output, []inventory.Host{row})
+		// One header at the top is enough for a stream of CSV rows.
+		output.NoHeader = true
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		logging.Fatalf("Error watching hosts: %v", err)
+	}
+}
+
+// handleValues prints one row per distinct value of a field with the
+// number of hosts holding it, most common first unless --sort value.
+func handleValues(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	fs := flag.NewFlagSet("values", flag.ExitOnError)
+	field := fs.String("field", "", "Field whose distinct values to list")
+	order := fs.String("sort", "count", "Order of the values: count (most hosts first) or value (alphabetically)")
+	fs.Parse(args)
+
+	if *field == "" || fs.NArg() != 0 {
+		logging.Fatal("Usage: values --field <field> [--sort count|value]")
+	}
+	values, err := inv.FieldValues(*field)
+	if err != nil {
+		logging.Fatalf("Error listing values: %v", err)
+	}
+	switch *order {
+	case "value":
+	case "count":
+		sort.SliceStable(values, func(a, b int) bool { return values[a].Hosts > values[b].Hosts })
+		output.KeepOrder = true
+	default:
+		logging.Fatalf("Invalid --sort %q (use count or value)", *order)
+	}
+
+	rows := make([]inventory.Host, 0, len(values))
+	for _, value := range values {
+		rows = append(rows, inventory.Host{Name: value.Value, Data: map[string]interface{}{"count": value.Hosts}})
+	}
+	output.Wide = true
+	printOutput(output, rows)
+}
+
+// handleFindDuplicates prints one row per group of hosts sharing the values
+// of every --by field, and exits nonzero if any group is found.
+func handleFindDuplicates(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	fs := flag.NewFlagSet("find-duplicates", flag.ExitOnError)
+	var by stringList
+	fs.Var(&by, "by", "Field identifying the machine (repeatable; hosts must match on all)")
+	fs.Parse(args)
+
+	if len(by) == 0 {
+		logging.Fatal("Usage: find-duplicates --by <field> [--by <field>...]")
+	}
+
+	groups, err := inv.FindDuplicates(by)
+	if err != nil {
+		logging.Fatalf("Error finding duplicates: %v", err)
+	}
+	if len(groups) == 0 {
+		logging.Infof("No hosts share %s", strings.Join(by, "+"))
+		return
+	}
+
+	rows := make([]inventory.Host, 0, len(groups))
+	for _, group := range groups {
+		data := make(map[string]interface{}, len(by)+2)
+		for n, field := range by {
+			data[field] = group.Values[n]
+		}
+		members := make([]interface{}, 0, len(group.Hosts))
+		for _, host := range group.Hosts {
+			members = append(members, host.Name)
+		}
+		data["count"] = len(members)
+		data["hosts"] = members
+		rows = append(rows, inventory.Host{Name: strings.Join(group.Values, "+"), Data: data})
+	}
+	// The rows are summaries, not hosts, so show all their columns.
+	output.Wide = true
+	printOutput(output, rows)
+	logging.Infof("%d groups of hosts share %s", len(groups), strings.Join(by, "+"))
+	os.Exit(1)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oferchen/inventory/internal/logging"
+)
+
+// logTag identifies this program's entries in syslog and the journal.
+const logTag = "inventory"
+
+// sinkWriter sends each message, with the severity it was logged at, to a
+// local syslog or journald socket. A message the socket refuses goes to
+// stderr rather than being lost.
+type sinkWriter struct {
+	conn net.Conn
+	// stream is set for a connection-oriented syslog socket, where
+	// entries are newline-terminated instead of one per datagram.
+	stream bool
+	encode func(severity logging.Severity, msg string) []byte
+}
+
+func (w sinkWriter) send(severity logging.Severity, msg string) {
+	entry := w.encode(severity, msg)
+	if w.stream {
+		entry = append(entry, '\n')
+	}
+	if _, err := w.conn.Write(entry); err != nil {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+}
+
+// Write sends what other packages log through the log package as
+// informational.
+func (w sinkWriter) Write(p []byte) (int, error) {
+	w.send(logging.Info, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// syslogEntry formats a message in the traditional BSD syslog form
+// (RFC 3164) with the daemon facility.
+func syslogEntry(severity logging.Severity, msg string) []byte {
+	const facilityDaemon = 3
+	return fmt.Appendf(nil, "<%d>%s %s[%d]: %s", facilityDaemon*8+int(severity), time.Now().Format(time.Stamp), logTag, os.Getpid(), msg)
+}
+
+// journaldEntry formats a message in journald's native protocol. A
+// multi-line message takes the length-prefixed binary form.
+func journaldEntry(severity logging.Severity, msg string) []byte {
+	b := fmt.Appendf(nil, "PRIORITY=%d\nSYSLOG_IDENTIFIER=%s\n", severity, logTag)
+	if !strings.Contains(msg, "\n") {
+		return append(append(append(b, "MESSAGE="...), msg...), '\n')
+	}
+	b = append(b, "MESSAGE\n"...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(msg)))
+	return append(append(b, msg...), '\n')
+}
+
+// syslogSockets are where the local syslog daemon listens, by platform.
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// journaldSocket is journald's native protocol socket. It is a variable
+// for the tests, like syslogSockets.
+var journaldSocket = "/run/systemd/journal/socket"
+
+// setLogOutput routes the log messages to output: stderr, syslog or
+// journald, each at the severity it was logged at (see logging) and
+// anything else logged through the log package as informational. The
+// sinks stamp entries themselves, so log's timestamp is dropped for them.
+func setLogOutput(output string) error {
+	var w sinkWriter
+	switch output {
+	case "stderr":
+		return nil
+	case "syslog":
+		var err error
+		for _, path := range syslogSockets {
+			if w.conn, err = net.Dial("unixgram", path); err == nil {
+				break
+			}
+			if w.conn, err = net.Dial("unix", path); err == nil {
+				w.stream = true
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("no syslog socket: %w", err)
+		}
+		w.encode = syslogEntry
+	case "journald":
+		conn, err := net.Dial("unixgram", journaldSocket)
+		if err != nil {
+			return fmt.Errorf("no journald socket: %w", err)
+		}
+		w.conn, w.encode = conn, journaldEntry
+	default:
+		return fmt.Errorf("unknown log output %q (use stderr, syslog or journald)", output)
+	}
+	logging.SetSink(w.send)
+	log.SetFlags(0)
+	log.SetOutput(w)
+	return nil
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// stringList collects a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// debug is set by --debug, which also sets the inventory's Debug.
+var debug bool
+
+// debugf logs like the library's own debug output, with --debug.
+func debugf(format string, args ...interface{}) {
+	if debug {
+		logging.Debugf(format, args...)
+	}
+}
+
+// dryRun is set by --dry-run, under which the Inventory writes nothing.
+var dryRun bool
+
+// logDone logs that a write was made. Under --dry-run it logs nothing, as
+// nothing was written; the diffs printed instead show what would have been.
+func logDone(format string, args ...interface{}) {
+	if !dryRun {
+		logging.Infof(format, args...)
+	}
+}
+
+func main() {
+	etcd := addEtcdFlags(flag.CommandLine)
+	outputFlag := flag.String("output", "table", "Output format: "+strings.Join(inventory.FormatNames(), ", "))
+	colorFlag := flag.String("color", "auto", "Colorize table and block output: auto, always or never")
+	highlightFlag := flag.String("highlight", "", "Highlight cells matching field=value in table and block output")
+	discoverySRVFlag := flag.String("discovery-srv", "", "Domain whose _etcd-client._tcp SRV records list the etcd endpoints")
+	dialTimeoutFlag := flag.Duration("dial-timeout", inventory.DefaultDialTimeout, "Timeout for establishing the etcd connection")
+	timeoutFlag := flag.Duration("timeout", inventory.DefaultRequestTimeout, "Timeout for each etcd request")
+	consistencyFlag := flag.String("consistency", "linearizable", "Read consistency: linearizable (always current) or serializable (faster, served locally, may be slightly stale)")
+	namespaceFlag := flag.String("namespace", "", "Inventory to use: a name such as prod, kept under "+inventory.NamespacesKey+"prod, or an etcd prefix starting with / (e.g. /team-a)")
+	requireConnectionFlag := flag.Bool("require-connection", true, "Check that etcd is reachable before running the subcommand")
+	rawNamesFlag := flag.Bool("raw-names", false, "Use host names as etcd key segments without encoding (for stores written before encoding)")
+	flag.BoolVar(&debug, "debug", false, "Enable debug logging")
+	logOutputFlag := flag.String("log-output", "stderr", "Where log messages go: stderr, syslog or journald (for serve under systemd)")
+	wideFlag := flag.Bool("wide", false, "Show every field in table output")
+	columnsFlag := flag.String("columns", inventory.DefaultColumns, "Comma-separated fields shown after NAME in table output (ignored with --wide)")
+	maxColWidthFlag := flag.Int("max-col-width", 0, "Truncate table cells wider than this on a terminal (0 for no per-column limit)")
+	prettyFlag := flag.Bool("pretty", false, "Indent json, xml and yaml output (default when writing to a terminal)")
+	compactFlag := flag.Bool("compact", false, "Emit json, xml and yaml output with minimal whitespace (default when piped)")
+	noHeaderFlag := flag.Bool("no-header", false, "Omit the header line of CSV output")
+	noTruncateFlag := flag.Bool("no-truncate", false, "Never truncate table cells to fit the terminal")
+	redactFlag := flag.String("redact", "", "Comma-separated fields to mask in output")
+	secretFieldsFlag := flag.String("secret-fields", "", "Comma-separated fields encrypted before they are stored and masked in output (e.g. ipmi_password,api_token)")
+	secretKeyFlag := flag.String("secret-key", "", "Key the secret fields are encrypted with: file:PATH, env:VARIABLE or awskms:PATH (a file holding a data key encrypted by AWS KMS)")
+	revealSecretsFlag := flag.Bool("reveal-secrets", false, "Show the values of secret fields instead of masking them")
+	onlyFieldsFlag := flag.String("only-fields", "", "Comma-separated fields to show; all others are left out of the output")
+	timeFormatFlag := flag.String("time-format", "", "Show timestamps in table, block and describe output as rfc3339, relative (e.g. 2h ago) or a Go time layout (default as stored)")
+	timezoneFlag := flag.String("timezone", "", "Time zone to show timestamps in, e.g. UTC, Local or Europe/Amsterdam (default as stored)")
+	truncateValuesFlag := flag.Int("truncate-values", 0, "Show only the first line and N characters of each value in table and block output (0 for whole values)")
+	aliases := make(inventory.AliasMap)
+	flag.Var(aliases, "alias", "Show a field under another name in output as field=alias (repeatable; stored data is unchanged)")
+	var computeFlags stringList
+	flag.Var(&computeFlags, "compute", "Add a derived output field as field=template, using text/template over the host (repeatable)")
+	var virtualFieldFlags stringList
+	flag.Var(&virtualFieldFlags, "virtual-field", "Define a field computed on output and never stored, as field=template like --compute (repeatable; see also virtual-fields in the config)")
+	cacheTTLFlag := flag.Duration("cache-ttl", 0, "Cache host reads for this long (0 disables the cache; enabled reads are eventually consistent)")
+	cacheSizeFlag := flag.Int("cache-size", 1024, "Maximum number of hosts kept in the read cache")
+	cacheWatchFlag := flag.Bool("cache-watch", false, "Keep the read cache fresh with a background etcd watch")
+	localCacheFlag := flag.String("local-cache", "", "File keeping every host between runs of list, get, values and ansible-inventory, so they read only the hosts changed since and fall back to it, with a warning, when etcd is unreachable")
+	localCacheMaxAgeFlag := flag.Duration("local-cache-max-age", 0, "Read the --local-cache without contacting etcd when it was checked less than this long ago (0 always checks)")
+	refreshFlag := flag.Bool("refresh", false, "Read every host into the --local-cache again instead of only the changed ones")
+	auditFileFlag := flag.String("audit-file", "", "Append a JSON line describing every change to this file")
+	auditFlag := flag.Bool("audit", false, "Record every host change under /audit/ in etcd, in the same transaction as the change (see audit list)")
+	actorFlag := flag.String("actor", "", "Who is making changes, as recorded by --audit (default $USER)")
+	webhookFlag := flag.String("webhook", "", "POST a JSON description of every change to this URL (in serve mode, of every change in etcd); failures are logged, not fatal")
+	webhookTimeoutFlag := flag.Duration("webhook-timeout", 5*time.Second, "Timeout for each webhook request")
+	webhookRetriesFlag := flag.Int("webhook-retries", 3, "Times to retry a failed webhook request, with backoff")
+	contextFlag := flag.String("context", "", "Named cluster context to connect with (default the current context)")
+	contextsFileFlag := flag.String("contexts-file", "", "File with named cluster contexts (default ~/"+defaultContextsName+")")
+	encodingFlag := flag.String("encoding", "json", "How host values are written to etcd: json, gob or msgpack (all are readable)")
+	compressValuesFlag := flag.Bool("compress-values", false, "Gzip host values in etcd when that makes them smaller (compressed values are always readable)")
+	preserveOrderFlag := flag.Bool("preserve-order", false, "Store hosts with their fields in the order given, and show them in that order (changes the stored format)")
+	trimFlag := flag.Bool("trim", false, "Strip surrounding whitespace from string values when creating and updating hosts")
+	pruneEmptyFlag := flag.Bool("prune-empty", false, "Drop fields whose value is \"\", null, [] or {} when creating, updating and importing hosts")
+	lowercaseFlag := flag.String("lowercase", "", "Comma-separated fields whose string values are lower-cased when written")
+	uppercaseFlag := flag.String("uppercase", "", "Comma-separated fields whose string values are upper-cased when written")
+	rulesFileFlag := flag.String("rules-file", "", "YAML file of per-field rules (required, match, min, max, enum) checked by validate and on every write")
+	keyFieldFlag := flag.String("key-field", "", "Comma-separated fields whose values, joined by ':', name each host instead of a free-form name (e.g. serialnum)")
+	maxValueSizeFlag := flag.Int("max-value-size", inventory.DefaultMaxValueSize, "Refuse to write a host whose stored value exceeds this many bytes (0 for no limit)")
+	warnValueSizeFlag := flag.Int("warn-value-size", 256*1024, "Log a warning when writing a host whose stored value exceeds this many bytes (0 for none)")
+	postProcessFlag := flag.String("post-process", "", "Shell command to pipe the formatted output through, e.g. \"jq '.[].name'\"")
+	postProcessTimeoutFlag := flag.Duration("post-process-timeout", 30*time.Second, "Kill the --post-process command after this long (0 for no limit)")
+	addressFieldFlag := flag.String("address-field", "ipaddr", "Field holding the host address in consul and prometheus output, and as the HostName of export ssh-config, dns and hostsfile")
+	serviceFieldFlag := flag.String("service-field", "service", "Field holding the service name in consul output")
+	sdGroupFieldFlag := flag.String("sd-group-field", "", "Group the targets of prometheus output by this field, keeping only the labels each group shares (default one group per host)")
+	sdPortFlag := flag.Int("sd-port", 0, "Port appended to prometheus targets whose address has none (0 for none)")
+	schemaFlag := flag.String("schema", "", "JSON Schema file host data must match on writes and in validate (default the one stored with 'schema set')")
+	templateFileFlag := flag.String("template-file", "", "text/template file rendering the hosts in template output, with the helpers join, lookup, default and toJSON")
+	explainFlag := flag.Bool("explain", false, "Print the etcd requests the subcommand would make, without connecting to etcd")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the changes the subcommand would make to each host (colored, or JSON lines with --output json) without writing anything")
+	configFlag := flag.String("config", "", "Config file with flag defaults (default ~/.inventory.yaml if it exists)")
+	// Ansible runs a dynamic inventory script as "script --list" or
+	// "script --host NAME", so those alone select ansible-inventory.
+	if len(os.Args) > 1 && (os.Args[1] == "--list" || os.Args[1] == "--host" || strings.HasPrefix(os.Args[1], "--host=")) {
+		os.Args = append([]string{os.Args[0], "ansible-inventory"}, os.Args[1:]...)
+	}
+	flag.Usage = printUsage
+	flag.Parse()
+	// "inventory hosts <subcommand>" is the host subcommand itself, with
+	// global flags before or after "hosts".
+	if flag.Arg(0) == "hosts" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if sub, ok := findSubcommand(flag.Arg(0)); !ok || !sub.hosts {
+			logging.Fatal(unknownSubcommand(flag.Arg(0), true))
+		}
+	}
+	if err := setFlagDefaults(flag.CommandLine, envFlagValues(flag.CommandLine, envPrefix)); err != nil {
+		logging.Fatalf("environment: %v", err)
+	}
+	if err := setLogOutput(*logOutputFlag); err != nil {
+		logging.Fatalf("Invalid --log-output: %v", err)
+	}
+
+	contextsPath := *contextsFileFlag
+	if contextsPath == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			contextsPath = filepath.Join(home, defaultContextsName)
+		}
+	}
+	switch flag.Arg(0) {
+	case "":
+		printUsage()
+		os.Exit(2)
+	case "help":
+		handleHelp(flag.Args()[1:])
+		return
+	case "completion":
+		handleCompletion(flag.Args()[1:])
+		return
+	case "use-context":
+		handleUseContext(contextsPath, flag.Args()[1:])
+		return
+	case completeHostsCommand:
+	default:
+		if _, ok := findSubcommand(flag.Arg(0)); !ok {
+			logging.Fatal(unknownSubcommand(flag.Arg(0), false))
+		}
+	}
+	// The context is applied before the config file so that its connection
+	// settings take precedence over the config's general defaults.
+	if contextsPath != "" {
+		contexts, err := loadContexts(contextsPath)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		clusterCtx, ok, err := contexts.selected(*contextFlag)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		if ok {
+			if err := clusterCtx.apply(flag.CommandLine); err != nil {
+				logging.Fatalf("context: %v", err)
+			}
+		}
+	}
+
+	configPath := *configFlag
+	if configPath == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configPath = filepath.Join(home, defaultConfigName)
+		}
+	}
+	virtualFields := make(inventory.VirtualFields)
+	if configPath != "" {
+		cfg, err := loadConfig(configPath, *configFlag != "")
+		if err != nil {
+			logging.Fatal(err)
+		}
+		if err := cfg.apply(flag.CommandLine); err != nil {
+			logging.Fatalf("config %s: %v", configPath, err)
+		}
+		for field, text := range cfg.VirtualFields {
+			virtualFields[field] = text
+		}
+	}
+	for _, virtual := range virtualFieldFlags {
+		field, text, ok := strings.Cut(virtual, "=")
+		if !ok || field == "" {
+			logging.Fatalf("Invalid --virtual-field %q: expected field=template", virtual)
+		}
+		virtualFields[field] = text
+	}
+
+	if err := inventory.ValidateColorMode(*colorFlag); err != nil {
+		logging.Fatal(err)
+	}
+	if err := inventory.ValidateEncoding(*encodingFlag); err != nil {
+		logging.Fatal(err)
+	}
+	if err := inventory.ValidateFormat(*outputFlag); err != nil {
+		logging.Fatal(err)
+	}
+	if *outputFlag == "template" && *templateFileFlag == "" {
+		logging.Fatal("--output template needs --template-file")
+	}
+	var validationRules inventory.FieldRules
+	if *rulesFileFlag != "" {
+		var err error
+		if validationRules, err = inventory.LoadFieldRules(*rulesFileFlag); err != nil {
+			logging.Fatalf("Error loading rules: %v", err)
+		}
+	}
+	if *prettyFlag && *compactFlag {
+		logging.Fatal("--pretty cannot be combined with --compact")
+	}
+	timeFormat := inventory.TimeFormat{Layout: *timeFormatFlag}
+	if *timezoneFlag != "" {
+		location, err := time.LoadLocation(*timezoneFlag)
+		if err != nil {
+			logging.Fatalf("Invalid --timezone: %v", err)
+		}
+		timeFormat.Location = location
+	}
+	output := inventory.OutputOptions{Format: *outputFlag, ColorMode: *colorFlag, Wide: *wideFlag, Columns: inventory.SplitList(*columnsFlag),
+		MaxColWidth: *maxColWidthFlag, NoTruncate: *noTruncateFlag, Pretty: *prettyFlag, Compact: *compactFlag, NoHeader: *noHeaderFlag, TruncateValues: *truncateValuesFlag, Aliases: aliases,
+		PostProcess: *postProcessFlag, PostProcessTimeout: *postProcessTimeoutFlag, AddressField: *addressFieldFlag, ServiceField: *serviceFieldFlag, SDGroupField: *sdGroupFieldFlag, SDPort: *sdPortFlag, TimeFormat: timeFormat}
+	if *templateFileFlag != "" {
+		text, err := os.ReadFile(*templateFileFlag)
+		if err != nil {
+			logging.Fatalf("Error reading --template-file: %v", err)
+		}
+		if output.Template, err = inventory.ParseOutputTemplate(filepath.Base(*templateFileFlag), string(text)); err != nil {
+			logging.Fatalf("Invalid --template-file: %v", err)
+		}
+	}
+	if *highlightFlag != "" {
+		var err error
+		if output.Highlight, err = inventory.ParseFieldMatch(*highlightFlag); err != nil {
+			logging.Fatalf("Invalid --highlight: %v", err)
+		}
+	}
+	var secretFields map[string]bool
+	if *secretFieldsFlag != "" {
+		secretFields = make(map[string]bool)
+		for _, field := range inventory.SplitList(*secretFieldsFlag) {
+			secretFields[field] = true
+		}
+	}
+	var secrets *inventory.FieldCipher
+	if *secretKeyFlag != "" {
+		key, err := loadSecretKey(*secretKeyFlag)
+		if err != nil {
+			logging.Fatalf("Invalid --secret-key: %v", err)
+		}
+		if secrets, err = inventory.NewFieldCipher(key); err != nil {
+			logging.Fatalf("Invalid --secret-key: %v", err)
+		}
+	}
+	if len(virtualFields) > 0 {
+		transform, err := virtualFields.Transform()
+		if err != nil {
+			logging.Fatalf("Invalid %v", err)
+		}
+		output.Transforms = append(output.Transforms, transform)
+	}
+	if *onlyFieldsFlag != "" {
+		output.Transforms = append(output.Transforms, inventory.OnlyFields(inventory.SplitList(*onlyFieldsFlag)))
+	}
+	if *redactFlag != "" {
+		output.Transforms = append(output.Transforms, inventory.RedactFields(strings.Split(*redactFlag, ",")))
+	}
+	for _, compute := range computeFlags {
+		field, text, ok := strings.Cut(compute, "=")
+		if !ok || field == "" {
+			logging.Fatalf("Invalid --compute %q: expected field=template", compute)
+		}
+		transform, err := inventory.ComputeField(field, text)
+		if err != nil {
+			logging.Fatalf("Invalid --compute template for %s: %v", field, err)
+		}
+		output.Transforms = append(output.Transforms, transform)
+	}
+
+	endpoints := etcd.endpointList()
+	if *discoverySRVFlag != "" {
+		discovered, err := discoverEndpoints(*discoverySRVFlag)
+		switch {
+		case err != nil:
+			logging.Warnf("SRV discovery for %s failed, using %v: %v", *discoverySRVFlag, endpoints, err)
+		case len(discovered) == 0:
+			logging.Warnf("SRV discovery for %s found no endpoints, using %v", *discoverySRVFlag, endpoints)
+		default:
+			debugf("Discovered etcd endpoints via SRV: %v", discovered)
+			endpoints = discovered
+		}
+	}
+
+	prefix, err := inventory.NamespacePrefix(*namespaceFlag)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	if dryRun && *explainFlag {
+		logging.Fatal("--dry-run and --explain cannot be combined")
+	}
+	// The read commands served by the local cache reach etcd only through
+	// it, which falls back to the file when etcd is unreachable.
+	useLocalCache := *localCacheFlag != "" && localCacheCommands[flag.Arg(0)] && !*explainFlag
+	if *refreshFlag && *localCacheFlag == "" {
+		logging.Fatal("--refresh needs --local-cache")
+	}
+	var inv *inventory.Inventory
+	var etcdClient *clientv3.Client
+	var reconnect func() (*clientv3.Client, error)
+	if *explainFlag {
+		// Nothing connects, caches or audits: the plan is derived from the
+		// command line alone.
+		inv = inventory.NewExplainInventory(os.Stdout, prefix)
+		*cacheTTLFlag, *auditFileFlag, *webhookFlag, *auditFlag = 0, "", "", false
+	} else {
+		security, err := etcd.security()
+		if err != nil {
+			logging.Fatal(err)
+		}
+		etcdClient, err = getClient(endpoints, *dialTimeoutFlag, security)
+		if err != nil {
+			logging.Fatalf("Error initializing Etcd client: %v", err)
+		}
+		if *requireConnectionFlag && !useLocalCache {
+			if err := checkConnection(etcdClient, endpoints, *dialTimeoutFlag); err != nil {
+				logging.Fatal(err)
+			}
+		}
+		inv = inventory.NewNamespacedInventory(etcdClient, prefix)
+		if security.Username != "" {
+			// Only password logins get tokens that can expire.
+			reconnect = func() (*clientv3.Client, error) {
+				return getClient(endpoints, *dialTimeoutFlag, security)
+			}
+		}
+	}
+	inv.Timeout = *timeoutFlag
+	if reconnect != nil {
+		inv.EnableReauth(reconnect)
+	}
+	inv.RawNames = *rawNamesFlag
+	inv.MaxValueSize = *maxValueSizeFlag
+	inv.WarnValueSize = *warnValueSizeFlag
+	inv.KeyFields = inventory.SplitList(*keyFieldFlag)
+	inv.VirtualFields = virtualFields
+	inv.ValidationRules = validationRules
+	inv.ValueEncoding = *encodingFlag
+	inv.CompressValues = *compressValuesFlag
+	inv.PreserveOrder = *preserveOrderFlag
+	inv.SecretFields = secretFields
+	inv.Secrets = secrets
+	inv.Debug = debug
+	// Secrets are masked before any other transform, so computed fields
+	// cannot show them either.
+	if !*revealSecretsFlag {
+		output.Transforms = slices.Insert(output.Transforms, 0, inventory.HostTransform(inv.MaskSecrets))
+	}
+	if *trimFlag || *pruneEmptyFlag || *lowercaseFlag != "" || *uppercaseFlag != "" {
+		rules := &inventory.WriteRules{Trim: *trimFlag, PruneEmpty: *pruneEmptyFlag, Lowercase: make(map[string]bool), Uppercase: make(map[string]bool)}
+		for _, field := range inventory.SplitList(*lowercaseFlag) {
+			rules.Lowercase[field] = true
+		}
+		for _, field := range inventory.SplitList(*uppercaseFlag) {
+			if rules.Lowercase[field] {
+				logging.Fatalf("field %s cannot be both --lowercase and --uppercase", field)
+			}
+			rules.Uppercase[field] = true
+		}
+		inv.WriteRules = rules
+	}
+	switch *consistencyFlag {
+	case "linearizable":
+	case "serializable":
+		inv.Serializable = true
+	default:
+		logging.Fatalf("invalid --consistency %q (use linearizable or serializable)", *consistencyFlag)
+	}
+	if *schemaFlag != "" {
+		schema, err := inventory.LoadSchema(*schemaFlag)
+		if err != nil {
+			logging.Fatalf("Error loading schema: %v", err)
+		}
+		inv.Schema = schema
+	} else if schemaCommands[flag.Arg(0)] && !*explainFlag {
+		if err := inv.UseStoredSchema(); err != nil {
+			logging.Fatalf("Error loading schema: %v", err)
+		}
+	}
+	if *auditFlag {
+		actor := *actorFlag
+		if actor == "" {
+			actor = os.Getenv("USER")
+		}
+		if actor == "" {
+			actor = "unknown"
+		}
+		inv.EnableAuditEntries(actor, flag.Arg(0))
+	}
+	if *cacheTTLFlag > 0 {
+		if *cacheSizeFlag < 1 {
+			logging.Fatal("--cache-size must be positive")
+		}
+		inv.EnableCache(context.Background(), *cacheSizeFlag, *cacheTTLFlag, *cacheWatchFlag)
+	}
+	if useLocalCache {
+		err := inv.EnableLocalCache(*localCacheFlag, inventory.LocalCacheOptions{MaxAge: *localCacheMaxAgeFlag, Refresh: *refreshFlag})
+		var stale *inventory.StaleCacheError
+		switch {
+		case errors.As(err, &stale):
+			logging.Warnf("%v", err)
+		case err != nil:
+			logging.Fatalf("Error loading the local cache: %v", err)
+		}
+	}
+	if *auditFileFlag != "" {
+		audit, err := inventory.OpenAuditLog(*auditFileFlag, flag.Arg(0))
+		if err != nil {
+			logging.Fatalf("Error opening audit log: %v", err)
+		}
+		inv.EnableAudit(audit)
+	}
+	var hook *webhook
+	if *webhookFlag != "" {
+		if *webhookRetriesFlag < 0 {
+			logging.Fatal("--webhook-retries must not be negative")
+		}
+		hook = &webhook{url: *webhookFlag, client: &http.Client{Timeout: *webhookTimeoutFlag}, retries: *webhookRetriesFlag}
+		// serve reports changes from an etcd watch instead, which also
+		// sees the writes of other clients.
+		if flag.Arg(0) != "serve" {
+			command := flag.Arg(0)
+			inv.OnMutation(func(m inventory.Mutation) {
+				hook.send(webhookEvent{Source: command, Operation: m.Operation, Host: m.Host, Revision: m.Revision, FieldsChanged: m.FieldsChanged})
+			})
+		}
+	}
+
+	if dryRun {
+		// Installed last, so the audit, webhooks and results never see the
+		// writes.
+		inv.EnableDryRun(func(diff inventory.HostDiff) {
+			if err := inventory.WriteHostDiff(os.Stdout, output, diff); err != nil {
+				logging.Fatalf("Error writing diff: %v", err)
+			}
+		})
+	}
+
+	// With --output json, the mutating subcommands print what they changed
+	// instead of a log line.
+	var results *resultReporter
+	switch flag.Arg(0) {
+	case "create", "update", "remove":
+		if output.Format == "json" && !*explainFlag && !dryRun {
+			results = newResultReporter(inv, flag.Arg(0), output)
+		}
+	}
+
+	switch flag.Arg(0) {
+	case "create":
+		handleCreate(inv, flag.Args()[1:], results)
+
+	case "update":
+		handleUpdate(inv, flag.Args()[1:], results)
+
+	case "set-default":
+		handleSetDefault(inv, flag.Args()[1:])
+
+	case "remove":
+		handleRemove(inv, flag.Args()[1:], results)
+
+	case "list":
+		clusters := clusterConnector{path: contextsPath, dialTimeout: *dialTimeoutFlag, base: inv, explain: *explainFlag}
+		handleList(inv, flag.Args()[1:], output, clusters)
+
+	case "groups":
+		handleGroups(inv, flag.Args()[1:], output)
+
+	case "group":
+		handleGroup(inv, flag.Args()[1:], output)
+
+	case "ansible-inventory":
+		handleAnsibleInventory(inv, flag.Args()[1:], output)
+
+	case "prometheus":
+		handlePrometheus(inv, flag.Args()[1:], output)
+
+	case "values":
+		handleValues(inv, flag.Args()[1:], output)
+
+	case "get-field":
+		handleGetField(inv, flag.Args()[1:], *revealSecretsFlag)
+
+	case "validate":
+		handleValidate(inv, output)
+
+	case "schema":
+		handleSchema(inv, flag.Args()[1:])
+
+	case "stats":
+		handleStats(inv, output)
+
+	case "export":
+		handleExport(inv, flag.Args()[1:], output)
+
+	case "import":
+		handleImport(inv, flag.Args()[1:])
+
+	case "normalize":
+		handleNormalize(inv, flag.Args()[1:])
+
+	case "clone":
+		handleClone(inv, flag.Args()[1:])
+
+	case "rename":
+		handleRename(inv, flag.Args()[1:])
+
+	case "set":
+		handleSet(inv, flag.Args()[1:])
+
+	case "bulk-update":
+		handleBulkUpdate(inv, flag.Args()[1:])
+
+	case "describe":
+		handleDescribe(inv, flag.Args()[1:], output.TimeFormat, *revealSecretsFlag)
+
+	case "serve":
+		handleServe(inv, flag.Args()[1:], output, hook, *revealSecretsFlag)
+
+	case "local-cache":
+		handleLocalCache(inv, flag.Args()[1:], *localCacheFlag)
+
+	case "notify":
+		handleNotify(inv, flag.Args()[1:], *revealSecretsFlag)
+
+	case "tui":
+		handleTUI(inv, flag.Args()[1:])
+
+	case "sync":
+		handleSync(inv, flag.Args()[1:])
+
+	case "namespace":
+		handleNamespace(inv, flag.Args()[1:], output)
+
+	case "auth":
+		handleAuth(inv, flag.Args()[1:], output)
+
+	case "keys":
+		handleKeys(etcdClient, prefix, flag.Args()[1:], output)
+
+	case completeHostsCommand:
+		handleCompleteHosts(inv, flag.Args()[1:])
+
+	case "edit":
+		handleEdit(inv, flag.Args()[1:])
+
+	case "exists":
+		handleExists(inv, flag.Args()[1:])
+
+	case "recent":
+		handleRecent(inv, flag.Args()[1:], output)
+
+	case "watch":
+		handleWatch(inv, flag.Args()[1:], output)
+
+	case "get":
+		handleGet(inv, flag.Args()[1:], output)
+
+	case "compare":
+		handleCompare(inv, flag.Args()[1:], *revealSecretsFlag)
+
+	case "touch":
+		handleTouch(inv, flag.Args()[1:])
+
+	case "status":
+		handleStatus(inv, flag.Args()[1:], output)
+
+	case "tag":
+		handleTag(inv, flag.Args()[1:])
+
+	case "snapshot":
+		handleSnapshot(inv, flag.Args()[1:])
+
+	case "find-duplicates":
+		handleFindDuplicates(inv, flag.Args()[1:], output)
+
+	case "history":
+		handleHistory(inv, flag.Args()[1:], output)
+
+	case "audit":
+		handleAudit(inv, flag.Args()[1:], output)
+
+	case "preflight":
+		handlePreflight(inv)
+
+	case "maintenance":
+		handleMaintenance(inv, flag.Args()[1:])
+
+	case "seed":
+		handleSeed(inv, flag.Args()[1:])
+
+	case "prune-empty":
+		handlePruneEmpty(inv, flag.Args()[1:])
+
+	default:
+		logging.Fatal(unknownSubcommand(flag.Arg(0), false))
+	}
+	if dryRun {
+		logging.Infof("Dry run: nothing was written")
+	}
+}
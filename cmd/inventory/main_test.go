@@ -0,0 +1,1936 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/etcdtest"
+	"github.com/oferchen/inventory/internal/logging"
+)
+
+func TestReadFieldValue(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"id_ed25519.pub": []byte("ssh-ed25519 AAAAC3Nza host\n"),
+		"cert.der":       {0x30, 0x82, 0xff, 0x00},
+		"ports.json":     []byte(`{"http": 80, "tls": [443, 8443]}`),
+		"broken.json":    []byte(`{"http":`),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		arg     string
+		want    interface{}
+		wantErr bool
+	}{
+		{arg: "plain", want: "plain"},
+		{arg: "@@handle", want: "@handle"},
+		{arg: "@" + filepath.Join(dir, "id_ed25519.pub"), want: "ssh-ed25519 AAAAC3Nza host\n"},
+		{arg: "@" + filepath.Join(dir, "cert.der"), want: []byte{0x30, 0x82, 0xff, 0x00}},
+		{arg: "@" + filepath.Join(dir, "ports.json"), want: map[string]interface{}{"http": 80.0, "tls": []interface{}{443.0, 8443.0}}},
+		{arg: "@" + filepath.Join(dir, "broken.json"), wantErr: true},
+		{arg: "@" + filepath.Join(dir, "missing"), wantErr: true},
+	} {
+		got, err := readFieldValue(tc.arg)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("readFieldValue(%q) error = %v, want error %v", tc.arg, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("readFieldValue(%q) = %#v, want %#v", tc.arg, got, tc.want)
+		}
+	}
+}
+
+func TestBulkRateLimit(t *testing.T) {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	bulk := addBulkFlags(fs)
+	if err := fs.Parse([]string{"--rate-limit", "20", "--concurrency", "4"}); err != nil {
+		t.Fatal(err)
+	}
+	hosts := make([]inventory.Host, 11)
+	for n := range hosts {
+		hosts[n].Name = fmt.Sprintf("host%02d", n)
+	}
+	var calls atomic.Int32
+	start := time.Now()
+	errs := bulk.run(hosts, func(int, inventory.Host) error {
+		calls.Add(1)
+		return nil
+	})
+	elapsed := time.Since(start)
+	for n, err := range errs {
+		if err != nil {
+			t.Errorf("%s: %v", hosts[n].Name, err)
+		}
+	}
+	if calls.Load() != int32(len(hosts)) {
+		t.Errorf("%d calls, want %d", calls.Load(), len(hosts))
+	}
+	// The first call is free, the other 10 wait 1/20s each however many
+	// workers there are.
+	if want := 450 * time.Millisecond; elapsed < want {
+		t.Errorf("%d calls at 20/s took %v, want at least %v", len(hosts), elapsed, want)
+	}
+}
+
+// newTestInventory returns an Inventory over a fresh in-memory etcd.
+func newTestInventory(t *testing.T) *inventory.Inventory {
+	t.Helper()
+	_, client := etcdtest.Start(t)
+	return inventory.NewInventory(client)
+}
+
+// createHosts creates the named hosts with their data.
+func createHosts(t *testing.T, inv *inventory.Inventory, hosts map[string]map[string]interface{}) {
+	t.Helper()
+	for name, data := range hosts {
+		if err := inv.CreateHost(name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// captureStdout returns what fn prints to os.Stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+	fn()
+	out, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestHandleSet(t *testing.T) {
+	inv := newTestInventory(t)
+	createHosts(t, inv, map[string]map[string]interface{}{
+		"web01": {"role": "web"},
+		"web02": {"role": "web"},
+		"db01":  {"role": "db"},
+	})
+	maintenance := func() map[string]interface{} {
+		result, err := inv.ListHostsWithOptions(inventory.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := make(map[string]interface{})
+		for _, host := range result.Hosts {
+			if value, ok := host.Data["maintenance"]; ok {
+				set[host.Name] = value
+			}
+		}
+		return set
+	}
+
+	out := captureStdout(t, func() { handleSet(inv, []string{"--filter", "role=web", "--dry-run", "maintenance=true"}) })
+	if out != "web01\nweb02\n" {
+		t.Errorf("dry run printed %q, want the two web hosts", out)
+	}
+	if set := maintenance(); len(set) != 0 {
+		t.Errorf("dry run set maintenance on %v", set)
+	}
+
+	handleSet(inv, []string{"--filter", "role=web", "maintenance=true"})
+	if set, want := maintenance(), map[string]interface{}{"web01": "true", "web02": "true"}; !reflect.DeepEqual(set, want) {
+		t.Errorf("maintenance set on %v, want %v", set, want)
+	}
+}
+
+func TestHTTPFormats(t *testing.T) {
+	inv := newTestInventory(t)
+	createHosts(t, inv, map[string]map[string]interface{}{"web01": {"site": "ams"}})
+	handler := newHTTPHandler(hostSource{inv: inv}, inventory.OutputOptions{}, 0, false)
+
+	for _, tc := range []struct {
+		target, accept string
+		status         int
+		contentType    string
+		body           string
+	}{
+		{"/hosts", "", http.StatusOK, "application/json", `"items":[{"name":"web01"`},
+		{"/hosts", "application/json", http.StatusOK, "application/json", `"items":[{"name":"web01"`},
+		{"/hosts/web01", "", http.StatusOK, "application/json", `{"name":"web01"`},
+		{"/hosts", "application/yaml", http.StatusOK, "application/yaml", "name: web01"},
+		{"/hosts", "text/xml", http.StatusOK, "application/xml", `<host name="web01">`},
+		{"/hosts", "text/csv", http.StatusOK, "text/csv; charset=utf-8", "web01,"},
+		{"/hosts", "text/plain", http.StatusOK, "text/plain; charset=utf-8", "NAME"},
+		{"/hosts", "text/csv;q=0.5, application/xml", http.StatusOK, "application/xml", `<host name="web01">`},
+		{"/hosts", "image/png, */*;q=0.1", http.StatusOK, "application/json", `"items"`},
+		{"/hosts?format=yaml", "application/json", http.StatusOK, "application/yaml", "name: web01"},
+		{"/hosts", "image/png", http.StatusNotAcceptable, "", "no acceptable format"},
+		{"/hosts?format=bogus", "", http.StatusNotAcceptable, "", "no acceptable format"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		name := tc.target + " Accept: " + tc.accept
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", name, rec.Code, tc.status)
+		}
+		if tc.contentType != "" && rec.Header().Get("Content-Type") != tc.contentType {
+			t.Errorf("%s: Content-Type %q, want %q", name, rec.Header().Get("Content-Type"), tc.contentType)
+		}
+		if !strings.Contains(rec.Body.String(), tc.body) {
+			t.Errorf("%s: body lacks %q:\n%s", name, tc.body, rec.Body.String())
+		}
+	}
+}
+
+func TestPrefixesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prefixes")
+	if err := os.WriteFile(path, []byte("# racks\n/rack/b/\n\n  /rack/a/  \n/rack/b/\n# /rack/d/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prefixes, err := readPrefixesFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/rack/b/", "/rack/a/", "/rack/b/"}; !reflect.DeepEqual(prefixes, want) {
+		t.Errorf("read prefixes %q, want %q", prefixes, want)
+	}
+	if _, err := readPrefixesFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("reading a missing prefixes file succeeded")
+	}
+
+	merged := mergePrefixes([]string{"/rack/c/"}, strings.Split("/rack/a/,", ","), prefixes)
+	if want := []string{"/rack/c/", "/rack/a/", "/rack/b/"}; !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged prefixes %q, want %q", merged, want)
+	}
+
+	_, client := etcdtest.Start(t)
+	for _, key := range []string{"/rack/a/1", "/rack/b/1", "/rack/c/1", "/rack/d/1"} {
+		if _, err := client.Put(t.Context(), key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := captureStdout(t, func() {
+		handleKeys(client, "", []string{"iter", "--key-prefixes", "/rack/c/,/rack/a/", "--prefixes-file", path}, inventory.OutputOptions{Format: "csv"})
+	})
+	var keys []string
+	for _, key := range []string{"/rack/a/1", "/rack/b/1", "/rack/c/1", "/rack/d/1"} {
+		if at := strings.Index(out, key); at >= 0 {
+			keys = append(keys, key)
+			if strings.LastIndex(out, key) != at {
+				t.Errorf("%s listed twice:\n%s", key, out)
+			}
+		}
+	}
+	slices.SortFunc(keys, func(a, b string) int { return strings.Index(out, a) - strings.Index(out, b) })
+	if want := []string{"/rack/c/1", "/rack/a/1", "/rack/b/1"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys iter listed %q, want %q:\n%s", keys, want, out)
+	}
+}
+
+func TestKeyRanges(t *testing.T) {
+	for _, tc := range []struct {
+		arg, start, err string
+	}{
+		{arg: "/b:/d", start: "/b"},
+		{arg: "/a:b:/c", start: "/a"},
+		{arg: "/b", err: "expected start:end"},
+		{arg: ":/d", err: "expected start:end"},
+		{arg: "/b:", err: "expected start:end"},
+		{arg: "/d:/b", err: "start must sort before end"},
+		{arg: "/b:/b", err: "start must sort before end"},
+	} {
+		r, err := parseKeyRange(tc.arg)
+		switch {
+		case tc.err != "":
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("parseKeyRange(%q) = %v, want an error containing %q", tc.arg, err, tc.err)
+			}
+		case err != nil:
+			t.Errorf("parseKeyRange(%q): %v", tc.arg, err)
+		case r.key != tc.start:
+			t.Errorf("parseKeyRange(%q) starts at %q, want %q", tc.arg, r.key, tc.start)
+		}
+	}
+
+	_, client := etcdtest.Start(t)
+	all := []string{"/a", "/b", "/b/1", "/c", "/d", "/e"}
+	for _, key := range all {
+		if _, err := client.Put(t.Context(), key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"iter", "--range", "/b:/d"}, []string{"/b", "/b/1", "/c"}},
+		{[]string{"iter", "--from-key", "/c"}, []string{"/c", "/d", "/e"}},
+	} {
+		out := captureStdout(t, func() {
+			handleKeys(client, "", tc.args, inventory.OutputOptions{Format: "csv"})
+		})
+		var keys []string
+		for _, line := range strings.Split(out, "\n") {
+			key, _, _ := strings.Cut(line, ",")
+			if slices.Contains(all, key) {
+				keys = append(keys, key)
+			}
+		}
+		if !reflect.DeepEqual(keys, tc.want) {
+			t.Errorf("keys %q listed %q, want %q:\n%s", tc.args, keys, tc.want, out)
+		}
+	}
+}
+
+func TestHTTPPagination(t *testing.T) {
+	inv := newTestInventory(t)
+	hosts := make(map[string]map[string]interface{})
+	for n := 1; n <= 7; n++ {
+		site := "ams"
+		if n%2 == 0 {
+			site = "fra"
+		}
+		hosts[fmt.Sprintf("web%02d", n)] = map[string]interface{}{"site": site}
+	}
+	createHosts(t, inv, hosts)
+	handler := newHTTPHandler(hostSource{inv: inv}, inventory.OutputOptions{}, 5, false)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	for _, tc := range []struct {
+		query string
+		pages []int
+		names []string
+	}{
+		{"limit=3", []int{3, 3, 1}, []string{"web01", "web02", "web03", "web04", "web05", "web06", "web07"}},
+		{"limit=10", []int{5, 2}, []string{"web01", "web02", "web03", "web04", "web05", "web06", "web07"}},
+		{"", []int{5, 2}, []string{"web01", "web02", "web03", "web04", "web05", "web06", "web07"}},
+		{"limit=2&filter=site%3Dfra", []int{2, 1}, []string{"web02", "web04", "web06"}},
+	} {
+		var pages []int
+		var names []string
+		token := ""
+		for len(pages) < 10 {
+			target := "/hosts?" + tc.query
+			if token != "" {
+				target += "&continue=" + token
+			}
+			rec := get(target)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: status %d: %s", target, rec.Code, rec.Body)
+			}
+			var page hostPage
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatalf("%s: %v", target, err)
+			}
+			pages = append(pages, len(page.Items))
+			for _, host := range page.Items {
+				names = append(names, host.Name)
+			}
+			if page.Continue != rec.Header().Get("Continue") {
+				t.Errorf("%s: body continue %q, header %q", target, page.Continue, rec.Header().Get("Continue"))
+			}
+			if token = page.Continue; token == "" {
+				break
+			}
+		}
+		if !reflect.DeepEqual(pages, tc.pages) || !reflect.DeepEqual(names, tc.names) {
+			t.Errorf("%s: pages %v of %v, want %v of %v", tc.query, pages, names, tc.pages, tc.names)
+		}
+	}
+
+	rec := get("/hosts?limit=4&format=csv")
+	if token := rec.Header().Get("Continue"); token == "" {
+		t.Error("a truncated CSV page has no Continue header")
+	} else if rec = get("/hosts?limit=4&format=csv&continue=" + token); !strings.Contains(rec.Body.String(), "web05,") || strings.Contains(rec.Body.String(), "web04,") {
+		t.Errorf("second CSV page:\n%s", rec.Body)
+	}
+
+	for _, query := range []string{"limit=0", "limit=x", "continue=***", "continue="} {
+		want := http.StatusBadRequest
+		if query == "continue=" {
+			want = http.StatusOK
+		}
+		if rec := get("/hosts?" + query); rec.Code != want {
+			t.Errorf("%s: status %d, want %d", query, rec.Code, want)
+		}
+	}
+}
+
+func TestPostProcessOutput(t *testing.T) {
+	hosts := []inventory.Host{{Name: "web01", Data: map[string]interface{}{"site": "ams"}}, {Name: "web02", Data: map[string]interface{}{"site": "fra"}}}
+	for _, tc := range []struct {
+		command string
+		timeout time.Duration
+		want    string
+		err     string
+	}{
+		{"cat", 0, `"name":"web01"`, ""},
+		{"tr a-z A-Z", 0, `"NAME":"WEB01"`, ""},
+		{"grep -c site", 0, "1\n", ""},
+		{"echo partial; exit 3", 0, "", `"echo partial; exit 3": exit status 3`},
+		{"no-such-filter-command", 0, "", `"no-such-filter-command": command not found`},
+		{"sleep 10", 100 * time.Millisecond, "", `"sleep 10" timed out after 100ms`},
+	} {
+		var out strings.Builder
+		start := time.Now()
+		err := postProcessOutput(&out, inventory.OutputOptions{Format: "json", Compact: true, PostProcess: tc.command, PostProcessTimeout: tc.timeout}, hosts)
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s ran for %v", tc.command, elapsed)
+		}
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: error %v, want %q", tc.command, err, tc.err)
+			}
+			if out.Len() > 0 {
+				t.Errorf("%s failed but wrote %q", tc.command, out.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.command, err)
+		} else if !strings.Contains(out.String(), tc.want) {
+			t.Errorf("%s wrote %q, want it to contain %q", tc.command, out.String(), tc.want)
+		}
+	}
+}
+
+func TestBulkInterrupted(t *testing.T) {
+	resumeFile := filepath.Join(t.TempDir(), "resume")
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	bulk := addBulkFlags(fs)
+	if err := fs.Parse([]string{"--resume-file", resumeFile}); err != nil {
+		t.Fatal(err)
+	}
+	hosts := make([]inventory.Host, 10)
+	for n := range hosts {
+		hosts[n].Name = fmt.Sprintf("host%02d", n)
+	}
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var finished []int
+	errs := bulk.run(hosts, func(n int, host inventory.Host) error {
+		switch n {
+		case 1:
+			return fmt.Errorf("%s failed", host.Name)
+		case 3:
+			// Interrupted mid-call: the call in flight still finishes.
+			if err := self.Signal(os.Interrupt); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		finished = append(finished, n)
+		return nil
+	})
+	if want := []int{0, 2, 3}; !reflect.DeepEqual(finished, want) {
+		t.Errorf("finished %v, want %v", finished, want)
+	}
+	for n, err := range errs {
+		var want error
+		switch {
+		case n == 1:
+			want = err
+			if err == nil {
+				t.Errorf("%s: no error", hosts[n].Name)
+			}
+		case n > 3:
+			want = errNotStarted
+		}
+		if err != want {
+			t.Errorf("%s: %v, want %v", hosts[n].Name, err, want)
+		}
+	}
+	resume, err := os.ReadFile(resumeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "host01\nhost04\nhost05\nhost06\nhost07\nhost08\nhost09\n"; string(resume) != want {
+		t.Errorf("resume file lists\n%s\nwant\n%s", resume, want)
+	}
+}
+
+func TestDescribeVirtualFields(t *testing.T) {
+	inv := newTestInventory(t)
+	createHosts(t, inv, map[string]map[string]interface{}{"web01": {"domain": "example.com"}})
+	inv.VirtualFields = inventory.VirtualFields{"fqdn": "{{.Name}}.{{.Data.domain}}"}
+	out := captureStdout(t, func() { handleDescribe(inv, []string{"web01"}, inventory.TimeFormat{}, false) })
+	stored, virtual, ok := strings.Cut(out, "Virtual fields (computed, not stored):\n")
+	if !ok {
+		t.Fatalf("describe has no virtual fields section:\n%s", out)
+	}
+	if strings.Contains(stored, "fqdn") || !strings.Contains(stored, "domain:") {
+		t.Errorf("stored fields section:\n%s", stored)
+	}
+	if !strings.Contains(virtual, "fqdn:  web01.example.com") {
+		t.Errorf("virtual fields section:\n%s", virtual)
+	}
+}
+
+func TestMutationResults(t *testing.T) {
+	inv := newTestInventory(t)
+	createHosts(t, inv, map[string]map[string]interface{}{"db01": {"site": "ams"}, "db02": {"site": "fra"}})
+	type result struct {
+		Operation     string   `json:"operation"`
+		Host          string   `json:"host"`
+		Status        string   `json:"status"`
+		Revision      int64    `json:"revision"`
+		FieldsChanged []string `json:"fields_changed"`
+	}
+	for _, tc := range []struct {
+		operation string
+		run       func(results *resultReporter)
+		want      []result
+	}{
+		{"create", func(r *resultReporter) { handleCreate(inv, []string{"web01", `{"site":"ams"}`}, r) },
+			[]result{{"create", "web01", "created", 1, []string{"site"}}}},
+		{"create", func(r *resultReporter) { handleCreate(inv, []string{"web01", `{"site":"fra"}`}, r) },
+			[]result{{"create", "web01", "updated", 1, []string{"site"}}}},
+		{"update", func(r *resultReporter) { handleUpdate(inv, []string{"web01", "rack", "r1"}, r) },
+			[]result{{"update", "web01", "updated", 1, []string{"rack"}}}},
+		{"update", func(r *resultReporter) { handleUpdate(inv, []string{"web01", "--patch", `{"rack":null}`}, r) },
+			[]result{{"update", "web01", "updated", 1, []string{"rack"}}}},
+		{"remove", func(r *resultReporter) { handleRemove(inv, []string{"--yes", "web01"}, r) },
+			[]result{{"remove", "web01", "removed", 1, []string{"site"}}}},
+		{"remove", func(r *resultReporter) { handleRemove(inv, []string{"--yes", "web01"}, r) },
+			[]result{{"remove", "web01", "not_found", 0, []string{}}}},
+		{"remove", func(r *resultReporter) { handleRemove(inv, []string{"--match", "db*", "--yes"}, r) },
+			[]result{{"remove", "db01", "removed", 1, []string{"site"}}, {"remove", "db02", "removed", 1, []string{"site"}}}},
+	} {
+		results := newResultReporter(inv, tc.operation, inventory.OutputOptions{Format: "json"})
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+		out := captureStdout(t, func() { tc.run(results) })
+		log.SetOutput(os.Stderr)
+		if logged.Len() > 0 {
+			t.Errorf("%s logged %q besides its result", tc.operation, logged.String())
+		}
+		if strings.Count(out, "\n") != 1 {
+			t.Errorf("%s printed more than one compact line:\n%s", tc.operation, out)
+		}
+		var got []result
+		if strings.HasPrefix(out, "[") {
+			err := json.Unmarshal([]byte(out), &got)
+			if err != nil {
+				t.Fatalf("%s: %v: %s", tc.operation, err, out)
+			}
+		} else {
+			var single result
+			if err := json.Unmarshal([]byte(out), &single); err != nil {
+				t.Fatalf("%s: %v: %s", tc.operation, err, out)
+			}
+			got = []result{single}
+			if len(tc.want) != 1 {
+				t.Errorf("%s printed one object for %d hosts: %s", tc.operation, len(tc.want), out)
+			}
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.Trim(out, "[]\n")), &fields); err == nil {
+			if keys := slices.Sorted(maps.Keys(fields)); !reflect.DeepEqual(keys, []string{"fields_changed", "host", "operation", "revision", "status"}) {
+				t.Errorf("%s result has keys %v", tc.operation, keys)
+			}
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s printed %s, want %d results", tc.operation, out, len(tc.want))
+			continue
+		}
+		for n := range got {
+			// A write has a revision; only its presence is compared.
+			if got[n].Revision > 0 {
+				got[n].Revision = 1
+			}
+			// The timestamps change only if the write is in a new second.
+			got[n].FieldsChanged = slices.DeleteFunc(got[n].FieldsChanged, func(field string) bool {
+				return field == inventory.CreatedAtField || field == inventory.UpdatedAtField
+			})
+			if !reflect.DeepEqual(got[n], tc.want[n]) {
+				t.Errorf("%s printed %+v, want %+v", tc.operation, got[n], tc.want[n])
+			}
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		fail    int32
+		retries int
+		timeout time.Duration
+		want    int32
+		logged  string
+	}{
+		{name: "delivered", want: 1},
+		{name: "retried", fail: 1, retries: 1, want: 2},
+		{name: "given up", fail: 3, retries: 1, want: 2, logged: "failed after 2 attempts"},
+		{name: "timed out", fail: -1, timeout: 50 * time.Millisecond, want: 1, logged: "failed after 1 attempts"},
+	} {
+		var requests atomic.Int32
+		var got webhookEvent
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := requests.Add(1)
+			if tc.fail < 0 {
+				// Reading the body lets the server see the client hang up.
+				io.Copy(io.Discard, r.Body)
+				<-r.Context().Done()
+				return
+			}
+			if n <= tc.fail {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("%s: webhook sent Content-Type %q", tc.name, ct)
+			}
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Errorf("%s: decoding the webhook body: %v", tc.name, err)
+			}
+		}))
+
+		inv := newTestInventory(t)
+		hook := &webhook{url: server.URL, client: &http.Client{Timeout: cmp.Or(tc.timeout, 5*time.Second)}, retries: tc.retries}
+		inv.OnMutation(func(m inventory.Mutation) {
+			hook.send(webhookEvent{Source: "create", Operation: m.Operation, Host: m.Host, Revision: m.Revision, FieldsChanged: m.FieldsChanged})
+		})
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+		handleCreate(inv, []string{"web01", `{"site":"ams"}`}, nil)
+		log.SetOutput(os.Stderr)
+		server.Close()
+
+		// A failed delivery never undoes or fails the change.
+		if _, err := inv.GetHost("web01"); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if n := requests.Load(); n != tc.want {
+			t.Errorf("%s: webhook got %d requests, want %d", tc.name, n, tc.want)
+		}
+		if tc.logged == "" {
+			if strings.Contains(logged.String(), "Webhook") {
+				t.Errorf("%s: logged %q", tc.name, logged.String())
+			}
+			if got.Source != "create" || got.Operation != "put" || got.Host != "web01" || got.Revision == 0 || got.Time.IsZero() || !slices.Contains(got.FieldsChanged, "site") {
+				t.Errorf("%s: webhook got %+v", tc.name, got)
+			}
+		} else if !strings.Contains(logged.String(), tc.logged) {
+			t.Errorf("%s: logged %q, want %q", tc.name, logged.String(), tc.logged)
+		}
+	}
+}
+
+func TestEnvFlags(t *testing.T) {
+	newFlags := func() (*flag.FlagSet, *etcdFlags) {
+		fs := flag.NewFlagSet("inventory", flag.ContinueOnError)
+		fs.String("output", "table", "")
+		etcd := addEtcdFlags(fs)
+		fs.String("namespace", "", "")
+		fs.String("log-output", "", "")
+		fs.Duration("timeout", 5*time.Second, "")
+		fs.Duration("dial-timeout", 5*time.Second, "")
+		return fs, etcd
+	}
+	t.Setenv("INVENTORY_OUTPUT", "json")
+	t.Setenv("INVENTORY_ETCD_ENDPOINTS", "env1:2379,env2:2379")
+	t.Setenv("INVENTORY_TIMEOUT", "30s")
+	t.Setenv("INVENTORY_DIAL_TIMEOUT", "2s")
+	t.Setenv("INVENTORY_LOG_OUTPUT", "")
+	t.Setenv("INVENTORY_ETCD_PASSWORD", "s3cret")
+	t.Setenv("OUTPUT", "csv")
+	config := map[string]string{"etcd-endpoints": "config:2379", "timeout": "10s", "namespace": "/team", "log-output": "stderr", "cacert": "config-ca.pem"}
+
+	for _, tc := range []struct {
+		args []string
+		// env is set on top of the environment above.
+		env  map[string]string
+		want map[string]string
+		// endpoints and security are what the connection flags give.
+		endpoints []string
+		security  clientSecurity
+	}{
+		// Environment over the config file, which fills in the rest.
+		{nil, nil, map[string]string{"output": "json", "timeout": "30s", "dial-timeout": "2s", "namespace": "/team", "log-output": "stderr", "etcd-host": "localhost"},
+			[]string{"env1:2379", "env2:2379"}, clientSecurity{CACert: "config-ca.pem", Password: "s3cret"}},
+		// The command line over the environment.
+		{[]string{"--output", "yaml", "--timeout=1m", "--etcd-ca", "ca.pem", "--etcd-cert", "cert.pem", "--etcd-key", "key.pem", "--etcd-username", "ops"}, nil,
+			map[string]string{"output": "yaml", "timeout": "1m0s", "dial-timeout": "2s", "namespace": "/team"},
+			[]string{"env1:2379", "env2:2379"}, clientSecurity{CACert: "ca.pem", Cert: "cert.pem", Key: "key.pem", Username: "ops", Password: "s3cret"}},
+		{[]string{"--etcd-username", "ops", "--etcd-password", "cli"}, nil, nil,
+			[]string{"env1:2379", "env2:2379"}, clientSecurity{CACert: "config-ca.pem", Username: "ops", Password: "cli"}},
+		// An explicit host keeps the environment's endpoints out.
+		{[]string{"--etcd-host", "cli"}, nil, map[string]string{"output": "json", "etcd-host": "cli", "timeout": "30s"},
+			[]string{"cli:2379"}, clientSecurity{CACert: "config-ca.pem", Password: "s3cret"}},
+		// The former names are aliases, ranked like the current ones.
+		{[]string{"--endpoints", "cli1:2379,cli2:2379", "--cacert", "ca.pem", "--cert", "cert.pem", "--key", "key.pem"}, nil, nil,
+			[]string{"cli1:2379", "cli2:2379"}, clientSecurity{CACert: "ca.pem", Cert: "cert.pem", Key: "key.pem", Password: "s3cret"}},
+		{nil, map[string]string{"INVENTORY_ETCD_ENDPOINTS": "", "INVENTORY_ENDPOINTS": "old:2379", "INVENTORY_CACERT": "old-ca.pem"}, nil,
+			[]string{"old:2379"}, clientSecurity{CACert: "old-ca.pem", Password: "s3cret"}},
+		{nil, map[string]string{"INVENTORY_ENDPOINTS": "old:2379", "INVENTORY_ETCD_CA": "ca.pem", "INVENTORY_CACERT": "old-ca.pem"}, nil,
+			[]string{"env1:2379", "env2:2379"}, clientSecurity{CACert: "ca.pem", Password: "s3cret"}},
+		{[]string{"--user", "root:old"}, nil, nil,
+			[]string{"env1:2379", "env2:2379"}, clientSecurity{CACert: "config-ca.pem", Username: "root", Password: "old"}},
+		{[]string{"--user", "root:old", "--etcd-username", "ops"}, nil, nil,
+			[]string{"env1:2379", "env2:2379"}, clientSecurity{CACert: "config-ca.pem", Username: "ops", Password: "s3cret"}},
+	} {
+		t.Run(fmt.Sprintf("%q %v", tc.args, tc.env), func(t *testing.T) {
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+			fs, etcd := newFlags()
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := setFlagDefaults(fs, envFlagValues(fs, envPrefix)); err != nil {
+				t.Fatal(err)
+			}
+			if err := setFlagDefaults(fs, config); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tc.want {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("--%s = %q, want %q", name, got, want)
+				}
+			}
+			if got := etcd.endpointList(); !reflect.DeepEqual(got, tc.endpoints) {
+				t.Errorf("endpoints %q, want %q", got, tc.endpoints)
+			}
+			if got, err := etcd.security(); err != nil || got != tc.security {
+				t.Errorf("security %+v, %v; want %+v", got, err, tc.security)
+			}
+		})
+	}
+
+	fs, etcd := newFlags()
+	fs.Parse([]string{"--user", "root"})
+	if _, err := etcd.security(); err == nil {
+		t.Error("--user without a password was accepted")
+	}
+
+	t.Setenv("INVENTORY_TIMEOUT", "soon")
+	fs, _ = newFlags()
+	fs.Parse(nil)
+	if err := setFlagDefaults(fs, envFlagValues(fs, envPrefix)); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("an invalid INVENTORY_TIMEOUT gave %v", err)
+	}
+}
+
+func TestHandleValues(t *testing.T) {
+	inv := newTestInventory(t)
+	createHosts(t, inv, map[string]map[string]interface{}{
+		"web01": {"env": "prod", "tags": []interface{}{"eu", "web"}},
+		"web02": {"env": "prod", "tags": []interface{}{"eu", "eu"}},
+		"web03": {"env": "stage", "tags": []interface{}{"us"}},
+		"db01":  {"env": "prod", "tags": "db"},
+		"db02":  {"env": "dev"},
+		"spare": {},
+	})
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--field", "env"}, "prod=3 dev=1 stage=1"},
+		{[]string{"--field", "env", "--sort", "value"}, "dev=1 prod=3 stage=1"},
+		// Each element counts once per host.
+		{[]string{"--field", "tags"}, "eu=2 db=1 us=1 web=1"},
+		{[]string{"--field", "rack"}, ""},
+	} {
+		out := captureStdout(t, func() {
+			handleValues(inv, tc.args, inventory.OutputOptions{Format: "json", Compact: true})
+		})
+		var rows []struct {
+			Name string
+			Data struct{ Count int }
+		}
+		if err := json.Unmarshal([]byte(out), &rows); err != nil {
+			t.Fatalf("%v: %v: %s", tc.args, err, out)
+		}
+		var got []string
+		for _, row := range rows {
+			got = append(got, fmt.Sprintf("%s=%d", row.Name, row.Data.Count))
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("values %v = %s, want %s", tc.args, strings.Join(got, " "), tc.want)
+		}
+	}
+
+	out := captureStdout(t, func() {
+		handleValues(inv, []string{"--field", "env"}, inventory.OutputOptions{Format: "csv"})
+	})
+	if !strings.Contains(out, "prod,") || !strings.Contains(out, `""count"":3`) {
+		t.Errorf("csv values:\n%s", out)
+	}
+	out = captureStdout(t, func() {
+		handleValues(inv, []string{"--field", "env"}, inventory.OutputOptions{Format: "yaml", Compact: true})
+	})
+	if prod, dev := strings.Index(out, "prod"), strings.Index(out, "dev"); prod < 0 || dev < prod {
+		t.Errorf("yaml values not by count:\n%s", out)
+	}
+}
+
+func TestHandleRecent(t *testing.T) {
+	inv := newTestInventory(t)
+	for _, name := range []string{"web01", "web02", "web03"} {
+		createHosts(t, inv, map[string]map[string]interface{}{name: {"site": "ams"}})
+	}
+	for _, format := range []string{"json", "yaml", "csv", "table"} {
+		out := captureStdout(t, func() {
+			handleRecent(inv, []string{"--limit", "2"}, inventory.OutputOptions{Format: format, Compact: true})
+		})
+		first, second := strings.Index(out, "web03"), strings.Index(out, "web02")
+		if first < 0 || second < first || strings.Contains(out, "web01") {
+			t.Errorf("%s: recent --limit 2 is not web03 then web02:\n%s", format, out)
+		}
+	}
+}
+
+func TestKeysDedupe(t *testing.T) {
+	_, client := etcdtest.Start(t)
+	for _, key := range []string{"/rack/a/1", "/rack/a/2", "/rack/b/1"} {
+		if _, err := client.Put(t.Context(), key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"iter", "/rack/a/", "/rack/"}, []string{"/rack/a/1", "/rack/a/2", "/rack/a/1", "/rack/a/2", "/rack/b/1"}},
+		{[]string{"iter", "--dedupe", "/rack/a/", "/rack/"}, []string{"/rack/a/1", "/rack/a/2", "/rack/b/1"}},
+		{[]string{"iter", "--dedupe", "/rack/", "/rack/a/", "/rack/b/"}, []string{"/rack/a/1", "/rack/a/2", "/rack/b/1"}},
+	} {
+		out := captureStdout(t, func() {
+			handleKeys(client, "", tc.args, inventory.OutputOptions{Format: "csv"})
+		})
+		var keys []string
+		for _, line := range strings.Split(out, "\n") {
+			if key, _, _ := strings.Cut(line, ","); strings.HasPrefix(key, "/rack/") {
+				keys = append(keys, key)
+			}
+		}
+		if !reflect.DeepEqual(keys, tc.want) {
+			t.Errorf("keys %q listed %q, want %q:\n%s", tc.args, keys, tc.want, out)
+		}
+	}
+}
+
+func TestListGroupBy(t *testing.T) {
+	inv := newTestInventory(t)
+	createHosts(t, inv, map[string]map[string]interface{}{
+		"web01":   {"role": "web", "env": "prod"},
+		"web02":   {"role": "web", "env": "stage"},
+		"db01":    {"role": "db", "env": "prod"},
+		"lb01":    {"role": "web", "env": []interface{}{"prod", "edge"}},
+		"cache01": {"role": "cache"},
+	})
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--group-by", "env"}, []string{
+			"=== env: edge ===", "lb01",
+			"=== env: prod ===", "db01 lb01 web01",
+			"=== env: stage ===", "web02",
+			"=== env: <ungrouped> ===", "cache01",
+		}},
+		{[]string{"--group-by", "env", "--filter", "role=web"}, []string{
+			"=== env: edge ===", "lb01",
+			"=== env: prod ===", "lb01 web01",
+			"=== env: stage ===", "web02",
+		}},
+		{[]string{"--group-by", "role", "--where", `env == "prod"`}, []string{
+			"=== role: db ===", "db01",
+			"=== role: web ===", "web01",
+		}},
+	} {
+		out := captureStdout(t, func() {
+			handleList(inv, tc.args, inventory.OutputOptions{Format: "json", Compact: true}, clusterConnector{})
+		})
+		var got []string
+		for _, line := range strings.Split(out, "\n") {
+			if line == "" {
+				continue
+			}
+			if strings.HasPrefix(line, "===") {
+				got = append(got, line)
+				continue
+			}
+			var hosts []inventory.Host
+			if err := json.Unmarshal([]byte(line), &hosts); err != nil {
+				t.Fatalf("%q: %v: %s", tc.args, err, line)
+			}
+			var names []string
+			for _, host := range hosts {
+				names = append(names, host.Name)
+			}
+			got = append(got, strings.Join(names, " "))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("list %q printed %q, want %q:\n%s", tc.args, got, tc.want, out)
+		}
+	}
+}
+
+func TestServeCache(t *testing.T) {
+	inv := newTestInventory(t)
+	createHosts(t, inv, map[string]map[string]interface{}{"web01": {"site": "ams"}})
+	snapshot, err := inv.Snapshot(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		source hostSource
+	}{
+		{"cache", hostSource{inv: inv, snapshot: snapshot}},
+		{"cache off", hostSource{inv: inv}},
+	} {
+		handler := newHTTPHandler(tc.source, inventory.OutputOptions{}, 5, false)
+		for _, target := range []string{"/hosts", "/hosts/web01"} {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: GET %s = %d: %s", tc.name, target, rec.Code, rec.Body)
+			}
+			age, cached := rec.Header()["X-Cache-Age"]
+			if cached != (tc.source.snapshot != nil) {
+				t.Errorf("%s: GET %s has X-Cache-Age %q", tc.name, target, age)
+			}
+			if cached && (len(age) != 1 || age[0] != "0") {
+				t.Errorf("%s: GET %s has X-Cache-Age %q, want 0", tc.name, target, age)
+			}
+		}
+	}
+
+	// A change made through etcd reaches the cached responses.
+	if err := inv.UpdateHostFieldValue("web01", "site", "fra"); err != nil {
+		t.Fatal(err)
+	}
+	handler := newHTTPHandler(hostSource{inv: inv, snapshot: snapshot}, inventory.OutputOptions{}, 5, false)
+	for n := 0; ; n++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/hosts/web01", nil))
+		if strings.Contains(rec.Body.String(), "fra") {
+			break
+		}
+		if n == 100 {
+			t.Fatalf("GET /hosts/web01 still serves %s", rec.Body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failOnEmptyEnv passes TestFailOnEmpty's command to the test binary it
+// runs, since --fail-on-empty exits the process.
+const failOnEmptyEnv = "TEST_FAIL_ON_EMPTY_COMMAND"
+
+func TestFailOnEmpty(t *testing.T) {
+	if command := os.Getenv(failOnEmptyEnv); command != "" {
+		inv := newTestInventory(t)
+		createHosts(t, inv, map[string]map[string]interface{}{"web01": {"role": "web"}})
+		output := inventory.OutputOptions{Format: "json", Compact: true}
+		args := strings.Fields(command)
+		switch args[0] {
+		case "list":
+			handleList(inv, args[1:], output, clusterConnector{})
+		case "get":
+			handleGet(inv, args[1:], output)
+		}
+		return
+	}
+
+	for _, tc := range []struct {
+		command string
+		status  int
+		printed string
+	}{
+		{"list --fail-on-empty --filter role=db", exitEmpty, "[]"},
+		{"list --fail-on-empty --filter role=web", 0, "web01"},
+		{"list --filter role=db", 0, "[]"},
+		{"list --fail-on-empty --names-only --filter role=db", exitEmpty, ""},
+		{"list --fail-on-empty --names-only", 0, "web01"},
+		{"get --fail-on-empty db01", exitEmpty, "[]"},
+		{"get --fail-on-empty web01", 0, "web01"},
+		{"get --fail-on-empty db01 db02", exitEmpty, "[]"},
+		// Some hosts found is an ordinary error, not an empty result.
+		{"get --fail-on-empty db01 web01", 1, "web01"},
+	} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestFailOnEmpty$")
+		cmd.Env = append(os.Environ(), failOnEmptyEnv+"="+tc.command)
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		err := cmd.Run()
+		status := 0
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			status = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if status != tc.status {
+			t.Errorf("%s exited with %d, want %d", tc.command, status, tc.status)
+		}
+		if !strings.Contains(stdout.String(), tc.printed) {
+			t.Errorf("%s printed %q, want %q", tc.command, stdout.String(), tc.printed)
+		}
+	}
+}
+
+func TestShowKey(t *testing.T) {
+	for _, ns := range []string{"", "/team"} {
+		server, client := etcdtest.Start(t)
+		inv := inventory.NewNamespacedInventory(client, ns)
+		createHosts(t, inv, map[string]map[string]interface{}{"web01": {"site": "ams"}, "db 01": {"site": "fra"}})
+		want := map[string]string{"web01": ns + "/hosts/web01", "db 01": ns + "/hosts/db%2001"}
+		for _, tc := range []struct {
+			args  []string
+			hosts int
+		}{
+			{[]string{"list", "--show-key"}, 2},
+			{[]string{"get", "--show-key", "web01", "db 01"}, 2},
+			{[]string{"get", "web01", "--show-key"}, 1},
+		} {
+			args := tc.args
+			out := captureStdout(t, func() {
+				output := inventory.OutputOptions{Format: "json"}
+				if args[0] == "list" {
+					handleList(inv, args[1:], output, clusterConnector{})
+				} else {
+					handleGet(inv, args[1:], output)
+				}
+			})
+			var hosts []inventory.Host
+			if err := json.Unmarshal([]byte(out), &hosts); err != nil {
+				t.Fatalf("%q: %v: %s", args, err, out)
+			}
+			if len(hosts) != tc.hosts {
+				t.Errorf("%q printed %d hosts, want %d", args, len(hosts), tc.hosts)
+			}
+			for _, host := range hosts {
+				key, _ := host.Data[inventory.KeyField].(string)
+				if key != want[host.Name] {
+					t.Errorf("namespace %q: %q shows %s under key %q, want %q", ns, args, host.Name, key, want[host.Name])
+				}
+				if _, ok := server.Keys()[key]; !ok {
+					t.Errorf("namespace %q: %q shows key %q, which is not in etcd", ns, args, key)
+				}
+			}
+		}
+	}
+}
+
+func TestSeed(t *testing.T) {
+	hosts := generateHosts(50, "demo-", 7)
+	if !reflect.DeepEqual(generateHosts(50, "demo-", 7), hosts) {
+		t.Error("the same seed generated different hosts")
+	}
+	if reflect.DeepEqual(generateHosts(50, "demo-", 8), hosts) {
+		t.Error("another seed generated the same hosts")
+	}
+	names := make(map[string]bool)
+	for _, host := range hosts {
+		names[host.Name] = true
+		if !strings.HasPrefix(host.Name, "demo-"+host.Data["role"].(string)+"-") {
+			t.Errorf("generated host %s has role %v", host.Name, host.Data["role"])
+		}
+		if typ := inventory.TypeName(host.Data["ip"]); typ != "IPAddress" {
+			t.Errorf("generated host %s has ip %v of type %s", host.Name, host.Data["ip"], typ)
+		}
+		for _, field := range []string{"env", "datacenter", "cpus"} {
+			if _, ok := host.Data[field]; !ok {
+				t.Errorf("generated host %s has no %s", host.Name, field)
+			}
+		}
+	}
+	if len(names) != len(hosts) {
+		t.Errorf("generated %d hosts with %d distinct names", len(hosts), len(names))
+	}
+
+	inv := newTestInventory(t)
+	createHosts(t, inv, map[string]map[string]interface{}{"web01": {"role": "web"}})
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	handleSeed(inv, []string{"--count", "25", "--prefix", "demo-", "--seed", "7"})
+	log.SetOutput(os.Stderr)
+	if !strings.Contains(logged.String(), "Created 25 hosts (0 failed, 0 not started)") {
+		t.Errorf("seed logged %q", logged.String())
+	}
+	seeded, err := inv.ListHostNames("demo-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, host := range generateHosts(25, "demo-", 7) {
+		want = append(want, host.Name)
+	}
+	slices.Sort(want)
+	if !reflect.DeepEqual(seeded, want) {
+		t.Errorf("seed created %q, want %q", seeded, want)
+	}
+
+	log.SetOutput(io.Discard)
+	handleSeed(inv, []string{"--clean", "--prefix", "demo-", "--yes"})
+	log.SetOutput(os.Stderr)
+	all, err := inv.ListHostNames("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(all, []string{"web01"}) {
+		t.Errorf("after seed --clean the hosts are %q, want only web01", all)
+	}
+}
+
+func TestListClusters(t *testing.T) {
+	servers := make(map[string]*etcdtest.Server)
+	contexts := contextsFile{Contexts: make(map[string]clusterContext)}
+	for name, hosts := range map[string]map[string]map[string]interface{}{
+		"east": {"web01": {"site": "ams"}, "db01": {"site": "ams"}},
+		"west": {"web01": {"site": "sfo"}, "web02": {"site": "sfo"}},
+	} {
+		server, client := etcdtest.Start(t)
+		createHosts(t, inventory.NewInventory(client), hosts)
+		servers[name] = server
+		contexts.Contexts[name] = clusterContext{Endpoints: []string{server.Endpoint()}}
+	}
+	path := filepath.Join(t.TempDir(), "contexts.yaml")
+	if err := contexts.save(path); err != nil {
+		t.Fatal(err)
+	}
+	connector := clusterConnector{path: path, dialTimeout: 5 * time.Second, base: newTestInventory(t)}
+	if _, err := connector.connect([]string{"east", "north"}); err == nil || !strings.Contains(err.Error(), `no context named "north"`) {
+		t.Errorf("connecting to an unknown context = %v", err)
+	}
+	clusters, err := connector.connect([]string{"all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listed := func(result inventory.ListResult) []string {
+		var hosts []string
+		for _, host := range result.Hosts {
+			hosts = append(hosts, fmt.Sprintf("%s@%v", host.Name, host.Data[clusterField]))
+		}
+		return hosts
+	}
+	for _, tc := range []struct {
+		name       string
+		down       string
+		opts       inventory.ListOptions
+		requireAll bool
+		want       []string
+		err        string
+	}{
+		{name: "both", want: []string{"db01@east", "web01@east", "web01@west", "web02@west"}},
+		{name: "paged", opts: inventory.ListOptions{Offset: 1, Limit: 2}, want: []string{"web01@east", "web01@west"}},
+		{name: "west down", down: "west", want: []string{"db01@east", "web01@east"}},
+		{name: "west down, all required", down: "west", requireAll: true, err: "cluster west"},
+		{name: "all down", down: "east,west", err: "no cluster could be listed"},
+	} {
+		for name, server := range servers {
+			server.Fault = nil
+			if slices.Contains(strings.Split(tc.down, ","), name) {
+				server.Fault = func(method string, applied bool) error {
+					if method == "range" {
+						return fmt.Errorf("%s is down", name)
+					}
+					return nil
+				}
+			}
+		}
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+		result, err := listClusters(clusters, tc.opts, tc.requireAll)
+		log.SetOutput(os.Stderr)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: listClusters = %v, want an error containing %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := listed(result); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: listed %q, want %q", tc.name, got, tc.want)
+		}
+		if warned := strings.Contains(logged.String(), "skipping cluster "+tc.down); warned != (tc.down != "") {
+			t.Errorf("%s: logged %q", tc.name, logged.String())
+		}
+	}
+	for _, server := range servers {
+		server.Fault = nil
+	}
+
+	out := captureStdout(t, func() {
+		handleList(connector.base, []string{"--clusters", "west,east", "--filter", "site=sfo"}, inventory.OutputOptions{Format: "json", Compact: true}, connector)
+	})
+	var hosts []inventory.Host
+	if err := json.Unmarshal([]byte(out), &hosts); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if got, want := listed(inventory.ListResult{Hosts: hosts}), []string{"web01@west", "web02@west"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("list --clusters printed %q, want %q", got, want)
+	}
+}
+
+func TestHTTPWatch(t *testing.T) {
+	inv := newTestInventory(t)
+	createHosts(t, inv, map[string]map[string]interface{}{"web01": {"site": "ams"}})
+	defer func(d time.Duration) { sseHeartbeat = d }(sseHeartbeat)
+	sseHeartbeat = 50 * time.Millisecond
+	handler := newHTTPHandler(hostSource{inv: inv}, inventory.OutputOptions{}, 5, false)
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		close(done)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/hosts/watch", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("GET /hosts/watch has Content-Type %q", ct)
+	}
+
+	// next reads the next event, counting the heartbeats before it.
+	lines := bufio.NewScanner(resp.Body)
+	heartbeats := 0
+	next := func() (event string, id int64, data string) {
+		for lines.Scan() {
+			line := lines.Text()
+			switch {
+			case line == ": heartbeat":
+				heartbeats++
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "id: "):
+				fmt.Sscan(strings.TrimPrefix(line, "id: "), &id)
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			case line == "" && event != "":
+				return event, id, data
+			}
+		}
+		t.Fatalf("the stream ended: %v", lines.Err())
+		return
+	}
+
+	event, listed, data := next()
+	var hosts []inventory.Host
+	if err := json.Unmarshal([]byte(data), &hosts); event != "list" || err != nil || len(hosts) != 1 || hosts[0].Name != "web01" {
+		t.Fatalf("first event is %s %s (%v)", event, data, err)
+	}
+	time.Sleep(3 * sseHeartbeat)
+	createHosts(t, inv, map[string]map[string]interface{}{"web02": {"site": "fra"}})
+	if err := inv.RemoveHost("web01"); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	last := listed
+	for range 2 {
+		event, id, data := next()
+		var change sseHostEvent
+		if err := json.Unmarshal([]byte(data), &change); err != nil {
+			t.Fatalf("%s: %v: %s", event, err, data)
+		}
+		if id <= last || change.Revision != id {
+			t.Errorf("%s event has id %d and revision %d after %d", event, id, change.Revision, last)
+		}
+		last = id
+		if (change.Host != nil) != (event == "put") || change.Host != nil && change.Host.Data["site"] != "fra" {
+			t.Errorf("%s event has host %+v", event, change.Host)
+		}
+		got = append(got, event+" "+change.Name)
+	}
+	if want := []string{"put web02", "delete web01"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events %q, want %q", got, want)
+	}
+	if heartbeats == 0 {
+		t.Error("no heartbeat while nothing changed")
+	}
+
+	// Hanging up ends the handler and its watch.
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler kept running after the client hung up")
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.csv")
+	if err := os.WriteFile(path, []byte("name,port,active,rack,weight:Number\nweb01,8080,true,007,3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args []string
+		want map[string]interface{}
+	}{
+		{nil, map[string]interface{}{"port": 8080.0, "active": true, "rack": "007", "weight": 3.0}},
+		{[]string{"--no-infer"}, map[string]interface{}{"port": "8080", "active": "true", "rack": "007", "weight": 3.0}},
+	} {
+		inv := newTestInventory(t)
+		log.SetOutput(io.Discard)
+		handleImport(inv, append([]string{"--format", "csv", "--file", path}, tc.args...))
+		log.SetOutput(os.Stderr)
+		host, err := inv.GetHost("web01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for field, want := range tc.want {
+			if got := host.Data[field]; got != want {
+				t.Errorf("import %q: %s = %#v, want %#v", tc.args, field, got, want)
+			}
+		}
+	}
+}
+
+func TestExportSubset(t *testing.T) {
+	src := newTestInventory(t)
+	createHosts(t, src, map[string]map[string]interface{}{
+		"web01": {"role": "web", "env": "prod"},
+		"web02": {"role": "web", "env": "stage"},
+		"db01":  {"role": "db", "env": "prod", "replicas": 2.0},
+	})
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--filter", "env=prod"}, []string{"db01", "web01"}},
+		{[]string{"--name-prefix", "web"}, []string{"web01", "web02"}},
+		{[]string{"--where", `env == "prod" && role == "web"`}, []string{"web01"}},
+		{[]string{"--format", "json", "--filter", "env=stage"}, []string{"web02"}},
+		{[]string{"--format", "yaml", "--filter", "role=db"}, []string{"db01"}},
+		{[]string{"--filter", "env=dev"}, nil},
+	} {
+		path := filepath.Join(t.TempDir(), "export")
+		dst := newTestInventory(t)
+		format := "export"
+		if n := slices.Index(tc.args, "--format"); n >= 0 {
+			format = tc.args[n+1]
+		}
+		log.SetOutput(io.Discard)
+		handleExport(src, append([]string{"--file", path}, tc.args...), inventory.OutputOptions{})
+		handleImport(dst, []string{"--file", path, "--format", format})
+		log.SetOutput(os.Stderr)
+
+		hosts, err := dst.ListHosts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, host := range hosts {
+			names = append(names, host.Name)
+			want, err := src.GetHost(host.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for field, value := range want.Data {
+				if field != inventory.UpdatedAtField && !reflect.DeepEqual(host.Data[field], value) {
+					t.Errorf("export %q reimported %s with %s = %v, want %v", tc.args, host.Name, field, host.Data[field], value)
+				}
+			}
+		}
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("export %q reimported %q, want %q", tc.args, names, tc.want)
+		}
+	}
+}
+
+func TestHTTPRBAC(t *testing.T) {
+	inv := newTestInventory(t)
+	cipher, err := inventory.NewFieldCipher(make([]byte, inventory.SecretKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.SecretFields = map[string]bool{"password": true}
+	inv.Secrets = cipher
+	createHosts(t, inv, map[string]map[string]interface{}{
+		"web01": {"site": "ams", "password": "s3cret"},
+		"web02": {"site": "fra", "password": "s3cret"},
+		"db07":  {"site": "ams", "password": "s3cret"},
+	})
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	create := func(grants ...string) string {
+		args := []string{"token", "create", "--name", strings.Join(grants, ",")}
+		for _, grant := range grants {
+			args = append(args, "--grant", grant)
+		}
+		return strings.TrimSpace(captureStdout(t, func() { handleAuth(inv, args, inventory.OutputOptions{}) }))
+	}
+	viewer := create("viewer::web*")
+	editor := create("editor")
+	admin := create("admin::web*")
+	stage := create("admin:stage")
+	revoked := create("admin")
+	var listed []inventory.Host
+	out := captureStdout(t, func() { handleAuth(inv, []string{"token", "list"}, inventory.OutputOptions{Format: "json"}) })
+	if err := json.Unmarshal([]byte(out), &listed); err != nil {
+		t.Fatalf("auth token list: %v\n%s", err, out)
+	}
+	for _, token := range listed {
+		if token.Data["grants"] == "admin" {
+			handleAuth(inv, []string{"token", "revoke", token.Name}, inventory.OutputOptions{})
+		}
+	}
+	if len(listed) != 5 {
+		t.Errorf("auth token list shows %d tokens, want 5:\n%s", len(listed), out)
+	}
+
+	auth, err := newServerAuth(context.Background(), inv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := authorizeRequests(auth.authenticate, newHTTPHandler(hostSource{inv: inv}, inventory.OutputOptions{}, 0, true))
+	for _, tc := range []struct {
+		name, method, target, token, body string
+		status                            int
+		// hosts are the hosts a listing or get returns, with the password
+		// each shows.
+		hosts map[string]interface{}
+	}{
+		{"no token", http.MethodGet, "/hosts", "", "", http.StatusUnauthorized, nil},
+		{"not a bearer token", http.MethodGet, "/hosts", "Basic " + viewer, "", http.StatusUnauthorized, nil},
+		{"unknown token", http.MethodGet, "/hosts", "Bearer " + viewer + "0", "", http.StatusUnauthorized, nil},
+		{"revoked token", http.MethodGet, "/hosts", "Bearer " + revoked, "", http.StatusUnauthorized, nil},
+		{"viewer lists", http.MethodGet, "/hosts", "Bearer " + viewer, "", http.StatusOK, map[string]interface{}{"web01": "*****", "web02": "*****"}},
+		{"viewer filters", http.MethodGet, "/hosts?filter=site%3Dams", "Bearer " + viewer, "", http.StatusOK, map[string]interface{}{"web01": "*****"}},
+		{"viewer gets", http.MethodGet, "/hosts/web01", "Bearer " + viewer, "", http.StatusOK, map[string]interface{}{"web01": "*****"}},
+		{"viewer gets another", http.MethodGet, "/hosts/db07", "Bearer " + viewer, "", http.StatusForbidden, nil},
+		{"viewer puts", http.MethodPut, "/hosts/web01", "Bearer " + viewer, `{"data": {}}`, http.StatusForbidden, nil},
+		{"viewer patches", http.MethodPatch, "/hosts/web01/fields/site", "Bearer " + viewer, `"lon"`, http.StatusForbidden, nil},
+		{"viewer deletes", http.MethodDelete, "/hosts/web01", "Bearer " + viewer, "", http.StatusForbidden, nil},
+		{"other namespace", http.MethodGet, "/hosts", "Bearer " + stage, "", http.StatusForbidden, nil},
+		{"admin lists", http.MethodGet, "/hosts", "Bearer " + admin, "", http.StatusOK, map[string]interface{}{"web01": "s3cret", "web02": "s3cret"}},
+		{"editor lists", http.MethodGet, "/hosts", "Bearer " + editor, "", http.StatusOK, map[string]interface{}{"web01": "*****", "web02": "*****", "db07": "*****"}},
+		{"editor creates", http.MethodPut, "/hosts/db08", "Bearer " + editor, `{"data": {"site": "lon"}}`, http.StatusCreated, nil},
+		{"editor patches", http.MethodPatch, "/hosts/db08/fields/site", "Bearer " + editor, `"ams"`, http.StatusNoContent, nil},
+		{"admin patches another", http.MethodPatch, "/hosts/db08/fields/site", "Bearer " + admin, `"fra"`, http.StatusForbidden, nil},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		if tc.token != "" {
+			req.Header.Set("Authorization", tc.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: %s %s: status %d, want %d: %s", tc.name, tc.method, tc.target, rec.Code, tc.status, rec.Body)
+			continue
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: 401 without WWW-Authenticate", tc.name)
+		}
+		if tc.hosts == nil {
+			continue
+		}
+		var hosts []inventory.Host
+		if strings.HasPrefix(tc.target, "/hosts/") {
+			var host inventory.Host
+			err = json.Unmarshal(rec.Body.Bytes(), &host)
+			hosts = []inventory.Host{host}
+		} else {
+			var page hostPage
+			err = json.Unmarshal(rec.Body.Bytes(), &page)
+			hosts = page.Items
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got := make(map[string]interface{})
+		for _, host := range hosts {
+			got[host.Name] = host.Data["password"]
+		}
+		if !reflect.DeepEqual(got, tc.hosts) {
+			t.Errorf("%s: hosts %v, want %v", tc.name, got, tc.hosts)
+		}
+	}
+	if host, err := inv.GetHost("db08"); err != nil || host.Data["site"] != "ams" {
+		t.Errorf("db08 = %v, %v; want it created by the editor with site ams", host, err)
+	}
+	if host, err := inv.GetHost("web01"); err != nil || host.Data["site"] != "ams" {
+		t.Errorf("web01 = %v, %v; want it untouched by the viewer", host, err)
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	hosts := []inventory.Host{
+		{Name: "web01", Data: map[string]interface{}{
+			"site": "ams", "cores": 8.0, "note": "x==y", "tags": []interface{}{"web", "eu"}, "a b": 1.0,
+			"nic": map[string]interface{}{"eth0": map[string]interface{}{"ip": "10.0.0.1"}},
+		}},
+		{Name: "db01", Data: map[string]interface{}{
+			"site": "fra", "cores": 16.0, "note": "a)]b", "tags": []interface{}{"db"},
+			"nic": map[string]interface{}{"eth1": map[string]interface{}{"ip": "10.0.1.2"}, "eth0": map[string]interface{}{"ip": "10.0.0.2"}},
+		}},
+	}
+	for _, tc := range []struct {
+		expr    string
+		want    []string
+		wantErr string
+	}{
+		// Names, indexes, wildcards and recursive descent.
+		{"$[*].name", []string{"web01", "db01"}, ""},
+		{"$[0].data.site", []string{"ams"}, ""},
+		{"$[-1].name", []string{"db01"}, ""},
+		{"$[5].name", nil, ""},
+		{"$[0].data.tags[1]", []string{"eu"}, ""},
+		{"$[0]['data']['a b']", []string{"1"}, ""},
+		{`$[1]["data"].site`, []string{"fra"}, ""},
+		{"$[*].data.nic.eth0.ip", []string{"10.0.0.1", "10.0.0.2"}, ""},
+		{"$[1].data.nic.*.ip", []string{"10.0.0.2", "10.0.1.2"}, ""},
+		{"$..ip", []string{"10.0.0.1", "10.0.0.2", "10.0.1.2"}, ""},
+		{"$[0].data.missing", nil, ""},
+		{"$[0].name.site", nil, ""},
+
+		// Filters with every operator.
+		{"$[?(@.data.cores == 8)].name", []string{"web01"}, ""},
+		{"$[?(@.data.cores != 8)].name", []string{"db01"}, ""},
+		{"$[?(@.data.cores < 16)].name", []string{"web01"}, ""},
+		{"$[?(@.data.cores <= 16)].name", []string{"web01", "db01"}, ""},
+		{"$[?(@.data.cores > 8)].name", []string{"db01"}, ""},
+		{"$[?(@.data.cores >= 8)].name", []string{"web01", "db01"}, ""},
+		{`$[?(@.data.site < "b")].name`, []string{"web01"}, ""},
+		{`$[?(@.data.site > 8)].name`, nil, ""},
+		{`$[?(@.data.cores == "8")].name`, nil, ""},
+		{"$[?(@.data.nic.eth1)].name", []string{"db01"}, ""},
+		{"$[?(@['data']['a b'] == 1)].name", []string{"web01"}, ""},
+		{`$[?(@.data.tags[?(@ == "eu")])].name`, []string{"web01"}, ""},
+		{`$[*].data.tags[?(@ != "web")]`, []string{"eu", "db"}, ""},
+
+		// Quoted operators, brackets and quotes.
+		{`$[?(@.data.note!="x==y")].name`, []string{"db01"}, ""},
+		{`$[?(@.data.note == "x==y")].name`, []string{"web01"}, ""},
+		{`$[?(@.data.note == "a)]b")].name`, []string{"db01"}, ""},
+		{`$[?(@.data.note == 'a)]b')].name`, []string{"db01"}, ""},
+		{`$[?(@.data.note == 'x\'y')].name`, nil, ""},
+		{`$[?(@.data.note < "b)]")].name`, []string{"db01"}, ""},
+
+		// Malformed expressions.
+		{"data.site", nil, "must start with $"},
+		{"$name", nil, "unexpected"},
+		{"$.", nil, "empty name"},
+		{"$[0", nil, "unterminated index"},
+		{"$['data", nil, "unterminated name"},
+		{"$['data'", nil, "unterminated name"},
+		{"$[x]", nil, "invalid index"},
+		{"$[?(@.data.cores == 8]", nil, "unterminated filter"},
+		{`$[?(@.data.note == "x)]`, nil, "unterminated string"},
+		{"$[?(@.data.cores == eight)]", nil, "invalid literal"},
+		{"$[?(@.data.cores ==)]", nil, "invalid literal"},
+		{"$[?(data.cores)]", nil, "must start with @"},
+	} {
+		steps, err := parseJSONPath(tc.expr)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("parseJSONPath(%s) = %v, want an error containing %q", tc.expr, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseJSONPath(%s): %v", tc.expr, err)
+			continue
+		}
+		var b bytes.Buffer
+		if err := writeQueryResults(&b, steps, hosts); err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Fields(b.String())
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s = %q, want %q", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestLogOutput(t *testing.T) {
+	defer func() {
+		logging.SetSink(nil)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+	messages := []struct {
+		log      func()
+		severity logging.Severity
+		msg      string
+	}{
+		{func() { logging.Infof("Host '%s' created successfully!", "web01") }, logging.Info, "Host 'web01' created successfully!"},
+		{func() { logging.Infof("Errors: none") }, logging.Info, "Errors: none"},
+		{func() { logging.Warnf("cache is %d seconds old", 90) }, logging.Warning, "Warning: cache is 90 seconds old"},
+		{func() { logging.Errorf("Webhook for host '%s' failed", "web01") }, logging.Err, "Webhook for host 'web01' failed"},
+		{func() { logging.Debugf("etcd get took %s", "3ms") }, logging.Debug, "DEBUG: etcd get took 3ms"},
+		{func() { log.Printf("from another package") }, logging.Info, "from another package"},
+		{func() {
+			inv := newTestInventory(t)
+			inv.WarnValueSize = 10
+			createHosts(t, inv, map[string]map[string]interface{}{"web01": {"site": strings.Repeat("a", 20)}})
+		}, logging.Warning, "Warning: host web01 is"},
+		{func() { logging.Infof("two\nlines") }, logging.Info, "two\nlines"},
+	}
+	for _, tc := range []struct {
+		output, network string
+		// parse returns the severity and message of an entry.
+		parse func(entry string) (logging.Severity, string)
+	}{
+		{"syslog", "unixgram", parseSyslogEntry},
+		{"syslog", "unix", parseSyslogEntry},
+		{"journald", "unixgram", parseJournaldEntry},
+	} {
+		t.Run(tc.output+" over "+tc.network, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "log")
+			entries := make(chan string, len(messages))
+			if tc.network == "unix" {
+				listener, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer listener.Close()
+				go func() {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					defer conn.Close()
+					scanner := bufio.NewScanner(conn)
+					for scanner.Scan() {
+						entries <- scanner.Text()
+					}
+				}()
+			} else {
+				conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				go func() {
+					buf := make([]byte, 1<<16)
+					for {
+						n, err := conn.Read(buf)
+						if err != nil {
+							return
+						}
+						entries <- string(buf[:n])
+					}
+				}()
+			}
+			syslogSockets, journaldSocket = []string{path}, path
+			defer func(sockets []string, socket string) { syslogSockets, journaldSocket = sockets, socket }(syslogSockets, journaldSocket)
+			if err := setLogOutput(tc.output); err != nil {
+				t.Fatal(err)
+			}
+			defer logging.SetSink(nil)
+			for _, m := range messages {
+				if tc.network == "unix" && strings.Contains(m.msg, "\n") {
+					// Stream entries end at a newline.
+					continue
+				}
+				m.log()
+				select {
+				case entry := <-entries:
+					severity, msg := tc.parse(entry)
+					if severity != m.severity || !strings.HasPrefix(msg, m.msg) {
+						t.Errorf("entry %q: severity %d, message %q; want %d, %q", entry, severity, msg, m.severity, m.msg)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%q never arrived", m.msg)
+				}
+			}
+		})
+	}
+}
+
+// parseSyslogEntry returns the severity and message of a BSD syslog entry
+// of the daemon facility.
+func parseSyslogEntry(entry string) (logging.Severity, string) {
+	var priority int
+	fmt.Sscanf(entry, "<%d>", &priority)
+	_, msg, _ := strings.Cut(entry, "]: ")
+	if priority/8 != 3 {
+		return -1, msg
+	}
+	return logging.Severity(priority % 8), msg
+}
+
+// parseJournaldEntry returns the severity and message of a journald
+// native protocol entry.
+func parseJournaldEntry(entry string) (logging.Severity, string) {
+	var severity logging.Severity = -1
+	var msg string
+	for entry != "" {
+		var line string
+		line, entry, _ = strings.Cut(entry, "\n")
+		switch {
+		case strings.HasPrefix(line, "PRIORITY="):
+			fmt.Sscanf(line, "PRIORITY=%d", &severity)
+		case strings.HasPrefix(line, "MESSAGE="):
+			msg = strings.TrimPrefix(line, "MESSAGE=")
+		case line == "MESSAGE" && len(entry) >= 8:
+			n := binary.LittleEndian.Uint64([]byte(entry[:8]))
+			msg, entry = entry[8:8+n], entry[8+n:]
+		}
+	}
+	return severity, msg
+}
+
+// mainArgsEnv passes runMain's arguments, as a JSON array, to the test
+// binary it runs main in.
+const mainArgsEnv = "TEST_MAIN_ARGS"
+
+func TestMain(m *testing.M) {
+	if encoded := os.Getenv(mainArgsEnv); encoded != "" {
+		var args []string
+		if err := json.Unmarshal([]byte(encoded), &args); err != nil {
+			log.Fatal(err)
+		}
+		os.Args = append([]string{"inventory"}, args...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the command with args in a process of its own, with env
+// added to an environment holding no INVENTORY_ variables or config file,
+// and returns its output and exit status.
+func runMain(t *testing.T, env []string, args ...string) (stdout, stderr string, status int) {
+	t.Helper()
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0])
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, envPrefix) && !strings.HasPrefix(v, "HOME=") {
+			cmd.Env = append(cmd.Env, v)
+		}
+	}
+	cmd.Env = append(cmd.Env, "HOME="+t.TempDir(), mainArgsEnv+"="+string(encoded))
+	cmd.Env = append(cmd.Env, env...)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), status
+}
+
+func TestDryRun(t *testing.T) {
+	server, client := etcdtest.Start(t)
+	inv := inventory.NewInventory(client)
+	createHosts(t, inv, map[string]map[string]interface{}{"web01": {"site": "ams"}, "web02": {"site": "fra"}})
+	revision := server.Revision()
+	for _, tc := range []struct {
+		args []string
+		// diff is whether a host diff is printed; touch changes only
+		// timestamps and groups are not hosts.
+		diff bool
+	}{
+		{[]string{"create", "web03", `{"site": "lon"}`}, true},
+		{[]string{"update", "web01", "site", "lon"}, true},
+		{[]string{"update", "web01", "--patch", `{"site": "lon"}`}, true},
+		{[]string{"clone", "web01", "web04"}, true},
+		{[]string{"rename", "web02", "web05"}, true},
+		{[]string{"remove", "--yes", "web01"}, true},
+		{[]string{"status", "set", "web01", "maintenance"}, true},
+		{[]string{"--output", "json", "create", "web03", `{"site": "lon"}`}, true},
+		{[]string{"touch", "web01"}, false},
+		{[]string{"group", "create", "webs"}, false},
+	} {
+		args := append([]string{"--etcd-endpoints", server.Endpoint(), "--dry-run"}, tc.args...)
+		stdout, stderr, status := runMain(t, nil, args...)
+		if status != 0 {
+			t.Errorf("%q exited with %d: %s", args, status, stderr)
+			continue
+		}
+		if tc.diff && stdout == "" {
+			t.Errorf("%q printed no diff", args)
+		}
+		// The one line logged, after the log package's timestamp.
+		if !strings.HasSuffix(stderr, " Dry run: nothing was written\n") || strings.Count(stderr, "\n") != 1 {
+			t.Errorf("%q logged %q, want only that nothing was written", args, stderr)
+		}
+	}
+	if got := server.Revision(); got != revision {
+		t.Errorf("etcd revision %d after the dry runs, want %d", got, revision)
+	}
+	hosts, err := inv.ListHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sites := make(map[string]interface{})
+	for _, host := range hosts {
+		sites[host.Name] = host.Data["site"]
+	}
+	if want := map[string]interface{}{"web01": "ams", "web02": "fra"}; !reflect.DeepEqual(sites, want) {
+		t.Errorf("sites after the dry runs = %v, want %v", sites, want)
+	}
+}
+
+func TestIfRevisionConflicts(t *testing.T) {
+	server, client := etcdtest.Start(t)
+	inv := inventory.NewInventory(client)
+	// stale stores web01 at site ams, then changes it to fra as another
+	// client would, and returns the revision first read.
+	stale := func() int64 {
+		t.Helper()
+		if _, err := inv.PutHost("web01", map[string]interface{}{"site": "ams"}); err != nil {
+			t.Fatal(err)
+		}
+		_, revision, err := inv.GetHostWithRevision("web01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := inv.UpdateHostFieldValue("web01", "site", "fra"); err != nil {
+			t.Fatal(err)
+		}
+		return revision
+	}
+	site := func() interface{} {
+		t.Helper()
+		host, err := inv.GetHost("web01")
+		if errors.Is(err, inventory.ErrHostNotFound) {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return host.Data["site"]
+	}
+	current := func() string {
+		t.Helper()
+		_, revision, err := inv.GetHostWithRevision("web01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strconv.FormatInt(revision, 10)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		// written is web01's site after a write that succeeds.
+		written interface{}
+	}{
+		{[]string{"update", "--if-revision", "%d", "web01", "site", "lon"}, "lon"},
+		{[]string{"update", "--if-revision", "%d", "web01", "site=lon"}, "lon"},
+		{[]string{"update", "--if-revision", "%d", "web01", "--patch", `{"site": "lon"}`}, "lon"},
+		{[]string{"remove", "--yes", "--if-revision", "%d", "web01"}, nil},
+	} {
+		run := func(revision string) (string, int) {
+			args := []string{"--etcd-endpoints", server.Endpoint()}
+			for _, arg := range tc.args {
+				args = append(args, strings.Replace(arg, "%d", revision, 1))
+			}
+			_, stderr, status := runMain(t, nil, args...)
+			return stderr, status
+		}
+		stderr, status := run(strconv.FormatInt(stale(), 10))
+		if status != 1 || !strings.Contains(stderr, inventory.ErrHostChanged.Error()) {
+			t.Errorf("%q at a stale revision exited with %d: %s", tc.args, status, stderr)
+		}
+		if got := site(); got != "fra" {
+			t.Errorf("%q at a stale revision left site %v, want fra", tc.args, got)
+		}
+		if stderr, status := run(current()); status != 0 {
+			t.Errorf("%q at the current revision exited with %d: %s", tc.args, status, stderr)
+		}
+		if got := site(); got != tc.written {
+			t.Errorf("%q at the current revision left site %v, want %v", tc.args, got, tc.written)
+		}
+		stale()
+		if stderr, status := run("0"); status != 0 {
+			t.Errorf("%q at revision 0 exited with %d: %s", tc.args, status, stderr)
+		}
+		if got := site(); got != tc.written {
+			t.Errorf("%q at revision 0 left site %v, want %v", tc.args, got, tc.written)
+		}
+	}
+
+	handler := newHTTPHandler(hostSource{inv: inv}, inventory.OutputOptions{}, 0, true)
+	for _, tc := range []struct {
+		method, target, body string
+		written              interface{}
+	}{
+		{http.MethodPut, "/hosts/web01", `{"data": {"site": "lon"}}`, "lon"},
+		{http.MethodPatch, "/hosts/web01/fields/site", `"lon"`, "lon"},
+		{http.MethodDelete, "/hosts/web01", "", nil},
+	} {
+		serve := func(ifMatch string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec
+		}
+		if rec := serve(strconv.Quote(strconv.FormatInt(stale(), 10))); rec.Code != http.StatusPreconditionFailed {
+			t.Errorf("%s %s at a stale revision: status %d, want 412: %s", tc.method, tc.target, rec.Code, rec.Body)
+		}
+		if got := site(); got != "fra" {
+			t.Errorf("%s %s at a stale revision left site %v, want fra", tc.method, tc.target, got)
+		}
+		if rec := serve(current()); rec.Code != http.StatusNoContent {
+			t.Errorf("%s %s at the current revision: status %d, want 204: %s", tc.method, tc.target, rec.Code, rec.Body)
+		}
+		if got := site(); got != tc.written {
+			t.Errorf("%s %s at the current revision left site %v, want %v", tc.method, tc.target, got, tc.written)
+		}
+		stale()
+		if rec := serve(""); rec.Code != http.StatusNoContent {
+			t.Errorf("%s %s without If-Match: status %d, want 204: %s", tc.method, tc.target, rec.Code, rec.Body)
+		}
+		if got := site(); got != tc.written {
+			t.Errorf("%s %s without If-Match left site %v, want %v", tc.method, tc.target, got, tc.written)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+// handlePreflight prints whether each capability is allowed and exits
+// nonzero if any is not, so scripts can check permissions before starting.
+func handlePreflight(inv *inventory.Inventory) {
+	failed := 0
+	for _, check := range inv.Preflight() {
+		status := "OK"
+		switch {
+		case errors.Is(check.Err, rpctypes.ErrPermissionDenied):
+			status = "denied"
+		case check.Err != nil:
+			status = "error: " + check.Err.Error()
+		}
+		if check.Err != nil {
+			failed++
+		}
+		fmt.Printf("%-8s %s\n", check.Capability, status)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// defaultSnapshotDir is the directory in the home directory that holds the
+// snapshots of snapshot create.
+const defaultSnapshotDir = ".inventory-snapshots"
+
+// snapshotIDLayout names a snapshot after the UTC time it was taken.
+const snapshotIDLayout = "20060102T150405Z"
+
+// handleSnapshot implements snapshot create, list, restore and diff, which
+// keep copies of the hosts and groups in files named <id>.json, and
+// snapshot save, which saves the whole etcd database.
+func handleSnapshot(inv *inventory.Inventory, args []string) {
+	const usage = "Usage: snapshot create|list [--dir D] | snapshot restore <id> [--dir D] [--dry-run] [--yes] | snapshot diff <a> <b> [--dir D] | snapshot save <file> (an id may also be a path to a snapshot file, or current in diff)"
+	if len(args) == 0 {
+		logging.Fatal(usage)
+	}
+	if args[0] == "save" {
+		if len(args) != 2 {
+			logging.Fatal(usage)
+		}
+		saveEtcdSnapshot(inv, args[1])
+		return
+	}
+	fs := flag.NewFlagSet("snapshot "+args[0], flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory holding the snapshots (default ~/"+defaultSnapshotDir+")")
+	dryRun := fs.Bool("dry-run", false, "With restore, show what it would change without changing anything")
+	yes := fs.Bool("yes", false, "With restore, confirm overwriting the current hosts and groups")
+	fs.Parse(args[1:])
+	operands := fs.Args()
+	// Allow the flags after the ids too: snapshot restore <id> --yes
+	for n := 0; n < len(operands); n++ {
+		if strings.HasPrefix(operands[n], "-") {
+			fs.Parse(operands[n:])
+			operands = append(operands[:n], fs.Args()...)
+		}
+	}
+	if *dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			logging.Fatalf("Error finding the snapshot directory (use --dir): %v", err)
+		}
+		*dir = filepath.Join(home, defaultSnapshotDir)
+	}
+
+	switch {
+	case args[0] == "create" && len(operands) == 0:
+		backup, err := inv.CreateBackup()
+		if err != nil {
+			logging.Fatalf("Error reading hosts: %v", err)
+		}
+		if err := os.MkdirAll(*dir, 0o700); err != nil {
+			logging.Fatalf("Error creating %s: %v", *dir, err)
+		}
+		id := backup.Time.Format(snapshotIDLayout)
+		if err := inventory.WriteBackup(filepath.Join(*dir, id+".json"), backup); err != nil {
+			logging.Fatalf("Error writing snapshot: %v", err)
+		}
+		logging.Infof("Created snapshot %s (%d keys at revision %d)", id, len(backup.Keys), backup.Revision)
+	case args[0] == "list" && len(operands) == 0:
+		listSnapshots(*dir)
+	case args[0] == "restore" && len(operands) == 1:
+		backup := readSnapshot(inv, *dir, operands[0])
+		if *dryRun || !*yes {
+			current, err := inv.CreateBackup()
+			if err != nil {
+				logging.Fatalf("Error reading hosts: %v", err)
+			}
+			printBackupDiff(inv.DiffBackups(current, backup))
+			if !*dryRun {
+				logging.Fatal("Refusing to restore without --yes: the changes above would be made")
+			}
+			return
+		}
+		written, deleted, err := inv.RestoreBackup(backup)
+		if err != nil {
+			logging.Fatalf("Error restoring snapshot after %d keys written and %d deleted: %v (restore again to finish)", written, deleted, err)
+		}
+		logDone("Restored snapshot %s (revision %d): %d keys written, %d deleted", operands[0], backup.Revision, written, deleted)
+	case args[0] == "diff" && len(operands) == 2:
+		diff := inv.DiffBackups(readSnapshot(inv, *dir, operands[0]), readSnapshot(inv, *dir, operands[1]))
+		printBackupDiff(diff)
+		if len(diff.Added)+len(diff.Removed)+len(diff.Changed) > 0 {
+			os.Exit(1)
+		}
+	default:
+		logging.Fatal(usage)
+	}
+}
+
+// readSnapshot loads the snapshot named by id: a file of dir, a path, or
+// for current the hosts as they are now.
+func readSnapshot(inv *inventory.Inventory, dir, id string) *inventory.Backup {
+	if id == "current" {
+		backup, err := inv.CreateBackup()
+		if err != nil {
+			logging.Fatalf("Error reading hosts: %v", err)
+		}
+		return backup
+	}
+	path := id
+	if !strings.ContainsRune(id, filepath.Separator) && !strings.HasSuffix(id, ".json") {
+		path = filepath.Join(dir, id+".json")
+	}
+	backup, err := inventory.ReadBackup(path)
+	if err != nil {
+		logging.Fatalf("Error reading snapshot: %v", err)
+	}
+	return backup
+}
+
+// listSnapshots prints the snapshots in dir, oldest first.
+func listSnapshots(dir string) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		logging.Fatalf("Error listing snapshots: %v", err)
+	}
+	sort.Strings(paths)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tREVISION\tHOSTS")
+	for _, path := range paths {
+		backup, err := inventory.ReadBackup(path)
+		if err != nil {
+			logging.Warnf("skipping %v", err)
+			continue
+		}
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", id, backup.Time.Format(time.RFC3339), backup.Revision, backup.HostCount())
+	}
+	tw.Flush()
+}
+
+// printBackupDiff prints the hosts a snapshot diff found, one per line,
+// prefixed with + for added, - for removed and ~ for changed, with the
+// fields that changed.
+func printBackupDiff(diff inventory.BackupDiff) {
+	for _, name := range diff.Added {
+		fmt.Printf("+ %s\n", name)
+	}
+	for _, name := range diff.Removed {
+		fmt.Printf("- %s\n", name)
+	}
+	for _, change := range diff.Changed {
+		fmt.Printf("~ %s (%s)\n", change.Name, strings.Join(change.FieldsChanged, ", "))
+	}
+	logging.Infof("%d added, %d removed, %d changed", len(diff.Added), len(diff.Removed), len(diff.Changed))
+}
+
+// saveEtcdSnapshot implements snapshot save <file>. Unlike the other
+// snapshots, it is the raw etcd database for disaster recovery. Restoring
+// is done on the cluster side, by seeding new members from the file with
+// etcdutl snapshot restore.
+func saveEtcdSnapshot(inv *inventory.Inventory, path string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	size, revision, err := inv.SaveSnapshot(ctx, path)
+	if err != nil {
+		logging.Fatalf("Error saving snapshot: %v", err)
+	}
+	logging.Infof("Saved snapshot %s (%d bytes, revision %d); restore it with etcdutl snapshot restore", path, size, revision)
+}
+
+// handleMaintenance implements maintenance compact --keep-revisions N
+// [--defrag] --yes. Compaction is cluster-wide and irreversible: history
+// older than the kept revisions is gone for history and get --at-revision,
+// and for any other client of the cluster.
+func handleMaintenance(inv *inventory.Inventory, args []string) {
+	const usage = "Usage: maintenance compact --keep-revisions N [--defrag] --yes"
+	if len(args) < 1 || args[0] != "compact" {
+		logging.Fatal(usage)
+	}
+	fs := flag.NewFlagSet("maintenance compact", flag.ExitOnError)
+	keep := fs.Int64("keep-revisions", -1, "Keep this many of the most recent revisions and discard all older history (required)")
+	defrag := fs.Bool("defrag", false, "Defragment each endpoint afterwards to return the freed space to the filesystem (blocks each member while it runs)")
+	yes := fs.Bool("yes", false, "Confirm the compaction, which cannot be undone")
+	fs.Parse(args[1:])
+	if *keep < 0 || fs.NArg() != 0 {
+		logging.Fatal(usage)
+	}
+	if !*yes {
+		logging.Fatal("Refusing to compact without --yes: compaction permanently discards history for the whole etcd cluster")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	revision, err := inv.Compact(ctx, *keep)
+	if err != nil {
+		logging.Fatalf("Error compacting: %v", err)
+	}
+	fmt.Printf("Compacted to revision %d\n", revision)
+	if !*defrag {
+		return
+	}
+	results, err := inv.Defragment(ctx)
+	failed := 0
+	var reclaimed int64
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("%s: error: %v\n", result.Endpoint, result.Err)
+			continue
+		}
+		if result.SizeBefore == 0 || result.SizeAfter == 0 {
+			fmt.Printf("%s: defragmented\n", result.Endpoint)
+			continue
+		}
+		reclaimed += result.SizeBefore - result.SizeAfter
+		fmt.Printf("%s: defragmented, %d -> %d bytes\n", result.Endpoint, result.SizeBefore, result.SizeAfter)
+	}
+	fmt.Printf("Reclaimed %d bytes\n", reclaimed)
+	if err != nil {
+		logging.Fatalf("Error defragmenting: %v", err)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+)
+
+// handleNamespace lists the named inventories or copies one into another;
+// see inventory.NamespacesKey.
+func handleNamespace(inv *inventory.Inventory, args []string, output inventory.OutputOptions) {
+	const usage = "Usage: namespace list | copy <src> <dst>"
+	if len(args) == 0 {
+		logging.Fatal(usage)
+	}
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			logging.Fatal(usage)
+		}
+		namespaces, err := inv.Namespaces()
+		if err != nil {
+			logging.Fatalf("Error listing namespaces: %v", err)
+		}
+		rows := make([]inventory.Host, len(namespaces))
+		for n, namespace := range namespaces {
+			rows[n] = inventory.Host{Name: namespace.Name, Data: map[string]interface{}{"hosts": namespace.Hosts}}
+		}
+		output.Wide = true
+		printOutput(output, rows)
+	case "copy":
+		if len(args) != 3 {
+			logging.Fatal(usage)
+		}
+		copied, err := inv.CopyNamespace(args[1], args[2])
+		if err != nil {
+			logging.Fatalf("Error copying namespace after %d keys: %v", copied, err)
+		}
+		logDone("Copied %d keys from namespace %s to %s", copied, args[1], args[2])
+	default:
+		logging.Fatalf("Unknown namespace subcommand %q. Use 'list' or 'copy'.", args[0])
+	}
+}
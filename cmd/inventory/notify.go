@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+	"github.com/oferchen/inventory/notify"
+)
+
+// webhookEvent is the JSON body POSTed to --webhook for each change.
+// Source is the subcommand that made it, or "watch" in serve mode, where
+// FieldsChanged is not known and Resync marks the events replayed after
+// etcd compacted the watched revisions (see WatchHosts).
+type webhookEvent struct {
+	Source        string    `json:"source"`
+	Operation     string    `json:"operation"`
+	Host          string    `json:"host"`
+	Revision      int64     `json:"revision"`
+	FieldsChanged []string  `json:"fields_changed,omitempty"`
+	Resync        bool      `json:"resync,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// webhookBackoff is the delay before the first webhook retry; it doubles
+// per retry.
+const webhookBackoff = 500 * time.Millisecond
+
+// webhook POSTs change events to a URL. A change has already been made by
+// the time it is reported, so delivery failures are logged and never fail
+// the command.
+type webhook struct {
+	url     string
+	client  *http.Client
+	retries int
+}
+
+// send delivers event, retrying with backoff on errors and non-2xx
+// responses.
+func (h *webhook) send(event webhookEvent) {
+	event.Time = time.Now().UTC()
+	body, err := json.Marshal(event)
+	if err != nil {
+		logging.Errorf("Error encoding webhook event for host '%s': %v", event.Host, err)
+		return
+	}
+	for attempt := 0; ; attempt++ {
+		if err = h.post(body); err == nil {
+			return
+		}
+		if attempt == h.retries {
+			break
+		}
+		debugf("Webhook for host '%s' failed, retrying: %v", event.Host, err)
+		time.Sleep(webhookBackoff << attempt)
+	}
+	logging.Errorf("Webhook for host '%s' failed after %d attempts: %v", event.Host, h.retries+1, err)
+}
+
+func (h *webhook) post(body []byte) error {
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", h.url, resp.Status)
+	}
+	return nil
+}
+
+// handleNotify implements notify: a daemon sending every change to the
+// hosts, with their data before and after it, to webhooks, a NATS subject
+// and a Kafka topic. With --state-file it resumes from the last revision
+// it delivered, which is sent again, so receivers should ignore a change
+// to a host at a revision they have already seen.
+func handleNotify(inv *inventory.Inventory, args []string, revealSecrets bool) {
+	const usage = "Usage: notify [--webhook <url>]... [--webhook-secret-file F] [--nats <url> [--nats-subject S]] [--kafka <brokers> [--kafka-topic T]] [--retries N] [--since-revision N] [--state-file F]"
+	fs := flag.NewFlagSet("notify", flag.ExitOnError)
+	var webhooks stringList
+	fs.Var(&webhooks, "webhook", "POST each change to this URL (repeatable)")
+	secretFile := fs.String("webhook-secret-file", "", "Sign webhook bodies with an HMAC-SHA256 of the key in this file, sent in the "+notify.SignatureHeader+" header")
+	webhookTimeout := fs.Duration("webhook-timeout", 5*time.Second, "Timeout for each webhook request")
+	natsURL := fs.String("nats", "", "Publish each change to the NATS servers at this URL (comma-separated)")
+	natsSubject := fs.String("nats-subject", "inventory.hosts", "NATS subject the changes are published to")
+	kafkaBrokers := fs.String("kafka", "", "Produce each change to Kafka on these comma-separated brokers")
+	kafkaTopic := fs.String("kafka-topic", "inventory-hosts", "Kafka topic the changes are produced to, keyed by host name")
+	retries := fs.Int("retries", 5, "Times to retry a failed delivery, with backoff, before dropping it")
+	sinceRevision := fs.Int64("since-revision", 0, "Send the changes made after this etcd revision before new ones (ignored once --state-file exists)")
+	stateFile := fs.String("state-file", "", "Keep the last delivered revision in this file, and resume from it")
+	fs.Parse(args)
+	if (len(webhooks) == 0 && *natsURL == "" && *kafkaBrokers == "") || *retries < 0 || *sinceRevision < 0 || fs.NArg() != 0 {
+		logging.Fatal(usage)
+	}
+
+	n := &notify.Notifier{Retries: *retries, RevealSecrets: revealSecrets}
+	var secret []byte
+	if *secretFile != "" {
+		content, err := os.ReadFile(*secretFile)
+		if err != nil {
+			logging.Fatalf("Error reading --webhook-secret-file: %v", err)
+		}
+		if secret = bytes.TrimSpace(content); len(secret) == 0 {
+			logging.Fatalf("--webhook-secret-file %s is empty", *secretFile)
+		}
+	}
+	client := &http.Client{Timeout: *webhookTimeout}
+	for _, target := range webhooks {
+		n.Sinks = append(n.Sinks, &notify.Webhook{URL: target, Client: client, Secret: secret})
+	}
+	if *natsURL != "" {
+		sink, err := notify.NewNATS(*natsURL, *natsSubject)
+		if err != nil {
+			logging.Fatalf("Error %v", err)
+		}
+		n.Sinks = append(n.Sinks, sink)
+	}
+	if *kafkaBrokers != "" {
+		n.Sinks = append(n.Sinks, notify.NewKafka(inventory.SplitList(*kafkaBrokers), *kafkaTopic))
+	}
+	defer func() {
+		for _, sink := range n.Sinks {
+			sink.Close()
+		}
+	}()
+
+	rev := *sinceRevision
+	if rev > 0 {
+		rev++
+	}
+	if *stateFile != "" {
+		content, err := os.ReadFile(*stateFile)
+		switch {
+		case err == nil:
+			if rev, err = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64); err != nil || rev < 1 {
+				logging.Fatalf("Invalid revision in --state-file %s", *stateFile)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			logging.Fatalf("Error reading --state-file: %v", err)
+		}
+		saved := rev
+		n.Delivered = func(revision int64) error {
+			// A transaction changing several hosts is saved once.
+			if revision == saved {
+				return nil
+			}
+			saved = revision
+			return inventory.WriteFileAtomic(*stateFile, []byte(strconv.FormatInt(revision, 10)+"\n"))
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	names := make([]string, len(n.Sinks))
+	for k, sink := range n.Sinks {
+		names[k] = sink.String()
+	}
+	logging.Infof("Sending host changes to %s", strings.Join(names, ", "))
+	if err := n.Run(ctx, inv, rev); err != nil && ctx.Err() == nil {
+		logging.Fatalf("Error watching for changes: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+)
+
+func printOutput(output inventory.OutputOptions, hosts []inventory.Host) {
+	if output.PostProcess != "" {
+		if err := postProcessOutput(os.Stdout, output, hosts); err != nil {
+			logging.Fatalf("Error post-processing output: %v", err)
+		}
+		return
+	}
+	if err := inventory.WriteOutput(os.Stdout, output, hosts); err != nil {
+		logging.Fatalf("Error writing output: %v", err)
+	}
+}
+
+// postProcessOutput formats hosts and runs output.PostProcess with sh -c,
+// the formatted output on its stdin, copying its stdout to w only if it
+// succeeds. The command, and any it started, is killed on interrupt or
+// after output.PostProcessTimeout (if positive).
+func postProcessOutput(w io.Writer, output inventory.OutputOptions, hosts []inventory.Host) error {
+	var formatted bytes.Buffer
+	if err := inventory.WriteOutput(&formatted, output, hosts); err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if output.PostProcessTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, output.PostProcessTimeout)
+		defer cancel()
+	}
+	var result bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", output.PostProcess)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = &formatted, &result, os.Stderr
+	killProcessGroup(cmd)
+	// Don't wait forever on a grandchild still holding stdout after the
+	// shell is killed.
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%q timed out after %v", output.PostProcess, output.PostProcessTimeout)
+	case ctx.Err() != nil:
+		return fmt.Errorf("%q interrupted", output.PostProcess)
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 127:
+		return fmt.Errorf("%q: command not found", output.PostProcess)
+	case err != nil:
+		return fmt.Errorf("%q: %w", output.PostProcess, err)
+	}
+	_, err = result.WriteTo(w)
+	return err
+}
+
+// outputTarget pairs a format with a file, as given to --also-output.
+type outputTarget struct {
+	Format string
+	Path   string
+}
+
+// outputTargets collects repeated --also-output format=path flags.
+type outputTargets []outputTarget
+
+func (t *outputTargets) String() string {
+	parts := make([]string, 0, len(*t))
+	for _, target := range *t {
+		parts = append(parts, target.Format+"="+target.Path)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (t *outputTargets) Set(value string) error {
+	format, path, ok := strings.Cut(value, "=")
+	if !ok || format == "" || path == "" {
+		return fmt.Errorf("expected format=path, got %q", value)
+	}
+	if err := inventory.ValidateFormat(format); err != nil {
+		return err
+	}
+	*t = append(*t, outputTarget{Format: format, Path: path})
+	return nil
+}
+
+// writeOutputTargets renders hosts once per target, each to its own file.
+// A path of "-" means stdout; use /dev/stderr for stderr.
+func writeOutputTargets(output inventory.OutputOptions, targets outputTargets, hosts []inventory.Host) error {
+	for _, target := range targets {
+		targetOutput := output
+		targetOutput.Format = target.Format
+		if target.Path == "-" {
+			if err := inventory.WriteOutput(os.Stdout, targetOutput, hosts); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := os.Create(target.Path)
+		if err != nil {
+			return err
+		}
+		err = inventory.WriteOutput(f, targetOutput, hosts)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", target.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killProcessGroup leaves cmd alone: without process groups only the
+// command itself is killed on cancellation.
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+)
+
+// handleValidate audits every stored host, against the schema too, and
+// prints all problems found as rows of host and problem, exiting nonzero
+// if any host fails.
+func handleValidate(inv *inventory.Inventory, output inventory.OutputOptions) {
+	hosts, err := inv.ListHosts()
+	if err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+	typeProblems := inventory.FieldTypeProblems(hosts)
+	failed := 0
+	var rows []inventory.Host
+	for _, host := range hosts {
+		problems := append(inv.ValidateHost(host), typeProblems[host.Name]...)
+		problems = append(problems, inv.Schema.Validate(host.Data)...)
+		if len(problems) == 0 {
+			continue
+		}
+		failed++
+		for _, problem := range problems {
+			rows = append(rows, inventory.Host{Name: host.Name, Data: map[string]interface{}{"problem": problem.Error()}})
+		}
+	}
+	if failed > 0 {
+		output.Wide = true
+		printOutput(output, rows)
+		logging.Errorf("%d of %d hosts failed validation", failed, len(hosts))
+		os.Exit(1)
+	}
+	logging.Infof("All %d hosts are valid", len(hosts))
+}
+
+// schemaCommands are the subcommands that read the stored schema, as they
+// write host data or, for validate, check it. --schema applies to all.
+var schemaCommands = map[string]bool{"create": true, "update": true, "set-default": true, "import": true, "clone": true, "rename": true, "bulk-update": true,
+	"set": true, "edit": true, "tui": true, "sync": true, "tag": true, "seed": true, "prune-empty": true, "serve": true, "validate": true, "status": true}
+
+// handleSchema stores, shows or removes the JSON Schema that host data is
+// checked against on writes and by validate.
+func handleSchema(inv *inventory.Inventory, args []string) {
+	if len(args) == 0 {
+		logging.Fatal("Usage: schema set <file> | show | remove")
+	}
+	switch args[0] {
+	case "set":
+		if len(args) != 2 {
+			logging.Fatal("Usage: schema set <file>")
+		}
+		text, err := os.ReadFile(args[1])
+		if err != nil {
+			logging.Fatalf("Error reading schema: %v", err)
+		}
+		if err := inv.PutSchema(text); err != nil {
+			logging.Fatalf("Error storing schema: %v", err)
+		}
+		logDone("Stored the schema from %s; run validate to check the existing hosts", args[1])
+	case "show":
+		text, err := inv.SchemaText()
+		if err != nil {
+			logging.Fatalf("Error reading schema: %v", err)
+		}
+		if text == nil {
+			logging.Fatal("No schema is stored")
+		}
+		os.Stdout.Write(text)
+		if !bytes.HasSuffix(text, []byte("\n")) {
+			fmt.Println()
+		}
+	case "remove":
+		removed, err := inv.RemoveSchema()
+		if err != nil {
+			logging.Fatalf("Error removing schema: %v", err)
+		}
+		if !removed {
+			logging.Fatal("No schema is stored")
+		}
+		logDone("Removed the schema")
+	default:
+		logging.Fatalf("Unknown schema subcommand %q. Use 'set', 'show' or 'remove'.", args[0])
+	}
+}
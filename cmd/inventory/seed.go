@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+)
+
+// handleSeed creates generated hosts for demos and tests, named with a
+// prefix so they are easy to tell from real hosts and to remove again with
+// --clean. The same --seed always generates the same hosts.
+func handleSeed(inv *inventory.Inventory, args []string) {
+	const usage = "Usage: seed --count N [--prefix P] [--seed S] | seed --clean [--prefix P] --yes"
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	count := fs.Int("count", 0, "Number of hosts to generate")
+	prefix := fs.String("prefix", "seed-", "Prefix of the generated host names, and of the hosts --clean removes")
+	seed := fs.Int64("seed", 0, "Seed of the generator, for reproducible hosts (0 picks one and logs it)")
+	clean := fs.Bool("clean", false, "Remove every host whose name starts with --prefix instead")
+	yes := fs.Bool("yes", false, "Confirm --clean")
+	bulk := addBulkFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 0 || *prefix == "" {
+		logging.Fatal(usage + " (P must not be empty)")
+	}
+	if *clean {
+		names, err := inv.ListHostNames(*prefix)
+		if err != nil {
+			logging.Fatalf("Error listing hosts: %v", err)
+		}
+		if !*yes {
+			logging.Fatalf("Refusing to remove %d hosts named %s* without --yes", len(names), *prefix)
+		}
+		deleted, archived, err := inv.DeleteHosts(names, false)
+		if err != nil {
+			logging.Fatalf("Error removing hosts after %d removed and %d archived: %v", deleted, archived, err)
+		}
+		logDone("Removed %d hosts, archived %d", deleted, archived)
+		return
+	}
+	if *count < 1 {
+		logging.Fatal(usage + " (N must be positive)")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+		logging.Infof("Seed: %d", *seed)
+	}
+	hosts := generateHosts(*count, *prefix, *seed)
+	errs := bulk.run(hosts, func(_ int, host inventory.Host) error {
+		return inv.Create(host)
+	})
+	failed, notStarted := 0, 0
+	for i, err := range errs {
+		switch {
+		case errors.Is(err, errNotStarted):
+			notStarted++
+		case err != nil:
+			logging.Errorf("Error creating host '%s': %v", hosts[i].Name, err)
+			failed++
+		}
+	}
+	logDone("Created %d hosts (%d failed, %d not started)", len(hosts)-failed-notStarted, failed, notStarted)
+	if failed+notStarted > 0 {
+		os.Exit(1)
+	}
+}
+
+// Value pools of generateHosts.
+var (
+	seedRoles       = []string{"web", "db", "cache", "queue", "worker", "lb"}
+	seedEnvs        = []string{"prod", "stage", "dev"}
+	seedDatacenters = []string{"us-east-1", "us-west-2", "eu-west-1"}
+	seedCPUs        = []float64{2, 4, 8, 16}
+)
+
+// generateHosts returns count plausible hosts named prefix, role and a
+// sequence number, e.g. seed-web-0001, with fields drawn from a generator
+// seeded with seed.
+func generateHosts(count int, prefix string, seed int64) []inventory.Host {
+	r := rand.New(rand.NewSource(seed))
+	hosts := make([]inventory.Host, count)
+	for n := range hosts {
+		role := seedRoles[r.Intn(len(seedRoles))]
+		hosts[n] = inventory.Host{
+			Name: fmt.Sprintf("%s%s-%04d", prefix, role, n+1),
+			Data: map[string]interface{}{
+				"role":       role,
+				"env":        seedEnvs[r.Intn(len(seedEnvs))],
+				"datacenter": seedDatacenters[r.Intn(len(seedDatacenters))],
+				"ip":         fmt.Sprintf("10.%d.%d.%d", r.Intn(256), r.Intn(256), 1+r.Intn(254)),
+				"cpus":       seedCPUs[r.Intn(len(seedCPUs))],
+			},
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/grpcserver"
+	"github.com/oferchen/inventory/internal/logging"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"google.golang.org/grpc"
+)
+
+func handleServe(inv *inventory.Inventory, args []string, output inventory.OutputOptions, hook *webhook, revealSecrets bool) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	unixPath := fs.String("unix", "", "Serve line-delimited JSON requests on this Unix domain socket")
+	listenAddr := fs.String("listen", "", "Serve the HTTP API on this address (e.g. :8080)")
+	grpcAddr := fs.String("grpc", "", "Serve the gRPC API of inventorypb on this address (e.g. :9090)")
+	pageSize := fs.Int64("page-size", 500, "Most hosts returned per page of GET /hosts, and the default ?limit=; also the keys read per request by the gRPC ListHosts")
+	cache := fs.String("cache", "on", "Serve reads from an in-memory copy kept current by a watch (on), or from etcd on every request (off)")
+	allowWrites := fs.Bool("allow-writes", false, "Also serve PUT and DELETE /hosts/{name} and PATCH /hosts/{name}/fields/{field}, and the gRPC CreateHost and UpdateField")
+	tokenFile := fs.String("token-file", "", "Require HTTP and gRPC requests to carry the bearer token stored in this file")
+	rbac := fs.Bool("rbac", false, "Require HTTP and gRPC requests to carry a token from 'auth token create', and allow each only what the token's roles grant")
+	oidcConfig := fs.String("oidc-config", "", "Also accept OIDC ID tokens, mapping their claims to roles as this YAML file says (implies --rbac)")
+	fs.Parse(args)
+
+	if (*unixPath == "" && *listenAddr == "" && *grpcAddr == "") || *pageSize < 1 || (*cache != "on" && *cache != "off") {
+		logging.Fatal("Usage: serve [--unix <socket_path>] [--listen <addr>] [--grpc <addr>] [--page-size N] [--allow-writes] [--token-file <path> | --rbac [--oidc-config <path>]] [--cache on|off] (N must be positive)")
+	}
+	// The etcd counters of GET /metrics.
+	inventory.PublishMetrics()
+	if *oidcConfig != "" {
+		*rbac = true
+	}
+	if *rbac && *tokenFile != "" {
+		logging.Fatal("--token-file and --rbac cannot be combined")
+	}
+	var token string
+	if *tokenFile != "" {
+		content, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			logging.Fatalf("Error reading --token-file: %v", err)
+		}
+		if token = strings.TrimSpace(string(content)); token == "" {
+			logging.Fatalf("--token-file %s is empty", *tokenFile)
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var authenticate grpcserver.Authenticator
+	if *rbac {
+		auth, err := newServerAuth(ctx, inv, *oidcConfig)
+		if err != nil {
+			logging.Fatalf("Error loading --oidc-config: %v", err)
+		}
+		authenticate = auth.authenticate
+	}
+	source := hostSource{inv: inv}
+	if *cache == "on" {
+		snapshot, err := inv.Snapshot(ctx)
+		if err != nil {
+			logging.Fatalf("Error loading hosts into the cache: %v", err)
+		}
+		source.snapshot = snapshot
+	}
+	var wg sync.WaitGroup
+	if hook != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := inv.WatchHosts(ctx, 0, func(event inventory.HostEvent) error {
+				operation := "put"
+				if event.Type == mvccpb.DELETE {
+					operation = "delete"
+				}
+				hook.send(webhookEvent{Source: "watch", Operation: operation, Host: event.Name, Revision: event.Revision, Resync: event.Resync})
+				return nil
+			})
+			if err != nil && ctx.Err() == nil {
+				logging.Fatalf("Error watching for webhook events: %v", err)
+			}
+		}()
+	}
+	if *unixPath != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serveUnix(ctx, source, *unixPath); err != nil {
+				logging.Fatalf("Error serving on %s: %v", *unixPath, err)
+			}
+		}()
+	}
+	if *listenAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serveHTTP(ctx, source, *listenAddr, output, *pageSize, *allowWrites, token, authenticate); err != nil {
+				logging.Fatalf("Error serving on %s: %v", *listenAddr, err)
+			}
+		}()
+	}
+	if *grpcAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serveGRPC(ctx, inv, *grpcAddr, *pageSize, *allowWrites, revealSecrets, token, authenticate); err != nil {
+				logging.Fatalf("Error serving gRPC on %s: %v", *grpcAddr, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// serveGRPC runs the gRPC API until ctx is done, then stops gracefully. It
+// reads etcd directly, not the cache. A non-empty token is required of
+// every call (see grpcserver.TokenAuth), and with authenticate set the
+// roles of the caller are checked (see grpcserver.Authorize).
+func serveGRPC(ctx context.Context, inv *inventory.Inventory, addr string, pageSize int64, writable, revealSecrets bool, token string, authenticate grpcserver.Authenticator) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	var opts []grpc.ServerOption
+	switch {
+	case token != "":
+		opts = grpcserver.TokenAuth(token)
+	case authenticate != nil:
+		opts = grpcserver.Authorize(authenticate)
+	}
+	server := grpc.NewServer(opts...)
+	api := grpcserver.New(inv)
+	api.Writable, api.PageSize, api.RevealSecrets = writable, pageSize, revealSecrets
+	api.Register(server)
+	go func() {
+		<-ctx.Done()
+		// Watch streams only end when their client leaves, so they are cut
+		// off if they hold up the shutdown.
+		timer := time.AfterFunc(inventory.DefaultRequestTimeout, server.Stop)
+		defer timer.Stop()
+		server.GracefulStop()
+	}()
+	return server.Serve(listener)
+}
+
+// serveHTTP runs the HTTP API until ctx is done, then shuts down gracefully.
+// A non-empty token is required of every request (see requireToken), and
+// with authenticate set the roles of the caller are checked (see
+// authorizeRequests).
+func serveHTTP(ctx context.Context, source hostSource, addr string, output inventory.OutputOptions, pageSize int64, writable bool, token string, authenticate grpcserver.Authenticator) error {
+	handler := newHTTPHandler(source, output, pageSize, writable)
+	switch {
+	case token != "":
+		handler = requireToken(token, handler)
+	case authenticate != nil:
+		handler = authorizeRequests(authenticate, handler)
+	}
+	handler = countRequests(handler)
+	// Requests share ctx, so the event streams of GET /hosts/watch end on
+	// shutdown instead of holding it up.
+	srv := &http.Server{Addr: addr, Handler: handler, BaseContext: func(net.Listener) context.Context { return ctx }}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), inventory.DefaultRequestTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// socketRequest is one request line on the Unix socket, either JSON such as
+// {"op":"get","name":"web01"} or the plain form "get web01". Ops are list
+// (optionally with a filter) and get.
+type socketRequest struct {
+	Op     string `json:"op"`
+	Name   string `json:"name,omitempty"`
+	Filter string `json:"filter,omitempty"`
+}
+
+// socketResponse is written as one JSON line per request.
+type socketResponse struct {
+	Hosts *[]inventory.Host `json:"hosts,omitempty"`
+	Host  *inventory.Host   `json:"host,omitempty"`
+	Error string            `json:"error,omitempty"`
+}
+
+// serveUnix answers socket requests until ctx is done, then removes the
+// socket file. A stale socket left by a crashed server is replaced, but one
+// that still accepts connections is not.
+func serveUnix(ctx context.Context, source hostSource, path string) error {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.New("another server is already listening on the socket")
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	// Closing the listener also unlinks the socket file.
+	defer listener.Close()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	logging.Infof("Serving on unix socket %s", path)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			// Unblock an idle client's read on shutdown.
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+			serveSocketConn(source, conn)
+		}()
+	}
+}
+
+func serveSocketConn(source hostSource, conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := enc.Encode(handleSocketRequest(source, line)); err != nil {
+			debugf("Socket client went away: %v", err)
+			return
+		}
+	}
+}
+
+func handleSocketRequest(source hostSource, line string) socketResponse {
+	var req socketRequest
+	if strings.HasPrefix(line, "{") {
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			return socketResponse{Error: fmt.Sprintf("invalid request: %v", err)}
+		}
+	} else {
+		req.Op, req.Name, _ = strings.Cut(line, " ")
+		if req.Op == "list" {
+			req.Filter, req.Name = req.Name, ""
+		}
+	}
+
+	switch req.Op {
+	case "list":
+		filter, err := inventory.ParseHostFilter(req.Filter)
+		if err != nil {
+			return socketResponse{Error: err.Error()}
+		}
+		result, _, err := source.list(inventory.ListOptions{Filter: filter})
+		if err != nil {
+			return socketResponse{Error: err.Error()}
+		}
+		inventory.WarnMalformed(result.Malformed)
+		return socketResponse{Hosts: &result.Hosts}
+	case "get":
+		host, _, err := source.get(req.Name)
+		if err != nil {
+			return socketResponse{Error: err.Error()}
+		}
+		if host.Name == "" {
+			host.Name = req.Name
+		}
+		return socketResponse{Host: &host}
+	default:
+		return socketResponse{Error: fmt.Sprintf("unknown op %q (use list or get)", req.Op)}
+	}
+}
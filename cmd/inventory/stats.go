@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+)
+
+// totalRow names the stats row that carries the overall host count.
+const totalRow = "<total>"
+
+// fieldStats accumulates per-field statistics for the stats subcommand.
+type fieldStats struct {
+	types    map[string]bool
+	hosts    int
+	distinct map[string]bool
+	numbers  int
+	sum      float64
+	min, max float64
+	trues    int
+	falses   int
+}
+
+// inventoryStats describes each field seen across hosts as one row per
+// field, preceded by a row holding the total host count.
+func inventoryStats(hosts []inventory.Host) []inventory.Host {
+	stats := make(map[string]*fieldStats)
+	for _, host := range hosts {
+		for field, value := range host.Data {
+			st := stats[field]
+			if st == nil {
+				st = &fieldStats{types: make(map[string]bool), distinct: make(map[string]bool)}
+				stats[field] = st
+			}
+			st.types[inventory.TypeName(value)] = true
+			st.hosts++
+			st.distinct[inventory.FormatValue(value)] = true
+			if v, ok := inventory.ToFloat(value); ok {
+				value = v
+			}
+			switch v := value.(type) {
+			case float64:
+				if st.numbers == 0 || v < st.min {
+					st.min = v
+				}
+				if st.numbers == 0 || v > st.max {
+					st.max = v
+				}
+				st.numbers++
+				st.sum += v
+			case bool:
+				if v {
+					st.trues++
+				} else {
+					st.falses++
+				}
+			}
+		}
+	}
+
+	rows := []inventory.Host{{Name: totalRow, Data: map[string]interface{}{"hosts": len(hosts)}}}
+	for _, field := range inventory.FieldNames(hosts) {
+		st := stats[field]
+		types := make([]string, 0, len(st.types))
+		for typeName := range st.types {
+			types = append(types, typeName)
+		}
+		sort.Strings(types)
+		data := map[string]interface{}{
+			"type":     strings.Join(types, ","),
+			"hosts":    st.hosts,
+			"distinct": len(st.distinct),
+		}
+		if st.numbers > 0 {
+			data["min"] = st.min
+			data["max"] = st.max
+			data["avg"] = st.sum / float64(st.numbers)
+		}
+		if st.trues+st.falses > 0 {
+			data["true"] = st.trues
+			data["false"] = st.falses
+		}
+		rows = append(rows, inventory.Host{Name: field, Data: data})
+	}
+	return rows
+}
+
+func handleStats(inv *inventory.Inventory, output inventory.OutputOptions) {
+	hosts, err := inv.ListHosts()
+	if err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+	output.Wide = true
+	printOutput(output, inventoryStats(hosts))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/awssync"
+	"github.com/oferchen/inventory/internal/logging"
+	"github.com/oferchen/inventory/k8ssync"
+)
+
+// syncProviders are the providers sync takes.
+var syncProviders = []string{"aws", "k8s"}
+
+// handleSync reconciles the hosts of a provider, the EC2 instances of an
+// AWS region or the nodes and services of a Kubernetes cluster, into the
+// inventory; see inventory.SyncHosts.
+func handleSync(inv *inventory.Inventory, args []string) {
+	const usage = "Usage: sync aws [--region R] [--tag key=value]... [--name-tag T] [--prune none|mark|remove] [--dry-run]\n" +
+		"       sync k8s [--kubeconfig F] [--context C] [--selector S] [--services [--namespace N]] [--prefix P] [--watch [--resync D]] [--prune none|mark|remove] [--dry-run]"
+	if len(args) == 0 {
+		logging.Fatal(usage)
+	}
+	if !slices.Contains(syncProviders, args[0]) {
+		logging.Fatal(inventory.UnknownChoiceError("sync provider", args[0], syncProviders))
+	}
+	fs := flag.NewFlagSet("sync "+args[0], flag.ExitOnError)
+	prune := fs.String("prune", inventory.PruneNone, "What to do with hosts synced before that are gone from the provider: none (only report them), mark (set "+inventory.SyncMissingField+") or remove")
+	dryRun := fs.Bool("dry-run", false, "Only report what the sync would change")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if args[0] == "aws" {
+		region := fs.String("region", "", "AWS region to sync (default AWS_REGION or the profile's)")
+		var tags stringList
+		fs.Var(&tags, "tag", "Only sync instances with this tag value, as key=value (repeatable, all must hold)")
+		nameTag := fs.String("name-tag", awssync.DefaultNameTag, "Tag naming the host of an instance; instances without it are named by their ID")
+		fs.Parse(args[1:])
+		if fs.NArg() != 0 {
+			logging.Fatal(usage)
+		}
+		provider, err := awssync.New(ctx, *region)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		provider.NameTag = *nameTag
+		provider.Tags = make(map[string]string, len(tags))
+		for _, tag := range tags {
+			key, value, ok := strings.Cut(tag, "=")
+			if !ok || key == "" {
+				logging.Fatalf("Invalid --tag %q: expected key=value", tag)
+			}
+			provider.Tags[key] = value
+		}
+		opts := inventory.SyncOptions{Prune: *prune, DryRun: *dryRun}
+		if err := reportSync(provider, opts)(inv.SyncHosts(ctx, provider, opts)); err != nil {
+			logging.Fatalf("Error syncing: %v", err)
+		}
+		return
+	}
+
+	kubeconfig := fs.String("kubeconfig", "", "Kubeconfig file (default $KUBECONFIG or ~/.kube/config, or the in-cluster configuration)")
+	kubeContext := fs.String("context", "", "Kubeconfig context of the cluster (default the current context)")
+	selector := fs.String("selector", "", "Only sync nodes and services matching this label selector")
+	services := fs.Bool("services", false, "Also sync the services, with the addresses of their endpoints")
+	namespace := fs.String("namespace", "", "Only sync the services of this namespace (default all)")
+	prefix := fs.String("prefix", k8ssync.DefaultPrefix, "Prefix of the fields holding the labels and annotations")
+	watch := fs.Bool("watch", false, "Keep syncing as nodes and services change, until interrupted")
+	resync := fs.Duration("resync", 10*time.Minute, "With --watch, also sync this often in case a change was missed (0 to only sync on changes)")
+	fs.Parse(args[1:])
+	if fs.NArg() != 0 {
+		logging.Fatal(usage)
+	}
+	if *namespace != "" && !*services {
+		logging.Fatal("--namespace needs --services")
+	}
+	provider, err := k8ssync.New(*kubeconfig, *kubeContext)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	provider.Selector = *selector
+	provider.Services = *services
+	provider.Namespace = *namespace
+	provider.Prefix = *prefix
+	opts := inventory.SyncOptions{Prune: *prune, DryRun: *dryRun}
+	report := reportSync(provider, opts)
+	if !*watch {
+		if err := report(inv.SyncHosts(ctx, provider, opts)); err != nil {
+			logging.Fatalf("Error syncing: %v", err)
+		}
+		return
+	}
+	err = inv.WatchSync(ctx, provider, opts, *resync, func(result inventory.SyncResult, err error) {
+		if err := report(result, err); err != nil {
+			logging.Errorf("Error syncing: %v", err)
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		logging.Fatalf("Error watching %s: %v", provider.Source(), err)
+	}
+}
+
+// reportSync returns a function logging what a sync of provider did, which
+// passes on its error.
+func reportSync(provider inventory.SyncProvider, opts inventory.SyncOptions) func(inventory.SyncResult, error) error {
+	return func(result inventory.SyncResult, err error) error {
+		for _, name := range result.Created {
+			logDone("Host '%s': created", name)
+		}
+		for _, name := range result.Updated {
+			logDone("Host '%s': updated", name)
+		}
+		for _, name := range result.Missing {
+			logDone("Host '%s': gone from %s", name, provider.Source())
+		}
+		pruned := "not pruned"
+		switch {
+		case opts.DryRun:
+			pruned = "dry run, nothing written"
+		case opts.Prune == inventory.PruneMark:
+			pruned = "marked"
+		case opts.Prune == inventory.PruneRemove:
+			pruned = "removed"
+		}
+		logDone("Synced %s: %d created, %d updated, %d unchanged, %d missing (%s)",
+			provider.Source(), len(result.Created), len(result.Updated), len(result.Unchanged), len(result.Missing), pruned)
+		return err
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"golang.org/x/term"
+)
+
+// Modes of the tui subcommand: what the keys do.
+const (
+	tuiBrowse        = "browse"
+	tuiSearch        = "search"
+	tuiAddField      = "add"
+	tuiEditValue     = "edit"
+	tuiConfirmDelete = "delete"
+)
+
+// tuiHelp is the status line of the tui subcommand when there is nothing
+// else to say.
+const tuiHelp = "↑↓ move  tab switch pane  / search  e edit  a add field  d delete host  q quit"
+
+// tuiBrowser is the state of the tui subcommand: the hosts, kept current
+// by a watch, and what the user is looking at and typing.
+type tuiBrowser struct {
+	inv   *inventory.Inventory
+	hosts map[string]inventory.Host
+	// revisions are the ModRevisions the edits are guarded by, so an edit
+	// of a host changed meanwhile by someone else fails instead of
+	// overwriting their change.
+	revisions map[string]int64
+	// visible are the names of the hosts matching search, sorted.
+	visible []string
+	search  string
+	// cursor and offset select and scroll the host list, field and
+	// fieldOffset the fields of the selected host.
+	cursor, offset     int
+	field, fieldOffset int
+	fieldsFocused      bool
+	mode               string
+	// input is the text typed at a prompt, and editing the field it is
+	// the value of.
+	input   string
+	editing string
+	status  string
+	width   int
+	height  int
+}
+
+// handleTUI browses and edits the hosts in a full-screen terminal UI, which
+// a watch keeps current as other clients change them.
+func handleTUI(inv *inventory.Inventory, args []string) {
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		logging.Fatal("Usage: tui")
+	}
+	if !inventory.IsTerminal(os.Stdin) || !inventory.IsTerminal(os.Stdout) {
+		logging.Fatal("tui needs a terminal")
+	}
+	hosts, revisions, err := inv.ListHostsWithRevisions(inventory.ListOptions{})
+	if err != nil {
+		logging.Fatalf("Error listing hosts: %v", err)
+	}
+	b := &tuiBrowser{inv: inv, hosts: make(map[string]inventory.Host, len(hosts)), revisions: revisions, mode: tuiBrowse}
+	var rev int64
+	for _, host := range hosts {
+		b.hosts[host.Name] = host
+		rev = max(rev, revisions[host.Name])
+	}
+	b.refilter("")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan inventory.HostEvent)
+	watchErr := make(chan error, 1)
+	go func() {
+		// Watching from just after the newest host misses nothing changed
+		// since the listing; apply skips what the listing already had.
+		if rev > 0 {
+			rev++
+		}
+		watchErr <- inv.WatchHosts(ctx, rev, func(event inventory.HostEvent) error {
+			select {
+			case events <- event:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		logging.Fatalf("Error setting up the terminal: %v", err)
+	}
+	// From here on the terminal must be restored on the way out, so
+	// errors go to the status line rather than logging.Fatal.
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+		term.Restore(fd, state)
+	}()
+	keys := make(chan string)
+	go readTUIKeys(bufio.NewReader(os.Stdin), keys)
+	// Polling the size works where there is no SIGWINCH.
+	resize := time.NewTicker(250 * time.Millisecond)
+	defer resize.Stop()
+	b.width, b.height = tuiSize()
+	b.draw()
+	for {
+		select {
+		case key, ok := <-keys:
+			if !ok || !b.handleKey(key) {
+				return
+			}
+		case event := <-events:
+			b.apply(event)
+		case err := <-watchErr:
+			b.status = "Watch stopped, changes by others are no longer shown: " + tuiLine(err.Error())
+		case <-resize.C:
+			width, height := tuiSize()
+			if width == b.width && height == b.height {
+				continue
+			}
+			b.width, b.height = width, height
+		}
+		b.draw()
+	}
+}
+
+// tuiSize returns the size of the terminal, or 80x24 if it is unknown.
+func tuiSize() (width, height int) {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		return 80, 24
+	}
+	return width, height
+}
+
+// readTUIKeys decodes the key presses read from a terminal in raw mode
+// into keys, each a printable character or a name such as "up" or
+// "enter", and closes keys when r fails.
+func readTUIKeys(r *bufio.Reader, keys chan<- string) {
+	defer close(keys)
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return
+		}
+		key := string(c)
+		switch c {
+		case '\r', '\n':
+			key = "enter"
+		case '\t':
+			key = "tab"
+		case 0x7f, 0x08:
+			key = "backspace"
+		case 0x03:
+			key = "ctrl-c"
+		case 0x15:
+			key = "ctrl-u"
+		case 0x1b:
+			// A terminal writes an escape sequence at once, so the rest of
+			// it is already buffered; a lone ESC is the key itself.
+			key = "esc"
+			if r.Buffered() > 0 {
+				key = readTUIEscape(r)
+			}
+		}
+		keys <- key
+	}
+}
+
+// readTUIEscape names the key of the escape sequence following an ESC, or
+// returns "" for keys the tui does not use.
+func readTUIEscape(r *bufio.Reader) string {
+	if c, err := r.ReadByte(); err != nil || c != '[' && c != 'O' {
+		return ""
+	}
+	var seq []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, c)
+		if c >= 0x40 && c <= 0x7e {
+			break
+		}
+	}
+	switch string(seq) {
+	case "A":
+		return "up"
+	case "B":
+		return "down"
+	case "C":
+		return "right"
+	case "D":
+		return "left"
+	case "H", "1~", "7~":
+		return "home"
+	case "F", "4~", "8~":
+		return "end"
+	case "5~":
+		return "pgup"
+	case "6~":
+		return "pgdn"
+	}
+	return ""
+}
+
+// selectedHost returns the name of the host under the cursor, or "" if no
+// host matches the search.
+func (b *tuiBrowser) selectedHost() string {
+	if b.cursor < len(b.visible) {
+		return b.visible[b.cursor]
+	}
+	return ""
+}
+
+// fieldNames returns the fields of the selected host, sorted.
+func (b *tuiBrowser) fieldNames() []string {
+	data := b.hosts[b.selectedHost()].Data
+	fields := make([]string, 0, len(data))
+	for field := range data {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// refilter shows the hosts whose name, field names or values contain
+// search, ignoring case. The selection stays on the same host if it is
+// still shown, or else moves to the next one.
+func (b *tuiBrowser) refilter(search string) {
+	selected := b.selectedHost()
+	b.search = search
+	needle := strings.ToLower(search)
+	b.visible = b.visible[:0]
+	for name, host := range b.hosts {
+		if tuiMatches(host, needle) {
+			b.visible = append(b.visible, name)
+		}
+	}
+	sort.Strings(b.visible)
+	n := sort.SearchStrings(b.visible, selected)
+	if n == len(b.visible) || b.visible[n] != selected {
+		b.field, b.fieldOffset = 0, 0
+	}
+	b.cursor = max(min(n, len(b.visible)-1), 0)
+	b.field = max(min(b.field, len(b.fieldNames())-1), 0)
+}
+
+func tuiMatches(host inventory.Host, needle string) bool {
+	if strings.Contains(strings.ToLower(host.Name), needle) {
+		return true
+	}
+	for field, value := range host.Data {
+		if strings.Contains(strings.ToLower(field), needle) || strings.Contains(strings.ToLower(inventory.FormatValue(value)), needle) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply updates the hosts with a change seen by the watch.
+func (b *tuiBrowser) apply(event inventory.HostEvent) {
+	if event.Type == mvccpb.PUT {
+		if event.Revision <= b.revisions[event.Name] {
+			return
+		}
+		host := event.Host
+		host.Name = event.Name
+		b.hosts[event.Name] = host
+		b.revisions[event.Name] = event.Revision
+	} else {
+		delete(b.hosts, event.Name)
+		delete(b.revisions, event.Name)
+	}
+	b.refilter(b.search)
+}
+
+// handleKey acts on a key press, returning false to quit.
+func (b *tuiBrowser) handleKey(key string) bool {
+	if key == "ctrl-c" {
+		return false
+	}
+	switch b.mode {
+	case tuiSearch:
+		switch key {
+		case "enter":
+			b.mode = tuiBrowse
+		case "esc":
+			b.mode = tuiBrowse
+			b.refilter("")
+		default:
+			b.refilter(tuiType(b.search, key))
+		}
+		return true
+	case tuiAddField, tuiEditValue:
+		switch key {
+		case "enter":
+			b.submit()
+		case "esc":
+			b.mode = tuiBrowse
+		default:
+			b.input = tuiType(b.input, key)
+		}
+		return true
+	case tuiConfirmDelete:
+		b.mode = tuiBrowse
+		if key == "y" || key == "Y" {
+			b.deleteHost()
+		} else {
+			b.status = "Delete cancelled"
+		}
+		return true
+	}
+	b.status = ""
+	page := max(b.height-2, 1)
+	switch key {
+	case "q":
+		return false
+	case "up", "k":
+		b.move(-1)
+	case "down", "j":
+		b.move(1)
+	case "pgup":
+		b.move(-page)
+	case "pgdn":
+		b.move(page)
+	case "home":
+		b.move(-len(b.hosts))
+	case "end":
+		b.move(len(b.hosts))
+	case "tab":
+		b.fieldsFocused = !b.fieldsFocused
+	case "left", "h":
+		b.fieldsFocused = false
+	case "right", "l":
+		b.fieldsFocused = true
+	case "/":
+		b.mode = tuiSearch
+	case "enter", "e":
+		if !b.fieldsFocused {
+			b.fieldsFocused = true
+			return true
+		}
+		fields := b.fieldNames()
+		if len(fields) == 0 {
+			return true
+		}
+		b.editing = fields[b.field]
+		b.input = inventory.FormatValue(b.hosts[b.selectedHost()].Data[b.editing])
+		b.mode = tuiEditValue
+	case "a":
+		if b.selectedHost() == "" {
+			b.status = "No host selected"
+			return true
+		}
+		b.input = ""
+		b.mode = tuiAddField
+	case "d":
+		if b.selectedHost() == "" {
+			b.status = "No host selected"
+			return true
+		}
+		b.mode = tuiConfirmDelete
+	}
+	return true
+}
+
+// tuiType returns text edited by a key press at a prompt.
+func tuiType(text, key string) string {
+	switch key {
+	case "backspace":
+		_, size := utf8.DecodeLastRuneInString(text)
+		return text[:len(text)-size]
+	case "ctrl-u":
+		return ""
+	}
+	if r, size := utf8.DecodeRuneInString(key); size == len(key) && unicode.IsPrint(r) {
+		return text + key
+	}
+	return text
+}
+
+// move moves the cursor of the focused pane by delta, within its bounds.
+func (b *tuiBrowser) move(delta int) {
+	if b.fieldsFocused {
+		b.field = max(min(b.field+delta, len(b.fieldNames())-1), 0)
+		return
+	}
+	cursor := max(min(b.cursor+delta, len(b.visible)-1), 0)
+	if cursor != b.cursor {
+		b.cursor, b.field, b.fieldOffset = cursor, 0, 0
+	}
+}
+
+// submit acts on the text typed at the field name or value prompt. A
+// string field stays a string; other values are typed as with update
+// --type auto.
+func (b *tuiBrowser) submit() {
+	name := b.selectedHost()
+	if b.mode == tuiAddField {
+		field := strings.TrimSpace(b.input)
+		if field == "" {
+			b.mode = tuiBrowse
+			return
+		}
+		b.editing, b.input, b.mode = field, "", tuiEditValue
+		if value, ok := b.hosts[name].Data[field]; ok {
+			b.input = inventory.FormatValue(value)
+		}
+		return
+	}
+	b.mode = tuiBrowse
+	valueType := "auto"
+	if _, isString := b.hosts[name].Data[b.editing].(string); isString {
+		valueType = "string"
+	}
+	value, err := inventory.ParseTypedValue(b.input, valueType)
+	if err == nil {
+		err = b.inv.UpdateHostFieldValueIfRevision(name, b.editing, value, b.revisions[name])
+	}
+	switch {
+	case errors.Is(err, inventory.ErrHostChanged):
+		b.status = fmt.Sprintf("%s was changed by someone else meanwhile; check its fields and edit again", name)
+	case err != nil:
+		b.status = "Error: " + tuiLine(err.Error())
+	default:
+		b.status = fmt.Sprintf("Set %s of %s", b.editing, name)
+	}
+}
+
+// deleteHost removes the selected host, unless it changed since shown,
+// archiving it if it is decommissioned as remove does.
+func (b *tuiBrowser) deleteHost() {
+	name := b.selectedHost()
+	archived, err := b.inv.DeleteHost(name, b.revisions[name], false)
+	switch {
+	case errors.Is(err, inventory.ErrHostChanged):
+		b.status = fmt.Sprintf("%s was changed by someone else meanwhile; check it and delete again", name)
+	case err != nil:
+		b.status = "Error: " + tuiLine(err.Error())
+	case archived:
+		b.status = fmt.Sprintf("Archived %s", name)
+	default:
+		b.status = fmt.Sprintf("Deleted %s", name)
+	}
+}
+
+// draw redraws the whole screen: a title line, the host list beside the
+// fields of the selected host, and a status or prompt line.
+func (b *tuiBrowser) draw() {
+	const reverse, bold, reset = "\x1b[7m", "\x1b[1m", "\x1b[0m"
+	rows := max(b.height-2, 1)
+	listWidth := min(max(b.width/3, 16), 40, b.width-2)
+	detailWidth := max(b.width-listWidth-1, 0)
+	if b.cursor < b.offset {
+		b.offset = b.cursor
+	}
+	if b.cursor >= b.offset+rows {
+		b.offset = b.cursor - rows + 1
+	}
+	if b.field < b.fieldOffset {
+		b.fieldOffset = b.field
+	}
+	if b.field >= b.fieldOffset+rows {
+		b.fieldOffset = b.field - rows + 1
+	}
+	host := b.hosts[b.selectedHost()]
+	fields := b.fieldNames()
+	keyWidth := 0
+	for _, field := range fields {
+		keyWidth = max(keyWidth, min(utf8.RuneCountInString(field), 24))
+	}
+
+	var s strings.Builder
+	s.WriteString("\x1b[H")
+	title := fmt.Sprintf(" inventory: %d hosts", len(b.hosts))
+	if b.search != "" {
+		title += fmt.Sprintf(", %d matching %q", len(b.visible), b.search)
+	}
+	s.WriteString(reverse + tuiPad(title, b.width) + reset + "\r\n")
+	for row := 0; row < rows; row++ {
+		n := b.offset + row
+		line := ""
+		if n < len(b.visible) {
+			line = " " + b.visible[n]
+		}
+		line = tuiPad(line, listWidth)
+		if n == b.cursor && n < len(b.visible) {
+			if b.fieldsFocused {
+				line = bold + line + reset
+			} else {
+				line = reverse + line + reset
+			}
+		}
+		s.WriteString(line + "│")
+		n = b.fieldOffset + row
+		line = ""
+		if n < len(fields) {
+			line = fmt.Sprintf(" %-*s  %s", keyWidth, fields[n], tuiLine(inventory.FormatValue(host.Data[fields[n]])))
+		}
+		line = tuiPad(line, detailWidth)
+		if n == b.field && b.fieldsFocused && n < len(fields) {
+			line = reverse + line + reset
+		}
+		s.WriteString(line + "\r\n")
+	}
+	switch b.mode {
+	case tuiSearch:
+		s.WriteString(tuiPrompt("/"+b.search, b.width))
+	case tuiAddField:
+		s.WriteString(tuiPrompt("Field to add to "+b.selectedHost()+": "+b.input, b.width))
+	case tuiEditValue:
+		s.WriteString(tuiPrompt(b.editing+" = "+b.input, b.width))
+	case tuiConfirmDelete:
+		s.WriteString(tuiPrompt("Delete host "+b.selectedHost()+"? (y/N) ", b.width))
+	default:
+		status := b.status
+		if status == "" {
+			status = tuiHelp
+		}
+		s.WriteString(tuiPad(status, b.width))
+	}
+	os.Stdout.WriteString(s.String())
+}
+
+// tuiLine makes text fit one line of the screen.
+func tuiLine(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+}
+
+// tuiPad cuts or pads text with spaces to width characters.
+func tuiPad(text string, width int) string {
+	runes := []rune(tuiLine(text))
+	if len(runes) > width {
+		return string(runes[:max(width, 0)])
+	}
+	return string(runes) + strings.Repeat(" ", width-len(runes))
+}
+
+// tuiPrompt is tuiPad for a prompt being typed at, followed by a cursor:
+// what does not fit is cut from the start, so the typing stays in view.
+func tuiPrompt(text string, width int) string {
+	runes := []rune(tuiLine(text))
+	if len(runes) > width-1 {
+		runes = runes[len(runes)-max(width-1, 0):]
+	}
+	return tuiPad(string(runes), width-1) + "\x1b[7m \x1b[0m"
+}
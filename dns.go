@@ -0,0 +1,215 @@
+package inventory
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+// DNSOptions configures DNSEntries and WriteZone.
+type DNSOptions struct {
+	// Origin is the zone the records belong to, e.g. "example.com". Host
+	// names and aliases are qualified with it, and hosts named outside of
+	// it are left out.
+	Origin string
+	// TTL is the zone's default $TTL in seconds; 0 leaves it out.
+	TTL int
+	// AddressField holds a host's IPv4 and IPv6 addresses, one or a list.
+	AddressField string
+	// FQDNField holds a host's fully qualified name, used instead of its
+	// host name.
+	FQDNField string
+	// AliasField lists other names of a host, written as CNAMEs.
+	AliasField string
+}
+
+// DNSEntry is a host's DNS name, fully qualified and without the final
+// dot, with its addresses and aliases.
+type DNSEntry struct {
+	Host      string
+	Name      string
+	Addresses []netip.Addr
+	Aliases   []string
+}
+
+// DNSEntries returns the entries of the hosts that have a usable name and
+// at least one valid address, along with the problems found per host:
+// invalid names and addresses, hosts without an address, and names or
+// addresses more than one host claims. Invalid addresses and conflicting
+// aliases are left out of the entries; duplicate names and addresses are
+// only reported, as round-robin names and shared addresses can be meant.
+func DNSEntries(hosts []Host, opts DNSOptions) ([]DNSEntry, map[string][]error) {
+	origin := strings.ToLower(strings.TrimSuffix(opts.Origin, "."))
+	problems := make(map[string][]error)
+	report := func(host string, err error) {
+		problems[host] = append(problems[host], err)
+	}
+	names := make(map[string]string)
+	addresses := make(map[netip.Addr]string)
+	entries := make([]DNSEntry, 0, len(hosts))
+	for _, host := range hosts {
+		entry := DNSEntry{Host: host.Name, Name: qualifyDNSName(host.Name, origin)}
+		if fqdn := FormatValue(host.Data[opts.FQDNField]); fqdn != "" {
+			entry.Name = strings.ToLower(strings.TrimSuffix(fqdn, "."))
+		}
+		if err := checkDNSName(entry.Name, origin); err != nil {
+			report(host.Name, err)
+			continue
+		}
+		for _, value := range listField(host, opts.AddressField) {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				report(host.Name, fmt.Errorf("%s %q is not an IP address", opts.AddressField, value))
+				continue
+			}
+			addr = addr.Unmap()
+			if owner, ok := addresses[addr]; ok && owner != host.Name {
+				report(host.Name, fmt.Errorf("address %s is also used by %s", addr, owner))
+			} else {
+				addresses[addr] = host.Name
+			}
+			entry.Addresses = append(entry.Addresses, addr)
+		}
+		if len(entry.Addresses) == 0 {
+			if len(problems[host.Name]) == 0 {
+				report(host.Name, fmt.Errorf("no address in %s", opts.AddressField))
+			}
+			continue
+		}
+		if owner, ok := names[entry.Name]; ok {
+			report(host.Name, fmt.Errorf("name %s is also used by %s", entry.Name, owner))
+		} else {
+			names[entry.Name] = host.Name
+		}
+		for _, alias := range listField(host, opts.AliasField) {
+			entry.Aliases = append(entry.Aliases, qualifyDNSName(alias, origin))
+		}
+		entries = append(entries, entry)
+	}
+
+	// A CNAME cannot share its name with any other record, so aliases are
+	// checked once every host's name is known.
+	aliases := make(map[string]string)
+	for n := range entries {
+		entry := &entries[n]
+		kept := entry.Aliases[:0]
+		for _, alias := range entry.Aliases {
+			var err error
+			if err = checkDNSName(alias, origin); err == nil {
+				if owner, ok := names[alias]; ok {
+					err = fmt.Errorf("alias %s is also the name of %s", alias, owner)
+				} else if owner, ok := aliases[alias]; ok && owner != entry.Host {
+					err = fmt.Errorf("alias %s is also an alias of %s", alias, owner)
+				}
+			}
+			if err != nil {
+				report(entry.Host, err)
+				continue
+			}
+			if _, ok := aliases[alias]; !ok {
+				aliases[alias] = entry.Host
+				kept = append(kept, alias)
+			}
+		}
+		entry.Aliases = kept
+	}
+	return entries, problems
+}
+
+// qualifyDNSName lowercases name and appends origin unless name ends with
+// a dot or is already within origin.
+func qualifyDNSName(name, origin string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if strings.HasSuffix(name, ".") {
+		return strings.TrimSuffix(name, ".")
+	}
+	if origin == "" || name == origin || strings.HasSuffix(name, "."+origin) {
+		return name
+	}
+	return name + "." + origin
+}
+
+// checkDNSName checks that a fully qualified name is made of valid labels
+// and, with an origin, lies within it.
+func checkDNSName(name, origin string) error {
+	if len(name) > maxHostNameLength {
+		return fmt.Errorf("name %s is longer than %d bytes", name, maxHostNameLength)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("name %q has a label that is empty or longer than 63 bytes", name)
+		}
+		for _, c := range []byte(label) {
+			if !(c == '-' || c == '_' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+				return fmt.Errorf("name %q contains %q", name, c)
+			}
+		}
+	}
+	if origin != "" && name != origin && !strings.HasSuffix(name, "."+origin) {
+		return fmt.Errorf("name %s is outside of %s", name, origin)
+	}
+	return nil
+}
+
+// WriteZone writes the entries as the A, AAAA and CNAME records of a BIND
+// zone file, after $ORIGIN and $TTL lines when they are set. It writes no
+// SOA or NS records: the result is meant to be $INCLUDEd by a zone that
+// has them.
+func WriteZone(w io.Writer, entries []DNSEntry, opts DNSOptions) error {
+	origin := strings.ToLower(strings.TrimSuffix(opts.Origin, "."))
+	var b bytes.Buffer
+	if origin != "" {
+		fmt.Fprintf(&b, "$ORIGIN %s.\n", origin)
+	}
+	if opts.TTL > 0 {
+		fmt.Fprintf(&b, "$TTL %d\n", opts.TTL)
+	}
+	for _, entry := range entries {
+		owner := zoneOwner(entry.Name, origin)
+		for _, addr := range entry.Addresses {
+			recordType := "A"
+			if addr.Is6() {
+				recordType = "AAAA"
+			}
+			fmt.Fprintf(&b, "%s\tIN\t%s\t%s\n", owner, recordType, addr)
+		}
+		for _, alias := range entry.Aliases {
+			fmt.Fprintf(&b, "%s\tIN\tCNAME\t%s\n", zoneOwner(alias, origin), owner)
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// zoneOwner writes name relative to origin: "@" for the origin itself,
+// and with the final dot when there is no origin.
+func zoneOwner(name, origin string) string {
+	switch {
+	case origin == "":
+		return name + "."
+	case name == origin:
+		return "@"
+	}
+	return strings.TrimSuffix(name, "."+origin)
+}
+
+// WriteHostsFile writes the entries in /etc/hosts format: a line per
+// address, with the entry's name, its first label when that differs, and
+// its aliases.
+func WriteHostsFile(w io.Writer, entries []DNSEntry) error {
+	var b bytes.Buffer
+	for _, entry := range entries {
+		names := []string{entry.Name}
+		if short, _, ok := strings.Cut(entry.Name, "."); ok {
+			names = append(names, short)
+		}
+		names = append(names, entry.Aliases...)
+		for _, addr := range entry.Addresses {
+			fmt.Fprintf(&b, "%s\t%s\n", addr, strings.Join(names, " "))
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
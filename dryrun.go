@@ -0,0 +1,291 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// FieldChange is the value of a field before and after a change.
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// HostDiff is the change a write makes to one host: the fields it adds,
+// changes and removes. Action is "create", "update" or "remove".
+type HostDiff struct {
+	Host    string                 `json:"host"`
+	Action  string                 `json:"action"`
+	Added   map[string]interface{} `json:"added,omitempty"`
+	Changed map[string]FieldChange `json:"changed,omitempty"`
+	Removed map[string]interface{} `json:"removed,omitempty"`
+}
+
+// DiffHost returns the change from before to after, the data of the host
+// name; before is nil for a create and after is nil for a remove.
+func DiffHost(name string, before, after map[string]interface{}) HostDiff {
+	diff := HostDiff{
+		Host:    name,
+		Action:  "update",
+		Added:   make(map[string]interface{}),
+		Changed: make(map[string]FieldChange),
+		Removed: make(map[string]interface{}),
+	}
+	switch {
+	case before == nil:
+		diff.Action = "create"
+	case after == nil:
+		diff.Action = "remove"
+	}
+	for _, field := range ChangedFields(before, after) {
+		old, had := before[field]
+		value, has := after[field]
+		switch {
+		case !had:
+			diff.Added[field] = value
+		case !has:
+			diff.Removed[field] = old
+		default:
+			diff.Changed[field] = FieldChange{Before: old, After: value}
+		}
+	}
+	return diff
+}
+
+// WriteHostDiff writes diff to w: in the json format as one JSON object
+// per line, otherwise as a "+ host (create)", "~ host" or "- host (remove)"
+// line followed by a "+ field: value", "~ field: before -> after" or
+// "- field: value" line per field, colored when output.ColorMode allows.
+func WriteHostDiff(w io.Writer, output OutputOptions, diff HostDiff) error {
+	if output.Format == "json" {
+		data, err := json.Marshal(diff)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+	color := colorEnabled(output.ColorMode, w)
+	var b strings.Builder
+	line := func(text, code string) {
+		b.WriteString(colorize(text, code, color) + "\n")
+	}
+	switch diff.Action {
+	case "create":
+		line("+ "+diff.Host+" (create)", ansiAdded)
+	case "remove":
+		line("- "+diff.Host+" (remove)", ansiRemoved)
+	default:
+		line("~ "+diff.Host, ansiHighlight)
+	}
+	fields := make([]string, 0, len(diff.Added)+len(diff.Changed)+len(diff.Removed))
+	for field := range diff.Added {
+		fields = append(fields, field)
+	}
+	for field := range diff.Changed {
+		fields = append(fields, field)
+	}
+	for field := range diff.Removed {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if value, ok := diff.Added[field]; ok {
+			line("  + "+field+": "+FormatValue(value), ansiAdded)
+		} else if change, ok := diff.Changed[field]; ok {
+			line("  ~ "+field+": "+FormatValue(change.Before)+" -> "+FormatValue(change.After), ansiHighlight)
+		} else {
+			line("  - "+field+": "+FormatValue(diff.Removed[field]), ansiRemoved)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// EnableDryRun makes the Inventory write nothing. Each write is instead
+// checked against etcd with the same conditions, answered as if it had
+// been made, and passed to fn as the HostDiff of every host it would have
+// changed, with secrets masked. Leases are neither granted nor renewed.
+// Later reads do not see the writes, so a command that reads back what it
+// wrote sees the stored hosts. Call it after every other Enable and
+// OnMutation, so none of them see the writes either.
+func (i *Inventory) EnableDryRun(fn func(HostDiff)) {
+	i.kv = dryRunKV{KV: i.kv, report: func(key string, before, after []byte) {
+		if strings.HasPrefix(key, baseKey) {
+			fn(DiffHost(i.hostNameFromKey(key), i.maskedData(auditData(before)), i.maskedData(auditData(after))))
+		}
+	}}
+	i.lease = dryRunLease{Lease: i.lease}
+}
+
+// maskedData returns data with every secret (see IsSecret) masked.
+func (i *Inventory) maskedData(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	masked := make(map[string]interface{}, len(data))
+	for field, value := range data {
+		if i.IsSecret(field, value) {
+			value = redactedPlaceholder
+		}
+		masked[field] = value
+	}
+	return masked
+}
+
+// dryRunKV wraps a KV for EnableDryRun. Reads pass through; writes are
+// made as transactions whose writes are replaced by gets of the keys they
+// would change, and report is called with each key's value before and
+// after (nil for a missing or deleted key).
+type dryRunKV struct {
+	clientv3.KV
+	report func(key string, before, after []byte)
+}
+
+func (kv dryRunKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	resp, err := kv.Txn(ctx).Then(clientv3.OpPut(key, val, opts...)).Commit()
+	if err != nil {
+		return nil, err
+	}
+	put := resp.Responses[0].GetResponsePut()
+	put.Header = resp.Header
+	return (*clientv3.PutResponse)(put), nil
+}
+
+func (kv dryRunKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	resp, err := kv.Txn(ctx).Then(clientv3.OpDelete(key, opts...)).Commit()
+	if err != nil {
+		return nil, err
+	}
+	deleted := resp.Responses[0].GetResponseDeleteRange()
+	deleted.Header = resp.Header
+	return (*clientv3.DeleteResponse)(deleted), nil
+}
+
+func (kv dryRunKV) Txn(ctx context.Context) clientv3.Txn {
+	return &dryRunTxn{ctx: ctx, kv: kv}
+}
+
+// dryRunTxn collects a transaction for dryRunKV.
+type dryRunTxn struct {
+	ctx       context.Context
+	kv        dryRunKV
+	cmps      []clientv3.Cmp
+	then, els []clientv3.Op
+}
+
+func (t *dryRunTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *dryRunTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.then = append(t.then, ops...)
+	return t
+}
+
+func (t *dryRunTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.els = append(t.els, ops...)
+	return t
+}
+
+// Commit runs the transaction with its writes read instead, then fills in
+// the responses the writes would have had.
+func (t *dryRunTxn) Commit() (*clientv3.TxnResponse, error) {
+	then, err := dryRunReads(t.then)
+	if err != nil {
+		return nil, err
+	}
+	els, err := dryRunReads(t.els)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.kv.KV.Txn(t.ctx).If(t.cmps...).Then(then...).Else(els...).Commit()
+	if err != nil {
+		return nil, err
+	}
+	ops := t.then
+	if !resp.Succeeded {
+		ops = t.els
+	}
+	for n, op := range ops {
+		kvs := resp.Responses[n].GetResponseRange().GetKvs()
+		switch {
+		case op.IsPut():
+			var prev *mvccpb.KeyValue
+			var before []byte
+			if len(kvs) > 0 {
+				prev, before = kvs[0], kvs[0].Value
+			}
+			t.kv.report(string(op.KeyBytes()), before, op.ValueBytes())
+			resp.Responses[n] = &pb.ResponseOp{Response: &pb.ResponseOp_ResponsePut{
+				ResponsePut: &pb.PutResponse{Header: resp.Header, PrevKv: prev},
+			}}
+		case op.IsDelete():
+			for _, prev := range kvs {
+				t.kv.report(string(prev.Key), prev.Value, nil)
+			}
+			resp.Responses[n] = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseDeleteRange{
+				ResponseDeleteRange: &pb.DeleteRangeResponse{Header: resp.Header, Deleted: int64(len(kvs)), PrevKvs: kvs},
+			}}
+		}
+	}
+	return resp, nil
+}
+
+// dryRunReads returns ops with every write replaced by a get of the keys
+// it would change.
+func dryRunReads(ops []clientv3.Op) ([]clientv3.Op, error) {
+	reads := make([]clientv3.Op, len(ops))
+	for n, op := range ops {
+		key := string(op.KeyBytes())
+		switch {
+		case op.IsTxn():
+			return nil, errors.New("nested transactions cannot be dry run")
+		case op.IsPut():
+			reads[n] = clientv3.OpGet(key)
+		case op.IsDelete() && len(op.RangeBytes()) > 0:
+			reads[n] = clientv3.OpGet(key, clientv3.WithRange(string(op.RangeBytes())))
+		case op.IsDelete():
+			reads[n] = clientv3.OpGet(key)
+		default:
+			reads[n] = op
+		}
+	}
+	return reads, nil
+}
+
+// dryRunLease grants, renews and revokes nothing for EnableDryRun. Granted
+// leases have no ID, as the writes using them are never made.
+type dryRunLease struct {
+	clientv3.Lease
+}
+
+func (l dryRunLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	return &clientv3.LeaseGrantResponse{ResponseHeader: &pb.ResponseHeader{}, ID: clientv3.NoLease, TTL: ttl}, nil
+}
+
+func (l dryRunLease) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	return &clientv3.LeaseRevokeResponse{Header: &pb.ResponseHeader{}}, nil
+}
+
+func (l dryRunLease) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
+	return &clientv3.LeaseKeepAliveResponse{ResponseHeader: &pb.ResponseHeader{}, ID: id}, nil
+}
+
+// KeepAlive returns a channel that is closed when ctx is done, without
+// ever renewing the lease.
+func (l dryRunLease) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	ch := make(chan *clientv3.LeaseKeepAliveResponse)
+	context.AfterFunc(ctx, func() { close(ch) })
+	return ch, nil
+}
@@ -0,0 +1,294 @@
+package inventory
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// binaryMarker tags a base64-encoded binary value in stored JSON, e.g.
+// {"$binary": "3q2+7w=="}, so []byte and non-UTF-8 strings survive the round
+// trip instead of being mangled by encoding/json.
+const binaryMarker = "$binary"
+
+// Value encodings. JSON values are stored as is, so other tools can keep
+// reading them; the others are tagged with a one-byte prefix that can never
+// start a JSON document. orderedPrefix marks JSON whose data is a list of
+// key/value pairs, written for hosts with a field order. gzipPrefix marks
+// a gzip stream of any of the others; see Inventory.CompressValues.
+const (
+	gobPrefix     byte = 0x01
+	msgpackPrefix byte = 0x02
+	orderedPrefix byte = 0x03
+	gzipPrefix    byte = 0x04
+)
+
+// orderedHost is the stored form of a host with a field order.
+type orderedHost struct {
+	Name string         `json:"name"`
+	Data []orderedField `json:"data"`
+}
+
+type orderedField struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+func ValidateEncoding(encoding string) error {
+	switch encoding {
+	case "json", "gob", "msgpack":
+		return nil
+	default:
+		return fmt.Errorf("invalid encoding %q (use json, gob or msgpack)", encoding)
+	}
+}
+
+// marshalHost encodes host for storage, sealing its secret fields, in the
+// ValueEncoding and, with CompressValues, compressed.
+func (i *Inventory) marshalHost(host Host) ([]byte, error) {
+	host, err := i.sealSecrets(host)
+	if err != nil {
+		return nil, err
+	}
+	value, err := i.encodeHostValue(host)
+	if err != nil || !i.CompressValues {
+		return value, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(gzipPrefix)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(value); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(value) {
+		return value, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeHostValue encodes host in the stored format chosen by PreserveOrder
+// and ValueEncoding.
+func (i *Inventory) encodeHostValue(host Host) ([]byte, error) {
+	if i.PreserveOrder || host.Order != nil {
+		data := EncodeBinaryValues(host.Data)
+		stored := orderedHost{Name: host.Name, Data: make([]orderedField, 0, len(data))}
+		for _, key := range host.fieldOrder() {
+			stored.Data = append(stored.Data, orderedField{Key: key, Value: data[key]})
+		}
+		b, err := json.Marshal(stored)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{orderedPrefix}, b...), nil
+	}
+	switch i.ValueEncoding {
+	case "gob":
+		var buf bytes.Buffer
+		buf.WriteByte(gobPrefix)
+		if host.Data != nil {
+			host.Data = toGob(host.Data).(map[string]interface{})
+		}
+		if err := gob.NewEncoder(&buf).Encode(host); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "msgpack":
+		// Loose decoding reads msgpack bin as a string, so binary values
+		// are tagged as in JSON.
+		host.Data = EncodeBinaryValues(host.Data)
+		b, err := msgpack.Marshal(host)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{msgpackPrefix}, b...), nil
+	default:
+		host.Data = EncodeBinaryValues(host.Data)
+		return json.Marshal(host)
+	}
+}
+
+// unmarshalHost decodes a stored host, decrypting its secret fields with
+// Secrets.
+func (i *Inventory) unmarshalHost(value []byte) (Host, error) {
+	host, err := decodeStoredHost(value)
+	if err != nil {
+		return Host{}, err
+	}
+	i.openSecrets(host)
+	return host, nil
+}
+
+// decodeStoredHost decodes a stored host in any of the value encodings,
+// leaving its secret fields sealed.
+func decodeStoredHost(value []byte) (Host, error) {
+	if len(value) > 0 && value[0] == gzipPrefix {
+		zr, err := gzip.NewReader(bytes.NewReader(value[1:]))
+		if err != nil {
+			return Host{}, err
+		}
+		if value, err = io.ReadAll(zr); err != nil {
+			return Host{}, err
+		}
+	}
+	host := Host{}
+	if len(value) > 0 {
+		switch value[0] {
+		case gobPrefix:
+			if err := gob.NewDecoder(bytes.NewReader(value[1:])).Decode(&host); err != nil {
+				return Host{}, err
+			}
+			if host.Data != nil {
+				host.Data = fromGob(host.Data).(map[string]interface{})
+			}
+			return host, nil
+		case msgpackPrefix:
+			dec := msgpack.NewDecoder(bytes.NewReader(value[1:]))
+			dec.UseLooseInterfaceDecoding(true)
+			if err := dec.Decode(&host); err != nil {
+				return Host{}, err
+			}
+			host.Data = DecodeBinaryValues(host.Data)
+			return host, nil
+		case orderedPrefix:
+			var stored orderedHost
+			if err := json.Unmarshal(value[1:], &stored); err != nil {
+				return Host{}, err
+			}
+			host.Name = stored.Name
+			host.Data = make(map[string]interface{}, len(stored.Data))
+			host.Order = make([]string, 0, len(stored.Data))
+			for _, field := range stored.Data {
+				host.Data[field.Key] = field.Value
+				host.Order = append(host.Order, field.Key)
+			}
+			host.Data = DecodeBinaryValues(host.Data)
+			return host, nil
+		}
+	}
+	if err := json.Unmarshal(value, &host); err != nil {
+		return Host{}, err
+	}
+	host.Data = DecodeBinaryValues(host.Data)
+	return host, nil
+}
+
+// gobNull stands in for nil values, which gob cannot encode inside an
+// interface.
+type gobNull struct{}
+
+func init() {
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(gobNull{})
+}
+
+// toGob returns a copy of value with nils replaced by gobNull.
+func toGob(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return gobNull{}
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			out[key] = toGob(elem)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = toGob(elem)
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+// fromGob reverses toGob in place.
+func fromGob(value interface{}) interface{} {
+	switch v := value.(type) {
+	case gobNull:
+		return nil
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = fromGob(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = fromGob(elem)
+		}
+	}
+	return value
+}
+
+func EncodeBinaryValues(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	encoded := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		encoded[key] = encodeBinaryValue(value)
+	}
+	return encoded
+}
+
+func encodeBinaryValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return map[string]interface{}{binaryMarker: base64.StdEncoding.EncodeToString(v)}
+	case string:
+		if !utf8.ValidString(v) {
+			return encodeBinaryValue([]byte(v))
+		}
+		return v
+	case map[string]interface{}:
+		return EncodeBinaryValues(v)
+	case []interface{}:
+		encoded := make([]interface{}, len(v))
+		for i, elem := range v {
+			encoded[i] = encodeBinaryValue(elem)
+		}
+		return encoded
+	default:
+		return v
+	}
+}
+
+func DecodeBinaryValues(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	for key, value := range data {
+		data[key] = decodeBinaryValue(value)
+	}
+	return data
+}
+
+func decodeBinaryValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if encoded, ok := v[binaryMarker].(string); ok && len(v) == 1 {
+			if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+				return decoded
+			}
+		}
+		return DecodeBinaryValues(v)
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = decodeBinaryValue(elem)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,44 @@
+package inventory_test
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/etcdtest"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func ExampleNewInventory() {
+	server, err := etcdtest.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer server.Close()
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{server.Endpoint()}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	inv := inventory.NewInventory(client)
+	if err := inv.CreateHost("web01", map[string]interface{}{"site": "ams"}); err != nil {
+		log.Fatal(err)
+	}
+	if err := inv.CreateHost("db01", map[string]interface{}{"site": "fra"}); err != nil {
+		log.Fatal(err)
+	}
+	filter, err := inventory.ParseHostFilter("site=ams")
+	if err != nil {
+		log.Fatal(err)
+	}
+	result, err := inv.ListHostsWithOptions(inventory.ListOptions{Filter: filter})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, host := range result.Hosts {
+		fmt.Println(host.Name, host.Data["site"])
+	}
+	// Output: web01 ams
+}
@@ -0,0 +1,249 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
+)
+
+// NewExplainInventory returns an Inventory that never contacts etcd:
+// every request is printed to w as a numbered plan step instead (see
+// --explain). Reads find nothing, except a get of a single key, which finds
+// an empty host at revision 0 so read-modify-write commands go on to show
+// their writes.
+func NewExplainInventory(w io.Writer, prefix string) *Inventory {
+	plan := &explainPlan{w: w}
+	i := &Inventory{
+		kv:        explainKV{plan: plan},
+		watcher:   explainWatcher{plan: plan},
+		lease:     explainLease{plan: plan},
+		namespace: prefix,
+		Timeout:   DefaultRequestTimeout,
+	}
+	if prefix != "" {
+		i.kv = namespace.NewKV(i.kv, prefix)
+		i.watcher = namespace.NewWatcher(i.watcher, prefix)
+		i.lease = namespace.NewLease(i.lease, prefix)
+	}
+	return i
+}
+
+// explainPlan numbers and prints the steps of an explained command.
+type explainPlan struct {
+	mu    sync.Mutex
+	w     io.Writer
+	steps int
+}
+
+func (p *explainPlan) step(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.steps++
+	fmt.Fprintf(p.w, "%d. %s\n", p.steps, fmt.Sprintf(format, args...))
+}
+
+// explainHeader is the zero response header of explained requests.
+func explainHeader() *pb.ResponseHeader { return &pb.ResponseHeader{} }
+
+type explainKV struct {
+	clientv3.KV
+	plan *explainPlan
+}
+
+func (kv explainKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	op := clientv3.OpGet(key, opts...)
+	kv.plan.step("%s", describeOp(op))
+	return explainGetResponse(op), nil
+}
+
+// explainGetResponse is the response to an explained get: an empty host
+// named after the key for a single key, nothing for a range.
+func explainGetResponse(op clientv3.Op) *clientv3.GetResponse {
+	resp := &clientv3.GetResponse{Header: explainHeader()}
+	if len(op.RangeBytes()) == 0 {
+		resp.Count = 1
+		if !op.IsCountOnly() {
+			var name string
+			if _, escaped, ok := strings.Cut(string(op.KeyBytes()), baseKey); ok {
+				name = escaped
+				if unescaped, err := url.PathUnescape(escaped); err == nil {
+					name = unescaped
+				}
+			}
+			value, _ := json.Marshal(Host{Name: name, Data: map[string]interface{}{}})
+			resp.Kvs = []*mvccpb.KeyValue{{Key: op.KeyBytes(), Value: value}}
+		}
+	}
+	return resp
+}
+
+func (kv explainKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	kv.plan.step("%s", describeOp(clientv3.OpPut(key, val, opts...)))
+	return &clientv3.PutResponse{Header: explainHeader()}, nil
+}
+
+func (kv explainKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	kv.plan.step("%s", describeOp(clientv3.OpDelete(key, opts...)))
+	return &clientv3.DeleteResponse{Header: explainHeader()}, nil
+}
+
+func (kv explainKV) Txn(ctx context.Context) clientv3.Txn {
+	return &explainTxn{plan: kv.plan}
+}
+
+// Do serves the requests of the namespace wrapper of --prefix, which sends
+// all but transactions through Do.
+func (kv explainKV) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	kv.plan.step("%s", describeOp(op))
+	switch {
+	case op.IsGet():
+		return explainGetResponse(op).OpResponse(), nil
+	case op.IsPut():
+		return (&clientv3.PutResponse{Header: explainHeader()}).OpResponse(), nil
+	case op.IsDelete():
+		return (&clientv3.DeleteResponse{Header: explainHeader()}).OpResponse(), nil
+	default:
+		return (&clientv3.TxnResponse{Header: explainHeader(), Succeeded: true}).OpResponse(), nil
+	}
+}
+
+// explainTxn prints the transaction on Commit and reports it as succeeded.
+type explainTxn struct {
+	plan             *explainPlan
+	cmps             []clientv3.Cmp
+	thenOps, elseOps []clientv3.Op
+}
+
+func (t *explainTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *explainTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.thenOps = append(t.thenOps, ops...)
+	return t
+}
+
+func (t *explainTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.elseOps = append(t.elseOps, ops...)
+	return t
+}
+
+func (t *explainTxn) Commit() (*clientv3.TxnResponse, error) {
+	t.plan.step("%s", describeOp(clientv3.OpTxn(t.cmps, t.thenOps, t.elseOps)))
+	return &clientv3.TxnResponse{Header: explainHeader(), Succeeded: true}, nil
+}
+
+type explainWatcher struct {
+	clientv3.Watcher
+	plan *explainPlan
+}
+
+// Watch prints the watch and returns a channel that is closed when ctx is
+// done, as no events will ever arrive.
+func (w explainWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	w.plan.step("WATCH %s", describeRange(clientv3.OpGet(key, opts...)))
+	ch := make(chan clientv3.WatchResponse)
+	context.AfterFunc(ctx, func() { close(ch) })
+	return ch
+}
+
+type explainLease struct {
+	clientv3.Lease
+	plan *explainPlan
+}
+
+func (l explainLease) TimeToLive(ctx context.Context, id clientv3.LeaseID, opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error) {
+	l.plan.step("LEASE TIMETOLIVE %x", int64(id))
+	return &clientv3.LeaseTimeToLiveResponse{ResponseHeader: explainHeader(), ID: id, TTL: -1}, nil
+}
+
+func (l explainLease) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
+	l.plan.step("LEASE KEEPALIVE %x", int64(id))
+	return &clientv3.LeaseKeepAliveResponse{ResponseHeader: explainHeader(), ID: id}, nil
+}
+
+// describeOp renders an etcd operation for --explain, e.g.
+// "GET /hosts/ (prefix) keys-only" or "PUT /hosts/web01 = {...}".
+func describeOp(op clientv3.Op) string {
+	switch {
+	case op.IsTxn():
+		cmps, thenOps, elseOps := op.Txn()
+		var b strings.Builder
+		b.WriteString("TXN")
+		for _, cmp := range cmps {
+			b.WriteString("\n     IF   " + describeCmp(cmp))
+		}
+		for _, thenOp := range thenOps {
+			b.WriteString("\n     THEN " + describeOp(thenOp))
+		}
+		for _, elseOp := range elseOps {
+			b.WriteString("\n     ELSE " + describeOp(elseOp))
+		}
+		return b.String()
+	case op.IsPut():
+		return fmt.Sprintf("PUT %s = %s", op.KeyBytes(), truncateValue(strconv.Quote(string(op.ValueBytes())), 200))
+	case op.IsDelete():
+		return "DELETE " + describeRange(op)
+	default:
+		desc := "GET " + describeRange(op)
+		if op.IsKeysOnly() {
+			desc += " keys-only"
+		}
+		if op.IsCountOnly() {
+			desc += " count-only"
+		}
+		if op.Rev() > 0 {
+			desc += fmt.Sprintf(" at-revision=%d", op.Rev())
+		}
+		if op.MinModRev() > 0 {
+			desc += fmt.Sprintf(" min-mod-revision=%d", op.MinModRev())
+		}
+		return desc
+	}
+}
+
+// describeRange renders the key or key range of op.
+func describeRange(op clientv3.Op) string {
+	key, end := string(op.KeyBytes()), string(op.RangeBytes())
+	switch end {
+	case "":
+		return key
+	case clientv3.GetPrefixRangeEnd(key):
+		return key + " (prefix)"
+	default:
+		return fmt.Sprintf("[%s, %s)", key, end)
+	}
+}
+
+// describeCmp renders a transaction guard, e.g. "mod(/hosts/web01) = 42".
+func describeCmp(cmp clientv3.Cmp) string {
+	compare := pb.Compare(cmp)
+	var value interface{}
+	switch compare.Target {
+	case pb.Compare_VERSION:
+		value = compare.GetVersion()
+	case pb.Compare_CREATE:
+		value = compare.GetCreateRevision()
+	case pb.Compare_MOD:
+		value = compare.GetModRevision()
+	case pb.Compare_LEASE:
+		value = compare.GetLease()
+	default:
+		value = strconv.Quote(string(compare.GetValue()))
+	}
+	result := map[pb.Compare_CompareResult]string{
+		pb.Compare_EQUAL: "=", pb.Compare_NOT_EQUAL: "!=", pb.Compare_GREATER: ">", pb.Compare_LESS: "<",
+	}[compare.Result]
+	return fmt.Sprintf("%s(%s) %s %v", strings.ToLower(compare.Target.String()), compare.Key, result, value)
+}
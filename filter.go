@@ -0,0 +1,128 @@
+package inventory
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// HostFilter selects hosts for --filter. It is a comma-separated list of
+// conditions that must all hold, each "field=value", "field!=value" or
+// "field in CIDR" (e.g. "ipaddr in 10.0.0.0/8", true when the field holds an
+// IP address inside the subnet). The field may be a nested path as accepted
+// by get-field, or "name" for the host name. A condition on an array field
+// holds if any element matches.
+type HostFilter []filterCondition
+
+type filterCondition struct {
+	field  string
+	path   []fieldPathSegment
+	op     string
+	value  string
+	subnet *net.IPNet
+}
+
+// filterOps lists the supported operators. The one occurring first in a
+// condition wins, so "!=" is not mistaken for "=".
+var filterOps = []string{"!=", "=", " in "}
+
+// ParseHostFilter parses a --filter expression. An empty expression matches
+// every host.
+func ParseHostFilter(expr string) (HostFilter, error) {
+	var filter HostFilter
+	for _, term := range SplitList(expr) {
+		var cond filterCondition
+		at := -1
+		for _, op := range filterOps {
+			if idx := strings.Index(term, op); idx >= 0 && (at < 0 || idx < at) {
+				at = idx
+				cond = filterCondition{
+					field: strings.TrimSpace(term[:idx]),
+					op:    strings.TrimSpace(op),
+					value: strings.TrimSpace(term[idx+len(op):]),
+				}
+			}
+		}
+		if cond.op == "" || cond.field == "" {
+			return nil, fmt.Errorf("invalid filter condition %q: expected field=value, field!=value or field in CIDR", term)
+		}
+		if cond.op == "in" {
+			_, subnet, err := net.ParseCIDR(cond.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter condition %q: %w", term, err)
+			}
+			cond.subnet = subnet
+		}
+		path, err := parseFieldPath(cond.field)
+		if err != nil {
+			return nil, err
+		}
+		cond.path = path
+		filter = append(filter, cond)
+	}
+	return filter, nil
+}
+
+// Match reports whether host satisfies every condition.
+func (f HostFilter) Match(host Host) bool {
+	for _, cond := range f {
+		if !cond.match(host) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c filterCondition) match(host Host) bool {
+	found := false
+	for _, value := range c.values(host) {
+		if c.subnet != nil {
+			if s, ok := value.(string); ok && subnetContains(c.subnet, s) {
+				found = true
+				break
+			}
+			continue
+		}
+		if FormatValue(value) == c.value {
+			found = true
+			break
+		}
+	}
+	if c.op == "!=" {
+		return !found
+	}
+	return found
+}
+
+// subnetContains reports whether s is an IP address inside subnet. An
+// address written with a prefix length, as in "10.1.2.3/24", counts by its
+// address.
+func subnetContains(subnet *net.IPNet, s string) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(s); err != nil {
+			return false
+		}
+	}
+	return subnet.Contains(ip)
+}
+
+// values returns the host's values for the condition's field, with arrays
+// expanded into their elements.
+func (c filterCondition) values(host Host) []interface{} {
+	value, ok := host.Data[c.field]
+	if !ok {
+		value, ok = lookupFieldPath(host.Data, c.path)
+	}
+	if !ok {
+		if c.field == "name" {
+			return []interface{}{host.Name}
+		}
+		return nil
+	}
+	if elems, isArray := value.([]interface{}); isArray {
+		return elems
+	}
+	return []interface{}{value}
+}
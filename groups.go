@@ -0,0 +1,214 @@
+package inventory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+// groupsKey is the prefix groups are stored under, beside baseKey.
+const groupsKey = "/groups/"
+
+// Group is a named set of hosts sharing variables, stored apart from the
+// hosts as JSON under groupsKey. Members are host names and need not
+// exist.
+type Group struct {
+	Name  string                 `json:"name"`
+	Hosts []string               `json:"hosts"`
+	Vars  map[string]interface{} `json:"vars,omitempty"`
+}
+
+var (
+	// ErrGroupExists is returned when creating a group that already exists.
+	ErrGroupExists = errors.New("group already exists")
+	// ErrGroupNotFound is returned when an operation targets a missing group.
+	ErrGroupNotFound = errors.New("group not found")
+)
+
+// groupKey returns the etcd key of a group, its name encoded like a host
+// name in hostKey.
+func (i *Inventory) groupKey(name string) string {
+	return groupsKey + url.PathEscape(name)
+}
+
+// CreateGroup stores a new group without members.
+func (i *Inventory) CreateGroup(name string, vars map[string]interface{}) error {
+	if name == "" {
+		return errors.New("group name must not be empty")
+	}
+	value, err := json.Marshal(Group{Name: name, Hosts: []string{}, Vars: vars})
+	if err != nil {
+		return err
+	}
+	key := i.groupKey(name)
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	txn, err := i.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txn.Succeeded {
+		return fmt.Errorf("%w: %s", ErrGroupExists, name)
+	}
+	return nil
+}
+
+// GetGroup returns the named group.
+func (i *Inventory) GetGroup(name string) (Group, error) {
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Get(ctx, i.groupKey(name), i.readOpts()...)
+	if err != nil {
+		return Group{}, err
+	}
+	if len(resp.Kvs) == 0 {
+		return Group{}, fmt.Errorf("%w: %s", ErrGroupNotFound, name)
+	}
+	var group Group
+	if err := json.Unmarshal(resp.Kvs[0].Value, &group); err != nil {
+		return Group{}, fmt.Errorf("group %s: %w", name, err)
+	}
+	return group, nil
+}
+
+// ListGroups returns every group, sorted by name.
+func (i *Inventory) ListGroups() ([]Group, error) {
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Get(ctx, groupsKey, i.readOpts(clientv3.WithPrefix())...)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]Group, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var group Group
+		if err := json.Unmarshal(kv.Value, &group); err != nil {
+			return nil, fmt.Errorf("group at %s: %w", kv.Key, err)
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(a, b int) bool { return groups[a].Name < groups[b].Name })
+	return groups, nil
+}
+
+// AddGroupHosts makes hosts members of the group, keeping its members
+// sorted. Hosts that already are members are left as they are.
+func (i *Inventory) AddGroupHosts(name string, hosts ...string) error {
+	return i.modifyGroup(name, func(group *Group) {
+		members := make(map[string]bool, len(group.Hosts))
+		for _, host := range group.Hosts {
+			members[host] = true
+		}
+		for _, host := range hosts {
+			if !members[host] {
+				members[host] = true
+				group.Hosts = append(group.Hosts, host)
+			}
+		}
+		sort.Strings(group.Hosts)
+	})
+}
+
+// RemoveGroupHosts removes hosts from the group's members; hosts that are
+// not members are ignored.
+func (i *Inventory) RemoveGroupHosts(name string, hosts ...string) error {
+	remove := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		remove[host] = true
+	}
+	return i.modifyGroup(name, func(group *Group) {
+		kept := []string{}
+		for _, host := range group.Hosts {
+			if !remove[host] {
+				kept = append(kept, host)
+			}
+		}
+		group.Hosts = kept
+	})
+}
+
+// modifyGroup is modifyHost for a group: a read-modify-write retried while
+// concurrent writers change the group in between.
+func (i *Inventory) modifyGroup(name string, modify func(group *Group)) error {
+	key := i.groupKey(name)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := i.requestContext()
+		resp, err := i.kv.Get(ctx, key)
+		if err != nil {
+			cancel()
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			cancel()
+			return fmt.Errorf("%w: %s", ErrGroupNotFound, name)
+		}
+		var group Group
+		if err := json.Unmarshal(resp.Kvs[0].Value, &group); err != nil {
+			cancel()
+			return fmt.Errorf("group %s: %w", name, err)
+		}
+		modify(&group)
+		value, err := json.Marshal(group)
+		if err != nil {
+			cancel()
+			return err
+		}
+		txn, err := i.kv.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(key, string(value))).
+			Commit()
+		cancel()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			return nil
+		}
+		if attempt == maxModifyAttempts {
+			return fmt.Errorf("group %s kept changing concurrently; gave up after %d attempts", name, attempt)
+		}
+	}
+}
+
+// ApplyGroupVars returns hosts with the variables of the groups each is a
+// member of merged into a copy of its data. A host's own fields take
+// precedence over group variables, and between groups the variable of the
+// group first by name wins.
+func ApplyGroupVars(hosts []Host, groups []Group) []Host {
+	sorted := make([]Group, len(groups))
+	copy(sorted, groups)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].Name < sorted[b].Name })
+	memberOf := make(map[string][]Group)
+	for _, group := range sorted {
+		for _, host := range group.Hosts {
+			memberOf[host] = append(memberOf[host], group)
+		}
+	}
+	merged := make([]Host, len(hosts))
+	for n, host := range hosts {
+		merged[n] = host
+		if len(memberOf[host.Name]) == 0 {
+			continue
+		}
+		data := make(map[string]interface{}, len(host.Data))
+		for key, value := range host.Data {
+			data[key] = value
+		}
+		for _, group := range memberOf[host.Name] {
+			for key, value := range group.Vars {
+				if _, ok := data[key]; !ok {
+					data[key] = value
+				}
+			}
+		}
+		merged[n].Data = data
+	}
+	return merged
+}
@@ -0,0 +1,314 @@
+// Package grpcserver serves an inventory over gRPC as the Inventory
+// service of inventorypb, as "inventory serve --grpc" does, for programs
+// that embed the inventory and want to offer the same API.
+package grpcserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/inventorypb"
+	"github.com/oferchen/inventory/query"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements inventorypb.InventoryServer on an inventory.
+type Server struct {
+	inventorypb.UnimplementedInventoryServer
+	inv *inventory.Inventory
+	// Writable allows CreateHost and UpdateField; without it they fail
+	// with PERMISSION_DENIED.
+	Writable bool
+	// PageSize is the number of keys ListHosts reads from etcd at a time;
+	// 0 means inventory.DefaultPageSize.
+	PageSize int64
+	// RevealSecrets sends secret fields as they are read instead of
+	// masked; see inventory.Inventory.MaskSecrets.
+	RevealSecrets bool
+}
+
+// New returns a read-only server of inv.
+func New(inv *inventory.Inventory) *Server {
+	return &Server{inv: inv}
+}
+
+// Register registers s on a gRPC server.
+func (s *Server) Register(server grpc.ServiceRegistrar) {
+	inventorypb.RegisterInventoryServer(server, s)
+}
+
+func (s *Server) CreateHost(ctx context.Context, req *inventorypb.CreateHostRequest) (*inventorypb.Host, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	host := req.GetHost().ToHost()
+	if host.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "host name is required")
+	}
+	if err := checkRole(ctx, host.Name, inventory.RoleEditor); err != nil {
+		return nil, err
+	}
+	if err := s.inv.Create(host); err != nil {
+		return nil, statusError(err)
+	}
+	return s.getHost(ctx, host.Name)
+}
+
+func (s *Server) GetHost(ctx context.Context, req *inventorypb.GetHostRequest) (*inventorypb.Host, error) {
+	if err := checkRole(ctx, req.GetName(), inventory.RoleViewer); err != nil {
+		return nil, err
+	}
+	return s.getHost(ctx, req.GetName())
+}
+
+func (s *Server) UpdateField(ctx context.Context, req *inventorypb.UpdateFieldRequest) (*inventorypb.Host, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if req.GetName() == "" || req.GetField() == "" {
+		return nil, status.Error(codes.InvalidArgument, "host name and field are required")
+	}
+	if err := checkRole(ctx, req.GetName(), inventory.RoleEditor); err != nil {
+		return nil, err
+	}
+	if err := s.inv.UpdateHostFieldValueIfRevision(req.GetName(), req.GetField(), req.GetValue().AsInterface(), req.GetIfRevision()); err != nil {
+		return nil, statusError(err)
+	}
+	return s.getHost(ctx, req.GetName())
+}
+
+func (s *Server) ListHosts(req *inventorypb.ListHostsRequest, stream inventorypb.Inventory_ListHostsServer) error {
+	if req.GetOffset() < 0 || req.GetLimit() < 0 {
+		return status.Error(codes.InvalidArgument, "offset and limit must not be negative")
+	}
+	filter, err := inventory.ParseHostFilter(req.GetFilter())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid filter: %v", err)
+	}
+	opts := inventory.ListOptions{NamePrefix: req.GetNamePrefix(), Filter: filter, Offset: req.GetOffset(), Limit: req.GetLimit()}
+	if req.GetWhere() != "" {
+		if opts.Where, err = query.Parse(req.GetWhere()); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid where: %v", err)
+		}
+	}
+	for _, name := range req.GetStatuses() {
+		hostStatus, err := inventory.ParseHostStatus(name)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		opts.Statuses = append(opts.Statuses, hostStatus)
+	}
+	access := AccessFromContext(stream.Context())
+	if !access.AllowsAny(inventory.RoleViewer) {
+		return status.Error(codes.PermissionDenied, "no role in this inventory")
+	}
+	_, err = s.inv.StreamHosts(opts, s.PageSize, func(hosts []inventory.Host) error {
+		for _, host := range hosts {
+			if !access.Allows(host.Name, inventory.RoleViewer) {
+				continue
+			}
+			msg, err := s.message(access, host)
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+		return stream.Context().Err()
+	})
+	return statusError(err)
+}
+
+func (s *Server) WatchHosts(req *inventorypb.WatchHostsRequest, stream inventorypb.Inventory_WatchHostsServer) error {
+	ctx := stream.Context()
+	access := AccessFromContext(ctx)
+	if !access.AllowsAny(inventory.RoleViewer) {
+		return status.Error(codes.PermissionDenied, "no role in this inventory")
+	}
+	err := s.inv.WatchHosts(ctx, req.GetStartRevision(), func(event inventory.HostEvent) error {
+		if !access.Allows(event.Name, inventory.RoleViewer) {
+			return nil
+		}
+		msg := &inventorypb.HostEvent{Type: inventorypb.HostEvent_PUT, Name: event.Name, Revision: event.Revision, Resync: event.Resync}
+		if event.Type == mvccpb.DELETE {
+			msg.Type = inventorypb.HostEvent_DELETE
+		} else {
+			host, err := s.message(access, event.Host)
+			if err != nil {
+				return err
+			}
+			msg.Host = host
+		}
+		return stream.Send(msg)
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return statusError(err)
+}
+
+func (s *Server) getHost(ctx context.Context, name string) (*inventorypb.Host, error) {
+	host, err := s.inv.GetHost(name)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return s.message(AccessFromContext(ctx), host)
+}
+
+// message converts host for sending, with its secrets masked unless
+// RevealSecrets is set and the caller is an admin of host.
+func (s *Server) message(access *inventory.Access, host inventory.Host) (*inventorypb.Host, error) {
+	if !s.RevealSecrets || !access.Allows(host.Name, inventory.RoleAdmin) {
+		masked, _ := s.inv.MaskSecrets([]inventory.Host{host})
+		host = masked[0]
+	}
+	msg, err := inventorypb.FromHost(host)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return msg, nil
+}
+
+func (s *Server) checkWritable() error {
+	if !s.Writable {
+		return status.Error(codes.PermissionDenied, "writes are not allowed (serve --allow-writes)")
+	}
+	return nil
+}
+
+// statusError maps the errors of the inventory to gRPC status codes, as
+// the HTTP API maps them to status codes. Errors that already are a
+// status, such as those of a stream, are returned as they are.
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, inventory.ErrHostNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, inventory.ErrHostExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, inventory.ErrHostChanged):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, inventory.ErrFieldImmutable), errors.Is(err, inventory.ErrSchemaViolation), errors.Is(err, inventory.ErrInvalidStatus):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, inventory.ErrStatusTransition):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// TokenAuth returns server options that refuse calls without the
+// metadata "authorization: Bearer <token>" with UNAUTHENTICATED,
+// comparing tokens in constant time.
+func TokenAuth(token string) []grpc.ServerOption {
+	check := func(ctx context.Context) error {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get("authorization") {
+			got, ok := strings.CutPrefix(value, "Bearer ")
+			if ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(token)) == 1 {
+				return nil
+			}
+		}
+		return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := check(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := check(stream.Context()); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	}
+}
+
+// Authenticator returns what the caller with a bearer token may do, or an
+// error if the token is not valid.
+type Authenticator func(ctx context.Context, token string) (*inventory.Access, error)
+
+type accessKey struct{}
+
+// AccessFromContext returns the access Authorize found for the call, or
+// nil, which may do everything, without Authorize.
+func AccessFromContext(ctx context.Context) *inventory.Access {
+	access, _ := ctx.Value(accessKey{}).(*inventory.Access)
+	return access
+}
+
+// checkRole fails with PERMISSION_DENIED unless the caller holds role on
+// the host name.
+func checkRole(ctx context.Context, name string, role inventory.Role) error {
+	if !AccessFromContext(ctx).Allows(name, role) {
+		return status.Errorf(codes.PermissionDenied, "%s role required on host '%s'", role, name)
+	}
+	return nil
+}
+
+// Authorize returns server options that authenticate every call by the
+// metadata "authorization: Bearer <token>", refusing it with
+// UNAUTHENTICATED if authenticate fails. The server then checks the
+// roles of the returned access on each host it reads or writes: calls
+// fail with PERMISSION_DENIED, and lists and watches skip the hosts the
+// caller may not view.
+func Authorize(authenticate Authenticator) []grpc.ServerOption {
+	check := func(ctx context.Context) (context.Context, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get("authorization") {
+			token, ok := strings.CutPrefix(value, "Bearer ")
+			if !ok {
+				continue
+			}
+			access, err := authenticate(ctx, strings.TrimSpace(token))
+			if err != nil {
+				return nil, status.Error(codes.Unauthenticated, err.Error())
+			}
+			return context.WithValue(ctx, accessKey{}, access), nil
+		}
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := check(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := check(stream.Context())
+			if err != nil {
+				return err
+			}
+			return handler(srv, authorizedStream{stream, ctx})
+		}),
+	}
+}
+
+// authorizedStream is a stream with the context Authorize made for it.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authorizedStream) Context() context.Context { return s.ctx }
@@ -0,0 +1,467 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/etcdtest"
+	"github.com/oferchen/inventory/inventorypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// newTestInventory returns an Inventory over a fresh in-memory etcd with
+// the hosts, whose password fields are secret.
+func newTestInventory(t *testing.T, hosts map[string]map[string]interface{}) *inventory.Inventory {
+	t.Helper()
+	_, client := etcdtest.Start(t)
+	inv := inventory.NewInventory(client)
+	cipher, err := inventory.NewFieldCipher(make([]byte, inventory.SecretKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.SecretFields = map[string]bool{"password": true}
+	inv.Secrets = cipher
+	for name, data := range hosts {
+		if err := inv.CreateHost(name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return inv
+}
+
+// dial serves s with opts on an in-memory listener and returns a client of
+// it.
+func dial(t *testing.T, s *Server, opts ...grpc.ServerOption) inventorypb.InventoryClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(opts...)
+	s.Register(server)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return inventorypb.NewInventoryClient(conn)
+}
+
+// withToken returns a context whose calls carry token as their bearer
+// token, or none for "".
+func withToken(token string) context.Context {
+	if token == "" {
+		return context.Background()
+	}
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+// listNames returns the names and passwords ListHosts streams, or the
+// error that ends the stream.
+func listNames(client inventorypb.InventoryClient, ctx context.Context, req *inventorypb.ListHostsRequest) (map[string]interface{}, error) {
+	stream, err := client.ListHosts(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string]interface{})
+	for {
+		host, err := stream.Recv()
+		if err == io.EOF {
+			return hosts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hosts[host.GetName()] = host.GetData().AsMap()["password"]
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	inv := newTestInventory(t, map[string]map[string]interface{}{
+		"web01": {"site": "ams", "password": "s3cret"},
+		"web02": {"site": "fra", "password": "s3cret"},
+		"db07":  {"site": "ams", "password": "s3cret"},
+	})
+	grants := func(texts ...string) []inventory.Grant {
+		var grants []inventory.Grant
+		for _, text := range texts {
+			grant, err := inventory.ParseGrant(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			grants = append(grants, grant)
+		}
+		return grants
+	}
+	tokens := map[string][]inventory.Grant{
+		"viewer": grants("viewer::web*"),
+		"editor": grants("editor::web*"),
+		"admin":  grants("admin::web*", "viewer"),
+		"stage":  grants("admin:stage"),
+	}
+	authenticate := func(ctx context.Context, token string) (*inventory.Access, error) {
+		grants, ok := tokens[token]
+		if !ok {
+			return nil, inventory.ErrInvalidToken
+		}
+		return &inventory.Access{Name: token, Grants: grants, Prefix: inv.KeyPrefix()}, nil
+	}
+	s := New(inv)
+	s.Writable, s.RevealSecrets = true, true
+	client := dial(t, s, Authorize(authenticate)...)
+	site := func(value string) *structpb.Value { return structpb.NewStringValue(value) }
+	newHost := func(name string) *inventorypb.CreateHostRequest {
+		return &inventorypb.CreateHostRequest{Host: &inventorypb.Host{Name: name, Data: &structpb.Struct{Fields: map[string]*structpb.Value{"site": site("lon")}}}}
+	}
+
+	for _, tc := range []struct {
+		name, token string
+		call        func(ctx context.Context) (*inventorypb.Host, error)
+		code        codes.Code
+		// password is the password of the host returned.
+		password interface{}
+	}{
+		{"get without a token", "", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.GetHost(ctx, &inventorypb.GetHostRequest{Name: "web01"})
+		}, codes.Unauthenticated, nil},
+		{"get with an unknown token", "nobody", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.GetHost(ctx, &inventorypb.GetHostRequest{Name: "web01"})
+		}, codes.Unauthenticated, nil},
+		{"viewer gets", "viewer", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.GetHost(ctx, &inventorypb.GetHostRequest{Name: "web01"})
+		}, codes.OK, "*****"},
+		{"viewer gets another", "viewer", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.GetHost(ctx, &inventorypb.GetHostRequest{Name: "db07"})
+		}, codes.PermissionDenied, nil},
+		{"viewer creates", "viewer", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.CreateHost(ctx, newHost("web03"))
+		}, codes.PermissionDenied, nil},
+		{"viewer updates", "viewer", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.UpdateField(ctx, &inventorypb.UpdateFieldRequest{Name: "web01", Field: "site", Value: site("lon")})
+		}, codes.PermissionDenied, nil},
+		{"editor creates another", "editor", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.CreateHost(ctx, newHost("db08"))
+		}, codes.PermissionDenied, nil},
+		{"editor updates another", "editor", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.UpdateField(ctx, &inventorypb.UpdateFieldRequest{Name: "db07", Field: "site", Value: site("lon")})
+		}, codes.PermissionDenied, nil},
+		{"editor creates", "editor", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.CreateHost(ctx, newHost("web03"))
+		}, codes.OK, nil},
+		{"editor updates", "editor", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.UpdateField(ctx, &inventorypb.UpdateFieldRequest{Name: "web02", Field: "site", Value: site("lon")})
+		}, codes.OK, "*****"},
+		{"admin gets", "admin", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.GetHost(ctx, &inventorypb.GetHostRequest{Name: "web01"})
+		}, codes.OK, "s3cret"},
+		{"admin gets as a viewer", "admin", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.GetHost(ctx, &inventorypb.GetHostRequest{Name: "db07"})
+		}, codes.OK, "*****"},
+		{"other namespace", "stage", func(ctx context.Context) (*inventorypb.Host, error) {
+			return client.GetHost(ctx, &inventorypb.GetHostRequest{Name: "web01"})
+		}, codes.PermissionDenied, nil},
+	} {
+		host, err := tc.call(withToken(tc.token))
+		if code := status.Code(err); code != tc.code {
+			t.Errorf("%s: code %s (%v), want %s", tc.name, code, err, tc.code)
+			continue
+		}
+		if tc.password != nil {
+			if got := host.GetData().AsMap()["password"]; got != tc.password {
+				t.Errorf("%s: password %v, want %v", tc.name, got, tc.password)
+			}
+		}
+	}
+	if host, err := inv.GetHost("web01"); err != nil || host.Data["site"] != "ams" {
+		t.Errorf("web01 = %v, %v; want it untouched", host, err)
+	}
+	if _, err := inv.GetHost("db08"); !errors.Is(err, inventory.ErrHostNotFound) {
+		t.Errorf("db08 = %v, want it not created", err)
+	}
+
+	for _, tc := range []struct {
+		token string
+		want  map[string]interface{}
+		code  codes.Code
+	}{
+		{"", nil, codes.Unauthenticated},
+		{"stage", nil, codes.PermissionDenied},
+		{"viewer", map[string]interface{}{"web01": "*****", "web02": "*****", "web03": nil}, codes.OK},
+		{"admin", map[string]interface{}{"web01": "s3cret", "web02": "s3cret", "web03": nil, "db07": "*****"}, codes.OK},
+	} {
+		got, err := listNames(client, withToken(tc.token), &inventorypb.ListHostsRequest{})
+		if code := status.Code(err); code != tc.code || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ListHosts as %q = %v, %v; want %v, %s", tc.token, got, err, tc.want, tc.code)
+		}
+	}
+
+	s.RevealSecrets = false
+	if got, err := listNames(client, withToken("admin"), &inventorypb.ListHostsRequest{NamePrefix: "web01"}); err != nil || got["web01"] != "*****" {
+		t.Errorf("ListHosts as admin without RevealSecrets = %v, %v; want the password masked", got, err)
+	}
+	s.RevealSecrets = true
+
+	listed, err := inv.ListHostsWithOptions(inventory.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.CreateHost("db09", map[string]interface{}{"password": "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.CreateHost("web04", map[string]interface{}{"password": "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(withToken("viewer"), 10*time.Second)
+	defer cancel()
+	stream, err := client.WatchHosts(ctx, &inventorypb.WatchHostsRequest{StartRevision: listed.Revision + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.GetName() != "web04" || event.GetHost().GetData().AsMap()["password"] != "*****" {
+		t.Errorf("viewer watched %v, want web04 with its password masked and db09 left out", event)
+	}
+
+	stream, err = client.WatchHosts(withToken("stage"), &inventorypb.WatchHostsRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("WatchHosts without a role = %v, want PERMISSION_DENIED", err)
+	}
+}
+
+func TestUpdateFieldIfRevision(t *testing.T) {
+	inv := newTestInventory(t, map[string]map[string]interface{}{"web01": {"site": "ams"}})
+	s := New(inv)
+	s.Writable = true
+	client := dial(t, s)
+	_, read, err := inv.GetHostWithRevision("web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.UpdateHostFieldValue("web01", "site", "fra"); err != nil {
+		t.Fatal(err)
+	}
+	update := func(value string, revision int64) error {
+		_, err := client.UpdateField(context.Background(), &inventorypb.UpdateFieldRequest{
+			Name: "web01", Field: "site", Value: structpb.NewStringValue(value), IfRevision: revision})
+		return err
+	}
+	site := func() interface{} {
+		host, err := inv.GetHost("web01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return host.Data["site"]
+	}
+
+	if err := update("lon", read); status.Code(err) != codes.Aborted {
+		t.Errorf("UpdateField at a stale revision = %v, want ABORTED", err)
+	}
+	if got := site(); got != "fra" {
+		t.Errorf("UpdateField at a stale revision left site %v, want fra", got)
+	}
+	_, current, err := inv.GetHostWithRevision("web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := update("lon", current); err != nil {
+		t.Errorf("UpdateField at the current revision: %v", err)
+	}
+	if got := site(); got != "lon" {
+		t.Errorf("UpdateField at the current revision left site %v, want lon", got)
+	}
+	if err := update("par", 0); err != nil {
+		t.Errorf("UpdateField at revision 0: %v", err)
+	}
+	if got := site(); got != "par" {
+		t.Errorf("UpdateField at revision 0 left site %v, want par", got)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	if err := statusError(nil); err != nil {
+		t.Errorf("statusError(nil) = %v", err)
+	}
+	aborted := status.Error(codes.Aborted, "stream closed")
+	if err := statusError(aborted); err != aborted {
+		t.Errorf("statusError of a status = %v, want it unchanged", err)
+	}
+	for _, tc := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{inventory.ErrHostNotFound, codes.NotFound},
+		{inventory.ErrHostExists, codes.AlreadyExists},
+		{inventory.ErrHostChanged, codes.Aborted},
+		{inventory.ErrFieldImmutable, codes.InvalidArgument},
+		{inventory.ErrSchemaViolation, codes.InvalidArgument},
+		{inventory.ErrInvalidStatus, codes.InvalidArgument},
+		{inventory.ErrStatusTransition, codes.FailedPrecondition},
+		{context.Canceled, codes.Canceled},
+		{context.DeadlineExceeded, codes.DeadlineExceeded},
+		{errors.New("etcd is down"), codes.Internal},
+	} {
+		wrapped := fmt.Errorf("web01: %w", tc.err)
+		err := statusError(wrapped)
+		if got := status.Code(err); got != tc.code {
+			t.Errorf("statusError(%v) = %s, want %s", wrapped, got, tc.code)
+		}
+		if got := status.Convert(err).Message(); got != wrapped.Error() {
+			t.Errorf("statusError(%v) has message %q, want the error's", wrapped, got)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	inv := newTestInventory(t, map[string]map[string]interface{}{
+		"web01": {"site": "ams"},
+		"web02": {"site": "fra"},
+		"web03": {"site": "ams"},
+		"web04": {"site": "ams"},
+		"db01":  {"site": "ams"},
+	})
+	s := New(inv)
+	client := dial(t, s)
+	ctx := context.Background()
+	site := func(value string) *structpb.Value { return structpb.NewStringValue(value) }
+	newHost := func(name string) *inventorypb.CreateHostRequest {
+		return &inventorypb.CreateHostRequest{Host: &inventorypb.Host{Name: name, Data: &structpb.Struct{Fields: map[string]*structpb.Value{"site": site("lon")}}}}
+	}
+
+	// New servers are read-only.
+	if _, err := client.CreateHost(ctx, newHost("web05")); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("CreateHost on a read-only server = %v, want PERMISSION_DENIED", err)
+	}
+	if _, err := client.UpdateField(ctx, &inventorypb.UpdateFieldRequest{Name: "web01", Field: "site", Value: site("lon")}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("UpdateField on a read-only server = %v, want PERMISSION_DENIED", err)
+	}
+	if _, err := inv.GetHost("web05"); !errors.Is(err, inventory.ErrHostNotFound) {
+		t.Errorf("web05 = %v, want it not created", err)
+	}
+	if host, err := inv.GetHost("web01"); err != nil || host.Data["site"] != "ams" {
+		t.Errorf("web01 = %v, %v; want it untouched", host, err)
+	}
+
+	s.Writable = true
+	for _, tc := range []struct {
+		name string
+		call func() (*inventorypb.Host, error)
+		code codes.Code
+	}{
+		{"get a missing host", func() (*inventorypb.Host, error) {
+			return client.GetHost(ctx, &inventorypb.GetHostRequest{Name: "web09"})
+		}, codes.NotFound},
+		{"create without a name", func() (*inventorypb.Host, error) { return client.CreateHost(ctx, newHost("")) }, codes.InvalidArgument},
+		{"create an existing host", func() (*inventorypb.Host, error) { return client.CreateHost(ctx, newHost("web01")) }, codes.AlreadyExists},
+		{"update without a field", func() (*inventorypb.Host, error) {
+			return client.UpdateField(ctx, &inventorypb.UpdateFieldRequest{Name: "web01", Value: site("lon")})
+		}, codes.InvalidArgument},
+		{"update a missing host", func() (*inventorypb.Host, error) {
+			return client.UpdateField(ctx, &inventorypb.UpdateFieldRequest{Name: "web09", Field: "site", Value: site("lon")})
+		}, codes.NotFound},
+		{"create", func() (*inventorypb.Host, error) { return client.CreateHost(ctx, newHost("web05")) }, codes.OK},
+	} {
+		if _, err := tc.call(); status.Code(err) != tc.code {
+			t.Errorf("%s = %v, want %s", tc.name, err, tc.code)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		req  *inventorypb.ListHostsRequest
+		want []string
+		code codes.Code
+	}{
+		{"all", &inventorypb.ListHostsRequest{}, []string{"db01", "web01", "web02", "web03", "web04", "web05"}, codes.OK},
+		{"prefix", &inventorypb.ListHostsRequest{NamePrefix: "web"}, []string{"web01", "web02", "web03", "web04", "web05"}, codes.OK},
+		{"offset and limit", &inventorypb.ListHostsRequest{NamePrefix: "web", Offset: 1, Limit: 2}, []string{"web02", "web03"}, codes.OK},
+		{"offset past the end", &inventorypb.ListHostsRequest{Offset: 10}, []string{}, codes.OK},
+		{"filter", &inventorypb.ListHostsRequest{Filter: "site=ams"}, []string{"db01", "web01", "web03", "web04"}, codes.OK},
+		{"filter and limit", &inventorypb.ListHostsRequest{Filter: "site=ams", Offset: 1, Limit: 2}, []string{"web01", "web03"}, codes.OK},
+		{"where", &inventorypb.ListHostsRequest{Where: `site == "fra"`}, []string{"web02"}, codes.OK},
+		{"negative offset", &inventorypb.ListHostsRequest{Offset: -1}, nil, codes.InvalidArgument},
+		{"negative limit", &inventorypb.ListHostsRequest{Limit: -1}, nil, codes.InvalidArgument},
+		{"invalid filter", &inventorypb.ListHostsRequest{Filter: "site"}, nil, codes.InvalidArgument},
+		{"invalid where", &inventorypb.ListHostsRequest{Where: "site =="}, nil, codes.InvalidArgument},
+		{"invalid status", &inventorypb.ListHostsRequest{Statuses: []string{"asleep"}}, nil, codes.InvalidArgument},
+	} {
+		hosts, err := listNames(client, ctx, tc.req)
+		if code := status.Code(err); code != tc.code {
+			t.Errorf("%s: ListHosts = %v, want %s", tc.name, err, tc.code)
+			continue
+		}
+		if tc.want == nil {
+			continue
+		}
+		got := make([]string, 0, len(hosts))
+		for name := range hosts {
+			got = append(got, name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: ListHosts = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	inv := newTestInventory(t, map[string]map[string]interface{}{"web01": {"site": "ams"}})
+	client := dial(t, New(inv), TokenAuth("s3cret")...)
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{"no token", context.Background(), codes.Unauthenticated},
+		{"wrong token", withToken("guess"), codes.Unauthenticated},
+		{"token prefix", withToken("s3cre"), codes.Unauthenticated},
+		{"not a bearer token", metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic s3cret"), codes.Unauthenticated},
+		{"token", withToken("s3cret"), codes.OK},
+		{"token among others", metadata.AppendToOutgoingContext(withToken("guess"), "authorization", "Bearer s3cret"), codes.OK},
+	} {
+		if _, err := client.GetHost(tc.ctx, &inventorypb.GetHostRequest{Name: "web01"}); status.Code(err) != tc.code {
+			t.Errorf("%s: GetHost = %v, want %s", tc.name, err, tc.code)
+		}
+		hosts, err := listNames(client, tc.ctx, &inventorypb.ListHostsRequest{})
+		if status.Code(err) != tc.code {
+			t.Errorf("%s: ListHosts = %v, want %s", tc.name, err, tc.code)
+		} else if err == nil && len(hosts) != 1 {
+			t.Errorf("%s: ListHosts = %v, want web01", tc.name, hosts)
+		}
+		ctx, cancel := context.WithTimeout(tc.ctx, 100*time.Millisecond)
+		stream, err := client.WatchHosts(ctx, &inventorypb.WatchHostsRequest{})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		cancel()
+		want := tc.code
+		if want == codes.OK {
+			// Nothing changes, so an authorized watch runs until its
+			// deadline.
+			want = codes.DeadlineExceeded
+		}
+		if status.Code(err) != want {
+			t.Errorf("%s: WatchHosts = %v, want %s", tc.name, err, want)
+		}
+	}
+}
@@ -0,0 +1,1582 @@
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"path"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+)
+
+func (i *Inventory) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), i.Timeout)
+}
+
+// hostKey returns the etcd key for a host. The name is percent-encoded as a
+// single path segment, so names containing "/", spaces or control
+// characters cannot escape the prefix scheme. Plain names (letters, digits,
+// "-", ".", "_") encode to themselves, so existing keys are unaffected.
+func (i *Inventory) hostKey(hostName string) string {
+	if i.RawNames {
+		return baseKey + hostName
+	}
+	return baseKey + url.PathEscape(hostName)
+}
+
+// hostNameFromKey reverses hostKey.
+func (i *Inventory) hostNameFromKey(key string) string {
+	segment := strings.TrimPrefix(key, baseKey)
+	if i.RawNames {
+		return segment
+	}
+	name, err := url.PathUnescape(segment)
+	if err != nil {
+		return segment
+	}
+	return name
+}
+
+// checkRawName rejects names that would corrupt the key scheme when name
+// encoding is disabled.
+func (i *Inventory) checkRawName(hostName string) error {
+	if i.RawNames && strings.Contains(hostName, "/") {
+		return fmt.Errorf("host name %q contains '/', which requires name encoding (drop --raw-names)", hostName)
+	}
+	return nil
+}
+
+var (
+	// ErrHostExists is returned when a create must not overwrite an existing host.
+	ErrHostExists = errors.New("host already exists")
+	// ErrHostNotFound is returned when an operation targets a missing host.
+	ErrHostNotFound = errors.New("host not found")
+	// ErrFieldNotFound is returned when a host lacks the requested field.
+	ErrFieldNotFound = errors.New("field not found")
+	// ErrFieldImmutable is returned when a write would set a field that
+	// cannot be written: a virtual field, or a key field of an existing
+	// host.
+	ErrFieldImmutable = errors.New("field cannot be written")
+	// ErrHostChanged is returned when a conditional write finds the host
+	// modified since it was read.
+	ErrHostChanged = errors.New("host changed since it was read")
+)
+
+// maxModifyAttempts bounds the retries of a compare-and-swap update that
+// keeps losing to concurrent writers.
+const maxModifyAttempts = 3
+
+func (i *Inventory) CreateHost(hostName string, hostData map[string]interface{}) error {
+	_, err := i.PutHost(hostName, hostData)
+	return err
+}
+
+// PutHost writes the host unconditionally and reports whether it replaced
+// an existing one.
+func (i *Inventory) PutHost(hostName string, hostData map[string]interface{}) (overwrote bool, err error) {
+	return i.Put(Host{Name: hostName, Data: hostData})
+}
+
+// Put is PutHost for a whole Host, keeping its field order.
+func (i *Inventory) Put(host Host) (overwrote bool, err error) {
+	return i.put(host)
+}
+
+// PutWithTTL is Put for a host that expires ttl after the last renewal of
+// its lease (see TouchHost and KeepHostAlive).
+func (i *Inventory) PutWithTTL(host Host, ttl time.Duration) (overwrote bool, err error) {
+	err = i.withNewLease(ttl, func(lease clientv3.OpOption) error {
+		overwrote, err = i.put(host, lease)
+		return err
+	})
+	return overwrote, err
+}
+
+// withNewLease grants a lease of ttl, rounded up to whole seconds, and
+// passes it to write as a put option. The lease is revoked if write fails.
+func (i *Inventory) withNewLease(ttl time.Duration, write func(lease clientv3.OpOption) error) error {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return fmt.Errorf("invalid TTL %v: must be at least a second", ttl)
+	}
+	ctx, cancel := i.requestContext()
+	grant, err := i.lease.Grant(ctx, seconds)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("granting lease: %w", err)
+	}
+	if err := write(clientv3.WithLease(grant.ID)); err != nil {
+		ctx, cancel := i.requestContext()
+		i.lease.Revoke(ctx, grant.ID)
+		cancel()
+		return err
+	}
+	return nil
+}
+
+func (i *Inventory) put(host Host, opts ...clientv3.OpOption) (overwrote bool, err error) {
+	if err := i.checkRawName(host.Name); err != nil {
+		return false, err
+	}
+	key := i.hostKey(host.Name)
+	hostJSON, err := i.encodeHost(i.WriteRules.applyHost(host), nil)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Put(ctx, key, string(hostJSON), append(opts, clientv3.WithPrevKV())...)
+	if err != nil {
+		return false, err
+	}
+	return resp.PrevKv != nil, nil
+}
+
+// ReplaceHost overwrites an existing host, checked atomically with a
+// transaction on the key's CreateRevision, and returns ErrHostNotFound if
+// there is nothing to replace.
+func (i *Inventory) ReplaceHost(hostName string, hostData map[string]interface{}) error {
+	return i.Replace(Host{Name: hostName, Data: hostData})
+}
+
+// Replace is ReplaceHost for a whole Host, keeping its field order.
+func (i *Inventory) Replace(host Host) error {
+	return i.replace(host)
+}
+
+// ReplaceWithTTL is Replace that gives the host a new lease of ttl, as
+// PutWithTTL does.
+func (i *Inventory) ReplaceWithTTL(host Host, ttl time.Duration) error {
+	return i.withNewLease(ttl, func(lease clientv3.OpOption) error {
+		return i.replace(host, lease)
+	})
+}
+
+func (i *Inventory) replace(host Host, opts ...clientv3.OpOption) error {
+	key := i.hostKey(host.Name)
+	hostJSON, err := i.encodeHost(i.WriteRules.applyHost(host), nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), ">", 0)).
+		Then(clientv3.OpPut(key, string(hostJSON), opts...)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("%w: %s", ErrHostNotFound, host.Name)
+	}
+	return nil
+}
+
+// CreateHostIfNotExists creates the host only if its key does not exist yet,
+// checked atomically with a transaction on the key's CreateRevision.
+func (i *Inventory) CreateHostIfNotExists(hostName string, hostData map[string]interface{}) error {
+	return i.Create(Host{Name: hostName, Data: hostData})
+}
+
+// Create is CreateHostIfNotExists for a whole Host, keeping
+// its field order.
+func (i *Inventory) Create(host Host) error {
+	return i.create(host)
+}
+
+// CreateWithTTL is Create for a host that expires like one written by
+// PutWithTTL.
+func (i *Inventory) CreateWithTTL(host Host, ttl time.Duration) error {
+	return i.withNewLease(ttl, func(lease clientv3.OpOption) error {
+		return i.create(host, lease)
+	})
+}
+
+func (i *Inventory) create(host Host, opts ...clientv3.OpOption) error {
+	if err := i.checkRawName(host.Name); err != nil {
+		return err
+	}
+	key := i.hostKey(host.Name)
+	hostJSON, err := i.encodeHost(i.WriteRules.applyHost(host), nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(hostJSON), opts...)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("%w: %s", ErrHostExists, host.Name)
+	}
+	return nil
+}
+
+func (i *Inventory) UpdateHostField(hostName, fieldName, fieldValue string) error {
+	return i.UpdateHostFieldValue(hostName, fieldName, fieldValue)
+}
+
+// UpdateHostFieldValue sets a field to a value of any JSON-compatible type,
+// or []byte for binary data.
+func (i *Inventory) UpdateHostFieldValue(hostName, fieldName string, fieldValue interface{}) error {
+	return i.UpdateHostFieldValueIfRevision(hostName, fieldName, fieldValue, 0)
+}
+
+// UpdateHostFieldValueIfRevision is UpdateHostFieldValue that only writes
+// if the host's key is at modRevision, returning ErrHostChanged otherwise;
+// 0 writes at any revision. The write is a compare-and-swap either way, so
+// it never overwrites a concurrent change to another field.
+//
+// A fieldName that is not a field of the host but a nested path such as
+// "network.interfaces[0].ip" sets the value inside the field (see
+// setFieldPath), as GetHostField reads it.
+func (i *Inventory) UpdateHostFieldValueIfRevision(hostName, fieldName string, fieldValue interface{}, modRevision int64) error {
+	return i.modifyHostIfRevision(hostName, modRevision, func(host *Host) error {
+		if _, ok := host.Data[fieldName]; !ok {
+			path, err := parseFieldPath(fieldName)
+			if err != nil {
+				return err
+			}
+			if len(path) > 1 {
+				top, err := setFieldPath(fieldName, host.Data[path[0].Key], path[1:], fieldValue)
+				if err != nil {
+					return err
+				}
+				fieldName, fieldValue = path[0].Key, top
+			}
+		}
+		i.WriteRules.set(host.Data, fieldName, fieldValue)
+		return nil
+	})
+}
+
+// GetHost returns the stored host, or ErrHostNotFound.
+func (i *Inventory) GetHost(hostName string) (Host, error) {
+	if i.local != nil {
+		return i.local.Get(hostName)
+	}
+	key := i.hostKey(hostName)
+	if i.cache != nil {
+		if value, ok := i.cache.get(key); ok {
+			return i.unmarshalHost(value)
+		}
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Get(ctx, key, i.readOpts()...)
+	if err != nil {
+		return Host{}, err
+	}
+	if len(resp.Kvs) == 0 {
+		return Host{}, fmt.Errorf("%w: %s", ErrHostNotFound, hostName)
+	}
+	if i.cache != nil {
+		i.cache.put(key, resp.Kvs[0].Value)
+	}
+	return i.unmarshalHost(resp.Kvs[0].Value)
+}
+
+// HostExists reports whether the host is stored, with a count-only read.
+func (i *Inventory) HostExists(hostName string) (bool, error) {
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Get(ctx, i.hostKey(hostName), i.readOpts(clientv3.WithCountOnly())...)
+	if err != nil {
+		return false, err
+	}
+	return resp.Count > 0, nil
+}
+
+// CountHosts returns the number of stored hosts, with a count-only read.
+func (i *Inventory) CountHosts() (int64, error) {
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Get(ctx, baseKey, i.readOpts(clientv3.WithPrefix(), clientv3.WithCountOnly())...)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// GetHostWithRevision is GetHost that also returns the key's ModRevision,
+// for a later UpdateHostIfRevision.
+func (i *Inventory) GetHostWithRevision(hostName string) (Host, int64, error) {
+	key := i.hostKey(hostName)
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Get(ctx, key)
+	if err != nil {
+		return Host{}, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return Host{}, 0, fmt.Errorf("%w: %s", ErrHostNotFound, hostName)
+	}
+	host, err := i.unmarshalHost(resp.Kvs[0].Value)
+	return host, resp.Kvs[0].ModRevision, err
+}
+
+// UpdateHostIfRevision replaces the host's data only if its key is still at
+// modRevision, returning ErrHostChanged otherwise.
+func (i *Inventory) UpdateHostIfRevision(hostName string, hostData map[string]interface{}, modRevision int64) error {
+	key := i.hostKey(hostName)
+	hostJSON, err := i.encodeHost(i.WriteRules.applyHost(Host{Name: hostName, Data: hostData}), nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(clientv3.OpPut(key, string(hostJSON))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("%w: %s", ErrHostChanged, hostName)
+	}
+	return nil
+}
+
+// HostMeta is the etcd metadata of a host's key.
+type HostMeta struct {
+	Key            string
+	CreateRevision int64
+	ModRevision    int64
+	Version        int64
+	// Lease is the ID of the key's lease, 0 if it has none; TTL is then the
+	// seconds left on it.
+	Lease int64
+	TTL   int64
+}
+
+// GetHostMeta returns the etcd metadata of a host without fetching its
+// data.
+func (i *Inventory) GetHostMeta(hostName string) (HostMeta, error) {
+	key := i.hostKey(hostName)
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Get(ctx, key, clientv3.WithKeysOnly())
+	if err != nil {
+		return HostMeta{}, err
+	}
+	if len(resp.Kvs) == 0 {
+		return HostMeta{}, fmt.Errorf("%w: %s", ErrHostNotFound, hostName)
+	}
+	kv := resp.Kvs[0]
+	meta := HostMeta{
+		Key:            key,
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Version:        kv.Version,
+		Lease:          kv.Lease,
+	}
+	if kv.Lease != int64(clientv3.NoLease) {
+		lease, err := i.lease.TimeToLive(ctx, clientv3.LeaseID(kv.Lease))
+		if err != nil {
+			return HostMeta{}, err
+		}
+		meta.TTL = lease.TTL
+	}
+	return meta, nil
+}
+
+// GetHostField returns a single field of a host. fieldName may be a nested
+// path such as "network.interfaces[0].ip"; a top-level field whose name
+// contains dots is matched first.
+func (i *Inventory) GetHostField(hostName, fieldName string) (interface{}, error) {
+	host, err := i.GetHost(hostName)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := host.Data[fieldName]; ok {
+		return value, nil
+	}
+	path, err := parseFieldPath(fieldName)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := lookupFieldPath(host.Data, path)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s has no field %s", ErrFieldNotFound, hostName, fieldName)
+	}
+	return value, nil
+}
+
+// fieldPathSegment is one step of a nested field path: a map key, or an
+// array index when Key is empty.
+type fieldPathSegment struct {
+	Key   string
+	Index int
+}
+
+// parseFieldPath splits a path like "network.interfaces[0].ip" into
+// segments.
+func parseFieldPath(path string) ([]fieldPathSegment, error) {
+	var segments []fieldPathSegment
+	for _, part := range strings.Split(path, ".") {
+		key, rest, _ := strings.Cut(part, "[")
+		if key == "" && (len(segments) == 0 || rest == "") {
+			return nil, fmt.Errorf("invalid field path %q", path)
+		}
+		if key != "" {
+			segments = append(segments, fieldPathSegment{Key: key})
+		}
+		for rest != "" {
+			index, after, ok := strings.Cut(rest, "]")
+			n, err := strconv.Atoi(index)
+			if !ok || err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid index in field path %q", path)
+			}
+			segments = append(segments, fieldPathSegment{Index: n})
+			if after == "" {
+				break
+			}
+			if !strings.HasPrefix(after, "[") {
+				return nil, fmt.Errorf("invalid field path %q", path)
+			}
+			rest = after[1:]
+		}
+	}
+	return segments, nil
+}
+
+func lookupFieldPath(data map[string]interface{}, path []fieldPathSegment) (interface{}, bool) {
+	var current interface{} = data
+	for _, segment := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			if segment.Key == "" {
+				return nil, false
+			}
+			value, ok := node[segment.Key]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			if segment.Key != "" || segment.Index >= len(node) {
+				return nil, false
+			}
+			current = node[segment.Index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// setFieldPath returns node with value stored at path below it, creating
+// the objects and arrays missing along the way. An array index may be one
+// past the end, appending the value. fieldName is the whole path, for
+// errors.
+func setFieldPath(fieldName string, node interface{}, path []fieldPathSegment, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	segment := path[0]
+	if segment.Key != "" {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			if node != nil {
+				return nil, fmt.Errorf("cannot set %s: %q is inside a %s, not an object", fieldName, segment.Key, TypeName(node))
+			}
+			object = map[string]interface{}{}
+		}
+		child, err := setFieldPath(fieldName, object[segment.Key], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		object[segment.Key] = child
+		return object, nil
+	}
+	array, ok := node.([]interface{})
+	if !ok && node != nil {
+		return nil, fmt.Errorf("cannot set %s: index %d is inside a %s, not an array", fieldName, segment.Index, TypeName(node))
+	}
+	switch {
+	case segment.Index > len(array):
+		return nil, fmt.Errorf("cannot set %s: index %d is past the end of an array of %d", fieldName, segment.Index, len(array))
+	case segment.Index == len(array):
+		array = append(array, nil)
+	}
+	child, err := setFieldPath(fieldName, array[segment.Index], path[1:], value)
+	if err != nil {
+		return nil, err
+	}
+	array[segment.Index] = child
+	return array, nil
+}
+
+// modifyHost applies modify to the stored host and writes the result back
+// only if the key was not changed in the meantime, retrying a few times when
+// it was. The key keeps its lease, if it has one.
+func (i *Inventory) modifyHost(hostName string, modify func(host *Host) error) error {
+	_, err := i.modifyLeasedHost(hostName, 0, modify)
+	return err
+}
+
+// modifyHostIfRevision is modifyHost for a host expected at modRevision:
+// if its key is at any other, or changes before the write, it fails with
+// ErrHostChanged instead of retrying. A modRevision of 0 expects none.
+func (i *Inventory) modifyHostIfRevision(hostName string, modRevision int64, modify func(host *Host) error) error {
+	_, err := i.modifyLeasedHost(hostName, modRevision, modify)
+	return err
+}
+
+// modifyLeasedHost is modifyHostIfRevision, also returning the key's lease
+// ID (0 for none).
+func (i *Inventory) modifyLeasedHost(hostName string, modRevision int64, modify func(host *Host) error) (clientv3.LeaseID, error) {
+	key := i.hostKey(hostName)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := i.requestContext()
+		resp, err := i.kv.Get(ctx, key)
+		if err != nil {
+			cancel()
+			return 0, err
+		}
+		if len(resp.Kvs) == 0 {
+			cancel()
+			return 0, fmt.Errorf("%w: %s", ErrHostNotFound, hostName)
+		}
+		if modRevision != 0 && resp.Kvs[0].ModRevision != modRevision {
+			cancel()
+			return 0, fmt.Errorf("%w: %s is at revision %d, not %d", ErrHostChanged, hostName, resp.Kvs[0].ModRevision, modRevision)
+		}
+		host, err := i.unmarshalHost(resp.Kvs[0].Value)
+		if err != nil {
+			cancel()
+			return 0, err
+		}
+		if host.Data == nil {
+			host.Data = make(map[string]interface{})
+		}
+		prev := maps.Clone(host.Data)
+		if err := modify(&host); err != nil {
+			cancel()
+			return 0, err
+		}
+		// As in updateFieldsOp, a change to nothing writes nothing.
+		lease := clientv3.LeaseID(resp.Kvs[0].Lease)
+		if reflect.DeepEqual(prev, host.Data) {
+			cancel()
+			return lease, nil
+		}
+		hostJSON, err := i.encodeHost(host, prev)
+		if err != nil {
+			cancel()
+			return 0, err
+		}
+		// A put without the lease would detach the key from it and make an
+		// expiring host permanent.
+		var putOpts []clientv3.OpOption
+		if lease != 0 {
+			putOpts = append(putOpts, clientv3.WithLease(lease))
+		}
+		txn, err := i.kv.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(key, string(hostJSON), putOpts...)).
+			Commit()
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+		if txn.Succeeded {
+			return lease, nil
+		}
+		if modRevision != 0 {
+			return 0, fmt.Errorf("%w: %s", ErrHostChanged, hostName)
+		}
+		if attempt == maxModifyAttempts {
+			return 0, fmt.Errorf("%w: %s kept changing concurrently; gave up after %d attempts", ErrHostChanged, hostName, attempt)
+		}
+	}
+}
+
+// UpdatedAtField holds the time a host was last touched, in RFC 3339.
+const UpdatedAtField = "updated_at"
+
+// TouchHost sets the host's updated_at field to the current time, leaving
+// the rest of its data alone, in a single transaction. If the key has a
+// lease, the lease is then renewed, so touch serves as a liveness heartbeat
+// for expiring hosts. It reports whether a lease was renewed.
+func (i *Inventory) TouchHost(hostName string) (renewed bool, err error) {
+	lease, err := i.modifyLeasedHost(hostName, 0, func(host *Host) error {
+		host.Data[UpdatedAtField] = time.Now().UTC().Format(time.RFC3339)
+		return nil
+	})
+	if err != nil || lease == 0 {
+		return false, err
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	if _, err := i.lease.KeepAliveOnce(ctx, lease); err != nil {
+		return false, fmt.Errorf("renewing lease %x: %w", int64(lease), err)
+	}
+	return true, nil
+}
+
+// CreatedAtField and StatusChangedAtField are, with UpdatedAtField, the
+// timestamps every write maintains; see stampHost.
+const (
+	CreatedAtField       = "created_at"
+	StatusChangedAtField = "status_changed_at"
+)
+
+// StatusField holds a host's lifecycle state; see HostStatus.
+const StatusField = "status"
+
+// HostStatus is the lifecycle state of a host, stored in its StatusField.
+// A host without one has not been given a state yet.
+type HostStatus string
+
+// The lifecycle states, in the order a host normally goes through them.
+const (
+	StatusProvisioning   HostStatus = "provisioning"
+	StatusActive         HostStatus = "active"
+	StatusMaintenance    HostStatus = "maintenance"
+	StatusDecommissioned HostStatus = "decommissioned"
+)
+
+// statusTransitions lists the states each state may move to. A
+// decommissioned host can only be provisioned again.
+var statusTransitions = map[HostStatus][]HostStatus{
+	StatusProvisioning:   {StatusActive, StatusDecommissioned},
+	StatusActive:         {StatusMaintenance, StatusDecommissioned},
+	StatusMaintenance:    {StatusActive, StatusDecommissioned},
+	StatusDecommissioned: {StatusProvisioning},
+}
+
+var (
+	// ErrInvalidStatus is returned for a status that is not a HostStatus.
+	ErrInvalidStatus = errors.New("invalid status")
+	// ErrStatusTransition is returned by SetHostStatus for a move its
+	// current state does not allow.
+	ErrStatusTransition = errors.New("status transition not allowed")
+)
+
+// HostStatuses returns the names of the lifecycle states, in lifecycle
+// order.
+func HostStatuses() []string {
+	return []string{string(StatusProvisioning), string(StatusActive), string(StatusMaintenance), string(StatusDecommissioned)}
+}
+
+// ParseHostStatus returns the state named s.
+func ParseHostStatus(s string) (HostStatus, error) {
+	if _, ok := statusTransitions[HostStatus(s)]; ok {
+		return HostStatus(s), nil
+	}
+	return "", fmt.Errorf("%w: %w", ErrInvalidStatus, UnknownChoiceError("status", s, HostStatuses()))
+}
+
+// Status returns the host's lifecycle state, or "" if it has none.
+func (h Host) Status() HostStatus {
+	status, _ := h.Data[StatusField].(string)
+	return HostStatus(status)
+}
+
+// CheckStatusTransition reports whether a host may move from one state to
+// another. Any state may be given to a host without one, and setting the
+// state it is in is no move at all.
+func CheckStatusTransition(from, to HostStatus) error {
+	if from == "" || from == to || slices.Contains(statusTransitions[from], to) {
+		return nil
+	}
+	allowed := make([]string, len(statusTransitions[from]))
+	for n, status := range statusTransitions[from] {
+		allowed[n] = string(status)
+	}
+	return fmt.Errorf("%w: %s to %s; %s hosts can only become %s", ErrStatusTransition, from, to, from, strings.Join(allowed, " or "))
+}
+
+// checkStatus refuses a host whose StatusField holds anything but a
+// HostStatus.
+func checkStatus(host Host) error {
+	value, ok := host.Data[StatusField]
+	if !ok {
+		return nil
+	}
+	if status, isString := value.(string); isString {
+		if _, err := ParseHostStatus(status); err != nil {
+			return fmt.Errorf("host %s: %w", host.Name, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("host %s: %w: %s is a %s, not a string", host.Name, ErrInvalidStatus, StatusField, TypeName(value))
+}
+
+// stampHost returns host with its timestamps maintained for a write at now,
+// given prev, the data being replaced (nil if unknown): updated_at is now;
+// created_at is kept from prev, or from host, or else now; and
+// status_changed_at is now when the status differs from prev's, and kept
+// otherwise. With no prev, a host with a status but no status_changed_at
+// gets now. A write that changes nothing but the timestamps keeps prev's
+// (see unchangedData). The data is copied, not modified.
+func stampHost(host Host, prev map[string]interface{}, now time.Time) Host {
+	if prev != nil && unchangedData(host.Data, prev) {
+		host.Data = maps.Clone(prev)
+		return host
+	}
+	stamp := now.UTC().Format(time.RFC3339)
+	data := make(map[string]interface{}, len(host.Data)+3)
+	for field, value := range host.Data {
+		data[field] = value
+	}
+	data[UpdatedAtField] = stamp
+	if created, ok := prev[CreatedAtField]; ok {
+		data[CreatedAtField] = created
+	} else if _, ok := data[CreatedAtField]; !ok {
+		data[CreatedAtField] = stamp
+	}
+	status, hasStatus := data[StatusField]
+	switch {
+	case prev != nil && !reflect.DeepEqual(prev[StatusField], status):
+		data[StatusChangedAtField] = stamp
+	case prev != nil:
+		if changed, ok := prev[StatusChangedAtField]; ok {
+			data[StatusChangedAtField] = changed
+		}
+	case hasStatus:
+		if _, ok := data[StatusChangedAtField]; !ok {
+			data[StatusChangedAtField] = stamp
+		}
+	}
+	host.Data = data
+	return host
+}
+
+// unchangedData reports whether data, written over prev, changes nothing
+// but the timestamps stampHost maintains. An updated_at set in data, as
+// TouchHost sets it, is a change.
+func unchangedData(data, prev map[string]interface{}) bool {
+	data = maps.Clone(data)
+	for _, field := range []string{CreatedAtField, StatusChangedAtField, UpdatedAtField} {
+		value, ok := prev[field]
+		if _, set := data[field]; set && field == UpdatedAtField {
+			continue
+		}
+		if ok {
+			data[field] = value
+		} else {
+			delete(data, field)
+		}
+	}
+	return reflect.DeepEqual(data, prev)
+}
+
+// SetHostStatus moves the host to status, if CheckStatusTransition allows
+// it from its current state, which it returns. status_changed_at records
+// when the state last changed.
+func (i *Inventory) SetHostStatus(hostName string, status HostStatus) (from HostStatus, err error) {
+	if _, err := ParseHostStatus(string(status)); err != nil {
+		return "", err
+	}
+	err = i.modifyHostIfRevision(hostName, 0, func(host *Host) error {
+		from = host.Status()
+		if err := CheckStatusTransition(from, status); err != nil {
+			return fmt.Errorf("host %s: %w", hostName, err)
+		}
+		host.Data[StatusField] = string(status)
+		return nil
+	})
+	return from, err
+}
+
+// archiveKey is where removing a decommissioned host moves it to, under
+// the same name as below baseKey, unless it is purged.
+const archiveKey = "/archive/"
+
+// archivedKey returns the archive key of the host stored at key.
+func archivedKey(key string) string {
+	return archiveKey + strings.TrimPrefix(key, baseKey)
+}
+
+// removeOps returns the operations removing the host stored as kv: a
+// delete, plus a put of the same value under archiveKey if the host is
+// decommissioned and not purged. The delete only happens if the key is
+// still at the revision read.
+func removeOps(kv *mvccpb.KeyValue, purge bool) (cmp clientv3.Cmp, ops []clientv3.Op, archived bool) {
+	key := string(kv.Key)
+	cmp = clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)
+	ops = []clientv3.Op{clientv3.OpDelete(key)}
+	if host, err := decodeStoredHost(kv.Value); err == nil && !purge && host.Status() == StatusDecommissioned {
+		ops = append(ops, clientv3.OpPut(archivedKey(key), string(kv.Value)))
+		archived = true
+	}
+	return cmp, ops, archived
+}
+
+// DeleteHost removes the host like RemoveHostIfRevision (at any revision
+// for a modRevision of 0), except that a decommissioned host is moved
+// under /archive/ instead, unless purge. It reports whether the host was
+// archived. ArchivedHosts lists the archive.
+func (i *Inventory) DeleteHost(hostName string, modRevision int64, purge bool) (archived bool, err error) {
+	key := i.hostKey(hostName)
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return false, fmt.Errorf("%w: %s", ErrHostNotFound, hostName)
+	}
+	if modRevision != 0 && resp.Kvs[0].ModRevision != modRevision {
+		return false, fmt.Errorf("%w: %s", ErrHostChanged, hostName)
+	}
+	cmp, ops, archived := removeOps(resp.Kvs[0], purge)
+	txn, err := i.kv.Txn(ctx).If(cmp).Then(ops...).Commit()
+	if err != nil {
+		return false, err
+	}
+	if !txn.Succeeded {
+		return false, fmt.Errorf("%w: %s", ErrHostChanged, hostName)
+	}
+	return archived, nil
+}
+
+// DeleteHosts is DeleteHost for many hosts, in batches of removeBatchSize
+// each read and then removed in one transaction. It returns how many hosts
+// were deleted and how many archived; if a host of a batch changed in
+// between, that batch fails with ErrHostChanged, leaving earlier ones
+// done.
+func (i *Inventory) DeleteHosts(names []string, purge bool) (deleted, archived int64, err error) {
+	for start := 0; start < len(names); start += removeBatchSize {
+		batch := names[start:min(start+removeBatchSize, len(names))]
+		gets := make([]clientv3.Op, len(batch))
+		for n, name := range batch {
+			gets[n] = clientv3.OpGet(i.hostKey(name))
+		}
+		ctx, cancel := i.requestContext()
+		resp, err := i.kv.Txn(ctx).Then(gets...).Commit()
+		cancel()
+		if err != nil {
+			return deleted, archived, err
+		}
+		var cmps []clientv3.Cmp
+		var ops []clientv3.Op
+		var batchArchived int64
+		for _, r := range resp.Responses {
+			for _, kv := range r.GetResponseRange().Kvs {
+				cmp, hostOps, isArchived := removeOps(kv, purge)
+				cmps, ops = append(cmps, cmp), append(ops, hostOps...)
+				if isArchived {
+					batchArchived++
+				}
+			}
+		}
+		if len(cmps) == 0 {
+			continue
+		}
+		ctx, cancel = i.requestContext()
+		txn, err := i.kv.Txn(ctx).If(cmps...).Then(ops...).Commit()
+		cancel()
+		if err != nil {
+			return deleted, archived, err
+		}
+		if !txn.Succeeded {
+			return deleted, archived, fmt.Errorf("%w: a host of the batch starting at %s", ErrHostChanged, batch[0])
+		}
+		deleted += int64(len(cmps)) - batchArchived
+		archived += batchArchived
+	}
+	return deleted, archived, nil
+}
+
+// ArchivedHosts returns the hosts DeleteHost archived, sorted by name.
+func (i *Inventory) ArchivedHosts() ([]Host, error) {
+	list, err := i.listHosts(archiveKey, true)
+	if err != nil {
+		return nil, err
+	}
+	for n, kv := range list.kvs {
+		list.hosts[n].Name = i.hostNameFromKey(baseKey + strings.TrimPrefix(string(kv.Key), archiveKey))
+	}
+	return list.hosts, nil
+}
+
+// ErrNoLease is returned by KeepHostAlive for a host without a TTL.
+var ErrNoLease = errors.New("host has no TTL")
+
+// KeepHostAlive renews the lease of a host written with a TTL until ctx is
+// done, when it returns nil, or until the lease can no longer be renewed,
+// as when it expired during a partition from etcd and took the host with
+// it, when it returns an error.
+func (i *Inventory) KeepHostAlive(ctx context.Context, hostName string) error {
+	reqCtx, cancel := i.requestContext()
+	resp, err := i.kv.Get(reqCtx, i.hostKey(hostName))
+	cancel()
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return fmt.Errorf("%w: %s", ErrHostNotFound, hostName)
+	}
+	lease := clientv3.LeaseID(resp.Kvs[0].Lease)
+	if lease == clientv3.NoLease {
+		return fmt.Errorf("%w: %s", ErrNoLease, hostName)
+	}
+	renewals, err := i.lease.KeepAlive(ctx, lease)
+	if err != nil {
+		return fmt.Errorf("renewing lease %x: %w", int64(lease), err)
+	}
+	// The channel closes once ctx is done or the lease is lost.
+	for range renewals {
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("lease %x of %s expired or could not be renewed", int64(lease), hostName)
+}
+
+// MergeHostData deep-merges data into the existing host's Data; values from
+// data win, and nested objects are merged key by key.
+func (i *Inventory) MergeHostData(hostName string, data map[string]interface{}) error {
+	return i.modifyHost(hostName, func(host *Host) error {
+		deepMerge(host.Data, data)
+		for field := range data {
+			i.WriteRules.set(host.Data, field, host.Data[field])
+		}
+		return nil
+	})
+}
+
+// UpdateHostFields sets several fields on a host in a single
+// read-modify-write.
+func (i *Inventory) UpdateHostFields(hostName string, fields map[string]interface{}) error {
+	return i.modifyHost(hostName, func(host *Host) error {
+		for field, value := range fields {
+			i.WriteRules.set(host.Data, field, value)
+		}
+		return nil
+	})
+}
+
+// DefaultUpdateBatch is the number of hosts UpdateHostsFields is given
+// per transaction by default, for the reasons of DefaultImportBatch.
+const DefaultUpdateBatch = 32
+
+// UpdateHostsFields sets fields on the named hosts as UpdateHostFields does
+// on each, in one transaction, so the batch is written entirely or not at
+// all; it is retried whole if a host changes before it is written. It
+// reports for each host, in order, whether it was written: a host already
+// holding the values is left alone. Hosts that cannot be updated, such as
+// missing or invalid ones, are left out of the transaction with their
+// error in errs; err fails the whole batch.
+func (i *Inventory) UpdateHostsFields(names []string, fields map[string]interface{}) (updated []bool, errs []error, err error) {
+	for attempt := 1; ; attempt++ {
+		updated, errs = make([]bool, len(names)), make([]error, len(names))
+		ctx, cancel := i.requestContext()
+		gets := make([]clientv3.Op, len(names))
+		for n, name := range names {
+			gets[n] = clientv3.OpGet(i.hostKey(name))
+		}
+		read, err := i.kv.Txn(ctx).Then(gets...).Commit()
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		var cmps []clientv3.Cmp
+		var puts []clientv3.Op
+		seen := make(map[string]bool, len(names))
+		for n, name := range names {
+			kvs := read.Responses[n].GetResponseRange().Kvs
+			switch {
+			case len(kvs) == 0:
+				errs[n] = fmt.Errorf("%w: %s", ErrHostNotFound, name)
+				continue
+			case seen[name]:
+				errs[n] = fmt.Errorf("host %s appears more than once in the batch", name)
+				continue
+			}
+			seen[name] = true
+			var put clientv3.Op
+			updated[n], put, errs[n] = i.updateFieldsOp(name, kvs[0], fields)
+			if errs[n] != nil || !updated[n] {
+				continue
+			}
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(string(kvs[0].Key)), "=", kvs[0].ModRevision))
+			puts = append(puts, put)
+		}
+		if len(puts) == 0 {
+			cancel()
+			return updated, errs, nil
+		}
+		txn, err := i.kv.Txn(ctx).If(cmps...).Then(puts...).Commit()
+		cancel()
+		if err != nil {
+			return nil, nil, err
+		}
+		if txn.Succeeded {
+			return updated, errs, nil
+		}
+		if attempt == maxModifyAttempts {
+			return nil, nil, fmt.Errorf("%w: hosts of the batch kept changing concurrently; gave up after %d attempts", ErrHostChanged, attempt)
+		}
+	}
+}
+
+// updateFieldsOp returns the put that sets fields on the stored host kv,
+// keeping its lease, or false if the host already holds them.
+func (i *Inventory) updateFieldsOp(name string, kv *mvccpb.KeyValue, fields map[string]interface{}) (bool, clientv3.Op, error) {
+	host, err := i.unmarshalHost(kv.Value)
+	if err != nil {
+		return false, clientv3.Op{}, fmt.Errorf("host %s: %w", name, err)
+	}
+	if host.Data == nil {
+		host.Data = make(map[string]interface{})
+	}
+	prev := maps.Clone(host.Data)
+	for field, value := range fields {
+		i.WriteRules.set(host.Data, field, value)
+	}
+	if reflect.DeepEqual(prev, host.Data) {
+		return false, clientv3.Op{}, nil
+	}
+	hostJSON, err := i.encodeHost(host, prev)
+	if err != nil {
+		return false, clientv3.Op{}, err
+	}
+	var opts []clientv3.OpOption
+	if kv.Lease != 0 {
+		opts = append(opts, clientv3.WithLease(clientv3.LeaseID(kv.Lease)))
+	}
+	return true, clientv3.OpPut(string(kv.Key), string(hostJSON), opts...), nil
+}
+
+// errFieldPresent stops SetFieldIfAbsent's read-modify-write without a
+// write.
+var errFieldPresent = errors.New("field already set")
+
+// SetFieldIfAbsent sets a field only if the host does not have it yet, so a
+// default never clobbers a value set by hand, and reports whether it did.
+// The check and the write are one read-modify-write.
+func (i *Inventory) SetFieldIfAbsent(hostName, fieldName string, fieldValue interface{}) (set bool, err error) {
+	err = i.modifyHost(hostName, func(host *Host) error {
+		if _, ok := host.Data[fieldName]; ok {
+			return errFieldPresent
+		}
+		i.WriteRules.set(host.Data, fieldName, fieldValue)
+		return nil
+	})
+	if errors.Is(err, errFieldPresent) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PruneEmptyFields deletes the empty fields (see IsEmptyValue) of every
+// host and returns the deleted field names by host. With dryRun it only
+// reports them.
+func (i *Inventory) PruneEmptyFields(dryRun bool) (map[string][]string, error) {
+	hosts, err := i.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	pruned := make(map[string][]string)
+	for _, host := range hosts {
+		fields := emptyFields(host.Data)
+		if len(fields) == 0 {
+			continue
+		}
+		if !dryRun {
+			err := i.modifyHost(host.Name, func(host *Host) error {
+				// Prune what is empty now, not what was when listed.
+				fields = emptyFields(host.Data)
+				for _, field := range fields {
+					delete(host.Data, field)
+				}
+				return nil
+			})
+			if errors.Is(err, ErrHostNotFound) {
+				continue
+			}
+			if err != nil {
+				return pruned, err
+			}
+		}
+		if len(fields) > 0 {
+			pruned[host.Name] = fields
+		}
+	}
+	return pruned, nil
+}
+
+// tagsField is the field the tag subcommands maintain: a sorted array of
+// distinct strings, which filters and groups match element by element.
+const tagsField = "tags"
+
+// HostTags returns the host's tags. Besides the array form it accepts the
+// comma-separated string older hosts were written with.
+func HostTags(host Host) []string {
+	return listField(host, tagsField)
+}
+
+// listField returns the elements of a list-valued field, held either as an
+// array or as a comma-separated string.
+func listField(host Host, field string) []string {
+	var elems []string
+	switch value := host.Data[field].(type) {
+	case string:
+		elems = SplitList(value)
+	case []interface{}:
+		for _, elem := range value {
+			if s, ok := elem.(string); ok {
+				elems = append(elems, s)
+			} else {
+				elems = append(elems, FormatValue(elem))
+			}
+		}
+	}
+	return elems
+}
+
+// setTags stores tags in normalized form; an empty set removes the field.
+func setTags(host *Host, tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag != "" && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	if len(normalized) == 0 {
+		delete(host.Data, tagsField)
+		return normalized
+	}
+	values := make([]interface{}, len(normalized))
+	for n, tag := range normalized {
+		values[n] = tag
+	}
+	host.Data[tagsField] = values
+	return normalized
+}
+
+// AddTags adds tags to the host and returns its resulting tags.
+func (i *Inventory) AddTags(hostName string, tags ...string) ([]string, error) {
+	var result []string
+	err := i.modifyHost(hostName, func(host *Host) error {
+		result = setTags(host, append(HostTags(*host), tags...))
+		return nil
+	})
+	return result, err
+}
+
+// RemoveTags removes tags from the host and returns its remaining tags.
+func (i *Inventory) RemoveTags(hostName string, tags ...string) ([]string, error) {
+	remove := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		remove[strings.TrimSpace(tag)] = true
+	}
+	var result []string
+	err := i.modifyHost(hostName, func(host *Host) error {
+		var kept []string
+		for _, tag := range HostTags(*host) {
+			if !remove[strings.TrimSpace(tag)] {
+				kept = append(kept, tag)
+			}
+		}
+		result = setTags(host, kept)
+		return nil
+	})
+	return result, err
+}
+
+// PatchHostData applies patch to the host's Data as a JSON merge patch
+// (RFC 7386): objects are merged recursively and null values delete keys.
+// The change is a single read-modify-write.
+func (i *Inventory) PatchHostData(hostName string, patch map[string]interface{}) error {
+	return i.PatchHostDataIfRevision(hostName, patch, 0)
+}
+
+// PatchHostDataIfRevision is PatchHostData that only writes if the host's
+// key is at modRevision, returning ErrHostChanged otherwise; 0 writes at
+// any revision.
+func (i *Inventory) PatchHostDataIfRevision(hostName string, patch map[string]interface{}, modRevision int64) error {
+	return i.modifyHostIfRevision(hostName, modRevision, func(host *Host) error {
+		mergePatch(host.Data, patch)
+		return nil
+	})
+}
+
+// mergePatch applies an RFC 7386 merge patch to target in place.
+func mergePatch(target, patch map[string]interface{}) {
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(target, key)
+		case map[string]interface{}:
+			nested, ok := target[key].(map[string]interface{})
+			if !ok {
+				nested = make(map[string]interface{})
+			}
+			mergePatch(nested, value)
+			target[key] = nested
+		default:
+			target[key] = value
+		}
+	}
+}
+
+// CloneHost creates dstName as a copy of srcName with overrides applied to
+// its fields, returning ErrHostExists if dstName already exists.
+func (i *Inventory) CloneHost(srcName, dstName string, overrides map[string]string) error {
+	return i.CopyHost(srcName, dstName, overrides, false)
+}
+
+// CopyHost is CloneHost; with force an existing destination is overwritten.
+// As with RenameHost, secret fields are sealed again for dstName.
+func (i *Inventory) CopyHost(srcName, dstName string, overrides map[string]string, force bool) error {
+	src, err := i.GetHost(srcName)
+	if err != nil {
+		return err
+	}
+	if src.Data == nil {
+		src.Data = make(map[string]interface{})
+	}
+	for field, value := range overrides {
+		src.Data[field] = value
+	}
+	if err := checkResealable(src); err != nil {
+		return err
+	}
+	if force {
+		return i.CreateHost(dstName, src.Data)
+	}
+	return i.CreateHostIfNotExists(dstName, src.Data)
+}
+
+// checkResealable refuses to store host under a new name while any of its
+// values is still sealed: a sealed value is bound to the name it was
+// sealed for, so only values opened with Secrets can be sealed again for
+// the new one.
+func checkResealable(host Host) error {
+	for _, field := range slices.Sorted(maps.Keys(host.Data)) {
+		if _, sealed := sealedValue(host.Data[field]); sealed {
+			return fmt.Errorf("host %s: %w to seal its secret field %s again for the new name", host.Name, ErrNoSecretKey, field)
+		}
+	}
+	return nil
+}
+
+// RenameHost moves a host to newName in one transaction that creates
+// newName and deletes oldName, so no reader sees both or neither. The data,
+// created_at and lease are kept; secret fields are sealed again for
+// newName, which needs Secrets. It returns ErrHostExists if newName is
+// taken, and retries like modifyHost if oldName changes concurrently. With
+// EnableAuditEntries the two entries name each other, and AuditEntries for
+// newName includes the history of oldName.
+func (i *Inventory) RenameHost(oldName, newName string) error {
+	if err := i.checkRawName(newName); err != nil {
+		return err
+	}
+	oldKey, newKey := i.hostKey(oldName), i.hostKey(newName)
+	if oldKey == newKey {
+		return fmt.Errorf("host %s: the new name is the same", oldName)
+	}
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := i.requestContext()
+		resp, err := i.kv.Get(ctx, oldKey)
+		if err != nil {
+			cancel()
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			cancel()
+			return fmt.Errorf("%w: %s", ErrHostNotFound, oldName)
+		}
+		host, err := i.unmarshalHost(resp.Kvs[0].Value)
+		if err != nil {
+			cancel()
+			return err
+		}
+		if err := checkResealable(host); err != nil {
+			cancel()
+			return err
+		}
+		host.Name = newName
+		hostJSON, err := i.encodeHost(host, host.Data)
+		if err != nil {
+			cancel()
+			return err
+		}
+		var putOpts []clientv3.OpOption
+		if lease := resp.Kvs[0].Lease; lease != 0 {
+			putOpts = append(putOpts, clientv3.WithLease(clientv3.LeaseID(lease)))
+		}
+		txn, err := i.kv.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(oldKey), "=", resp.Kvs[0].ModRevision), clientv3.Compare(clientv3.CreateRevision(newKey), "=", 0)).
+			Then(clientv3.OpPut(newKey, string(hostJSON), putOpts...), clientv3.OpDelete(oldKey)).
+			Else(clientv3.OpGet(newKey, clientv3.WithCountOnly())).
+			Commit()
+		cancel()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			return nil
+		}
+		if txn.Responses[0].GetResponseRange().Count > 0 {
+			return fmt.Errorf("%w: %s", ErrHostExists, newName)
+		}
+		if attempt == maxModifyAttempts {
+			return fmt.Errorf("%w: %s kept changing concurrently; gave up after %d attempts", ErrHostChanged, oldName, attempt)
+		}
+	}
+}
+
+func deepMerge(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			deepMerge(dstMap, srcMap)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+// NormalizeHosts rewrites every host whose stored JSON differs from its
+// canonical form (see normalizeData) and returns the names of those hosts.
+// Each rewrite is conditional on the key's ModRevision, so a host changed
+// concurrently is reported as an error rather than overwritten. With dryRun
+// nothing is written.
+func (i *Inventory) NormalizeHosts(dryRun bool) ([]string, error) {
+	ctx, cancel := i.requestContext()
+	resp, err := i.kv.Get(ctx, baseKey, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]Host, len(resp.Kvs))
+	for n, kv := range resp.Kvs {
+		if hosts[n], err = i.unmarshalHost(kv.Value); err != nil {
+			return nil, fmt.Errorf("%s: %w", i.hostNameFromKey(string(kv.Key)), err)
+		}
+	}
+	expected := expectedFieldTypes(hosts)
+	var normalized []string
+	for n, kv := range resp.Kvs {
+		host := hosts[n]
+		if host.Data != nil {
+			normalizeData(host.Data, expected)
+		}
+		hostJSON, err := i.marshalHost(host)
+		if err != nil {
+			return normalized, err
+		}
+		if bytes.Equal(hostJSON, kv.Value) {
+			continue
+		}
+		name := i.hostNameFromKey(string(kv.Key))
+		if !dryRun {
+			ctx, cancel := i.requestContext()
+			txn, err := i.kv.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision)).
+				Then(clientv3.OpPut(string(kv.Key), string(hostJSON))).
+				Commit()
+			cancel()
+			if err != nil {
+				return normalized, err
+			}
+			if !txn.Succeeded {
+				return normalized, fmt.Errorf("%w: %s, while normalizing; rerun normalize", ErrHostChanged, name)
+			}
+		}
+		normalized = append(normalized, name)
+	}
+	return normalized, nil
+}
+
+// RemoveHost deletes the host, returning ErrHostNotFound if there was
+// nothing to delete.
+func (i *Inventory) RemoveHost(hostName string) error {
+	key := i.hostKey(hostName)
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Delete(ctx, key, clientv3.WithPrevKV())
+	if err != nil {
+		return err
+	}
+	if len(resp.PrevKvs) == 0 {
+		return fmt.Errorf("%w: %s", ErrHostNotFound, hostName)
+	}
+	return nil
+}
+
+// RemoveHostIfRevision deletes the host only if its key is at
+// modRevision, returning ErrHostChanged otherwise; 0 deletes it at any
+// revision.
+func (i *Inventory) RemoveHostIfRevision(hostName string, modRevision int64) error {
+	key := i.hostKey(hostName)
+	cmp := clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)
+	if modRevision == 0 {
+		cmp = clientv3.Compare(clientv3.CreateRevision(key), ">", 0)
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Txn(ctx).
+		If(cmp).
+		Then(clientv3.OpDelete(key)).
+		Else(clientv3.OpGet(key, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if resp.Succeeded {
+		return nil
+	}
+	if resp.Responses[0].GetResponseRange().Count == 0 {
+		return fmt.Errorf("%w: %s", ErrHostNotFound, hostName)
+	}
+	return fmt.Errorf("%w: %s", ErrHostChanged, hostName)
+}
+
+// removeBatchSize is the number of deletes per transaction: a third of
+// etcd's default limit of 128 operations, leaving room for the gets the audit
+// log adds and the entries of EnableAuditEntries.
+const removeBatchSize = 42
+
+// RemoveHostsMatching deletes every host whose name matches the glob
+// pattern (as in path.Match) and returns how many were deleted.
+func (i *Inventory) RemoveHostsMatching(pattern string) (deleted int64, err error) {
+	names, err := i.HostNamesMatching(pattern, nil)
+	if err != nil {
+		return 0, err
+	}
+	return i.RemoveHosts(names)
+}
+
+// HostNamesMatching returns the names of the hosts matching both the glob
+// pattern and filter; an empty pattern or filter matches everything. The
+// pattern's literal prefix is pushed down to etcd.
+func (i *Inventory) HostNamesMatching(pattern string, filter HostFilter) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	prefix := pattern
+	if n := strings.IndexAny(pattern, `*?[\`); n >= 0 {
+		prefix = pattern[:n]
+	}
+	var candidates []string
+	if len(filter) == 0 {
+		var err error
+		if candidates, err = i.ListHostNames(prefix); err != nil {
+			return nil, err
+		}
+	} else {
+		result, err := i.ListHostsWithOptions(ListOptions{NamePrefix: prefix, Filter: filter})
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range result.Hosts {
+			candidates = append(candidates, host.Name)
+		}
+	}
+	var names []string
+	for _, name := range candidates {
+		if ok, _ := path.Match(pattern, name); ok || pattern == "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// RemoveHosts deletes the named hosts in batched transactions and returns
+// how many existed. Each batch is atomic; an error leaves earlier batches
+// deleted.
+func (i *Inventory) RemoveHosts(names []string) (deleted int64, err error) {
+	for start := 0; start < len(names); start += removeBatchSize {
+		batch := names[start:min(start+removeBatchSize, len(names))]
+		ops := make([]clientv3.Op, len(batch))
+		for n, name := range batch {
+			ops[n] = clientv3.OpDelete(i.hostKey(name))
+		}
+		ctx, cancel := i.requestContext()
+		resp, err := i.kv.Txn(ctx).Then(ops...).Commit()
+		cancel()
+		if err != nil {
+			return deleted, err
+		}
+		for _, r := range resp.Responses {
+			deleted += r.GetResponseDeleteRange().Deleted
+		}
+	}
+	return deleted, nil
+}
+
+// getBatchSize is the number of gets per transaction, etcd's default
+// --max-txn-ops. Unlike writes, gets keep their size with the audit and
+// mutation hooks, which add operations only for puts and deletes (see
+// withPrevGets).
+const getBatchSize = 128
+
+// MissingHostsError lists the names GetHosts found no host for.
+type MissingHostsError struct {
+	Names []string
+}
+
+func (e *MissingHostsError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrHostNotFound, strings.Join(e.Names, ", "))
+}
+
+func (e *MissingHostsError) Unwrap() error { return ErrHostNotFound }
+
+// GetHosts returns the named hosts, in the order named, reading up to
+// getBatchSize per transaction so each batch costs one round trip and is a
+// consistent snapshot. Names without a host are left out and reported
+// together in a *MissingHostsError, returned alongside the hosts found.
+func (i *Inventory) GetHosts(names []string) ([]Host, error) {
+	var hosts []Host
+	var missing []string
+	for start := 0; start < len(names); start += getBatchSize {
+		batch := names[start:min(start+getBatchSize, len(names))]
+		ops := make([]clientv3.Op, len(batch))
+		for n, name := range batch {
+			ops[n] = clientv3.OpGet(i.hostKey(name))
+		}
+		ctx, cancel := i.requestContext()
+		resp, err := i.kv.Txn(ctx).Then(ops...).Commit()
+		cancel()
+		if err != nil {
+			return hosts, err
+		}
+		for n, r := range resp.Responses {
+			kvs := r.GetResponseRange().Kvs
+			if len(kvs) == 0 {
+				missing = append(missing, batch[n])
+				continue
+			}
+			host, err := i.unmarshalHost(kvs[0].Value)
+			if err != nil {
+				return hosts, &MalformedHostError{Key: string(kvs[0].Key), Err: err}
+			}
+			if host.Name == "" {
+				host.Name = batch[n]
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	if len(missing) > 0 {
+		return hosts, &MissingHostsError{Names: missing}
+	}
+	return hosts, nil
+}
@@ -0,0 +1,379 @@
+package inventory
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// What ImportHosts does with a host that already exists.
+const (
+	ImportReplace = "replace"
+	ImportSkip    = "skip"
+	ImportMerge   = "merge"
+)
+
+// DefaultImportBatch is the number of hosts an import writes per
+// transaction by default. etcd refuses transactions of more than
+// --max-txn-ops operations, 128 by default, and audit and mutation hooks
+// each double the operations of a transaction, so 32 hosts fit with both.
+const DefaultImportBatch = 32
+
+// ImportHosts writes hosts in one transaction, so a batch is written
+// entirely or not at all. onConflict decides what happens to a host that
+// exists: ImportReplace overwrites it, ImportSkip leaves it and ImportMerge
+// merges the new data in as MergeHostData does. A host with a revision in
+// revisions is only replaced if it is still at that revision. It returns
+// what was done to each host, in order: created, replaced, merged or
+// skipped. Hosts that cannot be written, such as those changed since their
+// revision (ErrHostChanged) or invalid ones, are left out of the
+// transaction with their error in errs; err fails the whole batch.
+func (i *Inventory) ImportHosts(hosts []Host, onConflict string, revisions map[string]int64) (actions []string, errs []error, err error) {
+	for attempt := 1; ; attempt++ {
+		actions, errs = make([]string, len(hosts)), make([]error, len(hosts))
+		ctx, cancel := i.requestContext()
+		gets := make([]clientv3.Op, len(hosts))
+		for n, host := range hosts {
+			gets[n] = clientv3.OpGet(i.hostKey(host.Name))
+		}
+		read, err := i.kv.Txn(ctx).Then(gets...).Commit()
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		var cmps []clientv3.Cmp
+		var puts []clientv3.Op
+		seen := make(map[string]bool, len(hosts))
+		for n, host := range hosts {
+			var existing *mvccpb.KeyValue
+			if kvs := read.Responses[n].GetResponseRange().Kvs; len(kvs) > 0 {
+				existing = kvs[0]
+			}
+			if seen[host.Name] {
+				errs[n] = fmt.Errorf("host %s appears more than once in the batch", host.Name)
+				continue
+			}
+			seen[host.Name] = true
+			var put clientv3.Op
+			actions[n], put, errs[n] = i.importOp(host, existing, onConflict, revisions[host.Name])
+			if errs[n] != nil || actions[n] == "skipped" {
+				continue
+			}
+			key := i.hostKey(host.Name)
+			if existing == nil {
+				cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
+			} else {
+				cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", existing.ModRevision))
+			}
+			puts = append(puts, put)
+		}
+		if len(puts) == 0 {
+			cancel()
+			return actions, errs, nil
+		}
+		txn, err := i.kv.Txn(ctx).If(cmps...).Then(puts...).Commit()
+		cancel()
+		if err != nil {
+			return nil, nil, err
+		}
+		if txn.Succeeded {
+			return actions, errs, nil
+		}
+		if attempt == maxModifyAttempts {
+			return nil, nil, fmt.Errorf("%w: hosts of the batch kept changing concurrently; gave up after %d attempts", ErrHostChanged, attempt)
+		}
+	}
+}
+
+// importOp returns what ImportHosts does to host, given the stored key
+// (nil if there is none), and the put that does it.
+func (i *Inventory) importOp(host Host, existing *mvccpb.KeyValue, onConflict string, modRevision int64) (string, clientv3.Op, error) {
+	if err := i.checkRawName(host.Name); err != nil {
+		return "", clientv3.Op{}, err
+	}
+	key := i.hostKey(host.Name)
+	if onConflict == ImportReplace && modRevision != 0 && (existing == nil || existing.ModRevision != modRevision) {
+		return "", clientv3.Op{}, fmt.Errorf("%w: %s", ErrHostChanged, host.Name)
+	}
+	action := "created"
+	var opts []clientv3.OpOption
+	var prev map[string]interface{}
+	switch {
+	case existing == nil:
+		host = i.WriteRules.applyHost(host)
+	case onConflict == ImportSkip:
+		return "skipped", clientv3.Op{}, nil
+	case onConflict == ImportMerge:
+		stored, err := i.unmarshalHost(existing.Value)
+		if err != nil {
+			return "", clientv3.Op{}, fmt.Errorf("host %s: %w", host.Name, err)
+		}
+		if stored.Data == nil {
+			stored.Data = make(map[string]interface{})
+		}
+		prev = maps.Clone(stored.Data)
+		deepMerge(stored.Data, host.Data)
+		for field := range host.Data {
+			i.WriteRules.set(stored.Data, field, stored.Data[field])
+		}
+		action, host = "merged", stored
+		// As in modifyHost, a merge keeps the key's lease.
+		if existing.Lease != 0 {
+			opts = append(opts, clientv3.WithLease(clientv3.LeaseID(existing.Lease)))
+		}
+	default:
+		action, host = "replaced", i.WriteRules.applyHost(host)
+		if stored, err := i.unmarshalHost(existing.Value); err == nil {
+			prev = stored.Data
+		}
+	}
+	hostJSON, err := i.encodeHost(host, prev)
+	if err != nil {
+		return "", clientv3.Op{}, err
+	}
+	return action, clientv3.OpPut(key, string(hostJSON), opts...), nil
+}
+
+// Export files start with a one-line JSON header carrying the format
+// version and the SHA-256 of everything after it, so a truncated or edited
+// file is refused on import.
+const (
+	exportFormat  = "inventory-export"
+	exportVersion = 1
+)
+
+type exportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	SHA256  string `json:"sha256"`
+}
+
+// exportHost is a host as written to an export file. ModRevision, if
+// recorded, is the ModRevision of the host's key when it was exported.
+type exportHost struct {
+	Name        string                 `json:"name"`
+	Data        map[string]interface{} `json:"data"`
+	ModRevision int64                  `json:"mod_revision,omitempty"`
+}
+
+// EncodeExport writes hosts as an export file. With revisions, each host's
+// ModRevision is recorded too, so an import of the edited file can refuse
+// to overwrite hosts changed since (see UpdateHostIfRevision). Secret
+// fields are written sealed, as they are stored.
+func (i *Inventory) EncodeExport(hosts []Host, revisions map[string]int64) ([]byte, error) {
+	hosts, err := i.SealSecrets(hosts)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]exportHost, len(hosts))
+	for n, host := range hosts {
+		encoded[n] = exportHost{Name: host.Name, Data: EncodeBinaryValues(host.Data), ModRevision: revisions[host.Name]}
+	}
+	body, err := json.MarshalIndent(encoded, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	header, err := json.Marshal(exportHeader{Format: exportFormat, Version: exportVersion, SHA256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		return nil, err
+	}
+	return append(append(header, '\n'), body...), nil
+}
+
+// DecodeExport parses an export file, returning its hosts and the
+// ModRevisions recorded for them, by name. With verify unset the header
+// checks are skipped, and a bare JSON host array without a header is
+// accepted. With strict set, a host with a top-level key other than name,
+// data and mod_revision is refused instead of the key being ignored.
+func DecodeExport(data []byte, verify, strict bool) ([]Host, map[string]int64, error) {
+	body := data
+	line, rest, found := bytes.Cut(data, []byte("\n"))
+	header := exportHeader{}
+	hasHeader := found && json.Unmarshal(line, &header) == nil && header.Format == exportFormat
+	if hasHeader {
+		body = rest
+	}
+	if verify {
+		if !hasHeader {
+			return nil, nil, errors.New("missing export header (use --no-verify to import anyway)")
+		}
+		if header.Version != exportVersion {
+			return nil, nil, fmt.Errorf("unsupported export version %d (expected %d)", header.Version, exportVersion)
+		}
+		sum := sha256.Sum256(body)
+		if got := hex.EncodeToString(sum[:]); got != header.SHA256 {
+			return nil, nil, fmt.Errorf("checksum mismatch: header says %s, body is %s; the file is truncated or was modified", header.SHA256, got)
+		}
+	}
+	decoded := make([]exportHost, 0)
+	if strict {
+		var err error
+		if decoded, err = decodeHostsStrict(body); err != nil {
+			return nil, nil, err
+		}
+	} else if err := json.Unmarshal(body, &decoded); err != nil {
+		return nil, nil, err
+	}
+	hosts := make([]Host, len(decoded))
+	revisions := make(map[string]int64)
+	for i, host := range decoded {
+		hosts[i] = Host{Name: host.Name, Data: DecodeBinaryValues(host.Data)}
+		if host.ModRevision != 0 {
+			revisions[host.Name] = host.ModRevision
+		}
+	}
+	return hosts, revisions, nil
+}
+
+// DecodeYAMLHosts parses a YAML sequence of hosts with name and data keys,
+// as the yaml output format writes them. Values are read as JSON would
+// read them, so numbers are float64 and timestamps strings.
+func DecodeYAMLHosts(data []byte) ([]Host, error) {
+	var decoded []struct {
+		Name string                 `yaml:"name" json:"name"`
+		Data map[string]interface{} `yaml:"data" json:"data"`
+	}
+	if err := yaml.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(decoded)
+	if err != nil {
+		return nil, err
+	}
+	var normalized []exportHost
+	if err := json.Unmarshal(b, &normalized); err != nil {
+		return nil, err
+	}
+	hosts := make([]Host, len(normalized))
+	for n, host := range normalized {
+		hosts[n] = Host{Name: host.Name, Data: DecodeBinaryValues(host.Data)}
+	}
+	return hosts, nil
+}
+
+// decodeHostsStrict parses a JSON host array, failing on the first host
+// with an unknown field and naming it by position and, if it has one,
+// name.
+func decodeHostsStrict(body []byte) ([]exportHost, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	hosts := make([]exportHost, len(raw))
+	for n, elem := range raw {
+		dec := json.NewDecoder(bytes.NewReader(elem))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&hosts[n]); err != nil {
+			var named struct {
+				Name string `json:"name"`
+			}
+			if json.Unmarshal(elem, &named) == nil && named.Name != "" {
+				return nil, fmt.Errorf("host %d (%q): %w", n+1, named.Name, err)
+			}
+			return nil, fmt.Errorf("host %d: %w", n+1, err)
+		}
+	}
+	return hosts, nil
+}
+
+// DecodeCSVHosts reads hosts from CSV. Output of the csv, rfc4180-csv and
+// typed-csv formats ("Host Name", optionally "Host Data Type", "Host Data")
+// is read back as written. Any other header is taken as a name column
+// followed by one column per field, where "field:Type" declares the type
+// (as named by TypeName) the cells are coerced to, and empty cells are left
+// out. With infer, the cells of fields without a type are read as JSON
+// import would: true and false as booleans, JSON numbers as numbers and
+// anything else, such as 007 or 1e, as a string; without it they are all
+// strings.
+func DecodeCSVHosts(r io.Reader, infer bool) ([]Host, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("CSV has no header row")
+	}
+	header, rows := records[0], records[1:]
+	hosts := make([]Host, 0, len(rows))
+
+	if header[0] == "Host Name" && header[len(header)-1] == "Host Data" && len(header) <= 3 {
+		for n, row := range rows {
+			dataType := "JSON"
+			if len(row) == 3 {
+				dataType = row[1]
+			}
+			value, err := xmlField{Type: dataType, Value: row[len(row)-1]}.decode()
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %w", n+2, err)
+			}
+			data, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("row %d: host data is %s, not a JSON object", n+2, TypeName(value))
+			}
+			hosts = append(hosts, Host{Name: row[0], Data: data})
+		}
+		return hosts, nil
+	}
+
+	fields := make([]xmlField, len(header))
+	for col, name := range header[1:] {
+		field, typeName, _ := strings.Cut(name, ":")
+		fields[col+1] = xmlField{Name: field, Type: typeName}
+	}
+	for n, row := range rows {
+		host := Host{Name: row[0], Data: make(map[string]interface{})}
+		for col, cell := range row[1:] {
+			if cell == "" {
+				continue
+			}
+			field := fields[col+1]
+			field.Value = cell
+			if field.Type == "" {
+				host.Data[field.Name] = csvCellValue(cell, infer)
+				continue
+			}
+			value, err := field.decode()
+			if err != nil {
+				return nil, fmt.Errorf("row %d, field %s: %w", n+2, field.Name, err)
+			}
+			host.Data[field.Name] = value
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// jsonNumber matches the numbers of the JSON grammar.
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// csvCellValue returns an untyped CSV cell as DecodeCSVHosts reads it.
+func csvCellValue(cell string, infer bool) interface{} {
+	if !infer {
+		return cell
+	}
+	switch {
+	case cell == "true":
+		return true
+	case cell == "false":
+		return false
+	case jsonNumber.MatchString(cell):
+		if n, err := strconv.ParseFloat(cell, 64); err == nil {
+			return n
+		}
+	}
+	return cell
+}
@@ -0,0 +1,942 @@
+// Package etcdtest runs an in-memory etcd server for tests and examples:
+// the KV, Watch, Lease, Cluster and Maintenance services of a single
+// member, served over gRPC on a loopback port so the real client talks to
+// it. It keeps the history of every key for reads at a revision and for
+// watches, compacts like etcd, and refuses transactions over etcd's
+// default --max-txn-ops, so tests see the limits a real cluster imposes.
+package etcdtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+)
+
+// DefaultMaxTxnOps is etcd's default --max-txn-ops.
+const DefaultMaxTxnOps = 128
+
+// Version is the etcd version the server reports.
+const Version = "3.5.17"
+
+// Server is an in-memory etcd member.
+type Server struct {
+	// MaxTxnOps is the most operations a transaction may have in its
+	// comparisons or either branch, as etcd's --max-txn-ops.
+	MaxTxnOps int
+	// Fault, when set, is called before every KV request with applied
+	// false, and again with applied true once a request has made its
+	// changes. An error it returns fails the request; after applied, its
+	// changes stay made, as when a client loses the reply.
+	Fault func(method string, applied bool) error
+
+	mu        sync.Mutex
+	rev       int64
+	compacted int64
+	// history holds the versions of every key, oldest first; a deleted
+	// key ends with a tombstone.
+	history map[string][]version
+	// events are the changes from compacted on, in revision order, with
+	// the previous value of each key.
+	events []*mvccpb.Event
+	// changed is closed and replaced on every change, waking the watches.
+	changed   chan struct{}
+	leases    map[int64]*lease
+	nextLease int64
+
+	listener net.Listener
+	server   *grpc.Server
+}
+
+// version is one revision of a key: its value, or a tombstone.
+type version struct {
+	kv      *mvccpb.KeyValue
+	deleted bool
+}
+
+func (v version) rev() int64 { return v.kv.ModRevision }
+
+type lease struct {
+	ttl     int64
+	renewed time.Time
+	keys    map[string]bool
+}
+
+// New starts a server on a loopback port.
+func New() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		MaxTxnOps: DefaultMaxTxnOps,
+		rev:       1,
+		history:   make(map[string][]version),
+		changed:   make(chan struct{}),
+		leases:    make(map[int64]*lease),
+		listener:  listener,
+		server:    grpc.NewServer(),
+	}
+	pb.RegisterKVServer(s.server, kvServer{s})
+	pb.RegisterWatchServer(s.server, watchServer{s})
+	pb.RegisterLeaseServer(s.server, leaseServer{s})
+	pb.RegisterClusterServer(s.server, clusterServer{s})
+	pb.RegisterMaintenanceServer(s.server, maintenanceServer{s})
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+// Start starts a server and a client of it for t, closing both when t
+// ends.
+func Start(t testing.TB) (*Server, *clientv3.Client) {
+	t.Helper()
+	s, err := New()
+	if err != nil {
+		t.Fatalf("starting etcd: %v", err)
+	}
+	t.Cleanup(s.Close)
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{s.Endpoint()}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("connecting to etcd: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return s, client
+}
+
+// Endpoint returns the address clients connect to.
+func (s *Server) Endpoint() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server, ending its watches.
+func (s *Server) Close() {
+	s.server.Stop()
+}
+
+// Revision returns the current revision.
+func (s *Server) Revision() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rev
+}
+
+// Keys returns the current value of every key, for assertions.
+func (s *Server) Keys() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make(map[string]string)
+	for key, versions := range s.history {
+		if last := versions[len(versions)-1]; !last.deleted {
+			keys[key] = string(last.kv.Value)
+		}
+	}
+	return keys
+}
+
+func (s *Server) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{ClusterId: 1, MemberId: 1, Revision: s.rev, RaftTerm: 1}
+}
+
+// fault calls Fault, if set.
+func (s *Server) fault(method string, applied bool) error {
+	if s.Fault == nil {
+		return nil
+	}
+	return s.Fault(method, applied)
+}
+
+// inRange reports whether key is in the range of key and end as etcd
+// requests give it: the key alone without end, every key from key on
+// for end "\x00", and [key, end) otherwise.
+func inRange(k, key, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return bytes.Equal(k, key)
+	case len(end) == 1 && end[0] == 0:
+		return bytes.Compare(k, key) >= 0
+	}
+	return bytes.Compare(k, key) >= 0 && bytes.Compare(k, end) < 0
+}
+
+// at returns the value of key at rev, or nil if it did not exist.
+func (s *Server) at(key string, rev int64) *mvccpb.KeyValue {
+	versions := s.history[key]
+	for n := len(versions) - 1; n >= 0; n-- {
+		if versions[n].rev() <= rev {
+			if versions[n].deleted {
+				return nil
+			}
+			return versions[n].kv
+		}
+	}
+	return nil
+}
+
+// rangeKeys returns the values in a range at rev, by key.
+func (s *Server) rangeKeys(key, end []byte, rev int64) []*mvccpb.KeyValue {
+	var kvs []*mvccpb.KeyValue
+	for k := range s.history {
+		if !inRange([]byte(k), key, end) {
+			continue
+		}
+		if kv := s.at(k, rev); kv != nil {
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Slice(kvs, func(a, b int) bool { return bytes.Compare(kvs[a].Key, kvs[b].Key) < 0 })
+	return kvs
+}
+
+func (s *Server) doRange(r *pb.RangeRequest) (*pb.RangeResponse, error) {
+	rev := s.rev
+	if r.Revision > 0 {
+		if r.Revision < s.compacted {
+			return nil, rpctypes.ErrGRPCCompacted
+		}
+		if r.Revision > s.rev {
+			return nil, rpctypes.ErrGRPCFutureRev
+		}
+		rev = r.Revision
+	}
+	all := s.rangeKeys(r.Key, r.RangeEnd, rev)
+	resp := &pb.RangeResponse{Header: s.header(), Count: int64(len(all))}
+	if r.CountOnly {
+		return resp, nil
+	}
+	var kvs []*mvccpb.KeyValue
+	for _, kv := range all {
+		switch {
+		case r.MinModRevision > 0 && kv.ModRevision < r.MinModRevision,
+			r.MaxModRevision > 0 && kv.ModRevision > r.MaxModRevision,
+			r.MinCreateRevision > 0 && kv.CreateRevision < r.MinCreateRevision,
+			r.MaxCreateRevision > 0 && kv.CreateRevision > r.MaxCreateRevision:
+			continue
+		}
+		kvs = append(kvs, kv)
+	}
+	order := r.SortOrder
+	if order == pb.RangeRequest_NONE && r.SortTarget != pb.RangeRequest_KEY {
+		order = pb.RangeRequest_ASCEND
+	}
+	if order != pb.RangeRequest_NONE {
+		less := func(a, b *mvccpb.KeyValue) bool {
+			switch r.SortTarget {
+			case pb.RangeRequest_VERSION:
+				return a.Version < b.Version
+			case pb.RangeRequest_CREATE:
+				return a.CreateRevision < b.CreateRevision
+			case pb.RangeRequest_MOD:
+				return a.ModRevision < b.ModRevision
+			case pb.RangeRequest_VALUE:
+				return bytes.Compare(a.Value, b.Value) < 0
+			}
+			return bytes.Compare(a.Key, b.Key) < 0
+		}
+		sort.SliceStable(kvs, func(a, b int) bool {
+			if order == pb.RangeRequest_DESCEND {
+				return less(kvs[b], kvs[a])
+			}
+			return less(kvs[a], kvs[b])
+		})
+	}
+	if r.Limit > 0 && int64(len(kvs)) > r.Limit {
+		kvs = kvs[:r.Limit]
+		resp.More = true
+	}
+	for _, kv := range kvs {
+		kv := *kv
+		if r.KeysOnly {
+			kv.Value = nil
+		}
+		resp.Kvs = append(resp.Kvs, &kv)
+	}
+	return resp, nil
+}
+
+// record appends a version of key and its event.
+func (s *Server) record(key string, v version, prev *mvccpb.KeyValue) {
+	s.history[key] = append(s.history[key], v)
+	event := &mvccpb.Event{Type: mvccpb.PUT, Kv: v.kv, PrevKv: prev}
+	if v.deleted {
+		event.Type = mvccpb.DELETE
+	}
+	s.events = append(s.events, event)
+}
+
+// notify wakes the watches after a change.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) doPut(r *pb.PutRequest, rev int64) (*pb.PutResponse, error) {
+	key := string(r.Key)
+	prev := s.at(key, rev)
+	kv := &mvccpb.KeyValue{Key: r.Key, Value: r.Value, ModRevision: rev, CreateRevision: rev, Version: 1, Lease: r.Lease}
+	if r.IgnoreValue || r.IgnoreLease {
+		if prev == nil {
+			return nil, rpctypes.ErrGRPCKeyNotFound
+		}
+		if r.IgnoreValue {
+			kv.Value = prev.Value
+		}
+		if r.IgnoreLease {
+			kv.Lease = prev.Lease
+		}
+	}
+	if kv.Lease != 0 && s.leases[kv.Lease] == nil {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	if prev != nil {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+		if l := s.leases[prev.Lease]; l != nil {
+			delete(l.keys, key)
+		}
+	}
+	if l := s.leases[kv.Lease]; l != nil {
+		l.keys[key] = true
+	}
+	s.record(key, version{kv: kv}, prev)
+	resp := &pb.PutResponse{}
+	if r.PrevKv {
+		resp.PrevKv = prev
+	}
+	return resp, nil
+}
+
+func (s *Server) doDelete(r *pb.DeleteRangeRequest, rev int64) *pb.DeleteRangeResponse {
+	resp := &pb.DeleteRangeResponse{}
+	for _, prev := range s.rangeKeys(r.Key, r.RangeEnd, rev) {
+		key := string(prev.Key)
+		if l := s.leases[prev.Lease]; l != nil {
+			delete(l.keys, key)
+		}
+		s.record(key, version{kv: &mvccpb.KeyValue{Key: prev.Key, ModRevision: rev}, deleted: true}, prev)
+		resp.Deleted++
+		if r.PrevKv {
+			resp.PrevKvs = append(resp.PrevKvs, prev)
+		}
+	}
+	return resp
+}
+
+// checkTxn refuses transactions etcd would: over MaxTxnOps, or writing a
+// key twice in one branch.
+func (s *Server) checkTxn(r *pb.TxnRequest) error {
+	if len(r.Compare) > s.MaxTxnOps || len(r.Success) > s.MaxTxnOps || len(r.Failure) > s.MaxTxnOps {
+		return rpctypes.ErrGRPCTooManyOps
+	}
+	for _, branch := range [][]*pb.RequestOp{r.Success, r.Failure} {
+		puts := make(map[string]bool)
+		var deletes []*pb.DeleteRangeRequest
+		for _, op := range branch {
+			switch req := op.Request.(type) {
+			case *pb.RequestOp_RequestPut:
+				if puts[string(req.RequestPut.Key)] {
+					return rpctypes.ErrGRPCDuplicateKey
+				}
+				puts[string(req.RequestPut.Key)] = true
+			case *pb.RequestOp_RequestDeleteRange:
+				deletes = append(deletes, req.RequestDeleteRange)
+			case *pb.RequestOp_RequestTxn:
+				if err := s.checkTxn(req.RequestTxn); err != nil {
+					return err
+				}
+			}
+		}
+		for _, d := range deletes {
+			for key := range puts {
+				if inRange([]byte(key), d.Key, d.RangeEnd) {
+					return rpctypes.ErrGRPCDuplicateKey
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// compare evaluates one comparison against the current values.
+func (s *Server) compare(c *pb.Compare) bool {
+	kvs := s.rangeKeys(c.Key, c.RangeEnd, s.rev)
+	if len(kvs) == 0 {
+		if c.Target == pb.Compare_VALUE {
+			return false
+		}
+		kvs = []*mvccpb.KeyValue{{}}
+	}
+	for _, kv := range kvs {
+		var result int
+		switch c.Target {
+		case pb.Compare_VERSION:
+			result = compareInt(kv.Version, c.GetVersion())
+		case pb.Compare_CREATE:
+			result = compareInt(kv.CreateRevision, c.GetCreateRevision())
+		case pb.Compare_MOD:
+			result = compareInt(kv.ModRevision, c.GetModRevision())
+		case pb.Compare_VALUE:
+			result = bytes.Compare(kv.Value, c.GetValue())
+		case pb.Compare_LEASE:
+			result = compareInt(kv.Lease, c.GetLease())
+		}
+		var ok bool
+		switch c.Result {
+		case pb.Compare_EQUAL:
+			ok = result == 0
+		case pb.Compare_NOT_EQUAL:
+			ok = result != 0
+		case pb.Compare_GREATER:
+			ok = result > 0
+		case pb.Compare_LESS:
+			ok = result < 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// doTxn runs a transaction whose writes are made at rev.
+func (s *Server) doTxn(r *pb.TxnRequest, rev int64) (*pb.TxnResponse, error) {
+	succeeded := true
+	for _, c := range r.Compare {
+		if !s.compare(c) {
+			succeeded = false
+			break
+		}
+	}
+	ops := r.Success
+	if !succeeded {
+		ops = r.Failure
+	}
+	resp := &pb.TxnResponse{Succeeded: succeeded}
+	for _, op := range ops {
+		var result *pb.ResponseOp
+		switch req := op.Request.(type) {
+		case *pb.RequestOp_RequestRange:
+			// Reads see the writes made before them in the transaction.
+			read := *req.RequestRange
+			if read.Revision == 0 {
+				read.Revision = rev
+			}
+			saved := s.rev
+			s.rev = rev
+			got, err := s.doRange(&read)
+			s.rev = saved
+			if err != nil {
+				return nil, err
+			}
+			result = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseRange{ResponseRange: got}}
+		case *pb.RequestOp_RequestPut:
+			got, err := s.doPut(req.RequestPut, rev)
+			if err != nil {
+				return nil, err
+			}
+			result = &pb.ResponseOp{Response: &pb.ResponseOp_ResponsePut{ResponsePut: got}}
+		case *pb.RequestOp_RequestDeleteRange:
+			got := s.doDelete(req.RequestDeleteRange, rev)
+			result = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: got}}
+		case *pb.RequestOp_RequestTxn:
+			got, err := s.doTxn(req.RequestTxn, rev)
+			if err != nil {
+				return nil, err
+			}
+			result = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseTxn{ResponseTxn: got}}
+		}
+		resp.Responses = append(resp.Responses, result)
+	}
+	return resp, nil
+}
+
+// snapshot and restore let a failed write undo its partial changes.
+type snapshot struct {
+	lengths map[string]int
+	events  int
+	leases  map[int64]map[string]bool
+}
+
+func (s *Server) snapshot() snapshot {
+	snap := snapshot{lengths: make(map[string]int, len(s.history)), events: len(s.events), leases: make(map[int64]map[string]bool)}
+	for key, versions := range s.history {
+		snap.lengths[key] = len(versions)
+	}
+	for id, l := range s.leases {
+		keys := make(map[string]bool, len(l.keys))
+		for key := range l.keys {
+			keys[key] = true
+		}
+		snap.leases[id] = keys
+	}
+	return snap
+}
+
+func (s *Server) restore(snap snapshot) {
+	for key, versions := range s.history {
+		if n, ok := snap.lengths[key]; ok {
+			s.history[key] = versions[:n]
+		} else {
+			delete(s.history, key)
+		}
+	}
+	s.events = s.events[:snap.events]
+	for id, keys := range snap.leases {
+		if l := s.leases[id]; l != nil {
+			l.keys = keys
+		}
+	}
+}
+
+// expireLeases revokes the leases whose TTL ran out since they were last
+// renewed.
+func (s *Server) expireLeases() {
+	now := time.Now()
+	var expired []int64
+	for id, l := range s.leases {
+		if now.Sub(l.renewed) >= time.Duration(l.ttl)*time.Second {
+			expired = append(expired, id)
+		}
+	}
+	sort.Slice(expired, func(a, b int) bool { return expired[a] < expired[b] })
+	for _, id := range expired {
+		s.revoke(id)
+	}
+}
+
+// revoke deletes a lease and its keys at the next revision.
+func (s *Server) revoke(id int64) {
+	l := s.leases[id]
+	delete(s.leases, id)
+	if len(l.keys) == 0 {
+		return
+	}
+	rev := s.rev + 1
+	keys := make([]string, 0, len(l.keys))
+	for key := range l.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if prev := s.at(key, s.rev); prev != nil {
+			s.record(key, version{kv: &mvccpb.KeyValue{Key: []byte(key), ModRevision: rev}, deleted: true}, prev)
+		}
+	}
+	s.rev = rev
+	s.notify()
+}
+
+// write runs a KV request that may change keys, with the Fault hooks,
+// and advances the revision if it did. It returns the header as of the
+// request, not of whatever a Fault wrote after it.
+func (s *Server) write(method string, apply func(rev int64) error) (*pb.ResponseHeader, error) {
+	if err := s.fault(method, false); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.expireLeases()
+	snap := s.snapshot()
+	err := apply(s.rev + 1)
+	switch {
+	case err != nil:
+		s.restore(snap)
+	case len(s.events) > snap.events:
+		s.rev++
+		s.notify()
+	}
+	header := s.header()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return header, s.fault(method, true)
+}
+
+type kvServer struct{ s *Server }
+
+func (k kvServer) Range(ctx context.Context, r *pb.RangeRequest) (*pb.RangeResponse, error) {
+	s := k.s
+	if err := s.fault("range", false); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.expireLeases()
+	resp, err := s.doRange(r)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return resp, s.fault("range", true)
+}
+
+func (k kvServer) Put(ctx context.Context, r *pb.PutRequest) (resp *pb.PutResponse, err error) {
+	header, err := k.s.write("put", func(rev int64) (err error) {
+		resp, err = k.s.doPut(r, rev)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = header
+	return resp, nil
+}
+
+func (k kvServer) DeleteRange(ctx context.Context, r *pb.DeleteRangeRequest) (resp *pb.DeleteRangeResponse, err error) {
+	header, err := k.s.write("delete", func(rev int64) error {
+		resp = k.s.doDelete(r, rev)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = header
+	return resp, nil
+}
+
+func (k kvServer) Txn(ctx context.Context, r *pb.TxnRequest) (resp *pb.TxnResponse, err error) {
+	if err := k.s.checkTxn(r); err != nil {
+		return nil, err
+	}
+	header, err := k.s.write("txn", func(rev int64) (err error) {
+		resp, err = k.s.doTxn(r, rev)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(resp, header)
+	return resp, nil
+}
+
+// setHeaders sets the header of a transaction's response and of the
+// responses nested in it.
+func setHeaders(resp *pb.TxnResponse, header *pb.ResponseHeader) {
+	resp.Header = header
+	for _, op := range resp.Responses {
+		switch r := op.Response.(type) {
+		case *pb.ResponseOp_ResponseRange:
+			r.ResponseRange.Header = header
+		case *pb.ResponseOp_ResponsePut:
+			r.ResponsePut.Header = header
+		case *pb.ResponseOp_ResponseDeleteRange:
+			r.ResponseDeleteRange.Header = header
+		case *pb.ResponseOp_ResponseTxn:
+			setHeaders(r.ResponseTxn, header)
+		}
+	}
+}
+
+func (s *Server) lockedHeader() *pb.ResponseHeader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.header()
+}
+
+func (k kvServer) Compact(ctx context.Context, r *pb.CompactionRequest) (*pb.CompactionResponse, error) {
+	s := k.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Revision <= s.compacted {
+		return nil, rpctypes.ErrGRPCCompacted
+	}
+	if r.Revision > s.rev {
+		return nil, rpctypes.ErrGRPCFutureRev
+	}
+	s.compacted = r.Revision
+	for key, versions := range s.history {
+		keep := 0
+		for n, v := range versions {
+			if v.rev() <= r.Revision {
+				keep = n
+			}
+		}
+		versions = versions[keep:]
+		if versions[0].rev() <= r.Revision && versions[0].deleted {
+			versions = versions[1:]
+		}
+		if len(versions) == 0 {
+			delete(s.history, key)
+		} else {
+			s.history[key] = versions
+		}
+	}
+	n := sort.Search(len(s.events), func(n int) bool { return s.events[n].Kv.ModRevision >= r.Revision })
+	s.events = s.events[n:]
+	return &pb.CompactionResponse{Header: s.header()}, nil
+}
+
+type watchServer struct{ s *Server }
+
+func (w watchServer) Watch(stream pb.Watch_WatchServer) error {
+	s := w.s
+	var sendMu sync.Mutex
+	send := func(resp *pb.WatchResponse) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(resp)
+	}
+	cancels := make(map[int64]context.CancelFunc)
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	var nextID int64
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		switch r := req.RequestUnion.(type) {
+		case *pb.WatchRequest_CreateRequest:
+			create := r.CreateRequest
+			id := nextID
+			nextID++
+			s.mu.Lock()
+			header, compacted, start := s.header(), s.compacted, create.StartRevision
+			if start == 0 {
+				start = s.rev + 1
+			}
+			s.mu.Unlock()
+			if err := send(&pb.WatchResponse{Header: header, WatchId: id, Created: true}); err != nil {
+				return nil
+			}
+			if start < compacted {
+				send(&pb.WatchResponse{Header: header, WatchId: id, Canceled: true, CompactRevision: compacted, CancelReason: "mvcc: required revision has been compacted"})
+				continue
+			}
+			ctx, cancel := context.WithCancel(stream.Context())
+			cancels[id] = cancel
+			go s.serveWatch(ctx, id, create, start, send)
+		case *pb.WatchRequest_CancelRequest:
+			id := r.CancelRequest.WatchId
+			if cancel, ok := cancels[id]; ok {
+				cancel()
+				delete(cancels, id)
+				send(&pb.WatchResponse{Header: s.lockedHeader(), WatchId: id, Canceled: true})
+			}
+		case *pb.WatchRequest_ProgressRequest:
+			send(&pb.WatchResponse{Header: s.lockedHeader(), WatchId: -1})
+		}
+	}
+}
+
+// serveWatch sends the events of one watch from revision next on until
+// ctx is done.
+func (s *Server) serveWatch(ctx context.Context, id int64, create *pb.WatchCreateRequest, next int64, send func(*pb.WatchResponse) error) {
+	filtered := make(map[pb.WatchCreateRequest_FilterType]bool)
+	for _, filter := range create.Filters {
+		filtered[filter] = true
+	}
+	for {
+		s.mu.Lock()
+		if next < s.compacted {
+			header, compacted := s.header(), s.compacted
+			s.mu.Unlock()
+			send(&pb.WatchResponse{Header: header, WatchId: id, Canceled: true, CompactRevision: compacted})
+			return
+		}
+		var events []*mvccpb.Event
+		for _, event := range s.events {
+			if event.Kv.ModRevision < next || !inRange(event.Kv.Key, create.Key, create.RangeEnd) {
+				continue
+			}
+			if (event.Type == mvccpb.PUT && filtered[pb.WatchCreateRequest_NOPUT]) || (event.Type == mvccpb.DELETE && filtered[pb.WatchCreateRequest_NODELETE]) {
+				continue
+			}
+			sent := *event
+			if !create.PrevKv {
+				sent.PrevKv = nil
+			}
+			events = append(events, &sent)
+		}
+		header, changed := s.header(), s.changed
+		next = s.rev + 1
+		s.mu.Unlock()
+		if len(events) > 0 {
+			if err := send(&pb.WatchResponse{Header: header, WatchId: id, Events: events}); err != nil {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+type leaseServer struct{ s *Server }
+
+func (l leaseServer) LeaseGrant(ctx context.Context, r *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
+	s := l.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := r.ID
+	if id == 0 {
+		s.nextLease++
+		id = s.nextLease
+	}
+	if s.leases[id] != nil {
+		return nil, rpctypes.ErrGRPCLeaseExist
+	}
+	s.leases[id] = &lease{ttl: r.TTL, renewed: time.Now(), keys: make(map[string]bool)}
+	return &pb.LeaseGrantResponse{Header: s.header(), ID: id, TTL: r.TTL}, nil
+}
+
+func (l leaseServer) LeaseRevoke(ctx context.Context, r *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
+	s := l.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLeases()
+	if s.leases[r.ID] == nil {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	s.revoke(r.ID)
+	return &pb.LeaseRevokeResponse{Header: s.header()}, nil
+}
+
+func (l leaseServer) LeaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) error {
+	s := l.s
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		s.mu.Lock()
+		s.expireLeases()
+		resp := &pb.LeaseKeepAliveResponse{Header: s.header(), ID: req.ID}
+		if lease := s.leases[req.ID]; lease != nil {
+			lease.renewed = time.Now()
+			resp.TTL = lease.ttl
+		}
+		s.mu.Unlock()
+		if err := stream.Send(resp); err != nil {
+			return nil
+		}
+	}
+}
+
+func (l leaseServer) LeaseTimeToLive(ctx context.Context, r *pb.LeaseTimeToLiveRequest) (*pb.LeaseTimeToLiveResponse, error) {
+	s := l.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLeases()
+	lease := s.leases[r.ID]
+	if lease == nil {
+		return &pb.LeaseTimeToLiveResponse{Header: s.header(), ID: r.ID, TTL: -1}, nil
+	}
+	left := lease.ttl - int64(time.Since(lease.renewed)/time.Second)
+	resp := &pb.LeaseTimeToLiveResponse{Header: s.header(), ID: r.ID, TTL: left, GrantedTTL: lease.ttl}
+	if r.Keys {
+		for key := range lease.keys {
+			resp.Keys = append(resp.Keys, []byte(key))
+		}
+		sort.Slice(resp.Keys, func(a, b int) bool { return bytes.Compare(resp.Keys[a], resp.Keys[b]) < 0 })
+	}
+	return resp, nil
+}
+
+func (l leaseServer) LeaseLeases(ctx context.Context, r *pb.LeaseLeasesRequest) (*pb.LeaseLeasesResponse, error) {
+	s := l.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLeases()
+	resp := &pb.LeaseLeasesResponse{Header: s.header()}
+	for id := range s.leases {
+		resp.Leases = append(resp.Leases, &pb.LeaseStatus{ID: id})
+	}
+	sort.Slice(resp.Leases, func(a, b int) bool { return resp.Leases[a].ID < resp.Leases[b].ID })
+	return resp, nil
+}
+
+type clusterServer struct {
+	s *Server
+}
+
+func (c clusterServer) MemberAdd(context.Context, *pb.MemberAddRequest) (*pb.MemberAddResponse, error) {
+	return nil, errUnsupported
+}
+
+func (c clusterServer) MemberRemove(context.Context, *pb.MemberRemoveRequest) (*pb.MemberRemoveResponse, error) {
+	return nil, errUnsupported
+}
+
+func (c clusterServer) MemberUpdate(context.Context, *pb.MemberUpdateRequest) (*pb.MemberUpdateResponse, error) {
+	return nil, errUnsupported
+}
+
+func (c clusterServer) MemberPromote(context.Context, *pb.MemberPromoteRequest) (*pb.MemberPromoteResponse, error) {
+	return nil, errUnsupported
+}
+
+func (c clusterServer) MemberList(ctx context.Context, r *pb.MemberListRequest) (*pb.MemberListResponse, error) {
+	url := "http://" + c.s.Endpoint()
+	return &pb.MemberListResponse{Header: c.s.lockedHeader(), Members: []*pb.Member{{ID: 1, Name: "etcdtest", PeerURLs: []string{url}, ClientURLs: []string{url}}}}, nil
+}
+
+var errUnsupported = errors.New("etcdtest: not supported")
+
+type maintenanceServer struct {
+	s *Server
+}
+
+func (m maintenanceServer) Alarm(ctx context.Context, r *pb.AlarmRequest) (*pb.AlarmResponse, error) {
+	return &pb.AlarmResponse{Header: m.s.lockedHeader()}, nil
+}
+
+func (m maintenanceServer) Status(ctx context.Context, r *pb.StatusRequest) (*pb.StatusResponse, error) {
+	s := m.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var size int64
+	for key, versions := range s.history {
+		for _, v := range versions {
+			size += int64(len(key) + len(v.kv.Value))
+		}
+	}
+	return &pb.StatusResponse{Header: s.header(), Version: Version, DbSize: size, DbSizeInUse: size, Leader: 1, RaftIndex: uint64(s.rev), RaftTerm: 1, RaftAppliedIndex: uint64(s.rev)}, nil
+}
+
+func (m maintenanceServer) Defragment(ctx context.Context, r *pb.DefragmentRequest) (*pb.DefragmentResponse, error) {
+	return &pb.DefragmentResponse{Header: m.s.lockedHeader()}, nil
+}
+
+func (m maintenanceServer) Hash(context.Context, *pb.HashRequest) (*pb.HashResponse, error) {
+	return nil, errUnsupported
+}
+
+func (m maintenanceServer) HashKV(context.Context, *pb.HashKVRequest) (*pb.HashKVResponse, error) {
+	return nil, errUnsupported
+}
+
+func (m maintenanceServer) Snapshot(*pb.SnapshotRequest, pb.Maintenance_SnapshotServer) error {
+	return errUnsupported
+}
+
+func (m maintenanceServer) MoveLeader(context.Context, *pb.MoveLeaderRequest) (*pb.MoveLeaderResponse, error) {
+	return nil, errUnsupported
+}
+
+func (m maintenanceServer) Downgrade(context.Context, *pb.DowngradeRequest) (*pb.DowngradeResponse, error) {
+	return nil, errUnsupported
+}
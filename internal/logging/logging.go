@@ -0,0 +1,69 @@
+// Package logging gives each log message of the inventory and its commands
+// a severity, stated where it is logged. Messages go through the log
+// package, warnings and debug output with the "Warning: " and "DEBUG: "
+// prefixes they always had, until SetSink sends them to a sink, such as
+// syslog, that records the severity itself.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// Severity is a syslog severity, which journald's PRIORITY shares.
+type Severity int
+
+const (
+	Err     Severity = 3
+	Warning Severity = 4
+	Info    Severity = 6
+	Debug   Severity = 7
+)
+
+// prefixes start the messages of a severity.
+var prefixes = map[Severity]string{Warning: "Warning: ", Debug: "DEBUG: "}
+
+var (
+	mu   sync.RWMutex
+	sink func(severity Severity, msg string)
+)
+
+// SetSink sends every message logged from now on to send instead of the
+// log package; nil restores the log package.
+func SetSink(send func(severity Severity, msg string)) {
+	mu.Lock()
+	defer mu.Unlock()
+	sink = send
+}
+
+// Logf logs a message at severity.
+func Logf(severity Severity, format string, args ...interface{}) {
+	msg := prefixes[severity] + fmt.Sprintf(format, args...)
+	mu.RLock()
+	send := sink
+	mu.RUnlock()
+	if send != nil {
+		send(severity, msg)
+		return
+	}
+	log.Output(3, msg)
+}
+
+func Infof(format string, args ...interface{})  { Logf(Info, format, args...) }
+func Warnf(format string, args ...interface{})  { Logf(Warning, format, args...) }
+func Errorf(format string, args ...interface{}) { Logf(Err, format, args...) }
+func Debugf(format string, args ...interface{}) { Logf(Debug, format, args...) }
+
+// Fatalf logs an error and exits with status 1, as log.Fatalf does.
+func Fatalf(format string, args ...interface{}) {
+	Logf(Err, format, args...)
+	os.Exit(1)
+}
+
+// Fatal is Fatalf of the operands formatted as by fmt.Print.
+func Fatal(args ...interface{}) {
+	Logf(Err, "%s", fmt.Sprint(args...))
+	os.Exit(1)
+}
@@ -1,230 +1,724 @@
-package main
+// Package inventory keeps a host inventory with an unstructured schema in
+// etcd: each host is a name and a map of fields, stored as one key under
+// /hosts/. The inventory command in cmd/inventory is a client of it.
+//
+// A program embedding it connects to etcd and works with hosts directly:
+//
+//	client, err := clientv3.New(clientv3.Config{Endpoints: []string{"localhost:2379"}})
+//	if err != nil {
+//		return err
+//	}
+//	defer client.Close()
+//	inv := inventory.NewInventory(client)
+//	if err := inv.CreateHost("web01", map[string]interface{}{"site": "ams"}); err != nil {
+//		return err
+//	}
+//	filter, _ := inventory.ParseHostFilter("site=ams")
+//	result, err := inv.ListHostsWithOptions(inventory.ListOptions{Filter: filter})
+//	if err != nil {
+//		return err
+//	}
+//	return inventory.WriteOutput(os.Stdout, inventory.OutputOptions{Format: "table"}, result.Hosts)
+package inventory
 
 import (
-	"context"
+	"bytes"
 	"encoding/json"
-	"encoding/xml"
-	"flag"
+	"errors"
 	"fmt"
-	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/oferchen/inventory/internal/logging"
 	"go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
 )
 
+// Connection defaults, as used by the inventory command.
 const (
-	etcdHost = "localhost"
-	etcdPort = 2379
-	baseKey  = "/hosts/"
+	DefaultEtcdHost       = "localhost"
+	DefaultEtcdPort       = 2379
+	baseKey               = "/hosts/"
+	DefaultDialTimeout    = 5 * time.Second
+	DefaultRequestTimeout = 5 * time.Second
 )
 
 type Host struct {
 	Name string                 `json:"name"`
 	Data map[string]interface{} `json:"data"`
+	// Order, when set, is the order of the fields in Data for storage and
+	// output, as kept by --preserve-order. Fields missing from it follow in
+	// sorted order; see fieldOrder.
+	Order []string `json:"-" yaml:"-" msgpack:"-"`
 }
 
+// fieldOrder returns the keys of Data in Order, followed by any others
+// sorted by name.
+func (h Host) fieldOrder() []string {
+	keys := make([]string, 0, len(h.Data))
+	seen := make(map[string]bool, len(h.Order))
+	for _, key := range h.Order {
+		if _, ok := h.Data[key]; ok && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	ordered := len(keys)
+	for key := range h.Data {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys[ordered:])
+	return keys
+}
+
+// MarshalJSON writes Data in fieldOrder when the host has an Order; without
+// one the keys come out sorted, as encoding/json writes maps.
+func (h Host) MarshalJSON() ([]byte, error) {
+	if h.Order == nil || h.Data == nil {
+		type plainHost Host
+		return json.Marshal(plainHost(h))
+	}
+	name, err := json.Marshal(h.Name)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"name":`)
+	buf.Write(name)
+	buf.WriteString(`,"data":{`)
+	for n, key := range h.fieldOrder() {
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(h.Data[key])
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteString("}}")
+	return buf.Bytes(), nil
+}
+
+// Inventory reads and writes the hosts. Its exported fields configure it
+// and must be set before use.
 type Inventory struct {
 	client *clientv3.Client
+	// cache, when set, serves GetHost from memory; see EnableCache.
+	cache *hostCache
+	// local, when set, serves the host listings; see EnableLocalCache.
+	local *HostSnapshot
+	// kv, watcher and lease are the client's interfaces, optionally wrapped
+	// to scope every key under the namespace prefix.
+	kv        clientv3.KV
+	watcher   clientv3.Watcher
+	lease     clientv3.Lease
+	namespace string
+	// reauth, when set, renews the client when etcd rejects its auth
+	// token; see EnableReauth.
+	reauth *reauth
+	// Timeout bounds each etcd request made by the Inventory methods.
+	Timeout time.Duration
+	// RawNames disables host name encoding in keys, for stores written
+	// before names were encoded.
+	RawNames bool
+	// Serializable makes plain reads serializable: served by whichever
+	// member is asked, without a round of consensus, so they are faster
+	// but may miss the latest writes. Writes and their guards are
+	// unaffected. See --consistency.
+	Serializable bool
+	// WriteRules normalizes the values written by creates and field
+	// updates; nil writes them as given.
+	WriteRules *WriteRules
+	// MaxValueSize refuses writes of stored hosts larger than this many
+	// bytes, and WarnValueSize logs them; 0 disables either check.
+	MaxValueSize  int
+	WarnValueSize int
+	// KeyFields, when set, keys hosts by the values of these fields, such
+	// as a serial number, instead of a free-form name; see KeyName.
+	KeyFields []string
+	// VirtualFields are computed when hosts are shown and never stored:
+	// writes of a host with one of these fields are refused.
+	VirtualFields VirtualFields
+	// Schema, when set, refuses writes of hosts whose data does not match
+	// it, like ValidationRules; see UseStoredSchema.
+	Schema *Schema
+	// ValidationRules are checked by ValidateHost and on every write,
+	// which fails with all the rules the host violates.
+	ValidationRules FieldRules
+	// ValueEncoding selects how hosts are stored: json, gob or msgpack;
+	// empty means json. Reads accept any of them. Set by --encoding.
+	ValueEncoding string
+	// CompressValues gzips each stored value, keeping the compressed form
+	// only when it is smaller; set by --compress-values. Reads accept
+	// compressed values regardless.
+	CompressValues bool
+	// PreserveOrder stores every host with its field order; set by
+	// --preserve-order. Hosts already stored with an order keep it
+	// regardless.
+	PreserveOrder bool
+	// SecretFields are the fields whose values are encrypted with Secrets
+	// before hosts are stored, and masked by MaskSecrets; set by
+	// --secret-fields.
+	SecretFields map[string]bool
+	// Secrets encrypts the SecretFields on writes and decrypts any sealed
+	// value on reads. Without it, sealed values are read as they are
+	// stored, and writing a plain value to a secret field fails with
+	// ErrNoSecretKey. Set by --secret-key.
+	Secrets *FieldCipher
+	// Debug logs retried requests and resynced watches; set by --debug.
+	Debug bool
 }
 
-func NewInventory(client *clientv3.Client) *Inventory {
-	return &Inventory{client}
+// keySeparator joins the values of several KeyFields into one name.
+const keySeparator = ":"
+
+// KeyName returns the name data is stored under with KeyFields: the value
+// of each field, as text, joined by keySeparator. Every field must be
+// present and non-empty.
+func (i *Inventory) KeyName(data map[string]interface{}) (string, error) {
+	values := make([]string, len(i.KeyFields))
+	for n, field := range i.KeyFields {
+		value, ok := data[field]
+		if !ok || value == nil || FormatValue(value) == "" {
+			return "", fmt.Errorf("%w: key field %s", ErrFieldNotFound, field)
+		}
+		values[n] = FormatValue(value)
+	}
+	return strings.Join(values, keySeparator), nil
 }
 
-func (i *Inventory) CreateHost(hostName string, hostData map[string]interface{}) error {
-	key := baseKey + hostName
-	host := Host{Name: hostName, Data: hostData}
-	hostJSON, err := json.Marshal(host)
-	if err != nil {
-		return err
+// DefaultMaxValueSize leaves room for the key and request framing under
+// etcd's default --max-request-bytes of 1.5 MiB, so an oversized host is
+// refused with checkValueSize's message instead of etcd's.
+const DefaultMaxValueSize = 1536*1024 - 16*1024
+
+// checkValueSize enforces MaxValueSize and WarnValueSize on a host encoded
+// as hostJSON, naming its largest field, the likely culprit.
+func (i *Inventory) checkValueSize(host Host, hostJSON []byte) error {
+	size := len(hostJSON)
+	if (i.MaxValueSize <= 0 || size <= i.MaxValueSize) && (i.WarnValueSize <= 0 || size <= i.WarnValueSize) {
+		return nil
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	_, err = i.client.Put(ctx, key, string(hostJSON))
-	return err
+	field, fieldSize := "", 0
+	for key, value := range host.Data {
+		b, err := json.Marshal(encodeBinaryValue(value))
+		if err == nil && len(b) > fieldSize {
+			field, fieldSize = key, len(b)
+		}
+	}
+	if i.MaxValueSize > 0 && size > i.MaxValueSize {
+		return fmt.Errorf("host %s is %d bytes, over the --max-value-size of %d; its largest field is %s at %d bytes", host.Name, size, i.MaxValueSize, field, fieldSize)
+	}
+	logging.Warnf("host %s is %d bytes, over the --warn-value-size of %d; its largest field is %s at %d bytes", host.Name, size, i.WarnValueSize, field, fieldSize)
+	return nil
 }
 
-func (i *Inventory) UpdateHostField(hostName, fieldName, fieldValue string) error {
-	key := baseKey + hostName
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	resp, err := i.client.Get(ctx, key)
-	if err != nil {
-		return err
+// encodeHost marshals host for storage, refusing it if checkValueSize
+// does or, with KeyFields, if its name is not its KeyName: a change to a
+// key field would leave the host under a stale key. The timestamps are
+// stamped first, from prev, the stored data being replaced, or nil if it
+// is not known; see stampHost.
+func (i *Inventory) encodeHost(host Host, prev map[string]interface{}) ([]byte, error) {
+	host = stampHost(host, prev, time.Now())
+	if err := checkStatus(host); err != nil {
+		return nil, err
 	}
-	if len(resp.Kvs) == 0 {
-		return fmt.Errorf("Host not found")
+	if len(i.KeyFields) > 0 {
+		name, err := i.KeyName(host.Data)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %w", host.Name, err)
+		}
+		if name != host.Name {
+			return nil, fmt.Errorf("host %s: %w: its key fields %s give %s; to change them remove the host and create it again", host.Name, ErrFieldImmutable, strings.Join(i.KeyFields, ","), name)
+		}
 	}
-	host := Host{}
-	if err := json.Unmarshal(resp.Kvs[0].Value, &host); err != nil {
-		return err
+	for field := range host.Data {
+		if _, ok := i.VirtualFields[field]; ok {
+			return nil, fmt.Errorf("host %s: %w: %s is virtual, computed when shown", host.Name, ErrFieldImmutable, field)
+		}
+	}
+	if problems := i.ValidationRules.check(host); len(problems) > 0 {
+		return nil, fmt.Errorf("host %s: %w", host.Name, errors.Join(problems...))
 	}
-	host.Data[fieldName] = fieldValue
-	hostJSON, err := json.Marshal(host)
+	if problems := i.Schema.Validate(host.Data); len(problems) > 0 {
+		return nil, fmt.Errorf("host %s: %w: %w", host.Name, ErrSchemaViolation, errors.Join(problems...))
+	}
+	hostJSON, err := i.marshalHost(host)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := i.checkValueSize(host, hostJSON); err != nil {
+		return nil, err
 	}
-	_, err = i.client.Put(ctx, key, string(hostJSON))
-	return err
+	return hostJSON, nil
 }
 
-func (i *Inventory) RemoveHost(hostName string) error {
-	key := baseKey + hostName
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	_, err := i.client.Delete(ctx, key)
-	return err
+// WriteRules normalize field values before they are stored: Trim strips
+// surrounding whitespace from every string, and the fields in Lowercase and
+// Uppercase have their strings case-folded. Strings nested in arrays and
+// objects are included. PruneEmpty then drops the fields left empty (see
+// IsEmptyValue) instead of storing them.
+type WriteRules struct {
+	Trim       bool
+	Lowercase  map[string]bool
+	Uppercase  map[string]bool
+	PruneEmpty bool
 }
 
-func (i *Inventory) ListHosts() ([]Host, error) {
-	key := baseKey
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	resp, err := i.client.Get(ctx, key, clientv3.WithPrefix())
-	if err != nil {
-		return nil, err
+// apply returns value normalized for field, leaving value itself alone.
+func (r *WriteRules) apply(field string, value interface{}) interface{} {
+	if r == nil {
+		return value
 	}
-	hosts := make([]Host, 0)
-	for _, kv := range resp.Kvs {
-		host := Host{}
-		if err := json.Unmarshal(kv.Value, &host); err != nil {
-			return nil, err
+	return mapStrings(value, func(s string) string {
+		if r.Trim {
+			s = strings.TrimSpace(s)
+		}
+		switch {
+		case r.Lowercase[field]:
+			s = strings.ToLower(s)
+		case r.Uppercase[field]:
+			s = strings.ToUpper(s)
 		}
-		hosts = append(hosts, host)
+		return s
+	})
+}
+
+// applyHost returns a copy of host with every field normalized.
+func (r *WriteRules) applyHost(host Host) Host {
+	if r == nil || host.Data == nil {
+		return host
 	}
-	return hosts, nil
+	data := make(map[string]interface{}, len(host.Data))
+	for field, value := range host.Data {
+		r.set(data, field, value)
+	}
+	host.Data = data
+	return host
 }
 
-// OutputFormatter interface and formatter types
+// set stores value normalized for field in data, or deletes the field if
+// PruneEmpty and the value is empty.
+func (r *WriteRules) set(data map[string]interface{}, field string, value interface{}) {
+	value = r.apply(field, value)
+	if r != nil && r.PruneEmpty && IsEmptyValue(value) {
+		delete(data, field)
+		return
+	}
+	data[field] = value
+}
 
-func getTypeName(data interface{}) string {
-	switch data.(type) {
-	case map[string]interface{}:
-		return "JSON"
+// IsEmptyValue reports whether a field value carries nothing: null, the
+// empty string, or an empty array or object. Zero and false are values.
+func IsEmptyValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
 	case string:
-		return "String"
-	case int, int64, float64:
-		return "Number"
-	case bool:
-		return "Boolean"
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
 	default:
-		return "Unknown"
+		return false
 	}
 }
 
-func main() {
-	etcdHostFlag := flag.String("etcd-host", etcdHost, "etcd server address")
-	etcdPortFlag := flag.Int("etcd-port", etcdPort, "etcd server port")
-	outputFlag := flag.String("output", "table", "Output format")
-	flag.Parse()
-
-	etcdHost := *etcdHostFlag
-	etcdPort := *etcdPortFlag
-
-	etcdClient, err := getClient(etcdHost, etcdPort)
-	if err != nil {
-		log.Fatalf("Error initializing Etcd client: %v", err)
+// emptyFields returns the sorted names of the fields of data with empty
+// values.
+func emptyFields(data map[string]interface{}) []string {
+	var fields []string
+	for field, value := range data {
+		if IsEmptyValue(value) {
+			fields = append(fields, field)
+		}
 	}
+	sort.Strings(fields)
+	return fields
+}
 
-	inventory := NewInventory(etcdClient)
-
-	switch flag.Arg(0) {
-	case "create":
-		handleCreate(inventory, flag.Args()[1:])
-
-	case "update":
-		handleUpdate(inventory, flag.Args()[1:])
-
-	case "remove":
-		handleRemove(inventory, flag.Args()[1])
+// mapStrings returns a copy of value with fn applied to every string in it.
+func mapStrings(value interface{}, fn func(string) string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return fn(v)
+	case map[string]interface{}:
+		mapped := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			mapped[key] = mapStrings(elem, fn)
+		}
+		return mapped
+	case []interface{}:
+		mapped := make([]interface{}, len(v))
+		for n, elem := range v {
+			mapped[n] = mapStrings(elem, fn)
+		}
+		return mapped
+	}
+	return value
+}
 
-	case "list":
-		handleList(inventory, *outputFlag)
+// readOpts returns opts plus the read consistency option, for the Get calls
+// of plain reads.
+func (i *Inventory) readOpts(opts ...clientv3.OpOption) []clientv3.OpOption {
+	if i.Serializable {
+		opts = append(opts, clientv3.WithSerializable())
+	}
+	return opts
+}
 
-	default:
-		log.Fatal("Unknown subcommand. Use 'create', 'update', 'remove', or 'list'.")
+// NewInventory returns an Inventory over client, retrying transient
+// failures and with the default request timeout and value size limit.
+func NewInventory(client *clientv3.Client) *Inventory {
+	i := &Inventory{
+		client:       client,
+		watcher:      client.Watcher,
+		lease:        client.Lease,
+		Timeout:      DefaultRequestTimeout,
+		MaxValueSize: DefaultMaxValueSize,
 	}
+	i.kv = retryKV{KV: client.KV, inv: i}
+	return i
 }
 
-func getClient(host string, port int) (*clientv3.Client, error) {
-	config := clientv3.Config{
-		Endpoints: []string{fmt.Sprintf("%s:%d", host, port)},
+// NewNamespacedInventory is NewInventory with every key transparently
+// prefixed by prefix, using the etcd namespace wrappers. An empty prefix
+// leaves keys unscoped.
+func NewNamespacedInventory(client *clientv3.Client, prefix string) *Inventory {
+	i := NewInventory(client)
+	i.namespace = prefix
+	if prefix != "" {
+		i.kv = retryKV{KV: namespace.NewKV(client.KV, prefix), inv: i}
+		i.watcher = namespace.NewWatcher(client.Watcher, prefix)
+		i.lease = namespace.NewLease(client.Lease, prefix)
 	}
-	return clientv3.New(config)
+	return i
 }
 
-func handleCreate(inventory *Inventory, args []string) {
-	if len(args) != 2 {
-		log.Fatal("Usage: create <host_name> <host_data>")
+// NamespacesKey holds the named inventories: the one named NAME keeps its
+// keys under NamespacesKey+NAME, so several inventories, such as dev and
+// prod, can share an etcd cluster.
+const NamespacesKey = "/inventories/"
+
+// NamespacePrefix returns the key prefix of namespace for
+// NewNamespacedInventory: a name such as "prod" is kept under
+// NamespacesKey, while a value starting with "/" is an etcd prefix used as
+// is, and "" means no namespace.
+func NamespacePrefix(namespace string) (string, error) {
+	if namespace == "" || strings.HasPrefix(namespace, "/") {
+		return namespace, nil
 	}
+	if strings.Contains(namespace, "/") || strings.ContainsFunc(namespace, unicode.IsControl) || !utf8.ValidString(namespace) {
+		return "", fmt.Errorf("invalid namespace %q: names cannot contain / or control characters", namespace)
+	}
+	return NamespacesKey + namespace, nil
+}
 
-	hostName := args[0]
-	hostDataStr := args[1]
-	hostData := parseHostData(hostDataStr)
+// Namespace is a named inventory under NamespacesKey.
+type Namespace struct {
+	Name  string
+	Hosts int64
+}
 
-	err := inventory.CreateHost(hostName, hostData)
-	if err != nil {
-		log.Fatalf("Error creating host: %v", err)
+// Namespaces returns the named inventories, sorted, with their host
+// counts. It skips from one namespace to the next rather than reading
+// their keys, so it costs two requests per namespace.
+func (i *Inventory) Namespaces() ([]Namespace, error) {
+	if i.client == nil {
+		return nil, errors.New("listing namespaces needs a connection to etcd")
+	}
+	kv := retryKV{KV: i.client.KV, inv: i}
+	var namespaces []Namespace
+	end := clientv3.GetPrefixRangeEnd(NamespacesKey)
+	for key := NamespacesKey; ; {
+		ctx, cancel := i.requestContext()
+		resp, err := kv.Get(ctx, key, i.readOpts(clientv3.WithRange(end), clientv3.WithKeysOnly(), clientv3.WithLimit(1))...)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Kvs) == 0 {
+			return namespaces, nil
+		}
+		name, _, ok := strings.Cut(strings.TrimPrefix(string(resp.Kvs[0].Key), NamespacesKey), "/")
+		if !ok {
+			// A stray key right under NamespacesKey is not a namespace.
+			key = string(resp.Kvs[0].Key) + "\x00"
+			continue
+		}
+		ctx, cancel = i.requestContext()
+		count, err := kv.Get(ctx, NamespacesKey+name+baseKey, i.readOpts(clientv3.WithPrefix(), clientv3.WithCountOnly())...)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, Namespace{Name: name, Hosts: count.Count})
+		key = clientv3.GetPrefixRangeEnd(NamespacesKey + name + "/")
 	}
-	log.Printf("Host '%s' created successfully!", hostName)
 }
 
-func handleUpdate(inventory *Inventory, args []string) {
-	if len(args) != 3 {
-		log.Fatal("Usage: update <host_name> <field_name> <field_value>")
+// ErrNamespaceNotEmpty is returned when copying into a namespace that
+// already has keys.
+var ErrNamespaceNotEmpty = errors.New("namespace is not empty")
+
+// copyBatchSize is the number of keys CopyNamespace reads and writes at a
+// time, within etcd's default --max-txn-ops of 128.
+const copyBatchSize = 100
+
+// CopyNamespace copies every key of the namespace src, as read at one
+// revision, into dst, which must be empty: its hosts, groups, audit
+// entries and schema. Namespaces are as for NamespacePrefix. The copy is
+// written in batches, so a failure leaves dst partly written; hosts with a
+// TTL are copied without it. It returns the number of keys copied.
+func (i *Inventory) CopyNamespace(src, dst string) (copied int, err error) {
+	if i.client == nil {
+		return 0, errors.New("copying namespaces needs a connection to etcd")
+	}
+	srcPrefix, err := NamespacePrefix(src)
+	if err != nil {
+		return 0, err
+	}
+	dstPrefix, err := NamespacePrefix(dst)
+	if err != nil {
+		return 0, err
 	}
+	if strings.HasPrefix(srcPrefix+"/", dstPrefix+"/") || strings.HasPrefix(dstPrefix+"/", srcPrefix+"/") {
+		return 0, fmt.Errorf("cannot copy namespace %q into %q: one contains the other", src, dst)
+	}
+	kv := retryKV{KV: i.client.KV, inv: i}
+	ctx, cancel := i.requestContext()
+	existing, err := kv.Get(ctx, dstPrefix+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	if existing.Count > 0 {
+		return 0, fmt.Errorf("%w: %s has %d keys", ErrNamespaceNotEmpty, dst, existing.Count)
+	}
+	end := clientv3.GetPrefixRangeEnd(srcPrefix + "/")
+	var rev int64
+	for key := srcPrefix + "/"; ; {
+		opts := []clientv3.OpOption{clientv3.WithRange(end), clientv3.WithLimit(copyBatchSize)}
+		if rev > 0 {
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		ctx, cancel := i.requestContext()
+		resp, err := kv.Get(ctx, key, opts...)
+		cancel()
+		if err != nil {
+			return copied, err
+		}
+		if rev == 0 {
+			rev = resp.Header.Revision
+		}
+		if len(resp.Kvs) == 0 {
+			return copied, nil
+		}
+		puts := make([]clientv3.Op, len(resp.Kvs))
+		for n, item := range resp.Kvs {
+			puts[n] = clientv3.OpPut(dstPrefix+strings.TrimPrefix(string(item.Key), srcPrefix), string(item.Value))
+		}
+		ctx, cancel = i.requestContext()
+		_, err = kv.Txn(ctx).Then(puts...).Commit()
+		cancel()
+		if err != nil {
+			return copied, err
+		}
+		copied += len(puts)
+		if !resp.More {
+			return copied, nil
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
 
-	hostName := args[0]
-	fieldName := args[1]
-	fieldValue := args[2]
+// KeyPrefix returns the prefix of every key of the inventory, as given to
+// NewNamespacedInventory: "" without a namespace.
+func (i *Inventory) KeyPrefix() string {
+	return i.namespace
+}
 
-	err := inventory.UpdateHostField(hostName, fieldName, fieldValue)
+// WriteFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never observe a partial write.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
 	if err != nil {
-		log.Fatalf("Error updating host field: %v", err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
 	}
-	log.Printf("Field '%s' for host '%s' updated successfully!", fieldName, hostName)
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
-func handleRemove(inventory *Inventory, hostName string) {
-	err := inventory.RemoveHost(hostName)
-	if err != nil {
-		log.Fatalf("Error removing host: %v", err)
+// debugf logs with Debug; a nil Inventory logs nothing.
+func (i *Inventory) debugf(format string, args ...interface{}) {
+	if i != nil && i.Debug {
+		logging.Debugf(format, args...)
 	}
-	log.Printf("Host '%s' removed successfully!", hostName)
 }
 
-func handleList(inventory *Inventory, outputFormat string) {
-	hosts, err := inventory.ListHosts()
-	if err != nil {
-		log.Fatalf("Error listing hosts: %v", err)
+// ToFloat converts any of the number types TypeName accepts to float64.
+// JSON only yields float64, but the gob and msgpack encodings keep integers.
+func ToFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	default:
+		return 0, false
 	}
-	printOutput(outputFormat, hosts)
 }
 
-func printOutput(format string, hosts []Host) {
-	var formatter OutputFormatter
+func TypeName(data interface{}) string {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		return "JSON"
+	case string:
+		if net.ParseIP(v) != nil {
+			return "IPAddress"
+		}
+		if _, _, err := net.ParseCIDR(v); err == nil {
+			return "CIDR"
+		}
+		if _, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return "Timestamp"
+		}
+		return "String"
+	case int, int64, uint64, float64:
+		return "Number"
+	case bool:
+		return "Boolean"
+	case []interface{}:
+		return "Array"
+	case []byte:
+		return "Binary"
+	case nil:
+		return "Null"
+	default:
+		return "Unknown"
+	}
+}
 
-	switch format {
-	case "table":
-		formatter = TableOutputFormatter{}
+// ValueTypes are the type names accepted by ParseTypedValue.
+var ValueTypes = []string{"auto", "string", "number", "bool", "null", "list", "json"}
+
+// ParseTypedValue reads text as a field value of the named type: a
+// string as is; a number; a bool (true or false); null (text must be
+// empty or "null"); a list, given as a JSON array or comma-separated
+// strings; or any JSON value, such as an object. auto reads true, false,
+// null, numbers and JSON arrays and objects as such and anything else as
+// a string.
+func ParseTypedValue(text, typeName string) (interface{}, error) {
+	switch strings.ToLower(typeName) {
+	case "", "string":
+		return text, nil
+	case "number":
+		if !jsonNumber.MatchString(text) {
+			return nil, fmt.Errorf("%q is not a number", text)
+		}
+		return strconv.ParseFloat(text, 64)
+	case "bool", "boolean":
+		switch text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, fmt.Errorf("%q is not true or false", text)
+	case "null":
+		if text != "" && text != "null" {
+			return nil, fmt.Errorf("%q is not null", text)
+		}
+		return nil, nil
+	case "list", "array":
+		if strings.HasPrefix(strings.TrimSpace(text), "[") {
+			return parseJSONValue(text, "list")
+		}
+		list := []interface{}{}
+		for _, item := range SplitList(text) {
+			list = append(list, item)
+		}
+		return list, nil
 	case "json":
-		formatter = JSONOutputFormatter{}
-	case "xml":
-		formatter = XMLOutputFormatter{}
-	case "csv":
-		formatter = CSVOutputFormatter{}
-	case "block":
-		formatter = BlockOutputFormatter{}
-	case "rfc4180-csv":
-		formatter = RFC4180CsvOutputFormatter{}
-	case "typed-csv":
-		formatter = TypedCsvOutputFormatter{}
-	case "script":
-		formatter = ScriptOutputFormatter{}
+		return parseJSONValue(text, "json")
+	case "auto":
+		if text == "null" {
+			return nil, nil
+		}
+		if trimmed := strings.TrimSpace(text); strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+			if value, err := parseJSONValue(text, "json"); err == nil {
+				return value, nil
+			}
+		}
+		return csvCellValue(text, true), nil
 	default:
-		log.Fatalf("Unknown output format: %s", format)
+		return nil, fmt.Errorf("unknown value type %q (use %s)", typeName, strings.Join(ValueTypes, ", "))
 	}
+}
+
+// parseJSONValue decodes text as JSON, requiring an array for a list.
+func parseJSONValue(text, typeName string) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return nil, fmt.Errorf("%q is not valid %s: %w", text, typeName, err)
+	}
+	if _, ok := value.([]interface{}); typeName == "list" && !ok {
+		return nil, fmt.Errorf("%q is not a list", text)
+	}
+	return decodeBinaryValue(value), nil
+}
 
-	output := formatter.Format(hosts)
-	fmt.Println(output)
+// maxHostNameLength matches the longest DNS name.
+const maxHostNameLength = 253
+
+// ValidateHostName checks that a name is usable. Names are encoded into
+// their key segment, so "/" and spaces are allowed; control characters are
+// not, as they make output unreadable.
+func ValidateHostName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("host name is empty")
+	case len(name) > maxHostNameLength:
+		return fmt.Errorf("host name is longer than %d bytes", maxHostNameLength)
+	case !utf8.ValidString(name):
+		return errors.New("host name is not valid UTF-8")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("host name contains control character %q", r)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,3528 @@
+package inventory
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/oferchen/inventory/internal/etcdtest"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files under testdata")
+
+// checkGolden compares got with the golden file testdata/name, or rewrites
+// the file with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s (rerun with -update if intended):\n%s", path, got)
+	}
+}
+
+// newTestInventory returns an Inventory over a fresh in-memory etcd.
+func newTestInventory(t *testing.T) *Inventory {
+	t.Helper()
+	_, client := etcdtest.Start(t)
+	return NewInventory(client)
+}
+
+func TestRecordTxnSkipsReads(t *testing.T) {
+	inv := newTestInventory(t)
+	if err := inv.CreateHost("db01", map[string]interface{}{"site": "fra"}); err != nil {
+		t.Fatal(err)
+	}
+	var mutations []Mutation
+	inv.OnMutation(func(m Mutation) { mutations = append(mutations, m) })
+
+	ctx, cancel := inv.requestContext()
+	defer cancel()
+	resp, err := inv.kv.Txn(ctx).Then(
+		clientv3.OpGet(inv.hostKey("db01")),
+		clientv3.OpPut(inv.hostKey("web01"), `{"name":"web01","data":{"site":"ams"}}`),
+		clientv3.OpGet(inv.hostKey("web01")),
+	).Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Responses) != 3 {
+		t.Fatalf("got %d responses, want the 3 of the caller's ops", len(resp.Responses))
+	}
+	if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) != 1 || string(kvs[0].Key) != inv.hostKey("db01") {
+		t.Errorf("first response is %v, want the get of db01", resp.Responses[0])
+	}
+	if len(mutations) != 1 || mutations[0].Host != "web01" || !mutations[0].Created {
+		t.Errorf("mutations = %+v, want the creation of web01 only", mutations)
+	}
+
+	// A full transaction of gets stays within etcd's --max-txn-ops.
+	gets := make([]clientv3.Op, etcdtest.DefaultMaxTxnOps)
+	for n := range gets {
+		gets[n] = clientv3.OpGet(inv.hostKey(fmt.Sprintf("host%03d", n)))
+	}
+	if _, err := inv.kv.Txn(ctx).Then(gets...).Commit(); err != nil {
+		t.Errorf("transaction of %d gets: %v", len(gets), err)
+	}
+}
+
+func TestGetHostsWithHooks(t *testing.T) {
+	inv := newTestInventory(t)
+	names := make([]string, 2*getBatchSize+3)
+	for n := range names {
+		names[n] = fmt.Sprintf("host%03d", n)
+		if err := inv.CreateHost(names[n], map[string]interface{}{"n": n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	audit, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"), "get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.EnableAudit(audit)
+	inv.OnMutation(func(Mutation) {})
+
+	hosts, err := inv.GetHosts(append(names, "missing"))
+	var missing *MissingHostsError
+	if !errors.As(err, &missing) || len(missing.Names) != 1 || missing.Names[0] != "missing" {
+		t.Fatalf("GetHosts error = %v, want only missing reported", err)
+	}
+	if len(hosts) != len(names) {
+		t.Fatalf("got %d hosts, want %d", len(hosts), len(names))
+	}
+	for n, host := range hosts {
+		if host.Name != names[n] {
+			t.Fatalf("host %d is %s, want %s", n, host.Name, names[n])
+		}
+	}
+}
+
+func TestNoOpModifyWritesNothing(t *testing.T) {
+	inv := newTestInventory(t)
+	if err := inv.CreateHost("web01", map[string]interface{}{"site": "ams"}); err != nil {
+		t.Fatal(err)
+	}
+	before, rev, err := inv.GetHostWithRevision("web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.UpdateHostFields("web01", map[string]interface{}{"site": "ams"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.MergeHostData("web01", map[string]interface{}{"site": "ams"}); err != nil {
+		t.Fatal(err)
+	}
+	after, afterRev, err := inv.GetHostWithRevision("web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if afterRev != rev {
+		t.Errorf("revision went from %d to %d on writes that changed nothing", rev, afterRev)
+	}
+	if after.Data[UpdatedAtField] != before.Data[UpdatedAtField] {
+		t.Errorf("updated_at went from %v to %v", before.Data[UpdatedAtField], after.Data[UpdatedAtField])
+	}
+}
+
+func TestStampHostKeepsStampsOfUnchangedData(t *testing.T) {
+	prev := map[string]interface{}{"site": "ams", CreatedAtField: "2024-01-01T00:00:00Z", UpdatedAtField: "2024-01-02T00:00:00Z"}
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		data    map[string]interface{}
+		updated string
+	}{
+		{"same data", map[string]interface{}{"site": "ams"}, "2024-01-02T00:00:00Z"},
+		{"same data and stamps", maps.Clone(prev), "2024-01-02T00:00:00Z"},
+		{"changed field", map[string]interface{}{"site": "fra"}, "2025-06-01T12:00:00Z"},
+		{"touched", map[string]interface{}{"site": "ams", UpdatedAtField: "2025-06-01T12:00:00Z"}, "2025-06-01T12:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := stampHost(Host{Name: "web01", Data: tt.data}, prev, now)
+			if got := host.Data[UpdatedAtField]; got != tt.updated {
+				t.Errorf("updated_at = %v, want %s", got, tt.updated)
+			}
+			if got := host.Data[CreatedAtField]; got != prev[CreatedAtField] {
+				t.Errorf("created_at = %v, want %v", got, prev[CreatedAtField])
+			}
+		})
+	}
+}
+
+// staticProvider is a SyncProvider discovering a fixed list of hosts.
+type staticProvider []Host
+
+func (p staticProvider) Source() string { return "static" }
+
+func (p staticProvider) Discover(context.Context) ([]Host, error) { return p, nil }
+
+func TestSyncPruneRemoveArchivesDecommissioned(t *testing.T) {
+	inv := newTestInventory(t)
+	for _, host := range []Host{
+		{Name: "web01", Data: map[string]interface{}{SyncSourceField: "static"}},
+		{Name: "web02", Data: map[string]interface{}{SyncSourceField: "static", StatusField: string(StatusDecommissioned)}},
+	} {
+		if err := inv.CreateHost(host.Name, host.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := inv.SyncHosts(context.Background(), staticProvider{}, SyncOptions{Prune: PruneRemove})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Missing) != 2 {
+		t.Errorf("missing = %v, want both hosts", result.Missing)
+	}
+	if hosts, err := inv.ListHosts(); err != nil || len(hosts) != 0 {
+		t.Errorf("hosts left = %v (%v), want none", hosts, err)
+	}
+	archived, err := inv.ArchivedHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 1 || archived[0].Name != "web02" {
+		t.Errorf("archived = %v, want web02 only", archived)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name string
+		// fail is the error of the first txn, returned after applying it
+		// with applied.
+		fail    error
+		applied bool
+		// wantErr is the error expected of the create, nil for none.
+		wantErr error
+	}{
+		{"no leader", rpctypes.ErrGRPCNoLeader, false, nil},
+		{"unhealthy", rpctypes.ErrGRPCUnhealthy, false, nil},
+		{"timeout after applying", rpctypes.ErrGRPCTimeout, true, rpctypes.ErrTimeout},
+		{"leader lost after applying", rpctypes.ErrGRPCTimeoutDueToLeaderFail, true, rpctypes.ErrTimeoutDueToLeaderFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := etcdtest.Start(t)
+			inv := NewInventory(client)
+			failed := false
+			server.Fault = func(method string, applied bool) error {
+				if method == "txn" && applied == tt.applied && !failed {
+					failed = true
+					return tt.fail
+				}
+				return nil
+			}
+			err := inv.CreateHostIfNotExists("web01", map[string]interface{}{"site": "ams"})
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("create = %v, want %v", err, tt.wantErr)
+			}
+			if _, err := inv.GetHost("web01"); err != nil {
+				t.Errorf("host not created: %v", err)
+			}
+		})
+	}
+}
+
+// expiringKV is the KV of a fake client whose auth token etcd rejects for
+// the next expired requests, or all of them if expired is negative.
+type expiringKV struct {
+	clientv3.KV
+	expired int
+}
+
+func (kv *expiringKV) reject() error {
+	if kv.expired == 0 {
+		return nil
+	}
+	kv.expired--
+	return rpctypes.ErrInvalidAuthToken
+}
+
+func (kv *expiringKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	if err := kv.reject(); err != nil {
+		return nil, err
+	}
+	return kv.KV.Get(ctx, key, opts...)
+}
+
+func (kv *expiringKV) Txn(ctx context.Context) clientv3.Txn {
+	return &expiringTxn{Txn: kv.KV.Txn(ctx), kv: kv}
+}
+
+type expiringTxn struct {
+	clientv3.Txn
+	kv *expiringKV
+}
+
+func (t *expiringTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.Txn = t.Txn.If(cs...)
+	return t
+}
+
+func (t *expiringTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.Txn = t.Txn.Then(ops...)
+	return t
+}
+
+func (t *expiringTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.Txn = t.Txn.Else(ops...)
+	return t
+}
+
+func (t *expiringTxn) Commit() (*clientv3.TxnResponse, error) {
+	if err := t.kv.reject(); err != nil {
+		return nil, err
+	}
+	return t.Txn.Commit()
+}
+
+func TestReauth(t *testing.T) {
+	tests := []struct {
+		name string
+		// write updates the host instead of reading it.
+		write bool
+		// expired is how many requests in a row are rejected, -1 for all.
+		expired    int
+		connectErr error
+		// wantConnects is how many new clients are connected.
+		wantConnects int
+		wantErr      string
+	}{
+		{"expired read", false, 1, nil, 1, ""},
+		{"expired write", true, 1, nil, 1, ""},
+		{"expired twice", false, 2, nil, 2, ""},
+		{"always rejected", false, -1, nil, maxReauths, "invalid auth token"},
+		{"connect fails", false, 1, errors.New("bad password"), 1, "re-authenticate: bad password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := etcdtest.Start(t)
+			kv := &expiringKV{KV: client.KV, expired: tt.expired}
+			fake := clientv3.NewCtxClient(context.Background())
+			fake.KV = kv
+			inv := NewInventory(fake)
+			connects := 0
+			inv.EnableReauth(func() (*clientv3.Client, error) {
+				connects++
+				if tt.connectErr != nil {
+					return nil, tt.connectErr
+				}
+				renewed := clientv3.NewCtxClient(context.Background())
+				renewed.KV = kv
+				return renewed, nil
+			})
+			if err := NewInventory(client).CreateHost("web01", map[string]interface{}{"site": "ams"}); err != nil {
+				t.Fatal(err)
+			}
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			defer log.SetOutput(os.Stderr)
+
+			var err error
+			if tt.write {
+				err = inv.UpdateHostFieldValue("web01", "site", "fra")
+			} else {
+				_, err = inv.GetHost("web01")
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr) || !isUnauthenticated(err)) {
+				t.Fatalf("request = %v, want an invalid token error containing %q", err, tt.wantErr)
+			}
+			if connects != tt.wantConnects {
+				t.Errorf("connected %d clients, want %d", connects, tt.wantConnects)
+			}
+			if got := strings.Count(logged.String(), "re-authenticating"); got != tt.wantConnects {
+				t.Errorf("logged %d re-authentications, want %d:\n%s", got, tt.wantConnects, logged.String())
+			}
+			if tt.wantErr != "" {
+				return
+			}
+			host, err := inv.GetHost("web01")
+			if err != nil {
+				t.Fatalf("GetHost after renewing: %v", err)
+			}
+			want := "ams"
+			if tt.write {
+				want = "fra"
+			}
+			if host.Data["site"] != want {
+				t.Errorf("site = %v, want %v", host.Data["site"], want)
+			}
+		})
+	}
+}
+
+func TestPublishMetrics(t *testing.T) {
+	inv := newTestInventory(t)
+	if _, err := inv.GetHost("web01"); !errors.Is(err, ErrHostNotFound) {
+		t.Fatalf("GetHost = %v, want ErrHostNotFound", err)
+	}
+	PublishMetrics()
+	PublishMetrics()
+	requests, ok := expvar.Get("etcd_requests").(*expvar.Map)
+	if !ok {
+		t.Fatal("etcd_requests not published")
+	}
+	if got := requests.Get("get"); got == nil || got.String() == "0" {
+		t.Errorf("etcd_requests get = %v, want the get counted before publishing", got)
+	}
+}
+
+func TestSecretsBoundToHostAndField(t *testing.T) {
+	key := make([]byte, SecretKeySize)
+	cipher, err := NewFieldCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := cipher.Seal("bmc1", "ipmi_password", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, field string
+		ok          bool
+	}{
+		{"bmc1", "ipmi_password", true},
+		{"bmc2", "ipmi_password", false},
+		{"bmc1", "api_token", false},
+		{"bmc1\x00ipmi", "password", false},
+	}
+	for _, tt := range tests {
+		opened, err := cipher.Open(tt.host, tt.field, sealed)
+		if ok := err == nil && opened == "s3cret"; ok != tt.ok {
+			t.Errorf("Open(%q, %q) = %v, %v; want success %v", tt.host, tt.field, opened, err, tt.ok)
+		}
+	}
+}
+
+func TestRenameAndCloneResealSecrets(t *testing.T) {
+	inv := newTestInventory(t)
+	cipher, err := NewFieldCipher(make([]byte, SecretKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.SecretFields = map[string]bool{"ipmi_password": true}
+	inv.Secrets = cipher
+	if err := inv.CreateHost("bmc1", map[string]interface{}{"ipmi_password": "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.RenameHost("bmc1", "bmc2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.CloneHost("bmc2", "bmc3", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"bmc2", "bmc3"} {
+		host, err := inv.GetHost(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := host.Data["ipmi_password"]; got != "s3cret" {
+			t.Errorf("%s ipmi_password = %v, want it opened", name, got)
+		}
+	}
+
+	inv.Secrets = nil
+	if err := inv.RenameHost("bmc2", "bmc4"); !errors.Is(err, ErrNoSecretKey) {
+		t.Errorf("rename without the key = %v, want ErrNoSecretKey", err)
+	}
+	if err := inv.CloneHost("bmc2", "bmc4", nil); !errors.Is(err, ErrNoSecretKey) {
+		t.Errorf("clone without the key = %v, want ErrNoSecretKey", err)
+	}
+}
+
+func TestRestoreBackupInBatches(t *testing.T) {
+	server, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	for n := 0; n < 3*removeBatchSize; n++ {
+		if err := inv.CreateHost(fmt.Sprintf("host%03d", n), map[string]interface{}{"n": n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup, err := inv.CreateBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := server.Keys()
+	names, err := inv.ListHostNames("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.RemoveHosts(names[:removeBatchSize]); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names[removeBatchSize:] {
+		if err := inv.UpdateHostFields(name, map[string]interface{}{"n": -1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := inv.CreateHost("extra", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	audit, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"), "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.EnableAudit(audit)
+
+	written, deleted, err := inv.RestoreBackup(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != len(names) || deleted != 1 {
+		t.Errorf("restore wrote %d and deleted %d keys, want %d and 1", written, deleted, len(names))
+	}
+	if got := server.Keys(); !maps.Equal(got, want) {
+		t.Errorf("restored %d keys, differing from the %d backed up", len(got), len(want))
+	}
+}
+
+func TestRestoreBackupStopsOnConcurrentWrite(t *testing.T) {
+	server, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	backup, err := inv.CreateBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2*removeBatchSize; n++ {
+		if err := inv.CreateHost(fmt.Sprintf("host%03d", n), map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	intruded := false
+	server.Fault = func(method string, applied bool) error {
+		if method == "txn" && applied && !intruded {
+			intruded = true
+			_, err := client.Put(context.Background(), inv.hostKey("intruder"), `{"name":"intruder","data":{}}`)
+			return err
+		}
+		return nil
+	}
+	written, deleted, err := inv.RestoreBackup(backup)
+	if !errors.Is(err, ErrHostChanged) {
+		t.Fatalf("restore = %v, want ErrHostChanged", err)
+	}
+	if written != 0 || deleted != removeBatchSize {
+		t.Errorf("restore reported %d written and %d deleted, want the first batch of %d deletes", written, deleted, removeBatchSize)
+	}
+}
+
+func TestColorOutput(t *testing.T) {
+	hosts := []Host{
+		{Name: "web01", Data: map[string]interface{}{"site": "ams"}},
+		{Name: "db01", Data: map[string]interface{}{"site": "fra"}},
+	}
+	highlight, err := ParseFieldMatch("site=fra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, w := range []io.Writer{new(bytes.Buffer), file} {
+		if colorEnabled("auto", w) {
+			t.Errorf("auto colors output to %T, which is not a terminal", w)
+		}
+	}
+
+	for _, tc := range []struct {
+		mode      string
+		formatter func(color bool) OutputFormatter
+	}{
+		{"table", func(color bool) OutputFormatter { return TableOutputFormatter{Color: color, Highlight: highlight} }},
+		{"block", func(color bool) OutputFormatter { return BlockOutputFormatter{Color: color, Highlight: highlight} }},
+	} {
+		var plain bytes.Buffer
+		if err := tc.formatter(colorEnabled("auto", &plain)).Format(&plain, hosts); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(plain.String(), "\x1b[") {
+			t.Errorf("%s output under auto has escape codes: %q", tc.mode, plain.String())
+		}
+
+		var colored bytes.Buffer
+		if err := tc.formatter(colorEnabled("always", &colored)).Format(&colored, hosts); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(colored.String(), ansiHeader) {
+			t.Errorf("%s output under always has no colored header: %q", tc.mode, colored.String())
+		}
+		if n := strings.Count(colored.String(), ansiHighlight); n != 1 {
+			t.Errorf("%s output highlights %d cells, want only site=fra: %q", tc.mode, n, colored.String())
+		}
+	}
+
+	for mode, valid := range map[string]bool{"auto": true, "always": true, "never": true, "sometimes": false} {
+		if err := ValidateColorMode(mode); (err == nil) != valid {
+			t.Errorf("ValidateColorMode(%q) = %v", mode, err)
+		}
+	}
+}
+
+// getLog is a KV that records its gets and their key ranges.
+type getLog struct {
+	clientv3.KV
+	gets   []clientv3.Op
+	ranges [][2]string
+}
+
+func (l *getLog) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	op := clientv3.OpGet(key, opts...)
+	l.gets = append(l.gets, op)
+	l.ranges = append(l.ranges, [2]string{string(op.KeyBytes()), string(op.RangeBytes())})
+	return l.KV.Get(ctx, key, opts...)
+}
+
+func TestListNamePrefix(t *testing.T) {
+	inv := newTestInventory(t)
+	for name, site := range map[string]string{"web01": "ams", "web02": "fra", "webmail": "ams", "db01": "ams"} {
+		if err := inv.CreateHost(name, map[string]interface{}{"site": site}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log := &getLog{KV: inv.kv}
+	inv.kv = log
+	filter, err := ParseHostFilter("site=ams")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		prefix string
+		filter HostFilter
+		want   []string
+	}{
+		{"web", nil, []string{"web01", "web02", "webmail"}},
+		{"web0", nil, []string{"web01", "web02"}},
+		{"web", filter, []string{"web01", "webmail"}},
+		{"mail", nil, nil},
+	} {
+		log.ranges = nil
+		result, err := inv.ListHostsWithOptions(ListOptions{NamePrefix: tc.prefix, Filter: tc.filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, host := range result.Hosts {
+			names = append(names, host.Name)
+		}
+		if !slices.Equal(names, tc.want) {
+			t.Errorf("prefix %q lists %v, want %v", tc.prefix, names, tc.want)
+		}
+		start := inv.hostKey(tc.prefix)
+		want := [2]string{start, clientv3.GetPrefixRangeEnd(start)}
+		if !slices.Contains(log.ranges, want) {
+			t.Errorf("prefix %q read the ranges %q, want %q", tc.prefix, log.ranges, want)
+		}
+	}
+}
+
+func TestCreateHostIfNotExists(t *testing.T) {
+	inv := newTestInventory(t)
+	if err := inv.CreateHostIfNotExists("web01", map[string]interface{}{"site": "ams"}); err != nil {
+		t.Fatal(err)
+	}
+	err := inv.CreateHostIfNotExists("web01", map[string]interface{}{"site": "fra"})
+	if !errors.Is(err, ErrHostExists) {
+		t.Fatalf("second create = %v, want ErrHostExists", err)
+	}
+	host, err := inv.GetHost("web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Data["site"] != "ams" {
+		t.Errorf("site = %v after the refused create, want ams", host.Data["site"])
+	}
+
+	// A plain create still overwrites.
+	if err := inv.CreateHost("web01", map[string]interface{}{"site": "fra"}); err != nil {
+		t.Fatal(err)
+	}
+	if host, err = inv.GetHost("web01"); err != nil {
+		t.Fatal(err)
+	}
+	if host.Data["site"] != "fra" {
+		t.Errorf("site = %v after the overwrite, want fra", host.Data["site"])
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	blob := []byte{0x00, 0xde, 0xad, 0xbe, 0xef, 0xff, '\n'}
+	for _, ordered := range []bool{false, true} {
+		t.Run(fmt.Sprint("ordered=", ordered), func(t *testing.T) {
+			server, client := etcdtest.Start(t)
+			inv := NewInventory(client)
+			inv.PreserveOrder = ordered
+			if err := inv.CreateHost("web01", map[string]interface{}{"cert": blob, "mangled": string(blob[1:5]), "site": "ams"}); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(server.Keys()[inv.hostKey("web01")], `"`+binaryMarker+`"`) {
+				t.Errorf("stored %s, want the bytes tagged %s", server.Keys()[inv.hostKey("web01")], binaryMarker)
+			}
+			if err := inv.UpdateHostFieldValue("web01", "key", blob[:3]); err != nil {
+				t.Fatal(err)
+			}
+			host, err := inv.GetHost("web01")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for field, want := range map[string][]byte{"cert": blob, "mangled": blob[1:5], "key": blob[:3]} {
+				got, ok := host.Data[field].([]byte)
+				if !ok || !bytes.Equal(got, want) {
+					t.Errorf("%s = %#v, want the bytes %x", field, host.Data[field], want)
+				}
+				if name := TypeName(host.Data[field]); name != "Binary" {
+					t.Errorf("TypeName(%s) = %s, want Binary", field, name)
+				}
+			}
+			if host.Data["site"] != "ams" {
+				t.Errorf("site = %#v, want the string ams", host.Data["site"])
+			}
+		})
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	hosts := []Host{
+		{Name: "web01", Data: map[string]interface{}{"password": "hunter2", "dnsdomain": "example.com"}},
+		{Name: "db01", Data: map[string]interface{}{"dnsdomain": "example.org"}},
+	}
+	fqdn, err := ComputeField("fqdn", "{{.Name}}.{{.Data.dnsdomain}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ApplyTransforms([]HostTransform{RedactFields([]string{"password"}), fqdn}, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{
+		{"password": redactedPlaceholder, "dnsdomain": "example.com", "fqdn": "web01.example.com"},
+		{"dnsdomain": "example.org", "fqdn": "db01.example.org"},
+	}
+	for n, host := range got {
+		if !maps.Equal(host.Data, want[n]) {
+			t.Errorf("%s = %v, want %v", host.Name, host.Data, want[n])
+		}
+	}
+	if hosts[0].Data["password"] != "hunter2" || len(hosts[0].Data) != 2 {
+		t.Errorf("transforms modified the hosts passed in: %v", hosts[0].Data)
+	}
+
+	if _, err := ComputeField("bad", "{{.Name"); err == nil {
+		t.Error("ComputeField accepted an unterminated template")
+	}
+}
+
+func TestHostNameEncoding(t *testing.T) {
+	server, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	names := []string{"rack 1/web01", "a%2Fb", "tab\there", "plain"}
+	for _, name := range names {
+		if err := inv.CreateHost(name, map[string]interface{}{"name": name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key := range server.Keys() {
+		if segment := strings.TrimPrefix(key, baseKey); strings.ContainsAny(segment, "/ \t") {
+			t.Errorf("key %q has an unencoded name segment", key)
+		}
+	}
+	result, err := inv.ListHostsWithOptions(ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, host := range result.Hosts {
+		listed = append(listed, host.Name)
+		if host.Data["name"] != host.Name {
+			t.Errorf("listed %q with the data of %q", host.Name, host.Data["name"])
+		}
+	}
+	slices.Sort(listed)
+	slices.Sort(names)
+	if !slices.Equal(listed, names) {
+		t.Errorf("listed %q, want %q", listed, names)
+	}
+	for _, name := range names {
+		if _, err := inv.GetHost(name); err != nil {
+			t.Errorf("GetHost(%q): %v", name, err)
+		}
+	}
+
+	inv.RawNames = true
+	if err := inv.CreateHost("rack 1/web02", nil); err == nil {
+		t.Error("raw names accepted a name with '/'")
+	}
+	if err := inv.CreateHost("legacy host", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Keys()[baseKey+"legacy host"]; !ok {
+		t.Errorf("raw name stored under %q, want it unencoded", slices.Collect(maps.Keys(server.Keys())))
+	}
+}
+
+func TestPrettyCompact(t *testing.T) {
+	hosts := []Host{
+		{Name: "web01", Data: map[string]interface{}{"site": "ams", "ports": []interface{}{80.0, 443.0}}},
+		{Name: "db01", Data: map[string]interface{}{"limits": map[string]interface{}{"cpu": 2.0}}},
+	}
+	for _, tc := range []struct {
+		name            string
+		pretty, compact bool
+		// indented is the whitespace expected; piped output is compact
+		// unless Pretty asks otherwise.
+		indented bool
+	}{
+		{"default when piped", false, false, false},
+		{"pretty", true, false, true},
+		{"compact", false, true, false},
+	} {
+		for _, format := range []string{"json", "xml"} {
+			var b bytes.Buffer
+			if err := WriteOutput(&b, OutputOptions{Format: format, Pretty: tc.pretty, Compact: tc.compact}, hosts); err != nil {
+				t.Fatal(err)
+			}
+			out := strings.TrimSuffix(b.String(), "\n")
+			// The XML declaration is on a line of its own either way.
+			body := strings.TrimPrefix(out, strings.TrimSuffix(xml.Header, "\n")+"\n")
+			if got := strings.Contains(body, "\n"); got != tc.indented {
+				t.Errorf("%s %s: indented = %v, want %v:\n%s", tc.name, format, got, tc.indented, out)
+			}
+			if !tc.indented {
+				continue
+			}
+			// Indenting only adds whitespace.
+			var compact bytes.Buffer
+			if err := WriteOutput(&compact, OutputOptions{Format: format, Compact: true}, hosts); err != nil {
+				t.Fatal(err)
+			}
+			squeezed := xml.Header + regexp.MustCompile(`>\s+<`).ReplaceAllString(body, "><") + "\n"
+			if format == "json" {
+				var buf bytes.Buffer
+				if err := json.Compact(&buf, b.Bytes()); err != nil {
+					t.Fatal(err)
+				}
+				squeezed = buf.String() + "\n"
+			}
+			if squeezed != compact.String() {
+				t.Errorf("%s: pretty output differs from compact beyond whitespace:\n%s\n%s", format, b.String(), compact.String())
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		pretty, compact, terminal bool
+		want                      bool
+	}{
+		{false, false, true, true},
+		{false, false, false, false},
+		{true, false, false, true},
+		{false, true, true, false},
+	} {
+		if got := (OutputOptions{Pretty: tc.pretty, Compact: tc.compact}).Indent(tc.terminal); got != tc.want {
+			t.Errorf("Indent(%v) with pretty %v, compact %v = %v, want %v", tc.terminal, tc.pretty, tc.compact, got, tc.want)
+		}
+	}
+}
+
+func TestXMLOutput(t *testing.T) {
+	host := Host{Name: "web01", Data: map[string]interface{}{
+		"site":    "ams & fra",
+		"port":    8080.0,
+		"active":  true,
+		"retired": nil,
+		"ip":      "10.0.0.1",
+		"tags":    []interface{}{"web", 1.0},
+		"limits":  map[string]interface{}{"cpu": 2.0},
+		"cert":    []byte{0x00, 0xff},
+	}}
+	var b bytes.Buffer
+	if err := (XMLOutputFormatter{}).Format(&b, []Host{host}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<host name="web01">`,
+		`<field name="site" type="String">ams &amp; fra</field>`,
+		`<field name="port" type="Number">8080</field>`,
+		`<field name="active" type="Boolean">true</field>`,
+		`<field name="retired" type="Null"></field>`,
+		`<field name="ip" type="IPAddress">10.0.0.1</field>`,
+		`<field name="cert" type="Binary">AP8=</field>`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("output lacks %s:\n%s", want, b.String())
+		}
+	}
+
+	var doc xmlHosts
+	if err := xml.Unmarshal(b.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Hosts) != 1 || doc.Hosts[0].Name != host.Name || !reflect.DeepEqual(doc.Hosts[0].Data, host.Data) {
+		t.Errorf("round trip gave %+v, want %+v", doc.Hosts, host)
+	}
+}
+
+func TestPutAndReplaceHost(t *testing.T) {
+	inv := newTestInventory(t)
+	for n, want := range []bool{false, true} {
+		overwrote, err := inv.PutHost("web01", map[string]interface{}{"n": n})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if overwrote != want {
+			t.Errorf("put %d reported overwrote=%v, want %v", n, overwrote, want)
+		}
+	}
+
+	if err := inv.ReplaceHost("db01", map[string]interface{}{}); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("replacing a missing host = %v, want ErrHostNotFound", err)
+	}
+	if _, err := inv.GetHost("db01"); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("the refused replace created db01: %v", err)
+	}
+	if err := inv.ReplaceHost("web01", map[string]interface{}{"n": "replaced"}); err != nil {
+		t.Fatal(err)
+	}
+	host, err := inv.GetHost("web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Data["n"] != "replaced" {
+		t.Errorf("n = %v, want replaced", host.Data["n"])
+	}
+}
+
+func TestListHostsSince(t *testing.T) {
+	server, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	for _, name := range []string{"a", "b"} {
+		if err := inv.CreateHost(name, map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pulled := server.Revision()
+	if err := inv.UpdateHostFieldValue("b", "site", "ams"); err != nil {
+		t.Fatal(err)
+	}
+	updated := server.Revision()
+	if err := inv.CreateHost("c", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		rev  int64
+		want []string
+	}{
+		{0, []string{"a", "b", "c"}},
+		{pulled, []string{"b", "c"}},
+		{updated, []string{"c"}},
+		{server.Revision(), nil},
+	} {
+		hosts, err := inv.ListHostsSince(tc.rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, host := range hosts {
+			names = append(names, host.Name)
+		}
+		if !slices.Equal(names, tc.want) {
+			t.Errorf("since revision %d: %v, want %v", tc.rev, names, tc.want)
+		}
+	}
+}
+
+func TestTableColumns(t *testing.T) {
+	hosts := []Host{
+		{Name: "web01", Data: map[string]interface{}{"site": "ams", "os": "debian", "notes": "spare", "rack": "r1"}},
+		{Name: "db01", Data: map[string]interface{}{"site": "fra", "serial": "X1"}},
+	}
+	for _, tc := range []struct {
+		output OutputOptions
+		header string
+	}{
+		{OutputOptions{Format: "table", Columns: SplitList(DefaultColumns)}, "NAME   os      site"},
+		{OutputOptions{Format: "table", Columns: []string{"rack", "site", "missing"}}, "NAME   rack  site"},
+		{OutputOptions{Format: "table", Columns: SplitList(DefaultColumns), Wide: true}, "NAME   notes  os      rack  serial  site"},
+	} {
+		formatter, err := newFormatter(tc.output, false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := formatter.Format(&b, hosts); err != nil {
+			t.Fatal(err)
+		}
+		if header, _, _ := strings.Cut(b.String(), "\n"); header != tc.header {
+			t.Errorf("columns %v (wide %v) give the header %q, want %q", tc.output.Columns, tc.output.Wide, header, tc.header)
+		}
+	}
+}
+
+func TestListWithTTL(t *testing.T) {
+	inv := newTestInventory(t)
+	if _, err := inv.PutWithTTL(Host{Name: "leased", Data: map[string]interface{}{}}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.CreateHost("permanent", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := inv.ListHostsWithOptions(ListOptions{WithTTL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttls := make(map[string]interface{})
+	for _, host := range result.Hosts {
+		ttls[host.Name] = host.Data[TTLField]
+	}
+	if ttl, ok := ttls["leased"].(int64); !ok || ttl <= 0 || ttl > 60 {
+		t.Errorf("leased host has %s %#v, want the seconds left of a minute", TTLField, ttls["leased"])
+	}
+	if ttls["permanent"] != "permanent" {
+		t.Errorf("unleased host has %s %#v, want permanent", TTLField, ttls["permanent"])
+	}
+
+	result, err = inv.ListHostsWithOptions(ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range result.Hosts {
+		if _, ok := host.Data[TTLField]; ok {
+			t.Errorf("%s has %s without WithTTL", host.Name, TTLField)
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	for _, tc := range []struct{ target, patch, want string }{
+		{`{"a": "b"}`, `{"c": "d"}`, `{"a": "b", "c": "d"}`},
+		{`{"a": "b"}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "b", "c": "d"}`, `{"a": null}`, `{"c": "d"}`},
+		{`{"a": "b"}`, `{"x": null}`, `{"a": "b"}`},
+		{`{"a": {"b": "c", "d": "e"}}`, `{"a": {"d": null, "f": "g"}}`, `{"a": {"b": "c", "f": "g"}}`},
+		{`{"a": "b"}`, `{"a": {"c": "d"}}`, `{"a": {"c": "d"}}`},
+		{`{"a": ["b"]}`, `{"a": ["c", "d"]}`, `{"a": ["c", "d"]}`},
+		{`{"a": {"b": "c"}}`, `{"a": {"b": {"c": null}}}`, `{"a": {"b": {}}}`},
+	} {
+		decode := func(s string) map[string]interface{} {
+			var m map[string]interface{}
+			if err := json.Unmarshal([]byte(s), &m); err != nil {
+				t.Fatal(err)
+			}
+			return m
+		}
+		target, want := decode(tc.target), decode(tc.want)
+		mergePatch(target, decode(tc.patch))
+		if !reflect.DeepEqual(target, want) {
+			t.Errorf("patching %s with %s gave %v, want %s", tc.target, tc.patch, target, tc.want)
+		}
+	}
+
+	inv := newTestInventory(t)
+	if err := inv.CreateHost("web01", map[string]interface{}{"site": "ams", "rack": "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.PatchHostData("web01", map[string]interface{}{"site": "fra", "rack": nil, "os": "debian"}); err != nil {
+		t.Fatal(err)
+	}
+	host, err := inv.GetHost("web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Data["site"] != "fra" || host.Data["os"] != "debian" || host.Data["rack"] != nil {
+		t.Errorf("patched host has %v, want site fra, os debian and no rack", host.Data)
+	}
+	if err := inv.PatchHostData("missing", map[string]interface{}{"site": "fra"}); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("patching a missing host = %v, want ErrHostNotFound", err)
+	}
+}
+
+func TestTableTruncation(t *testing.T) {
+	long := strings.Repeat("x", 60)
+	hosts := []Host{{Name: "web01", Data: map[string]interface{}{"notes": long, "site": "ams"}}}
+	format := func(output OutputOptions, termWidth int) string {
+		t.Helper()
+		output.Format, output.Wide = "table", true
+		formatter, err := newFormatter(output, false, termWidth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := formatter.Format(&b, hosts); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	out := format(OutputOptions{}, 40)
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if n := utf8.RuneCountInString(line); n > 40 {
+			t.Errorf("line of %d columns on a 40-column terminal: %q", n, line)
+		}
+	}
+	if !strings.Contains(out, "x…") {
+		t.Errorf("truncated notes lack an ellipsis:\n%s", out)
+	}
+	if out := format(OutputOptions{MaxColWidth: 10}, 200); !strings.Contains(out, strings.Repeat("x", 9)+"…  ams") {
+		t.Errorf("--max-col-width 10 gave:\n%s", out)
+	}
+	for name, out := range map[string]string{"no terminal": format(OutputOptions{}, 0), "--no-truncate": format(OutputOptions{NoTruncate: true}, 40)} {
+		if !strings.Contains(out, long) || strings.Contains(out, "…") {
+			t.Errorf("%s truncated the table:\n%s", name, out)
+		}
+	}
+}
+
+func TestListSkipsMalformed(t *testing.T) {
+	_, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	if err := inv.CreateHost("web01", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.CreateHost("web03", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Put(context.Background(), inv.hostKey("web02"), `{"name": "web02", "data": `); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := inv.ListHostsWithOptions(ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, host := range result.Hosts {
+		names = append(names, host.Name)
+	}
+	if !slices.Equal(names, []string{"web01", "web03"}) {
+		t.Errorf("listed %v, want the two valid hosts", names)
+	}
+	var malformed *MalformedHostError
+	if len(result.Malformed) != 1 || !errors.As(result.Malformed[0], &malformed) || malformed.Key != inv.hostKey("web02") {
+		t.Errorf("malformed = %v, want the key of web02", result.Malformed)
+	}
+
+	_, err = inv.ListHostsWithOptions(ListOptions{Strict: true})
+	if !errors.As(err, &malformed) || malformed.Key != inv.hostKey("web02") {
+		t.Errorf("strict listing = %v, want a MalformedHostError for web02", err)
+	}
+}
+
+func TestCIDRFilter(t *testing.T) {
+	hosts := []Host{
+		{Name: "inside", Data: map[string]interface{}{"ip": "10.1.2.3"}},
+		{Name: "prefixed", Data: map[string]interface{}{"ip": "10.200.0.1/24"}},
+		{Name: "outside", Data: map[string]interface{}{"ip": "192.168.1.1"}},
+		{Name: "v6", Data: map[string]interface{}{"ip": "fd00::1"}},
+		{Name: "several", Data: map[string]interface{}{"ip": []interface{}{"192.168.1.2", "10.0.0.9"}}},
+		{Name: "garbage", Data: map[string]interface{}{"ip": "not-an-ip"}},
+		{Name: "none", Data: map[string]interface{}{}},
+	}
+	for _, tc := range []struct {
+		expr string
+		want []string
+	}{
+		{"ip in 10.0.0.0/8", []string{"inside", "prefixed", "several"}},
+		{"ip in 10.1.0.0/16", []string{"inside"}},
+		{"ip in fd00::/8", []string{"v6"}},
+		{"ip in 10.0.0.0/8, name!=several", []string{"inside", "prefixed"}},
+	} {
+		filter, err := ParseHostFilter(tc.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, host := range hosts {
+			if filter.Match(host) {
+				got = append(got, host.Name)
+			}
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%q matches %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+	if _, err := ParseHostFilter("ip in 10.0.0.0/33"); err == nil {
+		t.Error("accepted an invalid CIDR")
+	}
+
+	for value, want := range map[string]string{"10.1.2.3": "IPAddress", "fd00::1": "IPAddress", "10.0.0.0/8": "CIDR", "web": "String"} {
+		if got := TypeName(value); got != want {
+			t.Errorf("TypeName(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestJSONOutputGolden(t *testing.T) {
+	hosts := []Host{
+		{Name: "web02", Data: map[string]interface{}{"site": "fra", "ports": []interface{}{443.0, 80.0}}},
+		{Name: "db01", Data: map[string]interface{}{"site": "ams", "limits": map[string]interface{}{"mem": "4G", "cpu": 2.0, "disk": map[string]interface{}{"root": "20G", "data": "1T"}}}},
+		{Name: "web01", Data: map[string]interface{}{"z": true, "a": nil, "m": "x"}},
+	}
+	for _, tc := range []struct {
+		golden  string
+		compact bool
+	}{
+		{"hosts.json", false},
+		{"hosts-compact.json", true},
+	} {
+		formatter := JSONOutputFormatter{Compact: tc.compact}
+		var whole bytes.Buffer
+		if err := formatter.Format(&whole, hosts); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, tc.golden, whole.Bytes())
+
+		// The same hosts again in another order, and in pages, give the
+		// same bytes.
+		var paged bytes.Buffer
+		reversed := slices.Clone(hosts)
+		slices.Reverse(reversed)
+		if err := formatter.FormatPage(&paged, []Host{hosts[1]}, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := formatter.FormatPage(&paged, []Host{hosts[2], hosts[0]}, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := formatter.FinishPages(&paged); err != nil {
+			t.Fatal(err)
+		}
+		var again bytes.Buffer
+		if err := formatter.Format(&again, reversed); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again.Bytes(), whole.Bytes()) {
+			t.Errorf("%s: output depends on the order of the hosts:\n%s", tc.golden, again.Bytes())
+		}
+		if !bytes.Equal(paged.Bytes(), whole.Bytes()) {
+			t.Errorf("%s: paged output differs:\n%s", tc.golden, paged.Bytes())
+		}
+	}
+}
+
+func TestTypedCSVRoundTrip(t *testing.T) {
+	src := newTestInventory(t)
+	for name, data := range map[string]map[string]interface{}{
+		"web01": {"site": "ams, \"north\"", "port": 8080.0, "active": true, "notes": "line one\nline two"},
+		"db01":  {"tags": []interface{}{"db", "primary"}, "limits": map[string]interface{}{"cpu": 2.0}, "retired": nil},
+		"empty": {},
+	} {
+		if err := src.CreateHost(name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exported, err := src.ListHostsWithOptions(ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var csv bytes.Buffer
+	if err := (TypedCsvOutputFormatter{}).Format(&csv, exported.Hosts); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeCSVHosts(&csv, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := newTestInventory(t)
+	for _, host := range decoded {
+		if _, err := dst.Put(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	imported, err := dst.ListHostsWithOptions(ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported.Hosts) != len(exported.Hosts) {
+		t.Fatalf("imported %d hosts, want %d", len(imported.Hosts), len(exported.Hosts))
+	}
+	for n, host := range imported.Hosts {
+		want := exported.Hosts[n]
+		// Writing the host stamps it anew.
+		delete(host.Data, UpdatedAtField)
+		delete(want.Data, UpdatedAtField)
+		if host.Name != want.Name || !reflect.DeepEqual(host.Data, want.Data) {
+			t.Errorf("imported %s %v, want %s %v", host.Name, host.Data, want.Name, want.Data)
+		}
+	}
+}
+
+func TestDecodeCSVHostsTypedColumns(t *testing.T) {
+	input := "name,port:Number,active:Boolean,site\n" +
+		"web01,8080,true,\"ams, north\"\n" +
+		"web02,,false,12\n"
+	for _, tc := range []struct {
+		infer bool
+		want  []Host
+	}{
+		{false, []Host{
+			{Name: "web01", Data: map[string]interface{}{"port": 8080.0, "active": true, "site": "ams, north"}},
+			{Name: "web02", Data: map[string]interface{}{"active": false, "site": "12"}},
+		}},
+		{true, []Host{
+			{Name: "web01", Data: map[string]interface{}{"port": 8080.0, "active": true, "site": "ams, north"}},
+			{Name: "web02", Data: map[string]interface{}{"active": false, "site": 12.0}},
+		}},
+	} {
+		hosts, err := DecodeCSVHosts(strings.NewReader(input), tc.infer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(hosts, tc.want) {
+			t.Errorf("infer=%v decoded %+v, want %+v", tc.infer, hosts, tc.want)
+		}
+	}
+	if _, err := DecodeCSVHosts(strings.NewReader("name,port:Number\nweb01,eighty\n"), false); err == nil {
+		t.Error("decoded a Number column holding eighty")
+	}
+}
+
+func TestValueEncodings(t *testing.T) {
+	data := map[string]interface{}{
+		"site":    "ams",
+		"port":    8080.0,
+		"active":  true,
+		"retired": nil,
+		"tags":    []interface{}{"web", 1.5, nil},
+		"limits":  map[string]interface{}{"cpu": 2.0, "disk": map[string]interface{}{"root": "20G"}},
+		"cert":    []byte{0x00, 0xff},
+	}
+	for _, encoding := range []string{"", "json", "gob", "msgpack"} {
+		t.Run(encoding, func(t *testing.T) {
+			server, client := etcdtest.Start(t)
+			writer := NewInventory(client)
+			writer.ValueEncoding = encoding
+			if err := writer.CreateHost("web01", data); err != nil {
+				t.Fatal(err)
+			}
+			stored := server.Keys()[writer.hostKey("web01")]
+			prefix := map[string]byte{"gob": gobPrefix, "msgpack": msgpackPrefix}[encoding]
+			if prefix != 0 && stored[0] != prefix {
+				t.Errorf("stored value starts with %#x, want %#x", stored[0], prefix)
+			}
+			if prefix == 0 && stored[0] != '{' {
+				t.Errorf("stored value %q is not JSON", stored)
+			}
+
+			// Any Inventory reads it, whatever its own encoding.
+			host, err := NewInventory(client).GetHost("web01")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for field, want := range data {
+				if got := host.Data[field]; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %#v, want %#v", field, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestListRecentFirst(t *testing.T) {
+	inv := newTestInventory(t)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := inv.CreateHost(name, map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := inv.UpdateHostFieldValue("a", "site", "ams"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		limit int64
+		want  []string
+	}{
+		{0, []string{"a", "c", "b"}},
+		{2, []string{"a", "c"}},
+	} {
+		result, err := inv.ListHostsWithOptions(ListOptions{RecentFirst: true, Limit: tc.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		last := int64(-1)
+		for _, host := range result.Hosts {
+			names = append(names, host.Name)
+			rev, ok := host.Data[ModRevisionField].(int64)
+			if !ok || (last >= 0 && rev >= last) {
+				t.Errorf("%s has %s %#v after %d, want a lower revision", host.Name, ModRevisionField, host.Data[ModRevisionField], last)
+			}
+			last = rev
+		}
+		if !slices.Equal(names, tc.want) {
+			t.Errorf("limit %d lists %v, want %v", tc.limit, names, tc.want)
+		}
+	}
+}
+
+func TestEnvOutput(t *testing.T) {
+	notes := `it's "$HOME" $(rm -rf /) ` + "`id`\nsecond line"
+	host := Host{Name: "web01", Data: map[string]interface{}{
+		"notes":   notes,
+		"ip-addr": "10.0.0.1",
+		"2fa":     true,
+		"tags":    []interface{}{"a", "b"},
+	}}
+	var b bytes.Buffer
+	if err := (EnvOutputFormatter{}).Format(&b, []Host{host}); err != nil {
+		t.Fatal(err)
+	}
+	want := "NAME='web01'\n" +
+		"_2FA='true'\n" +
+		"IP_ADDR='10.0.0.1'\n" +
+		"NOTES='it'\\''s \"$HOME\" $(rm -rf /) `id`\nsecond line'\n" +
+		"TAGS='[\"a\",\"b\"]'\n"
+	if b.String() != want {
+		t.Errorf("output:\n%s\nwant:\n%s", b.String(), want)
+	}
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to evaluate the output with")
+	}
+	out, err := exec.Command(sh, "-c", b.String()+`printf '%s|%s' "$NOTES" "$TAGS"`).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(out); got != notes+`|["a","b"]` {
+		t.Errorf("sh evaluated the values to %q", got)
+	}
+}
+
+func TestHostCache(t *testing.T) {
+	server, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	other := NewInventory(client)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := inv.CreateHost(name, map[string]interface{}{"v": "1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ranges atomic.Int32
+	server.Fault = func(method string, applied bool) error {
+		if method == "range" && !applied {
+			ranges.Add(1)
+		}
+		return nil
+	}
+	// get returns the v of host and whether reading it went to etcd.
+	get := func(inv *Inventory, name string) (interface{}, bool) {
+		t.Helper()
+		before := ranges.Load()
+		host, err := inv.GetHost(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return host.Data["v"], ranges.Load() > before
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inv.EnableCache(ctx, 2, 200*time.Millisecond, false)
+	if _, read := get(inv, "a"); !read {
+		t.Error("first get of a was served without reading etcd")
+	}
+	if _, read := get(inv, "a"); read {
+		t.Error("second get of a missed the cache")
+	}
+
+	// Local writes invalidate; other clients' writes show after the TTL.
+	if err := inv.UpdateHostFieldValue("a", "v", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if v, read := get(inv, "a"); v != "2" || !read {
+		t.Errorf("get after a local write = %v (read %v), want a fresh 2", v, read)
+	}
+	if err := other.UpdateHostFieldValue("a", "v", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := get(inv, "a"); v != "2" {
+		t.Errorf("get within the TTL = %v, want the cached 2", v)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if v, read := get(inv, "a"); v != "3" || !read {
+		t.Errorf("get past the TTL = %v (read %v), want a fresh 3", v, read)
+	}
+
+	// Holding two hosts, reading a third evicts the least recently used.
+	get(inv, "b")
+	get(inv, "c")
+	if _, read := get(inv, "b"); read {
+		t.Error("b was evicted before a")
+	}
+	if _, read := get(inv, "a"); !read {
+		t.Error("a was not evicted")
+	}
+
+	watched := NewInventory(client)
+	watched.EnableCache(ctx, 10, time.Hour, true)
+	get(watched, "b")
+	// The watch starts in the background, so write until one is seen.
+	for n := 0; ; n++ {
+		want := fmt.Sprint("w", n)
+		if err := other.UpdateHostFieldValue("b", "v", want); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if v, _ := get(watched, "b"); v == want {
+			break
+		}
+		if n == 100 {
+			t.Fatal("the watched cache never saw a change made elsewhere")
+		}
+	}
+}
+
+func TestRemoveHostsMatching(t *testing.T) {
+	inv := newTestInventory(t)
+	var tests []string
+	for n := 0; n < removeBatchSize+5; n++ {
+		tests = append(tests, fmt.Sprintf("test-%02d", n))
+	}
+	for _, name := range append(slices.Clone(tests), "testing", "prod-1", "prod-2") {
+		site := "ams"
+		if name == "prod-2" {
+			site = "fra"
+		}
+		if err := inv.CreateHost(name, map[string]interface{}{"site": site}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filter, err := ParseHostFilter("site=fra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, err := inv.HostNamesMatching("prod-*", filter); err != nil || !slices.Equal(names, []string{"prod-2"}) {
+		t.Errorf("prod-* with site=fra = %v, %v, want prod-2", names, err)
+	}
+	if _, err := inv.RemoveHostsMatching("test-[0-"); err == nil {
+		t.Error("removed with a malformed pattern")
+	}
+
+	deleted, err := inv.RemoveHostsMatching("test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != int64(len(tests)) {
+		t.Errorf("deleted %d hosts, want %d", deleted, len(tests))
+	}
+	left, err := inv.ListHostNames("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"prod-1", "prod-2", "testing"}; !slices.Equal(left, want) {
+		t.Errorf("left %v, want %v", left, want)
+	}
+}
+
+func TestListHostNames(t *testing.T) {
+	inv := newTestInventory(t)
+	for _, name := range []string{"web02", "db01", "web01", "web 03"} {
+		if err := inv.CreateHost(name, map[string]interface{}{"blob": strings.Repeat("x", 1000)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log := &getLog{KV: inv.kv}
+	inv.kv = log
+	for _, tc := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"db01", "web 03", "web01", "web02"}},
+		{"web0", []string{"web01", "web02"}},
+	} {
+		names, err := inv.ListHostNames(tc.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(names, tc.want) {
+			t.Errorf("prefix %q: %v, want %v", tc.prefix, names, tc.want)
+		}
+	}
+	for _, op := range log.gets {
+		if !op.IsKeysOnly() {
+			t.Errorf("get of %q fetched the values", op.KeyBytes())
+		}
+	}
+	if len(log.gets) != 2 {
+		t.Errorf("%d gets for 2 listings", len(log.gets))
+	}
+}
+
+func TestAliases(t *testing.T) {
+	inv := newTestInventory(t)
+	if err := inv.CreateHost("web01", map[string]interface{}{"mgmt_ipv4_addr": "10.0.0.1", "site": "ams"}); err != nil {
+		t.Fatal(err)
+	}
+	aliases := AliasMap{}
+	if err := aliases.Set("mgmt_ipv4_addr=Management IP"); err != nil {
+		t.Fatal(err)
+	}
+	if err := aliases.Set("nope"); err == nil {
+		t.Error("accepted an alias without =")
+	}
+	hosts, err := inv.ListHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for format, want := range map[string]string{
+		"table": "NAME   Management IP  site",
+		"csv":   `""Management IP"":""10.0.0.1""`,
+		"json":  `"Management IP": "10.0.0.1"`,
+		"yaml":  "Management IP: 10.0.0.1",
+		"xml":   `<field name="Management IP" type="IPAddress">10.0.0.1</field>`,
+	} {
+		var b bytes.Buffer
+		output := OutputOptions{Format: format, Aliases: aliases, Columns: []string{"mgmt_ipv4_addr", "site"}, Pretty: true}
+		if err := WriteOutput(&b, output, hosts); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(b.String(), want) || strings.Contains(b.String(), "mgmt_ipv4_addr") {
+			t.Errorf("%s output lacks %q or shows the stored name:\n%s", format, want, b.String())
+		}
+	}
+
+	host, err := inv.GetHost("web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Data["mgmt_ipv4_addr"] != "10.0.0.1" {
+		t.Errorf("stored data changed: %v", host.Data)
+	}
+}
+
+func TestWatchHostsResyncsAfterCompaction(t *testing.T) {
+	server, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	for _, name := range []string{"a", "b"} {
+		if err := inv.CreateHost(name, map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	watched := server.Revision()
+	if err := inv.UpdateHostFieldValue("a", "site", "ams"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.RemoveHosts([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.CreateHost("c", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Compact(context.Background(), server.Revision()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan HostEvent)
+	done := make(chan error, 1)
+	go func() {
+		// The watcher had seen a and b.
+		done <- inv.watchHosts(ctx, watched, map[string]bool{"a": true, "b": true}, false, func(event HostEvent) error {
+			events <- event
+			return nil
+		})
+	}()
+	next := func() HostEvent {
+		t.Helper()
+		select {
+		case event := <-events:
+			return event
+		case err := <-done:
+			t.Fatalf("watch ended: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return HostEvent{}
+	}
+
+	resync := map[string]HostEvent{}
+	for range 3 {
+		event := next()
+		if !event.Resync {
+			t.Errorf("event %+v before the resync finished", event)
+		}
+		resync[event.Name] = event
+	}
+	if event := resync["a"]; event.Type != mvccpb.PUT || event.Host.Data["site"] != "ams" {
+		t.Errorf("resync of a = %+v, want a PUT of its current value", event)
+	}
+	if event := resync["c"]; event.Type != mvccpb.PUT {
+		t.Errorf("resync of c = %+v, want a PUT", event)
+	}
+	if event := resync["b"]; event.Type != mvccpb.DELETE {
+		t.Errorf("resync of b = %+v, want a DELETE", event)
+	}
+
+	// The watch goes on from the resynced revision.
+	if err := inv.CreateHost("d", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if event := next(); event.Name != "d" || event.Type != mvccpb.PUT || event.Resync {
+		t.Errorf("event after the resync = %+v, want the creation of d", event)
+	}
+}
+
+func TestPreserveOrder(t *testing.T) {
+	_, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	inv.PreserveOrder = true
+	order := []string{"zeta", "alpha", "mid"}
+	if _, err := inv.Put(Host{Name: "web01", Data: map[string]interface{}{"alpha": 1.0, "mid": "m", "zeta": true}, Order: order}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.UpdateHostFieldValue("web01", "alpha", 2.0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Any Inventory reads the order back.
+	host, err := NewInventory(client).GetHost("web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := host.fieldOrder(); !slices.Equal(got[:3], order) {
+		t.Fatalf("field order %v, want it to start with %v", got, order)
+	}
+	hosts := []Host{{Name: host.Name, Data: map[string]interface{}{"zeta": true, "alpha": 2.0, "mid": "m"}, Order: host.Order}}
+	for format, want := range map[string]string{
+		"json":  `{"name":"web01","data":{"zeta":true,"alpha":2,"mid":"m"}}`,
+		"yaml":  "{zeta: true, alpha: 2, mid: m}",
+		"table": "NAME   zeta  alpha  mid",
+	} {
+		var b bytes.Buffer
+		if err := WriteOutput(&b, OutputOptions{Format: format, Compact: true, Wide: true}, hosts); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("%s output is not in field order:\n%s", format, b.String())
+		}
+	}
+}
+
+func TestEmptyOutput(t *testing.T) {
+	tmpl, err := ParseOutputTemplate("t", "{{range .}}{{.Name}}\n{{end}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		format   string
+		noHeader bool
+		stdout   string
+		stderr   string
+	}{
+		{format: "table", stderr: "No hosts found\n"},
+		{format: "block", stderr: "No hosts found\n"},
+		{format: "json", stdout: "[]\n"},
+		{format: "yaml", stdout: "[]\n"},
+		{format: "consul", stdout: "[]\n"},
+		{format: "prometheus", stdout: "[]\n"},
+		{format: "xml", stdout: xml.Header + "<hosts></hosts>\n"},
+		{format: "csv", stdout: "Host Name,Host Data\n"},
+		{format: "csv", noHeader: true},
+		{format: "typed-csv", stdout: "Host Name,Host Data Type,Host Data\n"},
+		{format: "rfc4180-csv", stdout: "Host Name,Host Data\r\n"},
+		{format: "rfc4180-csv", noHeader: true},
+		{format: "env"},
+		{format: "script"},
+		{format: "template"},
+		{format: "ansible", stdout: `{"_meta":{"hostvars":{}},"all":{}}` + "\n"},
+		{format: "terraform", stdout: "{\n  \"hosts\": {}\n}\n"},
+		{format: "terraform-hcl", stdout: "locals {\n  hosts = {}\n}\n"},
+	} {
+		stderr, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := os.Stderr
+		os.Stderr = stderr
+		var stdout bytes.Buffer
+		err = WriteOutput(&stdout, OutputOptions{Format: tc.format, NoHeader: tc.noHeader, Template: tmpl}, nil)
+		os.Stderr = saved
+		stderr.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tc.format, err)
+			continue
+		}
+		logged, err := os.ReadFile(stderr.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stdout.String() != tc.stdout || string(logged) != tc.stderr {
+			t.Errorf("%s (no header %v) wrote %q and %q to stderr, want %q and %q", tc.format, tc.noHeader, stdout.String(), logged, tc.stdout, tc.stderr)
+		}
+	}
+}
+
+func TestTouchHost(t *testing.T) {
+	_, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	const old = "2000-01-01T00:00:00Z"
+	if _, err := client.Put(context.Background(), inv.hostKey("permanent"), `{"name":"permanent","data":{"site":"ams","updated_at":"`+old+`"}}`); err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := inv.TouchHost("permanent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed {
+		t.Error("touching a host without a lease renewed one")
+	}
+	host, err := inv.GetHost("permanent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Data[UpdatedAtField] == old || host.Data["site"] != "ams" {
+		t.Errorf("touched host has %v, want a new %s and its site", host.Data, UpdatedAtField)
+	}
+
+	if _, err := inv.PutWithTTL(Host{Name: "leased", Data: map[string]interface{}{}}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	ttl := func() int64 {
+		t.Helper()
+		result, err := inv.ListHostsWithOptions(ListOptions{WithTTL: true, NamePrefix: "leased"})
+		if err != nil || len(result.Hosts) != 1 {
+			t.Fatalf("listing the leased host: %v", err)
+		}
+		return result.Hosts[0].Data[TTLField].(int64)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	before := ttl()
+	if renewed, err = inv.TouchHost("leased"); err != nil {
+		t.Fatal(err)
+	}
+	if !renewed {
+		t.Error("touching a leased host did not renew the lease")
+	}
+	if after := ttl(); after <= before {
+		t.Errorf("lease has %ds left after touch, %ds before", after, before)
+	}
+
+	if _, err := inv.TouchHost("missing"); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("touching a missing host = %v, want ErrHostNotFound", err)
+	}
+}
+
+func TestTruncateValues(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		n     int
+		want  string
+	}{
+		{"abcde", 5, "abcde"},
+		{"abcdef", 5, "abcde…"},
+		{"abcd", 5, "abcd"},
+		{"ab\ncd", 5, "ab…"},
+		{"ab\ncd", 1, "a…"},
+		{"héllo wörld", 5, "héllo…"},
+		{"abcdef", 0, "abcdef"},
+	} {
+		if got := truncateValue(tc.value, tc.n); got != tc.want {
+			t.Errorf("truncateValue(%q, %d) = %q, want %q", tc.value, tc.n, got, tc.want)
+		}
+	}
+
+	hosts := []Host{{Name: "web01", Data: map[string]interface{}{"cert": "-----BEGIN CERTIFICATE-----\nMIIB"}}}
+	for format, want := range map[string]string{
+		"table": "web01  -----BEGIN…",
+		"block": "  cert: -----BEGIN…",
+		"json":  `"cert":"-----BEGIN CERTIFICATE-----\nMIIB"`,
+		"yaml":  "MIIB",
+	} {
+		var b bytes.Buffer
+		if err := WriteOutput(&b, OutputOptions{Format: format, TruncateValues: 10, Wide: true, Compact: true}, hosts); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("%s output with values truncated to 10 lacks %q:\n%s", format, want, b.String())
+		}
+	}
+
+	only, err := OnlyFields([]string{"site", "missing"})([]Host{{Name: "web01", Data: map[string]interface{}{"site": "ams", "cert": "x"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"site": "ams"}; !maps.Equal(only[0].Data, want) {
+		t.Errorf("only site and missing left %v, want %v", only[0].Data, want)
+	}
+}
+
+func TestTags(t *testing.T) {
+	inv := newTestInventory(t)
+	if err := inv.CreateHost("web01", map[string]interface{}{"tags": "prod, web"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.CreateHost("db01", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		host   string
+		add    bool
+		tags   []string
+		want   []string
+		stored interface{}
+	}{
+		{"web01", true, []string{"eu", " web ", "eu", ""}, []string{"eu", "prod", "web"}, []interface{}{"eu", "prod", "web"}},
+		{"db01", true, []string{"db", "prod"}, []string{"db", "prod"}, []interface{}{"db", "prod"}},
+		{"web01", false, []string{"prod", "missing"}, []string{"eu", "web"}, []interface{}{"eu", "web"}},
+		{"db01", false, []string{"db", "prod"}, []string{}, nil},
+	} {
+		var got []string
+		var err error
+		if tc.add {
+			got, err = inv.AddTags(tc.host, tc.tags...)
+		} else {
+			got, err = inv.RemoveTags(tc.host, tc.tags...)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("tags of %s after add=%v %q = %q, want %q", tc.host, tc.add, tc.tags, got, tc.want)
+		}
+		host, err := inv.GetHost(tc.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored := host.Data[tagsField]; !reflect.DeepEqual(stored, tc.stored) {
+			t.Errorf("stored tags of %s = %#v, want %#v", tc.host, stored, tc.stored)
+		}
+	}
+	if _, err := inv.AddTags("missing", "web"); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("tagging a missing host = %v, want ErrHostNotFound", err)
+	}
+
+	if _, err := inv.AddTags("db01", "db", "eu"); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := inv.ListHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		filter string
+		want   []string
+	}{
+		{"tags=eu", []string{"db01", "web01"}},
+		{"tags=web", []string{"web01"}},
+		{"tags!=web", []string{"db01"}},
+		{"tags=prod", nil},
+	} {
+		filter, err := ParseHostFilter(tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, host := range hosts {
+			if filter.Match(host) {
+				names = append(names, host.Name)
+			}
+		}
+		if !slices.Equal(names, tc.want) {
+			t.Errorf("%s matched %v, want %v", tc.filter, names, tc.want)
+		}
+	}
+
+	groups, ungrouped := GroupHosts(hosts, tagsField)
+	if len(ungrouped) != 0 {
+		t.Errorf("hosts without tags: %v", ungrouped)
+	}
+	for tag, want := range map[string][]string{"eu": {"db01", "web01"}, "web": {"web01"}, "db": {"db01"}} {
+		var names []string
+		for _, host := range groups[tag] {
+			names = append(names, host.Name)
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("group %s = %v, want %v", tag, names, want)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	stamp := regexp.MustCompile(`\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ`)
+	for _, tc := range []struct {
+		name   string
+		prefix string
+		run    func(inv *Inventory) error
+		want   string
+	}{
+		{"create", "", func(inv *Inventory) error {
+			return inv.CreateHost("web01", map[string]interface{}{"site": "ams"})
+		}, `1. PUT /hosts/web01 = "{\"name\":\"web01\",\"data\":{\"created_at\":\"T\",\"site\":\"ams\",\"updated_at\":\"T\"}}"
+`},
+		{"update", "", func(inv *Inventory) error {
+			return inv.UpdateHostFieldValueIfRevision("web 01", "site", "fra", 0)
+		}, `1. GET /hosts/web%2001
+2. TXN
+     IF   mod(/hosts/web%2001) = 0
+     THEN PUT /hosts/web%2001 = "{\"name\":\"web 01\",\"data\":{\"created_at\":\"T\",\"site\":\"fra\",\"updated_at\":\"T\"}}"
+`},
+		{"create with prefix", "/team", func(inv *Inventory) error {
+			return inv.CreateHost("web01", map[string]interface{}{"site": "ams"})
+		}, `1. PUT /team/hosts/web01 = "{\"name\":\"web01\",\"data\":{\"created_at\":\"T\",\"site\":\"ams\",\"updated_at\":\"T\"}}"
+`},
+		{"update with prefix", "/team", func(inv *Inventory) error {
+			return inv.UpdateHostFieldValueIfRevision("web01", "site", "fra", 0)
+		}, `1. GET /team/hosts/web01
+2. TXN
+     IF   mod(/team/hosts/web01) = 0
+     THEN PUT /team/hosts/web01 = "{\"name\":\"web01\",\"data\":{\"created_at\":\"T\",\"site\":\"fra\",\"updated_at\":\"T\"}}"
+`},
+	} {
+		var b bytes.Buffer
+		if err := tc.run(NewExplainInventory(&b, tc.prefix)); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := stamp.ReplaceAllString(b.String(), "T"); got != tc.want {
+			t.Errorf("%s explained\n%s\nwant\n%s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSerializableReads(t *testing.T) {
+	inv := newTestInventory(t)
+	if err := inv.CreateHost("web01", map[string]interface{}{"site": "ams"}); err != nil {
+		t.Fatal(err)
+	}
+	log := &getLog{KV: inv.kv}
+	inv.kv = log
+
+	for _, serializable := range []bool{false, true} {
+		inv.Serializable = serializable
+		for _, tc := range []struct {
+			name string
+			read func() error
+			want bool
+		}{
+			{"GetHost", func() error { _, err := inv.GetHost("web01"); return err }, serializable},
+			{"ListHosts", func() error { _, err := inv.ListHosts(); return err }, serializable},
+			{"HostExists", func() error { _, err := inv.HostExists("web01"); return err }, serializable},
+			// The read of a read-modify-write must see the latest value.
+			{"UpdateHostFields", func() error {
+				return inv.UpdateHostFields("web01", map[string]interface{}{"site": "fra"})
+			}, false},
+		} {
+			log.gets = nil
+			if err := tc.read(); err != nil {
+				t.Fatal(err)
+			}
+			if len(log.gets) == 0 {
+				t.Errorf("%s made no Get calls", tc.name)
+			}
+			for _, op := range log.gets {
+				if op.IsSerializable() != tc.want {
+					t.Errorf("%s with Serializable=%v: Get %s serializable=%v, want %v", tc.name, serializable, op.KeyBytes(), op.IsSerializable(), tc.want)
+				}
+			}
+		}
+	}
+}
+
+func TestWriteRules(t *testing.T) {
+	data := func() map[string]interface{} {
+		return map[string]interface{}{
+			"env":   " Prod ",
+			"site":  "AMS",
+			"owner": " Ops Team",
+			"tags":  []interface{}{" Web", "EU "},
+			"note":  "  ",
+			"cores": 8.0,
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		rules *WriteRules
+		want  map[string]interface{}
+	}{
+		{"off", nil, data()},
+		{"trim", &WriteRules{Trim: true}, map[string]interface{}{
+			"env": "Prod", "site": "AMS", "owner": "Ops Team", "tags": []interface{}{"Web", "EU"}, "note": "", "cores": 8.0,
+		}},
+		{"case", &WriteRules{Lowercase: map[string]bool{"env": true, "tags": true}, Uppercase: map[string]bool{"owner": true}}, map[string]interface{}{
+			"env": " prod ", "site": "AMS", "owner": " OPS TEAM", "tags": []interface{}{" web", "eu "}, "note": "  ", "cores": 8.0,
+		}},
+		{"all", &WriteRules{Trim: true, Lowercase: map[string]bool{"env": true, "site": true}, PruneEmpty: true}, map[string]interface{}{
+			"env": "prod", "site": "ams", "owner": "Ops Team", "tags": []interface{}{"Web", "EU"}, "cores": 8.0,
+		}},
+	} {
+		inv := newTestInventory(t)
+		inv.WriteRules = tc.rules
+		given := data()
+		if err := inv.CreateHost("web01", given); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(given, data()) {
+			t.Errorf("%s: CreateHost changed the caller's data to %v", tc.name, given)
+		}
+		host, err := inv.GetHost("web01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(host.Data, CreatedAtField)
+		delete(host.Data, UpdatedAtField)
+		if !reflect.DeepEqual(host.Data, tc.want) {
+			t.Errorf("%s: created %v, want %v", tc.name, host.Data, tc.want)
+		}
+
+		if err := inv.UpdateHostFieldValue("web01", "env", " Stage "); err != nil {
+			t.Fatal(err)
+		}
+		if host, err = inv.GetHost("web01"); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]interface{}{"off": " Stage ", "trim": "Stage", "case": " stage ", "all": "stage"}[tc.name]
+		if got := host.Data["env"]; got != want {
+			t.Errorf("%s: updated env to %q, want %q", tc.name, got, want)
+		}
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	inv := newTestInventory(t)
+	for name, data := range map[string]map[string]interface{}{
+		"web01":     {"serial": "S1", "mac": "aa"},
+		"web01-old": {"serial": "S1", "mac": "bb"},
+		"db01":      {"serial": "S2", "mac": "aa"},
+		"db01-dup":  {"serial": "S2", "mac": "aa"},
+		"db01-tri":  {"serial": "S2", "mac": "aa"},
+		"spare1":    {"serial": nil, "mac": "cc"},
+		"spare2":    {"serial": nil, "mac": "cc"},
+		"nameless":  {"mac": "cc"},
+	} {
+		if err := inv.CreateHost(name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type group struct {
+		values []string
+		hosts  []string
+	}
+	for _, tc := range []struct {
+		fields []string
+		want   []group
+	}{
+		{[]string{"serial"}, []group{
+			{[]string{"S1"}, []string{"web01", "web01-old"}},
+			{[]string{"S2"}, []string{"db01", "db01-dup", "db01-tri"}},
+		}},
+		{[]string{"serial", "mac"}, []group{
+			{[]string{"S2", "aa"}, []string{"db01", "db01-dup", "db01-tri"}},
+		}},
+		{[]string{"mac"}, []group{
+			{[]string{"aa"}, []string{"db01", "db01-dup", "db01-tri", "web01"}},
+			{[]string{"cc"}, []string{"nameless", "spare1", "spare2"}},
+		}},
+		{[]string{"rack"}, nil},
+	} {
+		duplicates, err := inv.FindDuplicates(tc.fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []group
+		for _, d := range duplicates {
+			g := group{values: d.Values}
+			for _, host := range d.Hosts {
+				g.hosts = append(g.hosts, host.Name)
+			}
+			got = append(got, g)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("duplicates by %v = %v, want %v", tc.fields, got, tc.want)
+		}
+	}
+}
+
+func TestTerraformOutputGolden(t *testing.T) {
+	hosts := []Host{
+		{Name: "web01", Data: map[string]interface{}{
+			"site":    "ams",
+			"cores":   8.0,
+			"weight":  int64(3),
+			"load":    0.25,
+			"active":  true,
+			"retired": nil,
+			"ports":   []interface{}{80.0, 443.0},
+			"labels":  map[string]interface{}{"team": "core", "cost center": "42"},
+			"motd":    "Welcome to ${host} at 100%{x}\n",
+		}},
+		{Name: "db01", Data: map[string]interface{}{"key": []byte{0xde, 0xad}, "empty": []interface{}{}, "none": map[string]interface{}{}}},
+		{Name: "bare"},
+	}
+	for _, tc := range []struct {
+		golden string
+		hcl    bool
+	}{
+		{"hosts.tfvars.json", false},
+		{"hosts.tf", true},
+	} {
+		var b bytes.Buffer
+		if err := (TerraformOutputFormatter{HCL: tc.hcl}).Format(&b, hosts); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, tc.golden, b.Bytes())
+	}
+}
+
+func TestHostHistory(t *testing.T) {
+	_, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	var revs []int64
+	write := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		current, err := inv.GetHostAt("web01", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		revs = append(revs, current.Revision)
+	}
+	write(inv.CreateHost("web01", map[string]interface{}{"site": "ams"}))
+	write(inv.UpdateHostFieldValue("web01", "site", "fra"))
+	if err := inv.CreateHost("db01", map[string]interface{}{"site": "ams"}); err != nil {
+		t.Fatal(err)
+	}
+	write(inv.UpdateHostFieldValue("web01", "site", "ber"))
+
+	site := func(v HostVersion) interface{} { return v.Host.Data["site"] }
+	for _, tc := range []struct {
+		limit    int
+		sites    []interface{}
+		complete bool
+	}{
+		{0, []interface{}{"ber", "fra", "ams"}, true},
+		{3, []interface{}{"ber", "fra", "ams"}, true},
+		{2, []interface{}{"ber", "fra"}, false},
+	} {
+		versions, complete, err := inv.HostHistory("web01", tc.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sites []interface{}
+		for n, v := range versions {
+			sites = append(sites, site(v))
+			if want := revs[len(revs)-1-n]; v.Revision != want {
+				t.Errorf("version %d at revision %d, want %d", n, v.Revision, want)
+			}
+			if want := int64(len(revs) - n); v.Version != want {
+				t.Errorf("version %d numbered %d, want %d", n, v.Version, want)
+			}
+		}
+		if !reflect.DeepEqual(sites, tc.sites) || complete != tc.complete {
+			t.Errorf("history limited to %d = %v complete=%v, want %v complete=%v", tc.limit, sites, complete, tc.sites, tc.complete)
+		}
+	}
+
+	for _, tc := range []struct {
+		rev  int64
+		site interface{}
+		at   int64
+	}{
+		{revs[0], "ams", revs[0]},
+		{revs[1], "fra", revs[1]},
+		// db01's creation between the writes leaves web01 as it was.
+		{revs[1] + 1, "fra", revs[1]},
+		{revs[2], "ber", revs[2]},
+	} {
+		v, err := inv.GetHostAt("web01", tc.rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if site(v) != tc.site || v.Revision != tc.at {
+			t.Errorf("web01 at revision %d = %v written at %d, want %v written at %d", tc.rev, site(v), v.Revision, tc.site, tc.at)
+		}
+	}
+	if _, err := inv.GetHostAt("web01", revs[0]-1); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("web01 before its creation = %v, want ErrHostNotFound", err)
+	}
+
+	if _, err := client.Compact(t.Context(), revs[1]+1); err != nil {
+		t.Fatal(err)
+	}
+	versions, complete, err := inv.HostHistory("web01", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || complete {
+		t.Errorf("history after compaction has %d versions, complete=%v; want 2, false", len(versions), complete)
+	}
+	if _, err := inv.GetHostAt("web01", revs[0]); !errors.Is(err, ErrRevisionCompacted) {
+		t.Errorf("web01 at a compacted revision = %v, want ErrRevisionCompacted", err)
+	}
+
+	// A host created again starts a new history.
+	if err := inv.RemoveHost("web01"); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.CreateHost("web01", map[string]interface{}{"site": "lis"}); err != nil {
+		t.Fatal(err)
+	}
+	versions, complete, err = inv.HostHistory("web01", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || !complete || site(versions[0]) != "lis" {
+		t.Errorf("history of a recreated host = %v complete=%v, want only the new version", versions, complete)
+	}
+}
+
+func TestDecodeExportStrict(t *testing.T) {
+	const valid = `[{"name": "web01", "data": {"site": "ams"}}, {"name": "db01", "data": {}, "mod_revision": 7}]`
+	for _, tc := range []struct {
+		name   string
+		body   string
+		strict bool
+		hosts  []string
+		err    string
+	}{
+		{"valid", valid, false, []string{"web01", "db01"}, ""},
+		{"valid strict", valid, true, []string{"web01", "db01"}, ""},
+		{"typo", `[{"name": "web01", "data": {}}, {"name": "db01", "dta": {"site": "ams"}}]`, false, []string{"web01", "db01"}, ""},
+		{"typo strict", `[{"name": "web01", "data": {}}, {"name": "db01", "dta": {"site": "ams"}}]`, true, nil, `host 2 ("db01"): json: unknown field "dta"`},
+		{"nameless strict", `[{"nmae": "web01", "data": {}}]`, true, nil, `host 1: json: unknown field "nmae"`},
+		{"unknown data field strict", `[{"name": "web01", "data": {"anything": 1}}]`, true, []string{"web01"}, ""},
+		{"not an array strict", `{"name": "web01"}`, true, nil, "cannot unmarshal object"},
+	} {
+		hosts, _, err := DecodeExport([]byte(tc.body), false, tc.strict)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: error %v, want one containing %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var names []string
+		for _, host := range hosts {
+			names = append(names, host.Name)
+		}
+		if !slices.Equal(names, tc.hosts) {
+			t.Errorf("%s: decoded %v, want %v", tc.name, names, tc.hosts)
+		}
+	}
+
+	// An export file is checked the same way once its header verifies.
+	inv := newTestInventory(t)
+	exported, err := inv.EncodeExport([]Host{{Name: "web01", Data: map[string]interface{}{"site": "ams"}}}, map[string]int64{"web01": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, revisions, err := DecodeExport(exported, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].Data["site"] != "ams" || revisions["web01"] != 3 {
+		t.Errorf("strictly decoded export = %v, revisions %v", hosts, revisions)
+	}
+}
+
+func TestValueSizeLimits(t *testing.T) {
+	server, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	if inv.MaxValueSize != DefaultMaxValueSize {
+		t.Errorf("MaxValueSize defaults to %d, want %d", inv.MaxValueSize, DefaultMaxValueSize)
+	}
+	// The stored size of a host grows byte for byte with an ASCII field.
+	if err := inv.CreateHost("web00", map[string]interface{}{"log": "", "id": 1.0}); err != nil {
+		t.Fatal(err)
+	}
+	base := len(server.Keys()["/hosts/web00"])
+	inv.MaxValueSize, inv.WarnValueSize = base+100, base+50
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, tc := range []struct {
+		name string
+		// size is the number of bytes over the empty host.
+		size int
+		err  string
+		warn bool
+	}{
+		{"web01", 50, "", false},
+		{"web02", 51, "", true},
+		{"web03", 100, "", true},
+		{"web04", 101, fmt.Sprintf("host web04 is %d bytes, over the --max-value-size of %d; its largest field is log at 103 bytes", base+101, base+100), false},
+	} {
+		logged.Reset()
+		err := inv.CreateHost(tc.name, map[string]interface{}{"log": strings.Repeat("x", tc.size), "id": 1.0})
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s of %d bytes over the limit: %v, want %q", tc.name, tc.size, err, tc.err)
+			}
+			if _, stored := server.Keys()["/hosts/"+tc.name]; stored {
+				t.Errorf("%s over the limit was stored", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s of %d bytes: %v", tc.name, tc.size, err)
+		}
+		if warned := strings.Contains(logged.String(), "over the --warn-value-size"); warned != tc.warn {
+			t.Errorf("%s of %d bytes warned=%v, want %v: %s", tc.name, tc.size, warned, tc.warn, logged.String())
+		}
+	}
+
+	before := server.Keys()["/hosts/web01"]
+	if err := inv.UpdateHostFieldValue("web01", "log", strings.Repeat("x", 101)); err == nil || !strings.Contains(err.Error(), "over the --max-value-size") {
+		t.Errorf("updating web01 over the limit: %v", err)
+	}
+	if after := server.Keys()["/hosts/web01"]; after != before {
+		t.Errorf("an update over the limit was stored: %s", after)
+	}
+	if err := inv.UpdateHostFieldValue("web01", "log", strings.Repeat("x", 100)); err != nil {
+		t.Errorf("updating web01 to the limit: %v", err)
+	}
+}
+
+func TestConsulOutputGolden(t *testing.T) {
+	hosts := []Host{
+		{Name: "web01", Data: map[string]interface{}{
+			"ipaddr":  "10.0.0.1",
+			"service": "nginx",
+			"tags":    []interface{}{"eu", "prod"},
+			"site":    "ams",
+			"cores":   8.0,
+			"labels":  map[string]interface{}{"team": "core"},
+		}},
+		// Without a service, the tags are node meta like any other field.
+		{Name: "db01", Data: map[string]interface{}{"ipaddr": "10.0.0.2", "tags": "db, eu"}},
+		{Name: "bare"},
+	}
+	var b bytes.Buffer
+	if err := WriteOutput(&b, OutputOptions{Format: "consul", AddressField: "ipaddr", ServiceField: "service"}, hosts); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "consul.json", b.Bytes())
+
+	var registrations []map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &registrations); err != nil {
+		t.Fatal(err)
+	}
+	for _, reg := range registrations {
+		for key := range reg {
+			if !slices.Contains([]string{"Node", "Address", "NodeMeta", "Service"}, key) {
+				t.Errorf("registration of %v has key %s, not in Consul's catalog register payload", reg["Node"], key)
+			}
+		}
+	}
+}
+
+func TestKeyFields(t *testing.T) {
+	inv := newTestInventory(t)
+	inv.KeyFields = []string{"serial", "rack"}
+	for _, tc := range []struct {
+		data map[string]interface{}
+		want string
+		err  error
+	}{
+		{map[string]interface{}{"serial": "S1", "rack": 4.0, "site": "ams"}, "S1:4", nil},
+		{map[string]interface{}{"serial": "S1"}, "", ErrFieldNotFound},
+		{map[string]interface{}{"serial": "S1", "rack": nil}, "", ErrFieldNotFound},
+		{map[string]interface{}{"serial": "", "rack": "r1"}, "", ErrFieldNotFound},
+	} {
+		got, err := inv.KeyName(tc.data)
+		if got != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("KeyName(%v) = %q, %v; want %q, %v", tc.data, got, err, tc.want, tc.err)
+		}
+	}
+
+	create := func(data map[string]interface{}) (string, error) {
+		name, err := inv.KeyName(data)
+		if err != nil {
+			return "", err
+		}
+		return name, inv.Create(Host{Name: name, Data: data})
+	}
+	name, err := create(map[string]interface{}{"serial": "S1", "rack": "r/1", "site": "ams"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := inv.GetHost("S1:r/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Name != name || host.Data["site"] != "ams" {
+		t.Errorf("fetched %s as %v", name, host)
+	}
+	if _, err := create(map[string]interface{}{"serial": "S1", "rack": "r/1", "site": "fra"}); !errors.Is(err, ErrHostExists) {
+		t.Errorf("creating a second host with the same key fields = %v, want ErrHostExists", err)
+	}
+
+	// Other fields may change; the key fields may not.
+	if err := inv.UpdateHostFieldValue(name, "site", "fra"); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.UpdateHostFieldValue(name, "serial", "S2"); !errors.Is(err, ErrFieldImmutable) {
+		t.Errorf("changing a key field = %v, want ErrFieldImmutable", err)
+	}
+	if err := inv.CreateHost("web01", map[string]interface{}{"serial": "S3", "rack": "r1"}); !errors.Is(err, ErrFieldImmutable) {
+		t.Errorf("storing a host under a name other than its key = %v, want ErrFieldImmutable", err)
+	}
+	if host, err = inv.GetHost(name); err != nil {
+		t.Fatal(err)
+	}
+	if host.Data["serial"] != "S1" || host.Data["site"] != "fra" {
+		t.Errorf("after the updates %s is %v", name, host.Data)
+	}
+}
+
+func TestVirtualFields(t *testing.T) {
+	server, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	inv.VirtualFields = VirtualFields{
+		"fqdn":  "{{.Name}}.{{.Data.domain}}",
+		"url":   "https://{{.Data.fqdn}}/",
+		"label": "{{.Name}}",
+	}
+	if err := inv.CreateHost("web01", map[string]interface{}{"domain": "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if stored := server.Keys()["/hosts/web01"]; strings.Contains(stored, "fqdn") || strings.Contains(stored, "url") {
+		t.Errorf("virtual fields were stored: %s", stored)
+	}
+
+	transform, err := inv.VirtualFields.Transform()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := inv.GetHost("web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := WriteOutput(&b, OutputOptions{Format: "json", Compact: true, Transforms: []HostTransform{transform}}, []Host{host}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"fqdn":"web01.example.com"`, `"url":"https://web01.example.com/"`, `"label":"web01"`} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("output lacks %s:\n%s", want, b.String())
+		}
+	}
+	if _, ok := host.Data["fqdn"]; ok {
+		t.Error("computing virtual fields changed the host read")
+	}
+
+	for _, write := range []func() error{
+		func() error { return inv.UpdateHostFieldValue("web01", "fqdn", "x") },
+		func() error { return inv.CreateHost("web02", map[string]interface{}{"url": "x"}) },
+	} {
+		if err := write(); !errors.Is(err, ErrFieldImmutable) {
+			t.Errorf("writing a virtual field = %v, want ErrFieldImmutable", err)
+		}
+	}
+	if _, err := (VirtualFields{"bad": "{{.Name"}).Transform(); err == nil || !strings.Contains(err.Error(), "virtual field bad") {
+		t.Errorf("an invalid template = %v, want an error naming the field", err)
+	}
+}
+
+func TestFieldRules(t *testing.T) {
+	rules, err := LoadFieldRules(filepath.Join("testdata", "rules.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := newTestInventory(t)
+	inv.ValidationRules = rules
+	for _, tc := range []struct {
+		name string
+		data map[string]interface{}
+		want []string
+	}{
+		{"valid", map[string]interface{}{"env": "prod", "cores": 8.0, "ipaddr": "10.0.0.1"}, nil},
+		{"numeric string", map[string]interface{}{"env": "dev", "cores": " 16 "}, nil},
+		{"required", map[string]interface{}{"cores": 8.0}, []string{`field "env" is required`}},
+		{"enum", map[string]interface{}{"env": "Prod"}, []string{`field "env": "Prod" is not one of prod, stage, dev`}},
+		{"regex", map[string]interface{}{"env": "prod", "ipaddr": "192.168.0.1"}, []string{`field "ipaddr": "192.168.0.1" does not match 10\.[0-9.]+`}},
+		{"regex anchored", map[string]interface{}{"env": "prod", "ipaddr": "x10.0.0.1"}, []string{`field "ipaddr": "x10.0.0.1" does not match 10\.[0-9.]+`}},
+		{"below range", map[string]interface{}{"env": "prod", "cores": 0.0}, []string{`field "cores": 0 is below the minimum 1`}},
+		{"above range", map[string]interface{}{"env": "prod", "cores": 1024.0}, []string{`field "cores": 1024 is above the maximum 512`}},
+		{"not a number", map[string]interface{}{"env": "prod", "cores": "many"}, []string{`field "cores": "many" is not a number`}},
+		{"array elements", map[string]interface{}{"env": []interface{}{"prod", "qa"}}, []string{`field "env": "qa" is not one of prod, stage, dev`}},
+		{"every violation", map[string]interface{}{"cores": 0.0, "ipaddr": "x"}, []string{
+			`field "cores": 0 is below the minimum 1`,
+			`field "env" is required`,
+			`field "ipaddr": "x" does not match 10\.[0-9.]+`,
+		}},
+	} {
+		var got []string
+		for _, problem := range inv.ValidateHost(Host{Name: "web01", Data: tc.data}) {
+			got = append(got, problem.Error())
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: problems %q, want %q", tc.name, got, tc.want)
+		}
+
+		err := inv.CreateHost("web01", tc.data)
+		if tc.want == nil {
+			if err != nil {
+				t.Errorf("%s: creating a valid host: %v", tc.name, err)
+			}
+			continue
+		}
+		for _, want := range tc.want {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: creating the host = %v, want an error with %q", tc.name, err, want)
+			}
+		}
+	}
+	if err := inv.UpdateHostFieldValue("web01", "env", "qa"); err == nil || !strings.Contains(err.Error(), "is not one of") {
+		t.Errorf("an update breaking a rule = %v", err)
+	}
+
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		rules string
+		err   string
+	}{
+		{"env:\n  match: '('\n", "field env: error parsing regexp"},
+		{"cores:\n  min: 5\n  max: 1\n", "field cores: min 5 is above max 1"},
+		{"env:\n  requried: true\n", "field requried not found"},
+		{"env:\n", "field env has no rules"},
+	} {
+		path := filepath.Join(dir, "rules.yaml")
+		if err := os.WriteFile(path, []byte(tc.rules), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadFieldRules(path); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("loading %q = %v, want an error with %q", tc.rules, err, tc.err)
+		}
+	}
+}
+
+func TestImportRevisionConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// during changes db01 between the import's read and its write.
+		during bool
+		force  bool
+	}{
+		{"changed before", false, false},
+		{"changed during", true, false},
+		{"forced", false, true},
+	} {
+		server, client := etcdtest.Start(t)
+		inv := NewInventory(client)
+		for _, name := range []string{"web01", "db01"} {
+			if err := inv.CreateHost(name, map[string]interface{}{"site": "ams"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hosts, revisions, err := inv.ListHostsWithRevisions(ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported, err := inv.EncodeExport(hosts, revisions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edited, revisions, err := DecodeExport(exported, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, host := range edited {
+			host.Data["site"] = "fra"
+		}
+		if tc.force {
+			revisions = nil
+		}
+
+		concurrent := func() error {
+			return inv.UpdateHostFieldValue("db01", "site", "lis")
+		}
+		if tc.during {
+			intruded := false
+			server.Fault = func(method string, applied bool) error {
+				// The first transaction is the import's read.
+				if method == "txn" && applied && !intruded {
+					intruded = true
+					return concurrent()
+				}
+				return nil
+			}
+		} else if err := concurrent(); err != nil {
+			t.Fatal(err)
+		}
+		actions, errs, err := inv.ImportHosts(edited, ImportReplace, revisions)
+		server.Fault = nil
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"db01": "lis", "web01": "fra"}
+		for n, host := range edited {
+			switch {
+			case host.Name == "db01" && !tc.force:
+				if !errors.Is(errs[n], ErrHostChanged) {
+					t.Errorf("%s: importing db01 = %v, want ErrHostChanged", tc.name, errs[n])
+				}
+			case errs[n] != nil:
+				t.Errorf("%s: importing %s: %v", tc.name, host.Name, errs[n])
+			case actions[n] != "replaced":
+				t.Errorf("%s: %s was %s, want replaced", tc.name, host.Name, actions[n])
+			}
+		}
+		if tc.force {
+			want["db01"] = "fra"
+		}
+		for name, site := range want {
+			host, err := inv.GetHost(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host.Data["site"] != site {
+				t.Errorf("%s: %s has site %v after the import, want %s", tc.name, name, host.Data["site"], site)
+			}
+		}
+	}
+}
+
+func TestTimeFormat(t *testing.T) {
+	const stored = "2024-03-10T22:30:00Z"
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	now := time.Now().UTC()
+	for _, tc := range []struct {
+		format TimeFormat
+		value  interface{}
+		want   string
+	}{
+		{TimeFormat{}, stored, stored},
+		{TimeFormat{Layout: "rfc3339"}, "2024-03-10T22:30:00.5Z", stored},
+		{TimeFormat{Location: zone}, stored, "2024-03-11T00:30:00+02:00"},
+		{TimeFormat{Layout: "RFC3339", Location: zone}, stored, "2024-03-11T00:30:00+02:00"},
+		{TimeFormat{Layout: "2006-01-02 15:04 MST", Location: zone}, stored, "2024-03-11 00:30 UTC+2"},
+		{TimeFormat{Layout: time.Kitchen, Location: time.UTC}, "2024-03-11T00:30:00+02:00", "10:30PM"},
+		{TimeFormat{Layout: "relative"}, now.Add(-30 * time.Second).Format(time.RFC3339), "30s ago"},
+		{TimeFormat{Layout: "relative"}, now.Add(-2*time.Hour - time.Minute).Format(time.RFC3339), "2h ago"},
+		{TimeFormat{Layout: "relative", Location: zone}, now.Add(-3 * 24 * time.Hour).Format(time.RFC3339), "3d ago"},
+		{TimeFormat{Layout: "relative"}, now.Add(5*time.Minute + 30*time.Second).Format(time.RFC3339), "in 5m"},
+		// Values that are not timestamps are shown as usual.
+		{TimeFormat{Layout: "relative", Location: zone}, "web", "web"},
+		{TimeFormat{Layout: "relative"}, "2024-03-10", "2024-03-10"},
+		{TimeFormat{Layout: "relative"}, 8.0, "8"},
+		{TimeFormat{Layout: "relative"}, nil, ""},
+	} {
+		if got := tc.format.Format(tc.value); got != tc.want {
+			t.Errorf("%+v.Format(%v) = %q, want %q", tc.format, tc.value, got, tc.want)
+		}
+	}
+
+	for value, want := range map[string]string{stored: "Timestamp", "2024-03-10T22:30:00.123+01:00": "Timestamp", "2024-03-10": "String", "10.0.0.1": "IPAddress"} {
+		if got := TypeName(value); got != want {
+			t.Errorf("TypeName(%q) = %s, want %s", value, got, want)
+		}
+	}
+
+	hosts := []Host{{Name: "web01", Data: map[string]interface{}{"seen": stored}}}
+	output := OutputOptions{TimeFormat: TimeFormat{Layout: "2006-01-02 15:04", Location: zone}}
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{"table", "2024-03-11 00:30"},
+		{"block", "2024-03-11 00:30"},
+		{"json", stored},
+		{"yaml", stored},
+	} {
+		output.Format = tc.format
+		formatter, err := newFormatter(output, false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := formatter.Format(&buf, hosts); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), tc.want) {
+			t.Errorf("%s output has no %q:\n%s", tc.format, tc.want, buf.String())
+		}
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	for _, tc := range []struct {
+		format  string
+		suggest string
+	}{
+		{"json", ""},
+		{"jsno", "json"},
+		{"JSON", "json"},
+		{"tabel", "table"},
+		{"yml", "yaml"},
+		{"rfc-4180-csv", "rfc4180-csv"},
+		{"typedcsv", "typed-csv"},
+		{"xyzzy", ""},
+	} {
+		err := ValidateFormat(tc.format)
+		if tc.format == "json" {
+			if err != nil {
+				t.Errorf("ValidateFormat(%q) = %v", tc.format, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("ValidateFormat(%q) accepted it", tc.format)
+			continue
+		}
+		want := "did you mean"
+		if tc.suggest != "" {
+			want = fmt.Sprintf("(did you mean %q?)", tc.suggest)
+		}
+		if strings.Contains(err.Error(), want) != (tc.suggest != "") {
+			t.Errorf("ValidateFormat(%q) = %v, want the suggestion %q", tc.format, err, tc.suggest)
+		}
+		if want := "valid: " + strings.Join(FormatNames(), ", "); !strings.HasSuffix(err.Error(), want) {
+			t.Errorf("ValidateFormat(%q) = %v, want it to end with %q", tc.format, err, want)
+		}
+	}
+	for _, name := range []string{"table", "json", "xml", "csv", "block", "rfc4180-csv", "typed-csv", "script"} {
+		if !slices.Contains(FormatNames(), name) {
+			t.Errorf("FormatNames() = %q, missing %s", FormatNames(), name)
+		}
+	}
+
+	RegisterFormat("lines", func(OutputOptions, bool, int) OutputFormatter { return ScriptOutputFormatter{} })
+	t.Cleanup(func() { delete(formatters, "lines") })
+	if err := ValidateFormat("lines"); err != nil {
+		t.Errorf("a registered format is invalid: %v", err)
+	}
+	if err := ValidateFormat("line"); err == nil || !strings.Contains(err.Error(), `did you mean "lines"`) {
+		t.Errorf("ValidateFormat(line) = %v, want a suggestion of the registered format", err)
+	}
+	if _, err := newFormatter(OutputOptions{Format: "jsno"}, false, 0); err == nil || !strings.Contains(err.Error(), `did you mean "json"`) {
+		t.Errorf("newFormatter(jsno) = %v, want a suggestion", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("registering json again did not panic")
+		}
+	}()
+	RegisterFormat("json", formatters["json"])
+}
+
+func TestSetFieldIfAbsent(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data map[string]interface{}
+		// during sets the field by hand between the read and the write.
+		during bool
+		set    bool
+		want   interface{}
+	}{
+		{"absent", map[string]interface{}{"site": "ams"}, false, true, "default"},
+		{"present", map[string]interface{}{"owner": "alice"}, false, false, "alice"},
+		{"present empty", map[string]interface{}{"owner": ""}, false, false, ""},
+		{"present null", map[string]interface{}{"owner": nil}, false, false, nil},
+		{"set during", map[string]interface{}{"site": "ams"}, true, false, "alice"},
+	} {
+		server, client := etcdtest.Start(t)
+		inv := NewInventory(client)
+		if err := inv.CreateHost("web01", tc.data); err != nil {
+			t.Fatal(err)
+		}
+		if tc.during {
+			intruded := false
+			server.Fault = func(method string, applied bool) error {
+				if method == "range" && applied && !intruded {
+					intruded = true
+					return inv.UpdateHostFieldValue("web01", "owner", "alice")
+				}
+				return nil
+			}
+		}
+		before := server.Revision()
+		set, err := inv.SetFieldIfAbsent("web01", "owner", "default")
+		server.Fault = nil
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if set != tc.set {
+			t.Errorf("%s: SetFieldIfAbsent = %v, want %v", tc.name, set, tc.set)
+		}
+		if !tc.set && !tc.during && server.Revision() != before {
+			t.Errorf("%s: leaving the field wrote the host", tc.name)
+		}
+		host, err := inv.GetHost("web01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := host.Data["owner"]; !ok || got != tc.want {
+			t.Errorf("%s: owner = %v (present %v), want %v", tc.name, got, ok, tc.want)
+		}
+		if tc.data["site"] != nil && host.Data["site"] != "ams" {
+			t.Errorf("%s: site = %v, want it kept", tc.name, host.Data["site"])
+		}
+	}
+
+	inv := newTestInventory(t)
+	if _, err := inv.SetFieldIfAbsent("missing", "owner", "default"); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("setting a default on a missing host = %v, want ErrHostNotFound", err)
+	}
+}
+
+func TestHostSnapshot(t *testing.T) {
+	server, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	for _, name := range []string{"web01", "web02"} {
+		if err := inv.CreateHost(name, map[string]interface{}{"site": "ams"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot, err := inv.Snapshot(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func() []string {
+		result, err := snapshot.List(ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, host := range result.Hosts {
+			names = append(names, host.Name)
+		}
+		return names
+	}
+	if got, want := names(), []string{"web01", "web02"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("warmed snapshot lists %q, want %q", got, want)
+	}
+	if host, err := snapshot.Get("web02"); err != nil || host.Data["site"] != "ams" {
+		t.Errorf("warmed snapshot has web02 %v, %v", host, err)
+	}
+	if age := snapshot.Age(); age < 0 || age > time.Second {
+		t.Errorf("warmed snapshot is %s old", age)
+	}
+
+	// The watch starts at the listing's revision, so the writes right after
+	// it are not missed.
+	if err := inv.UpdateHostFieldValue("web01", "site", "fra"); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.RemoveHost("web02"); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.CreateHost("web00", map[string]interface{}{"site": "lis"}); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; ; n++ {
+		result, err := snapshot.List(ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Revision == server.Revision() {
+			break
+		}
+		if n == 100 {
+			t.Fatalf("the snapshot is at revision %d, etcd at %d", result.Revision, server.Revision())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := names(), []string{"web00", "web01"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("watched snapshot lists %q, want %q", got, want)
+	}
+	if host, err := snapshot.Get("web01"); err != nil || host.Data["site"] != "fra" {
+		t.Errorf("watched snapshot has web01 %v, %v", host, err)
+	}
+	if _, err := snapshot.Get("web02"); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("watched snapshot has removed web02: %v", err)
+	}
+	if result, err := snapshot.List(ListOptions{NamePrefix: "web0", Limit: 1}); err != nil || len(result.Hosts) != 1 || result.Hosts[0].Name != "web00" || !result.Truncated {
+		t.Errorf("snapshot page is %+v, %v", result, err)
+	}
+	if _, err := snapshot.List(ListOptions{RecentFirst: true}); err == nil {
+		t.Error("snapshot listed most recent first without the modification revisions")
+	}
+}
+
+func TestCompressValues(t *testing.T) {
+	config := strings.Repeat("server {\n  listen 80;\n  root /srv/www;\n}\n", 200)
+	for _, encoding := range []string{"json", "gob", "msgpack"} {
+		t.Run(encoding, func(t *testing.T) {
+			server, client := etcdtest.Start(t)
+			writer := NewInventory(client)
+			writer.ValueEncoding = encoding
+			writer.CompressValues = true
+			large := map[string]interface{}{"config": config, "port": 80.0}
+			if err := writer.CreateHost("web01", large); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.CreateHost("web02", map[string]interface{}{"port": 80.0}); err != nil {
+				t.Fatal(err)
+			}
+			stored := server.Keys()
+			if value := stored[writer.hostKey("web01")]; value[0] != gzipPrefix || len(value) > len(config)/10 {
+				t.Errorf("large value stored as %d bytes starting with %#x, want it compressed", len(value), value[0])
+			}
+			// A value is only kept compressed when that makes it smaller,
+			// which a small JSON value never is.
+			for _, value := range stored {
+				if value[0] != gzipPrefix {
+					continue
+				}
+				zr, err := gzip.NewReader(strings.NewReader(value[1:]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(value) >= len(raw) {
+					t.Errorf("stored %d bytes compressed, %d uncompressed", len(value), len(raw))
+				}
+			}
+			if value := stored[writer.hostKey("web02")]; encoding == "json" && value[0] == gzipPrefix {
+				t.Errorf("small value stored compressed: %q", value)
+			}
+
+			// Reads decompress whatever the reader's own setting.
+			reader := NewInventory(client)
+			host, err := reader.GetHost("web01")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for field, want := range large {
+				if got := host.Data[field]; got != want {
+					t.Errorf("read back %s as %.40q, want %.40q", field, got, want)
+				}
+			}
+			if got := TypeName(host.Data["config"]); got != "String" {
+				t.Errorf("TypeName(config) = %s, want String", got)
+			}
+			hosts, err := reader.ListHosts()
+			if err != nil || len(hosts) != 2 || hosts[0].Data["config"] != config {
+				t.Errorf("listed %d hosts, %v", len(hosts), err)
+			}
+
+			// A read-modify-write keeps the value compressed.
+			if err := writer.UpdateHostFieldValue("web01", "port", 8080.0); err != nil {
+				t.Fatal(err)
+			}
+			if value := server.Keys()[writer.hostKey("web01")]; value[0] != gzipPrefix {
+				t.Errorf("updated value stored uncompressed")
+			}
+			if host, err := reader.GetHost("web01"); err != nil || host.Data["port"] != 8080.0 || host.Data["config"] != config {
+				t.Errorf("read back the update as %v, %v", host.Data["port"], err)
+			}
+		})
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	server, client := etcdtest.Start(t)
+	inv := NewInventory(client)
+	if err := inv.CreateHost("web01", map[string]interface{}{"site": "ams"}); err != nil {
+		t.Fatal(err)
+	}
+	_, revision, err := inv.GetHostWithRevision("web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		op   func() error
+		want error
+	}{
+		{"GetHost", func() error { _, err := inv.GetHost("missing"); return err }, ErrHostNotFound},
+		{"GetHostMeta", func() error { _, err := inv.GetHostMeta("missing"); return err }, ErrHostNotFound},
+		{"GetHostField of a missing host", func() error { _, err := inv.GetHostField("missing", "site"); return err }, ErrHostNotFound},
+		{"GetHostField", func() error { _, err := inv.GetHostField("web01", "rack"); return err }, ErrFieldNotFound},
+		{"UpdateHostFieldValue", func() error { return inv.UpdateHostFieldValue("missing", "site", "ams") }, ErrHostNotFound},
+		{"UpdateHostFields", func() error { return inv.UpdateHostFields("missing", map[string]interface{}{"site": "ams"}) }, ErrHostNotFound},
+		{"MergeHostData", func() error { return inv.MergeHostData("missing", map[string]interface{}{"site": "ams"}) }, ErrHostNotFound},
+		{"PatchHostData", func() error { return inv.PatchHostData("missing", map[string]interface{}{"site": nil}) }, ErrHostNotFound},
+		{"SetFieldIfAbsent", func() error { _, err := inv.SetFieldIfAbsent("missing", "site", "ams"); return err }, ErrHostNotFound},
+		{"AddTags", func() error { _, err := inv.AddTags("missing", "web"); return err }, ErrHostNotFound},
+		{"RemoveHost", func() error { return inv.RemoveHost("missing") }, ErrHostNotFound},
+		{"CreateHostIfNotExists", func() error { return inv.CreateHostIfNotExists("web01", nil) }, ErrHostExists},
+		{"UpdateHostIfRevision", func() error {
+			return inv.UpdateHostIfRevision("web01", map[string]interface{}{"site": "fra"}, revision-1)
+		}, ErrHostChanged},
+		{"RemoveHostIfRevision", func() error { return inv.RemoveHostIfRevision("web01", revision-1) }, ErrHostChanged},
+	} {
+		err := tc.op()
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s = %v, want %v", tc.name, err, tc.want)
+		}
+		for _, other := range []error{ErrHostNotFound, ErrFieldNotFound, ErrHostExists, ErrHostChanged, ErrFieldImmutable} {
+			if other != tc.want && errors.Is(err, other) {
+				t.Errorf("%s = %v, which is also %v", tc.name, err, other)
+			}
+		}
+	}
+
+	// A host stored without data is found and takes new fields.
+	if _, err := client.Put(t.Context(), "/hosts/bare", `{"name":"bare"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.UpdateHostFieldValue("bare", "site", "ams"); err != nil {
+		t.Errorf("setting a field of a host without data: %v", err)
+	}
+	if value, err := inv.GetHostField("bare", "site"); err != nil || value != "ams" {
+		t.Errorf("bare has site %v, %v", value, err)
+	}
+
+	// A host that keeps changing under a read-modify-write wears it out.
+	server.Fault = func(method string, applied bool) error {
+		if method == "range" && applied {
+			_, err := client.Put(t.Context(), "/hosts/web01", `{"name":"web01","data":{"site":"lis"}}`)
+			return err
+		}
+		return nil
+	}
+	err = inv.UpdateHostFields("web01", map[string]interface{}{"site": "fra"})
+	server.Fault = nil
+	if !errors.Is(err, ErrHostChanged) {
+		t.Errorf("updating a host changing on every read = %v, want ErrHostChanged", err)
+	}
+}
+
+func TestIfRevision(t *testing.T) {
+	inv := newTestInventory(t)
+	for _, tc := range []struct {
+		name string
+		// write writes web01 if it is at revision.
+		write func(revision int64) error
+		// want is web01's site after a successful write, "" if removed.
+		want string
+	}{
+		{"UpdateHostFieldValueIfRevision", func(revision int64) error {
+			return inv.UpdateHostFieldValueIfRevision("web01", "site", "lon", revision)
+		}, "lon"},
+		{"PatchHostDataIfRevision", func(revision int64) error {
+			return inv.PatchHostDataIfRevision("web01", map[string]interface{}{"site": "lon"}, revision)
+		}, "lon"},
+		{"RemoveHostIfRevision", func(revision int64) error { return inv.RemoveHostIfRevision("web01", revision) }, ""},
+		{"DeleteHost", func(revision int64) error { _, err := inv.DeleteHost("web01", revision, false); return err }, ""},
+	} {
+		site := func() string {
+			host, err := inv.GetHost("web01")
+			if errors.Is(err, ErrHostNotFound) {
+				return ""
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			return host.Data["site"].(string)
+		}
+		if err := inv.CreateHost("web01", map[string]interface{}{"site": "ams"}); err != nil {
+			t.Fatal(err)
+		}
+		_, read, err := inv.GetHostWithRevision("web01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Another client changes the host after it was read.
+		if err := inv.UpdateHostFieldValue("web01", "site", "fra"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.write(read); !errors.Is(err, ErrHostChanged) {
+			t.Errorf("%s at the revision read = %v, want ErrHostChanged", tc.name, err)
+		}
+		if got := site(); got != "fra" {
+			t.Errorf("%s at the revision read left site %q, want the concurrent %q", tc.name, got, "fra")
+		}
+
+		_, current, err := inv.GetHostWithRevision("web01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.write(current); err != nil {
+			t.Errorf("%s at the current revision: %v", tc.name, err)
+		}
+		if got := site(); got != tc.want {
+			t.Errorf("%s at the current revision left site %q, want %q", tc.name, got, tc.want)
+		}
+
+		// Revision 0 writes whatever the revision.
+		if _, err := inv.PutHost("web01", map[string]interface{}{"site": "ams"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := inv.UpdateHostFieldValue("web01", "site", "fra"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.write(0); err != nil {
+			t.Errorf("%s at revision 0: %v", tc.name, err)
+		}
+		if got := site(); got != tc.want {
+			t.Errorf("%s at revision 0 left site %q, want %q", tc.name, got, tc.want)
+		}
+		if err := inv.RemoveHost("web01"); err != nil && !errors.Is(err, ErrHostNotFound) {
+			t.Fatal(err)
+		}
+	}
+	if err := inv.RemoveHostIfRevision("web01", 0); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("RemoveHostIfRevision of a missing host = %v, want ErrHostNotFound", err)
+	}
+}
+
+func TestCSVTypeInference(t *testing.T) {
+	cells := []string{"true", "false", "TRUE", "yes", "0", "-12", "1.50", "1e3", "-2.5E-2", "007", "+5", "1e", ".5", " 12", "0x1F", "NaN", "Infinity", "null", "1e400", "ams"}
+	// Each cell is in a column named after it.
+	csvInput := "name," + strings.Join(cells, ",") + "\nweb01," + strings.Join(cells, ",") + "\n"
+	jsonData := make(map[string]interface{})
+	for _, cell := range cells {
+		// JSON import of the same value: a literal where the cell is a JSON
+		// boolean or number, a string otherwise.
+		var value interface{}
+		if err := json.Unmarshal([]byte(cell), &value); err != nil || value == nil || cell != strings.TrimSpace(cell) {
+			value = cell
+		}
+		jsonData[cell] = value
+	}
+
+	inferred, err := DecodeCSVHosts(strings.NewReader(csvInput), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inferred) != 1 || !reflect.DeepEqual(inferred[0].Data, jsonData) {
+		t.Fatalf("inferred %v, want %v", inferred, jsonData)
+	}
+	for cell, want := range map[string]string{"true": "Boolean", "1.50": "Number", "1e3": "Number", "007": "String", "yes": "String", "1e400": "String"} {
+		if got := TypeName(inferred[0].Data[cell]); got != want {
+			t.Errorf("%s is inferred as %s, want %s", cell, got, want)
+		}
+	}
+
+	plain, err := DecodeCSVHosts(strings.NewReader(csvInput), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cell := range cells {
+		if got := plain[0].Data[cell]; got != cell {
+			t.Errorf("without inference %q is read as %#v", cell, got)
+		}
+	}
+}
+
+func TestPruneEmpty(t *testing.T) {
+	empty := map[string]interface{}{
+		"null":   nil,
+		"string": "",
+		"array":  []interface{}{},
+		"object": map[string]interface{}{},
+	}
+	kept := map[string]interface{}{
+		"zero":         0.0,
+		"false":        false,
+		"space":        " ",
+		"null element": []interface{}{nil},
+		"null member":  map[string]interface{}{"a": nil},
+		"site":         "ams",
+	}
+	for field, value := range empty {
+		if !IsEmptyValue(value) {
+			t.Errorf("IsEmptyValue(%s) = false", field)
+		}
+	}
+	for field, value := range kept {
+		if IsEmptyValue(value) {
+			t.Errorf("IsEmptyValue(%s) = true", field)
+		}
+	}
+	data := func() map[string]interface{} {
+		data := maps.Clone(kept)
+		maps.Copy(data, empty)
+		return data
+	}
+	stored := func(inv *Inventory, name string) map[string]interface{} {
+		host, err := inv.GetHost(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(host.Data, CreatedAtField)
+		delete(host.Data, UpdatedAtField)
+		return host.Data
+	}
+
+	inv := newTestInventory(t)
+	inv.WriteRules = &WriteRules{PruneEmpty: true}
+	if err := inv.CreateHost("web01", data()); err != nil {
+		t.Fatal(err)
+	}
+	if got := stored(inv, "web01"); !reflect.DeepEqual(got, kept) {
+		t.Errorf("created %v, want %v", got, kept)
+	}
+	for field, value := range empty {
+		if err := inv.UpdateHostFieldValue("web01", "site", value); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := stored(inv, "web01")["site"]; ok {
+			t.Errorf("updating site to the empty %s kept it", field)
+		}
+		if err := inv.UpdateHostFieldValue("web01", "site", "ams"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, errs, err := inv.ImportHosts([]Host{{Name: "web02", Data: data()}}, ImportReplace, nil); err != nil || errs[0] != nil {
+		t.Fatal(err, errs)
+	}
+	if got := stored(inv, "web02"); !reflect.DeepEqual(got, kept) {
+		t.Errorf("imported %v, want %v", got, kept)
+	}
+
+	// prune-empty cleans the hosts written without the rule.
+	inv.WriteRules = nil
+	for _, name := range []string{"web01", "web02"} {
+		if err := inv.CreateHost(name, data()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := inv.CreateHost("web03", kept); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"web01": {"array", "null", "object", "string"}, "web02": {"array", "null", "object", "string"}}
+	for _, dryRun := range []bool{true, false} {
+		pruned, err := inv.PruneEmptyFields(dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pruned, want) {
+			t.Errorf("dry run %v pruned %v, want %v", dryRun, pruned, want)
+		}
+		wantStored := kept
+		if dryRun {
+			wantStored = data()
+		}
+		if got := stored(inv, "web01"); !reflect.DeepEqual(got, wantStored) {
+			t.Errorf("dry run %v left %v, want %v", dryRun, got, wantStored)
+		}
+	}
+	if pruned, err := inv.PruneEmptyFields(false); err != nil || len(pruned) != 0 {
+		t.Errorf("pruning again pruned %v, %v", pruned, err)
+	}
+}
+
+func TestParseGrant(t *testing.T) {
+	for _, tc := range []struct {
+		text    string
+		want    Grant
+		wantErr string
+	}{
+		{"viewer", Grant{Role: RoleViewer}, ""},
+		{"editor:prod", Grant{Role: RoleEditor, Namespace: "prod"}, ""},
+		{"admin:prod:web*", Grant{Role: RoleAdmin, Namespace: "prod", Hosts: "web*"}, ""},
+		{"viewer::db[0-9]*", Grant{Role: RoleViewer, Hosts: "db[0-9]*"}, ""},
+		{"viewer:/legacy", Grant{Role: RoleViewer, Namespace: "/legacy"}, ""},
+		{"viewer:prod:a:b", Grant{Role: RoleViewer, Namespace: "prod", Hosts: "a:b"}, ""},
+		{"", Grant{}, "unknown role"},
+		{"owner", Grant{}, "unknown role"},
+		{"veiwer", Grant{}, `did you mean "viewer"`},
+		{"editor:a/b", Grant{}, "invalid namespace"},
+		{"editor:prod:web[", Grant{}, "invalid host pattern"},
+	} {
+		got, err := ParseGrant(tc.text)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("ParseGrant(%q) = %v, %v; want an error containing %q", tc.text, got, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("ParseGrant(%q) = %+v, %v; want %+v", tc.text, got, err, tc.want)
+			continue
+		}
+		if again, err := ParseGrant(got.String()); err != nil || again != got {
+			t.Errorf("ParseGrant(%q) = %+v, %v; want %q read back as %+v", got.String(), again, err, tc.text, got)
+		}
+	}
+}
+
+func TestAccess(t *testing.T) {
+	prod, err := NamespacePrefix("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grants := func(texts ...string) []Grant {
+		var grants []Grant
+		for _, text := range texts {
+			grant, err := ParseGrant(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			grants = append(grants, grant)
+		}
+		return grants
+	}
+	for _, tc := range []struct {
+		name   string
+		access *Access
+		// roles is the role expected on each host.
+		roles map[string]Role
+		// any is the role expected by AllowsAny.
+		any Role
+	}{
+		{"no access check", nil, map[string]Role{"web01": RoleAdmin, "db07": RoleAdmin}, RoleAdmin},
+		{"no grants", &Access{}, map[string]Role{"web01": "", "db07": ""}, ""},
+		{"viewer of all", &Access{Grants: grants("viewer")}, map[string]Role{"web01": RoleViewer, "db07": RoleViewer}, RoleViewer},
+		{"viewer of web hosts", &Access{Grants: grants("viewer::web*")}, map[string]Role{"web01": RoleViewer, "web": RoleViewer, "db07": "", "xweb01": ""}, RoleViewer},
+		{"single character", &Access{Grants: grants("editor::web0?")}, map[string]Role{"web01": RoleEditor, "web10": "", "web012": ""}, RoleEditor},
+		{"character class", &Access{Grants: grants("admin::db[0-4]*")}, map[string]Role{"db01": RoleAdmin, "db7": "", "web01": ""}, RoleAdmin},
+		{"strongest grant wins", &Access{Grants: grants("editor::web*", "viewer", "admin::web01")}, map[string]Role{"web01": RoleAdmin, "web02": RoleEditor, "db07": RoleViewer}, RoleAdmin},
+		{"grant of this namespace", &Access{Grants: grants("editor:prod"), Prefix: prod}, map[string]Role{"web01": RoleEditor}, RoleEditor},
+		{"grant of another namespace", &Access{Grants: grants("editor:stage"), Prefix: prod}, map[string]Role{"web01": ""}, ""},
+		{"grant of every namespace", &Access{Grants: grants("viewer"), Prefix: prod}, map[string]Role{"web01": RoleViewer}, RoleViewer},
+		{"grant of a namespace without one", &Access{Grants: grants("admin:prod")}, map[string]Role{"web01": ""}, ""},
+	} {
+		for host, want := range tc.roles {
+			if got := tc.access.Role(host); got != want {
+				t.Errorf("%s: Role(%s) = %q, want %q", tc.name, host, got, want)
+			}
+			for _, role := range []Role{RoleViewer, RoleEditor, RoleAdmin} {
+				if got := tc.access.Allows(host, role); got != want.Allows(role) {
+					t.Errorf("%s: Allows(%s, %s) = %v, want %v", tc.name, host, role, got, !got)
+				}
+			}
+		}
+		for _, role := range []Role{RoleViewer, RoleEditor, RoleAdmin} {
+			if got := tc.access.AllowsAny(role); got != tc.any.Allows(role) {
+				t.Errorf("%s: AllowsAny(%s) = %v, want %v", tc.name, role, got, !got)
+			}
+		}
+	}
+
+	inv := &Inventory{SecretFields: map[string]bool{"password": true}}
+	hosts := []Host{
+		{Name: "db07", Data: map[string]interface{}{"password": "s3cret"}},
+		{Name: "web01", Data: map[string]interface{}{"password": "s3cret"}},
+		{Name: "web02", Data: map[string]interface{}{"password": "s3cret"}},
+	}
+	access := &Access{Grants: grants("viewer::web*", "admin::web02")}
+	visible := access.Visible(hosts, inv.MaskSecrets)
+	got := make(map[string]interface{})
+	for _, host := range visible {
+		got[host.Name] = host.Data["password"]
+	}
+	if want := map[string]interface{}{"web01": redactedPlaceholder, "web02": "s3cret"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Visible = %v, want %v", got, want)
+	}
+	if hosts[1].Data["password"] != "s3cret" {
+		t.Error("Visible masked the secret of the host it was given")
+	}
+	if got := (*Access)(nil).Visible(hosts, inv.MaskSecrets); !reflect.DeepEqual(got, hosts) {
+		t.Errorf("nil Visible = %v, want every host as given", got)
+	}
+}
+
+func TestAuthTokens(t *testing.T) {
+	inv := newTestInventory(t)
+	grants := []Grant{{Role: RoleViewer, Hosts: "web*"}, {Role: RoleEditor, Namespace: "prod"}}
+	viewer, stored, err := inv.CreateAuthToken("dashboard", grants, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(viewer, AuthTokenPrefix+stored.ID+"_") || stored.Expires != nil {
+		t.Errorf("token %q of %+v, want %s, the ID and its secret, never expiring", viewer, stored, AuthTokenPrefix)
+	}
+	if strings.Contains(stored.Hash, strings.TrimPrefix(viewer, AuthTokenPrefix+stored.ID+"_")) {
+		t.Error("the token's secret is stored")
+	}
+	checked, err := inv.CheckAuthToken(viewer)
+	if err != nil {
+		t.Fatalf("CheckAuthToken = %v", err)
+	}
+	if checked.Name != "dashboard" || !reflect.DeepEqual(checked.Grants, grants) {
+		t.Errorf("CheckAuthToken = %+v, want the dashboard token with %v", checked, grants)
+	}
+
+	expiring, short, err := inv.CreateAuthToken("ci", []Grant{{Role: RoleEditor}}, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if short.Expires == nil || !short.Expires.After(short.Created) {
+		t.Errorf("expiring token %+v has no expiry after its creation", short)
+	}
+	tokens, err := inv.AuthTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, token := range tokens {
+		names = append(names, token.Name)
+	}
+	slices.Sort(names)
+	if !reflect.DeepEqual(names, []string{"ci", "dashboard"}) {
+		t.Errorf("AuthTokens = %v, want ci and dashboard", names)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	other, err := hex.DecodeString(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, secret, _ := strings.Cut(strings.TrimPrefix(viewer, AuthTokenPrefix), "_")
+	for _, tc := range []struct {
+		name, token string
+	}{
+		{"expired", expiring},
+		{"wrong secret", AuthTokenPrefix + id + "_" + hex.EncodeToString(other)},
+		{"secret not hex", AuthTokenPrefix + id + "_" + secret[1:]},
+		{"unknown ID", AuthTokenPrefix + "0000000000000000_" + secret},
+		{"no prefix", id + "_" + secret},
+		{"no secret", AuthTokenPrefix + id},
+		{"ID with a slash", AuthTokenPrefix + "../tokens/" + id + "_" + secret},
+		{"empty", ""},
+	} {
+		if _, err := inv.CheckAuthToken(tc.token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: CheckAuthToken = %v, want ErrInvalidToken", tc.name, err)
+		}
+	}
+
+	if err := inv.RevokeAuthToken(stored.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.CheckAuthToken(viewer); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("CheckAuthToken of a revoked token = %v, want ErrInvalidToken", err)
+	}
+	if err := inv.RevokeAuthToken(stored.ID); err == nil || !strings.Contains(err.Error(), "no token") {
+		t.Errorf("revoking twice = %v, want no token", err)
+	}
+	if tokens, err := inv.AuthTokens(); err != nil || len(tokens) != 1 || tokens[0].Name != "ci" {
+		t.Errorf("AuthTokens after revoking = %+v, %v; want ci only", tokens, err)
+	}
+}
@@ -0,0 +1,25 @@
+package inventorypb
+
+import (
+	"fmt"
+
+	"github.com/oferchen/inventory"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// FromHost converts a host for the API. Binary values become base64
+// strings, as in JSON; a value of any other type than JSON has is an
+// error.
+func FromHost(host inventory.Host) (*Host, error) {
+	data, err := structpb.NewStruct(host.Data)
+	if err != nil {
+		return nil, fmt.Errorf("host %s: %w", host.Name, err)
+	}
+	return &Host{Name: host.Name, Data: data}, nil
+}
+
+// ToHost converts a host of the API. Numbers come back as float64, as
+// from JSON.
+func (x *Host) ToHost() inventory.Host {
+	return inventory.Host{Name: x.GetName(), Data: x.GetData().AsMap()}
+}
@@ -0,0 +1,29 @@
+// Package inventorypb is the gRPC API of the inventory, served by
+// "inventory serve --grpc": the messages and the Inventory service
+// generated from inventory.proto, with a client for Go programs, and
+// conversions between its hosts and inventory.Host.
+//
+// A client lists hosts with:
+//
+//	conn, err := grpc.Dial("localhost:9090", grpc.WithTransportCredentials(insecure.NewCredentials()))
+//	if err != nil {
+//		return err
+//	}
+//	defer conn.Close()
+//	stream, err := inventorypb.NewInventoryClient(conn).ListHosts(ctx, &inventorypb.ListHostsRequest{Filter: "site=ams"})
+//	if err != nil {
+//		return err
+//	}
+//	for {
+//		host, err := stream.Recv()
+//		if err == io.EOF {
+//			return nil
+//		}
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Println(host.Name)
+//	}
+package inventorypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative inventory.proto
@@ -0,0 +1,416 @@
+// Package k8ssync discovers the Nodes of a Kubernetes cluster, and
+// optionally its Services, as inventory hosts, for Inventory.SyncHosts
+// and Inventory.WatchSync. Each node becomes a host named after it, with
+// the fields bare-metal hosts use where they mean the same thing:
+//
+//	ipaddr (the internal IP address), external_ip, hostname
+//	arch, os, os_image, kernel, kubelet_version, container_runtime
+//	cores, memory (in MB) and pods, from the node's capacity
+//	provider_id, ready, unschedulable
+//
+// Each Service becomes a host named "<name>.<namespace>.svc", with
+// namespace, service_type, ipaddr (its cluster IP), external_ips, ports
+// and endpoints, the addresses of its ready endpoints. Both have k8s_kind set
+// to "node" or "service", and their labels and annotations as objects in
+// the fields named by Prefix followed by "labels" and "annotations".
+package k8ssync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/oferchen/inventory"
+)
+
+// DefaultPrefix starts the names of the label and annotation fields.
+const DefaultPrefix = "k8s_"
+
+// KindField is "node" or "service".
+const KindField = "k8s_kind"
+
+// lastAppliedAnnotation holds a copy of the whole object as kubectl apply
+// last wrote it, which is left out of the annotations.
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// listPageSize is how many objects are listed per request.
+const listPageSize = 500
+
+// watchRetry is how long Watch waits before watching again after the API
+// server ended a watch with an error.
+const watchRetry = 5 * time.Second
+
+// Provider discovers the nodes, and with Services the services, of one
+// cluster. It implements inventory.SyncWatcher.
+type Provider struct {
+	// Selector is a label selector nodes and services must match.
+	Selector string
+	// Services also discovers the services, of Namespace or of every
+	// namespace if it is empty.
+	Services  bool
+	Namespace string
+	// Prefix starts the names of the label and annotation fields,
+	// DefaultPrefix if empty.
+	Prefix string
+
+	client  kubernetes.Interface
+	cluster string
+}
+
+// New returns a provider for the cluster of kubeconfig's context, or of
+// its current context if context is empty. An empty kubeconfig means the
+// default: $KUBECONFIG or ~/.kube/config, and the in-cluster configuration
+// when running in a pod without either.
+func New(kubeconfig, context string) (*Provider, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: context})
+	restConfig, err := config.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading the kubeconfig: %w", err)
+	}
+	cluster := context
+	if cluster == "" {
+		if raw, err := config.RawConfig(); err == nil {
+			cluster = raw.CurrentContext
+		}
+	}
+	if cluster == "" {
+		cluster = "in-cluster"
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", cluster, err)
+	}
+	return &Provider{client: client, cluster: cluster}, nil
+}
+
+// Source is "k8s/" followed by the context, and by what narrows the
+// discovery, as in "k8s/prod/services=default/role=web" for the nodes and
+// the services of the default namespace labelled role=web.
+func (p *Provider) Source() string {
+	source := "k8s/" + p.cluster
+	switch {
+	case p.Services && p.Namespace != "":
+		source += "/services=" + p.Namespace
+	case p.Services:
+		source += "/services"
+	}
+	if p.Selector != "" {
+		source += "/" + p.Selector
+	}
+	return source
+}
+
+// Discover lists the nodes and, with Services, the services.
+func (p *Provider) Discover(ctx context.Context) ([]inventory.Host, error) {
+	var hosts []inventory.Host
+	err := p.list(ctx, func(opts metav1.ListOptions) (metav1.ListMeta, error) {
+		nodes, err := p.client.CoreV1().Nodes().List(ctx, opts)
+		if err != nil {
+			return metav1.ListMeta{}, fmt.Errorf("listing nodes of %s: %w", p.cluster, err)
+		}
+		for n := range nodes.Items {
+			hosts = append(hosts, inventory.Host{Name: nodes.Items[n].Name, Data: p.nodeData(&nodes.Items[n])})
+		}
+		return nodes.ListMeta, nil
+	})
+	if err != nil || !p.Services {
+		return hosts, err
+	}
+
+	endpoints := make(map[string][]string)
+	err = p.list(ctx, func(opts metav1.ListOptions) (metav1.ListMeta, error) {
+		list, err := p.client.CoreV1().Endpoints(p.Namespace).List(ctx, opts)
+		if err != nil {
+			return metav1.ListMeta{}, fmt.Errorf("listing endpoints of %s: %w", p.cluster, err)
+		}
+		for _, item := range list.Items {
+			endpoints[serviceName(item.ObjectMeta)] = endpointAddresses(item)
+		}
+		return list.ListMeta, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = p.list(ctx, func(opts metav1.ListOptions) (metav1.ListMeta, error) {
+		services, err := p.client.CoreV1().Services(p.Namespace).List(ctx, opts)
+		if err != nil {
+			return metav1.ListMeta{}, fmt.Errorf("listing services of %s: %w", p.cluster, err)
+		}
+		for n := range services.Items {
+			service := &services.Items[n]
+			name := serviceName(service.ObjectMeta)
+			hosts = append(hosts, inventory.Host{Name: name, Data: p.serviceData(service, endpoints[name])})
+		}
+		return services.ListMeta, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// list calls page with the Selector until the API server has no more
+// pages of objects.
+func (p *Provider) list(ctx context.Context, page func(metav1.ListOptions) (metav1.ListMeta, error)) error {
+	opts := metav1.ListOptions{LabelSelector: p.Selector, Limit: listPageSize}
+	for {
+		meta, err := page(opts)
+		if err != nil {
+			return err
+		}
+		if meta.Continue == "" {
+			return nil
+		}
+		opts.Continue = meta.Continue
+	}
+}
+
+// Watch calls changed whenever a node, or with Services a service or its
+// endpoints, is added, changed or removed. Watches the API server ends are
+// started again, from the last version seen when it still has it. If one
+// of them cannot be started, the others are stopped and its error
+// returned.
+func (p *Provider) Watch(ctx context.Context, changed func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type watchFunc func(context.Context, metav1.ListOptions) (watch.Interface, error)
+	watches := []watchFunc{p.client.CoreV1().Nodes().Watch}
+	if p.Services {
+		watches = append(watches, p.client.CoreV1().Services(p.Namespace).Watch, p.client.CoreV1().Endpoints(p.Namespace).Watch)
+	}
+	errs := make(chan error, len(watches))
+	for _, start := range watches {
+		go func(start watchFunc) {
+			errs <- p.watch(ctx, start, changed)
+		}(start)
+	}
+	var err error
+	for range watches {
+		if werr := <-errs; err == nil {
+			err = werr
+			cancel()
+		}
+	}
+	return err
+}
+
+// watch runs one watch until ctx is done. It only gives up if the watch
+// cannot be started at all, as when the user may not watch the resource.
+func (p *Provider) watch(ctx context.Context, start func(context.Context, metav1.ListOptions) (watch.Interface, error), changed func()) error {
+	opts := metav1.ListOptions{LabelSelector: p.Selector, AllowWatchBookmarks: true}
+	started := false
+	for {
+		w, err := start(ctx, opts)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil && !started:
+			return fmt.Errorf("watching %s: %w", p.cluster, err)
+		case err == nil:
+			started = true
+			opts.ResourceVersion = p.drain(ctx, w, opts.ResourceVersion, changed)
+			w.Stop()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(watchRetry):
+		}
+	}
+}
+
+// drain reads the events of w until it ends, and returns the resource
+// version to watch from next: the last one seen, or "" after an error such
+// as the version being too old, to start over from the current state.
+func (p *Provider) drain(ctx context.Context, w watch.Interface, version string, changed func()) string {
+	for {
+		select {
+		case <-ctx.Done():
+			return version
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return version
+			}
+			if event.Type == watch.Error {
+				changed()
+				return ""
+			}
+			if object, ok := event.Object.(metav1.Object); ok {
+				version = object.GetResourceVersion()
+			}
+			if event.Type != watch.Bookmark {
+				changed()
+			}
+		}
+	}
+}
+
+// nodeData maps a node to host fields, nil for those it has no value for.
+func (p *Provider) nodeData(node *corev1.Node) map[string]interface{} {
+	info := node.Status.NodeInfo
+	data := map[string]interface{}{
+		KindField:           "node",
+		"ipaddr":            nil,
+		"external_ip":       nil,
+		"hostname":          nil,
+		"arch":              optional(info.Architecture),
+		"os":                optional(info.OperatingSystem),
+		"os_image":          optional(info.OSImage),
+		"kernel":            optional(info.KernelVersion),
+		"kubelet_version":   optional(info.KubeletVersion),
+		"container_runtime": optional(info.ContainerRuntimeVersion),
+		"cores":             nil,
+		"memory":            nil,
+		"pods":              nil,
+		"provider_id":       optional(node.Spec.ProviderID),
+		"ready":             false,
+		"unschedulable":     nil,
+	}
+	for _, address := range node.Status.Addresses {
+		field := ""
+		switch address.Type {
+		case corev1.NodeInternalIP:
+			field = "ipaddr"
+		case corev1.NodeExternalIP:
+			field = "external_ip"
+		case corev1.NodeHostName:
+			field = "hostname"
+		}
+		// The first address of a type is the one the node prefers.
+		if field != "" && data[field] == nil {
+			data[field] = optional(address.Address)
+		}
+	}
+	// Numbers are float64, as stored hosts decode them, so that unchanged
+	// nodes compare equal in SyncHosts.
+	if cpu, ok := node.Status.Capacity[corev1.ResourceCPU]; ok {
+		data["cores"] = float64(cpu.Value())
+	}
+	if memory, ok := node.Status.Capacity[corev1.ResourceMemory]; ok {
+		data["memory"] = float64(memory.Value() >> 20)
+	}
+	if pods, ok := node.Status.Capacity[corev1.ResourcePods]; ok {
+		data["pods"] = float64(pods.Value())
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			data["ready"] = condition.Status == corev1.ConditionTrue
+		}
+	}
+	if node.Spec.Unschedulable {
+		data["unschedulable"] = true
+	}
+	p.addMeta(data, node.ObjectMeta)
+	return data
+}
+
+// serviceData maps a service and the addresses of its ready endpoints to
+// host fields, nil for those it has no value for.
+func (p *Provider) serviceData(service *corev1.Service, endpoints []string) map[string]interface{} {
+	data := map[string]interface{}{
+		KindField:      "service",
+		"namespace":    service.Namespace,
+		"service_type": optional(string(service.Spec.Type)),
+		"ipaddr":       nil,
+		"external_ips": nil,
+		"ports":        nil,
+		"endpoints":    nil,
+	}
+	if ip := service.Spec.ClusterIP; ip != corev1.ClusterIPNone {
+		data["ipaddr"] = optional(ip)
+	}
+	external := append([]string(nil), service.Spec.ExternalIPs...)
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			external = append(external, ingress.IP)
+		} else if ingress.Hostname != "" {
+			external = append(external, ingress.Hostname)
+		}
+	}
+	data["external_ips"] = optionalList(external)
+	ports := make([]string, 0, len(service.Spec.Ports))
+	for _, port := range service.Spec.Ports {
+		ports = append(ports, strconv.Itoa(int(port.Port))+"/"+string(port.Protocol))
+	}
+	data["ports"] = optionalList(ports)
+	data["endpoints"] = optionalList(endpoints)
+	p.addMeta(data, service.ObjectMeta)
+	return data
+}
+
+// addMeta sets the label and annotation fields of an object.
+func (p *Provider) addMeta(data map[string]interface{}, meta metav1.ObjectMeta) {
+	prefix := p.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	annotations := make(map[string]string, len(meta.Annotations))
+	for key, value := range meta.Annotations {
+		if key != lastAppliedAnnotation {
+			annotations[key] = value
+		}
+	}
+	data[prefix+"labels"] = optionalMap(meta.Labels)
+	data[prefix+"annotations"] = optionalMap(annotations)
+}
+
+// serviceName names the host of a service, or of its endpoints, which
+// share its name.
+func serviceName(meta metav1.ObjectMeta) string {
+	return meta.Name + "." + meta.Namespace + ".svc"
+}
+
+// endpointAddresses returns the ready addresses of endpoints, sorted.
+func endpointAddresses(endpoints corev1.Endpoints) []string {
+	var addresses []string
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			addresses = append(addresses, address.IP)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// optional returns s, or nil if it is empty.
+func optional(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// optionalList returns values as a host field value, or nil if it is
+// empty.
+func optionalList(values []string) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	list := make([]interface{}, len(values))
+	for n, value := range values {
+		list[n] = value
+	}
+	return list
+}
+
+// optionalMap returns m as a host field value, or nil if it is empty.
+func optionalMap(m map[string]string) interface{} {
+	if len(m) == 0 {
+		return nil
+	}
+	object := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		object[key] = value
+	}
+	return object
+}
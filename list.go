@@ -0,0 +1,670 @@
+package inventory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/oferchen/inventory/query"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+)
+
+func (i *Inventory) ListHosts() ([]Host, error) {
+	if i.local != nil {
+		result, err := i.local.List(ListOptions{})
+		return result.Hosts, err
+	}
+	list, err := i.listHosts(baseKey, true)
+	return list.hosts, err
+}
+
+// ListHostsWithRevisions returns the hosts selected by the NamePrefix,
+// Filter and Where of opts, with the ModRevision of each host's key by
+// name, for EncodeExport. The other options are ignored, and a malformed
+// value fails the listing as with Strict.
+func (i *Inventory) ListHostsWithRevisions(opts ListOptions) ([]Host, map[string]int64, error) {
+	list, err := i.listHosts(i.hostKey(opts.NamePrefix), true)
+	if err != nil {
+		return nil, nil, err
+	}
+	hosts := make([]Host, 0, len(list.hosts))
+	revisions := make(map[string]int64, len(list.hosts))
+	for n, host := range list.hosts {
+		if !opts.Filter.Match(host) || (opts.Where != nil && !opts.Where.Match(host.Name, host.Data)) {
+			continue
+		}
+		hosts = append(hosts, host)
+		revisions[host.Name] = list.kvs[n].ModRevision
+	}
+	return hosts, revisions, nil
+}
+
+// ListHostNames returns the names of the hosts whose name starts with
+// prefix, sorted. Only keys are requested, so etcd never sends the values.
+func (i *Inventory) ListHostNames(prefix string) ([]string, error) {
+	if i.local != nil {
+		result, err := i.local.List(ListOptions{NamePrefix: prefix})
+		names := make([]string, 0, len(result.Hosts))
+		for _, host := range result.Hosts {
+			names = append(names, host.Name)
+		}
+		return names, err
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Get(ctx, i.hostKey(prefix), i.readOpts(clientv3.WithPrefix(), clientv3.WithKeysOnly())...)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		names = append(names, i.hostNameFromKey(string(kv.Key)))
+	}
+	return names, nil
+}
+
+// noGroup is the bucket for hosts that lack the grouping field.
+const noGroup = "<none>"
+
+// GroupBy buckets hosts by the value of field as GroupHosts does, with the
+// hosts without the field in the "<none>" group.
+func (i *Inventory) GroupBy(field string) (map[string][]Host, error) {
+	hosts, err := i.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	groups, ungrouped := GroupHosts(hosts, field)
+	if len(ungrouped) > 0 {
+		groups[noGroup] = append(groups[noGroup], ungrouped...)
+	}
+	return groups, nil
+}
+
+// GroupHosts buckets hosts by the value of field, keeping their order
+// within each group. A host whose field holds an array belongs to one group
+// per element; hosts without the field are returned apart as ungrouped.
+func GroupHosts(hosts []Host, field string) (groups map[string][]Host, ungrouped []Host) {
+	groups = make(map[string][]Host)
+	for _, host := range hosts {
+		value, ok := host.Data[field]
+		if !ok {
+			ungrouped = append(ungrouped, host)
+			continue
+		}
+		if values, ok := value.([]interface{}); ok {
+			for _, v := range values {
+				group := FormatValue(v)
+				groups[group] = append(groups[group], host)
+			}
+			continue
+		}
+		group := FormatValue(value)
+		groups[group] = append(groups[group], host)
+	}
+	return groups, ungrouped
+}
+
+// ValueCount is one distinct value of a field, as FormatValue shows it, and
+// the number of hosts holding it.
+type ValueCount struct {
+	Value string
+	Hosts int
+}
+
+// FieldValues returns the distinct values of field sorted by value, with
+// how many hosts hold each. Each element of an array value counts on its
+// own, once per host; hosts without the field are not counted.
+func (i *Inventory) FieldValues(field string) ([]ValueCount, error) {
+	hosts, err := i.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, host := range hosts {
+		value, ok := host.Data[field]
+		if !ok {
+			continue
+		}
+		values := []interface{}{value}
+		if elems, ok := value.([]interface{}); ok {
+			values = elems
+		}
+		seen := make(map[string]bool, len(values))
+		for _, v := range values {
+			text := FormatValue(v)
+			if !seen[text] {
+				seen[text] = true
+				counts[text]++
+			}
+		}
+	}
+	result := make([]ValueCount, 0, len(counts))
+	for value, n := range counts {
+		result = append(result, ValueCount{Value: value, Hosts: n})
+	}
+	sort.Slice(result, func(a, b int) bool { return result[a].Value < result[b].Value })
+	return result, nil
+}
+
+// DuplicateGroup is a set of hosts sharing the same values for every
+// field of a FindDuplicates key.
+type DuplicateGroup struct {
+	// Values holds the shared value of each key field, in key order.
+	Values []string
+	Hosts  []Host
+}
+
+// FindDuplicates groups hosts by the composite key of fields and returns
+// the groups with more than one host, ordered by their values. Hosts
+// lacking any of the fields, or holding null there, are not compared: a
+// missing serial is not a shared one.
+func (i *Inventory) FindDuplicates(fields []string) ([]DuplicateGroup, error) {
+	hosts, err := i.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string]*DuplicateGroup)
+	var keys []string
+	for _, host := range hosts {
+		values := make([]string, 0, len(fields))
+		for _, field := range fields {
+			value, ok := host.Data[field]
+			if !ok || value == nil {
+				break
+			}
+			values = append(values, FormatValue(value))
+		}
+		if len(values) < len(fields) {
+			continue
+		}
+		// The JSON form of the values keeps composite keys distinct even
+		// when a value contains the separator.
+		encoded, _ := json.Marshal(values)
+		key := string(encoded)
+		group, ok := groups[key]
+		if !ok {
+			group = &DuplicateGroup{Values: values}
+			groups[key] = group
+			keys = append(keys, key)
+		}
+		group.Hosts = append(group.Hosts, host)
+	}
+	sort.Strings(keys)
+	var duplicates []DuplicateGroup
+	for _, key := range keys {
+		if group := groups[key]; len(group.Hosts) > 1 {
+			duplicates = append(duplicates, *group)
+		}
+	}
+	return duplicates, nil
+}
+
+// ListOptions narrows and pages a host listing.
+type ListOptions struct {
+	// NamePrefix restricts the listing to hosts whose name starts with it.
+	// It is encoded like a name and appended to baseKey, so etcd only returns
+	// matching keys.
+	NamePrefix string
+	Offset     int64
+	// Limit caps the number of hosts returned; 0 means no limit.
+	Limit int64
+	// SinceRevision restricts the listing to hosts modified after this etcd
+	// revision; 0 means all hosts.
+	SinceRevision int64
+	// Filter keeps only the matching hosts. It is applied client-side, before
+	// Offset and Limit.
+	Filter HostFilter
+	// Where keeps only the hosts the query expression holds for. Like
+	// Filter, it is applied client-side before Offset and Limit.
+	Where *query.Query
+	// After starts the listing past the host of that name, for cursor
+	// pagination: pass the last name of one page to get the next.
+	After string
+	// RecentFirst orders hosts by last modification, newest first, instead
+	// of by name, and adds a mod_revision field to each host.
+	RecentFirst bool
+	// Strict fails the listing on the first malformed value instead of
+	// skipping it and reporting it in ListResult.Malformed.
+	Strict bool
+	// WithTTL adds a ttl_remaining field to each host: the seconds left on
+	// the key's lease, or "permanent" for keys without one.
+	WithTTL bool
+	// WithKey adds a _key field to each host: its full etcd key, namespace
+	// included.
+	WithKey bool
+	// Group restricts the listing to the members of the named group. Like
+	// Filter, it is applied client-side before Offset and Limit.
+	Group string
+	// Statuses keeps only the hosts in one of these lifecycle states,
+	// client-side like Filter.
+	Statuses []HostStatus
+	// GroupVars merges the variables of each host's groups into its data;
+	// see ApplyGroupVars.
+	GroupVars bool
+	// Revision reads the hosts as they were at this etcd revision; 0 reads
+	// the latest. StreamHosts sets it to read every page at the revision of
+	// the first.
+	Revision int64
+}
+
+// ListResult is a page of hosts together with the etcd revision it was
+// read at, which can be fed back as ListOptions.SinceRevision to fetch only
+// later changes.
+type ListResult struct {
+	Hosts []Host
+	// Truncated reports whether more hosts exist past the returned page.
+	Truncated bool
+	Revision  int64
+	// Malformed holds a *MalformedHostError for each stored value that could
+	// not be decoded and was skipped; it is always empty with Strict.
+	Malformed []error
+}
+
+// ListHostsWithOptions lists hosts according to opts. The name prefix,
+// revision filter and limit are all pushed down to etcd; the limit only when
+// there is no host filter or query.
+func (i *Inventory) ListHostsWithOptions(opts ListOptions) (ListResult, error) {
+	if i.listsLocally(opts) {
+		return i.local.List(opts)
+	}
+	groups, members, err := i.groupMembers(opts)
+	if err != nil {
+		return ListResult{}, err
+	}
+	start, getOpts := i.hostRange(opts)
+	if opts.Limit > 0 && !opts.clientSide() {
+		getOpts = append(getOpts, clientv3.WithLimit(opts.Offset+opts.Limit))
+	}
+	if opts.RecentFirst {
+		getOpts = append(getOpts, clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortDescend))
+	}
+	list, err := i.listHosts(start, opts.Strict, getOpts...)
+	if err != nil {
+		return ListResult{}, err
+	}
+	hosts, kvs := selectHosts(list, opts, members)
+	hosts, truncated := paginate(hosts, opts.Offset, opts.Limit)
+	if len(hosts) > 0 {
+		kvs = kvs[opts.Offset : opts.Offset+int64(len(hosts))]
+	}
+	if hosts, err = i.decorateHosts(hosts, kvs, opts, groups); err != nil {
+		return ListResult{}, err
+	}
+	revision := list.resp.Header.Revision
+	if opts.Revision > 0 {
+		revision = opts.Revision
+	}
+	return ListResult{Hosts: hosts, Truncated: truncated || list.resp.More, Revision: revision, Malformed: list.malformed}, nil
+}
+
+// clientSide reports whether opts selects hosts by their data, which etcd
+// cannot do, so limits cannot be pushed down to it.
+func (opts ListOptions) clientSide() bool {
+	return len(opts.Filter) > 0 || opts.Where != nil || opts.Group != "" || len(opts.Statuses) > 0
+}
+
+// groupMembers loads the groups opts needs for Group and GroupVars, with
+// the members of opts.Group as a set.
+func (i *Inventory) groupMembers(opts ListOptions) ([]Group, map[string]bool, error) {
+	var groups []Group
+	members := make(map[string]bool)
+	if opts.Group != "" || opts.GroupVars {
+		var err error
+		if groups, err = i.ListGroups(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.Group != "" {
+		found := false
+		for _, group := range groups {
+			if group.Name == opts.Group {
+				found = true
+				for _, host := range group.Hosts {
+					members[host] = true
+				}
+			}
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("%w: %s", ErrGroupNotFound, opts.Group)
+		}
+	}
+	return groups, members, nil
+}
+
+// hostRange returns the start key and range options of a listing with the
+// NamePrefix, After, SinceRevision and Revision of opts. The range always
+// ends where the name prefix does, so more options, such as a limit, can
+// be added to it.
+func (i *Inventory) hostRange(opts ListOptions) (string, []clientv3.OpOption) {
+	start := i.hostKey(opts.NamePrefix)
+	getOpts := []clientv3.OpOption{clientv3.WithRange(clientv3.GetPrefixRangeEnd(start))}
+	if opts.SinceRevision > 0 {
+		getOpts = append(getOpts, clientv3.WithMinModRev(opts.SinceRevision+1))
+	}
+	if opts.Revision > 0 {
+		getOpts = append(getOpts, clientv3.WithRev(opts.Revision))
+	}
+	// Start at the first key after After's; WithRange keeps the end
+	// where the prefix puts it.
+	if opts.After != "" {
+		if after := i.hostKey(opts.After) + "\x00"; after > start {
+			start = after
+		}
+	}
+	return start, getOpts
+}
+
+// selectHosts returns the hosts of list that pass the Filter, Where and
+// Group of opts, with their keys.
+func selectHosts(list hostList, opts ListOptions, members map[string]bool) ([]Host, []*mvccpb.KeyValue) {
+	if !opts.clientSide() {
+		return list.hosts, list.kvs
+	}
+	var hosts []Host
+	var kvs []*mvccpb.KeyValue
+	for n, host := range list.hosts {
+		if opts.Filter.Match(host) && (opts.Where == nil || opts.Where.Match(host.Name, host.Data)) && (opts.Group == "" || members[host.Name]) && (len(opts.Statuses) == 0 || slices.Contains(opts.Statuses, host.Status())) {
+			hosts = append(hosts, host)
+			kvs = append(kvs, list.kvs[n])
+		}
+	}
+	return hosts, kvs
+}
+
+// decorateHosts merges the group variables into hosts and adds the
+// synthetic fields opts asks for, read from kvs, the keys of hosts.
+func (i *Inventory) decorateHosts(hosts []Host, kvs []*mvccpb.KeyValue, opts ListOptions, groups []Group) ([]Host, error) {
+	if opts.GroupVars {
+		hosts = ApplyGroupVars(hosts, groups)
+	}
+	if opts.RecentFirst {
+		for n, kv := range kvs[:len(hosts)] {
+			if hosts[n].Data == nil {
+				hosts[n].Data = make(map[string]interface{})
+			}
+			hosts[n].Data[ModRevisionField] = kv.ModRevision
+		}
+	}
+	if opts.WithTTL && len(hosts) > 0 {
+		if err := i.addLeaseTTLs(hosts, kvs); err != nil {
+			return nil, err
+		}
+	}
+	if opts.WithKey {
+		for n, kv := range kvs[:len(hosts)] {
+			if hosts[n].Data == nil {
+				hosts[n].Data = make(map[string]interface{})
+			}
+			hosts[n].Data[KeyField] = i.namespace + string(kv.Key)
+		}
+	}
+	return hosts, nil
+}
+
+// DefaultPageSize is the number of keys ListHostsPage and StreamHosts
+// read per request when not told otherwise: small enough to stay far
+// below etcd's response size limit with large hosts.
+const DefaultPageSize = 500
+
+// ErrNotPageable is returned when a listing cannot be read a page at a
+// time.
+var ErrNotPageable = errors.New("listing cannot be paged")
+
+// HostPage is one page of a listing read by ListHostsPage.
+type HostPage struct {
+	// Hosts are the hosts of the page that pass the listing's filters, so
+	// a page may hold fewer hosts than were read, or none.
+	Hosts []Host
+	// Next is the After of the following page, or "" after the last one.
+	Next string
+	// Revision is the etcd revision the page was read at; pass it as
+	// ListOptions.Revision for the following pages to read them all at
+	// the same revision.
+	Revision  int64
+	Malformed []error
+}
+
+// ListHostsPage reads one page of a listing in name order: the hosts
+// among the next opts.Limit keys (DefaultPageSize if 0) past opts.After,
+// selected and decorated as ListHostsWithOptions does. Pass the page's
+// Next as After to read the following one. Pages cannot skip an Offset or
+// be ordered by RecentFirst; StreamHosts applies Offset itself.
+func (i *Inventory) ListHostsPage(opts ListOptions) (HostPage, error) {
+	if opts.Offset > 0 || opts.RecentFirst {
+		return HostPage{}, fmt.Errorf("%w: offsets and recent-first order need the whole listing", ErrNotPageable)
+	}
+	if i.listsLocally(opts) {
+		if opts.Limit <= 0 {
+			opts.Limit = DefaultPageSize
+		}
+		result, err := i.local.List(opts)
+		page := HostPage{Hosts: result.Hosts, Revision: result.Revision}
+		if result.Truncated && len(result.Hosts) > 0 {
+			page.Next = result.Hosts[len(result.Hosts)-1].Name
+		}
+		return page, err
+	}
+	groups, members, err := i.groupMembers(opts)
+	if err != nil {
+		return HostPage{}, err
+	}
+	return i.listHostsPage(opts, groups, members)
+}
+
+// listHostsPage is ListHostsPage with the groups already loaded, so
+// StreamHosts loads them only once.
+func (i *Inventory) listHostsPage(opts ListOptions, groups []Group, members map[string]bool) (HostPage, error) {
+	size := opts.Limit
+	if size <= 0 {
+		size = DefaultPageSize
+	}
+	start, getOpts := i.hostRange(opts)
+	list, err := i.listHosts(start, opts.Strict, append(getOpts, clientv3.WithLimit(size))...)
+	if err != nil {
+		return HostPage{}, err
+	}
+	page := HostPage{Revision: list.resp.Header.Revision, Malformed: list.malformed}
+	if opts.Revision > 0 {
+		page.Revision = opts.Revision
+	}
+	if kvs := list.resp.Kvs; list.resp.More && len(kvs) > 0 {
+		page.Next = i.hostNameFromKey(string(kvs[len(kvs)-1].Key))
+	}
+	hosts, kvs := selectHosts(list, opts, members)
+	if page.Hosts, err = i.decorateHosts(hosts, kvs, opts, groups); err != nil {
+		return HostPage{}, err
+	}
+	return page, nil
+}
+
+// StreamResult sums up a listing read by StreamHosts.
+type StreamResult struct {
+	// Count is the number of hosts passed to the callback.
+	Count int
+	// Truncated reports whether opts.Limit stopped the listing early.
+	Truncated bool
+	// Revision is the etcd revision every page was read at.
+	Revision  int64
+	Malformed []error
+}
+
+// StreamHosts lists hosts like ListHostsWithOptions, but reads them
+// pageSize keys at a time (DefaultPageSize if 0) and calls fn with each
+// page of hosts as it arrives, so memory stays bounded however large the
+// inventory is. All pages are read at the revision of the first. fn is not
+// called for pages without hosts; an error from it stops the listing and
+// is returned. RecentFirst cannot be streamed.
+func (i *Inventory) StreamHosts(opts ListOptions, pageSize int64, fn func([]Host) error) (StreamResult, error) {
+	if opts.RecentFirst {
+		return StreamResult{}, fmt.Errorf("%w: recent-first order needs the whole listing", ErrNotPageable)
+	}
+	if i.listsLocally(opts) {
+		// The hosts are in memory already, so they are passed in one call.
+		list, err := i.local.List(opts)
+		if err != nil {
+			return StreamResult{}, err
+		}
+		result := StreamResult{Count: len(list.Hosts), Truncated: list.Truncated, Revision: list.Revision}
+		if len(list.Hosts) > 0 {
+			err = fn(list.Hosts)
+		}
+		return result, err
+	}
+	groups, members, err := i.groupMembers(opts)
+	if err != nil {
+		return StreamResult{}, err
+	}
+	var result StreamResult
+	offset := opts.Offset
+	pageOpts := opts
+	pageOpts.Offset, pageOpts.Limit = 0, pageSize
+	for {
+		page, err := i.listHostsPage(pageOpts, groups, members)
+		if err != nil {
+			return result, err
+		}
+		pageOpts.Revision, result.Revision = page.Revision, page.Revision
+		result.Malformed = append(result.Malformed, page.Malformed...)
+
+		hosts := page.Hosts
+		skip := min(offset, int64(len(hosts)))
+		hosts, offset = hosts[skip:], offset-skip
+		if opts.Limit > 0 && int64(result.Count+len(hosts)) >= opts.Limit {
+			rest := opts.Limit - int64(result.Count)
+			result.Truncated = int64(len(hosts)) > rest || page.Next != ""
+			hosts, page.Next = hosts[:rest], ""
+		}
+		if len(hosts) > 0 {
+			if err := fn(hosts); err != nil {
+				return result, err
+			}
+			result.Count += len(hosts)
+		}
+		if page.Next == "" {
+			return result, nil
+		}
+		pageOpts.After = page.Next
+	}
+}
+
+// TTLField is the synthetic field that ListOptions.WithTTL adds.
+const TTLField = "ttl_remaining"
+
+// ModRevisionField is the synthetic field that ListOptions.RecentFirst adds.
+const ModRevisionField = "mod_revision"
+
+// KeyField is the synthetic field that ListOptions.WithKey adds.
+const KeyField = "_key"
+
+// EtcdKey returns the full etcd key of the named host, namespace included,
+// as it appears in a raw dump of the cluster.
+func (i *Inventory) EtcdKey(hostName string) string {
+	return i.namespace + i.hostKey(hostName)
+}
+
+// addLeaseTTLs sets TTLField on each host from the lease of the matching
+// key in kvs. Hosts commonly share a lease, so each distinct lease is looked
+// up only once.
+func (i *Inventory) addLeaseTTLs(hosts []Host, kvs []*mvccpb.KeyValue) error {
+	ttls := make(map[int64]interface{})
+	for n, kv := range kvs {
+		ttl, ok := ttls[kv.Lease]
+		if !ok {
+			if kv.Lease == int64(clientv3.NoLease) {
+				ttl = "permanent"
+			} else {
+				ctx, cancel := i.requestContext()
+				resp, err := i.lease.TimeToLive(ctx, clientv3.LeaseID(kv.Lease))
+				cancel()
+				if err != nil {
+					return fmt.Errorf("lease of host %s: %w", hosts[n].Name, err)
+				}
+				ttl = resp.TTL
+				if resp.TTL < 0 {
+					ttl = "expired"
+				}
+			}
+			ttls[kv.Lease] = ttl
+		}
+		if hosts[n].Data == nil {
+			hosts[n].Data = make(map[string]interface{})
+		}
+		hosts[n].Data[TTLField] = ttl
+	}
+	return nil
+}
+
+// ListHostsSince returns the hosts whose ModRevision is greater than rev.
+func (i *Inventory) ListHostsSince(rev int64) ([]Host, error) {
+	result, err := i.ListHostsWithOptions(ListOptions{SinceRevision: rev, Strict: true})
+	return result.Hosts, err
+}
+
+// MalformedHostError reports a stored value that is not a valid host.
+type MalformedHostError struct {
+	Key string
+	Err error
+}
+
+func (e *MalformedHostError) Error() string {
+	return fmt.Sprintf("malformed host at key %s: %v", e.Key, e.Err)
+}
+
+func (e *MalformedHostError) Unwrap() error { return e.Err }
+
+// hostList is the decoded result of a range read. kvs is aligned with
+// hosts; values that failed to decode are left out of both and reported in
+// malformed instead.
+type hostList struct {
+	hosts     []Host
+	kvs       []*mvccpb.KeyValue
+	malformed []error
+	resp      *clientv3.GetResponse
+}
+
+// listHosts reads and decodes the hosts under prefix. With strict, the first
+// malformed value fails the whole read.
+func (i *Inventory) listHosts(prefix string, strict bool, opts ...clientv3.OpOption) (hostList, error) {
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	opts = i.readOpts(append([]clientv3.OpOption{clientv3.WithPrefix()}, opts...)...)
+	resp, err := i.kv.Get(ctx, prefix, opts...)
+	if err != nil {
+		return hostList{}, err
+	}
+	list := hostList{hosts: make([]Host, 0, len(resp.Kvs)), resp: resp}
+	for _, kv := range resp.Kvs {
+		host, err := i.unmarshalHost(kv.Value)
+		if err != nil {
+			err = &MalformedHostError{Key: string(kv.Key), Err: err}
+			if strict {
+				return hostList{}, err
+			}
+			list.malformed = append(list.malformed, err)
+			continue
+		}
+		if host.Name == "" {
+			host.Name = i.hostNameFromKey(string(kv.Key))
+		}
+		list.hosts = append(list.hosts, host)
+		list.kvs = append(list.kvs, kv)
+	}
+	return list, nil
+}
+
+// paginate applies offset and limit to an already fetched host slice, for
+// cases where the limit cannot be pushed down to etcd. A limit of 0 means no
+// limit.
+func paginate(hosts []Host, offset, limit int64) ([]Host, bool) {
+	if offset >= int64(len(hosts)) {
+		return []Host{}, false
+	}
+	hosts = hosts[offset:]
+	if limit > 0 && int64(len(hosts)) > limit {
+		return hosts[:limit], true
+	}
+	return hosts, false
+}
@@ -0,0 +1,356 @@
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// PreflightCheck is the outcome of probing one capability; Err is nil when
+// it is allowed.
+type PreflightCheck struct {
+	Capability string
+	Err        error
+}
+
+// preflightTTL bounds the life of the preflight test key, so it expires
+// even if deleting it is denied or the process dies first.
+const preflightTTL = 60
+
+// Preflight probes whether the credentials may read, write and delete
+// hosts, using a test key of its own that it deletes before returning.
+// The key is a host named .inventory-preflight-<random> with no fields, so
+// a listing running concurrently shows nothing worse than that.
+func (i *Inventory) Preflight() []PreflightCheck {
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	key := i.hostKey(".inventory-preflight-" + hex.EncodeToString(nonce[:]))
+	var checks []PreflightCheck
+
+	ctx, cancel := i.requestContext()
+	_, err := i.kv.Get(ctx, baseKey, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancel()
+	checks = append(checks, PreflightCheck{"read", err})
+
+	value, err := i.marshalHost(Host{Name: i.hostNameFromKey(key), Data: map[string]interface{}{}})
+	if err == nil {
+		var opts []clientv3.OpOption
+		ctx, cancel = i.requestContext()
+		if lease, err := i.lease.Grant(ctx, preflightTTL); err == nil {
+			opts = append(opts, clientv3.WithLease(lease.ID))
+		}
+		_, err = i.kv.Put(ctx, key, string(value), opts...)
+		cancel()
+	}
+	checks = append(checks, PreflightCheck{"write", err})
+
+	// Deleting a key is checked against the permissions like any other,
+	// so this probes delete even when the write was denied.
+	ctx, cancel = i.requestContext()
+	_, err = i.kv.Delete(ctx, key)
+	cancel()
+	checks = append(checks, PreflightCheck{"delete", err})
+	return checks
+}
+
+// SaveSnapshot streams a snapshot of the etcd backend database to path, via
+// a temporary file renamed into place once complete. It covers the whole
+// cluster keyspace, not just the inventory or its namespace. It returns the
+// snapshot's size and the cluster revision when it was requested; the
+// snapshot holds at least every change up to that revision.
+func (i *Inventory) SaveSnapshot(ctx context.Context, path string) (size, revision int64, err error) {
+	if i.client == nil {
+		return 0, 0, errors.New("snapshots need a connection to etcd")
+	}
+	endpoints := i.client.Endpoints()
+	if len(endpoints) == 0 {
+		return 0, 0, errors.New("no etcd endpoints")
+	}
+	status, err := i.client.Status(ctx, endpoints[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	rc, err := i.client.Snapshot(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".part*")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if size, err = io.Copy(tmp, rc); err != nil {
+		tmp.Close()
+		return 0, 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, 0, err
+	}
+	return size, status.Header.Revision, os.Rename(tmp.Name(), path)
+}
+
+// BackupVersion is the format version of the files written by WriteBackup.
+const BackupVersion = 1
+
+// Backup is a copy of the hosts and groups at one etcd revision: the stored
+// values by key below the namespace, so a restore writes back exactly what
+// was read, whatever encoding it had. Unlike SaveSnapshot it covers only
+// the inventory, and is restored through the inventory rather than etcdutl.
+type Backup struct {
+	Version  int               `json:"version"`
+	Revision int64             `json:"revision"`
+	Time     time.Time         `json:"time"`
+	Keys     map[string][]byte `json:"keys"`
+}
+
+// backupPrefixes are the trees a Backup covers.
+var backupPrefixes = []string{baseKey, groupsKey}
+
+// CreateBackup reads the hosts and groups at one revision.
+func (i *Inventory) CreateBackup() (*Backup, error) {
+	b := &Backup{Version: BackupVersion, Time: time.Now().UTC(), Keys: make(map[string][]byte)}
+	for _, prefix := range backupPrefixes {
+		opts := []clientv3.OpOption{clientv3.WithPrefix()}
+		if b.Revision != 0 {
+			opts = append(opts, clientv3.WithRev(b.Revision))
+		}
+		ctx, cancel := i.requestContext()
+		resp, err := i.kv.Get(ctx, prefix, opts...)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if b.Revision == 0 {
+			b.Revision = resp.Header.Revision
+		}
+		for _, kv := range resp.Kvs {
+			b.Keys[string(kv.Key)] = kv.Value
+		}
+	}
+	return b, nil
+}
+
+// HostCount returns the number of hosts in b.
+func (b *Backup) HostCount() int {
+	n := 0
+	for key := range b.Keys {
+		if strings.HasPrefix(key, baseKey) {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteBackup saves b to path, atomically.
+func WriteBackup(path string, b *Backup) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data)
+}
+
+// ReadBackup loads a backup saved by WriteBackup.
+func ReadBackup(path string) (*Backup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var b Backup
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if b.Version < 1 || b.Version > BackupVersion {
+		return nil, fmt.Errorf("%s: unsupported backup version %d", path, b.Version)
+	}
+	return &b, nil
+}
+
+// RestoreBackup makes the hosts and groups what they were in b: it writes
+// the keys whose values differ and deletes those b lacks, and returns how
+// many of each. The changes are made in transactions of removeBatchSize
+// keys, each guarded so that it fails with ErrHostChanged if a host or
+// group was written by anyone else since the comparison or since the
+// previous batch; the counts then cover the batches already made, and
+// restoring again finishes the job. Hosts come back without their leases.
+func (i *Inventory) RestoreBackup(b *Backup) (written, deleted int, err error) {
+	current, err := i.CreateBackup()
+	if err != nil {
+		return 0, 0, err
+	}
+	var ops []clientv3.Op
+	for _, key := range sortedKeys(b.Keys) {
+		if value, ok := current.Keys[key]; !ok || !bytes.Equal(value, b.Keys[key]) {
+			ops = append(ops, clientv3.OpPut(key, string(b.Keys[key])))
+		}
+	}
+	for _, key := range sortedKeys(current.Keys) {
+		if _, ok := b.Keys[key]; !ok {
+			ops = append(ops, clientv3.OpDelete(key))
+		}
+	}
+	rev := current.Revision
+	for start := 0; start < len(ops); start += removeBatchSize {
+		batch := ops[start:min(start+removeBatchSize, len(ops))]
+		guards := make([]clientv3.Cmp, len(backupPrefixes))
+		for n, prefix := range backupPrefixes {
+			guards[n] = clientv3.Compare(clientv3.ModRevision(prefix).WithPrefix(), "<", rev+1)
+		}
+		ctx, cancel := i.requestContext()
+		resp, err := i.kv.Txn(ctx).If(guards...).Then(batch...).Commit()
+		cancel()
+		if err != nil {
+			return written, deleted, err
+		}
+		if !resp.Succeeded {
+			return written, deleted, fmt.Errorf("%w: the inventory changed during the restore", ErrHostChanged)
+		}
+		rev = resp.Header.Revision
+		for _, op := range batch {
+			if op.IsPut() {
+				written++
+			} else {
+				deleted++
+			}
+		}
+	}
+	return written, deleted, nil
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// HostChange is a host whose data differs between two backups.
+type HostChange struct {
+	Name          string
+	FieldsChanged []string
+}
+
+// BackupDiff lists the hosts added, removed and changed from one backup to
+// another, each sorted by name.
+type BackupDiff struct {
+	Added   []string
+	Removed []string
+	Changed []HostChange
+}
+
+// DiffBackups compares the hosts of a and b. Hosts are compared by their
+// data, so a host stored in another encoding is not changed.
+func (i *Inventory) DiffBackups(a, b *Backup) BackupDiff {
+	var diff BackupDiff
+	for _, key := range sortedKeys(b.Keys) {
+		if !strings.HasPrefix(key, baseKey) {
+			continue
+		}
+		before, ok := a.Keys[key]
+		if !ok {
+			diff.Added = append(diff.Added, i.hostNameFromKey(key))
+			continue
+		}
+		if fields := ChangedFields(auditData(before), auditData(b.Keys[key])); len(fields) > 0 {
+			diff.Changed = append(diff.Changed, HostChange{Name: i.hostNameFromKey(key), FieldsChanged: fields})
+		}
+	}
+	for _, key := range sortedKeys(a.Keys) {
+		if _, ok := b.Keys[key]; !ok && strings.HasPrefix(key, baseKey) {
+			diff.Removed = append(diff.Removed, i.hostNameFromKey(key))
+		}
+	}
+	return diff
+}
+
+// Compact discards the history of the whole etcd keyspace older than the
+// last keepRevisions revisions, so GetHostAt and HostHistory can no longer
+// reach it, and returns the revision compacted to. Compaction cannot be
+// undone. The space it frees is only returned to the filesystem by
+// Defragment.
+func (i *Inventory) Compact(ctx context.Context, keepRevisions int64) (int64, error) {
+	if i.client == nil {
+		return 0, errors.New("compaction needs a connection to etcd")
+	}
+	if keepRevisions < 0 {
+		return 0, fmt.Errorf("invalid number of revisions to keep: %d", keepRevisions)
+	}
+	endpoints := i.client.Endpoints()
+	if len(endpoints) == 0 {
+		return 0, errors.New("no etcd endpoints")
+	}
+	status, err := i.client.Status(ctx, endpoints[0])
+	if err != nil {
+		return 0, err
+	}
+	revision := status.Header.Revision - keepRevisions
+	if revision <= 0 {
+		return 0, fmt.Errorf("nothing to compact: the cluster is at revision %d", status.Header.Revision)
+	}
+	// A physical compaction returns once the old revisions are actually
+	// removed from the backend, so a following Defragment reclaims them.
+	if _, err := i.client.Compact(ctx, revision, clientv3.WithCompactPhysical()); err != nil {
+		if errors.Is(err, rpctypes.ErrCompacted) {
+			return 0, fmt.Errorf("%w: %d", ErrRevisionCompacted, revision)
+		}
+		return 0, err
+	}
+	return revision, nil
+}
+
+// DefragmentResult is the outcome of defragmenting one endpoint. The sizes
+// are of its backend database file, and are zero if unknown.
+type DefragmentResult struct {
+	Endpoint   string
+	SizeBefore int64
+	SizeAfter  int64
+	Err        error
+}
+
+// Defragment defragments each etcd endpoint in turn, returning the space
+// freed by compaction to the filesystem. A member blocks reads and writes
+// while it is defragmented, which is why this goes one endpoint at a time.
+func (i *Inventory) Defragment(ctx context.Context) ([]DefragmentResult, error) {
+	if i.client == nil {
+		return nil, errors.New("defragmentation needs a connection to etcd")
+	}
+	var results []DefragmentResult
+	for _, endpoint := range i.client.Endpoints() {
+		result := DefragmentResult{Endpoint: endpoint}
+		if status, err := i.client.Status(ctx, endpoint); err == nil {
+			result.SizeBefore = status.DbSize
+		}
+		if _, result.Err = i.client.Defragment(ctx, endpoint); result.Err == nil {
+			if status, err := i.client.Status(ctx, endpoint); err == nil {
+				result.SizeAfter = status.DbSize
+			}
+		}
+		results = append(results, result)
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,253 @@
+// Package notify delivers the changes to an inventory's hosts to webhooks
+// and message buses, so systems such as a CMDB can follow the inventory.
+// Every change is sent as the JSON of an Event, with the host's data
+// before and after it.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/oferchen/inventory"
+	"github.com/oferchen/inventory/internal/logging"
+	"github.com/segmentio/kafka-go"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// DefaultBackoff is the delay before the first retry of a failed
+// delivery; it doubles per retry.
+const DefaultBackoff = 500 * time.Millisecond
+
+// SignatureHeader carries the HMAC-SHA256 of a webhook body, as
+// "sha256=" and the hex digest, when the Webhook has a Secret.
+const SignatureHeader = "X-Inventory-Signature"
+
+// Event is one change to a host. Operation is "create", "update" or
+// "remove"; Before is null for a create and After is null for a remove.
+// Resync marks the events replayed after etcd compacted the watched
+// revisions (see inventory.WatchHosts), which have no Before.
+type Event struct {
+	Operation string                 `json:"operation"`
+	Host      string                 `json:"host"`
+	Revision  int64                  `json:"revision"`
+	Resync    bool                   `json:"resync,omitempty"`
+	Time      time.Time              `json:"time"`
+	Before    map[string]interface{} `json:"before"`
+	After     map[string]interface{} `json:"after"`
+}
+
+// Sink delivers events somewhere. body is the JSON of event.
+type Sink interface {
+	Send(ctx context.Context, event Event, body []byte) error
+	// String names the sink in log messages.
+	String() string
+	Close() error
+}
+
+// Notifier watches an inventory and sends every change to its Sinks, in
+// revision order. A delivery that still fails after Retries retries is
+// logged and dropped, so one unreachable sink delays the others but never
+// stops them.
+type Notifier struct {
+	Sinks   []Sink
+	Retries int
+	// Backoff is the delay before the first retry, DefaultBackoff if 0.
+	Backoff time.Duration
+	// RevealSecrets sends secret fields in the clear instead of masked
+	// (see inventory.Inventory.MaskSecrets).
+	RevealSecrets bool
+	// Delivered, if set, is called with the revision of each change once
+	// it has been sent, so the caller can resume from it after a restart.
+	// Run stops with its error.
+	Delivered func(revision int64) error
+}
+
+// Run sends the changes from revision rev on (0 for changes from now on)
+// until ctx is done.
+func (n *Notifier) Run(ctx context.Context, inv *inventory.Inventory, rev int64) error {
+	return inv.WatchHostChanges(ctx, rev, func(change inventory.HostEvent) error {
+		event, err := n.event(inv, change)
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("encoding the event for host '%s': %w", event.Host, err)
+		}
+		for _, sink := range n.Sinks {
+			if err := n.send(ctx, inv, sink, event, body); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				logging.Errorf("Failed to notify %s of host '%s' at revision %d after %d attempts: %v", sink, event.Host, event.Revision, n.Retries+1, err)
+			}
+		}
+		if n.Delivered != nil {
+			return n.Delivered(event.Revision)
+		}
+		return nil
+	})
+}
+
+// event converts a watched change.
+func (n *Notifier) event(inv *inventory.Inventory, change inventory.HostEvent) (Event, error) {
+	event := Event{Operation: "update", Host: change.Name, Revision: change.Revision, Resync: change.Resync, Time: time.Now().UTC()}
+	var err error
+	if change.Before != nil {
+		if event.Before, err = n.data(inv, *change.Before); err != nil {
+			return event, err
+		}
+	}
+	switch {
+	case change.Type == mvccpb.DELETE:
+		event.Operation = "remove"
+		return event, nil
+	case change.Before == nil && !change.Resync:
+		event.Operation = "create"
+	}
+	event.After, err = n.data(inv, change.Host)
+	return event, err
+}
+
+// data returns the data of host as sent, with secrets masked unless
+// RevealSecrets.
+func (n *Notifier) data(inv *inventory.Inventory, host inventory.Host) (map[string]interface{}, error) {
+	if !n.RevealSecrets {
+		masked, err := inv.MaskSecrets([]inventory.Host{host})
+		if err != nil {
+			return nil, err
+		}
+		host = masked[0]
+	}
+	return inventory.EncodeBinaryValues(host.Data), nil
+}
+
+// send delivers to sink, retrying with backoff, and logs the retries
+// with inv's Debug.
+func (n *Notifier) send(ctx context.Context, inv *inventory.Inventory, sink Sink, event Event, body []byte) error {
+	backoff := n.Backoff
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		err := sink.Send(ctx, event, body)
+		if err == nil || attempt == n.Retries {
+			return err
+		}
+		if inv.Debug {
+			logging.Debugf("Notifying %s of host '%s' failed, retrying: %v", sink, event.Host, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff << attempt):
+		}
+	}
+}
+
+// Webhook POSTs events to a URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+	// Secret, if set, signs each body in the SignatureHeader, so the
+	// receiver can check that it came from this inventory.
+	Secret []byte
+}
+
+func (w *Webhook) Send(ctx context.Context, event Event, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != nil {
+		req.Header.Set(SignatureHeader, Sign(w.Secret, body))
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+func (w *Webhook) String() string { return w.URL }
+
+func (w *Webhook) Close() error { return nil }
+
+// Sign returns the SignatureHeader value of body for secret.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NATS publishes events to a NATS subject.
+type NATS struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// NewNATS connects to the NATS servers of url, a comma-separated list.
+func NewNATS(url, subject string) (*NATS, error) {
+	conn, err := nats.Connect(url, nats.Name("inventory notify"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to NATS at %s: %w", url, err)
+	}
+	return &NATS{conn: conn, subject: subject}, nil
+}
+
+// Send publishes body and waits for the server to have received it.
+func (s *NATS) Send(ctx context.Context, event Event, body []byte) error {
+	if err := s.conn.Publish(s.subject, body); err != nil {
+		return err
+	}
+	return s.conn.FlushWithContext(ctx)
+}
+
+func (s *NATS) String() string { return "nats subject " + s.subject }
+
+func (s *NATS) Close() error {
+	s.conn.Close()
+	return nil
+}
+
+// Kafka produces events to a Kafka topic, keyed by host name so the
+// changes of a host stay in order on one partition.
+type Kafka struct {
+	writer *kafka.Writer
+}
+
+// NewKafka returns a producer for topic on the given brokers. It only
+// connects on the first Send.
+func NewKafka(brokers []string, topic string) *Kafka {
+	return &Kafka{writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		// The Notifier retries with its own backoff.
+		MaxAttempts: 1,
+	}}
+}
+
+func (s *Kafka) Send(ctx context.Context, event Event, body []byte) error {
+	return s.writer.WriteMessages(ctx, kafka.Message{Key: []byte(event.Host), Value: body})
+}
+
+func (s *Kafka) String() string { return "kafka topic " + s.writer.Topic }
+
+func (s *Kafka) Close() error { return s.writer.Close() }
@@ -0,0 +1,1703 @@
+package inventory
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/oferchen/inventory/internal/logging"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// OutputFormatter interface and formatter types
+
+// OutputFormatter renders hosts to a writer, so one host slice can be sent
+// to several targets in different formats.
+type OutputFormatter interface {
+	Format(w io.Writer, hosts []Host) error
+}
+
+// OutputOptions carries the global output flags down to the formatters.
+type OutputOptions struct {
+	Format    string
+	ColorMode string
+	Highlight *FieldMatch
+	// Transforms run in order on the hosts before they are formatted.
+	Transforms []HostTransform
+	// Wide shows every field in table output instead of Columns.
+	Wide    bool
+	Columns []string
+	// MaxColWidth caps table cells on a terminal; 0 means only the terminal
+	// width limits them. NoTruncate disables truncation altogether.
+	MaxColWidth int
+	NoTruncate  bool
+	// Pretty and Compact set the whitespace of the structured formats
+	// (json, xml, yaml): indented, or as little as the format allows. With
+	// neither, WriteOutput indents only output to a terminal; see Indent.
+	Pretty  bool
+	Compact bool
+	// NoHeader omits the header record of the CSV formats.
+	NoHeader bool
+	// TruncateValues shortens long values in the table and block formats;
+	// the data formats always show values whole.
+	TruncateValues int
+	// Aliases renames fields for display, mapping the stored name to the
+	// shown one. It applies to every format, after Transforms, and to
+	// Columns and Highlight, which keep naming the stored fields.
+	Aliases AliasMap
+	// PostProcess, when set, is a shell command printOutput pipes the
+	// formatted output through, printing what it writes instead. It is
+	// killed after PostProcessTimeout.
+	PostProcess        string
+	PostProcessTimeout time.Duration
+	// AddressField and ServiceField name the fields the consul format
+	// maps to a node's address and service.
+	AddressField string
+	ServiceField string
+	// SDGroupField and SDPort group and complete the targets of the
+	// prometheus format, which also takes its addresses from AddressField.
+	SDGroupField string
+	SDPort       int
+	// TimeFormat renders timestamps in the table and block formats.
+	TimeFormat TimeFormat
+	// Template renders the hosts in the template format; see
+	// ParseOutputTemplate.
+	Template *template.Template
+	// KeepOrder writes the hosts of the json and yaml formats in the order
+	// given instead of sorted by name, for rows ordered by something else,
+	// such as a count.
+	KeepOrder bool
+}
+
+// HostTransform rewrites hosts between listing and formatting, e.g. to
+// redact secrets or add derived fields. It must not modify the hosts passed
+// in; copyHosts gives it a private copy to work on.
+type HostTransform func(hosts []Host) ([]Host, error)
+
+// redactedPlaceholder replaces the value of redacted fields.
+const redactedPlaceholder = "*****"
+
+func copyHosts(hosts []Host) []Host {
+	copied := make([]Host, len(hosts))
+	for i, host := range hosts {
+		data := make(map[string]interface{}, len(host.Data))
+		for key, value := range host.Data {
+			data[key] = value
+		}
+		copied[i] = Host{Name: host.Name, Data: data, Order: host.Order}
+	}
+	return copied
+}
+
+// OnlyFields drops every field but the given ones.
+func OnlyFields(fields []string) HostTransform {
+	return func(hosts []Host) ([]Host, error) {
+		hosts = copyHosts(hosts)
+		keep := make(map[string]bool, len(fields))
+		for _, field := range fields {
+			keep[field] = true
+		}
+		for _, host := range hosts {
+			for field := range host.Data {
+				if !keep[field] {
+					delete(host.Data, field)
+				}
+			}
+		}
+		return hosts, nil
+	}
+}
+
+// RedactFields masks the given fields on every host that has them.
+func RedactFields(fields []string) HostTransform {
+	return func(hosts []Host) ([]Host, error) {
+		hosts = copyHosts(hosts)
+		for _, host := range hosts {
+			for _, field := range fields {
+				if _, ok := host.Data[field]; ok {
+					host.Data[field] = redactedPlaceholder
+				}
+			}
+		}
+		return hosts, nil
+	}
+}
+
+// ComputeField adds field to every host, rendered from a text/template
+// executed against the Host (e.g. "{{.Name}}.{{.Data.dnsdomain}}") with
+// the helpers of the template format (see ParseOutputTemplate).
+func ComputeField(field, text string) (HostTransform, error) {
+	tmpl, err := template.New(field).Option("missingkey=zero").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return func(hosts []Host) ([]Host, error) {
+		hosts = copyHosts(hosts)
+		for _, host := range hosts {
+			var b strings.Builder
+			if err := tmpl.Execute(&b, host); err != nil {
+				return nil, fmt.Errorf("computing %s for host %s: %w", field, host.Name, err)
+			}
+			host.Data[field] = b.String()
+		}
+		return hosts, nil
+	}, nil
+}
+
+// VirtualFields maps field names to text/templates over the Host, as for
+// ComputeField, whose results stand in for stored fields on output (e.g.
+// fqdn: "{{.Name}}.{{.Data.dnsdomain}}").
+type VirtualFields map[string]string
+
+// Transform returns a HostTransform adding every virtual field, in name
+// order, so a template can use the fields before it.
+func (v VirtualFields) Transform() (HostTransform, error) {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	transforms := make([]HostTransform, len(names))
+	for n, name := range names {
+		transform, err := ComputeField(name, v[name])
+		if err != nil {
+			return nil, fmt.Errorf("virtual field %s: %w", name, err)
+		}
+		transforms[n] = transform
+	}
+	return func(hosts []Host) ([]Host, error) {
+		return ApplyTransforms(transforms, hosts)
+	}, nil
+}
+
+// AliasMap maps stored field names to display names, as given to --alias.
+type AliasMap map[string]string
+
+func (m AliasMap) String() string {
+	pairs := make([]string, 0, len(m))
+	for field, alias := range m {
+		pairs = append(pairs, field+"="+alias)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set adds field=alias pairs; several may be given comma-separated.
+func (m AliasMap) Set(value string) error {
+	for _, pair := range SplitList(value) {
+		field, alias, ok := strings.Cut(pair, "=")
+		if !ok || field == "" || alias == "" {
+			return fmt.Errorf("expected field=alias, got %q", pair)
+		}
+		m[field] = alias
+	}
+	return nil
+}
+
+// name returns the display name of field.
+func (m AliasMap) name(field string) string {
+	if alias, ok := m[field]; ok {
+		return alias
+	}
+	return field
+}
+
+// apply renames the aliased fields of copies of hosts.
+func (m AliasMap) Apply(hosts []Host) []Host {
+	renamed := make([]Host, len(hosts))
+	for n, host := range hosts {
+		data := make(map[string]interface{}, len(host.Data))
+		for key, value := range host.Data {
+			data[m.name(key)] = value
+		}
+		var order []string
+		for _, key := range host.Order {
+			order = append(order, m.name(key))
+		}
+		renamed[n] = Host{Name: host.Name, Data: data, Order: order}
+	}
+	return renamed
+}
+
+func ApplyTransforms(transforms []HostTransform, hosts []Host) ([]Host, error) {
+	for _, transform := range transforms {
+		var err error
+		if hosts, err = transform(hosts); err != nil {
+			return nil, err
+		}
+	}
+	return hosts, nil
+}
+
+// SplitList splits a comma-separated flag value, dropping empty items.
+func SplitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// FieldMatch is a field=value predicate, as given to --highlight.
+type FieldMatch struct {
+	Field string
+	Value string
+}
+
+func ParseFieldMatch(s string) (*FieldMatch, error) {
+	field, value, ok := strings.Cut(s, "=")
+	if !ok || field == "" {
+		return nil, fmt.Errorf("expected field=value, got %q", s)
+	}
+	return &FieldMatch{Field: field, Value: value}, nil
+}
+
+func (m *FieldMatch) matches(field, value string) bool {
+	return m != nil && m.Field == field && m.Value == value
+}
+
+const (
+	ansiReset     = "\x1b[0m"
+	ansiHeader    = "\x1b[1;36m"
+	ansiHighlight = "\x1b[1;33m"
+	ansiAdded     = "\x1b[32m"
+	ansiRemoved   = "\x1b[31m"
+)
+
+func ValidateColorMode(mode string) error {
+	switch mode {
+	case "auto", "always", "never":
+		return nil
+	default:
+		return fmt.Errorf("invalid color mode %q (use auto, always or never)", mode)
+	}
+}
+
+// colorEnabled turns a --color mode into a decision for one writer. "auto"
+// enables color only when w is a terminal, so redirected output never
+// carries escape codes.
+func colorEnabled(mode string, w io.Writer) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		return writesToTerminal(w)
+	}
+}
+
+// writesToTerminal reports whether w is a terminal.
+func writesToTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && IsTerminal(f)
+}
+
+func IsTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// terminalWidth returns the width in columns of the terminal w writes to,
+// or 0 when w is not a terminal.
+func terminalWidth(w io.Writer) int {
+	f, ok := w.(*os.File)
+	if !ok || !IsTerminal(f) {
+		return 0
+	}
+	width, _, err := term.GetSize(int(f.Fd()))
+	if err != nil {
+		return 0
+	}
+	return width
+}
+
+func colorize(s, code string, enabled bool) string {
+	if !enabled {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+// FormatValue renders a single Data value as text: strings as-is, everything
+// else as JSON.
+func FormatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	}
+}
+
+// TimeFormat renders Timestamp values (see TypeName) for people in the
+// table, block and describe output. Layout is "rfc3339", "relative" (as in
+// "2h ago") or a Go time layout, and Location the zone to show them in;
+// the zero TimeFormat shows values as stored. The data formats always keep
+// the stored RFC 3339 form.
+type TimeFormat struct {
+	Layout   string
+	Location *time.Location
+}
+
+// Format is FormatValue, with Timestamp values rendered per t.
+func (t TimeFormat) Format(value interface{}) string {
+	s, ok := value.(string)
+	if !ok || (t.Layout == "" && t.Location == nil) {
+		return FormatValue(value)
+	}
+	ts, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return s
+	}
+	if t.Location != nil {
+		ts = ts.In(t.Location)
+	}
+	switch strings.ToLower(t.Layout) {
+	case "", "rfc3339":
+		return ts.Format(time.RFC3339)
+	case "relative":
+		return relativeTime(time.Since(ts))
+	default:
+		return ts.Format(t.Layout)
+	}
+}
+
+// relativeTime renders the age d in its largest whole unit, e.g. "2h ago",
+// or "in 5m" for a time in the future.
+func relativeTime(d time.Duration) string {
+	format := "%s ago"
+	if d < 0 {
+		d, format = -d, "in %s"
+	}
+	var age string
+	switch {
+	case d < time.Minute:
+		age = fmt.Sprintf("%ds", int(d/time.Second))
+	case d < time.Hour:
+		age = fmt.Sprintf("%dm", int(d/time.Minute))
+	case d < 24*time.Hour:
+		age = fmt.Sprintf("%dh", int(d/time.Hour))
+	default:
+		age = fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	}
+	return fmt.Sprintf(format, age)
+}
+
+func dataJSON(data map[string]interface{}) string {
+	b, err := json.Marshal(EncodeBinaryValues(data))
+	if err != nil {
+		logging.Fatalf("Error marshaling host data: %v", err)
+	}
+	return string(b)
+}
+
+// FieldNames returns the sorted union of Data keys across hosts.
+func FieldNames(hosts []Host) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	ordered := false
+	for _, host := range hosts {
+		ordered = ordered || host.Order != nil
+		for _, name := range host.fieldOrder() {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	// With a field order, fields come in the order they are first seen.
+	if !ordered {
+		sort.Strings(names)
+	}
+	return names
+}
+
+// DefaultColumns are the key fields the narrow table shows; see --columns.
+const DefaultColumns = "mode,os,osver,ipaddr,site,location"
+
+// presentFields returns the given fields that at least one host has.
+func presentFields(hosts []Host, fields []string) []string {
+	present := make([]string, 0, len(fields))
+	for _, field := range fields {
+		for _, host := range hosts {
+			if _, ok := host.Data[field]; ok {
+				present = append(present, field)
+				break
+			}
+		}
+	}
+	return present
+}
+
+// TableOutputFormatter renders one row per host with a column per field.
+type TableOutputFormatter struct {
+	Color     bool
+	Highlight *FieldMatch
+	// Columns lists the fields to show after NAME, in order; fields no host
+	// has are left out. Nil shows every field (wide mode).
+	Columns []string
+	// MaxWidth is the line width to fit rows into by ellipsizing the widest
+	// cells, and MaxColWidth caps every column; 0 disables either limit.
+	MaxWidth    int
+	MaxColWidth int
+	// TruncateValues cuts every value to its first line and at most this
+	// many characters; 0 shows values whole.
+	TruncateValues int
+	TimeFormat     TimeFormat
+}
+
+// minColWidth is the narrowest a column is truncated to.
+const minColWidth = 4
+
+// fitWidths shrinks column widths to at most maxCol each and, taking the
+// two-space gutters into account, the widest columns until a row fits in
+// maxLine. Zero limits are ignored.
+func fitWidths(widths []int, maxCol, maxLine int) {
+	for col := range widths {
+		if maxCol > 0 && widths[col] > maxCol {
+			widths[col] = max(maxCol, minColWidth)
+		}
+	}
+	if maxLine <= 0 {
+		return
+	}
+	total := 2 * (len(widths) - 1)
+	for _, width := range widths {
+		total += width
+	}
+	for total > maxLine {
+		widest := 0
+		for col, width := range widths {
+			if width > widths[widest] {
+				widest = col
+			}
+		}
+		if widths[widest] <= minColWidth {
+			return
+		}
+		widths[widest]--
+		total--
+	}
+}
+
+// ellipsize cuts s to width runes, marking the cut with an ellipsis.
+func ellipsize(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+// truncateValue keeps the first line of s and at most n of its characters,
+// followed by an ellipsis if anything was dropped; n <= 0 keeps s whole.
+// Unlike ellipsize it limits how much of a value is shown, not how wide a
+// column is, so the ellipsis comes after the n characters.
+func truncateValue(s string, n int) string {
+	if n <= 0 {
+		return s
+	}
+	cut := false
+	if line, _, found := strings.Cut(s, "\n"); found {
+		s, cut = line, true
+	}
+	if runes := []rune(s); len(runes) > n {
+		s, cut = string(runes[:n]), true
+	}
+	if cut {
+		s += "…"
+	}
+	return s
+}
+
+func (f TableOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	if len(hosts) == 0 {
+		return reportNoHosts()
+	}
+	fields := FieldNames(hosts)
+	if f.Columns != nil {
+		fields = presentFields(hosts, f.Columns)
+	}
+	headers := append([]string{"NAME"}, fields...)
+	rows := make([][]string, 0, len(hosts))
+	for _, host := range hosts {
+		row := []string{host.Name}
+		for _, field := range fields {
+			value, ok := host.Data[field]
+			if !ok {
+				row = append(row, "")
+				continue
+			}
+			row = append(row, truncateValue(f.TimeFormat.Format(value), f.TruncateValues))
+		}
+		rows = append(rows, row)
+	}
+
+	widths := make([]int, len(headers))
+	for col, header := range headers {
+		widths[col] = utf8.RuneCountInString(header)
+	}
+	for _, row := range rows {
+		for col, cell := range row {
+			if n := utf8.RuneCountInString(cell); n > widths[col] {
+				widths[col] = n
+			}
+		}
+	}
+	fitWidths(widths, f.MaxColWidth, f.MaxWidth)
+
+	// Pad before coloring so escape codes don't count towards the width.
+	var b strings.Builder
+	writeRow := func(cells []string, code func(col int, cell string) string) {
+		for col, cell := range cells {
+			cell = ellipsize(cell, widths[col])
+			padded := cell
+			if col < len(cells)-1 {
+				padded += strings.Repeat(" ", widths[col]-utf8.RuneCountInString(cell)+2)
+			}
+			if c := code(col, cell); c != "" {
+				padded = colorize(padded, c, f.Color)
+			}
+			b.WriteString(padded)
+		}
+		b.WriteString("\n")
+	}
+	writeRow(headers, func(int, string) string { return ansiHeader })
+	for _, row := range rows {
+		writeRow(row, func(col int, cell string) string {
+			if col > 0 && f.Highlight.matches(headers[col], cell) {
+				return ansiHighlight
+			}
+			return ""
+		})
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// JSONOutputFormatter writes hosts as a JSON array. The output is
+// deterministic: hosts are sorted by name unless KeepOrder, each host's
+// fields are always "name" then "data", and map keys are sorted at every
+// level (as encoding/json does). Compact puts everything on one line
+// instead of indenting.
+type JSONOutputFormatter struct {
+	Compact   bool
+	KeepOrder bool
+}
+
+func (f JSONOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	sorted := make([]Host, len(hosts))
+	copy(sorted, hosts)
+	if !f.KeepOrder {
+		sort.SliceStable(sorted, func(a, b int) bool { return sorted[a].Name < sorted[b].Name })
+	}
+	var b []byte
+	var err error
+	if f.Compact {
+		b, err = json.Marshal(sorted)
+	} else {
+		b, err = json.MarshalIndent(sorted, "", "    ")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// FormatPage writes the hosts of a page as elements of the array, sorted
+// by name within the page unless KeepOrder; listings come in name order
+// anyway.
+func (f JSONOutputFormatter) FormatPage(w io.Writer, hosts []Host, first bool) error {
+	sorted := make([]Host, len(hosts))
+	copy(sorted, hosts)
+	if !f.KeepOrder {
+		sort.SliceStable(sorted, func(a, b int) bool { return sorted[a].Name < sorted[b].Name })
+	}
+	var b bytes.Buffer
+	for n, host := range sorted {
+		if first && n == 0 {
+			b.WriteByte('[')
+		} else {
+			b.WriteByte(',')
+		}
+		var element []byte
+		var err error
+		if f.Compact {
+			element, err = json.Marshal(host)
+		} else {
+			b.WriteString("\n    ")
+			element, err = json.MarshalIndent(host, "    ", "    ")
+		}
+		if err != nil {
+			return err
+		}
+		b.Write(element)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// FinishPages closes the array.
+func (f JSONOutputFormatter) FinishPages(w io.Writer) error {
+	end := "\n]\n"
+	if f.Compact {
+		end = "]\n"
+	}
+	_, err := io.WriteString(w, end)
+	return err
+}
+
+// xmlHosts is the document root written by XMLOutputFormatter.
+type xmlHosts struct {
+	XMLName xml.Name `xml:"hosts"`
+	Hosts   []Host   `xml:"host"`
+}
+
+// xmlField is one Data entry in XML form; Type is the TypeName of the
+// value, which tells UnmarshalXML how to decode the text back.
+type xmlField struct {
+	Name  string `xml:"name,attr"`
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// MarshalXML writes a host as <host name="..."> with one
+// <field name="..." type="...">value</field> per Data entry, since
+// encoding/xml cannot represent maps.
+func (h Host) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "name"}, Value: h.Name})
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, key := range h.fieldOrder() {
+		field, err := newXMLField(key, h.Data[key])
+		if err != nil {
+			return err
+		}
+		if err := e.EncodeElement(field, xml.StartElement{Name: xml.Name{Local: "field"}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// UnmarshalXML is the inverse of MarshalXML.
+func (h *Host) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var doc struct {
+		Name   string     `xml:"name,attr"`
+		Fields []xmlField `xml:"field"`
+	}
+	if err := d.DecodeElement(&doc, &start); err != nil {
+		return err
+	}
+	h.Name = doc.Name
+	h.Data = make(map[string]interface{}, len(doc.Fields))
+	for _, field := range doc.Fields {
+		value, err := field.decode()
+		if err != nil {
+			return fmt.Errorf("host %s field %s: %w", doc.Name, field.Name, err)
+		}
+		h.Data[field.Name] = value
+	}
+	return nil
+}
+
+func newXMLField(name string, value interface{}) (xmlField, error) {
+	field := xmlField{Name: name, Type: TypeName(value)}
+	switch v := value.(type) {
+	case nil:
+	case string:
+		field.Value = v
+	case bool:
+		field.Value = strconv.FormatBool(v)
+	case float64:
+		field.Value = strconv.FormatFloat(v, 'g', -1, 64)
+	case []byte:
+		field.Value = base64.StdEncoding.EncodeToString(v)
+	default:
+		b, err := json.Marshal(encodeBinaryValue(v))
+		if err != nil {
+			return xmlField{}, err
+		}
+		field.Value = string(b)
+	}
+	return field, nil
+}
+
+func (f xmlField) decode() (interface{}, error) {
+	switch f.Type {
+	case "Null":
+		return nil, nil
+	case "String", "IPAddress", "CIDR", "Timestamp":
+		return f.Value, nil
+	case "Boolean":
+		return strconv.ParseBool(f.Value)
+	case "Number":
+		return strconv.ParseFloat(f.Value, 64)
+	case "Binary":
+		return base64.StdEncoding.DecodeString(f.Value)
+	case "JSON", "Array":
+		var value interface{}
+		if err := json.Unmarshal([]byte(f.Value), &value); err != nil {
+			return nil, err
+		}
+		return decodeBinaryValue(value), nil
+	default:
+		return nil, fmt.Errorf("unknown field type %q", f.Type)
+	}
+}
+
+// XMLOutputFormatter writes hosts as a <hosts> document. Compact leaves
+// out the indentation and the newlines between elements.
+type XMLOutputFormatter struct {
+	Compact bool
+}
+
+func (f XMLOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	output := xmlHosts{Hosts: hosts}
+	var b []byte
+	var err error
+	if f.Compact {
+		b, err = xml.Marshal(output)
+	} else {
+		b, err = xml.MarshalIndent(output, "", "    ")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, xml.Header+string(b))
+	return err
+}
+
+// YAMLOutputFormatter prints the hosts as a YAML sequence sorted by name
+// unless KeepOrder, with binary values encoded as in the JSON output and
+// fields in fieldOrder. Compact writes it in flow style, as one line.
+type YAMLOutputFormatter struct {
+	Compact   bool
+	KeepOrder bool
+}
+
+func (f YAMLOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	type yamlHost struct {
+		Name string     `yaml:"name"`
+		Data *yaml.Node `yaml:"data"`
+	}
+	sorted := make([]yamlHost, len(hosts))
+	for n, host := range hosts {
+		sorted[n].Name = host.Name
+		if host.Data == nil {
+			continue
+		}
+		data := EncodeBinaryValues(host.Data)
+		sorted[n].Data = &yaml.Node{Kind: yaml.MappingNode}
+		for _, key := range host.fieldOrder() {
+			var value yaml.Node
+			if err := value.Encode(data[key]); err != nil {
+				return err
+			}
+			sorted[n].Data.Content = append(sorted[n].Data.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, &value)
+		}
+	}
+	if !f.KeepOrder {
+		sort.SliceStable(sorted, func(a, b int) bool { return sorted[a].Name < sorted[b].Name })
+	}
+	var doc yaml.Node
+	if err := doc.Encode(sorted); err != nil {
+		return err
+	}
+	if f.Compact {
+		// Flow style on the outermost collection carries into all of it.
+		doc.Style = yaml.FlowStyle
+	}
+	b, err := yaml.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// writeCSV renders records with encoding/csv, optionally with CRLF line
+// endings.
+func writeCSV(w io.Writer, records [][]string, crlf bool) error {
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = crlf
+	return cw.WriteAll(records)
+}
+
+// reportNoHosts tells the user an empty result was not an error. The
+// human-oriented formats print it to stderr instead of an empty table, so
+// stdout stays empty for scripts; the machine formats write an empty
+// document ([] or a bare CSV header) instead.
+func reportNoHosts() error {
+	_, err := fmt.Fprintln(os.Stderr, "No hosts found")
+	return err
+}
+
+// csvRecords returns the header, unless noHeader, followed by one record
+// per host from row.
+func csvRecords(header []string, noHeader bool, hosts []Host, row func(Host) []string) [][]string {
+	records := make([][]string, 0, len(hosts)+1)
+	if !noHeader {
+		records = append(records, header)
+	}
+	for _, host := range hosts {
+		records = append(records, row(host))
+	}
+	return records
+}
+
+type CSVOutputFormatter struct {
+	NoHeader bool
+}
+
+func (f CSVOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	records := csvRecords([]string{"Host Name", "Host Data"}, f.NoHeader, hosts, func(host Host) []string {
+		return []string{host.Name, dataJSON(host.Data)}
+	})
+	return writeCSV(w, records, false)
+}
+
+// FormatPage writes the header only before the first page.
+func (f CSVOutputFormatter) FormatPage(w io.Writer, hosts []Host, first bool) error {
+	return CSVOutputFormatter{NoHeader: f.NoHeader || !first}.Format(w, hosts)
+}
+
+func (CSVOutputFormatter) FinishPages(io.Writer) error { return nil }
+
+// BlockOutputFormatter prints each host as an indented block of fields.
+type BlockOutputFormatter struct {
+	Color     bool
+	Highlight *FieldMatch
+	// TruncateValues shortens values as in TableOutputFormatter.
+	TruncateValues int
+	TimeFormat     TimeFormat
+}
+
+func (f BlockOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	if len(hosts) == 0 {
+		return reportNoHosts()
+	}
+	var b strings.Builder
+	for _, host := range hosts {
+		b.WriteString(colorize("Host: "+host.Name, ansiHeader, f.Color))
+		b.WriteString("\n")
+		for _, key := range host.fieldOrder() {
+			value := FormatValue(host.Data[key])
+			line := fmt.Sprintf("  %s: %s", key, truncateValue(f.TimeFormat.Format(host.Data[key]), f.TruncateValues))
+			b.WriteString(colorize(line, ansiHighlight, f.Color && f.Highlight.matches(key, value)))
+			b.WriteString("\n")
+		}
+		b.WriteString(strings.Repeat("-", 20))
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// FormatPage writes a page of hosts as Format does; the hosts are
+// independent of each other.
+func (f BlockOutputFormatter) FormatPage(w io.Writer, hosts []Host, _ bool) error {
+	return f.Format(w, hosts)
+}
+
+func (BlockOutputFormatter) FinishPages(io.Writer) error { return nil }
+
+// RFC4180CsvOutputFormatter is CSVOutputFormatter with CRLF line endings.
+type RFC4180CsvOutputFormatter struct {
+	NoHeader bool
+}
+
+func (f RFC4180CsvOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	records := csvRecords([]string{"Host Name", "Host Data"}, f.NoHeader, hosts, func(host Host) []string {
+		return []string{host.Name, dataJSON(host.Data)}
+	})
+	return writeCSV(w, records, true)
+}
+
+func (f RFC4180CsvOutputFormatter) FormatPage(w io.Writer, hosts []Host, first bool) error {
+	return RFC4180CsvOutputFormatter{NoHeader: f.NoHeader || !first}.Format(w, hosts)
+}
+
+func (RFC4180CsvOutputFormatter) FinishPages(io.Writer) error { return nil }
+
+type TypedCsvOutputFormatter struct {
+	NoHeader bool
+}
+
+func (f TypedCsvOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	records := csvRecords([]string{"Host Name", "Host Data Type", "Host Data"}, f.NoHeader, hosts, func(host Host) []string {
+		return []string{host.Name, TypeName(host.Data), dataJSON(host.Data)}
+	})
+	return writeCSV(w, records, false)
+}
+
+func (f TypedCsvOutputFormatter) FormatPage(w io.Writer, hosts []Host, first bool) error {
+	return TypedCsvOutputFormatter{NoHeader: f.NoHeader || !first}.Format(w, hosts)
+}
+
+func (TypedCsvOutputFormatter) FinishPages(io.Writer) error { return nil }
+
+// ScriptOutputFormatter prints headerless, unquoted name,data lines.
+type ScriptOutputFormatter struct{}
+
+func (ScriptOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	for _, host := range hosts {
+		if _, err := fmt.Fprintln(w, host.Name+","+dataJSON(host.Data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f ScriptOutputFormatter) FormatPage(w io.Writer, hosts []Host, _ bool) error {
+	return f.Format(w, hosts)
+}
+
+func (ScriptOutputFormatter) FinishPages(io.Writer) error { return nil }
+
+// EnvOutputFormatter prints shell assignments meant to be eval'd, e.g.
+// eval "$(inventory --output env get web01)": NAME for the host name, then
+// one upper-cased, sanitized variable per field. Values are single-quoted;
+// objects and arrays are JSON-encoded. Unlike ScriptOutputFormatter, which
+// emits one unquoted name,JSON line per host for line-oriented parsing, this
+// is safe to evaluate but only useful for a single host, as every host
+// assigns the same variables.
+type EnvOutputFormatter struct{}
+
+func (EnvOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	for _, host := range hosts {
+		if _, err := fmt.Fprintf(w, "NAME=%s\n", shellQuote(host.Name)); err != nil {
+			return err
+		}
+		for _, field := range FieldNames([]Host{host}) {
+			line := envName(field) + "=" + shellQuote(FormatValue(host.Data[field]))
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f EnvOutputFormatter) FormatPage(w io.Writer, hosts []Host, _ bool) error {
+	return f.Format(w, hosts)
+}
+
+func (EnvOutputFormatter) FinishPages(io.Writer) error { return nil }
+
+// envName turns a field name into a shell variable name: upper case, with
+// every character other than letters, digits and "_" replaced by "_", and a
+// leading "_" added if it would start with a digit.
+func envName(field string) string {
+	name := []rune(strings.ToUpper(field))
+	for i, r := range name {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || (name[0] >= '0' && name[0] <= '9') {
+		return "_" + string(name)
+	}
+	return string(name)
+}
+
+// shellQuote single-quotes s for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ConsulOutputFormatter prints the hosts as a JSON array of Consul catalog
+// registrations, the payload of PUT /v1/catalog/register: the host name is
+// the Node, AddressField its Address, and ServiceField, if the host has
+// it, a Service carrying the host's tags. Consul meta values are strings,
+// so every other field becomes a formatted NodeMeta entry.
+type ConsulOutputFormatter struct {
+	AddressField string
+	ServiceField string
+}
+
+type consulService struct {
+	Service string
+	Tags    []string `json:",omitempty"`
+}
+
+type consulRegistration struct {
+	Node     string
+	Address  string
+	NodeMeta map[string]string `json:",omitempty"`
+	Service  *consulService    `json:",omitempty"`
+}
+
+func (f ConsulOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	registrations := make([]consulRegistration, len(hosts))
+	for n, host := range hosts {
+		reg := consulRegistration{Node: host.Name}
+		if address, ok := host.Data[f.AddressField]; ok {
+			reg.Address = FormatValue(address)
+		}
+		if service, ok := host.Data[f.ServiceField]; ok {
+			reg.Service = &consulService{Service: FormatValue(service), Tags: HostTags(host)}
+		}
+		for key, value := range host.Data {
+			if key == f.AddressField || key == f.ServiceField || (key == tagsField && reg.Service != nil) {
+				continue
+			}
+			if reg.NodeMeta == nil {
+				reg.NodeMeta = make(map[string]string)
+			}
+			reg.NodeMeta[key] = FormatValue(value)
+		}
+		registrations[n] = reg
+	}
+	b, err := json.MarshalIndent(registrations, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// PrometheusOutputFormatter prints the hosts as the target groups of
+// Prometheus file_sd and http_sd service discovery. A host's target is its
+// AddressField, or its name without one, with TargetPort appended unless
+// the address has a port; its fields and its name become labels (see
+// PrometheusLabelName). Without GroupField every host is a group of its
+// own; with it, hosts with the same value of that field share a group,
+// which keeps only the labels all of them agree on.
+type PrometheusOutputFormatter struct {
+	AddressField string
+	GroupField   string
+	TargetPort   int
+	Compact      bool
+}
+
+// prometheusTargetGroup is one entry of a file_sd or http_sd document.
+type prometheusTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+func (f PrometheusOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	groups := make([]prometheusTargetGroup, 0, len(hosts))
+	byValue := make(map[string]int)
+	for _, host := range hosts {
+		target := host.Name
+		if address, ok := host.Data[f.AddressField]; ok && FormatValue(address) != "" {
+			target = FormatValue(address)
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil && f.TargetPort > 0 {
+			target = net.JoinHostPort(target, strconv.Itoa(f.TargetPort))
+		}
+		labels := prometheusLabels(host)
+		if f.GroupField == "" {
+			groups = append(groups, prometheusTargetGroup{Targets: []string{target}, Labels: labels})
+			continue
+		}
+		value := FormatValue(host.Data[f.GroupField])
+		n, ok := byValue[value]
+		if !ok {
+			byValue[value] = len(groups)
+			groups = append(groups, prometheusTargetGroup{Targets: []string{target}, Labels: labels})
+			continue
+		}
+		group := &groups[n]
+		group.Targets = append(group.Targets, target)
+		for name, value := range group.Labels {
+			if labels[name] != value {
+				delete(group.Labels, name)
+			}
+		}
+	}
+	var b []byte
+	var err error
+	if f.Compact {
+		b, err = json.Marshal(groups)
+	} else {
+		b, err = json.MarshalIndent(groups, "", "    ")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// prometheusLabels returns the labels of a host's target: its fields, and
+// its name as "name" unless a field takes that label. Labels starting with
+// "__" are reserved by Prometheus and left out.
+func prometheusLabels(host Host) map[string]string {
+	labels := map[string]string{"name": host.Name}
+	for field, value := range host.Data {
+		if name := PrometheusLabelName(field); !strings.HasPrefix(name, "__") {
+			labels[name] = FormatValue(value)
+		}
+	}
+	return labels
+}
+
+// PrometheusLabelName turns a field name into a valid Prometheus label
+// name by replacing the characters labels cannot have with underscores.
+func PrometheusLabelName(field string) string {
+	b := []byte(field)
+	for n, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || n > 0 && c >= '0' && c <= '9') {
+			b[n] = '_'
+		}
+	}
+	return string(b)
+}
+
+// TemplateOutputFormatter renders the hosts through a text/template,
+// executed once with the []Host, so it ranges over them itself (e.g.
+// "{{range .}}{{.Data.ipaddr}} {{.Name}}\n{{end}}" for /etc/hosts).
+type TemplateOutputFormatter struct {
+	Template *template.Template
+}
+
+func (f TemplateOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	if f.Template == nil {
+		return errors.New("the template format needs a template")
+	}
+	return f.Template.Execute(w, hosts)
+}
+
+// ParseOutputTemplate parses text as an output template named name, with
+// the helper functions of templateFuncs.
+func ParseOutputTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=zero").Funcs(templateFuncs).Parse(text)
+}
+
+// templateFuncs are the helpers of output templates and computed fields:
+//
+//	join SEP LIST     the elements of an array (or a comma-separated string) joined by SEP
+//	lookup PATH HOST  the value at a nested field path of a host or object, or nil
+//	default DEF VALUE VALUE, or DEF if VALUE is empty (see IsEmptyValue)
+//	toJSON VALUE      VALUE as compact JSON
+var templateFuncs = template.FuncMap{
+	"join": func(sep string, value interface{}) string {
+		switch v := value.(type) {
+		case nil:
+			return ""
+		case []interface{}:
+			items := make([]string, len(v))
+			for n, item := range v {
+				items[n] = FormatValue(item)
+			}
+			return strings.Join(items, sep)
+		case []string:
+			return strings.Join(v, sep)
+		case string:
+			return strings.Join(SplitList(v), sep)
+		default:
+			return FormatValue(v)
+		}
+	},
+	"lookup": func(path string, value interface{}) (interface{}, error) {
+		segments, err := parseFieldPath(path)
+		if err != nil {
+			return nil, err
+		}
+		var data map[string]interface{}
+		switch v := value.(type) {
+		case Host:
+			data = v.Data
+		case *Host:
+			data = v.Data
+		case map[string]interface{}:
+			data = v
+		default:
+			return nil, nil
+		}
+		found, _ := lookupFieldPath(data, segments)
+		return found, nil
+	},
+	"default": func(def, value interface{}) interface{} {
+		if IsEmptyValue(value) {
+			return def
+		}
+		return value
+	},
+	"toJSON": func(value interface{}) (string, error) {
+		b, err := json.Marshal(value)
+		return string(b), err
+	},
+}
+
+// AnsibleGroupsField is the field listing the Ansible groups a host is a
+// member of, as an array or a comma-separated string.
+const AnsibleGroupsField = "groups"
+
+// ansibleGroup is a group of an Ansible dynamic inventory.
+type ansibleGroup struct {
+	Hosts    []string `json:"hosts,omitempty"`
+	Children []string `json:"children,omitempty"`
+}
+
+// AnsibleOutputFormatter prints the hosts as the JSON an Ansible dynamic
+// inventory script returns for --list: one group per name found in the
+// AnsibleGroupsField of the hosts, "ungrouped" for the hosts without any,
+// "all" as the parent of every group, and each host's data as its
+// variables under _meta.hostvars, so Ansible needs no --host call.
+// Compact puts everything on one line.
+type AnsibleOutputFormatter struct {
+	Compact bool
+}
+
+func (f AnsibleOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	hostvars := make(map[string]interface{}, len(hosts))
+	groups := make(map[string]*ansibleGroup)
+	var ungrouped []string
+	for _, host := range hosts {
+		hostvars[host.Name] = AnsibleHostVars(host)
+		grouped := false
+		for _, name := range listField(host, AnsibleGroupsField) {
+			// Ansible defines these two itself.
+			if name == "all" || name == "ungrouped" {
+				continue
+			}
+			grouped = true
+			if groups[name] == nil {
+				groups[name] = &ansibleGroup{}
+			}
+			groups[name].Hosts = append(groups[name].Hosts, host.Name)
+		}
+		if !grouped {
+			ungrouped = append(ungrouped, host.Name)
+		}
+	}
+	doc := map[string]interface{}{"_meta": map[string]interface{}{"hostvars": hostvars}}
+	all := &ansibleGroup{Children: []string{}}
+	for name, group := range groups {
+		sort.Strings(group.Hosts)
+		doc[name] = group
+		all.Children = append(all.Children, name)
+	}
+	if len(ungrouped) > 0 {
+		sort.Strings(ungrouped)
+		doc["ungrouped"] = &ansibleGroup{Hosts: ungrouped}
+		all.Children = append(all.Children, "ungrouped")
+	}
+	sort.Strings(all.Children)
+	doc["all"] = all
+	var b []byte
+	var err error
+	if f.Compact {
+		b, err = json.Marshal(doc)
+	} else {
+		b, err = json.MarshalIndent(doc, "", "    ")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// AnsibleHostVars returns the variables of host in an Ansible inventory:
+// its data, with binary values encoded as in the JSON output.
+func AnsibleHostVars(host Host) map[string]interface{} {
+	vars := EncodeBinaryValues(host.Data)
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	return vars
+}
+
+// terraformVariable names the map of hosts, keyed by host name, in
+// Terraform output.
+const terraformVariable = "hosts"
+
+// TerraformOutputFormatter prints the hosts for Terraform to consume: by
+// default a .tfvars.json document, {"hosts": {"<name>": {<data>}}}, or with
+// HCL a locals block assigning the same map to local.hosts. Field types
+// are kept, and binary values are encoded as in the JSON output.
+type TerraformOutputFormatter struct {
+	HCL bool
+}
+
+func (f TerraformOutputFormatter) Format(w io.Writer, hosts []Host) error {
+	byName := make(map[string]interface{}, len(hosts))
+	for _, host := range hosts {
+		data := EncodeBinaryValues(host.Data)
+		if data == nil {
+			data = map[string]interface{}{}
+		}
+		byName[host.Name] = data
+	}
+	if !f.HCL {
+		b, err := json.MarshalIndent(map[string]interface{}{terraformVariable: byName}, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+	// A JSON round trip reduces the data to maps, slices and json.Number,
+	// so writeHCLValue needs no case for the other numeric types hosts
+	// may hold.
+	b, err := json.Marshal(byName)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+	var out strings.Builder
+	out.WriteString("locals {\n  " + terraformVariable + " = ")
+	writeHCLValue(&out, value, "  ")
+	out.WriteString("\n}\n")
+	_, err = io.WriteString(w, out.String())
+	return err
+}
+
+// writeHCLValue writes value as an HCL expression, with maps and lists
+// spread over lines indented one level past indent. Object keys are
+// sorted and always quoted, so any field name is valid.
+func writeHCLValue(b *strings.Builder, value interface{}, indent string) {
+	switch v := value.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		b.WriteString(v.String())
+	case string:
+		b.WriteString(hclQuote(v))
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString("[]")
+			return
+		}
+		b.WriteString("[\n")
+		for _, elem := range v {
+			b.WriteString(indent + "  ")
+			writeHCLValue(b, elem, indent+"  ")
+			b.WriteString(",\n")
+		}
+		b.WriteString(indent + "]")
+	case map[string]interface{}:
+		if len(v) == 0 {
+			b.WriteString("{}")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteString("{\n")
+		for _, key := range keys {
+			b.WriteString(indent + "  " + hclQuote(key) + " = ")
+			writeHCLValue(b, v[key], indent+"  ")
+			b.WriteString("\n")
+		}
+		b.WriteString(indent + "}")
+	}
+}
+
+// hclQuote quotes s as an HCL string literal. JSON escaping covers HCL's
+// escapes; "${" and "%{" are doubled so they are not read as templates.
+func hclQuote(s string) string {
+	b, _ := json.Marshal(s)
+	quoted := strings.ReplaceAll(string(b), "${", "$${")
+	return strings.ReplaceAll(quoted, "%{", "%%{")
+}
+
+func WriteOutput(w io.Writer, output OutputOptions, hosts []Host) error {
+	output, formatter, err := prepareOutput(w, output)
+	if err != nil {
+		return err
+	}
+	if hosts, err = output.transform(hosts); err != nil {
+		return err
+	}
+	return formatter.Format(w, hosts)
+}
+
+// prepareOutput settles the options of output written to w and builds its
+// formatter.
+func prepareOutput(w io.Writer, output OutputOptions) (OutputOptions, OutputFormatter, error) {
+	// Settle the whitespace once, so the formatters only read Compact.
+	output.Compact = !output.Indent(writesToTerminal(w))
+	if len(output.Aliases) > 0 {
+		columns := make([]string, len(output.Columns))
+		for n, column := range output.Columns {
+			columns[n] = output.Aliases.name(column)
+		}
+		output.Columns = columns
+		if output.Highlight != nil {
+			output.Highlight = &FieldMatch{Field: output.Aliases.name(output.Highlight.Field), Value: output.Highlight.Value}
+		}
+	}
+	formatter, err := newFormatter(output, colorEnabled(output.ColorMode, w), terminalWidth(w))
+	return output, formatter, err
+}
+
+// transform runs the Transforms and Aliases of output on hosts.
+func (o OutputOptions) transform(hosts []Host) ([]Host, error) {
+	hosts, err := ApplyTransforms(o.Transforms, hosts)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.Aliases) > 0 {
+		hosts = o.Aliases.Apply(hosts)
+	}
+	return hosts, nil
+}
+
+// PageFormatter is an OutputFormatter that can also render a listing a
+// page at a time, as OutputStream does. Formatting every page and then
+// finishing writes the same as Format does with all the hosts.
+type PageFormatter interface {
+	OutputFormatter
+	// FormatPage renders a page of hosts; first tells whether it is the
+	// first page, as headers are written only once.
+	FormatPage(w io.Writer, hosts []Host, first bool) error
+	// FinishPages ends the output after the last page. It is only called
+	// if a page was written; otherwise Format is called with no hosts.
+	FinishPages(w io.Writer) error
+}
+
+// OutputStream writes hosts as they are listed, a page at a time, with the
+// formatter of an output format. Formats that need every host at once,
+// such as table with its column widths, are not PageFormatters: their
+// pages are kept and formatted together on Close.
+type OutputStream struct {
+	w         io.Writer
+	output    OutputOptions
+	formatter OutputFormatter
+	written   bool
+	held      []Host
+}
+
+// NewOutputStream starts output to w with the options of WriteOutput.
+func NewOutputStream(w io.Writer, output OutputOptions) (*OutputStream, error) {
+	output, formatter, err := prepareOutput(w, output)
+	if err != nil {
+		return nil, err
+	}
+	return &OutputStream{w: w, output: output, formatter: formatter}, nil
+}
+
+// Write renders a page of hosts, or holds it until Close if the format
+// cannot be written a page at a time.
+func (s *OutputStream) Write(hosts []Host) error {
+	hosts, err := s.output.transform(hosts)
+	if err != nil {
+		return err
+	}
+	pages, ok := s.formatter.(PageFormatter)
+	if !ok {
+		s.held = append(s.held, hosts...)
+		return nil
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+	first := !s.written
+	s.written = true
+	return pages.FormatPage(s.w, hosts, first)
+}
+
+// Close ends the output, writing the held hosts of a format that needs
+// them all, or what the format writes for no hosts if nothing was written.
+func (s *OutputStream) Close() error {
+	if s.written {
+		return s.formatter.(PageFormatter).FinishPages(s.w)
+	}
+	return s.formatter.Format(s.w, s.held)
+}
+
+// Indent reports whether the structured formats indent their output when
+// writing to a terminal or not: as Pretty or Compact ask, and by default
+// only for a terminal, so piped output is as small as it can be.
+func (o OutputOptions) Indent(terminal bool) bool {
+	switch {
+	case o.Compact:
+		return false
+	case o.Pretty:
+		return true
+	}
+	return terminal
+}
+
+// FormatterBuilder builds the formatter of an output format from the
+// output options, whether to color the output and the terminal width (0
+// when not writing to a terminal). Table cells are only truncated on a
+// terminal, so piped output stays complete.
+type FormatterBuilder func(output OutputOptions, color bool, termWidth int) OutputFormatter
+
+// formatters is the registry of output formats; see RegisterFormat.
+var formatters = map[string]FormatterBuilder{
+	"table": func(output OutputOptions, color bool, termWidth int) OutputFormatter {
+		table := TableOutputFormatter{Color: color, Highlight: output.Highlight, TruncateValues: output.TruncateValues, TimeFormat: output.TimeFormat}
+		if !output.Wide {
+			table.Columns = output.Columns
+		}
+		if termWidth > 0 && !output.NoTruncate {
+			table.MaxWidth = termWidth
+			table.MaxColWidth = output.MaxColWidth
+		}
+		return table
+	},
+	"json": func(output OutputOptions, _ bool, _ int) OutputFormatter {
+		return JSONOutputFormatter{Compact: output.Compact, KeepOrder: output.KeepOrder}
+	},
+	"xml": func(output OutputOptions, _ bool, _ int) OutputFormatter {
+		return XMLOutputFormatter{Compact: output.Compact}
+	},
+	"yaml": func(output OutputOptions, _ bool, _ int) OutputFormatter {
+		return YAMLOutputFormatter{Compact: output.Compact, KeepOrder: output.KeepOrder}
+	},
+	"csv": func(output OutputOptions, _ bool, _ int) OutputFormatter {
+		return CSVOutputFormatter{NoHeader: output.NoHeader}
+	},
+	"block": func(output OutputOptions, color bool, _ int) OutputFormatter {
+		return BlockOutputFormatter{Color: color, Highlight: output.Highlight, TruncateValues: output.TruncateValues, TimeFormat: output.TimeFormat}
+	},
+	"rfc4180-csv": func(output OutputOptions, _ bool, _ int) OutputFormatter {
+		return RFC4180CsvOutputFormatter{NoHeader: output.NoHeader}
+	},
+	"typed-csv": func(output OutputOptions, _ bool, _ int) OutputFormatter {
+		return TypedCsvOutputFormatter{NoHeader: output.NoHeader}
+	},
+	"script": func(OutputOptions, bool, int) OutputFormatter {
+		return ScriptOutputFormatter{}
+	},
+	"env": func(OutputOptions, bool, int) OutputFormatter {
+		return EnvOutputFormatter{}
+	},
+	"terraform": func(OutputOptions, bool, int) OutputFormatter {
+		return TerraformOutputFormatter{}
+	},
+	"terraform-hcl": func(OutputOptions, bool, int) OutputFormatter {
+		return TerraformOutputFormatter{HCL: true}
+	},
+	"ansible": func(output OutputOptions, _ bool, _ int) OutputFormatter {
+		return AnsibleOutputFormatter{Compact: output.Compact}
+	},
+	"consul": func(output OutputOptions, _ bool, _ int) OutputFormatter {
+		return ConsulOutputFormatter{AddressField: output.AddressField, ServiceField: output.ServiceField}
+	},
+	"prometheus": func(output OutputOptions, _ bool, _ int) OutputFormatter {
+		return PrometheusOutputFormatter{AddressField: output.AddressField, GroupField: output.SDGroupField, TargetPort: output.SDPort, Compact: output.Compact}
+	},
+	"template": func(output OutputOptions, _ bool, _ int) OutputFormatter {
+		return TemplateOutputFormatter{Template: output.Template}
+	},
+}
+
+// RegisterFormat adds an output format, so programs embedding the
+// inventory can offer formats of their own. It panics if name is already
+// registered, as that is a programming error.
+func RegisterFormat(name string, build FormatterBuilder) {
+	if _, ok := formatters[name]; ok {
+		panic(fmt.Sprintf("output format %q registered twice", name))
+	}
+	formatters[name] = build
+}
+
+// FormatNames returns the names of the output formats, sorted.
+func FormatNames() []string {
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateFormat checks that format is a known output format, so a typo is
+// reported before any work is done rather than when the output is written.
+func ValidateFormat(format string) error {
+	if _, ok := formatters[format]; ok {
+		return nil
+	}
+	return UnknownChoiceError("output format", format, FormatNames())
+}
+
+// UnknownChoiceError reports that value is not one of the valid choices of
+// what, listing them and suggesting the closest (see ClosestMatch).
+func UnknownChoiceError(what, value string, valid []string) error {
+	if match := ClosestMatch(value, valid); match != "" {
+		return fmt.Errorf("unknown %s %q (did you mean %q?); valid: %s", what, value, match, strings.Join(valid, ", "))
+	}
+	return fmt.Errorf("unknown %s %q; valid: %s", what, value, strings.Join(valid, ", "))
+}
+
+// ClosestMatch returns the option closest to s by edit distance, or "" if
+// even that one is too far off to be a likely typo of it. Ties go to an
+// option starting with the same letter, as typos rarely hit the first one.
+func ClosestMatch(s string, options []string) string {
+	s = strings.ToLower(s)
+	best, bestDistance := "", 0
+	for _, option := range options {
+		d := editDistance(s, option)
+		sameStart := s != "" && option != "" && s[0] == option[0]
+		if best == "" || d < bestDistance || d == bestDistance && sameStart && best[0] != s[0] {
+			best, bestDistance = option, d
+		}
+	}
+	if best == "" || bestDistance > max(2, len(s)/3) {
+		return ""
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// newFormatter builds the formatter for output.Format from the registry.
+func newFormatter(output OutputOptions, color bool, termWidth int) (OutputFormatter, error) {
+	build, ok := formatters[output.Format]
+	if !ok {
+		return nil, ValidateFormat(output.Format)
+	}
+	return build(output, color, termWidth), nil
+}
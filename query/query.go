@@ -0,0 +1,562 @@
+// Package query parses and evaluates the boolean expressions accepted by
+// inventory's --where flag, such as
+//
+//	role == "web" && (env == "prod" || env == "stage") && !maintenance
+//
+// Operands are field paths (network.interfaces[0].ip), string literals in
+// double or single quotes, numbers, true, false and null. Operators, from
+// lowest to highest precedence, are ||, &&, the prefix !, and the
+// comparisons ==, !=, <, <=, >, >=, contains, matches and its shorthands =~
+// and !~ (does not match). A bare field is true unless it is missing, null,
+// false, "" or 0.
+//
+// Comparisons are type-aware: values are classified the way inventory's
+// getTypeName does (Number, String, Boolean, Null, Array, JSON), and values
+// of different types are never equal or ordered, so a stored "4" does not
+// equal 4. Ordering applies to numbers and strings. "contains" tests for a
+// substring of a string, an element of an array or a key of an object;
+// "matches" tests a string against an RE2 regular expression.
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Query is a parsed expression.
+type Query struct {
+	root node
+}
+
+// Parse parses an expression.
+func Parse(src string) (*Query, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at offset %d", tok, tok.pos)
+	}
+	return &Query{root: root}, nil
+}
+
+// Match evaluates the query against a host. The field "name" refers to the
+// host name unless data has a field of that name.
+func (q *Query) Match(name string, data map[string]interface{}) bool {
+	return truthy(q.root.eval(record{name: name, data: data}))
+}
+
+type record struct {
+	name string
+	data map[string]interface{}
+}
+
+// Lexer
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// operators lists the symbolic operators, longest first so that "<=" is
+// not read as "<".
+var operators = []string{"&&", "||", "==", "!=", "=~", "!~", "<=", ">=", "<", ">", "!", "(", ")"}
+
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for pos := 0; pos < len(src); {
+		c := src[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+		case c == '"' || c == '\'':
+			text, n, err := lexString(src[pos:])
+			if err != nil {
+				return nil, fmt.Errorf("%v at offset %d", err, pos)
+			}
+			tokens = append(tokens, token{kind: tokString, text: text, pos: pos})
+			pos += n
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := pos + 1
+			for end < len(src) && strings.IndexByte("0123456789.eE+-", src[end]) >= 0 {
+				if (src[end] == '+' || src[end] == '-') && src[end-1] != 'e' && src[end-1] != 'E' {
+					break
+				}
+				end++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[pos:end], pos: pos})
+			pos = end
+		case isIdentStart(rune(c)):
+			end := pos + 1
+			for end < len(src) && isIdentPart(rune(src[end])) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[pos:end], pos: pos})
+			pos = end
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(src[pos:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, pos)
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: pos})
+			pos += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+// lexString reads a quoted string with backslash escapes for the quote and
+// the backslash itself, returning its value and length in src.
+func lexString(src string) (string, int, error) {
+	quote := src[0]
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			if i+1 < len(src) {
+				i++
+			}
+			b.WriteByte(src[i])
+		case quote:
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(src[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+// isIdentPart allows the dots and brackets of field paths.
+func isIdentPart(r rune) bool {
+	return isIdentStart(r) || unicode.IsDigit(r) || r == '.' || r == '[' || r == ']' || r == '-'
+}
+
+// Parser
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) accept(kind tokenKind, text string) bool {
+	if tok := p.peek(); tok.kind == kind && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokOp, "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokOp, "&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.accept(tokOp, "!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+	return p.parseComparison()
+}
+
+// comparisonOps are the binary operators of a comparison.
+var comparisonOps = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"contains": true, "matches": true, "=~": true, "!~": true,
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if !comparisonOps[tok.text] || tok.kind == tokString {
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	cmp := compareNode{op: tok.text, left: left, right: right}
+	if tok.text == "matches" || tok.text == "=~" || tok.text == "!~" {
+		lit, ok := right.(literalNode)
+		pattern, isString := lit.value.(string)
+		if !ok || !isString {
+			return nil, fmt.Errorf("%s at offset %d needs a string literal pattern", tok.text, tok.pos)
+		}
+		if cmp.re, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern at offset %d: %w", tok.pos, err)
+		}
+	}
+	return cmp, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return literalNode{tok.text}, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", tok.text, tok.pos)
+		}
+		return literalNode{n}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		case "contains", "matches":
+			return nil, fmt.Errorf("unexpected %s at offset %d", tok, tok.pos)
+		}
+		path, err := parsePath(tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("%v at offset %d", err, tok.pos)
+		}
+		return fieldNode{name: tok.text, path: path}, nil
+	case tokOp:
+		if tok.text == "(" {
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.accept(tokOp, ")") {
+				return nil, fmt.Errorf("expected ) at offset %d", p.peek().pos)
+			}
+			return inner, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at offset %d", tok, tok.pos)
+}
+
+// pathSegment is a map key, or an array index when key is empty.
+type pathSegment struct {
+	key   string
+	index int
+}
+
+// parsePath splits a field path like "network.interfaces[0].ip".
+func parsePath(text string) ([]pathSegment, error) {
+	var path []pathSegment
+	for _, part := range strings.Split(text, ".") {
+		key, rest, _ := strings.Cut(part, "[")
+		if key == "" && (len(path) == 0 || rest == "") {
+			return nil, fmt.Errorf("invalid field path %q", text)
+		}
+		if key != "" {
+			path = append(path, pathSegment{key: key})
+		}
+		for rest != "" {
+			index, after, ok := strings.Cut(rest, "]")
+			n, err := strconv.Atoi(index)
+			if !ok || err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid index in field path %q", text)
+			}
+			path = append(path, pathSegment{index: n})
+			if after == "" {
+				break
+			}
+			if !strings.HasPrefix(after, "[") {
+				return nil, fmt.Errorf("invalid field path %q", text)
+			}
+			rest = after[1:]
+		}
+	}
+	return path, nil
+}
+
+// Evaluation
+
+type node interface {
+	eval(r record) interface{}
+}
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(r record) interface{} {
+	return truthy(n.left.eval(r)) || truthy(n.right.eval(r))
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(r record) interface{} {
+	return truthy(n.left.eval(r)) && truthy(n.right.eval(r))
+}
+
+type notNode struct{ operand node }
+
+func (n notNode) eval(r record) interface{} {
+	return !truthy(n.operand.eval(r))
+}
+
+type literalNode struct{ value interface{} }
+
+func (n literalNode) eval(record) interface{} { return n.value }
+
+type fieldNode struct {
+	name string
+	path []pathSegment
+}
+
+// missing is the value of a field the host does not have. It is distinct
+// from null so that "x == null" only holds for a stored null.
+type missingValue struct{}
+
+var missing = missingValue{}
+
+func (n fieldNode) eval(r record) interface{} {
+	if value, ok := r.data[n.name]; ok {
+		return value
+	}
+	var current interface{} = r.data
+	for _, segment := range n.path {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			value, ok := v[segment.key]
+			if segment.key == "" || !ok {
+				return n.fallback(r)
+			}
+			current = value
+		case []interface{}:
+			if segment.key != "" || segment.index >= len(v) {
+				return n.fallback(r)
+			}
+			current = v[segment.index]
+		default:
+			return n.fallback(r)
+		}
+	}
+	return current
+}
+
+func (n fieldNode) fallback(r record) interface{} {
+	if n.name == "name" {
+		return r.name
+	}
+	return missing
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+	re          *regexp.Regexp
+}
+
+func (n compareNode) eval(r record) interface{} {
+	left, right := n.left.eval(r), n.right.eval(r)
+	if left == missing || right == missing {
+		return n.op == "!=" || n.op == "!~"
+	}
+	switch n.op {
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	case "contains":
+		return contains(left, right)
+	case "matches", "=~":
+		s, ok := left.(string)
+		return ok && n.re.MatchString(s)
+	case "!~":
+		s, ok := left.(string)
+		return !ok || !n.re.MatchString(s)
+	default:
+		return order(left, n.op, right)
+	}
+}
+
+// typeName classifies a value the way inventory's getTypeName does, for the
+// types that can occur in decoded host data.
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "Null"
+	case string:
+		return "String"
+	case bool:
+		return "Boolean"
+	case float64, int, int64, uint64:
+		return "Number"
+	case []interface{}:
+		return "Array"
+	case map[string]interface{}:
+		return "JSON"
+	case []byte:
+		return "Binary"
+	default:
+		return "Unknown"
+	}
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	}
+	return 0
+}
+
+func equal(a, b interface{}) bool {
+	if typeName(a) != typeName(b) {
+		return false
+	}
+	if typeName(a) == "Number" {
+		return toFloat(a) == toFloat(b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func order(a interface{}, op string, b interface{}) bool {
+	var cmp int
+	switch {
+	case typeName(a) == "Number" && typeName(b) == "Number":
+		x, y := toFloat(a), toFloat(b)
+		switch {
+		case x < y:
+			cmp = -1
+		case x > y:
+			cmp = 1
+		}
+	case typeName(a) == "String" && typeName(b) == "String":
+		cmp = strings.Compare(a.(string), b.(string))
+	default:
+		return false
+	}
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func contains(container, item interface{}) bool {
+	switch c := container.(type) {
+	case string:
+		s, ok := item.(string)
+		return ok && strings.Contains(c, s)
+	case []interface{}:
+		for _, elem := range c {
+			if equal(elem, item) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		key, ok := item.(string)
+		if ok {
+			_, ok = c[key]
+		}
+		return ok
+	}
+	return false
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil, missingValue:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64, int, int64, uint64:
+		return toFloat(v) != 0
+	default:
+		return true
+	}
+}
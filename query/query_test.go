@@ -0,0 +1,158 @@
+package query
+
+import (
+	"strings"
+	"testing"
+)
+
+// host is the data the expressions of TestMatch are evaluated against.
+var host = map[string]interface{}{
+	"role":        "web",
+	"env":         "prod",
+	"maintenance": false,
+	"cores":       8.0,
+	"weight":      int64(3),
+	"version":     "4",
+	"empty":       "",
+	"zero":        0.0,
+	"retired":     nil,
+	"tags":        []interface{}{"frontend", "eu", 2.0},
+	"labels":      map[string]interface{}{"team": "core"},
+	"network": map[string]interface{}{
+		"interfaces": []interface{}{
+			map[string]interface{}{"ip": "10.0.0.1"},
+			map[string]interface{}{"ip": "192.168.1.1"},
+		},
+	},
+	"dotted.key": "literal",
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		want bool
+	}{
+		// Boolean structure and precedence.
+		{`role == "web" && (env == "prod" || env == "stage") && !maintenance`, true},
+		{`role == "db" || env == "prod"`, true},
+		{`role == "db" || env == "prod" && maintenance`, false},
+		{`(role == "db" || env == "prod") && !maintenance`, true},
+		{`!!role`, true},
+		{`!(role == "web")`, false},
+
+		// Truthiness of bare fields.
+		{`role`, true},
+		{`maintenance`, false},
+		{`empty`, false},
+		{`zero`, false},
+		{`retired`, false},
+		{`missing`, false},
+		{`!missing`, true},
+		{`tags`, true},
+
+		// Equality is type-aware.
+		{`cores == 8`, true},
+		{`cores == 8.0`, true},
+		{`weight == 3`, true},
+		{`version == 4`, false},
+		{`version == "4"`, true},
+		{`version != 4`, true},
+		{`maintenance == false`, true},
+		{`retired == null`, true},
+		{`missing == null`, false},
+		{`missing != null`, true},
+		{`missing != "x"`, true},
+		{`'web' == role`, true},
+		{`tags == tags`, true},
+
+		// Ordering of numbers and strings only.
+		{`cores > 4`, true},
+		{`cores >= 8`, true},
+		{`cores < 8`, false},
+		{`cores <= 8 && weight < 3.5`, true},
+		{`weight > -1`, true},
+		{`cores > 1e1`, false},
+		{`env > "dev"`, true},
+		{`env < "dev"`, false},
+		{`version > 3`, false},
+		{`missing < 1`, false},
+
+		// contains on strings, arrays and objects.
+		{`role contains "e"`, true},
+		{`role contains "x"`, false},
+		{`tags contains "eu"`, true},
+		{`tags contains 2`, true},
+		{`tags contains "2"`, false},
+		{`labels contains "team"`, true},
+		{`labels contains "core"`, false},
+		{`cores contains 8`, false},
+
+		// Regular expressions.
+		{`role matches "^w.b$"`, true},
+		{`role =~ "^db"`, false},
+		{`role !~ "^db"`, true},
+		{`cores matches "8"`, false},
+		{`cores !~ "8"`, true},
+		{`missing !~ "x"`, true},
+
+		// Field paths, the name fallback and keys with dots.
+		{`network.interfaces[1].ip == "192.168.1.1"`, true},
+		{`network.interfaces[0].ip matches "^10\\."`, true},
+		{`network.interfaces[2].ip`, false},
+		{`labels.team == "core"`, true},
+		{`labels[0]`, false},
+		{`name == "web01"`, true},
+		{`dotted.key == "literal"`, true},
+
+		// String escapes.
+		{`"it's" == 'it\'s'`, true},
+	} {
+		q, err := Parse(tc.expr)
+		if err != nil {
+			t.Errorf("Parse(%s): %v", tc.expr, err)
+			continue
+		}
+		if got := q.Match("web01", host); got != tc.want {
+			t.Errorf("%s = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestNameField(t *testing.T) {
+	q, err := Parse(`name == "web01"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Match("web01", map[string]interface{}{"name": "other"}) {
+		t.Error("name matched the host name although data has a name field")
+	}
+	if !q.Match("web01", nil) {
+		t.Error("name did not match the host name of a host without data")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		want string
+	}{
+		{``, "unexpected end of expression"},
+		{`role ==`, "unexpected end of expression"},
+		{`role == "web`, "unterminated string"},
+		{`(role == "web"`, "expected )"},
+		{`role == "web")`, `unexpected ")"`},
+		{`role == "web" env`, `unexpected "env"`},
+		{`role & env`, "unexpected character"},
+		{`role matches env`, "needs a string literal pattern"},
+		{`role =~ "("`, "invalid pattern"},
+		{`cores > 1.2.3`, "invalid number"},
+		{`tags[x] == 1`, "invalid index"},
+		{`contains == 1`, `unexpected "contains"`},
+		{`&& role`, `unexpected "&&"`},
+	} {
+		_, err := Parse(tc.expr)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Parse(%s) = %v, want an error containing %q", tc.expr, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package inventory
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oferchen/inventory/internal/logging"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// Role is what a caller of the servers may do with a host: RoleViewer
+// reads it, RoleEditor also writes it, and RoleAdmin also sees its secret
+// fields, when the server reveals them.
+type Role string
+
+const (
+	RoleViewer Role = "viewer"
+	RoleEditor Role = "editor"
+	RoleAdmin  Role = "admin"
+)
+
+// Roles returns the role names, weakest first.
+func Roles() []string {
+	return []string{string(RoleViewer), string(RoleEditor), string(RoleAdmin)}
+}
+
+// ParseRole returns the role named s.
+func ParseRole(s string) (Role, error) {
+	if slices.Contains(Roles(), s) {
+		return Role(s), nil
+	}
+	return "", UnknownChoiceError("role", s, Roles())
+}
+
+// Allows reports whether r includes need; every role includes the weaker
+// ones, and "" includes none.
+func (r Role) Allows(need Role) bool {
+	return r != "" && slices.Index(Roles(), string(r)) >= slices.Index(Roles(), string(need))
+}
+
+// Grant gives Role on the hosts whose names match the Hosts pattern (as
+// in path.Match; "" for all) in Namespace, named as for NamespacePrefix
+// ("" for every namespace).
+type Grant struct {
+	Role      Role   `json:"role"`
+	Namespace string `json:"namespace,omitempty"`
+	Hosts     string `json:"hosts,omitempty"`
+}
+
+// ParseGrant reads a grant written as role[:namespace[:hosts]], e.g.
+// "viewer", "editor:prod" or "editor:prod:web*".
+func ParseGrant(s string) (Grant, error) {
+	parts := strings.SplitN(s, ":", 3)
+	role, err := ParseRole(parts[0])
+	if err != nil {
+		return Grant{}, err
+	}
+	g := Grant{Role: role}
+	if len(parts) > 1 {
+		g.Namespace = parts[1]
+		if _, err := NamespacePrefix(g.Namespace); err != nil {
+			return Grant{}, err
+		}
+	}
+	if len(parts) > 2 {
+		g.Hosts = parts[2]
+		if _, err := path.Match(g.Hosts, ""); err != nil {
+			return Grant{}, fmt.Errorf("invalid host pattern %q: %w", g.Hosts, err)
+		}
+	}
+	return g, nil
+}
+
+// String returns g as ParseGrant reads it.
+func (g Grant) String() string {
+	switch {
+	case g.Hosts != "":
+		return string(g.Role) + ":" + g.Namespace + ":" + g.Hosts
+	case g.Namespace != "":
+		return string(g.Role) + ":" + g.Namespace
+	}
+	return string(g.Role)
+}
+
+// covers reports whether g applies to the inventory at prefix (as
+// KeyPrefix returns).
+func (g Grant) covers(prefix string) bool {
+	if g.Namespace == "" {
+		return true
+	}
+	grantPrefix, err := NamespacePrefix(g.Namespace)
+	return err == nil && grantPrefix == prefix
+}
+
+// Access is what one caller of the servers may do in the inventory at
+// Prefix (as KeyPrefix returns). A nil *Access, as used when the servers
+// do not check roles, may do everything.
+type Access struct {
+	// Name identifies the caller in logs: a token's name or an OIDC
+	// subject.
+	Name   string
+	Grants []Grant
+	Prefix string
+}
+
+// Role returns the strongest role a grants on hostName, or "" if none.
+func (a *Access) Role(hostName string) Role {
+	if a == nil {
+		return RoleAdmin
+	}
+	var role Role
+	for _, g := range a.Grants {
+		if !g.covers(a.Prefix) || role.Allows(g.Role) {
+			continue
+		}
+		if ok, _ := path.Match(g.Hosts, hostName); ok || g.Hosts == "" {
+			role = g.Role
+		}
+	}
+	return role
+}
+
+// Allows reports whether a holds role on hostName.
+func (a *Access) Allows(hostName string, role Role) bool {
+	return a.Role(hostName).Allows(role)
+}
+
+// AllowsAny reports whether a holds role on any host of the inventory, as
+// a listing needs.
+func (a *Access) AllowsAny(role Role) bool {
+	if a == nil {
+		return true
+	}
+	for _, g := range a.Grants {
+		if g.covers(a.Prefix) && g.Role.Allows(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// Visible returns the hosts a may view, with their secret fields masked
+// by mask, such as Inventory.MaskSecrets, on those it is not an admin of.
+func (a *Access) Visible(hosts []Host, mask HostTransform) []Host {
+	if a == nil {
+		return hosts
+	}
+	visible := make([]Host, 0, len(hosts))
+	for _, host := range hosts {
+		switch role := a.Role(host.Name); {
+		case role.Allows(RoleAdmin):
+			visible = append(visible, host)
+		case role.Allows(RoleViewer):
+			masked, _ := mask([]Host{host})
+			visible = append(visible, masked[0])
+		}
+	}
+	return visible
+}
+
+// authTokensKey holds the API tokens of the servers, outside every
+// namespace, so one token can hold grants in several.
+const authTokensKey = "/auth/tokens/"
+
+// AuthTokenPrefix starts every token CreateAuthToken returns, which is
+// AuthTokenPrefix, the token's ID, "_" and its secret, so servers can tell
+// them from other bearer tokens.
+const AuthTokenPrefix = "inv_"
+
+// ErrInvalidToken is returned for a token that is unknown, revoked or
+// expired.
+var ErrInvalidToken = errors.New("invalid, revoked or expired token")
+
+// AuthToken is an API token as stored under /auth/tokens/: only the
+// SHA-256 of its secret is kept, so the token cannot be read back.
+type AuthToken struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Grants  []Grant   `json:"grants"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	// Expires is nil for a token that never expires.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// authKV returns the KV of the keys outside the namespace.
+func (i *Inventory) authKV() (clientv3.KV, error) {
+	if i.client == nil {
+		return nil, errors.New("API tokens need a connection to etcd")
+	}
+	return retryKV{KV: i.client.KV, inv: i}, nil
+}
+
+// CreateAuthToken stores a new token named name with grants, expiring
+// after ttl (0 for never), and returns it: the token to hand to the
+// caller, shown only now, and its stored form.
+func (i *Inventory) CreateAuthToken(name string, grants []Grant, ttl time.Duration) (string, AuthToken, error) {
+	kv, err := i.authKV()
+	if err != nil {
+		return "", AuthToken{}, err
+	}
+	id, secret := make([]byte, 8), make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", AuthToken{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", AuthToken{}, err
+	}
+	hash := sha256.Sum256(secret)
+	token := AuthToken{ID: hex.EncodeToString(id), Name: name, Grants: grants, Hash: hex.EncodeToString(hash[:]), Created: time.Now().UTC()}
+	if ttl > 0 {
+		expires := token.Created.Add(ttl)
+		token.Expires = &expires
+	}
+	value, err := json.Marshal(token)
+	if err != nil {
+		return "", AuthToken{}, err
+	}
+	key := authTokensKey + token.ID
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return "", AuthToken{}, err
+	}
+	if !resp.Succeeded {
+		return "", AuthToken{}, fmt.Errorf("token ID %s is taken; try again", token.ID)
+	}
+	return AuthTokenPrefix + token.ID + "_" + hex.EncodeToString(secret), token, nil
+}
+
+// RevokeAuthToken deletes the token with ID id, which is refused from then
+// on.
+func (i *Inventory) RevokeAuthToken(id string) error {
+	kv, err := i.authKV()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := kv.Delete(ctx, authTokensKey+id)
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return fmt.Errorf("no token with ID %s", id)
+	}
+	return nil
+}
+
+// AuthTokens returns the stored tokens, by ID. Malformed ones are skipped
+// with a warning.
+func (i *Inventory) AuthTokens() ([]AuthToken, error) {
+	kv, err := i.authKV()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := kv.Get(ctx, authTokensKey, i.readOpts(clientv3.WithPrefix())...)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]AuthToken, 0, len(resp.Kvs))
+	for _, item := range resp.Kvs {
+		var token AuthToken
+		if err := json.Unmarshal(item.Value, &token); err != nil {
+			logging.Warnf("skipping malformed token %s: %v", item.Key, err)
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// CheckAuthToken returns the stored token of a token CreateAuthToken
+// returned, or ErrInvalidToken. The token is read on every call, so a
+// revoked one is refused at once.
+func (i *Inventory) CheckAuthToken(token string) (AuthToken, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, AuthTokenPrefix), "_")
+	if !ok || !strings.HasPrefix(token, AuthTokenPrefix) || strings.Contains(id, "/") {
+		return AuthToken{}, ErrInvalidToken
+	}
+	kv, err := i.authKV()
+	if err != nil {
+		return AuthToken{}, err
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := kv.Get(ctx, authTokensKey+id)
+	if err != nil {
+		return AuthToken{}, err
+	}
+	if len(resp.Kvs) == 0 {
+		return AuthToken{}, ErrInvalidToken
+	}
+	var stored AuthToken
+	if err := json.Unmarshal(resp.Kvs[0].Value, &stored); err != nil {
+		return AuthToken{}, fmt.Errorf("token %s: %w", id, err)
+	}
+	raw, err := hex.DecodeString(secret)
+	hash := sha256.Sum256(raw)
+	if err != nil || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(stored.Hash)) != 1 {
+		return AuthToken{}, ErrInvalidToken
+	}
+	if stored.Expires != nil && time.Now().After(*stored.Expires) {
+		return AuthToken{}, ErrInvalidToken
+	}
+	return stored, nil
+}
@@ -0,0 +1,365 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/oferchen/inventory/internal/logging"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
+)
+
+// maxRetries bounds how many times retryKV repeats a request that failed
+// with a transient etcd error.
+const maxRetries = 3
+
+// retryBackoff is the delay before the first retry; it doubles per retry.
+const retryBackoff = 100 * time.Millisecond
+
+// retryCounts counts retries per operation (get, put, delete, txn), and
+// requestCounts, requestErrors and requestSeconds count the etcd requests
+// per operation, those that failed after any retries, and the seconds
+// spent in them, retries included. PublishMetrics publishes them.
+var (
+	retryCounts    = new(expvar.Map)
+	requestCounts  = new(expvar.Map)
+	requestErrors  = new(expvar.Map)
+	requestSeconds = new(expvar.Map)
+)
+
+var publishMetrics sync.Once
+
+// PublishMetrics publishes the etcd request counters through expvar, as
+// etcd_requests, etcd_request_errors, etcd_request_seconds and
+// etcd_retries, so a metrics endpoint can expose them. Until then they
+// are counted but not published, so importing the package registers no
+// expvar names of its own. Later calls do nothing.
+func PublishMetrics() {
+	publishMetrics.Do(func() {
+		expvar.Publish("etcd_requests", requestCounts)
+		expvar.Publish("etcd_request_errors", requestErrors)
+		expvar.Publish("etcd_request_seconds", requestSeconds)
+		expvar.Publish("etcd_retries", retryCounts)
+	})
+}
+
+// isTransient reports whether err is an etcd error worth retrying: one
+// refusing the request before it was applied, such as a leader election in
+// progress. With read, it also reports the timeouts after which a write
+// may have been applied all the same: only a read can safely be repeated
+// then, as a repeated write could fail the guard of its own first attempt.
+func isTransient(err error, read bool) bool {
+	transient := []error{rpctypes.ErrNoLeader, rpctypes.ErrUnhealthy}
+	if read {
+		transient = append(transient,
+			rpctypes.ErrLeaderChanged,
+			rpctypes.ErrTimeout,
+			rpctypes.ErrTimeoutDueToLeaderFail,
+			rpctypes.ErrTimeoutDueToConnectionLost)
+	}
+	for _, target := range transient {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetry runs do, repeating it with backoff while it fails with a
+// transient error (see isTransient; read says whether do only reads) and
+// ctx allows. Every retry is counted in retryCounts,
+// and the request as a whole in requestCounts, requestErrors and
+// requestSeconds. With r set, a rejected auth token also renews the client
+// and repeats do, up to maxReauths times.
+func withRetry(ctx context.Context, op string, read bool, r *reauth, inv *Inventory, do func() error) (err error) {
+	start := time.Now()
+	defer func() {
+		requestCounts.Add(op, 1)
+		requestSeconds.AddFloat(op, time.Since(start).Seconds())
+		if err != nil {
+			requestErrors.Add(op, 1)
+		}
+	}()
+	for retries, reauths := 0, 0; ; retries++ {
+		generation := r.generation()
+		err := do()
+		if err == nil {
+			if retries > 0 {
+				inv.debugf("etcd %s succeeded after %d retries", op, retries)
+			}
+			return nil
+		}
+		if r != nil && isUnauthenticated(err) && reauths < maxReauths {
+			reauths++
+			if rerr := r.renew(generation); rerr != nil {
+				return fmt.Errorf("%w (%v)", err, rerr)
+			}
+			retries--
+			continue
+		}
+		if !isTransient(err, read) || retries == maxRetries {
+			if retries > 0 {
+				inv.debugf("etcd %s failed after %d retries: %v", op, retries, err)
+			}
+			return err
+		}
+		inv.debugf("etcd %s failed, retrying: %v", op, err)
+		retryCounts.Add(op, 1)
+		select {
+		case <-time.After(retryBackoff << retries):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// retryKV wraps a KV so that every request the Inventory methods make is
+// retried on transient errors.
+type retryKV struct {
+	clientv3.KV
+	// reauth, when set, supplies the KV of its current client instead.
+	reauth *reauth
+	// inv, when set, logs the retries with its Debug.
+	inv *Inventory
+}
+
+// current returns the KV to send the next request to.
+func (kv retryKV) current() clientv3.KV {
+	if kv.reauth != nil {
+		return kv.reauth.kv()
+	}
+	return kv.KV
+}
+
+func (kv retryKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (resp *clientv3.GetResponse, err error) {
+	err = withRetry(ctx, "get", true, kv.reauth, kv.inv, func() error {
+		resp, err = kv.current().Get(ctx, key, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (kv retryKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (resp *clientv3.PutResponse, err error) {
+	err = withRetry(ctx, "put", false, kv.reauth, kv.inv, func() error {
+		resp, err = kv.current().Put(ctx, key, val, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (kv retryKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (resp *clientv3.DeleteResponse, err error) {
+	err = withRetry(ctx, "delete", false, kv.reauth, kv.inv, func() error {
+		resp, err = kv.current().Delete(ctx, key, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (kv retryKV) Txn(ctx context.Context) clientv3.Txn {
+	return &retryTxn{kv: kv, ctx: ctx}
+}
+
+// retryTxn records the transaction so Commit can rebuild and resend it.
+type retryTxn struct {
+	kv        retryKV
+	ctx       context.Context
+	cmps      []clientv3.Cmp
+	then, els []clientv3.Op
+}
+
+func (t *retryTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *retryTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.then = append(t.then, ops...)
+	return t
+}
+
+func (t *retryTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.els = append(t.els, ops...)
+	return t
+}
+
+func (t *retryTxn) Commit() (resp *clientv3.TxnResponse, err error) {
+	read := readOnly(t.then) && readOnly(t.els)
+	err = withRetry(t.ctx, "txn", read, t.kv.reauth, t.kv.inv, func() error {
+		resp, err = t.kv.current().Txn(t.ctx).If(t.cmps...).Then(t.then...).Else(t.els...).Commit()
+		return err
+	})
+	return resp, err
+}
+
+// readOnly reports whether ops are all gets.
+func readOnly(ops []clientv3.Op) bool {
+	for _, op := range ops {
+		if !op.IsGet() {
+			return false
+		}
+	}
+	return true
+}
+
+// maxReauths bounds how many times in a row a request or watch renews the
+// client after etcd rejected its auth token, so bad credentials fail
+// instead of reconnecting forever.
+const maxReauths = 3
+
+// isUnauthenticated reports whether etcd rejected err's request because the
+// client's auth token is no longer valid, as happens once it expires.
+func isUnauthenticated(err error) bool {
+	return errors.Is(err, rpctypes.ErrInvalidAuthToken) || errors.Is(err, rpctypes.ErrGRPCInvalidAuthToken)
+}
+
+// reauth holds the client an Inventory with EnableReauth talks to, and
+// replaces it with a freshly authenticated one when etcd rejects its token.
+type reauth struct {
+	connect func() (*clientv3.Client, error)
+	prefix  string
+	// closeAfter is how long a replaced client stays open, so requests
+	// still in flight on it can finish.
+	closeAfter time.Duration
+
+	mu      sync.RWMutex
+	client  *clientv3.Client
+	owned   bool
+	gen     int
+	current struct {
+		kv      clientv3.KV
+		watcher clientv3.Watcher
+		lease   clientv3.Lease
+	}
+}
+
+// use makes client the current one, scoped under the namespace prefix.
+// The caller holds r.mu.
+func (r *reauth) use(client *clientv3.Client) {
+	r.client = client
+	r.current.kv, r.current.watcher, r.current.lease = client.KV, client.Watcher, client.Lease
+	if r.prefix != "" {
+		r.current.kv = namespace.NewKV(client.KV, r.prefix)
+		r.current.watcher = namespace.NewWatcher(client.Watcher, r.prefix)
+		r.current.lease = namespace.NewLease(client.Lease, r.prefix)
+	}
+}
+
+// generation numbers the current client; renew takes the generation the
+// failed request was sent with, so concurrent failures renew only once.
+// It is 0 for a nil r.
+func (r *reauth) generation() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.gen
+}
+
+// renew connects a new client in place of the one of generation gen,
+// unless another request already has. The client the Inventory was created
+// with belongs to its caller and is left open; those renew made are closed
+// after closeAfter.
+func (r *reauth) renew(gen int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if gen != r.gen {
+		return nil
+	}
+	logging.Warnf("etcd rejected the auth token, re-authenticating")
+	client, err := r.connect()
+	if err != nil {
+		return fmt.Errorf("re-authenticate: %w", err)
+	}
+	if old := r.client; r.owned {
+		time.AfterFunc(r.closeAfter, func() { old.Close() })
+	}
+	r.use(client)
+	r.owned = true
+	r.gen++
+	return nil
+}
+
+func (r *reauth) kv() clientv3.KV {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current.kv
+}
+
+// reauthWatcher and reauthLease forward to the current client of r.
+type reauthWatcher struct{ r *reauth }
+
+func (w reauthWatcher) get() clientv3.Watcher {
+	w.r.mu.RLock()
+	defer w.r.mu.RUnlock()
+	return w.r.current.watcher
+}
+
+func (w reauthWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	return w.get().Watch(ctx, key, opts...)
+}
+
+func (w reauthWatcher) RequestProgress(ctx context.Context) error {
+	return w.get().RequestProgress(ctx)
+}
+
+func (w reauthWatcher) Close() error { return w.get().Close() }
+
+type reauthLease struct{ r *reauth }
+
+func (l reauthLease) get() clientv3.Lease {
+	l.r.mu.RLock()
+	defer l.r.mu.RUnlock()
+	return l.r.current.lease
+}
+
+func (l reauthLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	return l.get().Grant(ctx, ttl)
+}
+
+func (l reauthLease) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	return l.get().Revoke(ctx, id)
+}
+
+func (l reauthLease) TimeToLive(ctx context.Context, id clientv3.LeaseID, opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error) {
+	return l.get().TimeToLive(ctx, id, opts...)
+}
+
+func (l reauthLease) Leases(ctx context.Context) (*clientv3.LeaseLeasesResponse, error) {
+	return l.get().Leases(ctx)
+}
+
+func (l reauthLease) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	return l.get().KeepAlive(ctx, id)
+}
+
+func (l reauthLease) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
+	return l.get().KeepAliveOnce(ctx, id)
+}
+
+func (l reauthLease) Close() error { return l.get().Close() }
+
+// EnableReauth makes the Inventory call connect for a new client whenever
+// etcd rejects the auth token of the current one, such as after it expired
+// in a long-running serve or watch, and repeat the request or resume the
+// watch with it. Each re-authentication is logged as a warning; more than
+// maxReauths in a row fail. Call it before EnableCache, EnableAudit and
+// OnMutation, which wrap the requests it renews, and after setting Timeout,
+// which also bounds how long a replaced client is kept for its requests in
+// flight. Inventories that never contact etcd ignore it.
+func (i *Inventory) EnableReauth(connect func() (*clientv3.Client, error)) {
+	if i.client == nil {
+		return
+	}
+	r := &reauth{connect: connect, prefix: i.namespace, closeAfter: i.Timeout}
+	r.use(i.client)
+	i.reauth = r
+	i.kv = retryKV{KV: r.current.kv, reauth: r, inv: i}
+	i.watcher = reauthWatcher{r: r}
+	i.lease = reauthLease{r: r}
+}
@@ -0,0 +1,707 @@
+package inventory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/oferchen/inventory/internal/logging"
+	"gopkg.in/yaml.v3"
+)
+
+// FieldRule constrains the values of one field. Each constraint applies to
+// every element of an array value; unset constraints allow anything.
+type FieldRule struct {
+	// Required fails hosts without the field.
+	Required bool `yaml:"required"`
+	// Match is a regular expression the whole value must match.
+	Match string `yaml:"match"`
+	// Min and Max bound numeric values, and strings holding numbers.
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+	// Enum lists the allowed values, compared as FormatValue shows them.
+	Enum []string `yaml:"enum"`
+
+	match *regexp.Regexp
+}
+
+// FieldRules maps field names to their rules.
+type FieldRules map[string]*FieldRule
+
+// LoadFieldRules reads a YAML rules file mapping each field to its rules:
+//
+//	env:
+//	  required: true
+//	  enum: [prod, stage, dev]
+//	cores:
+//	  min: 1
+//	  max: 512
+//	ipaddr:
+//	  match: '10\.[0-9.]+'
+func LoadFieldRules(path string) (FieldRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules := make(FieldRules)
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&rules); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for field, rule := range rules {
+		if rule == nil {
+			return nil, fmt.Errorf("%s: field %s has no rules", path, field)
+		}
+		if rule.Match != "" {
+			if rule.match, err = regexp.Compile("^(?:" + rule.Match + ")$"); err != nil {
+				return nil, fmt.Errorf("%s: field %s: %w", path, field, err)
+			}
+		}
+		if rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+			return nil, fmt.Errorf("%s: field %s: min %v is above max %v", path, field, *rule.Min, *rule.Max)
+		}
+	}
+	return rules, nil
+}
+
+// check returns every rule the host violates, in field order.
+func (r FieldRules) check(host Host) []error {
+	fields := make([]string, 0, len(r))
+	for field := range r {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var problems []error
+	for _, field := range fields {
+		rule := r[field]
+		value, ok := host.Data[field]
+		if !ok {
+			if rule.Required {
+				problems = append(problems, fmt.Errorf("field %q is required", field))
+			}
+			continue
+		}
+		values := []interface{}{value}
+		if elems, ok := value.([]interface{}); ok {
+			values = elems
+		}
+		for _, value := range values {
+			problems = append(problems, rule.checkValue(field, value)...)
+		}
+	}
+	return problems
+}
+
+func (rule *FieldRule) checkValue(field string, value interface{}) []error {
+	var problems []error
+	text := FormatValue(value)
+	if rule.match != nil && !rule.match.MatchString(text) {
+		problems = append(problems, fmt.Errorf("field %q: %q does not match %s", field, text, rule.Match))
+	}
+	if rule.Min != nil || rule.Max != nil {
+		n, ok := ToFloat(value)
+		if s, isString := value.(string); isString {
+			var err error
+			n, err = strconv.ParseFloat(strings.TrimSpace(s), 64)
+			ok = err == nil
+		}
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Errorf("field %q: %q is not a number", field, text))
+		case rule.Min != nil && n < *rule.Min:
+			problems = append(problems, fmt.Errorf("field %q: %v is below the minimum %v", field, n, *rule.Min))
+		case rule.Max != nil && n > *rule.Max:
+			problems = append(problems, fmt.Errorf("field %q: %v is above the maximum %v", field, n, *rule.Max))
+		}
+	}
+	if len(rule.Enum) > 0 {
+		allowed := false
+		for _, option := range rule.Enum {
+			allowed = allowed || option == text
+		}
+		if !allowed {
+			problems = append(problems, fmt.Errorf("field %q: %q is not one of %s", field, text, strings.Join(rule.Enum, ", ")))
+		}
+	}
+	return problems
+}
+
+// ValidateHost returns every problem found with host rather than stopping at
+// the first one, including any ValidationRules it violates.
+func (i *Inventory) ValidateHost(host Host) []error {
+	var problems []error
+	if err := ValidateHostName(host.Name); err != nil {
+		problems = append(problems, err)
+	}
+	fields := make([]string, 0, len(host.Data))
+	for field := range host.Data {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if strings.TrimSpace(field) == "" {
+			problems = append(problems, errors.New("field name is empty"))
+		}
+		if TypeName(host.Data[field]) == "Unknown" {
+			problems = append(problems, fmt.Errorf("field %q has an unsupported type %T", field, host.Data[field]))
+		}
+	}
+	return append(problems, i.ValidationRules.check(host)...)
+}
+
+// schemaKey holds the JSON Schema that host data is checked against when
+// no other is given; see UseStoredSchema.
+const schemaKey = "/schema/hosts"
+
+// ErrSchemaViolation is wrapped by the errors of writes refused because
+// the host data does not match the Inventory's Schema.
+var ErrSchemaViolation = errors.New("schema violation")
+
+// Schema is a compiled JSON Schema for host data, the object of a host's
+// fields. It supports the keywords that constrain a value on its own:
+// type, enum, const, properties, required, additionalProperties, items,
+// minItems, maxItems, uniqueItems, minLength, maxLength, pattern, minimum,
+// maximum, exclusiveMinimum, exclusiveMaximum, allOf, anyOf, oneOf and
+// not. Schemas using references or other validation keywords are refused
+// rather than half checked; annotations such as title and format are
+// ignored.
+type Schema struct {
+	// never is the false schema, which no value matches.
+	never bool
+	types []string
+	enum  []interface{}
+	// constant is set when hasConst, as null is a valid const.
+	constant   interface{}
+	hasConst   bool
+	properties map[string]*Schema
+	required   []string
+	additional *Schema
+	items      *Schema
+
+	minItems, maxItems   *int
+	uniqueItems          bool
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	minimum, maximum, exclusiveMinimum, exclusiveMaximum *float64
+
+	allOf, anyOf, oneOf []*Schema
+	not                 *Schema
+}
+
+// unsupportedSchemaKeywords are the validation keywords Schema cannot
+// check.
+var unsupportedSchemaKeywords = []string{"$ref", "$dynamicRef", "$recursiveRef", "patternProperties", "propertyNames",
+	"dependencies", "dependentRequired", "dependentSchemas", "if", "then", "else", "contains", "prefixItems",
+	"unevaluatedItems", "unevaluatedProperties", "minProperties", "maxProperties", "multipleOf"}
+
+// schemaTypes are the values of the type keyword.
+var schemaTypes = []string{"null", "boolean", "string", "number", "integer", "array", "object"}
+
+// ParseSchema compiles a JSON Schema document.
+func ParseSchema(text []byte) (*Schema, error) {
+	var node interface{}
+	if err := json.Unmarshal(text, &node); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return compileSchema(node, "#")
+}
+
+// LoadSchema reads and compiles a JSON Schema file.
+func LoadSchema(path string) (*Schema, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := ParseSchema(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return schema, nil
+}
+
+// compileSchema compiles the schema node found at the JSON pointer at.
+func compileSchema(node interface{}, at string) (*Schema, error) {
+	if b, ok := node.(bool); ok {
+		return &Schema{never: !b}, nil
+	}
+	obj, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema %s: expected an object or a boolean", at)
+	}
+	for _, keyword := range unsupportedSchemaKeywords {
+		if _, ok := obj[keyword]; ok {
+			return nil, fmt.Errorf("schema %s: %s is not supported", at, keyword)
+		}
+	}
+	s := &Schema{}
+	var err error
+	switch types := obj["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{types}
+	case []interface{}:
+		for _, t := range types {
+			name, ok := t.(string)
+			if !ok {
+				return nil, fmt.Errorf("schema %s/type: expected strings", at)
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("schema %s/type: expected a string or an array", at)
+	}
+	for _, t := range s.types {
+		if !slices.Contains(schemaTypes, t) {
+			return nil, fmt.Errorf("schema %s/type: %w", at, UnknownChoiceError("type", t, schemaTypes))
+		}
+	}
+	if enum, ok := obj["enum"]; ok {
+		if s.enum, ok = enum.([]interface{}); !ok {
+			return nil, fmt.Errorf("schema %s/enum: expected an array", at)
+		}
+	}
+	s.constant, s.hasConst = obj["const"]
+	if properties, ok := obj["properties"]; ok {
+		props, ok := properties.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("schema %s/properties: expected an object", at)
+		}
+		s.properties = make(map[string]*Schema, len(props))
+		for name, prop := range props {
+			if s.properties[name], err = compileSchema(prop, at+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if required, ok := obj["required"]; ok {
+		names, ok := required.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("schema %s/required: expected an array", at)
+		}
+		for _, name := range names {
+			field, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("schema %s/required: expected strings", at)
+			}
+			s.required = append(s.required, field)
+		}
+	}
+	if s.additional, err = compileSubschema(obj, "additionalProperties", at); err != nil {
+		return nil, err
+	}
+	if s.items, err = compileSubschema(obj, "items", at); err != nil {
+		return nil, err
+	}
+	if s.not, err = compileSubschema(obj, "not", at); err != nil {
+		return nil, err
+	}
+	for keyword, list := range map[string]*[]*Schema{"allOf": &s.allOf, "anyOf": &s.anyOf, "oneOf": &s.oneOf} {
+		nodes, ok := obj[keyword]
+		if !ok {
+			continue
+		}
+		subschemas, ok := nodes.([]interface{})
+		if !ok || len(subschemas) == 0 {
+			return nil, fmt.Errorf("schema %s/%s: expected a non-empty array", at, keyword)
+		}
+		for n, node := range subschemas {
+			subschema, err := compileSchema(node, fmt.Sprintf("%s/%s/%d", at, keyword, n))
+			if err != nil {
+				return nil, err
+			}
+			*list = append(*list, subschema)
+		}
+	}
+	for keyword, bound := range map[string]**int{"minItems": &s.minItems, "maxItems": &s.maxItems, "minLength": &s.minLength, "maxLength": &s.maxLength} {
+		value, ok := obj[keyword]
+		if !ok {
+			continue
+		}
+		n, ok := value.(float64)
+		if !ok || n < 0 || n != math.Trunc(n) {
+			return nil, fmt.Errorf("schema %s/%s: expected a non-negative integer", at, keyword)
+		}
+		count := int(n)
+		*bound = &count
+	}
+	for keyword, bound := range map[string]**float64{"minimum": &s.minimum, "maximum": &s.maximum, "exclusiveMinimum": &s.exclusiveMinimum, "exclusiveMaximum": &s.exclusiveMaximum} {
+		value, ok := obj[keyword]
+		if !ok {
+			continue
+		}
+		n, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("schema %s/%s: expected a number", at, keyword)
+		}
+		*bound = &n
+	}
+	if unique, ok := obj["uniqueItems"]; ok {
+		if s.uniqueItems, ok = unique.(bool); !ok {
+			return nil, fmt.Errorf("schema %s/uniqueItems: expected a boolean", at)
+		}
+	}
+	if pattern, ok := obj["pattern"]; ok {
+		text, ok := pattern.(string)
+		if !ok {
+			return nil, fmt.Errorf("schema %s/pattern: expected a string", at)
+		}
+		if s.pattern, err = regexp.Compile(text); err != nil {
+			return nil, fmt.Errorf("schema %s/pattern: %w", at, err)
+		}
+	}
+	return s, nil
+}
+
+// compileSubschema compiles the schema under keyword of obj, if any.
+func compileSubschema(obj map[string]interface{}, keyword, at string) (*Schema, error) {
+	node, ok := obj[keyword]
+	if !ok {
+		return nil, nil
+	}
+	return compileSchema(node, at+"/"+keyword)
+}
+
+// Validate returns every way data, a host's fields, fails the schema, each
+// naming the field at fault by its path (as in "network.interfaces[0]").
+// A nil Schema allows anything.
+func (s *Schema) Validate(data map[string]interface{}) []error {
+	if s == nil {
+		return nil
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	return s.check(data, "")
+}
+
+// schemaProblem describes a problem with the value at path, the host data
+// itself when path is empty.
+func schemaProblem(path, format string, args ...interface{}) error {
+	if path == "" {
+		return fmt.Errorf("host data "+format, args...)
+	}
+	return fmt.Errorf("field %q "+format, append([]interface{}{path}, args...)...)
+}
+
+// schemaType returns the JSON type of a field value, or its TypeName for
+// values JSON cannot hold.
+func schemaType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	if _, ok := ToFloat(value); ok {
+		return "number"
+	}
+	return TypeName(value)
+}
+
+// schemaJSON renders a value in a problem, as the schema would spell it.
+func schemaJSON(value interface{}) string {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return FormatValue(value)
+	}
+	return string(b)
+}
+
+func (s *Schema) check(value interface{}, path string) []error {
+	if s.never {
+		return []error{schemaProblem(path, "is not allowed by the schema")}
+	}
+	valueType := schemaType(value)
+	if len(s.types) > 0 {
+		matched := false
+		for _, t := range s.types {
+			n, _ := ToFloat(value)
+			matched = matched || t == valueType || t == "integer" && valueType == "number" && n == math.Trunc(n)
+		}
+		if !matched {
+			return []error{schemaProblem(path, "is %s, expected %s", schemaJSON(value), strings.Join(s.types, " or "))}
+		}
+	}
+	var problems []error
+	if len(s.enum) > 0 {
+		allowed := false
+		for _, option := range s.enum {
+			allowed = allowed || schemaJSON(option) == schemaJSON(value)
+		}
+		if !allowed {
+			options := make([]string, len(s.enum))
+			for n, option := range s.enum {
+				options[n] = schemaJSON(option)
+			}
+			problems = append(problems, schemaProblem(path, "is %s, not one of %s", schemaJSON(value), strings.Join(options, ", ")))
+		}
+	}
+	if s.hasConst && schemaJSON(s.constant) != schemaJSON(value) {
+		problems = append(problems, schemaProblem(path, "is %s, expected %s", schemaJSON(value), schemaJSON(s.constant)))
+	}
+	switch v := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			problems = append(problems, schemaProblem(path, "is shorter than %d characters", *s.minLength))
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			problems = append(problems, schemaProblem(path, "is longer than %d characters", *s.maxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			problems = append(problems, schemaProblem(path, "is %q, which does not match %s", v, s.pattern))
+		}
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			problems = append(problems, schemaProblem(path, "has %d items, fewer than %d", len(v), *s.minItems))
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			problems = append(problems, schemaProblem(path, "has %d items, more than %d", len(v), *s.maxItems))
+		}
+		seen := make(map[string]bool)
+		for n, item := range v {
+			if s.uniqueItems {
+				text := schemaJSON(item)
+				if seen[text] {
+					problems = append(problems, schemaProblem(path, "has %s more than once", text))
+				}
+				seen[text] = true
+			}
+			if s.items != nil {
+				problems = append(problems, s.items.check(item, fmt.Sprintf("%s[%d]", path, n))...)
+			}
+		}
+	case map[string]interface{}:
+		for _, field := range s.required {
+			if _, ok := v[field]; !ok {
+				problems = append(problems, fmt.Errorf("field %q is required", schemaFieldPath(path, field)))
+			}
+		}
+		fields := make([]string, 0, len(v))
+		for field := range v {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			subschema, ok := s.properties[field]
+			if !ok {
+				subschema = s.additional
+			}
+			if subschema != nil {
+				problems = append(problems, subschema.check(v[field], schemaFieldPath(path, field))...)
+			}
+		}
+	default:
+		if n, ok := ToFloat(value); ok {
+			switch {
+			case s.minimum != nil && n < *s.minimum:
+				problems = append(problems, schemaProblem(path, "%v is below the minimum %v", n, *s.minimum))
+			case s.exclusiveMinimum != nil && n <= *s.exclusiveMinimum:
+				problems = append(problems, schemaProblem(path, "%v is not above %v", n, *s.exclusiveMinimum))
+			case s.maximum != nil && n > *s.maximum:
+				problems = append(problems, schemaProblem(path, "%v is above the maximum %v", n, *s.maximum))
+			case s.exclusiveMaximum != nil && n >= *s.exclusiveMaximum:
+				problems = append(problems, schemaProblem(path, "%v is not below %v", n, *s.exclusiveMaximum))
+			}
+		}
+	}
+	for _, subschema := range s.allOf {
+		problems = append(problems, subschema.check(value, path)...)
+	}
+	if len(s.anyOf) > 0 {
+		matched := false
+		for _, subschema := range s.anyOf {
+			matched = matched || len(subschema.check(value, path)) == 0
+		}
+		if !matched {
+			problems = append(problems, schemaProblem(path, "matches none of the anyOf schemas"))
+		}
+	}
+	if len(s.oneOf) > 0 {
+		matches := 0
+		for _, subschema := range s.oneOf {
+			if len(subschema.check(value, path)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			problems = append(problems, schemaProblem(path, "matches %d of the oneOf schemas, not exactly one", matches))
+		}
+	}
+	if s.not != nil && len(s.not.check(value, path)) == 0 {
+		problems = append(problems, schemaProblem(path, "matches the schema under not"))
+	}
+	return problems
+}
+
+// schemaFieldPath appends field to the path of an object.
+func schemaFieldPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// UseStoredSchema makes writes check host data against the schema stored
+// in etcd (see PutSchema), if there is one, unless Schema is already set.
+// The schema is read once, so a long-running process keeps the schema it
+// started with.
+func (i *Inventory) UseStoredSchema() error {
+	if i.Schema != nil {
+		return nil
+	}
+	text, err := i.SchemaText()
+	if err != nil || text == nil {
+		return err
+	}
+	schema, err := ParseSchema(text)
+	if err != nil {
+		return fmt.Errorf("%s: %w", schemaKey, err)
+	}
+	i.Schema = schema
+	return nil
+}
+
+// SchemaText returns the schema stored in etcd as it was stored, or nil if
+// there is none.
+func (i *Inventory) SchemaText() ([]byte, error) {
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Get(ctx, schemaKey, i.readOpts()...)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// PutSchema stores text as the schema of host data, after checking that
+// it compiles. Hosts already stored are not checked; see Schema.Validate.
+func (i *Inventory) PutSchema(text []byte) error {
+	if _, err := ParseSchema(text); err != nil {
+		return err
+	}
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	_, err := i.kv.Put(ctx, schemaKey, string(text))
+	return err
+}
+
+// RemoveSchema deletes the stored schema, reporting whether there was one.
+func (i *Inventory) RemoveSchema() (bool, error) {
+	ctx, cancel := i.requestContext()
+	defer cancel()
+	resp, err := i.kv.Delete(ctx, schemaKey)
+	if err != nil {
+		return false, err
+	}
+	return resp.Deleted > 0, nil
+}
+
+// expectedFieldTypes returns, per field, the type (per TypeName) that
+// most hosts store for it.
+func expectedFieldTypes(hosts []Host) map[string]string {
+	counts := make(map[string]map[string]int)
+	for _, host := range hosts {
+		for field, value := range host.Data {
+			if counts[field] == nil {
+				counts[field] = make(map[string]int)
+			}
+			counts[field][TypeName(value)]++
+		}
+	}
+	expected := make(map[string]string)
+	for field, types := range counts {
+		best := ""
+		for typeName, n := range types {
+			if best == "" || n > types[best] || (n == types[best] && typeName < best) {
+				best = typeName
+			}
+		}
+		expected[field] = best
+	}
+	return expected
+}
+
+// FieldTypeProblems reports hosts whose value for a field has a different
+// type (per TypeName) than most other hosts use for that field.
+func FieldTypeProblems(hosts []Host) map[string][]error {
+	expected := expectedFieldTypes(hosts)
+	problems := make(map[string][]error)
+	for _, host := range hosts {
+		for field, value := range host.Data {
+			if typeName := TypeName(value); typeName != expected[field] && typeName != "Null" {
+				problems[host.Name] = append(problems[host.Name],
+					fmt.Errorf("field %q is %s but most hosts store %s", field, typeName, expected[field]))
+			}
+		}
+	}
+	return problems
+}
+
+// normalizeData canonicalizes data in place: strings are trimmed, and a
+// top-level string is coerced to the field's expected Number or Boolean type
+// when it parses as one. Key order and whitespace are canonicalized by
+// marshalHost itself.
+func normalizeData(data map[string]interface{}, expected map[string]string) {
+	for field, value := range data {
+		value = trimStrings(value)
+		if s, ok := value.(string); ok {
+			switch expected[field] {
+			case "Number":
+				if n, err := strconv.ParseFloat(s, 64); err == nil {
+					value = n
+				}
+			case "Boolean":
+				if b, err := strconv.ParseBool(s); err == nil {
+					value = b
+				}
+			}
+		}
+		data[field] = value
+	}
+}
+
+func trimStrings(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = trimStrings(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = trimStrings(elem)
+		}
+	}
+	return value
+}
+
+// WarnMalformed prints a warning for each stored host that was skipped
+// because its value could not be decoded.
+func WarnMalformed(errs []error) {
+	for _, err := range errs {
+		logging.Warnf("skipping %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package inventory
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// secretMarker tags the sealed value of a secret field in stored data, e.g.
+// {"$secret": "<base64 nonce and ciphertext>"}; see FieldCipher.
+const secretMarker = "$secret"
+
+// ErrNoSecretKey is returned by writes of a secret field without Secrets.
+var ErrNoSecretKey = errors.New("no secret key set")
+
+// SecretKeySize is the size of the AES-256 keys of a FieldCipher.
+const SecretKeySize = 32
+
+// FieldCipher encrypts field values with AES-256-GCM, bound to their host
+// and field names as additional data so a sealed value cannot be moved to
+// another field or another host. The nonce is derived from the host name, the field and the value,
+// so storing the same value again gives the same bytes and rewrites
+// nothing; in exchange, equal values of one field of one host can be told
+// apart from different ones across revisions.
+type FieldCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// NewFieldCipher returns a cipher with key, which must be SecretKeySize
+// bytes; see ParseSecretKey.
+func NewFieldCipher(key []byte) (*FieldCipher, error) {
+	if len(key) != SecretKeySize {
+		return nil, fmt.Errorf("secret key is %d bytes, not %d", len(key), SecretKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonceKey := sha256.Sum256(append([]byte("inventory field nonce\x00"), key...))
+	return &FieldCipher{aead: aead, nonceKey: nonceKey[:]}, nil
+}
+
+// ParseSecretKey reads a key as SecretKeySize raw bytes, or as their hex
+// or base64 encoding, ignoring surrounding whitespace.
+func ParseSecretKey(b []byte) ([]byte, error) {
+	if len(b) == SecretKeySize {
+		return b, nil
+	}
+	text := strings.TrimSpace(string(b))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == SecretKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == SecretKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("secret key must be %d bytes, raw or hex or base64 encoded", SecretKeySize)
+}
+
+// Seal encrypts the value of field on host into its stored form.
+func (c *FieldCipher) Seal(host, field string, value interface{}) (map[string]interface{}, error) {
+	plaintext, err := json.Marshal(encodeBinaryValue(value))
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %w", field, err)
+	}
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write([]byte(host + "\x00" + field + "\x00"))
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+	sealed := c.aead.Seal(nonce, nonce, plaintext, sealedFor(host, field))
+	return map[string]interface{}{secretMarker: base64.StdEncoding.EncodeToString(sealed)}, nil
+}
+
+// Open decrypts a value sealed for field on host, failing if it was
+// sealed with another key, for another field or for another host.
+func (c *FieldCipher) Open(host, field string, value interface{}) (interface{}, error) {
+	encoded, ok := sealedValue(value)
+	if !ok {
+		return nil, fmt.Errorf("field %s is not sealed", field)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("field %s: malformed sealed value", field)
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, sealedFor(host, field))
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %w", field, err)
+	}
+	var opened interface{}
+	if err := json.Unmarshal(plaintext, &opened); err != nil {
+		return nil, fmt.Errorf("field %s: %w", field, err)
+	}
+	return decodeBinaryValue(opened), nil
+}
+
+// sealedFor is the additional data binding a sealed value to its host and
+// field.
+func sealedFor(host, field string) []byte {
+	return []byte(host + "\x00" + field)
+}
+
+// sealedValue returns the encoded ciphertext of a sealed value.
+func sealedValue(value interface{}) (string, bool) {
+	object, ok := value.(map[string]interface{})
+	if !ok || len(object) != 1 {
+		return "", false
+	}
+	encoded, ok := object[secretMarker].(string)
+	return encoded, ok
+}
+
+// sealSecrets returns host with its SecretFields sealed by Secrets, on a
+// copy of its data. Values already sealed, as read without a key or from
+// an export, are kept as they are.
+func (i *Inventory) sealSecrets(host Host) (Host, error) {
+	copied := false
+	for field := range i.SecretFields {
+		value, ok := host.Data[field]
+		if !ok || value == nil {
+			continue
+		}
+		if _, sealed := sealedValue(value); sealed {
+			continue
+		}
+		if i.Secrets == nil {
+			return host, fmt.Errorf("host %s: %w: %s is a secret field", host.Name, ErrNoSecretKey, field)
+		}
+		sealed, err := i.Secrets.Seal(host.Name, field, value)
+		if err != nil {
+			return host, fmt.Errorf("host %s: %w", host.Name, err)
+		}
+		if !copied {
+			host.Data = maps.Clone(host.Data)
+			copied = true
+		}
+		host.Data[field] = sealed
+	}
+	return host, nil
+}
+
+// openSecrets decrypts the sealed values of host in place. Values Secrets
+// cannot open, or all of them without Secrets, stay sealed.
+func (i *Inventory) openSecrets(host Host) {
+	if i.Secrets == nil {
+		return
+	}
+	for field, value := range host.Data {
+		if _, sealed := sealedValue(value); !sealed {
+			continue
+		}
+		if opened, err := i.Secrets.Open(host.Name, field, value); err == nil {
+			host.Data[field] = opened
+		}
+	}
+}
+
+// SealSecrets is a HostTransform that seals the SecretFields, for output
+// meant to be imported again, such as exports.
+func (i *Inventory) SealSecrets(hosts []Host) ([]Host, error) {
+	sealed := make([]Host, len(hosts))
+	for n, host := range hosts {
+		var err error
+		if sealed[n], err = i.sealSecrets(host); err != nil {
+			return nil, err
+		}
+	}
+	return sealed, nil
+}
+
+// IsSecret reports whether value of field is a secret: the field is one
+// of the SecretFields, or the value is still sealed.
+func (i *Inventory) IsSecret(field string, value interface{}) bool {
+	_, sealed := sealedValue(value)
+	return sealed || i.SecretFields[field]
+}
+
+// MaskSecrets is a HostTransform that masks every secret (see IsSecret)
+// as RedactFields does.
+func (i *Inventory) MaskSecrets(hosts []Host) ([]Host, error) {
+	hosts = copyHosts(hosts)
+	for _, host := range hosts {
+		for field, value := range host.Data {
+			if i.IsSecret(field, value) {
+				host.Data[field] = redactedPlaceholder
+			}
+		}
+	}
+	return hosts, nil
+}
@@ -0,0 +1,253 @@
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// SSHOptions name the fields the ssh_config options of a host are read
+// from. A host lacking one of the fields takes it from the Vars of the
+// first of its groups that has it, rendered as a text/template over the
+// host as for ComputeField, so a group can set a default such as
+// "bastion.{{.Data.site}}.example.com" for its members.
+type SSHOptions struct {
+	// HostNameField holds the address or name ssh connects to; without
+	// it, ssh resolves the host name itself.
+	HostNameField string
+	UserField     string
+	PortField     string
+	// JumpField holds the ProxyJump hosts, one or a list.
+	JumpField string
+	// HostKeyField lists the host's public keys as "type base64", for
+	// known_hosts. It is only read from the host.
+	HostKeyField string
+}
+
+// SSHHost is the ssh_config Host block of a host, named by the host name.
+type SSHHost struct {
+	Host      string
+	HostName  string
+	User      string
+	Port      int // 0 for ssh's default
+	ProxyJump string
+	HostKeys  []string
+	// Comment, if set, is written above the block.
+	Comment string
+}
+
+// defaultSSHPort is the port ssh connects to without a Port.
+const defaultSSHPort = 22
+
+// SSHHosts returns the Host blocks of the hosts along with the problems
+// found per host: names and values ssh_config cannot hold, invalid ports
+// and host keys, and group templates that fail. Hosts whose name is
+// unusable are left out; other problems only leave out the option.
+func SSHHosts(hosts []Host, groups []Group, opts SSHOptions) ([]SSHHost, map[string][]error) {
+	problems := make(map[string][]error)
+	report := func(host string, err error) {
+		problems[host] = append(problems[host], err)
+	}
+	memberOf := make(map[string][]Group)
+	for _, group := range groups {
+		for _, name := range group.Hosts {
+			memberOf[name] = append(memberOf[name], group)
+		}
+	}
+	templates := make(map[string]*template.Template)
+	value := func(host Host, field string) (string, error) {
+		if field == "" {
+			return "", nil
+		}
+		if v, ok := host.Data[field]; ok {
+			if _, list := v.([]interface{}); list {
+				return strings.Join(listField(host, field), ","), nil
+			}
+			return FormatValue(v), nil
+		}
+		for _, group := range memberOf[host.Name] {
+			text, ok := group.Vars[field]
+			if !ok {
+				continue
+			}
+			key := group.Name + "\x00" + field
+			tmpl, ok := templates[key]
+			if !ok {
+				var err error
+				tmpl, err = template.New(field).Option("missingkey=zero").Funcs(templateFuncs).Parse(FormatValue(text))
+				if err != nil {
+					return "", fmt.Errorf("group %s: %s: %w", group.Name, field, err)
+				}
+				templates[key] = tmpl
+			}
+			var b strings.Builder
+			if err := tmpl.Execute(&b, host); err != nil {
+				return "", fmt.Errorf("group %s: %s: %w", group.Name, field, err)
+			}
+			return b.String(), nil
+		}
+		return "", nil
+	}
+	option := func(host Host, field string) string {
+		v, err := value(host, field)
+		if err == nil {
+			err = checkSSHValue(field, v)
+		}
+		if err != nil {
+			report(host.Name, err)
+			return ""
+		}
+		return v
+	}
+
+	entries := make([]SSHHost, 0, len(hosts))
+	for _, host := range hosts {
+		if err := checkSSHValue("name", host.Name); err != nil || strings.ContainsAny(host.Name, "*?!,") {
+			report(host.Name, fmt.Errorf("name %q cannot be an ssh_config Host", host.Name))
+			continue
+		}
+		entry := SSHHost{
+			Host:      host.Name,
+			HostName:  option(host, opts.HostNameField),
+			User:      option(host, opts.UserField),
+			ProxyJump: option(host, opts.JumpField),
+		}
+		if port := option(host, opts.PortField); port != "" {
+			n, err := strconv.Atoi(port)
+			if err != nil || n < 1 || n > 65535 {
+				report(host.Name, fmt.Errorf("%s %q is not a port", opts.PortField, port))
+			} else {
+				entry.Port = n
+			}
+		}
+		if opts.HostKeyField != "" {
+			for _, key := range listField(host, opts.HostKeyField) {
+				if len(strings.Fields(key)) < 2 {
+					report(host.Name, fmt.Errorf("%s %q is not a public key of the form \"type base64\"", opts.HostKeyField, key))
+					continue
+				}
+				entry.HostKeys = append(entry.HostKeys, strings.Join(strings.Fields(key), " "))
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, problems
+}
+
+// checkSSHValue checks that value can be written unquoted in ssh_config.
+func checkSSHValue(field, value string) error {
+	if i := strings.IndexFunc(value, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) || r == '"' || r == '#' }); i >= 0 {
+		return fmt.Errorf("%s %q contains %q", field, value, value[i:i+1])
+	}
+	return nil
+}
+
+// WriteSSHConfig writes the entries as ssh_config Host blocks, separated
+// by blank lines, leaving out the options they do not set.
+func WriteSSHConfig(w io.Writer, entries []SSHHost) error {
+	var b bytes.Buffer
+	for n, entry := range entries {
+		if n > 0 {
+			b.WriteString("\n")
+		}
+		if entry.Comment != "" {
+			fmt.Fprintf(&b, "# %s\n", entry.Comment)
+		}
+		fmt.Fprintf(&b, "Host %s\n", entry.Host)
+		if entry.HostName != "" {
+			fmt.Fprintf(&b, "    HostName %s\n", entry.HostName)
+		}
+		if entry.User != "" {
+			fmt.Fprintf(&b, "    User %s\n", entry.User)
+		}
+		if entry.Port != 0 {
+			fmt.Fprintf(&b, "    Port %d\n", entry.Port)
+		}
+		if entry.ProxyJump != "" {
+			fmt.Fprintf(&b, "    ProxyJump %s\n", entry.ProxyJump)
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// WriteKnownHosts writes a known_hosts line per host key of the entries,
+// naming the host by its name and its HostName, bracketed with the port
+// when it is not 22.
+func WriteKnownHosts(w io.Writer, entries []SSHHost) error {
+	var b bytes.Buffer
+	for _, entry := range entries {
+		if len(entry.HostKeys) == 0 {
+			continue
+		}
+		names := []string{entry.Host}
+		if entry.HostName != "" && entry.HostName != entry.Host {
+			names = append(names, entry.HostName)
+		}
+		if entry.Port != 0 && entry.Port != defaultSSHPort {
+			for n, name := range names {
+				names[n] = fmt.Sprintf("[%s]:%d", name, entry.Port)
+			}
+		}
+		for _, key := range entry.HostKeys {
+			fmt.Fprintf(&b, "%s %s\n", strings.Join(names, ","), key)
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// ProbeSSH checks that the ssh port of every entry accepts TCP
+// connections, making up to workers connections at a time, each given
+// timeout, and returns the error of each host that did not. Hosts reached
+// through a ProxyJump are not probed, as they usually cannot be reached
+// directly.
+func ProbeSSH(ctx context.Context, entries []SSHHost, timeout time.Duration, workers int) map[string]error {
+	if workers < 1 {
+		workers = 1
+	}
+	var mu sync.Mutex
+	unreachable := make(map[string]error)
+	jobs := make(chan SSHHost)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dialer := net.Dialer{Timeout: timeout}
+			for entry := range jobs {
+				address, port := entry.HostName, entry.Port
+				if address == "" {
+					address = entry.Host
+				}
+				if port == 0 {
+					port = defaultSSHPort
+				}
+				conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+				if err != nil {
+					mu.Lock()
+					unreachable[entry.Host] = err
+					mu.Unlock()
+					continue
+				}
+				conn.Close()
+			}
+		}()
+	}
+	for _, entry := range entries {
+		if entry.ProxyJump == "" {
+			jobs <- entry
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return unreachable
+}
@@ -0,0 +1,226 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// SyncProvider is an outside source of hosts, such as the instances of a
+// cloud provider, that SyncHosts reconciles into the inventory.
+type SyncProvider interface {
+	// Source names what the provider discovers, e.g. "aws/us-east-1". It
+	// is stored in the SyncSourceField of the hosts synced, and only hosts
+	// of the same source are pruned, so it should include any filter
+	// narrowing the discovery.
+	Source() string
+	// Discover returns the hosts there are now. A field set to nil is
+	// removed from the stored host, for values that come and go.
+	Discover(ctx context.Context) ([]Host, error)
+}
+
+const (
+	// SyncSourceField holds the Source of the provider a host was synced
+	// from.
+	SyncSourceField = "sync_source"
+	// SyncMissingField holds when a sync with PruneMark first found a host
+	// gone from its provider; a sync that finds it again removes it.
+	SyncMissingField = "sync_missing"
+)
+
+// What SyncHosts does with hosts gone from their provider.
+const (
+	PruneNone   = "none"
+	PruneMark   = "mark"
+	PruneRemove = "remove"
+)
+
+// PruneModes are the values of SyncOptions.Prune.
+var PruneModes = []string{PruneNone, PruneMark, PruneRemove}
+
+// SyncOptions control SyncHosts. Prune is PruneNone (the default) to
+// only report the hosts gone from the provider, PruneMark to set their
+// SyncMissingField, or PruneRemove to remove them. DryRun reports what
+// would be done without writing.
+type SyncOptions struct {
+	Prune  string
+	DryRun bool
+}
+
+// SyncResult names the hosts a sync created, updated and found
+// unchanged, and those gone from the provider, which were pruned as
+// SyncOptions.Prune says.
+type SyncResult struct {
+	Created   []string
+	Updated   []string
+	Unchanged []string
+	Missing   []string
+}
+
+// SyncHosts reconciles the hosts of provider into the inventory: hosts it
+// discovers are created, or have the fields it gives updated, keeping any
+// others; a host of the same name created by hand is taken over. Hosts
+// synced from the same Source before but not discovered now are pruned as
+// opts.Prune says. Every write is guarded by the revision the host was
+// listed at, so a host changed meanwhile fails with ErrHostChanged instead
+// of being overwritten; the errors of the hosts that failed are joined in
+// err, while the others are written.
+func (i *Inventory) SyncHosts(ctx context.Context, provider SyncProvider, opts SyncOptions) (SyncResult, error) {
+	var result SyncResult
+	if opts.Prune == "" {
+		opts.Prune = PruneNone
+	}
+	if !slices.Contains(PruneModes, opts.Prune) {
+		return result, UnknownChoiceError("prune mode", opts.Prune, PruneModes)
+	}
+	discovered, err := provider.Discover(ctx)
+	if err != nil {
+		return result, fmt.Errorf("discovering hosts from %s: %w", provider.Source(), err)
+	}
+	source := provider.Source()
+	stored, revisions, err := i.ListHostsWithRevisions(ListOptions{})
+	if err != nil {
+		return result, err
+	}
+	existing := make(map[string]Host, len(stored))
+	for _, host := range stored {
+		existing[host.Name] = host
+	}
+	var errs []error
+	seen := make(map[string]bool, len(discovered))
+	for _, host := range discovered {
+		if seen[host.Name] {
+			errs = append(errs, fmt.Errorf("host %s: discovered more than once", host.Name))
+			continue
+		}
+		seen[host.Name] = true
+		current, ok := existing[host.Name]
+		data := make(map[string]interface{}, len(current.Data)+len(host.Data)+1)
+		for field, value := range current.Data {
+			data[field] = value
+		}
+		for field, value := range host.Data {
+			if value == nil {
+				delete(data, field)
+			} else {
+				data[field] = value
+			}
+		}
+		delete(data, SyncMissingField)
+		data[SyncSourceField] = source
+		var err error
+		switch {
+		case !ok:
+			if !opts.DryRun {
+				err = i.Create(Host{Name: host.Name, Data: data})
+			}
+			if err == nil {
+				result.Created = append(result.Created, host.Name)
+			}
+		case reflect.DeepEqual(data, current.Data):
+			result.Unchanged = append(result.Unchanged, host.Name)
+			continue
+		default:
+			if !opts.DryRun {
+				err = i.UpdateHostIfRevision(host.Name, data, revisions[host.Name])
+			}
+			if err == nil {
+				result.Updated = append(result.Updated, host.Name)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("host %s: %w", host.Name, err))
+		}
+	}
+	for _, host := range stored {
+		if seen[host.Name] || host.Data[SyncSourceField] != source {
+			continue
+		}
+		result.Missing = append(result.Missing, host.Name)
+		if opts.DryRun {
+			continue
+		}
+		var err error
+		switch _, marked := host.Data[SyncMissingField]; {
+		case opts.Prune == PruneRemove:
+			_, err = i.DeleteHost(host.Name, revisions[host.Name], false)
+		case opts.Prune == PruneMark && !marked:
+			data := make(map[string]interface{}, len(host.Data)+1)
+			for field, value := range host.Data {
+				data[field] = value
+			}
+			data[SyncMissingField] = time.Now().UTC().Format(time.RFC3339)
+			err = i.UpdateHostIfRevision(host.Name, data, revisions[host.Name])
+		default:
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("host %s: %w", host.Name, err))
+		}
+	}
+	return result, errors.Join(errs...)
+}
+
+// SyncWatcher is a SyncProvider that can tell when what it discovers
+// has changed, so WatchSync need not poll it.
+type SyncWatcher interface {
+	SyncProvider
+	// Watch calls changed whenever the hosts Discover returns may have
+	// changed, until ctx is done or watching fails.
+	Watch(ctx context.Context, changed func()) error
+}
+
+// syncSettle is how long WatchSync waits after a change for others to
+// follow, so a burst of changes costs one sync.
+const syncSettle = 2 * time.Second
+
+// WatchSync keeps the hosts of provider in sync until ctx is done: it runs
+// SyncHosts once, then again after the provider reports changes and every
+// resync interval (if positive) to catch up on anything a watch missed.
+// report is called with the result of every sync; a failed sync is retried
+// on the next change or resync rather than ending the loop. It returns
+// the error that stopped the provider's Watch, or ctx.Err().
+func (i *Inventory) WatchSync(ctx context.Context, provider SyncWatcher, opts SyncOptions, resync time.Duration, report func(SyncResult, error)) error {
+	changes := make(chan struct{}, 1)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- provider.Watch(ctx, func() {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		})
+	}()
+	var tick <-chan time.Time
+	if resync > 0 {
+		ticker := time.NewTicker(resync)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		report(i.SyncHosts(ctx, provider, opts))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-watchErr:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		case <-tick:
+		case <-changes:
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(syncSettle):
+			}
+			select {
+			case <-changes:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+locals {
+  hosts = {
+    "bare" = {}
+    "db01" = {
+      "empty" = []
+      "key" = {
+        "$binary" = "3q0="
+      }
+      "none" = {}
+    }
+    "web01" = {
+      "active" = true
+      "cores" = 8
+      "labels" = {
+        "cost center" = "42"
+        "team" = "core"
+      }
+      "load" = 0.25
+      "motd" = "Welcome to $${host} at 100%%{x}\n"
+      "ports" = [
+        80,
+        443,
+      ]
+      "retired" = null
+      "site" = "ams"
+      "weight" = 3
+    }
+  }
+}
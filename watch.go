@@ -0,0 +1,309 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oferchen/inventory/internal/logging"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// HostEvent is a change to a host reported by WatchHosts.
+type HostEvent struct {
+	Type mvccpb.Event_EventType
+	Name string
+	// Host is the new value; it is empty for deletes.
+	Host Host
+	// Before is the value the change replaced, only set by
+	// WatchHostChanges, and nil for creates and Resync events.
+	Before   *Host
+	Revision int64
+	// Resync marks the synthetic events WatchHosts emits to catch up after
+	// etcd compacted the revisions it was watching.
+	Resync bool
+	// value is the stored value of Host, with its secrets sealed.
+	value []byte
+}
+
+// WatchHosts calls fn for every change to a host after revision rev (0 for
+// changes from now on) until ctx is done or fn returns an error.
+//
+// If etcd compacts past the watch's revision, the missed changes are gone,
+// so WatchHosts re-lists all hosts at the latest revision, emits a Resync
+// PUT for each and a Resync DELETE for each host it reported earlier that no
+// longer exists, and resumes watching from that revision. A watch that ends
+// for any other reason is resumed where it left off.
+func (i *Inventory) WatchHosts(ctx context.Context, rev int64, fn func(HostEvent) error) error {
+	return i.watchHosts(ctx, rev, make(map[string]bool), false, fn)
+}
+
+// WatchHostChanges is WatchHosts with the Before of every event set, for
+// consumers that need the whole change. etcd then sends each change with
+// the value it replaced, doubling the watch's traffic.
+func (i *Inventory) WatchHostChanges(ctx context.Context, rev int64, fn func(HostEvent) error) error {
+	return i.watchHosts(ctx, rev, make(map[string]bool), true, fn)
+}
+
+// watchHosts is WatchHosts for a caller that already knows the hosts in
+// known to exist, so a resync also reports their deletion. With prev, the
+// events carry their Before.
+func (i *Inventory) watchHosts(ctx context.Context, rev int64, known map[string]bool, prev bool, fn func(HostEvent) error) error {
+	for reauths := 0; ; {
+		generation, from := i.reauth.generation(), rev
+		compacted, err := i.watchHostsFrom(ctx, &rev, known, prev, fn)
+		if rev > from {
+			reauths = 0
+		}
+		if i.reauth != nil && isUnauthenticated(err) && reauths < maxReauths {
+			reauths++
+			if err := i.reauth.renew(generation); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !compacted {
+			// Back off so a watcher that keeps closing (e.g. on a closed
+			// client) does not spin.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retryBackoff):
+			}
+			continue
+		}
+		i.debugf("watch revision %d was compacted, resyncing", rev)
+		if rev, err = i.resyncHosts(known, fn); err != nil {
+			return fmt.Errorf("resync after compaction: %w", err)
+		}
+	}
+}
+
+// watchHostsFrom runs one etcd watch starting at *rev, advancing *rev past
+// every revision it has delivered. It reports whether the watch ended
+// because *rev was compacted.
+func (i *Inventory) watchHostsFrom(ctx context.Context, rev *int64, known map[string]bool, prev bool, fn func(HostEvent) error) (compacted bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	opts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if *rev > 0 {
+		opts = append(opts, clientv3.WithRev(*rev))
+	}
+	if prev {
+		opts = append(opts, clientv3.WithPrevKV())
+	}
+	for resp := range i.watcher.Watch(ctx, baseKey, opts...) {
+		if resp.CompactRevision != 0 || errors.Is(resp.Err(), rpctypes.ErrCompacted) {
+			return true, nil
+		}
+		if err := resp.Err(); err != nil {
+			return false, err
+		}
+		for _, ev := range resp.Events {
+			event := HostEvent{Type: ev.Type, Name: i.hostNameFromKey(string(ev.Kv.Key)), Revision: ev.Kv.ModRevision, value: ev.Kv.Value}
+			if ev.Type == mvccpb.PUT {
+				host, err := i.unmarshalHost(ev.Kv.Value)
+				if err != nil {
+					WarnMalformed([]error{&MalformedHostError{Key: string(ev.Kv.Key), Err: err}})
+					continue
+				}
+				event.Host = host
+			}
+			if ev.PrevKv != nil {
+				// A malformed previous value is left out.
+				if before, err := i.unmarshalHost(ev.PrevKv.Value); err == nil {
+					event.Before = &before
+				}
+			}
+			if ev.Type == mvccpb.PUT {
+				known[event.Name] = true
+			} else {
+				delete(known, event.Name)
+			}
+			if err := fn(event); err != nil {
+				return false, err
+			}
+		}
+		if resp.Header.Revision >= *rev {
+			*rev = resp.Header.Revision + 1
+		}
+	}
+	return false, nil
+}
+
+// resyncHosts emits Resync events reconciling known with the current hosts
+// and returns the revision to resume watching from.
+func (i *Inventory) resyncHosts(known map[string]bool, fn func(HostEvent) error) (int64, error) {
+	list, err := i.listHosts(baseKey, false)
+	if err != nil {
+		return 0, err
+	}
+	WarnMalformed(list.malformed)
+	revision := list.resp.Header.Revision
+	present := make(map[string]bool, len(list.hosts))
+	for n, host := range list.hosts {
+		name := i.hostNameFromKey(string(list.kvs[n].Key))
+		present[name] = true
+		known[name] = true
+		if err := fn(HostEvent{Type: mvccpb.PUT, Name: name, Host: host, Revision: revision, Resync: true, value: list.kvs[n].Value}); err != nil {
+			return 0, err
+		}
+	}
+	for name := range known {
+		if present[name] {
+			continue
+		}
+		delete(known, name)
+		if err := fn(HostEvent{Type: mvccpb.DELETE, Name: name, Revision: revision, Resync: true}); err != nil {
+			return 0, err
+		}
+	}
+	return revision + 1, nil
+}
+
+// HostSnapshot is an in-memory copy of every host, kept current by a
+// background watch, for servers answering many reads; see Snapshot. Its
+// reads are eventually consistent: a change shows up once the watch
+// delivers it. The hosts it returns are shared and must not be modified.
+type HostSnapshot struct {
+	inv *Inventory
+	mu  sync.RWMutex
+	// keys are the keys of the hosts, sorted as etcd lists them.
+	keys     []string
+	hosts    map[string]Host
+	revision int64
+	updated  time.Time
+	// stale is set once the watch has stopped following the store.
+	stale bool
+}
+
+// ErrSnapshotStale is returned by the HostSnapshot reads once its watch has
+// stopped, so callers can read from etcd instead.
+var ErrSnapshotStale = errors.New("host snapshot is stale")
+
+// Snapshot lists every host and keeps the returned snapshot current with a
+// watch from that listing's revision until ctx is done. If the watch fails
+// for good, the snapshot turns stale.
+func (i *Inventory) Snapshot(ctx context.Context) (*HostSnapshot, error) {
+	list, err := i.listHosts(baseKey, false)
+	if err != nil {
+		return nil, err
+	}
+	WarnMalformed(list.malformed)
+	s := &HostSnapshot{inv: i, hosts: make(map[string]Host, len(list.hosts)), revision: list.resp.Header.Revision, updated: time.Now()}
+	known := make(map[string]bool, len(list.hosts))
+	for n, host := range list.hosts {
+		key := string(list.kvs[n].Key)
+		s.keys = append(s.keys, key)
+		s.hosts[key] = host
+		known[i.hostNameFromKey(key)] = true
+	}
+	go func() {
+		err := i.watchHosts(ctx, s.revision+1, known, false, s.apply)
+		if ctx.Err() != nil {
+			return
+		}
+		logging.Warnf("host snapshot watch stopped, reads now go to etcd: %v", err)
+		s.mu.Lock()
+		s.stale = true
+		s.mu.Unlock()
+	}()
+	return s, nil
+}
+
+func (s *HostSnapshot) apply(event HostEvent) error {
+	key := s.inv.hostKey(event.Name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := sort.SearchStrings(s.keys, key)
+	found := n < len(s.keys) && s.keys[n] == key
+	switch {
+	case event.Type == mvccpb.DELETE && found:
+		s.keys = append(s.keys[:n], s.keys[n+1:]...)
+		delete(s.hosts, key)
+	case event.Type == mvccpb.PUT:
+		if !found {
+			s.keys = append(s.keys, "")
+			copy(s.keys[n+1:], s.keys[n:])
+			s.keys[n] = key
+		}
+		s.hosts[key] = event.Host
+	}
+	s.revision = event.Revision
+	s.updated = time.Now()
+	return nil
+}
+
+// Get returns the named host like Inventory.GetHost.
+func (s *HostSnapshot) Get(hostName string) (Host, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stale {
+		return Host{}, ErrSnapshotStale
+	}
+	host, ok := s.hosts[s.inv.hostKey(hostName)]
+	if !ok {
+		return Host{}, fmt.Errorf("%w: %s", ErrHostNotFound, hostName)
+	}
+	return host, nil
+}
+
+// List lists hosts like Inventory.ListHostsWithOptions, with the revision
+// the snapshot is current to. SinceRevision, RecentFirst, WithTTL and
+// WithKey need what etcd keeps beside the values, and Group and GroupVars
+// the groups it does not hold, so they are not supported.
+func (s *HostSnapshot) List(opts ListOptions) (ListResult, error) {
+	if !s.lists(opts) {
+		return ListResult{}, errors.New("host snapshot cannot list by revision or group, or with TTLs, keys or group variables")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stale {
+		return ListResult{}, ErrSnapshotStale
+	}
+	start := s.inv.hostKey(opts.NamePrefix)
+	from := start
+	if opts.After != "" {
+		if after := s.inv.hostKey(opts.After) + "\x00"; after > start {
+			from = after
+		}
+	}
+	var hosts []Host
+	for _, key := range s.keys[sort.SearchStrings(s.keys, from):] {
+		if !strings.HasPrefix(key, start) {
+			break
+		}
+		host := s.hosts[key]
+		if opts.Filter.Match(host) && (opts.Where == nil || opts.Where.Match(host.Name, host.Data)) && (len(opts.Statuses) == 0 || slices.Contains(opts.Statuses, host.Status())) {
+			hosts = append(hosts, host)
+		}
+	}
+	hosts, truncated := paginate(hosts, opts.Offset, opts.Limit)
+	return ListResult{Hosts: hosts, Truncated: truncated, Revision: s.revision}, nil
+}
+
+// lists reports whether List supports opts.
+func (s *HostSnapshot) lists(opts ListOptions) bool {
+	return opts.SinceRevision == 0 && !opts.RecentFirst && !opts.WithTTL && !opts.WithKey && opts.Group == "" && !opts.GroupVars
+}
+
+// Age returns how long ago the snapshot was listed or last changed by its
+// watch.
+func (s *HostSnapshot) Age() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return time.Since(s.updated)
+}